@@ -3,6 +3,7 @@ package client
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,7 +25,8 @@ const (
 )
 
 const (
-	maxResponseBytes = 4096
+	maxResponseBytes  = 4096
+	retryAfterDefault = time.Second // Used if a rate limited response has no (valid) Retry-After header
 )
 
 var (
@@ -60,12 +63,13 @@ type Message struct { // TODO combine with server.message
 
 // Attachment represents a message attachment
 type Attachment struct {
-	Name    string `json:"name"`
-	Type    string `json:"type,omitempty"`
-	Size    int64  `json:"size,omitempty"`
-	Expires int64  `json:"expires,omitempty"`
-	URL     string `json:"url"`
-	Owner   string `json:"-"` // IP address of uploader, used for rate limiting
+	Name       string `json:"name"`
+	Type       string `json:"type,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Expires    int64  `json:"expires,omitempty"`
+	URL        string `json:"url"`
+	Encryption string `json:"encryption,omitempty"` // "client" if the file must be decrypted by the client
+	Owner      string `json:"-"`                    // IP address of uploader, used for rate limiting
 }
 
 type subscription struct {
@@ -102,33 +106,59 @@ func (c *Client) PublishReader(topic string, body io.Reader, options ...PublishO
 	if err != nil {
 		return nil, err
 	}
+	if c.config.PublishRetries > 0 {
+		if body, err = toReadSeeker(body); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	for retry := 0; ; retry++ {
+		m, retryAfter, err := c.publish(topicURL, body, options...)
+		if err == nil || retryAfter < 0 || retry >= c.config.PublishRetries {
+			return m, err
+		} else if c.config.PublishRetryTimeout > 0 && time.Since(start)+retryAfter > c.config.PublishRetryTimeout {
+			return nil, err
+		}
+		log.Debug("%s Rate limited, retrying in %s (retry %d/%d)", util.ShortTopicURL(topicURL), retryAfter, retry+1, c.config.PublishRetries)
+		time.Sleep(retryAfter)
+		if _, err := body.(io.Seeker).Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// publish sends a single publish request. If the request was rate limited (HTTP 429), it returns the time
+// to wait before retrying, as per the Retry-After header. Otherwise, the returned duration is negative.
+func (c *Client) publish(topicURL string, body io.Reader, options ...PublishOption) (*Message, time.Duration, error) {
 	req, err := http.NewRequest("POST", topicURL, body)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 	for _, option := range options {
 		if err := option(req); err != nil {
-			return nil, err
+			return nil, -1, err
 		}
 	}
 	log.Debug("%s Publishing message with headers %s", util.ShortTopicURL(topicURL), req.Header)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 	defer resp.Body.Close()
 	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(strings.TrimSpace(string(b)))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")), errors.New(strings.TrimSpace(string(b)))
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, -1, errors.New(strings.TrimSpace(string(b)))
 	}
 	m, err := toMessage(string(b), topicURL, "")
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
-	return m, nil
+	return m, -1, nil
 }
 
 // Poll queries a topic for all (or a limited set) of messages. Unlike Subscribe, this method only polls for
@@ -290,3 +320,29 @@ func toMessage(s, topicURL, subscriptionID string) (*Message, error) {
 	m.Raw = s
 	return m, nil
 }
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil && t.After(time.Now()) {
+		return time.Until(t)
+	} else if err == nil {
+		return 0
+	}
+	return retryAfterDefault
+}
+
+// toReadSeeker returns the reader itself if it can be rewound, or reads it into memory if it cannot (e.g. stdin)
+func toReadSeeker(r io.Reader) (io.ReadSeeker, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if _, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			return rs, nil
+		}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
@@ -6,7 +6,12 @@ import (
 	"heckel.io/ntfy/v2/client"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -101,6 +106,32 @@ func TestClient_Publish_Poll(t *testing.T) {
 	require.Equal(t, "some delayed message", messages[1].Message)
 }
 
+func TestClient_Publish_Retries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, "some message", string(body))
+		if requests.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":42901,"http":429,"error":"limit reached: too many requests"}`))
+			return
+		}
+		w.Write([]byte(`{"id":"RXIQBFaieLVr","time":124,"event":"message","topic":"mytopic","message":"some message"}`))
+	}))
+	defer server.Close()
+
+	conf := client.NewConfig()
+	conf.DefaultHost = server.URL
+	conf.PublishRetries = 2
+	c := client.New(conf)
+	msg, err := c.PublishReader("mytopic", io.NopCloser(strings.NewReader("some message"))) // Not seekable
+	require.Nil(t, err)
+	require.Equal(t, "some message", msg.Message)
+	require.Equal(t, int32(3), requests.Load())
+}
+
 func newTestConfig(port int) *client.Config {
 	c := client.NewConfig()
 	c.DefaultHost = fmt.Sprintf("http://127.0.0.1:%d", port)
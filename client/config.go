@@ -4,6 +4,7 @@ import (
 	"gopkg.in/yaml.v2"
 	"heckel.io/ntfy/v2/log"
 	"os"
+	"time"
 )
 
 const (
@@ -13,12 +14,14 @@ const (
 
 // Config is the config struct for a Client
 type Config struct {
-	DefaultHost     string      `yaml:"default-host"`
-	DefaultUser     string      `yaml:"default-user"`
-	DefaultPassword *string     `yaml:"default-password"`
-	DefaultToken    string      `yaml:"default-token"`
-	DefaultCommand  string      `yaml:"default-command"`
-	Subscribe       []Subscribe `yaml:"subscribe"`
+	DefaultHost         string        `yaml:"default-host"`
+	DefaultUser         string        `yaml:"default-user"`
+	DefaultPassword     *string       `yaml:"default-password"`
+	DefaultToken        string        `yaml:"default-token"`
+	DefaultCommand      string        `yaml:"default-command"`
+	PublishRetries      int           `yaml:"publish-retries"`       // Number of retries if rate limited (HTTP 429), see PublishReader
+	PublishRetryTimeout time.Duration `yaml:"publish-retry-timeout"` // Max total time spent retrying, zero means no limit
+	Subscribe           []Subscribe   `yaml:"subscribe"`
 }
 
 // Subscribe is the struct for a Subscription within Config
@@ -34,12 +37,14 @@ type Subscribe struct {
 // NewConfig creates a new Config struct for a Client
 func NewConfig() *Config {
 	return &Config{
-		DefaultHost:     DefaultBaseURL,
-		DefaultUser:     "",
-		DefaultPassword: nil,
-		DefaultToken:    "",
-		DefaultCommand:  "",
-		Subscribe:       nil,
+		DefaultHost:         DefaultBaseURL,
+		DefaultUser:         "",
+		DefaultPassword:     nil,
+		DefaultToken:        "",
+		DefaultCommand:      "",
+		PublishRetries:      0,
+		PublishRetryTimeout: 0,
+		Subscribe:           nil,
 	}
 }
 
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestConfig_Load(t *testing.T) {
@@ -15,6 +16,8 @@ default-host: http://localhost
 default-user: philipp
 default-password: mypass
 default-command: 'echo "Got the message: $message"'
+publish-retries: 3
+publish-retry-timeout: 2m
 subscribe:
   - topic: no-command-with-auth
     user: phil
@@ -34,6 +37,8 @@ subscribe:
 	require.Equal(t, "philipp", conf.DefaultUser)
 	require.Equal(t, "mypass", *conf.DefaultPassword)
 	require.Equal(t, `echo "Got the message: $message"`, conf.DefaultCommand)
+	require.Equal(t, 3, conf.PublishRetries)
+	require.Equal(t, 2*time.Minute, conf.PublishRetryTimeout)
 	require.Equal(t, 4, len(conf.Subscribe))
 	require.Equal(t, "no-command-with-auth", conf.Subscribe[0].Topic)
 	require.Equal(t, "", conf.Subscribe[0].Command)
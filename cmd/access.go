@@ -194,6 +194,9 @@ func showUsers(c *cli.Context, manager *user.Manager, users []*user.User) error
 			tier = u.Tier.Name
 		}
 		fmt.Fprintf(c.App.ErrWriter, "user %s (role: %s, tier: %s)\n", u.Name, u.Role, tier)
+		if u.LimitOverrides != nil {
+			fmt.Fprintf(c.App.ErrWriter, "- limit overrides: %d requests/minute, %d messages/day, %s message size (0 = not overridden)\n", u.LimitOverrides.RequestLimit, u.LimitOverrides.MessageLimit, util.FormatSize(u.LimitOverrides.MessageSizeLimit))
+		}
 		if u.Role == user.RoleAdmin {
 			fmt.Fprintf(c.App.ErrWriter, "- read-write access to all topics (admin role)\n")
 		} else if len(grants) > 0 {
@@ -19,6 +19,15 @@ func init() {
 	commands = append(commands, cmdPublish)
 }
 
+// Canned values for "ntfy publish --test", see execPublish
+const (
+	publishTestTitle    = "Test notification"
+	publishTestMessage  = "If you can see this, publishing to this topic works. Nice!"
+	publishTestTags     = "white_check_mark"
+	publishTestPriority = "3"
+	publishTestActions  = "view, Open docs, https://ntfy.sh/docs/"
+)
+
 var flagsPublish = append(
 	append([]cli.Flag{}, flagsDefault...),
 	&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"NTFY_CONFIG"}, Usage: "client config file"},
@@ -31,6 +40,7 @@ var flagsPublish = append(
 	&cli.StringFlag{Name: "icon", Aliases: []string{"i"}, EnvVars: []string{"NTFY_ICON"}, Usage: "URL to use as notification icon"},
 	&cli.StringFlag{Name: "actions", Aliases: []string{"A"}, EnvVars: []string{"NTFY_ACTIONS"}, Usage: "actions JSON array or simple definition"},
 	&cli.StringFlag{Name: "attach", Aliases: []string{"a"}, EnvVars: []string{"NTFY_ATTACH"}, Usage: "URL to send as an external attachment"},
+	&cli.BoolFlag{Name: "strip-ansi", Aliases: []string{"strip_ansi"}, EnvVars: []string{"NTFY_STRIP_ANSI"}, Usage: "remove ANSI escape codes (e.g. terminal colors) from the message"},
 	&cli.BoolFlag{Name: "markdown", Aliases: []string{"md"}, EnvVars: []string{"NTFY_MARKDOWN"}, Usage: "Message is formatted as Markdown"},
 	&cli.StringFlag{Name: "filename", Aliases: []string{"name", "n"}, EnvVars: []string{"NTFY_FILENAME"}, Usage: "filename for the attachment"},
 	&cli.StringFlag{Name: "file", Aliases: []string{"f"}, EnvVars: []string{"NTFY_FILE"}, Usage: "file to upload as an attachment"},
@@ -41,6 +51,9 @@ var flagsPublish = append(
 	&cli.BoolFlag{Name: "wait-cmd", Aliases: []string{"wait_cmd", "cmd", "done"}, EnvVars: []string{"NTFY_WAIT_CMD"}, Usage: "run command and wait until it finishes before publishing"},
 	&cli.BoolFlag{Name: "no-cache", Aliases: []string{"no_cache", "C"}, EnvVars: []string{"NTFY_NO_CACHE"}, Usage: "do not cache message server-side"},
 	&cli.BoolFlag{Name: "no-firebase", Aliases: []string{"no_firebase", "F"}, EnvVars: []string{"NTFY_NO_FIREBASE"}, Usage: "do not forward message to Firebase"},
+	&cli.IntFlag{Name: "retries", Aliases: []string{"r"}, EnvVars: []string{"NTFY_RETRIES"}, Usage: "retry this many times if rate limited, honoring Retry-After"},
+	&cli.StringFlag{Name: "retry-timeout", Aliases: []string{"retry_timeout"}, EnvVars: []string{"NTFY_RETRY_TIMEOUT"}, Usage: "max total time to spend retrying if rate limited (e.g. 1m)"},
+	&cli.BoolFlag{Name: "test", EnvVars: []string{"NTFY_TEST"}, Usage: "send a test notification with a title, tag, priority and action to verify your setup"},
 	&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, EnvVars: []string{"NTFY_QUIET"}, Usage: "do not print message"},
 )
 
@@ -72,6 +85,9 @@ Examples:
   ntfy pub -u phil:mypass secret Psst                     # Publish with username/password
   ntfy pub --wait-pid 1234 mytopic                        # Wait for process 1234 to exit before publishing
   ntfy pub --wait-cmd mytopic rsync -av ./ /tmp/a         # Run command and publish after it completes
+  ntfy pub --strip-ansi builds "$(make 2>&1 | tail)"      # Remove terminal colors from the message
+  ntfy pub --retries=3 --retry-timeout=1m alerts 'Hi'     # Retry up to 3 times within 1m if rate limited
+  ntfy pub --test mytopic                                 # Send a test notification to verify your setup
   NTFY_USER=phil:mypass ntfy pub secret Psst              # Use env variables to set username/password
   NTFY_TOPIC=mytopic ntfy pub "some message"              # Use NTFY_TOPIC variable as topic 
   cat flower.jpg | ntfy pub --file=- flowers 'Nice!'      # Same as above, send image.jpg as attachment
@@ -97,6 +113,7 @@ func execPublish(c *cli.Context) error {
 	actions := c.String("actions")
 	attach := c.String("attach")
 	markdown := c.Bool("markdown")
+	stripANSI := c.Bool("strip-ansi")
 	filename := c.String("filename")
 	file := c.String("file")
 	email := c.String("email")
@@ -106,17 +123,52 @@ func execPublish(c *cli.Context) error {
 	noFirebase := c.Bool("no-firebase")
 	quiet := c.Bool("quiet")
 	pid := c.Int("wait-pid")
+	test := c.Bool("test")
 
 	// Checks
 	if user != "" && token != "" {
 		return errors.New("cannot set both --user and --token")
 	}
+	if c.IsSet("retries") {
+		if c.Int("retries") < 0 {
+			return errors.New("--retries must be zero or a positive number")
+		}
+		conf.PublishRetries = c.Int("retries")
+	}
+	if c.IsSet("retry-timeout") {
+		retryTimeout, err := util.ParseDuration(c.String("retry-timeout"))
+		if err != nil {
+			return fmt.Errorf("invalid --retry-timeout: %s", err.Error())
+		}
+		conf.PublishRetryTimeout = retryTimeout
+	}
+	if test && (pid > 0 || c.Bool("wait-cmd")) {
+		return errors.New("cannot combine --test with --wait-pid or --wait-cmd")
+	}
 
 	// Do the things
 	topic, message, command, err := parseTopicMessageCommand(c)
 	if err != nil {
 		return err
 	}
+	if test {
+		// Fill in canned values, but let explicitly passed options win
+		if title == "" {
+			title = publishTestTitle
+		}
+		if message == "" {
+			message = publishTestMessage
+		}
+		if tags == "" {
+			tags = publishTestTags
+		}
+		if priority == "" {
+			priority = publishTestPriority
+		}
+		if actions == "" {
+			actions = publishTestActions
+		}
+	}
 	var options []client.PublishOption
 	if title != "" {
 		options = append(options, client.WithTitle(title))
@@ -195,6 +247,9 @@ func execPublish(c *cli.Context) error {
 			message = newMessage
 		}
 	}
+	if stripANSI {
+		message = util.StripANSI(message)
+	}
 	var body io.Reader
 	if file == "" {
 		body = strings.NewReader(message)
@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/test"
 	"heckel.io/ntfy/v2/util"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -50,6 +52,20 @@ func TestCLI_Publish_Subscribe_Poll(t *testing.T) {
 	require.Equal(t, "some message", m.Message)
 }
 
+func TestCLI_Publish_StripANSI(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	topic := fmt.Sprintf("http://127.0.0.1:%d/mytopic", port)
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--strip-ansi", topic, "\x1b[32mbuild ok\x1b[0m"}))
+	require.Equal(t, "build ok", toMessage(t, stdout.String()).Message)
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", topic, "\x1b[32mbuild ok\x1b[0m"}))
+	require.Equal(t, "\x1b[32mbuild ok\x1b[0m", toMessage(t, stdout.String()).Message)
+}
+
 func TestCLI_Publish_All_The_Things(t *testing.T) {
 	s, port := test.StartServer(t)
 	defer test.StopServer(t, s, port)
@@ -198,6 +214,117 @@ default-token: tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2
 	require.Equal(t, "triggered", m.Message)
 }
 
+func TestCLI_Publish_Test(t *testing.T) {
+	message := `{"id":"RXIQBFaieLVr","time":124,"expires":1124,"event":"message","topic":"mytopic","title":"Test notification","message":"If you can see this, publishing to this topic works. Nice!"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, "/mytopic", r.URL.Path)
+		require.Equal(t, "Bearer tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2", r.Header.Get("Authorization"))
+		require.Equal(t, "If you can see this, publishing to this topic works. Nice!", string(body))
+		require.Equal(t, "Test notification", r.Header.Get("X-Title"))
+		require.Equal(t, "white_check_mark", r.Header.Get("X-Tags"))
+		require.Equal(t, "3", r.Header.Get("X-Priority"))
+		require.Equal(t, "view, Open docs, https://ntfy.sh/docs/", r.Header.Get("X-Actions"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(message))
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "client.yml")
+	require.Nil(t, os.WriteFile(filename, []byte(fmt.Sprintf(`
+default-host: %s
+default-token: tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2
+`, server.URL)), 0600))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--config=" + filename, "--test", "mytopic"}))
+	m := toMessage(t, stdout.String())
+	require.Equal(t, "Test notification", m.Title)
+}
+
+func TestCLI_Publish_Test_Failed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "high", r.Header.Get("X-Priority")) // Explicit options win over canned values
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"code":40301,"http":403,"error":"forbidden"}`))
+	}))
+	defer server.Close()
+
+	app, _, stdout, _ := newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", "--test", "--priority=high", server.URL + "/mytopic"}))
+	require.Empty(t, stdout.String())
+	require.Error(t, app.Run([]string{"ntfy", "publish", "--test", "--wait-cmd", server.URL + "/mytopic", "true"}))
+}
+
+func TestCLI_Publish_Retries(t *testing.T) {
+	message := `{"id":"RXIQBFaieLVr","time":124,"expires":1124,"event":"message","topic":"mytopic","message":"triggered"}`
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, "triggered", string(body))
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":42901,"http":429,"error":"limit reached: too many requests"}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(message))
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--retries=2", server.URL + "/mytopic", "triggered"}))
+	m := toMessage(t, stdout.String())
+	require.Equal(t, "triggered", m.Message)
+	require.Equal(t, int32(2), requests.Load())
+	require.True(t, time.Since(start) >= time.Second)
+}
+
+func TestCLI_Publish_Retries_Exhausted(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"code":42901,"http":429,"error":"limit reached: too many requests"}`))
+	}))
+	defer server.Close()
+
+	// Without --retries, the first 429 is an error
+	app, _, _, _ := newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", server.URL + "/mytopic", "triggered"}))
+	require.Equal(t, int32(1), requests.Load())
+
+	// With --retries, the error is returned after the last retry
+	requests.Store(0)
+	app, _, _, _ = newTestApp()
+	err := app.Run([]string{"ntfy", "publish", "--retries=3", server.URL + "/mytopic", "triggered"})
+	require.ErrorContains(t, err, "too many requests")
+	require.Equal(t, int32(4), requests.Load())
+}
+
+func TestCLI_Publish_Retries_Timeout(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"code":42901,"http":429,"error":"limit reached: too many requests"}`))
+	}))
+	defer server.Close()
+
+	// Retry-After exceeds the retry timeout, so the client gives up right away
+	start := time.Now()
+	app, _, _, _ := newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", "--retries=3", "--retry-timeout=5s", server.URL + "/mytopic", "triggered"}))
+	require.Equal(t, int32(1), requests.Load())
+	require.True(t, time.Since(start) < 5*time.Second)
+}
+
 func TestCLI_Publish_Default_UserPass_CLI_Token(t *testing.T) {
 	message := `{"id":"RXIQBFaieLVr","time":124,"expires":1124,"event":"message","topic":"mytopic","message":"triggered"}`
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -19,6 +19,8 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -32,6 +34,11 @@ const (
 	defaultServerConfigFile = "/etc/ntfy/server.yml"
 )
 
+var (
+	topicRegex        = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)  // Must match the server's topic regex
+	topicPatternRegex = regexp.MustCompile(`^[-_A-Za-z0-9*]{1,64}$`) // Same as topicRegex, but allows * wildcards
+)
+
 var flagsServe = append(
 	append([]cli.Flag{}, flagsDefault...),
 	&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"NTFY_CONFIG_FILE"}, Value: defaultServerConfigFile, Usage: "config file"},
@@ -40,29 +47,79 @@ var flagsServe = append(
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "listen-https", Aliases: []string{"listen_https", "L"}, EnvVars: []string{"NTFY_LISTEN_HTTPS"}, Usage: "ip:port used as HTTPS listen address"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "listen-unix", Aliases: []string{"listen_unix", "U"}, EnvVars: []string{"NTFY_LISTEN_UNIX"}, Usage: "listen on unix socket path"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "listen-unix-mode", Aliases: []string{"listen_unix_mode"}, EnvVars: []string{"NTFY_LISTEN_UNIX_MODE"}, DefaultText: "system default", Usage: "file permissions of unix socket, e.g. 0700"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "listen-grpc", Aliases: []string{"listen_grpc"}, EnvVars: []string{"NTFY_LISTEN_GRPC"}, Usage: "ip:port used as gRPC listen address (optional)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "key-file", Aliases: []string{"key_file", "K"}, EnvVars: []string{"NTFY_KEY_FILE"}, Usage: "private key file, if listen-https is set"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cert-file", Aliases: []string{"cert_file", "E"}, EnvVars: []string{"NTFY_CERT_FILE"}, Usage: "certificate file, if listen-https is set"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "tls-session-ticket-rotation", Aliases: []string{"tls_session_ticket_rotation"}, EnvVars: []string{"NTFY_TLS_SESSION_TICKET_ROTATION"}, Value: "0", Usage: "interval in which TLS session ticket keys are rotated, if listen-https is set (0 = use Go defaults)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "firebase-key-file", Aliases: []string{"firebase_key_file", "F"}, EnvVars: []string{"NTFY_FIREBASE_KEY_FILE"}, Usage: "Firebase credentials file; if set additionally publish to FCM topic"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "firebase-priority-route", Aliases: []string{"firebase_priority_route"}, EnvVars: []string{"NTFY_FIREBASE_PRIORITY_ROUTE"}, Usage: "message priorities delivered with the given FCM/APNs priority, in the format MIN[-MAX]:high|normal[:APNS-PRIORITY], e.g. 4-5:high:10"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "apns-key-file", Aliases: []string{"apns_key_file"}, EnvVars: []string{"NTFY_APNS_KEY_FILE"}, Usage: "APNs auth key file (.p8); if set additionally send notifications to registered iOS devices via APNs"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "apns-key-id", Aliases: []string{"apns_key_id"}, EnvVars: []string{"NTFY_APNS_KEY_ID"}, Usage: "key ID of the APNs auth key"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "apns-team-id", Aliases: []string{"apns_team_id"}, EnvVars: []string{"NTFY_APNS_TEAM_ID"}, Usage: "Apple developer team ID"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "apns-bundle-id", Aliases: []string{"apns_bundle_id"}, EnvVars: []string{"NTFY_APNS_BUNDLE_ID"}, Usage: "bundle ID of the iOS app"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "apns-production", Aliases: []string{"apns_production"}, EnvVars: []string{"NTFY_APNS_PRODUCTION"}, Value: false, Usage: "use the production APNs environment instead of the sandbox"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "apns-device-file", Aliases: []string{"apns_device_file"}, EnvVars: []string{"NTFY_APNS_DEVICE_FILE"}, Usage: "file used to store the APNs device registrations"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-file", Aliases: []string{"cache_file", "C"}, EnvVars: []string{"NTFY_CACHE_FILE"}, Usage: "cache file used for message caching"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-duration", Aliases: []string{"cache_duration", "b"}, EnvVars: []string{"NTFY_CACHE_DURATION"}, Value: util.FormatDuration(server.DefaultCacheDuration), Usage: "buffer messages for this time to allow `since` requests"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "retain-priority", Aliases: []string{"retain_priority"}, EnvVars: []string{"NTFY_RETAIN_PRIORITY"}, Usage: "messages with at least this priority are kept for retain-duration instead of cache-duration (e.g. 5 or urgent)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "retain-duration", Aliases: []string{"retain_duration"}, EnvVars: []string{"NTFY_RETAIN_DURATION"}, Value: "0", Usage: "duration for which messages with retain-priority are kept in the cache (e.g. 30d)"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "topic-cache-duration", Aliases: []string{"topic_cache_duration"}, EnvVars: []string{"NTFY_TOPIC_CACHE_DURATION"}, Usage: "cache duration for a topic, overriding cache-duration, in the format TOPIC:DURATION, e.g. audit-log:30d"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "no-cache-topics", Aliases: []string{"no_cache_topics"}, EnvVars: []string{"NTFY_NO_CACHE_TOPICS"}, Usage: "topics (or patterns, e.g. telemetry-*) whose messages are only delivered to active subscribers, and never cached"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "priority-ordered-topics", Aliases: []string{"priority_ordered_topics"}, EnvVars: []string{"NTFY_PRIORITY_ORDERED_TOPICS"}, Usage: "topics (or patterns, e.g. triage-*) whose poll results are ordered by priority (highest first) instead of time"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-batch-size", Aliases: []string{"cache_batch_size"}, EnvVars: []string{"NTFY_BATCH_SIZE"}, Usage: "max size of messages to batch together when writing to message cache (if zero, writes are synchronous)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-batch-timeout", Aliases: []string{"cache_batch_timeout"}, EnvVars: []string{"NTFY_CACHE_BATCH_TIMEOUT"}, Value: util.FormatDuration(server.DefaultCacheBatchTimeout), Usage: "timeout for batched async writes to the message cache (if zero, writes are synchronous)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-startup-queries", Aliases: []string{"cache_startup_queries"}, EnvVars: []string{"NTFY_CACHE_STARTUP_QUERIES"}, Usage: "queries run when the cache database is initialized"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-file", Aliases: []string{"auth_file", "H"}, EnvVars: []string{"NTFY_AUTH_FILE"}, Usage: "auth database file used for access control"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-startup-queries", Aliases: []string{"auth_startup_queries"}, EnvVars: []string{"NTFY_AUTH_STARTUP_QUERIES"}, Usage: "queries run when the auth database is initialized"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-default-access", Aliases: []string{"auth_default_access", "p"}, EnvVars: []string{"NTFY_AUTH_DEFAULT_ACCESS"}, Value: "read-write", Usage: "default permissions if no matching entries in the auth database are found"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-url", Aliases: []string{"auth_ldap_url"}, EnvVars: []string{"NTFY_AUTH_LDAP_URL"}, Usage: "LDAP server URL (ldap:// or ldaps://) used to authenticate users, e.g. ldaps://ldap.example.com"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-bind-dn", Aliases: []string{"auth_ldap_bind_dn"}, EnvVars: []string{"NTFY_AUTH_LDAP_BIND_DN"}, Usage: "DN of the service account used to look up users in LDAP"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-bind-password", Aliases: []string{"auth_ldap_bind_password"}, EnvVars: []string{"NTFY_AUTH_LDAP_BIND_PASSWORD"}, Usage: "password of the LDAP service account"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-base-dn", Aliases: []string{"auth_ldap_base_dn"}, EnvVars: []string{"NTFY_AUTH_LDAP_BASE_DN"}, Usage: "base DN under which users are searched, e.g. ou=people,dc=example,dc=com"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-user-filter", Aliases: []string{"auth_ldap_user_filter"}, EnvVars: []string{"NTFY_AUTH_LDAP_USER_FILTER"}, Value: user.DefaultLDAPUserFilter, Usage: "LDAP search filter to find a user; %s is replaced with the username"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-group-attribute", Aliases: []string{"auth_ldap_group_attribute"}, EnvVars: []string{"NTFY_AUTH_LDAP_GROUP_ATTRIBUTE"}, Value: user.DefaultLDAPGroupAttribute, Usage: "attribute of the LDAP user entry that lists the user's groups"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "auth-ldap-admin-groups", Aliases: []string{"auth_ldap_admin_groups"}, EnvVars: []string{"NTFY_AUTH_LDAP_ADMIN_GROUPS"}, Usage: "LDAP groups whose members get the admin role"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "auth-ldap-group-access", Aliases: []string{"auth_ldap_group_access"}, EnvVars: []string{"NTFY_AUTH_LDAP_GROUP_ACCESS"}, Usage: "topic permissions for members of LDAP groups, in the format GROUP:TOPIC:PERMISSION"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-ldap-cache-ttl", Aliases: []string{"auth_ldap_cache_ttl"}, EnvVars: []string{"NTFY_AUTH_LDAP_CACHE_TTL"}, Value: util.FormatDuration(user.DefaultLDAPCacheTTL), Usage: "duration for which successful LDAP authentications are cached"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "subscribe-url-secret", Aliases: []string{"subscribe_url_secret"}, EnvVars: []string{"NTFY_SUBSCRIBE_URL_SECRET"}, Usage: "secret used to sign time-limited subscribe URLs (at least 32 characters); enables the /v1/account/subscribe-url endpoint"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-cache-dir", Aliases: []string{"attachment_cache_dir"}, EnvVars: []string{"NTFY_ATTACHMENT_CACHE_DIR"}, Usage: "cache directory for attached files"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-s3-endpoint", Aliases: []string{"attachment_s3_endpoint"}, EnvVars: []string{"NTFY_ATTACHMENT_S3_ENDPOINT"}, Usage: "URL of the S3-compatible object storage for attached files (e.g. https://s3.us-east-1.amazonaws.com), alternative to attachment-cache-dir"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-s3-bucket", Aliases: []string{"attachment_s3_bucket"}, EnvVars: []string{"NTFY_ATTACHMENT_S3_BUCKET"}, Usage: "S3 bucket for attached files"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-s3-region", Aliases: []string{"attachment_s3_region"}, EnvVars: []string{"NTFY_ATTACHMENT_S3_REGION"}, Value: server.DefaultAttachmentS3Region, Usage: "S3 region of the bucket"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-s3-access-key", Aliases: []string{"attachment_s3_access_key"}, EnvVars: []string{"NTFY_ATTACHMENT_S3_ACCESS_KEY"}, Usage: "S3 access key ID"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-s3-secret-key", Aliases: []string{"attachment_s3_secret_key"}, EnvVars: []string{"NTFY_ATTACHMENT_S3_SECRET_KEY"}, Usage: "S3 secret access key"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-total-size-limit", Aliases: []string{"attachment_total_size_limit", "A"}, EnvVars: []string{"NTFY_ATTACHMENT_TOTAL_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultAttachmentTotalSizeLimit), Usage: "limit of the on-disk attachment cache"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-file-size-limit", Aliases: []string{"attachment_file_size_limit", "Y"}, EnvVars: []string{"NTFY_ATTACHMENT_FILE_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultAttachmentFileSizeLimit), Usage: "per-file attachment size limit (e.g. 300k, 2M, 100M)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-expiry-duration", Aliases: []string{"attachment_expiry_duration", "X"}, EnvVars: []string{"NTFY_ATTACHMENT_EXPIRY_DURATION"}, Value: util.FormatDuration(server.DefaultAttachmentExpiryDuration), Usage: "duration after which uploaded attachments will be deleted (e.g. 3h, 20h)"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "attachment-dedup-topics", Aliases: []string{"attachment_dedup_topics"}, EnvVars: []string{"NTFY_ATTACHMENT_DEDUP_TOPICS"}, Usage: "topics on which a new attachment replaces earlier attachments with the same filename"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "attachment-fetch-credential", Aliases: []string{"attachment_fetch_credential"}, EnvVars: []string{"NTFY_ATTACHMENT_FETCH_CREDENTIAL"}, Usage: "credential for a host from which attachment URLs of authenticated users are fetched and cached, in the format [USER,...@]HOST=USER:PASS or [USER,...@]HOST=TOKEN"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "keepalive-interval", Aliases: []string{"keepalive_interval", "k"}, EnvVars: []string{"NTFY_KEEPALIVE_INTERVAL"}, Value: util.FormatDuration(server.DefaultKeepaliveInterval), Usage: "interval of keepalive messages"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "shutdown-grace-period", Aliases: []string{"shutdown_grace_period"}, EnvVars: []string{"NTFY_SHUTDOWN_GRACE_PERIOD"}, Value: "0", Usage: "time to drain subscribers on SIGTERM/SIGINT before closing their connections (e.g. 30s), 0 to exit immediately"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "manager-interval", Aliases: []string{"manager_interval", "m"}, EnvVars: []string{"NTFY_MANAGER_INTERVAL"}, Value: util.FormatDuration(server.DefaultManagerInterval), Usage: "interval of for message pruning and stats printing"}),
 	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "disallowed-topics", Aliases: []string{"disallowed_topics"}, EnvVars: []string{"NTFY_DISALLOWED_TOPICS"}, Usage: "topics that are not allowed to be used"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "disallowed-topic-pattern", Aliases: []string{"disallowed_topic_pattern"}, EnvVars: []string{"NTFY_DISALLOWED_TOPIC_PATTERN"}, Usage: "regular expression; publishing and subscribing to topics whose name matches are rejected"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "require-title-topics", Aliases: []string{"require_title_topics"}, EnvVars: []string{"NTFY_REQUIRE_TITLE_TOPICS"}, Usage: "topics on which messages without a title are rejected"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "unique-title-topic", Aliases: []string{"unique_title_topic"}, EnvVars: []string{"NTFY_UNIQUE_TITLE_TOPIC"}, Usage: "topic on which recent messages with the same title are suppressed or replaced, in the format TOPIC:suppress|update[:WINDOW], e.g. alerts:suppress:30m"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "web-root", Aliases: []string{"web_root"}, EnvVars: []string{"NTFY_WEB_ROOT"}, Value: "/", Usage: "sets root of the web app (e.g. /, or /app), or disables it (disable)"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-signup", Aliases: []string{"enable_signup"}, EnvVars: []string{"NTFY_ENABLE_SIGNUP"}, Value: false, Usage: "allows users to sign up via the web app, or API"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-login", Aliases: []string{"enable_login"}, EnvVars: []string{"NTFY_ENABLE_LOGIN"}, Value: false, Usage: "allows users to log in via the web app, or API"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-reservations", Aliases: []string{"enable_reservations"}, EnvVars: []string{"NTFY_ENABLE_RESERVATIONS"}, Value: false, Usage: "allows users to reserve topics (if their tier allows it)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "upstream-base-url", Aliases: []string{"upstream_base_url"}, EnvVars: []string{"NTFY_UPSTREAM_BASE_URL"}, Value: "", Usage: "forward poll request to an upstream server, this is needed for iOS push notifications for self-hosted servers"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "redact-pattern", Aliases: []string{"redact_pattern"}, EnvVars: []string{"NTFY_REDACT_PATTERN"}, Usage: "regular expression; matches in message title and body are redacted in logs and when forwarding messages to other servers"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "spam-quarantine-topic", Aliases: []string{"spam_quarantine_topic"}, EnvVars: []string{"NTFY_SPAM_QUARANTINE_TOPIC"}, Usage: "topic to which suspected spam messages are published instead of their original topic, enables the spam trap"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "spam-pattern", Aliases: []string{"spam_pattern"}, EnvVars: []string{"NTFY_SPAM_PATTERN"}, Usage: "regular expression; messages whose title or body match are quarantined as suspected spam"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "spam-duplicate-threshold", Aliases: []string{"spam_duplicate_threshold"}, EnvVars: []string{"NTFY_SPAM_DUPLICATE_THRESHOLD"}, Value: 0, Usage: "identical messages published from at least this many IP addresses are quarantined as suspected spam (0 = disabled)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "spam-duplicate-window", Aliases: []string{"spam_duplicate_window"}, EnvVars: []string{"NTFY_SPAM_DUPLICATE_WINDOW"}, Value: util.FormatDuration(server.DefaultSpamDuplicateWindow), Usage: "time window in which identical messages are counted for spam-duplicate-threshold"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "federate-topic", Aliases: []string{"federate_topic"}, EnvVars: []string{"NTFY_FEDERATE_TOPIC"}, Usage: "forward messages of a local topic to a topic on a remote ntfy server, in the format TOPIC:REMOTE-TOPIC-URL[:TOKEN], e.g. alerts:https://ntfy.example.com/alerts:tk_..."}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "federate-message-headers", Aliases: []string{"federate_message_headers"}, EnvVars: []string{"NTFY_FEDERATE_MESSAGE_HEADERS"}, Value: false, Usage: "also send the priority, tags and title of forwarded messages as X-Ntfy-Priority, X-Ntfy-Tags and X-Ntfy-Title headers"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "kafka-brokers", Aliases: []string{"kafka_brokers"}, EnvVars: []string{"NTFY_KAFKA_BROKERS"}, Usage: "Kafka bootstrap brokers (host:port) to produce all messages to"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "kafka-topic", Aliases: []string{"kafka_topic"}, EnvVars: []string{"NTFY_KAFKA_TOPIC"}, Usage: "Kafka topic that messages are produced to, if kafka-brokers is set"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "kafka-key", Aliases: []string{"kafka_key"}, EnvVars: []string{"NTFY_KAFKA_KEY"}, Value: server.DefaultKafkaKey, Usage: "Kafka record key, either the ntfy topic (topic) or the message ID (id)"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "kafka-tls", Aliases: []string{"kafka_tls"}, EnvVars: []string{"NTFY_KAFKA_TLS"}, Value: false, Usage: "connect to the Kafka brokers via TLS"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "kafka-sasl-mechanism", Aliases: []string{"kafka_sasl_mechanism"}, EnvVars: []string{"NTFY_KAFKA_SASL_MECHANISM"}, Usage: "Kafka SASL mechanism, either plain, scram-sha-256 or scram-sha-512 (optional)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "kafka-username", Aliases: []string{"kafka_username"}, EnvVars: []string{"NTFY_KAFKA_USERNAME"}, Usage: "Kafka SASL username, if kafka-sasl-mechanism is set"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "kafka-password", Aliases: []string{"kafka_password"}, EnvVars: []string{"NTFY_KAFKA_PASSWORD"}, Usage: "Kafka SASL password, if kafka-sasl-mechanism is set"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "meta-topic", Aliases: []string{"meta_topic"}, EnvVars: []string{"NTFY_META_TOPIC"}, Usage: "topic that aggregates multiple topics when subscribing, in the format NAME:TOPIC1+TOPIC2[+...], e.g. dashboard:alerts+backups"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "upstream-access-token", Aliases: []string{"upstream_access_token"}, EnvVars: []string{"NTFY_UPSTREAM_ACCESS_TOKEN"}, Value: "", Usage: "access token to use for the upstream server; needed only if upstream rate limits are exceeded or upstream server requires auth"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-addr", Aliases: []string{"smtp_sender_addr"}, EnvVars: []string{"NTFY_SMTP_SENDER_ADDR"}, Usage: "SMTP server address (host:port) for outgoing emails"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-sender-user", Aliases: []string{"smtp_sender_user"}, EnvVars: []string{"NTFY_SMTP_SENDER_USER"}, Usage: "SMTP user (if e-mail sending is enabled)"}),
@@ -78,7 +135,21 @@ var flagsServe = append(
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "message-size-limit", Aliases: []string{"message_size_limit"}, EnvVars: []string{"NTFY_MESSAGE_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultMessageSizeLimit), Usage: "size limit for the message (see docs for limitations)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "message-delay-limit", Aliases: []string{"message_delay_limit"}, EnvVars: []string{"NTFY_MESSAGE_DELAY_LIMIT"}, Value: util.FormatDuration(server.DefaultMessageDelayMax), Usage: "max duration a message can be scheduled into the future"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "global-topic-limit", Aliases: []string{"global_topic_limit", "T"}, EnvVars: []string{"NTFY_GLOBAL_TOPIC_LIMIT"}, Value: server.DefaultTotalTopicLimit, Usage: "total number of topics allowed"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-emoji-tags", Aliases: []string{"enable_emoji_tags"}, EnvVars: []string{"NTFY_ENABLE_EMOJI_TAGS"}, Value: true, Usage: "map tags to emojis in e-mails and the web app (e.g. warning -> ⚠️); if false, tags are shown verbatim"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "emoji-tag-map-file", Aliases: []string{"emoji_tag_map_file"}, EnvVars: []string{"NTFY_EMOJI_TAG_MAP_FILE"}, Usage: "JSON file mapping custom tags to strings (e.g. {\"deploy\":\"🚀\"}), applied to tags when publishing"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "enable-icon-cache", Aliases: []string{"enable_icon_cache"}, EnvVars: []string{"NTFY_ENABLE_ICON_CACHE"}, Value: false, Usage: "fetch X-Icon URLs once when publishing, and serve the icons from the attachment cache"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "icon-cache-file-size-limit", Aliases: []string{"icon_cache_file_size_limit"}, EnvVars: []string{"NTFY_ICON_CACHE_FILE_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultIconCacheFileSizeLimit), Usage: "max size of a cached icon (e.g. 100k, 1M)"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "expand-url-host", Aliases: []string{"expand_url_host"}, EnvVars: []string{"NTFY_EXPAND_URL_HOST"}, Usage: "URL shortener host (e.g. bit.ly) whose URLs are expanded in message bodies when publishing"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "expand-url-mode", Aliases: []string{"expand_url_mode"}, EnvVars: []string{"NTFY_EXPAND_URL_MODE"}, Value: server.ExpandURLModeRewrite, Usage: "replace shortened URLs with the expanded URL (rewrite), or append it (annotate)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "expand-url-timeout", Aliases: []string{"expand_url_timeout"}, EnvVars: []string{"NTFY_EXPAND_URL_TIMEOUT"}, Value: util.FormatDuration(server.DefaultExpandURLTimeout), Usage: "timeout for expanding a shortened URL"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "strip-ansi", Aliases: []string{"strip_ansi"}, EnvVars: []string{"NTFY_STRIP_ANSI"}, Value: false, Usage: "remove ANSI escape codes (e.g. terminal colors) from message bodies when publishing"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "markdown-sanitize-policy", Aliases: []string{"markdown_sanitize_policy"}, EnvVars: []string{"NTFY_MARKDOWN_SANITIZE_POLICY"}, Usage: "remove dangerous HTML from Markdown messages when publishing: 'safe' keeps only common formatting tags, 'strict' removes all HTML tags"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "markdown-disallowed-tags", Aliases: []string{"markdown_disallowed_tags"}, EnvVars: []string{"NTFY_MARKDOWN_DISALLOWED_TAGS"}, Usage: "HTML tags removed from Markdown messages if markdown-sanitize-policy is 'safe' (default: script, style, iframe, ...)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "receipt-timeout", Aliases: []string{"receipt_timeout"}, EnvVars: []string{"NTFY_RECEIPT_TIMEOUT"}, Value: util.FormatDuration(server.DefaultReceiptTimeout), Usage: "max. time to wait for a message to be delivered before sending its delivery receipt (X-Receipt-URL)"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "topic-default-filter", Aliases: []string{"topic_default_filter"}, EnvVars: []string{"NTFY_TOPIC_DEFAULT_FILTER"}, Usage: "default subscribe filter for a topic, in the format TOPIC:FILTER, e.g. firehose:priority=high,urgent"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-subscription-limit", Aliases: []string{"visitor_subscription_limit"}, EnvVars: []string{"NTFY_VISITOR_SUBSCRIPTION_LIMIT"}, Value: server.DefaultVisitorSubscriptionLimit, Usage: "number of subscriptions per visitor"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-schedule-limit", Aliases: []string{"visitor_schedule_limit"}, EnvVars: []string{"NTFY_VISITOR_SCHEDULE_LIMIT"}, Value: server.DefaultVisitorScheduleLimit, Usage: "number of recurring message schedules (X-Cron) per user, or per IP address for anonymous visitors"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-repeat-limit", Aliases: []string{"visitor_repeat_limit"}, EnvVars: []string{"NTFY_VISITOR_REPEAT_LIMIT"}, Value: server.DefaultVisitorRepeatLimit, Usage: "number of messages repeated until acknowledged (X-Repeat-Until-Ack) per user, or per IP address for anonymous visitors"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-attachment-total-size-limit", Aliases: []string{"visitor_attachment_total_size_limit"}, EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_TOTAL_SIZE_LIMIT"}, Value: util.FormatSize(server.DefaultVisitorAttachmentTotalSizeLimit), Usage: "total storage limit used for attachments per visitor"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-attachment-daily-bandwidth-limit", Aliases: []string{"visitor_attachment_daily_bandwidth_limit"}, EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_DAILY_BANDWIDTH_LIMIT"}, Value: "500M", Usage: "total daily attachment download/upload bandwidth limit per visitor"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-request-limit-burst", Aliases: []string{"visitor_request_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_REQUEST_LIMIT_BURST"}, Value: server.DefaultVisitorRequestLimitBurst, Usage: "initial limit of requests per visitor"}),
@@ -88,7 +159,10 @@ var flagsServe = append(
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-email-limit-burst", Aliases: []string{"visitor_email_limit_burst"}, EnvVars: []string{"NTFY_VISITOR_EMAIL_LIMIT_BURST"}, Value: server.DefaultVisitorEmailLimitBurst, Usage: "initial limit of e-mails per visitor"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-email-limit-replenish", Aliases: []string{"visitor_email_limit_replenish"}, EnvVars: []string{"NTFY_VISITOR_EMAIL_LIMIT_REPLENISH"}, Value: util.FormatDuration(server.DefaultVisitorEmailLimitReplenish), Usage: "interval at which burst limit is replenished (one per x)"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "visitor-subscriber-rate-limiting", Aliases: []string{"visitor_subscriber_rate_limiting"}, EnvVars: []string{"NTFY_VISITOR_SUBSCRIBER_RATE_LIMITING"}, Value: false, Usage: "enables subscriber-based rate limiting"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "topic-publish-limit", Aliases: []string{"topic_publish_limit"}, EnvVars: []string{"NTFY_TOPIC_PUBLISH_LIMIT"}, Usage: "limit of messages per interval on a topic, regardless of the publisher, in the format TOPIC-PATTERN:COUNT/INTERVAL, e.g. alerts:10/1m"}),
 	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "behind-proxy", Aliases: []string{"behind_proxy", "P"}, EnvVars: []string{"NTFY_BEHIND_PROXY"}, Value: false, Usage: "if set, use X-Forwarded-For header to determine visitor IP address (for rate limiting)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "proxy-trusted-hosts", Aliases: []string{"proxy_trusted_hosts"}, EnvVars: []string{"NTFY_PROXY_TRUSTED_HOSTS"}, Value: "", Usage: "hostnames and/or IP addresses of proxies whose X-Forwarded-Proto/X-Forwarded-Host headers are used for generated URLs, if behind-proxy is set (default: all)"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "cors-allowed-origins", Aliases: []string{"cors_allowed_origins"}, EnvVars: []string{"NTFY_CORS_ALLOWED_ORIGINS"}, Usage: "origins (e.g. https://dashboard.example.com) allowed to make cross-origin requests; other origins get no CORS headers (default: all)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "stripe-secret-key", Aliases: []string{"stripe_secret_key"}, EnvVars: []string{"NTFY_STRIPE_SECRET_KEY"}, Value: "", Usage: "key used for the Stripe API communication, this enables payments"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "stripe-webhook-key", Aliases: []string{"stripe_webhook_key"}, EnvVars: []string{"NTFY_STRIPE_WEBHOOK_KEY"}, Value: "", Usage: "key required to validate the authenticity of incoming webhooks from Stripe"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "billing-contact", Aliases: []string{"billing_contact"}, EnvVars: []string{"NTFY_BILLING_CONTACT"}, Value: "", Usage: "e-mail or website to display in upgrade dialog (only if payments are enabled)"}),
@@ -132,9 +206,18 @@ func execServe(c *cli.Context) error {
 	listenHTTPS := c.String("listen-https")
 	listenUnix := c.String("listen-unix")
 	listenUnixMode := c.Int("listen-unix-mode")
+	listenGRPC := c.String("listen-grpc")
 	keyFile := c.String("key-file")
 	certFile := c.String("cert-file")
+	tlsSessionTicketRotationStr := c.String("tls-session-ticket-rotation")
 	firebaseKeyFile := c.String("firebase-key-file")
+	firebasePriorityRoutesRaw := c.StringSlice("firebase-priority-route")
+	apnsKeyFile := c.String("apns-key-file")
+	apnsKeyID := c.String("apns-key-id")
+	apnsTeamID := c.String("apns-team-id")
+	apnsBundleID := c.String("apns-bundle-id")
+	apnsProduction := c.Bool("apns-production")
+	apnsDeviceFile := c.String("apns-device-file")
 	webPushPrivateKey := c.String("web-push-private-key")
 	webPushPublicKey := c.String("web-push-public-key")
 	webPushFile := c.String("web-push-file")
@@ -142,24 +225,65 @@ func execServe(c *cli.Context) error {
 	webPushStartupQueries := c.String("web-push-startup-queries")
 	cacheFile := c.String("cache-file")
 	cacheDurationStr := c.String("cache-duration")
+	retainPriorityStr := c.String("retain-priority")
+	retainDurationStr := c.String("retain-duration")
+	topicCacheDurationsRaw := c.StringSlice("topic-cache-duration")
+	noCacheTopics := c.StringSlice("no-cache-topics")
+	priorityOrderedTopics := c.StringSlice("priority-ordered-topics")
 	cacheStartupQueries := c.String("cache-startup-queries")
 	cacheBatchSize := c.Int("cache-batch-size")
 	cacheBatchTimeoutStr := c.String("cache-batch-timeout")
 	authFile := c.String("auth-file")
 	authStartupQueries := c.String("auth-startup-queries")
 	authDefaultAccess := c.String("auth-default-access")
+	authLDAPURL := c.String("auth-ldap-url")
+	authLDAPBindDN := c.String("auth-ldap-bind-dn")
+	authLDAPBindPassword := c.String("auth-ldap-bind-password")
+	authLDAPBaseDN := c.String("auth-ldap-base-dn")
+	authLDAPUserFilter := c.String("auth-ldap-user-filter")
+	authLDAPGroupAttribute := c.String("auth-ldap-group-attribute")
+	authLDAPAdminGroups := c.StringSlice("auth-ldap-admin-groups")
+	authLDAPGroupAccessRaw := c.StringSlice("auth-ldap-group-access")
+	authLDAPCacheTTLStr := c.String("auth-ldap-cache-ttl")
+	subscribeURLSecret := c.String("subscribe-url-secret")
 	attachmentCacheDir := c.String("attachment-cache-dir")
+	attachmentS3Endpoint := c.String("attachment-s3-endpoint")
+	attachmentS3Bucket := c.String("attachment-s3-bucket")
+	attachmentS3Region := c.String("attachment-s3-region")
+	attachmentS3AccessKey := c.String("attachment-s3-access-key")
+	attachmentS3SecretKey := c.String("attachment-s3-secret-key")
 	attachmentTotalSizeLimitStr := c.String("attachment-total-size-limit")
 	attachmentFileSizeLimitStr := c.String("attachment-file-size-limit")
 	attachmentExpiryDurationStr := c.String("attachment-expiry-duration")
+	attachmentDedupTopics := c.StringSlice("attachment-dedup-topics")
+	attachmentFetchCredentialsRaw := c.StringSlice("attachment-fetch-credential")
 	keepaliveIntervalStr := c.String("keepalive-interval")
+	shutdownGracePeriodStr := c.String("shutdown-grace-period")
 	managerIntervalStr := c.String("manager-interval")
 	disallowedTopics := c.StringSlice("disallowed-topics")
+	disallowedTopicPatternsRaw := c.StringSlice("disallowed-topic-pattern")
+	requireTitleTopics := c.StringSlice("require-title-topics")
 	webRoot := c.String("web-root")
 	enableSignup := c.Bool("enable-signup")
 	enableLogin := c.Bool("enable-login")
 	enableReservations := c.Bool("enable-reservations")
 	upstreamBaseURL := c.String("upstream-base-url")
+	federateTopicsRaw := c.StringSlice("federate-topic")
+	federateMessageHeaders := c.Bool("federate-message-headers")
+	kafkaBrokers := c.StringSlice("kafka-brokers")
+	kafkaTopic := c.String("kafka-topic")
+	kafkaKey := c.String("kafka-key")
+	kafkaTLS := c.Bool("kafka-tls")
+	kafkaSASLMechanism := c.String("kafka-sasl-mechanism")
+	kafkaUsername := c.String("kafka-username")
+	kafkaPassword := c.String("kafka-password")
+	metaTopicsRaw := c.StringSlice("meta-topic")
+	uniqueTitleTopicsRaw := c.StringSlice("unique-title-topic")
+	redactPatternsRaw := c.StringSlice("redact-pattern")
+	spamQuarantineTopic := c.String("spam-quarantine-topic")
+	spamPatternsRaw := c.StringSlice("spam-pattern")
+	spamDuplicateThreshold := c.Int("spam-duplicate-threshold")
+	spamDuplicateWindowStr := c.String("spam-duplicate-window")
 	upstreamAccessToken := c.String("upstream-access-token")
 	smtpSenderAddr := c.String("smtp-sender-addr")
 	smtpSenderUser := c.String("smtp-sender-user")
@@ -175,8 +299,23 @@ func execServe(c *cli.Context) error {
 	messageSizeLimitStr := c.String("message-size-limit")
 	messageDelayLimitStr := c.String("message-delay-limit")
 	totalTopicLimit := c.Int("global-topic-limit")
+	topicDefaultFiltersRaw := c.StringSlice("topic-default-filter")
+	enableEmojiTags := c.Bool("enable-emoji-tags")
+	emojiTagMapFile := c.String("emoji-tag-map-file")
+	enableIconCache := c.Bool("enable-icon-cache")
+	iconCacheFileSizeLimitStr := c.String("icon-cache-file-size-limit")
+	expandURLHostsRaw := c.StringSlice("expand-url-host")
+	expandURLMode := c.String("expand-url-mode")
+	expandURLTimeoutStr := c.String("expand-url-timeout")
+	stripANSI := c.Bool("strip-ansi")
+	markdownSanitizePolicy := c.String("markdown-sanitize-policy")
+	markdownDisallowedTags := c.StringSlice("markdown-disallowed-tags")
+	receiptTimeoutStr := c.String("receipt-timeout")
 	visitorSubscriptionLimit := c.Int("visitor-subscription-limit")
+	visitorScheduleLimit := c.Int("visitor-schedule-limit")
+	visitorRepeatLimit := c.Int("visitor-repeat-limit")
 	visitorSubscriberRateLimiting := c.Bool("visitor-subscriber-rate-limiting")
+	topicPublishLimitsRaw := c.StringSlice("topic-publish-limit")
 	visitorAttachmentTotalSizeLimitStr := c.String("visitor-attachment-total-size-limit")
 	visitorAttachmentDailyBandwidthLimitStr := c.String("visitor-attachment-daily-bandwidth-limit")
 	visitorRequestLimitBurst := c.Int("visitor-request-limit-burst")
@@ -186,6 +325,8 @@ func execServe(c *cli.Context) error {
 	visitorEmailLimitBurst := c.Int("visitor-email-limit-burst")
 	visitorEmailLimitReplenishStr := c.String("visitor-email-limit-replenish")
 	behindProxy := c.Bool("behind-proxy")
+	proxyTrustedHosts := util.SplitNoEmpty(c.String("proxy-trusted-hosts"), ",")
+	corsAllowedOriginsRaw := c.StringSlice("cors-allowed-origins")
 	stripeSecretKey := c.String("stripe-secret-key")
 	stripeWebhookKey := c.String("stripe-webhook-key")
 	billingContact := c.String("billing-contact")
@@ -194,14 +335,30 @@ func execServe(c *cli.Context) error {
 	profileListenHTTP := c.String("profile-listen-http")
 
 	// Convert durations
+	tlsSessionTicketRotation, err := util.ParseDuration(tlsSessionTicketRotationStr)
+	if err != nil {
+		return fmt.Errorf("invalid TLS session ticket rotation interval: %s", tlsSessionTicketRotationStr)
+	}
 	cacheDuration, err := util.ParseDuration(cacheDurationStr)
 	if err != nil {
 		return fmt.Errorf("invalid cache duration: %s", cacheDurationStr)
 	}
+	retainPriority, err := util.ParsePriority(retainPriorityStr)
+	if err != nil {
+		return fmt.Errorf("invalid retain priority: %s", retainPriorityStr)
+	}
+	retainDuration, err := util.ParseDuration(retainDurationStr)
+	if err != nil {
+		return fmt.Errorf("invalid retain duration: %s", retainDurationStr)
+	}
 	cacheBatchTimeout, err := util.ParseDuration(cacheBatchTimeoutStr)
 	if err != nil {
 		return fmt.Errorf("invalid cache batch timeout: %s", cacheBatchTimeoutStr)
 	}
+	authLDAPCacheTTL, err := util.ParseDuration(authLDAPCacheTTLStr)
+	if err != nil {
+		return fmt.Errorf("invalid auth LDAP cache TTL: %s", authLDAPCacheTTLStr)
+	}
 	attachmentExpiryDuration, err := util.ParseDuration(attachmentExpiryDurationStr)
 	if err != nil {
 		return fmt.Errorf("invalid attachment expiry duration: %s", attachmentExpiryDurationStr)
@@ -210,6 +367,10 @@ func execServe(c *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("invalid keepalive interval: %s", keepaliveIntervalStr)
 	}
+	shutdownGracePeriod, err := util.ParseDuration(shutdownGracePeriodStr)
+	if err != nil || shutdownGracePeriod < 0 {
+		return fmt.Errorf("invalid shutdown grace period: %s", shutdownGracePeriodStr)
+	}
 	managerInterval, err := util.ParseDuration(managerIntervalStr)
 	if err != nil {
 		return fmt.Errorf("invalid manager interval: %s", managerIntervalStr)
@@ -240,6 +401,26 @@ func execServe(c *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("invalid attachment file size limit: %s", attachmentFileSizeLimitStr)
 	}
+	iconCacheFileSizeLimit, err := util.ParseSize(iconCacheFileSizeLimitStr)
+	if err != nil {
+		return fmt.Errorf("invalid icon cache file size limit: %s", iconCacheFileSizeLimitStr)
+	}
+	expandURLTimeout, err := util.ParseDuration(expandURLTimeoutStr)
+	if err != nil || expandURLTimeout <= 0 {
+		return fmt.Errorf("invalid expand URL timeout: %s", expandURLTimeoutStr)
+	}
+	receiptTimeout, err := util.ParseDuration(receiptTimeoutStr)
+	if err != nil || receiptTimeout <= 0 {
+		return fmt.Errorf("invalid receipt timeout: %s", receiptTimeoutStr)
+	}
+	corsAllowedOrigins, err := parseCORSAllowedOrigins(corsAllowedOriginsRaw)
+	if err != nil {
+		return err
+	}
+	expandURLHosts := make([]string, 0)
+	for _, host := range expandURLHostsRaw {
+		expandURLHosts = append(expandURLHosts, strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www."))
+	}
 	visitorAttachmentTotalSizeLimit, err := util.ParseSize(visitorAttachmentTotalSizeLimitStr)
 	if err != nil {
 		return fmt.Errorf("invalid visitor attachment total size limit: %s", visitorAttachmentTotalSizeLimitStr)
@@ -254,6 +435,10 @@ func execServe(c *cli.Context) error {
 	// Check values
 	if firebaseKeyFile != "" && !util.FileExists(firebaseKeyFile) {
 		return errors.New("if set, FCM key file must exist")
+	} else if apnsKeyFile != "" && !util.FileExists(apnsKeyFile) {
+		return errors.New("if set, APNs key file must exist")
+	} else if apnsKeyFile != "" && (apnsKeyID == "" || apnsTeamID == "" || apnsBundleID == "" || apnsDeviceFile == "") {
+		return errors.New("if apns-key-file is set, apns-key-id, apns-team-id, apns-bundle-id and apns-device-file must also be set")
 	} else if webPushPublicKey != "" && (webPushPrivateKey == "" || webPushFile == "" || webPushEmailAddress == "" || baseURL == "") {
 		return errors.New("if web push is enabled, web-push-private-key, web-push-public-key, web-push-file, web-push-email-address, and base-url should be set. run 'ntfy webpush keys' to generate keys")
 	} else if keepaliveInterval < 5*time.Second {
@@ -262,6 +447,8 @@ func execServe(c *cli.Context) error {
 		return errors.New("manager interval cannot be lower than five seconds")
 	} else if cacheDuration > 0 && cacheDuration < managerInterval {
 		return errors.New("cache duration cannot be lower than manager interval")
+	} else if retainPriority > 0 && (cacheDuration == 0 || retainDuration <= cacheDuration) {
+		return errors.New("if retain-priority is set, the cache must be enabled and retain-duration must be longer than cache-duration")
 	} else if keyFile != "" && !util.FileExists(keyFile) {
 		return errors.New("if set, key file must exist")
 	} else if certFile != "" && !util.FileExists(certFile) {
@@ -274,6 +461,12 @@ func execServe(c *cli.Context) error {
 		return errors.New("if smtp-server-listen is set, smtp-server-domain must also be set")
 	} else if attachmentCacheDir != "" && baseURL == "" {
 		return errors.New("if attachment-cache-dir is set, base-url must also be set")
+	} else if attachmentCacheDir != "" && attachmentS3Bucket != "" {
+		return errors.New("attachment-cache-dir and attachment-s3-bucket cannot both be set")
+	} else if attachmentS3Bucket != "" && (attachmentS3Endpoint == "" || attachmentS3AccessKey == "" || attachmentS3SecretKey == "") {
+		return errors.New("if attachment-s3-bucket is set, attachment-s3-endpoint, attachment-s3-access-key and attachment-s3-secret-key must also be set")
+	} else if attachmentS3Bucket != "" && baseURL == "" {
+		return errors.New("if attachment-s3-bucket is set, base-url must also be set")
 	} else if baseURL != "" {
 		u, err := url.Parse(baseURL)
 		if err != nil {
@@ -291,8 +484,38 @@ func execServe(c *cli.Context) error {
 		return errors.New("if upstream-base-url is set, base-url must also be set")
 	} else if upstreamBaseURL != "" && baseURL != "" && baseURL == upstreamBaseURL {
 		return errors.New("base-url and upstream-base-url cannot be identical, you'll likely want to set upstream-base-url to https://ntfy.sh, see https://ntfy.sh/docs/config/#ios-instant-notifications")
+	} else if emojiTagMapFile != "" && !enableEmojiTags {
+		return errors.New("cannot set emoji-tag-map-file if enable-emoji-tags is false")
+	} else if expandURLMode != server.ExpandURLModeRewrite && expandURLMode != server.ExpandURLModeAnnotate {
+		return fmt.Errorf("expand-url-mode must be '%s' or '%s'", server.ExpandURLModeRewrite, server.ExpandURLModeAnnotate)
+	} else if markdownSanitizePolicy != "" && markdownSanitizePolicy != server.MarkdownSanitizePolicySafe && markdownSanitizePolicy != server.MarkdownSanitizePolicyStrict {
+		return fmt.Errorf("markdown-sanitize-policy must be '%s' or '%s'", server.MarkdownSanitizePolicySafe, server.MarkdownSanitizePolicyStrict)
+	} else if len(markdownDisallowedTags) > 0 && markdownSanitizePolicy != server.MarkdownSanitizePolicySafe {
+		return fmt.Errorf("if markdown-disallowed-tags is set, markdown-sanitize-policy must be '%s'", server.MarkdownSanitizePolicySafe)
+	} else if enableIconCache && attachmentCacheDir == "" && attachmentS3Bucket == "" {
+		return errors.New("if enable-icon-cache is set, attachment-cache-dir or attachment-s3-bucket must also be set")
+	} else if len(federateTopicsRaw) > 0 && baseURL == "" {
+		return errors.New("if federate-topic is set, base-url must also be set")
+	} else if len(kafkaBrokers) > 0 && kafkaTopic == "" {
+		return errors.New("if kafka-brokers is set, kafka-topic must also be set")
+	} else if kafkaKey != "topic" && kafkaKey != "id" {
+		return errors.New("if set, kafka-key must be 'topic' or 'id'")
+	} else if kafkaSASLMechanism != "" && !util.Contains([]string{"plain", "scram-sha-256", "scram-sha-512"}, kafkaSASLMechanism) {
+		return errors.New("if set, kafka-sasl-mechanism must be 'plain', 'scram-sha-256' or 'scram-sha-512'")
+	} else if kafkaSASLMechanism != "" && (kafkaUsername == "" || kafkaPassword == "") {
+		return errors.New("if kafka-sasl-mechanism is set, kafka-username and kafka-password must also be set")
 	} else if authFile == "" && (enableSignup || enableLogin || enableReservations || stripeSecretKey != "") {
 		return errors.New("cannot set enable-signup, enable-login, enable-reserve-topics, or stripe-secret-key if auth-file is not set")
+	} else if subscribeURLSecret != "" && authFile == "" {
+		return errors.New("if subscribe-url-secret is set, auth-file must also be set")
+	} else if subscribeURLSecret != "" && len(subscribeURLSecret) < 32 {
+		return errors.New("subscribe-url-secret must be at least 32 characters long")
+	} else if authLDAPURL != "" && (authFile == "" || authLDAPBaseDN == "") {
+		return errors.New("if auth-ldap-url is set, auth-file and auth-ldap-base-dn must also be set")
+	} else if authLDAPURL != "" && !strings.HasPrefix(authLDAPURL, "ldap://") && !strings.HasPrefix(authLDAPURL, "ldaps://") {
+		return errors.New("if set, auth-ldap-url must start with ldap:// or ldaps://")
+	} else if authLDAPURL != "" && !strings.Contains(authLDAPUserFilter, "%s") {
+		return errors.New("auth-ldap-user-filter must contain %s, which is replaced with the username")
 	} else if enableSignup && !enableLogin {
 		return errors.New("cannot set enable-signup without also setting enable-login")
 	} else if stripeSecretKey != "" && (stripeWebhookKey == "" || baseURL == "") {
@@ -323,6 +546,126 @@ func execServe(c *cli.Context) error {
 		return errors.New("if set, auth-default-access must start set to 'read-write', 'read-only', 'write-only' or 'deny-all'")
 	}
 
+	// Default subscribe filters
+	topicDefaultFilters, err := parseTopicDefaultFilters(topicDefaultFiltersRaw)
+	if err != nil {
+		return err
+	}
+
+	// HTML tags removed from Markdown messages
+	if len(markdownDisallowedTags) == 0 {
+		markdownDisallowedTags = server.DefaultMarkdownDisallowedTags
+	}
+
+	// Per-topic cache durations
+	topicCacheDurations, err := parseTopicCacheDurations(topicCacheDurationsRaw)
+	if err != nil {
+		return err
+	}
+
+	// Topics without cache
+	for _, pattern := range noCacheTopics {
+		if !topicPatternRegex.MatchString(pattern) {
+			return fmt.Errorf("invalid no-cache-topics entry %s, must be a topic name, optionally with * wildcards", pattern)
+		}
+	}
+
+	// Topics with poll results ordered by priority
+	for _, pattern := range priorityOrderedTopics {
+		if !topicPatternRegex.MatchString(pattern) {
+			return fmt.Errorf("invalid priority-ordered-topics entry %s, must be a topic name, optionally with * wildcards", pattern)
+		}
+	}
+
+	// Disallowed topic patterns
+	disallowedTopicPatterns := make([]*regexp.Regexp, 0)
+	for _, pattern := range disallowedTopicPatternsRaw {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid disallowed-topic-pattern %s: %s", pattern, err.Error())
+		}
+		disallowedTopicPatterns = append(disallowedTopicPatterns, re)
+	}
+
+	// Redact patterns
+	redactPatterns := make([]*regexp.Regexp, 0)
+	for _, pattern := range redactPatternsRaw {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid redact-pattern %s: %s", pattern, err.Error())
+		}
+		redactPatterns = append(redactPatterns, re)
+	}
+
+	// Spam trap
+	spamPatterns := make([]*regexp.Regexp, 0)
+	for _, pattern := range spamPatternsRaw {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid spam-pattern %s: %s", pattern, err.Error())
+		}
+		spamPatterns = append(spamPatterns, re)
+	}
+	spamDuplicateWindow, err := util.ParseDuration(spamDuplicateWindowStr)
+	if err != nil || spamDuplicateWindow <= 0 {
+		return fmt.Errorf("invalid spam duplicate window: %s", spamDuplicateWindowStr)
+	}
+	if spamQuarantineTopic != "" && !topicRegex.MatchString(spamQuarantineTopic) {
+		return fmt.Errorf("invalid spam-quarantine-topic %s, must be a valid topic name", spamQuarantineTopic)
+	} else if spamQuarantineTopic != "" && len(spamPatterns) == 0 && spamDuplicateThreshold <= 0 {
+		return errors.New("if spam-quarantine-topic is set, spam-pattern or spam-duplicate-threshold must also be set")
+	} else if spamQuarantineTopic == "" && (len(spamPatterns) > 0 || spamDuplicateThreshold > 0) {
+		return errors.New("if spam-pattern or spam-duplicate-threshold is set, spam-quarantine-topic must also be set")
+	} else if spamDuplicateThreshold < 0 {
+		return errors.New("if set, spam-duplicate-threshold must be positive")
+	}
+
+	// Federated topics
+	attachmentFetchCredentials, err := parseAttachmentFetchCredentials(attachmentFetchCredentialsRaw)
+	if err != nil {
+		return err
+	} else if len(attachmentFetchCredentials) > 0 && attachmentCacheDir == "" && attachmentS3Bucket == "" {
+		return errors.New("if attachment-fetch-credential is set, attachment-cache-dir or attachment-s3-bucket must also be set")
+	}
+	federatedTopics, err := parseFederatedTopics(federateTopicsRaw)
+	if err != nil {
+		return err
+	}
+
+	// Meta-topics
+	metaTopics, err := parseMetaTopics(metaTopicsRaw)
+	if err != nil {
+		return err
+	}
+
+	// Unique titles
+	uniqueTitleTopics, err := parseUniqueTitleTopics(uniqueTitleTopicsRaw)
+	if err != nil {
+		return err
+	}
+
+	// Topic publish limits
+	topicPublishLimits, err := parseTopicPublishLimits(topicPublishLimitsRaw)
+	if err != nil {
+		return err
+	}
+
+	// Firebase priority routes
+	firebasePriorityRoutes, err := parseFirebasePriorityRoutes(firebasePriorityRoutesRaw)
+	if err != nil {
+		return err
+	}
+
+	// LDAP group permissions
+	authLDAPGroupAccess := make(map[string][]user.Grant)
+	for _, entry := range authLDAPGroupAccessRaw {
+		group, grant, err := user.ParseGroupGrant(entry)
+		if err != nil {
+			return fmt.Errorf("invalid auth-ldap-group-access entry %s: %s", entry, err.Error())
+		}
+		authLDAPGroupAccess[group] = append(authLDAPGroupAccess[group], grant)
+	}
+
 	// Special case: Unset default
 	if listenHTTP == "-" {
 		listenHTTP = ""
@@ -338,6 +681,15 @@ func execServe(c *cli.Context) error {
 		}
 		visitorRequestLimitExemptIPs = append(visitorRequestLimitExemptIPs, ips...)
 	}
+	proxyTrustedIPs := make([]netip.Prefix, 0)
+	for _, host := range proxyTrustedHosts {
+		ips, err := parseIPHostPrefix(host)
+		if err != nil {
+			log.Warn("cannot resolve host %s: %s, ignoring trusted proxy", host, err.Error())
+			continue
+		}
+		proxyTrustedIPs = append(proxyTrustedIPs, ips...)
+	}
 
 	// Stripe things
 	if stripeSecretKey != "" {
@@ -356,27 +708,77 @@ func execServe(c *cli.Context) error {
 	conf.ListenHTTPS = listenHTTPS
 	conf.ListenUnix = listenUnix
 	conf.ListenUnixMode = fs.FileMode(listenUnixMode)
+	conf.ListenGRPC = listenGRPC
 	conf.KeyFile = keyFile
 	conf.CertFile = certFile
+	conf.TLSSessionTicketRotation = tlsSessionTicketRotation
 	conf.FirebaseKeyFile = firebaseKeyFile
+	conf.APNSKeyFile = apnsKeyFile
+	conf.APNSKeyID = apnsKeyID
+	conf.APNSTeamID = apnsTeamID
+	conf.APNSBundleID = apnsBundleID
+	conf.APNSProduction = apnsProduction
+	conf.APNSDeviceFile = apnsDeviceFile
+	conf.FirebasePriorityRoutes = firebasePriorityRoutes
 	conf.CacheFile = cacheFile
 	conf.CacheDuration = cacheDuration
+	conf.RetainPriority = retainPriority
+	conf.RetainDuration = retainDuration
+	conf.TopicCacheDurations = topicCacheDurations
+	conf.NoCacheTopics = noCacheTopics
+	conf.PriorityOrderedTopics = priorityOrderedTopics
 	conf.CacheStartupQueries = cacheStartupQueries
 	conf.CacheBatchSize = cacheBatchSize
 	conf.CacheBatchTimeout = cacheBatchTimeout
 	conf.AuthFile = authFile
 	conf.AuthStartupQueries = authStartupQueries
 	conf.AuthDefault = authDefault
+	conf.AuthLDAPURL = authLDAPURL
+	conf.AuthLDAPBindDN = authLDAPBindDN
+	conf.AuthLDAPBindPassword = authLDAPBindPassword
+	conf.AuthLDAPBaseDN = authLDAPBaseDN
+	conf.AuthLDAPUserFilter = authLDAPUserFilter
+	conf.AuthLDAPGroupAttribute = authLDAPGroupAttribute
+	conf.AuthLDAPAdminGroups = authLDAPAdminGroups
+	conf.AuthLDAPGroupAccess = authLDAPGroupAccess
+	conf.AuthLDAPCacheTTL = authLDAPCacheTTL
+	conf.SubscribeURLSecret = subscribeURLSecret
 	conf.AttachmentCacheDir = attachmentCacheDir
+	conf.AttachmentS3Endpoint = attachmentS3Endpoint
+	conf.AttachmentS3Bucket = attachmentS3Bucket
+	conf.AttachmentS3Region = attachmentS3Region
+	conf.AttachmentS3AccessKey = attachmentS3AccessKey
+	conf.AttachmentS3SecretKey = attachmentS3SecretKey
 	conf.AttachmentTotalSizeLimit = attachmentTotalSizeLimit
 	conf.AttachmentFileSizeLimit = attachmentFileSizeLimit
 	conf.AttachmentExpiryDuration = attachmentExpiryDuration
+	conf.AttachmentDedupTopics = attachmentDedupTopics
+	conf.AttachmentFetchCredentials = attachmentFetchCredentials
 	conf.KeepaliveInterval = keepaliveInterval
+	conf.ShutdownGracePeriod = shutdownGracePeriod
 	conf.ManagerInterval = managerInterval
 	conf.DisallowedTopics = disallowedTopics
+	conf.DisallowedTopicPatterns = disallowedTopicPatterns
+	conf.RequireTitleTopics = requireTitleTopics
 	conf.WebRoot = webRoot
 	conf.UpstreamBaseURL = upstreamBaseURL
 	conf.UpstreamAccessToken = upstreamAccessToken
+	conf.FederatedTopics = federatedTopics
+	conf.FederationMessageHeaders = federateMessageHeaders
+	conf.KafkaBrokers = kafkaBrokers
+	conf.KafkaTopic = kafkaTopic
+	conf.KafkaKey = kafkaKey
+	conf.KafkaTLS = kafkaTLS
+	conf.KafkaSASLMechanism = kafkaSASLMechanism
+	conf.KafkaUsername = kafkaUsername
+	conf.KafkaPassword = kafkaPassword
+	conf.MetaTopics = metaTopics
+	conf.UniqueTitleTopics = uniqueTitleTopics
+	conf.RedactPatterns = redactPatterns
+	conf.SpamQuarantineTopic = spamQuarantineTopic
+	conf.SpamPatterns = spamPatterns
+	conf.SpamDuplicateThreshold = spamDuplicateThreshold
+	conf.SpamDuplicateWindow = spamDuplicateWindow
 	conf.SMTPSenderAddr = smtpSenderAddr
 	conf.SMTPSenderUser = smtpSenderUser
 	conf.SMTPSenderPass = smtpSenderPass
@@ -391,7 +793,21 @@ func execServe(c *cli.Context) error {
 	conf.MessageSizeLimit = int(messageSizeLimit)
 	conf.MessageDelayMax = messageDelayLimit
 	conf.TotalTopicLimit = totalTopicLimit
+	conf.TopicDefaultFilters = topicDefaultFilters
+	conf.EnableEmojiTags = enableEmojiTags
+	conf.EmojiTagMapFile = emojiTagMapFile
+	conf.EnableIconCache = enableIconCache
+	conf.IconCacheFileSizeLimit = iconCacheFileSizeLimit
+	conf.ExpandURLHosts = expandURLHosts
+	conf.ExpandURLMode = expandURLMode
+	conf.ExpandURLTimeout = expandURLTimeout
+	conf.StripANSI = stripANSI
+	conf.MarkdownSanitizePolicy = markdownSanitizePolicy
+	conf.MarkdownDisallowedTags = markdownDisallowedTags
+	conf.ReceiptTimeout = receiptTimeout
 	conf.VisitorSubscriptionLimit = visitorSubscriptionLimit
+	conf.VisitorScheduleLimit = visitorScheduleLimit
+	conf.VisitorRepeatLimit = visitorRepeatLimit
 	conf.VisitorAttachmentTotalSizeLimit = visitorAttachmentTotalSizeLimit
 	conf.VisitorAttachmentDailyBandwidthLimit = visitorAttachmentDailyBandwidthLimit
 	conf.VisitorRequestLimitBurst = visitorRequestLimitBurst
@@ -401,7 +817,10 @@ func execServe(c *cli.Context) error {
 	conf.VisitorEmailLimitBurst = visitorEmailLimitBurst
 	conf.VisitorEmailLimitReplenish = visitorEmailLimitReplenish
 	conf.VisitorSubscriberRateLimiting = visitorSubscriberRateLimiting
+	conf.TopicPublishLimits = topicPublishLimits
 	conf.BehindProxy = behindProxy
+	conf.ProxyTrustedPrefixes = proxyTrustedIPs
+	conf.CORSAllowedOrigins = corsAllowedOrigins
 	conf.StripeSecretKey = stripeSecretKey
 	conf.StripeWebhookKey = stripeWebhookKey
 	conf.BillingContact = billingContact
@@ -425,7 +844,11 @@ func execServe(c *cli.Context) error {
 	s, err := server.New(conf)
 	if err != nil {
 		log.Fatal(err.Error())
-	} else if err := s.Run(); err != nil {
+	}
+	if conf.ShutdownGracePeriod > 0 {
+		go sigHandlerShutdown(s)
+	}
+	if err := s.Run(); err != nil {
 		log.Fatal(err.Error())
 	}
 	log.Info("Exiting.")
@@ -448,6 +871,279 @@ func sigHandlerConfigReload(config string) {
 	}
 }
 
+// sigHandlerShutdown drains the server on the first SIGTERM or SIGINT, see server.Shutdown. A second signal
+// terminates the process right away, since the default signal handling is restored.
+func sigHandlerShutdown(s *server.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	signal.Stop(sigs)
+	log.Info("Received %s, shutting down gracefully ...", sig.String())
+	s.Shutdown()
+}
+
+// parseTopicDefaultFilters parses the topic-default-filter entries (TOPIC:FILTER) into a topic -> filter map. Since
+// string slice flags are split by comma, entries without a topic are the continuation of the previous entry, e.g.
+// "firehose:priority=high,urgent" is passed as "firehose:priority=high" and "urgent".
+func parseTopicDefaultFilters(entries []string) (map[string]string, error) {
+	filters := make(map[string]string)
+	var lastTopic string
+	for _, entry := range entries {
+		topic, filter, ok := strings.Cut(entry, ":")
+		if !ok && lastTopic != "" {
+			filters[lastTopic] += "," + strings.TrimSpace(entry)
+			continue
+		} else if !ok || strings.TrimSpace(topic) == "" || strings.TrimSpace(filter) == "" {
+			return nil, fmt.Errorf("invalid topic-default-filter entry %s, expected format TOPIC:FILTER", entry)
+		}
+		lastTopic = strings.TrimSpace(topic)
+		filters[lastTopic] = strings.TrimSpace(filter)
+	}
+	return filters, nil
+}
+
+// parseCORSAllowedOrigins parses the cors-allowed-origins entries into a list of normalized origins (lowercase
+// scheme://host[:port], no trailing slash), so they can be compared against the Origin header of a request
+func parseCORSAllowedOrigins(entries []string) ([]string, error) {
+	origins := make([]string, 0)
+	for _, entry := range entries {
+		origin := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), "/")
+		if origin == "*" {
+			origins = append(origins, origin)
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid cors-allowed-origins entry %s, expected origin like https://dashboard.example.com", entry)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// parseTopicCacheDurations parses the topic-cache-duration entries (TOPIC:DURATION) into a topic -> duration map
+func parseTopicCacheDurations(entries []string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, entry := range entries {
+		topic, durationStr, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || !topicRegex.MatchString(topic) {
+			return nil, fmt.Errorf("invalid topic-cache-duration entry %s, expected format TOPIC:DURATION", entry)
+		}
+		duration, err := util.ParseDuration(durationStr)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid topic-cache-duration entry %s, duration must be positive, e.g. 30d", entry)
+		}
+		durations[topic] = duration
+	}
+	return durations, nil
+}
+
+// parseAttachmentFetchCredentials parses the attachment-fetch-credential entries ([USER,...@]HOST=USER:PASS or
+// [USER,...@]HOST=TOKEN). Values that contain a colon are treated as username and password, all others as bearer
+// token. The optional list of ntfy users before the host restricts who may use the credential. Since usernames
+// may contain "@" and hosts may not, the list is split off at the last "@".
+func parseAttachmentFetchCredentials(entries []string) ([]*server.AttachmentFetchCredential, error) {
+	credentials := make([]*server.AttachmentFetchCredential, 0)
+	for _, entry := range entries {
+		host, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		var users []string
+		if i := strings.LastIndex(host, "@"); i != -1 {
+			for _, username := range strings.Split(host[:i], ",") {
+				username = strings.TrimSpace(username)
+				if !user.AllowedUsername(username) {
+					return nil, fmt.Errorf("invalid attachment-fetch-credential entry %s, invalid username %s", entry, username)
+				}
+				users = append(users, username)
+			}
+			host = host[i+1:]
+		}
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" || value == "" || strings.ContainsAny(host, "/@ ") {
+			return nil, fmt.Errorf("invalid attachment-fetch-credential entry %s, expected format [USER,...@]HOST=USER:PASS or [USER,...@]HOST=TOKEN", entry)
+		}
+		cred := &server.AttachmentFetchCredential{Host: host, Users: users}
+		if username, password, ok := strings.Cut(value, ":"); ok {
+			cred.Username, cred.Password = username, password
+		} else {
+			cred.Token = value
+		}
+		credentials = append(credentials, cred)
+	}
+	return credentials, nil
+}
+
+// parseFederatedTopics parses the federate-topic entries (TOPIC:REMOTE-TOPIC-URL[:TOKEN]). Since the URL contains
+// colons itself, the token is only split off if the last part looks like an access token (tk_...).
+func parseFederatedTopics(entries []string) ([]*server.FederatedTopic, error) {
+	federatedTopics := make([]*server.FederatedTopic, 0)
+	for _, entry := range entries {
+		topic, remoteURL, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("invalid federate-topic entry %s, expected format TOPIC:REMOTE-TOPIC-URL[:TOKEN]", entry)
+		}
+		var token string
+		if i := strings.LastIndex(remoteURL, ":"); i != -1 && strings.HasPrefix(remoteURL[i+1:], "tk_") {
+			remoteURL, token = remoteURL[:i], remoteURL[i+1:]
+		}
+		u, err := url.Parse(remoteURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return nil, fmt.Errorf("invalid federate-topic entry %s, remote topic URL must be a valid topic URL, e.g. https://ntfy.example.com/mytopic", entry)
+		}
+		federatedTopics = append(federatedTopics, &server.FederatedTopic{
+			Topic:     topic,
+			RemoteURL: remoteURL,
+			Token:     token,
+		})
+	}
+	return federatedTopics, nil
+}
+
+// parseMetaTopics parses the meta-topic entries (NAME:TOPIC1+TOPIC2[+...]). Meta-topics cannot contain other
+// meta-topics, and each name may only be defined once.
+func parseMetaTopics(entries []string) ([]*server.MetaTopic, error) {
+	metaTopics := make([]*server.MetaTopic, 0)
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		name, topicsStr, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || !topicRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid meta-topic entry %s, expected format NAME:TOPIC1+TOPIC2[+...]", entry)
+		} else if names[name] {
+			return nil, fmt.Errorf("invalid meta-topic entry %s, meta-topic %s is defined more than once", entry, name)
+		}
+		topics := util.SplitNoEmpty(topicsStr, "+")
+		if len(topics) == 0 {
+			return nil, fmt.Errorf("invalid meta-topic entry %s, expected format NAME:TOPIC1+TOPIC2[+...]", entry)
+		}
+		for i, topic := range topics {
+			topics[i] = strings.TrimSpace(topic)
+			if !topicRegex.MatchString(topics[i]) {
+				return nil, fmt.Errorf("invalid meta-topic entry %s, topic %s is not a valid topic name", entry, topics[i])
+			}
+		}
+		names[name] = true
+		metaTopics = append(metaTopics, &server.MetaTopic{
+			Name:   name,
+			Topics: topics,
+		})
+	}
+	for _, metaTopic := range metaTopics {
+		for _, topic := range metaTopic.Topics {
+			if names[topic] {
+				return nil, fmt.Errorf("invalid meta-topic %s, topic %s is a meta-topic itself, nesting meta-topics is not supported", metaTopic.Name, topic)
+			}
+		}
+	}
+	return metaTopics, nil
+}
+
+// parseUniqueTitleTopics parses the unique-title-topic entries (TOPIC:MODE[:WINDOW]), where MODE is "suppress" or
+// "update". If the window is not set, server.DefaultUniqueTitleWindow is used.
+func parseUniqueTitleTopics(entries []string) ([]*server.UniqueTitleTopic, error) {
+	uniqueTitleTopics := make([]*server.UniqueTitleTopic, 0)
+	topics := make(map[string]bool)
+	for _, entry := range entries {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) < 2 || len(parts) > 3 || !topicRegex.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid unique-title-topic entry %s, expected format TOPIC:MODE[:WINDOW]", entry)
+		} else if topics[parts[0]] {
+			return nil, fmt.Errorf("invalid unique-title-topic entry %s, topic %s is defined more than once", entry, parts[0])
+		} else if parts[1] != server.UniqueTitleModeSuppress && parts[1] != server.UniqueTitleModeUpdate {
+			return nil, fmt.Errorf("invalid unique-title-topic entry %s, mode must be '%s' or '%s'", entry, server.UniqueTitleModeSuppress, server.UniqueTitleModeUpdate)
+		}
+		window := server.DefaultUniqueTitleWindow
+		if len(parts) == 3 {
+			var err error
+			window, err = util.ParseDuration(parts[2])
+			if err != nil || window <= 0 {
+				return nil, fmt.Errorf("invalid unique-title-topic entry %s, window must be a positive duration, e.g. 30m", entry)
+			}
+		}
+		topics[parts[0]] = true
+		uniqueTitleTopics = append(uniqueTitleTopics, &server.UniqueTitleTopic{
+			Topic:  parts[0],
+			Mode:   parts[1],
+			Window: window,
+		})
+	}
+	return uniqueTitleTopics, nil
+}
+
+// parseTopicPublishLimits parses the topic-publish-limit entries (TOPIC-PATTERN:COUNT/INTERVAL), e.g. alerts:10/1m
+func parseTopicPublishLimits(entries []string) ([]*server.TopicPublishLimit, error) {
+	limits := make([]*server.TopicPublishLimit, 0)
+	for _, entry := range entries {
+		pattern, limitStr, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || !topicPatternRegex.MatchString(pattern) {
+			return nil, fmt.Errorf("invalid topic-publish-limit entry %s, expected format TOPIC-PATTERN:COUNT/INTERVAL", entry)
+		}
+		countStr, intervalStr, ok := strings.Cut(limitStr, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid topic-publish-limit entry %s, expected format TOPIC-PATTERN:COUNT/INTERVAL", entry)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid topic-publish-limit entry %s, count must be a positive number", entry)
+		}
+		interval, err := util.ParseDuration(intervalStr)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid topic-publish-limit entry %s, interval must be a positive duration, e.g. 1m", entry)
+		}
+		limits = append(limits, &server.TopicPublishLimit{
+			Pattern:  pattern,
+			Limit:    count,
+			Interval: interval,
+		})
+	}
+	return limits, nil
+}
+
+// parseFirebasePriorityRoutes parses the firebase-priority-route entries (MIN[-MAX]:FCM-PRIORITY[:APNS-PRIORITY]), where
+// MIN and MAX are message priorities (1-5, or their names), FCM-PRIORITY is "high" or "normal", and APNS-PRIORITY
+// is 10, 5 or 1. Priority ranges must not overlap.
+func parseFirebasePriorityRoutes(entries []string) ([]*server.FirebasePriorityRoute, error) {
+	routes := make([]*server.FirebasePriorityRoute, 0)
+	for _, entry := range entries {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid firebase-priority-route entry %s, expected format MIN[-MAX]:FCM-PRIORITY[:APNS-PRIORITY]", entry)
+		}
+		minStr, maxStr, ok := strings.Cut(parts[0], "-")
+		if !ok {
+			maxStr = minStr
+		}
+		minPriority, err := util.ParsePriority(minStr)
+		if err != nil || minPriority == 0 {
+			return nil, fmt.Errorf("invalid firebase-priority-route entry %s, invalid priority %s", entry, minStr)
+		}
+		maxPriority, err := util.ParsePriority(maxStr)
+		if err != nil || maxPriority == 0 || maxPriority < minPriority {
+			return nil, fmt.Errorf("invalid firebase-priority-route entry %s, invalid priority range %s", entry, parts[0])
+		}
+		if parts[1] != server.FirebasePriorityHigh && parts[1] != server.FirebasePriorityNormal {
+			return nil, fmt.Errorf("invalid firebase-priority-route entry %s, FCM priority must be '%s' or '%s'", entry, server.FirebasePriorityHigh, server.FirebasePriorityNormal)
+		}
+		var apnsPriority string
+		if len(parts) == 3 {
+			apnsPriority = parts[2]
+			if apnsPriority != "10" && apnsPriority != "5" && apnsPriority != "1" {
+				return nil, fmt.Errorf("invalid firebase-priority-route entry %s, APNs priority must be 10, 5 or 1", entry)
+			}
+		}
+		for _, route := range routes {
+			if minPriority <= route.MaxPriority && maxPriority >= route.MinPriority {
+				return nil, fmt.Errorf("invalid firebase-priority-route entry %s, priority range overlaps with another entry", entry)
+			}
+		}
+		routes = append(routes, &server.FirebasePriorityRoute{
+			MinPriority:  minPriority,
+			MaxPriority:  maxPriority,
+			FCMPriority:  parts[1],
+			APNSPriority: apnsPriority,
+		})
+	}
+	return routes, nil
+}
+
 func parseIPHostPrefix(host string) (prefixes []netip.Prefix, err error) {
 	// Try parsing as prefix, e.g. 10.0.1.0/24
 	prefix, err := netip.ParsePrefix(host)
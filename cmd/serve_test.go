@@ -13,6 +13,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/client"
+	"heckel.io/ntfy/v2/server"
 	"heckel.io/ntfy/v2/test"
 	"heckel.io/ntfy/v2/util"
 )
@@ -84,6 +85,194 @@ func TestIP_Host_Parsing(t *testing.T) {
 	}
 }
 
+func TestParseTopicDefaultFilters(t *testing.T) {
+	filters, err := parseTopicDefaultFilters([]string{"firehose:priority=high", "urgent", "deploys: tags=prod "})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{
+		"firehose": "priority=high,urgent",
+		"deploys":  "tags=prod",
+	}, filters)
+
+	_, err = parseTopicDefaultFilters([]string{"priority=high"})
+	require.Error(t, err)
+	_, err = parseTopicDefaultFilters([]string{"firehose:"})
+	require.Error(t, err)
+}
+
+func TestParseCORSAllowedOrigins(t *testing.T) {
+	origins, err := parseCORSAllowedOrigins([]string{"https://Dashboard.example.com/", " http://localhost:3000"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"https://dashboard.example.com", "http://localhost:3000"}, origins)
+
+	_, err = parseCORSAllowedOrigins([]string{"dashboard.example.com"})
+	require.Error(t, err)
+	_, err = parseCORSAllowedOrigins([]string{"https://dashboard.example.com/app"})
+	require.Error(t, err)
+}
+
+func TestParseTopicCacheDurations(t *testing.T) {
+	durations, err := parseTopicCacheDurations([]string{"audit-log:30d", " heartbeat:10m"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]time.Duration{
+		"audit-log": 30 * 24 * time.Hour,
+		"heartbeat": 10 * time.Minute,
+	}, durations)
+
+	_, err = parseTopicCacheDurations([]string{"audit-log"})
+	require.Error(t, err)
+	_, err = parseTopicCacheDurations([]string{"audit-log:0"})
+	require.Error(t, err)
+	_, err = parseTopicCacheDurations([]string{"audit*:1h"})
+	require.Error(t, err)
+}
+
+func TestParseAttachmentFetchCredentials(t *testing.T) {
+	credentials, err := parseAttachmentFetchCredentials([]string{
+		"Files.Example.com=phil:my:pass",
+		" nas.lan:8443=tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2",
+		"phil,ben@example.com@nas.lan=backup:pass",
+	})
+	require.Nil(t, err)
+	require.Equal(t, []*server.AttachmentFetchCredential{
+		{Host: "files.example.com", Username: "phil", Password: "my:pass"},
+		{Host: "nas.lan:8443", Token: "tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2"},
+		{Host: "nas.lan", Username: "backup", Password: "pass", Users: []string{"phil", "ben@example.com"}},
+	}, credentials)
+
+	_, err = parseAttachmentFetchCredentials([]string{"files.example.com"})
+	require.Error(t, err)
+	_, err = parseAttachmentFetchCredentials([]string{"files.example.com="})
+	require.Error(t, err)
+	_, err = parseAttachmentFetchCredentials([]string{"https://files.example.com=phil:mypass"})
+	require.Error(t, err)
+	_, err = parseAttachmentFetchCredentials([]string{"phil,@files.example.com=phil:mypass"})
+	require.Error(t, err)
+}
+
+func TestParseTopicPublishLimits(t *testing.T) {
+	limits, err := parseTopicPublishLimits([]string{
+		"alerts:10/1m",
+		" ci-*:100/1h",
+	})
+	require.Nil(t, err)
+	require.Equal(t, []*server.TopicPublishLimit{
+		{Pattern: "alerts", Limit: 10, Interval: time.Minute},
+		{Pattern: "ci-*", Limit: 100, Interval: time.Hour},
+	}, limits)
+
+	_, err = parseTopicPublishLimits([]string{"alerts:10"})
+	require.Error(t, err)
+	_, err = parseTopicPublishLimits([]string{"alerts:0/1m"})
+	require.Error(t, err)
+	_, err = parseTopicPublishLimits([]string{"alerts:10/forever"})
+	require.Error(t, err)
+	_, err = parseTopicPublishLimits([]string{"al/erts:10/1m"})
+	require.Error(t, err)
+}
+
+func TestParseFederatedTopics(t *testing.T) {
+	federatedTopics, err := parseFederatedTopics([]string{
+		"global-alerts:https://ntfy.dc2.example.com/global-alerts:tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2",
+		" deploys:http://ntfy.internal:8080/deploys",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(federatedTopics))
+	require.Equal(t, "global-alerts", federatedTopics[0].Topic)
+	require.Equal(t, "https://ntfy.dc2.example.com/global-alerts", federatedTopics[0].RemoteURL)
+	require.Equal(t, "tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2", federatedTopics[0].Token)
+	require.Equal(t, "deploys", federatedTopics[1].Topic)
+	require.Equal(t, "http://ntfy.internal:8080/deploys", federatedTopics[1].RemoteURL)
+	require.Equal(t, "", federatedTopics[1].Token)
+
+	_, err = parseFederatedTopics([]string{"https://ntfy.dc2.example.com/global-alerts"})
+	require.Error(t, err)
+	_, err = parseFederatedTopics([]string{"global-alerts:https://ntfy.dc2.example.com"})
+	require.Error(t, err)
+	_, err = parseFederatedTopics([]string{"global-alerts:ftp://ntfy.dc2.example.com/global-alerts"})
+	require.Error(t, err)
+}
+
+func TestParseMetaTopics(t *testing.T) {
+	metaTopics, err := parseMetaTopics([]string{
+		"dashboard:alerts+backups",
+		" ci:builds + deploys",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(metaTopics))
+	require.Equal(t, "dashboard", metaTopics[0].Name)
+	require.Equal(t, []string{"alerts", "backups"}, metaTopics[0].Topics)
+	require.Equal(t, "ci", metaTopics[1].Name)
+	require.Equal(t, []string{"builds", "deploys"}, metaTopics[1].Topics)
+
+	_, err = parseMetaTopics([]string{"dashboard"})
+	require.Error(t, err)
+	_, err = parseMetaTopics([]string{"dashboard:"})
+	require.Error(t, err)
+	_, err = parseMetaTopics([]string{"dash/board:alerts"})
+	require.Error(t, err)
+	_, err = parseMetaTopics([]string{"dashboard:alerts+back/ups"})
+	require.Error(t, err)
+	_, err = parseMetaTopics([]string{"dashboard:alerts", "dashboard:backups"})
+	require.Error(t, err)
+	_, err = parseMetaTopics([]string{"dashboard:alerts+ci", "ci:builds"})
+	require.Error(t, err)
+}
+
+func TestParseUniqueTitleTopics(t *testing.T) {
+	uniqueTitleTopics, err := parseUniqueTitleTopics([]string{
+		"alerts:suppress:30m",
+		" deploys:update",
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(uniqueTitleTopics))
+	require.Equal(t, "alerts", uniqueTitleTopics[0].Topic)
+	require.Equal(t, server.UniqueTitleModeSuppress, uniqueTitleTopics[0].Mode)
+	require.Equal(t, 30*time.Minute, uniqueTitleTopics[0].Window)
+	require.Equal(t, "deploys", uniqueTitleTopics[1].Topic)
+	require.Equal(t, server.UniqueTitleModeUpdate, uniqueTitleTopics[1].Mode)
+	require.Equal(t, server.DefaultUniqueTitleWindow, uniqueTitleTopics[1].Window)
+
+	_, err = parseUniqueTitleTopics([]string{"alerts"})
+	require.Error(t, err)
+	_, err = parseUniqueTitleTopics([]string{"alerts:drop"})
+	require.Error(t, err)
+	_, err = parseUniqueTitleTopics([]string{"alerts:suppress:soon"})
+	require.Error(t, err)
+	_, err = parseUniqueTitleTopics([]string{"alerts:suppress:0"})
+	require.Error(t, err)
+	_, err = parseUniqueTitleTopics([]string{"ale/rts:suppress"})
+	require.Error(t, err)
+	_, err = parseUniqueTitleTopics([]string{"alerts:suppress", "alerts:update"})
+	require.Error(t, err)
+}
+
+func TestParseFirebasePriorityRoutes(t *testing.T) {
+	routes, err := parseFirebasePriorityRoutes([]string{
+		"4-5:high:10",
+		" 1-low:normal:5",
+		"default:normal",
+	})
+	require.Nil(t, err)
+	require.Equal(t, []*server.FirebasePriorityRoute{
+		{MinPriority: 4, MaxPriority: 5, FCMPriority: "high", APNSPriority: "10"},
+		{MinPriority: 1, MaxPriority: 2, FCMPriority: "normal", APNSPriority: "5"},
+		{MinPriority: 3, MaxPriority: 3, FCMPriority: "normal", APNSPriority: ""},
+	}, routes)
+
+	_, err = parseFirebasePriorityRoutes([]string{"4-5"})
+	require.Error(t, err)
+	_, err = parseFirebasePriorityRoutes([]string{"5-4:high"})
+	require.Error(t, err)
+	_, err = parseFirebasePriorityRoutes([]string{"0-5:high"})
+	require.Error(t, err)
+	_, err = parseFirebasePriorityRoutes([]string{"4-5:urgent"})
+	require.Error(t, err)
+	_, err = parseFirebasePriorityRoutes([]string{"4-5:high:7"})
+	require.Error(t, err)
+	_, err = parseFirebasePriorityRoutes([]string{"4-5:high", "3-4:normal"})
+	require.Error(t, err)
+}
+
 func newEmptyFile(t *testing.T) string {
 	filename := filepath.Join(t.TempDir(), "empty")
 	require.Nil(t, os.WriteFile(filename, []byte{}, 0600))
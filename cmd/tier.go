@@ -55,6 +55,7 @@ var cmdTier = &cli.Command{
 				&cli.StringFlag{Name: "attachment-total-size-limit", Value: defaultAttachmentTotalSizeLimit, Usage: "total size limit of attachments for the user"},
 				&cli.StringFlag{Name: "attachment-expiry-duration", Value: defaultAttachmentExpiryDuration, Usage: "duration after which attachments are deleted"},
 				&cli.StringFlag{Name: "attachment-bandwidth-limit", Value: defaultAttachmentBandwidthLimit, Usage: "daily bandwidth limit for attachment uploads/downloads"},
+				&cli.StringFlag{Name: "message-size-limit", Value: "0", Usage: "message size limit, capped by the server-wide limit (0 = server-wide limit)"},
 				&cli.StringFlag{Name: "stripe-monthly-price-id", Usage: "Monthly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.StringFlag{Name: "stripe-yearly-price-id", Usage: "Yearly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.BoolFlag{Name: "ignore-exists", Usage: "if the tier already exists, perform no action and exit"},
@@ -79,6 +80,7 @@ Examples:
     --attachment-total-size-limit=1G \
     --attachment-expiry-duration=12h \
     --attachment-bandwidth-limit=5G \
+    --message-size-limit=8k \
     pro
 `,
 		},
@@ -99,6 +101,7 @@ Examples:
 				&cli.StringFlag{Name: "attachment-total-size-limit", Usage: "total size limit of attachments for the user"},
 				&cli.StringFlag{Name: "attachment-expiry-duration", Usage: "duration after which attachments are deleted"},
 				&cli.StringFlag{Name: "attachment-bandwidth-limit", Usage: "daily bandwidth limit for attachment uploads/downloads"},
+				&cli.StringFlag{Name: "message-size-limit", Usage: "message size limit, capped by the server-wide limit (0 = server-wide limit)"},
 				&cli.StringFlag{Name: "stripe-monthly-price-id", Usage: "Monthly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.StringFlag{Name: "stripe-yearly-price-id", Usage: "Yearly Stripe price ID for paid tiers (e.g. price_12345)"},
 			},
@@ -211,6 +214,10 @@ func execTierAdd(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	messageSizeLimit, err := util.ParseSize(c.String("message-size-limit"))
+	if err != nil {
+		return err
+	}
 	tier := &user.Tier{
 		ID:                       "", // Generated
 		Code:                     code,
@@ -224,6 +231,7 @@ func execTierAdd(c *cli.Context) error {
 		AttachmentTotalSizeLimit: attachmentTotalSizeLimit,
 		AttachmentExpiryDuration: attachmentExpiryDuration,
 		AttachmentBandwidthLimit: attachmentBandwidthLimit,
+		MessageSizeLimit:         messageSizeLimit,
 		StripeMonthlyPriceID:     c.String("stripe-monthly-price-id"),
 		StripeYearlyPriceID:      c.String("stripe-yearly-price-id"),
 	}
@@ -301,6 +309,12 @@ func execTierChange(c *cli.Context) error {
 			return err
 		}
 	}
+	if c.IsSet("message-size-limit") {
+		tier.MessageSizeLimit, err = util.ParseSize(c.String("message-size-limit"))
+		if err != nil {
+			return err
+		}
+	}
 	if c.IsSet("stripe-monthly-price-id") {
 		tier.StripeMonthlyPriceID = c.String("stripe-monthly-price-id")
 	}
@@ -370,5 +384,6 @@ func printTier(c *cli.Context, tier *user.Tier) {
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment total size limit: %s\n", util.FormatSizeHuman(tier.AttachmentTotalSizeLimit))
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment expiry duration: %s (%d seconds)\n", tier.AttachmentExpiryDuration.String(), int64(tier.AttachmentExpiryDuration.Seconds()))
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment daily bandwidth limit: %s\n", util.FormatSizeHuman(tier.AttachmentBandwidthLimit))
+	fmt.Fprintf(c.App.ErrWriter, "- Message size limit: %s (0 = server-wide limit)\n", util.FormatSizeHuman(tier.MessageSizeLimit))
 	fmt.Fprintf(c.App.ErrWriter, "- Stripe prices (monthly/yearly): %s\n", prices)
 }
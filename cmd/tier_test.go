@@ -36,6 +36,7 @@ func TestCLI_Tier_AddListChangeDelete(t *testing.T) {
 		"--attachment-expiry-duration=1d",
 		"--attachment-total-size-limit=10G",
 		"--attachment-bandwidth-limit=100G",
+		"--message-size-limit=2k",
 		"--stripe-monthly-price-id=price_991",
 		"--stripe-yearly-price-id=price_992",
 		"pro",
@@ -47,6 +48,7 @@ func TestCLI_Tier_AddListChangeDelete(t *testing.T) {
 	require.Contains(t, stderr.String(), "- Attachment file size limit: 100.0 MB")
 	require.Contains(t, stderr.String(), "- Attachment expiry duration: 24h")
 	require.Contains(t, stderr.String(), "- Attachment total size limit: 10.0 GB")
+	require.Contains(t, stderr.String(), "- Message size limit: 2.0 KB (0 = server-wide limit)")
 	require.Contains(t, stderr.String(), "- Stripe prices (monthly/yearly): price_991 / price_992")
 
 	app, _, _, stderr = newTestApp()
@@ -117,7 +117,7 @@ func execTokenAdd(c *cli.Context) error {
 	} else if err != nil {
 		return err
 	}
-	token, err := manager.CreateToken(u.ID, label, expires, netip.IPv4Unspecified())
+	token, err := manager.CreateToken(u.ID, label, expires, netip.IPv4Unspecified(), "")
 	if err != nil {
 		return err
 	}
@@ -191,7 +191,7 @@ func execTokenList(c *cli.Context) error {
 		usersWithTokens++
 		fmt.Fprintf(c.App.ErrWriter, "user %s\n", u.Name)
 		for _, t := range tokens {
-			var label, expires string
+			var label, expires, userAgent string
 			if t.Label != "" {
 				label = fmt.Sprintf(" (%s)", t.Label)
 			}
@@ -200,7 +200,10 @@ func execTokenList(c *cli.Context) error {
 			} else {
 				expires = fmt.Sprintf("expires %s", t.Expires.Format(time.RFC822))
 			}
-			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s, accessed from %s at %s\n", t.Value, label, expires, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822))
+			if t.LastUserAgent != "" {
+				userAgent = fmt.Sprintf(" via %s", t.LastUserAgent)
+			}
+			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s, accessed from %s%s at %s\n", t.Value, label, expires, t.LastOrigin.String(), userAgent, t.LastAccess.Format(time.RFC822))
 		}
 	}
 	if usersWithTokens == 0 {
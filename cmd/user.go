@@ -131,6 +131,32 @@ as messages per day, attachment file sizes, etc.
 Example:
   ntfy user change-tier phil pro   # Change tier to "pro" for user "phil"  
   ntfy user change-tier phil -     # Remove tier from user "phil" entirely 
+`,
+		},
+		{
+			Name:      "change-limits",
+			Aliases:   []string{"chl"},
+			Usage:     "Overrides the rate limits of a user",
+			UsageText: "ntfy user change-limits [--request-limit=N] [--message-limit=N] [--message-size-limit=SIZE] [--reset] USERNAME",
+			Action:    execUserChangeLimits,
+			Flags: []cli.Flag{
+				&cli.Int64Flag{Name: "request-limit", Usage: "requests per minute"},
+				&cli.Int64Flag{Name: "message-limit", Usage: "daily message limit"},
+				&cli.StringFlag{Name: "message-size-limit", Usage: "maximum size of a message"},
+				&cli.BoolFlag{Name: "reset", Usage: "remove all limit overrides from the user"},
+			},
+			Description: `Override individual rate limits of the given user.
+
+This command can be used to bump (or lower) the limits of a specific user, without
+changing their tier. Overrides take precedence over the tier limits and the server
+defaults, but the message size limit cannot exceed the server's message-size-limit.
+Limits that are not passed are left unchanged, and a value of 0 removes the
+individual override.
+
+Example:
+  ntfy user change-limits --message-limit=50000 phil     # Allow 50k messages per day for user "phil"
+  ntfy user change-limits --message-size-limit=16k phil  # Allow messages of up to 16k for user "phil"
+  ntfy user change-limits --reset phil                   # Remove all overrides from user "phil"
 `,
 		},
 		{
@@ -309,6 +335,56 @@ func execUserChangeTier(c *cli.Context) error {
 	return nil
 }
 
+func execUserChangeLimits(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == "" {
+		return errors.New("username expected, type 'ntfy user change-limits --help' for help")
+	} else if username == userEveryone || username == user.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	u, err := manager.User(username)
+	if err == user.ErrUserNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	if c.Bool("reset") {
+		if err := manager.ChangeLimitOverrides(username, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "removed limit overrides from user %s\n", username)
+		return nil
+	}
+	overrides := &user.LimitOverrides{}
+	if u.LimitOverrides != nil {
+		*overrides = *u.LimitOverrides
+	}
+	if c.IsSet("request-limit") {
+		overrides.RequestLimit = c.Int64("request-limit")
+	}
+	if c.IsSet("message-limit") {
+		overrides.MessageLimit = c.Int64("message-limit")
+	}
+	if c.IsSet("message-size-limit") {
+		overrides.MessageSizeLimit, err = util.ParseSize(c.String("message-size-limit"))
+		if err != nil {
+			return err
+		}
+	}
+	if *overrides == (user.LimitOverrides{}) {
+		overrides = nil
+	}
+	if err := manager.ChangeLimitOverrides(username, overrides); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "changed limit overrides for user %s\n", username)
+	return nil
+}
+
 func execUserList(c *cli.Context) error {
 	manager, err := createUserManager(c)
 	if err != nil {
@@ -91,6 +91,35 @@ func TestCLI_User_ChangeRole(t *testing.T) {
 	require.Contains(t, stderr.String(), "changed role for user phil to admin")
 }
 
+func TestCLI_User_ChangeLimits(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	// Add user
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Contains(t, stderr.String(), "user phil added with role user")
+
+	// Change limits
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-limits", "--message-limit=5000", "--message-size-limit=8k", "phil"))
+	require.Contains(t, stderr.String(), "changed limit overrides for user phil")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "- limit overrides: 0 requests/minute, 5000 messages/day, 8K message size")
+
+	// Reset limits
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-limits", "--reset", "phil"))
+	require.Contains(t, stderr.String(), "removed limit overrides from user phil")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.NotContains(t, stderr.String(), "limit overrides")
+}
+
 func TestCLI_User_Delete(t *testing.T) {
 	s, conf, port := newTestServerWithAuth(t)
 	defer test.StopServer(t, s, port)
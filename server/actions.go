@@ -14,6 +14,8 @@ const (
 	actionIDLength = 10
 	actionEOF      = rune(0)
 	actionsMax     = 3
+
+	actionHTTPBodyMaxLength = 4096
 )
 
 const (
@@ -23,9 +25,10 @@ const (
 )
 
 var (
-	actionsAll      = []string{actionView, actionBroadcast, actionHTTP}
-	actionsWithURL  = []string{actionView, actionHTTP}
-	actionsKeyRegex = regexp.MustCompile(`^([-.\w]+)\s*=\s*`)
+	actionsAll        = []string{actionView, actionBroadcast, actionHTTP}
+	actionsWithURL    = []string{actionView, actionHTTP}
+	actionHTTPMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	actionsKeyRegex   = regexp.MustCompile(`^([-.\w]+)\s*=\s*`)
 )
 
 type actionParser struct {
@@ -68,6 +71,15 @@ func parseActions(s string) (actions []*action, err error) {
 			return nil, fmt.Errorf("parameter 'url' is required for action '%s'", action.Action)
 		} else if action.Action == actionHTTP && util.Contains([]string{"GET", "HEAD"}, action.Method) && action.Body != "" {
 			return nil, fmt.Errorf("parameter 'body' cannot be set if method is %s", action.Method)
+		} else if action.Action == actionHTTP && action.Method != "" && !util.Contains(actionHTTPMethods, action.Method) {
+			return nil, fmt.Errorf("parameter 'method' cannot be '%s', valid values are 'GET', 'POST', 'PUT' and 'DELETE'", action.Method)
+		} else if action.Action == actionHTTP && len(action.Body) > actionHTTPBodyMaxLength {
+			return nil, fmt.Errorf("parameter 'body' cannot be longer than %d bytes", actionHTTPBodyMaxLength)
+		}
+		for name := range action.Headers {
+			if name == "" {
+				return nil, fmt.Errorf("parameter 'headers' cannot contain an empty header name")
+			}
 		}
 	}
 
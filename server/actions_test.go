@@ -2,6 +2,7 @@ package server
 
 import (
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -70,6 +71,22 @@ func TestParseActions(t *testing.T) {
 	require.Equal(t, "application/json", actions[0].Headers["Content-Type"])
 	require.Equal(t, "Basic sdasffsf", actions[0].Headers["Authorization"])
 
+	// HTTP action with JSON body and headers, simple format
+	actions, err = parseActions(`http, Close door, https://api.mygarage.lan/, method=delete, headers.Authorization=Bearer zAzsx1sk, headers.X-Door-ID=2, body='{"action": "close", "door": 2}'`)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(actions))
+	require.Equal(t, "DELETE", actions[0].Method)
+	require.Equal(t, map[string]string{"Authorization": "Bearer zAzsx1sk", "X-Door-ID": "2"}, actions[0].Headers)
+	require.Equal(t, `{"action": "close", "door": 2}`, actions[0].Body)
+
+	// HTTP action with JSON body and headers, JSON format
+	actions, err = parseActions(`[{"action":"http","label":"Close door","url":"https://api.mygarage.lan/","method":"post","headers":{"Authorization":"Bearer zAzsx1sk","Content-Type":"application/json"},"body":"{\"action\": \"close\"}"}]`)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(actions))
+	require.Equal(t, "POST", actions[0].Method)
+	require.Equal(t, map[string]string{"Authorization": "Bearer zAzsx1sk", "Content-Type": "application/json"}, actions[0].Headers)
+	require.Equal(t, `{"action": "close"}`, actions[0].Body)
+
 	// Quotes
 	actions, err = parseActions(`action=http, "Look ma, \"quotes\"; and semicolons", url=http://example.com`)
 	require.Nil(t, err)
@@ -169,6 +186,18 @@ func TestParseActions(t *testing.T) {
 	_, err = parseActions(`action=http, label=a label, url=http://ntfy.sh, method=HEAD, body=somebody`)
 	require.EqualError(t, err, "parameter 'body' cannot be set if method is HEAD")
 
+	_, err = parseActions(`action=http, label=a label, url=http://ntfy.sh, method=PATCH`)
+	require.EqualError(t, err, "parameter 'method' cannot be 'PATCH', valid values are 'GET', 'POST', 'PUT' and 'DELETE'")
+
+	_, err = parseActions(`[{"action":"http","label":"a label","url":"http://ntfy.sh","method":"CONNECT"}]`)
+	require.EqualError(t, err, "parameter 'method' cannot be 'CONNECT', valid values are 'GET', 'POST', 'PUT' and 'DELETE'")
+
+	_, err = parseActions(`action=http, label=a label, url=http://ntfy.sh, body=` + strings.Repeat("x", 4097))
+	require.EqualError(t, err, "parameter 'body' cannot be longer than 4096 bytes")
+
+	_, err = parseActions(`action=http, label=a label, url=http://ntfy.sh, headers.=x`)
+	require.EqualError(t, err, "parameter 'headers' cannot contain an empty header name")
+
 	_, err = parseActions(`[ invalid json ]`)
 	require.EqualError(t, err, "JSON error: invalid character 'i' looking for beginning of value")
 
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // SQLite driver
+)
+
+const (
+	apnsDeviceTopicLimit = 50 // Maximum number of topics per device
+)
+
+var (
+	errAPNSUserIDCannotBeEmpty = errors.New("user ID cannot be empty")
+)
+
+const (
+	createAPNSDevicesTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS device (
+			token TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			updated_at INT NOT NULL,
+			PRIMARY KEY (token, topic)
+		);
+		CREATE INDEX IF NOT EXISTS idx_topic ON device (topic);
+		CREATE INDEX IF NOT EXISTS idx_user_id ON device (user_id);
+		CREATE TABLE IF NOT EXISTS schemaVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+		COMMIT;
+	`
+	selectAPNSDeviceTokensForTopicQuery = `SELECT token FROM device WHERE topic = ? ORDER BY token`
+	insertAPNSDeviceQuery               = `INSERT INTO device (token, topic, user_id, updated_at) VALUES (?, ?, ?, ?)`
+	deleteAPNSDeviceByTokenQuery        = `DELETE FROM device WHERE token = ?`
+	deleteAPNSDeviceByUserIDQuery       = `DELETE FROM device WHERE user_id = ?`
+)
+
+// Schema management queries
+const (
+	currentAPNSSchemaVersion     = 1
+	insertAPNSSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
+	selectAPNSSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
+)
+
+// apnsStore stores the APNs device tokens of iOS devices, and the topics they are registered for
+type apnsStore struct {
+	db *sql.DB
+}
+
+func newAPNSStore(filename string) (*apnsStore, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupAPNSDB(db); err != nil {
+		return nil, err
+	}
+	return &apnsStore{
+		db: db,
+	}, nil
+}
+
+func setupAPNSDB(db *sql.DB) error {
+	// If 'schemaVersion' table does not exist, this must be a new database
+	rows, err := db.Query(selectAPNSSchemaVersionQuery)
+	if err != nil {
+		return setupNewAPNSDB(db)
+	}
+	return rows.Close()
+}
+
+func setupNewAPNSDB(db *sql.DB) error {
+	if _, err := db.Exec(createAPNSDevicesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(insertAPNSSchemaVersion, currentAPNSSchemaVersion); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpsertDevice registers the device token for the given topics and user ID. It replaces all existing topics of the
+// device, so an empty list of topics removes the device.
+func (c *apnsStore) UpsertDevice(token, userID string, topics []string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(deleteAPNSDeviceByTokenQuery, token); err != nil {
+		return err
+	}
+	updatedAt := time.Now().Unix()
+	for _, topic := range topics {
+		if _, err := tx.Exec(insertAPNSDeviceQuery, token, topic, userID, updatedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeviceTokensForTopic returns the tokens of all devices registered for the given topic
+func (c *apnsStore) DeviceTokensForTopic(topic string) ([]string, error) {
+	rows, err := c.db.Query(selectAPNSDeviceTokensForTopicQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]string, 0)
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RemoveDevice removes the device with the given token for all topics
+func (c *apnsStore) RemoveDevice(token string) error {
+	_, err := c.db.Exec(deleteAPNSDeviceByTokenQuery, token)
+	return err
+}
+
+// RemoveDevicesByUserID removes all devices registered by the given user ID
+func (c *apnsStore) RemoveDevicesByUserID(userID string) error {
+	if userID == "" {
+		return errAPNSUserIDCannotBeEmpty
+	}
+	_, err := c.db.Exec(deleteAPNSDeviceByUserIDQuery, userID)
+	return err
+}
+
+// Close closes the underlying database connection
+func (c *apnsStore) Close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testAPNSDeviceToken = strings.Repeat("ab", 32)
+
+func TestAPNSStore_UpsertDevice_DeviceTokensForTopic(t *testing.T) {
+	apns := newTestAPNSStore(t)
+	token2 := strings.Repeat("cd", 32)
+
+	require.Nil(t, apns.UpsertDevice(testAPNSDeviceToken, "u_1234", []string{"mytopic", "alerts"}))
+	require.Nil(t, apns.UpsertDevice(token2, "", []string{"mytopic"}))
+
+	tokens, err := apns.DeviceTokensForTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []string{testAPNSDeviceToken, token2}, tokens)
+	tokens, err = apns.DeviceTokensForTopic("alerts")
+	require.Nil(t, err)
+	require.Equal(t, []string{testAPNSDeviceToken}, tokens)
+
+	// Topics are replaced
+	require.Nil(t, apns.UpsertDevice(testAPNSDeviceToken, "u_1234", []string{"alerts"}))
+	tokens, err = apns.DeviceTokensForTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []string{token2}, tokens)
+}
+
+func TestAPNSStore_RemoveDevice(t *testing.T) {
+	apns := newTestAPNSStore(t)
+
+	require.Nil(t, apns.UpsertDevice(testAPNSDeviceToken, "", []string{"mytopic", "alerts"}))
+	require.Nil(t, apns.RemoveDevice(testAPNSDeviceToken))
+
+	tokens, err := apns.DeviceTokensForTopic("mytopic")
+	require.Nil(t, err)
+	require.Empty(t, tokens)
+	tokens, err = apns.DeviceTokensForTopic("alerts")
+	require.Nil(t, err)
+	require.Empty(t, tokens)
+}
+
+func TestAPNSStore_RemoveDevicesByUserID(t *testing.T) {
+	apns := newTestAPNSStore(t)
+	token2 := strings.Repeat("cd", 32)
+
+	require.Nil(t, apns.UpsertDevice(testAPNSDeviceToken, "u_1234", []string{"mytopic"}))
+	require.Nil(t, apns.UpsertDevice(token2, "u_5678", []string{"mytopic"}))
+	require.Nil(t, apns.RemoveDevicesByUserID("u_1234"))
+
+	tokens, err := apns.DeviceTokensForTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []string{token2}, tokens)
+	require.Equal(t, errAPNSUserIDCannotBeEmpty, apns.RemoveDevicesByUserID(""))
+}
+
+func newTestAPNSStore(t *testing.T) *apnsStore {
+	apns, err := newAPNSStore(filepath.Join(t.TempDir(), "apns.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() { apns.Close() })
+	return apns
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"io/fs"
 	"net/netip"
+	"regexp"
 	"time"
 
 	"heckel.io/ntfy/v2/user"
@@ -16,8 +17,12 @@ const (
 	DefaultKeepaliveInterval                    = 45 * time.Second // Not too frequently to save battery (Android read timeout used to be 77s!)
 	DefaultManagerInterval                      = time.Minute
 	DefaultDelayedSenderInterval                = 10 * time.Second
+	DefaultFederationRetryDelay                 = 5 * time.Second
+	DefaultReceiptTimeout                       = time.Minute
+	DefaultKafkaKey                             = "topic"
 	DefaultMessageDelayMin                      = 10 * time.Second
 	DefaultMessageDelayMax                      = 3 * 24 * time.Hour
+	DefaultMessageRepeatIntervalMin             = time.Minute
 	DefaultFirebaseKeepaliveInterval            = 3 * time.Hour    // ~control topic (Android), not too frequently to save battery
 	DefaultFirebasePollInterval                 = 20 * time.Minute // ~poll topic (iOS), max. 2-3 times per hour (see docs)
 	DefaultFirebaseQuotaExceededPenaltyDuration = 10 * time.Minute // Time that over-users are locked out of Firebase if it returns "quota exceeded"
@@ -40,16 +45,22 @@ const (
 	DefaultAttachmentTotalSizeLimit = int64(5 * 1024 * 1024 * 1024) // 5 GB
 	DefaultAttachmentFileSizeLimit  = int64(15 * 1024 * 1024)       // 15 MB
 	DefaultAttachmentExpiryDuration = 3 * time.Hour
+	DefaultAttachmentS3Region       = "us-east-1"
+	DefaultIconCacheFileSizeLimit   = int64(256 * 1024) // 256 KB
+	DefaultExpandURLTimeout         = 3 * time.Second
 )
 
 // Defines all per-visitor limits
 // - per visitor subscription limit: max number of subscriptions (active HTTP connections) per per-visitor/IP
+// - per visitor schedule limit: max number of active recurring message schedules (X-Cron) per user, or per IP for anonymous visitors
 // - per visitor request limit: max number of PUT/GET/.. requests (here: 60 requests bucket, replenished at a rate of one per 5 seconds)
 // - per visitor email limit: max number of emails (here: 16 email bucket, replenished at a rate of one per hour)
 // - per visitor attachment size limit: total per-visitor attachment size in bytes to be stored on the server
 // - per visitor attachment daily bandwidth limit: number of bytes that can be transferred to/from the server
 const (
 	DefaultVisitorSubscriptionLimit             = 30
+	DefaultVisitorScheduleLimit                 = 10
+	DefaultVisitorRepeatLimit                   = 10
 	DefaultVisitorRequestLimitBurst             = 60
 	DefaultVisitorRequestLimitReplenish         = 5 * time.Second
 	DefaultVisitorMessageDailyLimit             = 0
@@ -80,11 +91,24 @@ type Config struct {
 	ListenHTTPS                          string
 	ListenUnix                           string
 	ListenUnixMode                       fs.FileMode
+	ListenGRPC                           string
 	KeyFile                              string
+	TLSSessionTicketRotation             time.Duration // If >0, TLS session ticket keys are rotated in this interval
 	CertFile                             string
 	FirebaseKeyFile                      string
+	APNSKeyFile                          string // APNs auth key (.p8), enables sending notifications to APNs directly
+	APNSKeyID                            string
+	APNSTeamID                           string
+	APNSBundleID                         string // Bundle ID of the iOS app, sent as APNs topic
+	APNSProduction                       bool   // Use the production APNs environment instead of the sandbox
+	APNSDeviceFile                       string // Database that stores the device tokens and their topics
 	CacheFile                            string
 	CacheDuration                        time.Duration
+	RetainPriority                       int // Messages with at least this priority are kept for RetainDuration, if longer than CacheDuration (0 = disabled)
+	RetainDuration                       time.Duration
+	TopicCacheDurations                  map[string]time.Duration // Topic -> cache duration, overrides CacheDuration (and tier limits) for that topic
+	NoCacheTopics                        []string                 // Topics (or patterns, e.g. telemetry-*) whose messages are never cached
+	PriorityOrderedTopics                []string                 // Topics (or patterns) whose poll results are ordered by priority (highest first), then time
 	CacheStartupQueries                  string
 	CacheBatchSize                       int
 	CacheBatchTimeout                    time.Duration
@@ -93,20 +117,70 @@ type Config struct {
 	AuthDefault                          user.Permission
 	AuthBcryptCost                       int
 	AuthStatsQueueWriterInterval         time.Duration
+	AuthLDAPURL                          string
+	AuthLDAPBindDN                       string
+	AuthLDAPBindPassword                 string
+	AuthLDAPBaseDN                       string
+	AuthLDAPUserFilter                   string
+	AuthLDAPGroupAttribute               string
+	AuthLDAPAdminGroups                  []string
+	AuthLDAPGroupAccess                  map[string][]user.Grant // LDAP group -> topic permissions
+	AuthLDAPCacheTTL                     time.Duration
+	SubscribeURLSecret                   string // Secret used to sign subscribe URLs (?sig=...&exp=...), empty to disable
 	AttachmentCacheDir                   string
+	AttachmentS3Endpoint                 string // S3-compatible object storage for attachments, alternative to AttachmentCacheDir
+	AttachmentS3Bucket                   string
+	AttachmentS3Region                   string
+	AttachmentS3AccessKey                string
+	AttachmentS3SecretKey                string
 	AttachmentTotalSizeLimit             int64
 	AttachmentFileSizeLimit              int64
 	AttachmentExpiryDuration             time.Duration
+	AttachmentDedupTopics                []string                     // Topics on which a new attachment supersedes earlier attachments with the same filename
+	AttachmentFetchCredentials           []*AttachmentFetchCredential // Credentials for hosts from which X-Attach URLs are fetched and cached
 	KeepaliveInterval                    time.Duration
+	ShutdownGracePeriod                  time.Duration // Time to drain subscribers on SIGTERM/SIGINT before closing their connections, 0 to exit immediately
 	ManagerInterval                      time.Duration
 	DisallowedTopics                     []string
-	WebRoot                              string // empty to disable
+	DisallowedTopicPatterns              []*regexp.Regexp // Publishing and subscribing to topics whose name matches are rejected
+	RequireTitleTopics                   []string         // Topics on which messages without a title are rejected
+	EnableEmojiTags                      bool             // If false, tags are never mapped to emojis (e-mails, web app)
+	EmojiTagMapFile                      string           // JSON file mapping custom tags to strings (e.g. emojis), applied when publishing
+	EnableIconCache                      bool             // If true, X-Icon URLs are fetched once and served from the attachment store
+	IconCacheFileSizeLimit               int64
+	ExpandURLHosts                       []string          // URL shortener hosts (e.g. bit.ly) whose URLs are expanded in message bodies, empty to disable
+	ExpandURLMode                        string            // ExpandURLModeRewrite or ExpandURLModeAnnotate
+	ExpandURLTimeout                     time.Duration     // Timeout for resolving a single shortened URL
+	StripANSI                            bool              // If true, ANSI escape codes (e.g. terminal colors) are removed from message bodies
+	MarkdownSanitizePolicy               string            // MarkdownSanitizePolicySafe or MarkdownSanitizePolicyStrict, empty to disable
+	MarkdownDisallowedTags               []string          // HTML tags removed from Markdown messages with MarkdownSanitizePolicySafe
+	ReceiptTimeout                       time.Duration     // Max. time to wait for deliveries before sending a delivery receipt (X-Receipt-URL)
+	RedactPatterns                       []*regexp.Regexp  // Matches in message title/body are redacted in logs and outbound forwarding
+	SpamQuarantineTopic                  string            // If set, suspected spam messages are published to this topic instead, see SpamPatterns
+	SpamPatterns                         []*regexp.Regexp  // Messages whose title/body match are suspected spam, if SpamQuarantineTopic is set
+	SpamDuplicateThreshold               int               // Identical messages from at least this many IP addresses are suspected spam (0 = disabled)
+	SpamDuplicateWindow                  time.Duration     // Time window for SpamDuplicateThreshold
+	TopicDefaultFilters                  map[string]string // Topic -> default subscribe filter, e.g. "priority=high,urgent&tags=prod"
+	WebRoot                              string            // empty to disable
 	DelayedSenderInterval                time.Duration
 	FirebaseKeepaliveInterval            time.Duration
 	FirebasePollInterval                 time.Duration
 	FirebaseQuotaExceededPenaltyDuration time.Duration
+	FirebasePriorityRoutes               []*FirebasePriorityRoute // Message priority ranges -> FCM/APNs delivery options
 	UpstreamBaseURL                      string
 	UpstreamAccessToken                  string
+	FederatedTopics                      []*FederatedTopic // Local topics that are forwarded to topics on remote servers
+	FederationRetryDelay                 time.Duration
+	FederationMessageHeaders             bool     // Also send priority, tags and title as plain-text X-Ntfy-* headers
+	KafkaBrokers                         []string // Bootstrap brokers (host:port); if set, all messages are produced to KafkaTopic
+	KafkaTopic                           string
+	KafkaKey                             string // Record key, either "topic" (ntfy topic) or "id" (message ID)
+	KafkaTLS                             bool   // Connect to the brokers via TLS
+	KafkaSASLMechanism                   string // SASL mechanism, either "plain", "scram-sha-256" or "scram-sha-512"; no SASL if empty
+	KafkaUsername                        string
+	KafkaPassword                        string
+	MetaTopics                           []*MetaTopic        // Named topics that aggregate multiple topics when subscribing
+	UniqueTitleTopics                    []*UniqueTitleTopic // Topics on which recent messages with the same title are suppressed or replaced
 	SMTPSenderAddr                       string
 	SMTPSenderUser                       string
 	SMTPSenderPass                       string
@@ -124,11 +198,14 @@ type Config struct {
 	MetricsListenHTTP                    string
 	ProfileListenHTTP                    string
 	MessageDelayMin                      time.Duration
+	MessageRepeatIntervalMin             time.Duration
 	MessageDelayMax                      time.Duration
 	MessageSizeLimit                     int
 	TotalTopicLimit                      int
 	TotalAttachmentSizeLimit             int64
 	VisitorSubscriptionLimit             int
+	VisitorScheduleLimit                 int
+	VisitorRepeatLimit                   int
 	VisitorAttachmentTotalSizeLimit      int64
 	VisitorAttachmentDailyBandwidthLimit int64
 	VisitorRequestLimitBurst             int
@@ -141,9 +218,11 @@ type Config struct {
 	VisitorAccountCreationLimitReplenish time.Duration
 	VisitorAuthFailureLimitBurst         int
 	VisitorAuthFailureLimitReplenish     time.Duration
-	VisitorStatsResetTime                time.Time // Time of the day at which to reset visitor stats
-	VisitorSubscriberRateLimiting        bool      // Enable subscriber-based rate limiting for UnifiedPush topics
+	VisitorStatsResetTime                time.Time            // Time of the day at which to reset visitor stats
+	VisitorSubscriberRateLimiting        bool                 // Enable subscriber-based rate limiting for UnifiedPush topics
+	TopicPublishLimits                   []*TopicPublishLimit // Publish limits per topic (pattern), regardless of the visitor
 	BehindProxy                          bool
+	ProxyTrustedPrefixes                 []netip.Prefix // If behind proxy, X-Forwarded-Proto/-Host is only used from these addresses (empty = all); also skipped as hops in Forwarded
 	StripeSecretKey                      string
 	StripeWebhookKey                     string
 	StripePriceCacheDuration             time.Duration
@@ -152,8 +231,9 @@ type Config struct {
 	EnableLogin                          bool
 	EnableReservations                   bool // Allow users with role "user" to own/reserve topics
 	EnableMetrics                        bool
-	AccessControlAllowOrigin             string // CORS header field to restrict access from web clients
-	Version                              string // injected by App
+	AccessControlAllowOrigin             string   // CORS header field to restrict access from web clients
+	CORSAllowedOrigins                   []string // If set, CORS headers are only sent to these origins (e.g. https://dashboard.example.com), instead of AccessControlAllowOrigin
+	Version                              string   // injected by App
 	WebPushPrivateKey                    string
 	WebPushPublicKey                     string
 	WebPushFile                          string
@@ -172,11 +252,22 @@ func NewConfig() *Config {
 		ListenHTTPS:                          "",
 		ListenUnix:                           "",
 		ListenUnixMode:                       0,
+		ListenGRPC:                           "",
 		KeyFile:                              "",
+		TLSSessionTicketRotation:             0,
 		CertFile:                             "",
 		FirebaseKeyFile:                      "",
+		APNSKeyFile:                          "",
+		APNSKeyID:                            "",
+		APNSTeamID:                           "",
+		APNSBundleID:                         "",
+		APNSProduction:                       false,
+		APNSDeviceFile:                       "",
 		CacheFile:                            "",
 		CacheDuration:                        DefaultCacheDuration,
+		RetainPriority:                       0,
+		RetainDuration:                       0,
+		TopicCacheDurations:                  make(map[string]time.Duration),
 		CacheStartupQueries:                  "",
 		CacheBatchSize:                       0,
 		CacheBatchTimeout:                    0,
@@ -185,20 +276,67 @@ func NewConfig() *Config {
 		AuthDefault:                          user.PermissionReadWrite,
 		AuthBcryptCost:                       user.DefaultUserPasswordBcryptCost,
 		AuthStatsQueueWriterInterval:         user.DefaultUserStatsQueueWriterInterval,
+		AuthLDAPURL:                          "",
+		AuthLDAPBindDN:                       "",
+		AuthLDAPBindPassword:                 "",
+		AuthLDAPBaseDN:                       "",
+		AuthLDAPUserFilter:                   user.DefaultLDAPUserFilter,
+		AuthLDAPGroupAttribute:               user.DefaultLDAPGroupAttribute,
+		AuthLDAPAdminGroups:                  nil,
+		AuthLDAPGroupAccess:                  nil,
+		AuthLDAPCacheTTL:                     user.DefaultLDAPCacheTTL,
+		SubscribeURLSecret:                   "",
 		AttachmentCacheDir:                   "",
+		AttachmentS3Endpoint:                 "",
+		AttachmentS3Bucket:                   "",
+		AttachmentS3Region:                   DefaultAttachmentS3Region,
+		AttachmentS3AccessKey:                "",
+		AttachmentS3SecretKey:                "",
 		AttachmentTotalSizeLimit:             DefaultAttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:              DefaultAttachmentFileSizeLimit,
 		AttachmentExpiryDuration:             DefaultAttachmentExpiryDuration,
 		KeepaliveInterval:                    DefaultKeepaliveInterval,
+		ShutdownGracePeriod:                  0,
 		ManagerInterval:                      DefaultManagerInterval,
 		DisallowedTopics:                     DefaultDisallowedTopics,
+		DisallowedTopicPatterns:              make([]*regexp.Regexp, 0),
+		EnableEmojiTags:                      true,
+		EmojiTagMapFile:                      "",
+		EnableIconCache:                      false,
+		IconCacheFileSizeLimit:               DefaultIconCacheFileSizeLimit,
+		ExpandURLHosts:                       make([]string, 0),
+		ExpandURLMode:                        ExpandURLModeRewrite,
+		ExpandURLTimeout:                     DefaultExpandURLTimeout,
+		StripANSI:                            false,
+		MarkdownSanitizePolicy:               "",
+		MarkdownDisallowedTags:               DefaultMarkdownDisallowedTags,
+		ReceiptTimeout:                       DefaultReceiptTimeout,
+		RedactPatterns:                       make([]*regexp.Regexp, 0),
+		SpamQuarantineTopic:                  "",
+		SpamPatterns:                         make([]*regexp.Regexp, 0),
+		SpamDuplicateThreshold:               0,
+		SpamDuplicateWindow:                  DefaultSpamDuplicateWindow,
+		TopicDefaultFilters:                  make(map[string]string),
 		WebRoot:                              "/",
 		DelayedSenderInterval:                DefaultDelayedSenderInterval,
 		FirebaseKeepaliveInterval:            DefaultFirebaseKeepaliveInterval,
 		FirebasePollInterval:                 DefaultFirebasePollInterval,
 		FirebaseQuotaExceededPenaltyDuration: DefaultFirebaseQuotaExceededPenaltyDuration,
+		FirebasePriorityRoutes:               make([]*FirebasePriorityRoute, 0),
 		UpstreamBaseURL:                      "",
 		UpstreamAccessToken:                  "",
+		FederatedTopics:                      make([]*FederatedTopic, 0),
+		FederationRetryDelay:                 DefaultFederationRetryDelay,
+		FederationMessageHeaders:             false,
+		KafkaBrokers:                         nil,
+		KafkaTopic:                           "",
+		KafkaKey:                             DefaultKafkaKey,
+		KafkaTLS:                             false,
+		KafkaSASLMechanism:                   "",
+		KafkaUsername:                        "",
+		KafkaPassword:                        "",
+		MetaTopics:                           make([]*MetaTopic, 0),
+		UniqueTitleTopics:                    make([]*UniqueTitleTopic, 0),
 		SMTPSenderAddr:                       "",
 		SMTPSenderUser:                       "",
 		SMTPSenderPass:                       "",
@@ -214,10 +352,13 @@ func NewConfig() *Config {
 		TwilioVerifyService:                  "",
 		MessageSizeLimit:                     DefaultMessageSizeLimit,
 		MessageDelayMin:                      DefaultMessageDelayMin,
+		MessageRepeatIntervalMin:             DefaultMessageRepeatIntervalMin,
 		MessageDelayMax:                      DefaultMessageDelayMax,
 		TotalTopicLimit:                      DefaultTotalTopicLimit,
 		TotalAttachmentSizeLimit:             0,
 		VisitorSubscriptionLimit:             DefaultVisitorSubscriptionLimit,
+		VisitorScheduleLimit:                 DefaultVisitorScheduleLimit,
+		VisitorRepeatLimit:                   DefaultVisitorRepeatLimit,
 		VisitorAttachmentTotalSizeLimit:      DefaultVisitorAttachmentTotalSizeLimit,
 		VisitorAttachmentDailyBandwidthLimit: DefaultVisitorAttachmentDailyBandwidthLimit,
 		VisitorRequestLimitBurst:             DefaultVisitorRequestLimitBurst,
@@ -233,6 +374,7 @@ func NewConfig() *Config {
 		VisitorStatsResetTime:                DefaultVisitorStatsResetTime,
 		VisitorSubscriberRateLimiting:        false,
 		BehindProxy:                          false,
+		ProxyTrustedPrefixes:                 make([]netip.Prefix, 0),
 		StripeSecretKey:                      "",
 		StripeWebhookKey:                     "",
 		StripePriceCacheDuration:             DefaultStripePriceCacheDuration,
@@ -241,6 +383,7 @@ func NewConfig() *Config {
 		EnableLogin:                          false,
 		EnableReservations:                   false,
 		AccessControlAllowOrigin:             "*",
+		CORSAllowedOrigins:                   make([]string, 0),
 		Version:                              "",
 		WebPushPrivateKey:                    "",
 		WebPushPublicKey:                     "",
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	dataMax = 50
+)
+
+// parseData parses the structured key-value data of a message (X-Data header, or "data" field when publishing as JSON).
+// It supports a JSON object (if the string begins with "{"), and a simple comma-separated list of key=value pairs,
+// e.g. "cpu=12%, disk=54%". Values containing commas must use the JSON format.
+func parseData(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	data := make(map[string]string)
+	if strings.HasPrefix(s, "{") {
+		if err := json.Unmarshal([]byte(s), &data); err != nil {
+			return nil, errors.New("JSON object with string values expected")
+		}
+	} else {
+		for _, pair := range strings.Split(s, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("key=value pair expected, got '%s'", strings.TrimSpace(pair))
+			}
+			data[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if len(data) > dataMax {
+		return nil, fmt.Errorf("only %d keys allowed", dataMax)
+	}
+	for key := range data {
+		if key == "" {
+			return nil, errors.New("key must not be empty")
+		}
+	}
+	return data, nil
+}
+
+// renderDataTable renders the data as a Markdown table with the columns "Key" and "Value". Rows are sorted by key,
+// since the order of the keys is not retained.
+func renderDataTable(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var table strings.Builder
+	table.WriteString("| Key | Value |\n|-----|-------|")
+	for _, key := range keys {
+		table.WriteString(fmt.Sprintf("\n| %s | %s |", escapeDataTableCell(key), escapeDataTableCell(data[key])))
+	}
+	return table.String()
+}
+
+// renderDataTableIntoMessage appends the data table to the message body, and enables Markdown formatting
+func renderDataTableIntoMessage(m *message) {
+	if m.Message == "" || m.Message == emptyMessageBody {
+		m.Message = renderDataTable(m.Data)
+	} else {
+		m.Message = m.Message + "\n\n" + renderDataTable(m.Data)
+	}
+	m.ContentType = "text/markdown"
+}
+
+func escapeDataTableCell(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "|", "\\|", "\r", "", "\n", " ").Replace(s)
+}
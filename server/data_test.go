@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseData(t *testing.T) {
+	data, err := parseData("host=nas01, duration = 12m,url=https://example.com/?a=b")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"host": "nas01", "duration": "12m", "url": "https://example.com/?a=b"}, data)
+
+	data, err = parseData(`  {"host":"nas01","volumes":"a, b"}`)
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"host": "nas01", "volumes": "a, b"}, data)
+
+	data, err = parseData("empty=")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"empty": ""}, data)
+
+	_, err = parseData("host=nas01, oops")
+	require.EqualError(t, err, "key=value pair expected, got 'oops'")
+
+	_, err = parseData(`{"count":1}`)
+	require.EqualError(t, err, "JSON object with string values expected")
+
+	_, err = parseData(`{"":"value"}`)
+	require.EqualError(t, err, "key must not be empty")
+}
+
+func TestRenderDataTable(t *testing.T) {
+	table := renderDataTable(map[string]string{
+		"status": "ok",
+		"cmd":    "ls | wc -l",
+		"output": "line1\nline2",
+	})
+	expected := "| Key | Value |\n" +
+		"|-----|-------|\n" +
+		"| cmd | ls \\| wc -l |\n" +
+		"| output | line1 line2 |\n" +
+		"| status | ok |"
+	require.Equal(t, expected, table)
+}
@@ -118,22 +118,51 @@ var (
 	errHTTPBadRequestWebPushEndpointUnknown          = &errHTTP{40039, http.StatusBadRequest, "invalid request: web push endpoint unknown", "", nil}
 	errHTTPBadRequestWebPushTopicCountTooHigh        = &errHTTP{40040, http.StatusBadRequest, "invalid request: too many web push topic subscriptions", "", nil}
 	errHTTPBadRequestTemplateMessageTooLarge         = &errHTTP{40041, http.StatusBadRequest, "invalid request: message or title is too large after replacing template", "https://ntfy.sh/docs/publish/#message-templating", nil}
-	errHTTPBadRequestTemplateMessageNotJSON          = &errHTTP{40042, http.StatusBadRequest, "invalid request: message body must be JSON if templating is enabled", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestTemplateInvalid                 = &errHTTP{40043, http.StatusBadRequest, "invalid request: could not parse template", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestTemplateDisallowedFunctionCalls = &errHTTP{40044, http.StatusBadRequest, "invalid request: template contains disallowed function calls, e.g. template, call, or define", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestTemplateExecuteFailed           = &errHTTP{40045, http.StatusBadRequest, "invalid request: template execution failed", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestInvalidUsername                 = &errHTTP{40046, http.StatusBadRequest, "invalid request: invalid username", "", nil}
+	errHTTPBadRequestCallMenuInvalid                 = &errHTTP{40047, http.StatusBadRequest, "invalid request: call menu invalid", "https://ntfy.sh/docs/publish/#phone-calls", nil}
+	errHTTPBadRequestMessageIDInvalid                = &errHTTP{40048, http.StatusBadRequest, "invalid request: message ID invalid, must be 12 alphanumeric characters", "https://ntfy.sh/docs/publish/#custom-message-id", nil}
+	errHTTPBadRequestConsumeWithoutPoll              = &errHTTP{40049, http.StatusBadRequest, "invalid request: consume is only supported for poll requests", "https://ntfy.sh/docs/subscribe/api/#consume-messages", nil}
+	errHTTPBadRequestConsumeWithoutAuth              = &errHTTP{40050, http.StatusBadRequest, "invalid request: consume requires access control to be enabled on the server", "https://ntfy.sh/docs/subscribe/api/#consume-messages", nil}
+	errHTTPBadRequestRepeatUntilAckInvalid           = &errHTTP{40051, http.StatusBadRequest, "invalid request: repeat-until-ack invalid, expected format <interval>[,<repeats>]", "https://ntfy.sh/docs/publish/#repeat-until-acknowledged", nil}
+	errHTTPBadRequestTopicIsMetaTopic                = &errHTTP{40052, http.StatusBadRequest, "invalid request: topic is a meta-topic, publish to one of its topics instead", "https://ntfy.sh/docs/config/#meta-topics", nil}
+	errHTTPBadRequestDataInvalid                     = &errHTTP{40054, http.StatusBadRequest, "invalid request: data invalid", "https://ntfy.sh/docs/publish/#structured-data", nil}
+	errHTTPBadRequestCronInvalid                     = &errHTTP{40055, http.StatusBadRequest, "invalid request: cron expression or RRULE invalid", "https://ntfy.sh/docs/publish/#recurring-messages", nil}
+	errHTTPBadRequestCronNotAllowed                  = &errHTTP{40056, http.StatusBadRequest, "invalid request: recurring messages cannot be combined with delays, e-mails, phone calls, attachment uploads or disabled caching", "https://ntfy.sh/docs/publish/#recurring-messages", nil}
+	errHTTPBadRequestTitleRequired                   = &errHTTP{40057, http.StatusBadRequest, "invalid request: a title is required on this topic", "https://ntfy.sh/docs/publish/#message-title", nil}
+	errHTTPBadRequestSlackMessageInvalid             = &errHTTP{40058, http.StatusBadRequest, "invalid request: Slack webhook payload has no text or attachments", "https://ntfy.sh/docs/publish/#slack-compatible-webhooks", nil}
+	errHTTPBadRequestMaxMessagesInvalid              = &errHTTP{40059, http.StatusBadRequest, "invalid request: max_messages invalid, must be a positive number", "https://ntfy.sh/docs/subscribe/api/#limit-number-of-messages", nil}
+	errHTTPBadRequestSearchQueryMissing              = &errHTTP{40060, http.StatusBadRequest, "invalid request: search query missing, pass ?q=...", "https://ntfy.sh/docs/subscribe/api/#search-messages", nil}
+	errHTTPBadRequestLocationInvalid                 = &errHTTP{40061, http.StatusBadRequest, "invalid request: location invalid", "https://ntfy.sh/docs/publish/#location", nil}
+	errHTTPBadRequestSubscribeTopicInvalid           = &errHTTP{40062, http.StatusBadRequest, "invalid request: topic missing or invalid, topics must be 1-64 characters of A-Z, a-z, 0-9, _ and -, multiple topics are separated by commas", "https://ntfy.sh/docs/subscribe/api/#topic-names", nil}
+	errHTTPBadRequestEncryptionInvalid               = &errHTTP{40063, http.StatusBadRequest, "invalid request: encryption invalid, only 'client' is supported", "https://ntfy.sh/docs/publish/#encrypted-attachments", nil}
+	errHTTPBadRequestReceiptURLInvalid               = &errHTTP{40064, http.StatusBadRequest, "invalid request: receipt URL invalid", "https://ntfy.sh/docs/publish/#delivery-receipts", nil}
+	errHTTPBadRequestCollapseKeyInvalid              = &errHTTP{40065, http.StatusBadRequest, "invalid request: collapse key invalid, must be 1-64 characters (letters, numbers, '-', '_', '.' and ':')", "https://ntfy.sh/docs/publish/#collapse-keys", nil}
+	errHTTPBadRequestAttachmentNotFetchable          = &errHTTP{40066, http.StatusBadRequest, "invalid request: attachment URL could not be fetched", "https://ntfy.sh/docs/config/#attachments-from-authenticated-hosts", nil}
+	errHTTPBadRequestAPNSDeviceInvalid               = &errHTTP{40067, http.StatusBadRequest, "invalid request: APNs device token or topics invalid", "https://ntfy.sh/docs/config/#apns-direct-delivery", nil}
+	errHTTPBadRequestAckConsumerInvalid              = &errHTTP{40068, http.StatusBadRequest, "invalid request: ack consumer invalid, must be 1-64 characters (letters, numbers, '-' and '_'), and cannot be combined with poll", "https://ntfy.sh/docs/subscribe/api/#acknowledge-deliveries", nil}
+	errHTTPBadRequestMarkdownModeInvalid             = &errHTTP{40069, http.StatusBadRequest, "invalid request: markdown parameter invalid, must be 'strip'", "https://ntfy.sh/docs/subscribe/api/#strip-markdown", nil}
+	errHTTPBadRequestSubscribeURLExpiresInvalid      = &errHTTP{40070, http.StatusBadRequest, "invalid request: subscribe URL expiry must be in the future, and at most 30 days from now", "https://ntfy.sh/docs/subscribe/api/#signed-subscribe-urls", nil}
 	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", "", nil}
 	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication", nil}
+	errHTTPUnauthorizedSubscribeURLExpired           = &errHTTP{40102, http.StatusUnauthorized, "unauthorized: signed subscribe URL expired", "https://ntfy.sh/docs/subscribe/api/#signed-subscribe-urls", nil}
+	errHTTPUnauthorizedTLSRequired                   = &errHTTP{40103, http.StatusUnauthorized, "unauthorized: credentials are only accepted over TLS", "https://ntfy.sh/docs/subscribe/api/#grpc", nil}
 	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication", nil}
+	errHTTPForbiddenTopicDisallowed                  = &errHTTP{40302, http.StatusForbidden, "forbidden: topic name is not allowed on this server", "https://ntfy.sh/docs/config/#disallowed-topic-names", nil}
 	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "conflict: user already exists", "", nil}
 	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "conflict: access control entry for topic or topic pattern already exists", "", nil}
 	errHTTPConflictSubscriptionExists                = &errHTTP{40903, http.StatusConflict, "conflict: topic subscription already exists", "", nil}
 	errHTTPConflictPhoneNumberExists                 = &errHTTP{40904, http.StatusConflict, "conflict: phone number already exists", "", nil}
+	errHTTPConflictMessageIDUnavailable              = &errHTTP{40905, http.StatusConflict, "conflict: message ID is not available, choose a different ID", "https://ntfy.sh/docs/publish/#custom-message-id", nil}
+	errHTTPConflictTitleExists                       = &errHTTP{40906, http.StatusConflict, "conflict: a message with this title was published recently", "https://ntfy.sh/docs/config/#unique-titles", nil}
 	errHTTPGonePhoneVerificationExpired              = &errHTTP{41001, http.StatusGone, "phone number verification expired or does not exist", "", nil}
+	errHTTPPreconditionFailedNoSubscribers           = &errHTTP{41201, http.StatusPreconditionFailed, "precondition failed: topic has no active subscribers", "https://ntfy.sh/docs/publish/#conditional-delivery", nil}
 	errHTTPEntityTooLargeAttachment                  = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPEntityTooLargeMatrixRequest               = &errHTTP{41302, http.StatusRequestEntityTooLarge, "Matrix request is larger than the max allowed length", "", nil}
 	errHTTPEntityTooLargeJSONBody                    = &errHTTP{41303, http.StatusRequestEntityTooLarge, "JSON body too large", "", nil}
+	errHTTPEntityTooLargeMessage                     = &errHTTP{41304, http.StatusRequestEntityTooLarge, "message too large", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitSubscriptions         = &errHTTP{42903, http.StatusTooManyRequests, "limit reached: too many active subscriptions", "https://ntfy.sh/docs/publish/#limitations", nil}
@@ -144,9 +173,14 @@ var (
 	errHTTPTooManyRequestsLimitMessages              = &errHTTP{42908, http.StatusTooManyRequests, "limit reached: daily message quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitAuthFailure           = &errHTTP{42909, http.StatusTooManyRequests, "limit reached: too many auth failures", "https://ntfy.sh/docs/publish/#limitations", nil} // FIXME document limit
 	errHTTPTooManyRequestsLimitCalls                 = &errHTTP{42910, http.StatusTooManyRequests, "limit reached: daily phone call quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
+	errHTTPTooManyRequestsLimitSchedules             = &errHTTP{42911, http.StatusTooManyRequests, "limit reached: too many recurring message schedules", "https://ntfy.sh/docs/publish/#recurring-messages", nil}
+	errHTTPTooManyRequestsLimitTopicMessages         = &errHTTP{42912, http.StatusTooManyRequests, "limit reached: too many messages published to this topic, please slow down", "https://ntfy.sh/docs/config/#topic-publish-limits", nil}
+	errHTTPTooManyRequestsLimitAckConsumers          = &errHTTP{42913, http.StatusTooManyRequests, "limit reached: too many connected ack consumers", "https://ntfy.sh/docs/subscribe/api/#acknowledge-deliveries", nil}
+	errHTTPTooManyRequestsLimitRepeats               = &errHTTP{42914, http.StatusTooManyRequests, "limit reached: too many messages that are repeated until acknowledged", "https://ntfy.sh/docs/publish/#repeat-until-acknowledged", nil}
 	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", "", nil}
 	errHTTPInternalErrorInvalidPath                  = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid path", "", nil}
 	errHTTPInternalErrorMissingBaseURL               = &errHTTP{50003, http.StatusInternalServerError, "internal server error: base-url must be be configured for this feature", "https://ntfy.sh/docs/config/", nil}
 	errHTTPInternalErrorWebPushUnableToPublish       = &errHTTP{50004, http.StatusInternalServerError, "internal server error: unable to publish web push message", "", nil}
+	errHTTPServiceUnavailableShuttingDown            = &errHTTP{50301, http.StatusServiceUnavailable, "service unavailable: server is shutting down, please retry later", "", nil}
 	errHTTPInsufficientStorageUnifiedPush            = &errHTTP{50701, http.StatusInsufficientStorage, "cannot publish to UnifiedPush topic without previously active subscriber", "", nil}
 )
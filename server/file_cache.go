@@ -10,14 +10,28 @@ import (
 	"path/filepath"
 	"regexp"
 	"sync"
+	"time"
 )
 
 var (
 	fileIDRegex      = regexp.MustCompile(fmt.Sprintf(`^[-_A-Za-z0-9]{%d}$`, messageIDLength))
 	errInvalidFileID = errors.New("invalid file ID")
 	errFileExists    = errors.New("file exists")
+	errFileNotFound  = errors.New("file not found")
 )
 
+// attachmentStore stores attachment files by message ID. Attachments are either stored on the local disk (fileCache),
+// or in an S3-compatible object storage (s3Store). Both enforce the total size limit of all attachments.
+type attachmentStore interface {
+	Write(id string, in io.Reader, limiters ...util.Limiter) (int64, error)
+	Read(id string) (reader io.ReadSeekCloser, size int64, modTime time.Time, err error)
+	Remove(ids ...string) error
+	Size() int64
+	Remaining() int64
+}
+
+var _ attachmentStore = (*fileCache)(nil)
+
 type fileCache struct {
 	dir              string
 	totalSizeCurrent int64
@@ -72,6 +86,25 @@ func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (in
 	return size, nil
 }
 
+// Read opens the attachment file. The returned reader is an *os.File, so it can be used with http.ServeContent.
+func (c *fileCache) Read(id string) (io.ReadSeekCloser, int64, time.Time, error) {
+	if !fileIDRegex.MatchString(id) {
+		return nil, 0, time.Time{}, errInvalidFileID
+	}
+	f, err := os.Open(filepath.Join(c.dir, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, time.Time{}, errFileNotFound
+	} else if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, time.Time{}, err
+	}
+	return f, stat.Size(), stat.ModTime(), nil
+}
+
 func (c *fileCache) Remove(ids ...string) error {
 	for _, id := range ids {
 		if !fileIDRegex.MatchString(id) {
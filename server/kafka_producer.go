@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	kafkaClientID           = "ntfy"
+	kafkaMaxBufferedRecords = 10000 // Records that have not been acknowledged yet; if the buffer is full, records are dropped
+	kafkaRequestTimeout     = 10 * time.Second
+	kafkaDeliveryTimeout    = time.Minute // Records that cannot be delivered within this time (incl. retries) are dropped
+	kafkaFlushTimeout       = 10 * time.Second
+
+	kafkaSASLMechanismPlain       = "plain"
+	kafkaSASLMechanismSCRAMSHA256 = "scram-sha-256"
+	kafkaSASLMechanismSCRAMSHA512 = "scram-sha-512"
+)
+
+// kafkaProducer produces records to a Kafka topic asynchronously, using the franz-go client. Records are buffered
+// in memory (at most kafkaMaxBufferedRecords), and produced in order per partition. The partition is chosen based
+// on the record key, using the same hash as the default partitioner of the Java client (murmur2), so records with
+// the same key always end up in the same partition.
+type kafkaProducer struct {
+	client *kgo.Client
+}
+
+func newKafkaProducer(conf *Config) (*kafkaProducer, error) {
+	options := []kgo.Opt{
+		kgo.SeedBrokers(conf.KafkaBrokers...),
+		kgo.ClientID(kafkaClientID),
+		kgo.DefaultProduceTopic(conf.KafkaTopic),
+		kgo.RequiredAcks(kgo.LeaderAck()),
+		kgo.DisableIdempotentWrite(), // Required for acks=1; only one request per partition is in flight, so records stay in order
+		kgo.ProducerBatchCompression(kgo.NoCompression()),
+		kgo.MaxBufferedRecords(kafkaMaxBufferedRecords),
+		kgo.ProduceRequestTimeout(kafkaRequestTimeout),
+		kgo.RecordDeliveryTimeout(kafkaDeliveryTimeout),
+	}
+	if conf.KafkaTLS {
+		options = append(options, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	if conf.KafkaSASLMechanism != "" {
+		mechanism, err := kafkaSASLMechanism(conf.KafkaSASLMechanism, conf.KafkaUsername, conf.KafkaPassword)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, kgo.SASL(mechanism))
+	}
+	client, err := kgo.NewClient(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaProducer{client: client}, nil
+}
+
+// Produce buffers the record, and returns immediately. Once the partition leader acknowledged the record, or
+// producing it failed, done is called. If the buffer is full, done is called right away with kgo.ErrMaxBuffered.
+func (p *kafkaProducer) Produce(key, value []byte, done func(err error)) {
+	p.client.TryProduce(context.Background(), &kgo.Record{Key: key, Value: value}, func(_ *kgo.Record, err error) {
+		done(err)
+	})
+}
+
+// Close waits for buffered records to be produced (for at most kafkaFlushTimeout), and closes the client
+func (p *kafkaProducer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaFlushTimeout)
+	defer cancel()
+	_ = p.client.Flush(ctx)
+	p.client.Close()
+}
+
+func kafkaSASLMechanism(mechanism, username, password string) (sasl.Mechanism, error) {
+	switch mechanism {
+	case kafkaSASLMechanismPlain:
+		return plain.Auth{User: username, Pass: password}.AsMechanism(), nil
+	case kafkaSASLMechanismSCRAMSHA256:
+		return scram.Auth{User: username, Pass: password}.AsSha256Mechanism(), nil
+	case kafkaSASLMechanismSCRAMSHA512:
+		return scram.Auth{User: username, Pass: password}.AsSha512Mechanism(), nil
+	}
+	return nil, fmt.Errorf("invalid kafka SASL mechanism %s", mechanism)
+}
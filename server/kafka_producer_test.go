@@ -0,0 +1,276 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kbin"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func TestKafkaProducer_Produce(t *testing.T) {
+	broker := newTestKafkaBroker(t, 3)
+	producer := newTestKafkaProducer(t, broker)
+
+	require.Nil(t, produceTestKafkaRecord(producer, "mytopic", `{"id":"abc"}`))
+	record := broker.Record(t)
+	require.Equal(t, "events", record.topic)
+	require.Equal(t, []byte("mytopic"), record.key)
+	require.Equal(t, []byte(`{"id":"abc"}`), record.value)
+
+	// Same key, same partition
+	require.Nil(t, produceTestKafkaRecord(producer, "mytopic", "second"))
+	second := broker.Record(t)
+	require.Equal(t, record.partition, second.partition)
+	require.Equal(t, []byte("second"), second.value)
+}
+
+func TestKafkaProducer_ProduceInOrder(t *testing.T) {
+	broker := newTestKafkaBroker(t, 1)
+	producer := newTestKafkaProducer(t, broker)
+
+	done := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		producer.Produce([]byte("mytopic"), []byte(strconv.Itoa(i)), func(err error) {
+			done <- err
+		})
+	}
+	for i := 0; i < 20; i++ {
+		require.Nil(t, <-done)
+		require.Equal(t, strconv.Itoa(i), string(broker.Record(t).value))
+	}
+}
+
+func TestKafkaProducer_ProduceError(t *testing.T) {
+	broker := newTestKafkaBroker(t, 1)
+	broker.produceErrorCode = kerr.MessageTooLarge.Code // Not retriable
+	producer := newTestKafkaProducer(t, broker)
+
+	require.Equal(t, kerr.MessageTooLarge, produceTestKafkaRecord(producer, "mytopic", "hi"))
+}
+
+func TestKafkaProducer_InvalidSASLMechanism(t *testing.T) {
+	c := newTestConfig(t)
+	c.KafkaBrokers = []string{"127.0.0.1:1"}
+	c.KafkaTopic = "events"
+	c.KafkaSASLMechanism = "invalid"
+	_, err := newKafkaProducer(c)
+	require.EqualError(t, err, "invalid kafka SASL mechanism invalid")
+}
+
+func newTestKafkaProducer(t *testing.T, broker *testKafkaBroker) *kafkaProducer {
+	c := newTestConfig(t)
+	c.KafkaBrokers = []string{broker.Addr()}
+	c.KafkaTopic = "events"
+	producer, err := newKafkaProducer(c)
+	require.Nil(t, err)
+	t.Cleanup(producer.Close)
+	return producer
+}
+
+func produceTestKafkaRecord(producer *kafkaProducer, key, value string) error {
+	done := make(chan error, 1)
+	producer.Produce([]byte(key), []byte(value), func(err error) {
+		done <- err
+	})
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		return errors.New("record not acknowledged")
+	}
+}
+
+type testKafkaRecord struct {
+	topic     string
+	partition int32
+	key       []byte
+	value     []byte
+}
+
+// testKafkaBroker is a single-node Kafka broker that answers API versions, metadata and produce requests, and
+// decodes the produced records
+type testKafkaBroker struct {
+	listener         net.Listener
+	partitions       int32
+	produceErrorCode int16
+	records          chan *testKafkaRecord
+}
+
+func newTestKafkaBroker(t *testing.T, partitions int32) *testKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	b := &testKafkaBroker{
+		listener:   listener,
+		partitions: partitions,
+		records:    make(chan *testKafkaRecord, 100),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(t, conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return b
+}
+
+func (b *testKafkaBroker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *testKafkaBroker) Record(t *testing.T) *testKafkaRecord {
+	select {
+	case record := <-b.records:
+		return record
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record produced")
+		return nil
+	}
+}
+
+func (b *testKafkaBroker) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size int32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		r := &kbin.Reader{Src: buf}
+		apiKey, apiVersion, correlationID := r.Int16(), r.Int16(), r.Int32()
+		require.Equal(t, kafkaClientID, *r.NullableString())
+		req := kmsg.RequestForKey(apiKey)
+		require.NotNil(t, req, "unexpected api key %d", apiKey)
+		req.SetVersion(apiVersion)
+		if req.IsFlexible() {
+			kmsg.SkipTags(r)
+		}
+		require.Nil(t, req.ReadFrom(r.Src))
+		var resp kmsg.Response
+		switch req := req.(type) {
+		case *kmsg.ApiVersionsRequest:
+			resp = b.apiVersions(req)
+		case *kmsg.MetadataRequest:
+			resp = b.metadata(req)
+		case *kmsg.ProduceRequest:
+			produceResp, err := b.produce(req)
+			require.Nil(t, err)
+			resp = produceResp
+		default:
+			t.Errorf("unexpected api key %d", apiKey)
+			return
+		}
+		out := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(correlationID))
+		if resp.IsFlexible() && apiKey != kmsg.ApiVersions.Int16() { // ApiVersions responses always use header v0
+			out = append(out, 0) // No tagged fields
+		}
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (b *testKafkaBroker) apiVersions(req *kmsg.ApiVersionsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.ApiVersionsResponse)
+	for _, r := range []kmsg.Request{kmsg.NewPtrApiVersionsRequest(), kmsg.NewPtrMetadataRequest(), kmsg.NewPtrProduceRequest()} {
+		apiKey := kmsg.NewApiVersionsResponseApiKey()
+		apiKey.ApiKey = r.Key()
+		apiKey.MaxVersion = r.MaxVersion()
+		resp.ApiKeys = append(resp.ApiKeys, apiKey)
+	}
+	return resp
+}
+
+func (b *testKafkaBroker) metadata(req *kmsg.MetadataRequest) kmsg.Response {
+	host, portStr, _ := net.SplitHostPort(b.Addr())
+	port, _ := strconv.Atoi(portStr)
+	resp := req.ResponseKind().(*kmsg.MetadataResponse)
+	broker := kmsg.NewMetadataResponseBroker()
+	broker.NodeID = 1
+	broker.Host = host
+	broker.Port = int32(port)
+	resp.Brokers = append(resp.Brokers, broker)
+	resp.ControllerID = 1
+	for _, reqTopic := range req.Topics {
+		topic := kmsg.NewMetadataResponseTopic()
+		topic.Topic = reqTopic.Topic
+		for i := int32(0); i < b.partitions; i++ {
+			partition := kmsg.NewMetadataResponseTopicPartition()
+			partition.Partition = i
+			partition.Leader = 1
+			partition.Replicas = []int32{1}
+			partition.ISR = []int32{1}
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		resp.Topics = append(resp.Topics, topic)
+	}
+	return resp
+}
+
+func (b *testKafkaBroker) produce(req *kmsg.ProduceRequest) (kmsg.Response, error) {
+	resp := req.ResponseKind().(*kmsg.ProduceResponse)
+	for _, reqTopic := range req.Topics {
+		topic := kmsg.NewProduceResponseTopic()
+		topic.Topic = reqTopic.Topic
+		for _, reqPartition := range reqTopic.Partitions {
+			records, err := decodeTestKafkaRecordBatch(reqPartition.Records)
+			if err != nil {
+				return nil, err
+			}
+			if b.produceErrorCode == 0 {
+				for _, record := range records {
+					record.topic, record.partition = reqTopic.Topic, reqPartition.Partition
+					b.records <- record
+				}
+			}
+			partition := kmsg.NewProduceResponseTopicPartition()
+			partition.Partition = reqPartition.Partition
+			partition.ErrorCode = b.produceErrorCode
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		resp.Topics = append(resp.Topics, topic)
+	}
+	return resp, nil
+}
+
+func decodeTestKafkaRecordBatch(buf []byte) ([]*testKafkaRecord, error) {
+	batch := kmsg.NewRecordBatch()
+	if err := batch.ReadFrom(buf); err != nil {
+		return nil, err
+	} else if batch.Attributes&0x07 != 0 {
+		return nil, errors.New("unexpected compression")
+	}
+	records := make([]*testKafkaRecord, 0)
+	raw := batch.Records
+	for i := int32(0); i < batch.NumRecords; i++ {
+		length, n := binary.Varint(raw)
+		if n <= 0 || len(raw) < n+int(length) {
+			return nil, errors.New("invalid record length")
+		}
+		record := kmsg.NewRecord()
+		if err := record.ReadFrom(raw[:n+int(length)]); err != nil {
+			return nil, err
+		}
+		records = append(records, &testKafkaRecord{key: record.Key, value: record.Value})
+		raw = raw[n+int(length):]
+	}
+	return records, nil
+}
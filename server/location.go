@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	locationLabelMaxLength = 256
+)
+
+// location is a geographic location attached to a message, e.g. to show a map pin in the notification
+type location struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	Label     string  `json:"label,omitempty"`
+}
+
+// parseLocation parses the location of a message (X-Location header, or "location" field when publishing as JSON).
+// It supports a JSON object (if the string begins with "{"), e.g. {"lat":52.52,"lon":13.40,"label":"Berlin"}, and
+// a simple comma-separated format "<lat>,<lon>[,<label>]", e.g. "52.52,13.40,Berlin".
+func parseLocation(s string) (*location, error) {
+	s = strings.TrimSpace(s)
+	var loc location
+	if strings.HasPrefix(s, "{") {
+		var raw struct {
+			Latitude  *float64 `json:"lat"`
+			Longitude *float64 `json:"lon"`
+			Label     string   `json:"label"`
+		}
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, errors.New(`JSON object expected, e.g. {"lat":52.52,"lon":13.40}`)
+		} else if raw.Latitude == nil || raw.Longitude == nil {
+			return nil, errors.New("lat and lon are required")
+		}
+		loc = location{Latitude: *raw.Latitude, Longitude: *raw.Longitude, Label: strings.TrimSpace(raw.Label)}
+	} else {
+		parts := strings.SplitN(s, ",", 3)
+		if len(parts) < 2 {
+			return nil, errors.New("expected format <lat>,<lon>[,<label>]")
+		}
+		var err error
+		if loc.Latitude, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err != nil {
+			return nil, fmt.Errorf("invalid latitude '%s'", strings.TrimSpace(parts[0]))
+		} else if loc.Longitude, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+			return nil, fmt.Errorf("invalid longitude '%s'", strings.TrimSpace(parts[1]))
+		}
+		if len(parts) == 3 {
+			loc.Label = strings.TrimSpace(parts[2])
+		}
+	}
+	if math.IsNaN(loc.Latitude) || loc.Latitude < -90 || loc.Latitude > 90 {
+		return nil, errors.New("latitude must be between -90 and 90")
+	} else if math.IsNaN(loc.Longitude) || loc.Longitude < -180 || loc.Longitude > 180 {
+		return nil, errors.New("longitude must be between -180 and 180")
+	} else if utf8.RuneCountInString(loc.Label) > locationLabelMaxLength {
+		return nil, fmt.Errorf("label must not be longer than %d characters", locationLabelMaxLength)
+	}
+	return &loc, nil
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	loc, err := parseLocation("52.5200, 13.4050")
+	require.Nil(t, err)
+	require.Equal(t, &location{Latitude: 52.52, Longitude: 13.405}, loc)
+
+	loc, err = parseLocation("-33.8688,151.2093, Pump station 7, north gate")
+	require.Nil(t, err)
+	require.Equal(t, &location{Latitude: -33.8688, Longitude: 151.2093, Label: "Pump station 7, north gate"}, loc)
+
+	loc, err = parseLocation(` {"lat":0,"lon":-180,"label":"Null Island-ish"}`)
+	require.Nil(t, err)
+	require.Equal(t, &location{Latitude: 0, Longitude: -180, Label: "Null Island-ish"}, loc)
+
+	_, err = parseLocation("91,0")
+	require.EqualError(t, err, "latitude must be between -90 and 90")
+
+	_, err = parseLocation("0,180.5")
+	require.EqualError(t, err, "longitude must be between -180 and 180")
+
+	_, err = parseLocation("NaN,0")
+	require.EqualError(t, err, "latitude must be between -90 and 90")
+
+	_, err = parseLocation("52.52")
+	require.EqualError(t, err, "expected format <lat>,<lon>[,<label>]")
+
+	_, err = parseLocation("north,13.4")
+	require.EqualError(t, err, "invalid latitude 'north'")
+
+	_, err = parseLocation(`{"lat":52.52}`)
+	require.EqualError(t, err, "lat and lon are required")
+
+	_, err = parseLocation(`{"lat":"52.52","lon":"13.40"}`)
+	require.Error(t, err)
+
+	_, err = parseLocation("1,2," + strings.Repeat("x", 257))
+	require.EqualError(t, err, "label must not be longer than 256 characters")
+}
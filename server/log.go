@@ -7,6 +7,7 @@ import (
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
 	"net/http"
+	"regexp"
 	"strings"
 	"unicode/utf8"
 )
@@ -30,10 +31,11 @@ const (
 	tagWebsocket    = "websocket"
 	tagMatrix       = "matrix"
 	tagWebPush      = "webpush"
+	tagAPNS         = "apns"
 )
 
 var (
-	normalErrorCodes       = []int{http.StatusNotFound, http.StatusBadRequest, http.StatusTooManyRequests, http.StatusUnauthorized, http.StatusForbidden, http.StatusInsufficientStorage}
+	normalErrorCodes       = []int{http.StatusNotFound, http.StatusBadRequest, http.StatusTooManyRequests, http.StatusUnauthorized, http.StatusForbidden, http.StatusInsufficientStorage, http.StatusServiceUnavailable}
 	rateLimitingErrorCodes = []int{http.StatusTooManyRequests, http.StatusRequestEntityTooLarge}
 )
 
@@ -71,15 +73,28 @@ func logem(smtpConn *smtp.Conn) *log.Event {
 	return ev
 }
 
+// authQueryParamRegex matches the value of the ?auth=... query param, see redactAuthQueryParam
+var authQueryParamRegex = regexp.MustCompile(`([?&](?:auth|authorization)=)[^&]*`)
+
 func httpContext(r *http.Request) log.Context {
 	requestURI := r.RequestURI
 	if requestURI == "" {
 		requestURI = r.URL.Path
 	}
-	return log.Context{
+	ctx := log.Context{
 		"http_method": r.Method,
-		"http_path":   requestURI,
+		"http_path":   redactAuthQueryParam(requestURI),
+	}
+	if proxyNode, err := fromContext[string](r, contextProxyNode); err == nil {
+		ctx["http_proxy_node"] = proxyNode
 	}
+	return ctx
+}
+
+// redactAuthQueryParam removes the credentials passed via the ?auth=... query param from the request URI,
+// so that they never end up in the logs
+func redactAuthQueryParam(requestURI string) string {
+	return authQueryParamRegex.ReplaceAllString(requestURI, "${1}REDACTED")
 }
 
 func websocketErrorContext(err error) log.Context {
@@ -97,9 +112,12 @@ func websocketErrorContext(err error) log.Context {
 
 func renderHTTPRequest(r *http.Request) string {
 	peekLimit := 4096
-	lines := fmt.Sprintf("%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+	lines := fmt.Sprintf("%s %s %s\n", r.Method, redactAuthQueryParam(r.URL.RequestURI()), r.Proto)
 	for key, values := range r.Header {
 		for _, value := range values {
+			if key == "Authorization" {
+				value = "REDACTED"
+			}
 			lines += fmt.Sprintf("%s: %s\n", key, value)
 		}
 	}
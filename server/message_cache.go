@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/netip"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
@@ -18,6 +19,8 @@ var (
 	errUnexpectedMessageType = errors.New("unexpected message type")
 	errMessageNotFound       = errors.New("message not found")
 	errNoRows                = errors.New("no rows found")
+	errScheduleNotFound      = errors.New("schedule not found")
+	errMessageIDExists       = errors.New("message ID exists")
 )
 
 // Messages cache
@@ -37,11 +40,16 @@ const (
 			click TEXT NOT NULL,
 			icon TEXT NOT NULL,			
 			actions TEXT NOT NULL,
+			data TEXT NOT NULL,
+			location TEXT NOT NULL,
+			schedule TEXT NOT NULL,
+			collapse_key TEXT NOT NULL,
 			attachment_name TEXT NOT NULL,
 			attachment_type TEXT NOT NULL,
 			attachment_size INT NOT NULL,
 			attachment_expires INT NOT NULL,
 			attachment_url TEXT NOT NULL,
+			attachment_encryption TEXT NOT NULL,
 			attachment_deleted INT NOT NULL,
 			sender TEXT NOT NULL,
 			user TEXT NOT NULL,
@@ -56,6 +64,22 @@ const (
 		CREATE INDEX IF NOT EXISTS idx_sender ON messages (sender);
 		CREATE INDEX IF NOT EXISTS idx_user ON messages (user);
 		CREATE INDEX IF NOT EXISTS idx_attachment_expires ON messages (attachment_expires);
+		CREATE INDEX IF NOT EXISTS idx_schedule ON messages (schedule);
+		CREATE TABLE IF NOT EXISTS schedules (
+			id TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			cron TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			user TEXT NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_schedules_topic ON schedules (topic);
+		CREATE TABLE IF NOT EXISTS message_ids (
+			mid TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			expires INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_ids_expires ON message_ids (expires);
 		CREATE TABLE IF NOT EXISTS stats (
 			key TEXT PRIMARY KEY,
 			value INT
@@ -64,65 +88,135 @@ const (
 		COMMIT;
 	`
 	insertMessageQuery = `
-		INSERT INTO messages (mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_deleted, sender, user, content_type, encoding, published)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (mid, time, expires, topic, message, title, priority, tags, click, icon, actions, data, location, schedule, collapse_key, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_encryption, attachment_deleted, sender, user, content_type, encoding, published)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	deleteMessageQuery                = `DELETE FROM messages WHERE mid = ?`
 	updateMessagesForTopicExpiryQuery = `UPDATE messages SET expires = ? WHERE topic = ?`
 	selectRowIDFromMessageID          = `SELECT id FROM messages WHERE mid = ?` // Do not include topic, see #336 and TestServer_PollSinceID_MultipleTopics
 	selectMessagesByIDQuery           = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, data, location, schedule, collapse_key, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_encryption, sender, user, content_type, encoding
 		FROM messages 
 		WHERE mid = ?
 	`
 	selectMessagesSinceTimeQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, data, location, schedule, collapse_key, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_encryption, sender, user, content_type, encoding
 		FROM messages 
 		WHERE topic = ? AND time >= ? AND published = 1
 		ORDER BY time, id
 	`
 	selectMessagesSinceTimeIncludeScheduledQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, data, location, schedule, collapse_key, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_encryption, sender, user, content_type, encoding
 		FROM messages 
-		WHERE topic = ? AND time >= ?
+		WHERE topic = ? AND time >= ? AND published != 2
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, data, location, schedule, collapse_key, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_encryption, sender, user, content_type, encoding
 		FROM messages 
 		WHERE topic = ? AND id > ? AND published = 1 
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDIncludeScheduledQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, data, location, schedule, collapse_key, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_encryption, sender, user, content_type, encoding
 		FROM messages 
-		WHERE topic = ? AND (id > ? OR published = 0)
+		WHERE topic = ? AND ((id > ? AND published = 1) OR published = 0)
 		ORDER BY time, id
 	`
 	selectMessagesDueQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, data, location, schedule, collapse_key, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_encryption, sender, user, content_type, encoding
 		FROM messages 
 		WHERE time <= ? AND published = 0
 		ORDER BY time, id
 	`
-	selectMessagesExpiredQuery      = `SELECT mid FROM messages WHERE expires <= ? AND published = 1`
-	updateMessagePublishedQuery     = `UPDATE messages SET published = 1 WHERE mid = ?`
-	selectMessagesCountQuery        = `SELECT COUNT(*) FROM messages`
-	selectMessageCountPerTopicQuery = `SELECT topic, COUNT(*) FROM messages GROUP BY topic`
-	selectTopicsQuery               = `SELECT topic FROM messages GROUP BY topic`
+	selectMessagesSearchLikeQuery = `
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, data, location, schedule, collapse_key, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_encryption, sender, user, content_type, encoding
+		FROM messages
+		WHERE topic = ? AND published = 1 AND encoding = '' AND time >= ? AND time <= ? AND (message LIKE ? ESCAPE '\' OR title LIKE ? ESCAPE '\')
+		ORDER BY time DESC, id DESC
+		LIMIT ? OFFSET ?
+	`
+	selectMessagesSearchFTSQuery = `
+		SELECT m.mid, m.time, m.expires, m.topic, m.message, m.title, m.priority, m.tags, m.click, m.icon, m.actions, m.data, m.location, m.schedule, m.collapse_key, m.attachment_name, m.attachment_type, m.attachment_size, m.attachment_expires, m.attachment_url, m.attachment_encryption, m.sender, m.user, m.content_type, m.encoding
+		FROM messages_fts f
+		JOIN messages m ON m.id = f.rowid
+		WHERE messages_fts MATCH ? AND m.topic = ? AND m.published = 1 AND m.encoding = '' AND m.time >= ? AND m.time <= ?
+		ORDER BY m.time DESC, m.id DESC
+		LIMIT ? OFFSET ?
+	`
+	selectMessagesExpiredQuery       = `SELECT mid FROM messages WHERE expires <= ? AND published != 0`
+	selectMessagesExpiredRetainQuery = `SELECT mid FROM messages WHERE expires <= ? AND published != 0 AND (priority < ? OR time <= ?)`
+	selectMessagesByTitleQuery       = `SELECT mid FROM messages WHERE topic = ? AND title = ? AND mid != ? AND time >= ? AND published = 1`
+	updateMessagePublishedQuery      = `UPDATE messages SET published = 1 WHERE mid = ?`
+	updateMessageConsumedQuery       = `UPDATE messages SET published = 2 WHERE mid = ? AND published = 1`
+	selectMessagesCountQuery         = `SELECT COUNT(*) FROM messages`
+	selectMessageCountPerTopicQuery  = `SELECT topic, COUNT(*) FROM messages GROUP BY topic`
+	selectMessagesCountSinceQuery    = `SELECT COUNT(*) FROM messages WHERE time >= ? AND published = 1`
+	selectTopTopicsQuery             = `SELECT topic, COUNT(*) AS count FROM messages GROUP BY topic ORDER BY count DESC, topic LIMIT ?`
+	selectTopicsQuery                = `SELECT topic FROM messages GROUP BY topic`
 
 	updateAttachmentDeleted            = `UPDATE messages SET attachment_deleted = 1 WHERE mid = ?`
+	updateAttachmentSuperseded         = `UPDATE messages SET attachment_deleted = 1, attachment_expires = ? WHERE mid = ?`
+	selectAttachmentsByNameQuery       = `SELECT mid FROM messages WHERE topic = ? AND attachment_name = ? AND mid != ? AND attachment_expires > ? AND attachment_deleted = 0`
 	selectAttachmentsExpiredQuery      = `SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_expires <= ? AND attachment_deleted = 0`
 	selectAttachmentsSizeBySenderQuery = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = '' AND sender = ? AND attachment_expires >= ?`
 	selectAttachmentsSizeByUserIDQuery = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = ? AND attachment_expires >= ?`
 
+	insertScheduleQuery  = `INSERT INTO schedules (id, topic, cron, sender, user, created) VALUES (?, ?, ?, ?, ?, ?)`
+	selectScheduleQuery  = `SELECT id, topic, cron, sender, user, created FROM schedules WHERE id = ?`
+	selectSchedulesQuery = `
+		SELECT s.id, s.topic, s.cron, s.sender, s.user, s.created, IFNULL(MIN(m.time), 0)
+		FROM schedules s
+		LEFT JOIN messages m ON m.schedule = s.id AND m.published = 0
+		WHERE s.topic = ?
+		GROUP BY s.id
+		ORDER BY s.created, s.id
+	`
+	selectScheduleCountBySenderQuery = `SELECT COUNT(*) FROM schedules WHERE user = '' AND sender = ?`
+	selectScheduleCountByUserIDQuery = `SELECT COUNT(*) FROM schedules WHERE user = ?`
+	deleteScheduleQuery              = `DELETE FROM schedules WHERE topic = ? AND id = ?`
+	deleteScheduledMessagesQuery     = `DELETE FROM messages WHERE schedule = ? AND published = 0`
+
+	deleteMessageIDExpiredQuery     = `DELETE FROM message_ids WHERE mid = ? AND expires <= ?`
+	deleteMessageIDsExpiredQuery    = `DELETE FROM message_ids WHERE expires <= ?`
+	deleteMessageIDQuery            = `DELETE FROM message_ids WHERE mid = ?`
+	insertMessageIDQuery            = `INSERT OR IGNORE INTO message_ids (mid, topic, expires) VALUES (?, ?, ?)`
+	selectMessageLiveCountByIDQuery = `SELECT COUNT(*) FROM messages WHERE mid = ? AND (expires = 0 OR expires > ?)`
+
 	selectStatsQuery = `SELECT value FROM stats WHERE key = 'messages'`
 	updateStatsQuery = `UPDATE stats SET value = ? WHERE key = 'messages'`
 )
 
+// Full-text search queries, only used if SQLite was compiled with FTS5 (build tag sqlite_fts5). The FTS table
+// is an external content table, and is kept in sync with the messages table via triggers. It is not part of the
+// schema version, since the same cache file may be used by builds with and without FTS5.
+const (
+	selectFTS5AvailableQuery     = `SELECT sqlite_compileoption_used('ENABLE_FTS5')`
+	selectMessagesFTSExistsQuery = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'messages_fts_insert'`
+	createMessagesFTSQuery       = `
+		CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(title, message, content='messages', content_rowid='id');
+		CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, title, message) VALUES (new.id, new.title, new.message);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, title, message) VALUES ('delete', old.id, old.title, old.message);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF title, message ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, title, message) VALUES ('delete', old.id, old.title, old.message);
+			INSERT INTO messages_fts (rowid, title, message) VALUES (new.id, new.title, new.message);
+		END;
+		INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');
+	`
+	dropMessagesFTSTriggersQuery = `
+		DROP TRIGGER IF EXISTS messages_fts_insert;
+		DROP TRIGGER IF EXISTS messages_fts_delete;
+		DROP TRIGGER IF EXISTS messages_fts_update;
+	`
+)
+
 // Schema management queries
 const (
-	currentSchemaVersion          = 13
+	currentSchemaVersion          = 19
 	createSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -251,6 +345,51 @@ const (
 	migrate12To13AlterMessagesTableQuery = `
 		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
 	`
+
+	// 13 -> 14
+	migrate13To14AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN data TEXT NOT NULL DEFAULT('');
+	`
+
+	// 14 -> 15
+	migrate14To15AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN schedule TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_schedule ON messages (schedule);
+		CREATE TABLE IF NOT EXISTS schedules (
+			id TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			cron TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			user TEXT NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_schedules_topic ON schedules (topic);
+	`
+
+	// 15 -> 16
+	migrate15To16AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN location TEXT NOT NULL DEFAULT('');
+	`
+
+	// 16 -> 17
+	migrate16To17AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_encryption TEXT NOT NULL DEFAULT('');
+	`
+
+	// 17 -> 18
+	migrate17To18AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN collapse_key TEXT NOT NULL DEFAULT('');
+	`
+
+	// 18 -> 19
+	migrate18To19CreateMessageIDsTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_ids (
+			mid TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			expires INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_ids_expires ON message_ids (expires);
+	`
 )
 
 var (
@@ -268,13 +407,21 @@ var (
 		10: migrateFrom10,
 		11: migrateFrom11,
 		12: migrateFrom12,
+		13: migrateFrom13,
+		14: migrateFrom14,
+		15: migrateFrom15,
+		16: migrateFrom16,
+		17: migrateFrom17,
+		18: migrateFrom18,
 	}
 )
 
 type messageCache struct {
-	db    *sql.DB
-	queue *util.BatchingQueue[*message]
-	nop   bool
+	db        *sql.DB
+	queue     *util.BatchingQueue[*message]
+	nop       bool
+	fts       bool       // True if the messages_fts table is available, see setupMessagesFTS
+	consumeMu sync.Mutex // Serializes ConsumeMessages, so that concurrent consumers never see the same message
 }
 
 // newSqliteCache creates a SQLite file-backed cache
@@ -286,6 +433,10 @@ func newSqliteCache(filename, startupQueries string, cacheDuration time.Duration
 	if err := setupMessagesDB(db, startupQueries, cacheDuration); err != nil {
 		return nil, err
 	}
+	fts, err := setupMessagesFTS(db)
+	if err != nil {
+		return nil, err
+	}
 	var queue *util.BatchingQueue[*message]
 	if batchSize > 0 || batchTimeout > 0 {
 		queue = util.NewBatchingQueue[*message](batchSize, batchTimeout)
@@ -294,6 +445,7 @@ func newSqliteCache(filename, startupQueries string, cacheDuration time.Duration
 		db:    db,
 		queue: queue,
 		nop:   nop,
+		fts:   fts,
 	}
 	go cache.processMessageBatches()
 	return cache, nil
@@ -356,7 +508,7 @@ func (c *messageCache) addMessages(ms []*message) error {
 		}
 		published := m.Time <= time.Now().Unix()
 		tags := strings.Join(m.Tags, ",")
-		var attachmentName, attachmentType, attachmentURL string
+		var attachmentName, attachmentType, attachmentURL, attachmentEncryption string
 		var attachmentSize, attachmentExpires, attachmentDeleted int64
 		if m.Attachment != nil {
 			attachmentName = m.Attachment.Name
@@ -364,6 +516,7 @@ func (c *messageCache) addMessages(ms []*message) error {
 			attachmentSize = m.Attachment.Size
 			attachmentExpires = m.Attachment.Expires
 			attachmentURL = m.Attachment.URL
+			attachmentEncryption = m.Attachment.Encryption
 		}
 		var actionsStr string
 		if len(m.Actions) > 0 {
@@ -373,6 +526,22 @@ func (c *messageCache) addMessages(ms []*message) error {
 			}
 			actionsStr = string(actionsBytes)
 		}
+		var dataStr string
+		if len(m.Data) > 0 {
+			dataBytes, err := json.Marshal(m.Data)
+			if err != nil {
+				return err
+			}
+			dataStr = string(dataBytes)
+		}
+		var locationStr string
+		if m.Location != nil {
+			locationBytes, err := json.Marshal(m.Location)
+			if err != nil {
+				return err
+			}
+			locationStr = string(locationBytes)
+		}
 		var sender string
 		if m.Sender.IsValid() {
 			sender = m.Sender.String()
@@ -389,11 +558,16 @@ func (c *messageCache) addMessages(ms []*message) error {
 			m.Click,
 			m.Icon,
 			actionsStr,
+			dataStr,
+			locationStr,
+			m.Schedule,
+			m.CollapseKey,
 			attachmentName,
 			attachmentType,
 			attachmentSize,
 			attachmentExpires,
 			attachmentURL,
+			attachmentEncryption,
 			attachmentDeleted, // Always zero
 			sender,
 			m.User,
@@ -470,9 +644,58 @@ func (c *messageCache) MessagesDue() ([]*message, error) {
 	return readMessages(rows)
 }
 
-// MessagesExpired returns a list of IDs for messages that have expires (should be deleted)
-func (c *messageCache) MessagesExpired() ([]string, error) {
-	rows, err := c.db.Query(selectMessagesExpiredQuery, time.Now().Unix())
+// SearchMessages returns the messages of a topic whose title or message contain the query, newest first. If FTS5 is
+// available, the query is matched as a phrase against the full-text index, otherwise a case-insensitive substring
+// match is performed. Encoded (binary) messages are never matched.
+func (c *messageCache) SearchMessages(topic, query string, since, until int64, limit, offset int) ([]*message, error) {
+	var rows *sql.Rows
+	var err error
+	if c.fts {
+		phrase := `"` + strings.ReplaceAll(query, `"`, `""`) + `"`
+		rows, err = c.db.Query(selectMessagesSearchFTSQuery, phrase, topic, since, until, limit, offset)
+	} else {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+		rows, err = c.db.Query(selectMessagesSearchLikeQuery, topic, since, until, pattern, pattern, limit, offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// MessagesExpired returns a list of IDs for messages that have expires (should be deleted). If retainPriority is set,
+// messages with at least that priority are only returned once they are also older than retainDuration.
+func (c *messageCache) MessagesExpired(retainPriority int, retainDuration time.Duration) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	now := time.Now()
+	if retainPriority > 0 {
+		rows, err = c.db.Query(selectMessagesExpiredRetainQuery, now.Unix(), retainPriority, now.Add(-retainDuration).Unix())
+	} else {
+		rows, err = c.db.Query(selectMessagesExpiredQuery, now.Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// MessagesByTitle returns the IDs of the published messages on the topic with the given title, that were sent at or
+// after the since time. The message with the given ID is excluded.
+func (c *messageCache) MessagesByTitle(topic, title, exceptID string, since time.Time) ([]string, error) {
+	rows, err := c.db.Query(selectMessagesByTitleQuery, topic, title, exceptID, since.Unix())
 	if err != nil {
 		return nil, err
 	}
@@ -528,6 +751,45 @@ func (c *messageCache) MessageCounts() (map[string]int, error) {
 	return counts, nil
 }
 
+// MessagesCount returns the total number of messages in the cache
+func (c *messageCache) MessagesCount() (int, error) {
+	rows, err := c.db.Query(selectMessagesCountQuery)
+	if err != nil {
+		return 0, err
+	}
+	return readCount(rows)
+}
+
+// MessagesCountSince returns the number of published messages in the cache that were sent after the given time
+func (c *messageCache) MessagesCountSince(since time.Time) (int, error) {
+	rows, err := c.db.Query(selectMessagesCountSinceQuery, since.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return readCount(rows)
+}
+
+// TopTopics returns up to limit topics with the highest number of messages in the cache, ordered by message count
+func (c *messageCache) TopTopics(limit int) ([]*topicMessageCount, error) {
+	rows, err := c.db.Query(selectTopTopicsQuery, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make([]*topicMessageCount, 0)
+	for rows.Next() {
+		var t topicMessageCount
+		if err := rows.Scan(&t.Topic, &t.Messages); err != nil {
+			return nil, err
+		}
+		topics = append(topics, &t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
 func (c *messageCache) Topics() (map[string]*topic, error) {
 	rows, err := c.db.Query(selectTopicsQuery)
 	if err != nil {
@@ -548,6 +810,61 @@ func (c *messageCache) Topics() (map[string]*topic, error) {
 	return topics, nil
 }
 
+// ReserveMessageID reserves a client-supplied message ID until the given time, or returns errMessageIDExists if the
+// ID is reserved or used by an unexpired message. Reservations are kept even if the message is not cached, since
+// attachments are stored by message ID. Expired messages with the same ID are deleted, and returned as "deleted",
+// so that the caller can remove their attachments.
+func (c *messageCache) ReserveMessageID(id, topic string, expires int64) (deleted bool, err error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	if _, err := tx.Exec(deleteMessageIDExpiredQuery, id, now); err != nil {
+		return false, err
+	}
+	rows, err := tx.Query(selectMessageLiveCountByIDQuery, id, now)
+	if err != nil {
+		return false, err
+	}
+	count, err := readCount(rows)
+	if err != nil {
+		return false, err
+	} else if count > 0 {
+		return false, errMessageIDExists
+	}
+	res, err := tx.Exec(insertMessageIDQuery, id, topic, expires)
+	if err != nil {
+		return false, err
+	} else if inserted, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if inserted == 0 {
+		return false, errMessageIDExists
+	}
+	res, err = tx.Exec(deleteMessageQuery, id)
+	if err != nil {
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return removed > 0, tx.Commit()
+}
+
+// ReleaseMessageID removes the reservation of a message ID, e.g. if publishing the message failed
+func (c *messageCache) ReleaseMessageID(id string) error {
+	_, err := c.db.Exec(deleteMessageIDQuery, id)
+	return err
+}
+
+// DeleteExpiredMessageIDs removes all expired message ID reservations
+func (c *messageCache) DeleteExpiredMessageIDs() error {
+	_, err := c.db.Exec(deleteMessageIDsExpiredQuery, time.Now().Unix())
+	return err
+}
+
 func (c *messageCache) DeleteMessages(ids ...string) error {
 	tx, err := c.db.Begin()
 	if err != nil {
@@ -562,6 +879,47 @@ func (c *messageCache) DeleteMessages(ids ...string) error {
 	return tx.Commit()
 }
 
+// ConsumeMessages selects the messages of a topic like Messages, and marks the ones that pass the filter as
+// consumed in the same transaction. Each message is returned to exactly one caller, even if multiple callers consume
+// the same topic concurrently.
+//
+// Consumed messages (published = 2) are never returned for the topic again, but they are kept until they expire, so
+// that their attachments can still be downloaded by the consumer (see handleFile), and are deleted by the manager
+// like those of any other message.
+func (c *messageCache) ConsumeMessages(topic string, since sinceMarker, scheduled bool, filter func(m *message) bool) ([]*message, error) {
+	c.consumeMu.Lock()
+	defer c.consumeMu.Unlock()
+	messages, err := c.Messages(topic, since, scheduled)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	consumed := make([]*message, 0)
+	for _, m := range messages {
+		if !filter(m) {
+			continue
+		}
+		res, err := tx.Exec(updateMessageConsumedQuery, m.ID)
+		if err != nil {
+			return nil, err
+		}
+		if rows, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if rows == 0 {
+			continue // Deleted in the meantime, e.g. by the manager because it expired
+		}
+		consumed = append(consumed, m)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return consumed, nil
+}
+
 func (c *messageCache) ExpireMessages(topics ...string) error {
 	tx, err := c.db.Begin()
 	if err != nil {
@@ -610,6 +968,45 @@ func (c *messageCache) MarkAttachmentsDeleted(ids ...string) error {
 	return tx.Commit()
 }
 
+// SupersedeAttachments marks the unexpired (uploaded) attachments with the given name on the topic as deleted, except
+// for the attachment of the message with the given ID, and returns the IDs of the affected messages. The messages
+// themselves are kept, but their attachments are marked as expired, so that they no longer count towards the
+// attachment quota, and clients show them as expired.
+func (c *messageCache) SupersedeAttachments(topic, name, exceptID string) ([]string, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	rows, err := tx.Query(selectAttachmentsByNameQuery, topic, name, exceptID, now)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec(updateAttachmentSuperseded, now-1, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func (c *messageCache) AttachmentBytesUsedBySender(sender string) (int64, error) {
 	rows, err := c.db.Query(selectAttachmentsSizeBySenderQuery, sender, time.Now().Unix())
 	if err != nil {
@@ -640,6 +1037,20 @@ func (c *messageCache) readAttachmentBytesUsed(rows *sql.Rows) (int64, error) {
 	return size, nil
 }
 
+func readCount(rows *sql.Rows) (int, error) {
+	defer rows.Close()
+	var count int
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 func (c *messageCache) processMessageBatches() {
 	if c.queue == nil {
 		return
@@ -651,6 +1062,18 @@ func (c *messageCache) processMessageBatches() {
 	}
 }
 
+// Flush synchronously stores the messages that are queued to be stored asynchronously, see AddMessage
+func (c *messageCache) Flush() error {
+	if c.queue == nil {
+		return nil
+	}
+	messages := c.queue.Flush()
+	if len(messages) == 0 {
+		return nil
+	}
+	return c.addMessages(messages)
+}
+
 func readMessages(rows *sql.Rows) ([]*message, error) {
 	defer rows.Close()
 	messages := make([]*message, 0)
@@ -670,7 +1093,7 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 func readMessage(rows *sql.Rows) (*message, error) {
 	var timestamp, expires, attachmentSize, attachmentExpires int64
 	var priority int
-	var id, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, sender, user, contentType, encoding string
+	var id, topic, msg, title, tagsStr, click, icon, actionsStr, dataStr, locationStr, schedule, collapseKey, attachmentName, attachmentType, attachmentURL, attachmentEncryption, sender, user, contentType, encoding string
 	err := rows.Scan(
 		&id,
 		&timestamp,
@@ -683,11 +1106,16 @@ func readMessage(rows *sql.Rows) (*message, error) {
 		&click,
 		&icon,
 		&actionsStr,
+		&dataStr,
+		&locationStr,
+		&schedule,
+		&collapseKey,
 		&attachmentName,
 		&attachmentType,
 		&attachmentSize,
 		&attachmentExpires,
 		&attachmentURL,
+		&attachmentEncryption,
 		&sender,
 		&user,
 		&contentType,
@@ -706,6 +1134,18 @@ func readMessage(rows *sql.Rows) (*message, error) {
 			return nil, err
 		}
 	}
+	var data map[string]string
+	if dataStr != "" {
+		if err := json.Unmarshal([]byte(dataStr), &data); err != nil {
+			return nil, err
+		}
+	}
+	var loc *location
+	if locationStr != "" {
+		if err := json.Unmarshal([]byte(locationStr), &loc); err != nil {
+			return nil, err
+		}
+	}
 	senderIP, err := netip.ParseAddr(sender)
 	if err != nil {
 		senderIP = netip.Addr{} // if no IP stored in database, return invalid address
@@ -713,11 +1153,12 @@ func readMessage(rows *sql.Rows) (*message, error) {
 	var att *attachment
 	if attachmentName != "" && attachmentURL != "" {
 		att = &attachment{
-			Name:    attachmentName,
-			Type:    attachmentType,
-			Size:    attachmentSize,
-			Expires: attachmentExpires,
-			URL:     attachmentURL,
+			Name:       attachmentName,
+			Type:       attachmentType,
+			Size:       attachmentSize,
+			Expires:    attachmentExpires,
+			URL:        attachmentURL,
+			Encryption: attachmentEncryption,
 		}
 	}
 	return &message{
@@ -733,6 +1174,10 @@ func readMessage(rows *sql.Rows) (*message, error) {
 		Click:       click,
 		Icon:        icon,
 		Actions:     actions,
+		Data:        data,
+		Location:    loc,
+		Schedule:    schedule,
+		CollapseKey: collapseKey,
 		Attachment:  att,
 		Sender:      senderIP, // Must parse assuming database must be correct
 		User:        user,
@@ -741,6 +1186,101 @@ func readMessage(rows *sql.Rows) (*message, error) {
 	}, nil
 }
 
+// AddSchedule stores the definition of a recurring message. The pending occurrence is stored as a regular
+// (delayed) message, see Server.sendScheduledMessage.
+func (c *messageCache) AddSchedule(sc *schedule) error {
+	if c.nop {
+		return nil
+	}
+	var sender string
+	if sc.Sender.IsValid() {
+		sender = sc.Sender.String()
+	}
+	_, err := c.db.Exec(insertScheduleQuery, sc.ID, sc.Topic, sc.Cron, sender, sc.User, sc.Created)
+	return err
+}
+
+// Schedule returns the recurring message schedule with the given ID, or errScheduleNotFound
+func (c *messageCache) Schedule(id string) (*schedule, error) {
+	rows, err := c.db.Query(selectScheduleQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, errScheduleNotFound
+	}
+	var sc schedule
+	var sender string
+	if err := rows.Scan(&sc.ID, &sc.Topic, &sc.Cron, &sender, &sc.User, &sc.Created); err != nil {
+		return nil, err
+	}
+	sc.Sender, _ = netip.ParseAddr(sender) // Invalid address if not stored
+	return &sc, nil
+}
+
+// Schedules returns the recurring message schedules of a topic, including the time of the next occurrence
+func (c *messageCache) Schedules(topic string) ([]*schedule, error) {
+	rows, err := c.db.Query(selectSchedulesQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	schedules := make([]*schedule, 0)
+	for rows.Next() {
+		var sc schedule
+		var sender string
+		if err := rows.Scan(&sc.ID, &sc.Topic, &sc.Cron, &sender, &sc.User, &sc.Created, &sc.Next); err != nil {
+			return nil, err
+		}
+		sc.Sender, _ = netip.ParseAddr(sender)
+		schedules = append(schedules, &sc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// ScheduleCountBySender returns the number of recurring message schedules created by an anonymous visitor
+func (c *messageCache) ScheduleCountBySender(sender string) (int, error) {
+	rows, err := c.db.Query(selectScheduleCountBySenderQuery, sender)
+	if err != nil {
+		return 0, err
+	}
+	return readCount(rows)
+}
+
+// ScheduleCountByUserID returns the number of recurring message schedules created by a user
+func (c *messageCache) ScheduleCountByUserID(userID string) (int, error) {
+	rows, err := c.db.Query(selectScheduleCountByUserIDQuery, userID)
+	if err != nil {
+		return 0, err
+	}
+	return readCount(rows)
+}
+
+// RemoveSchedule deletes a recurring message schedule and its pending occurrence, or returns errScheduleNotFound
+func (c *messageCache) RemoveSchedule(topic, id string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(deleteScheduleQuery, topic, id)
+	if err != nil {
+		return err
+	} else if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return errScheduleNotFound
+	}
+	if _, err := tx.Exec(deleteScheduledMessagesQuery, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (c *messageCache) UpdateStats(messages int64) error {
 	_, err := c.db.Exec(updateStatsQuery, messages)
 	return err
@@ -765,6 +1305,31 @@ func (c *messageCache) Close() error {
 	return c.db.Close()
 }
 
+// setupMessagesFTS creates the full-text search table and its triggers, if SQLite supports FTS5. The index is only
+// rebuilt if the triggers did not exist before. If FTS5 is not supported, triggers left over from a build that supported
+// it are dropped, since they would make all inserts fail.
+func setupMessagesFTS(db *sql.DB) (bool, error) {
+	var available bool
+	if err := db.QueryRow(selectFTS5AvailableQuery).Scan(&available); err != nil {
+		return false, err
+	} else if !available {
+		if _, err := db.Exec(dropMessagesFTSTriggersQuery); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	var exists int
+	if err := db.QueryRow(selectMessagesFTSExistsQuery).Scan(&exists); err != nil {
+		return false, err
+	} else if exists > 0 {
+		return true, nil
+	}
+	if _, err := db.Exec(createMessagesFTSQuery); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func setupMessagesDB(db *sql.DB, startupQueries string, cacheDuration time.Duration) error {
 	// Run startup queries
 	if startupQueries != "" {
@@ -992,3 +1557,99 @@ func migrateFrom12(db *sql.DB, _ time.Duration) error {
 	}
 	return tx.Commit()
 }
+
+func migrateFrom13(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 13 to 14")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate13To14AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 14); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom14(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 14 to 15")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate14To15AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 15); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom15(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 15 to 16")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate15To16AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 16); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom16(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 16 to 17")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate16To17AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 17); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom17(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 17 to 18")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate17To18AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 18); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom18(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 18 to 19")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate18To19CreateMessageIDsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 19); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
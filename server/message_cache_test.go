@@ -142,6 +142,39 @@ func testCacheTopics(t *testing.T, c *messageCache) {
 	require.Equal(t, "topic2", topics["topic2"].ID)
 }
 
+func TestSqliteCache_TopTopicsAndCounts(t *testing.T) {
+	testCacheTopTopicsAndCounts(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopTopicsAndCounts(t *testing.T) {
+	testCacheTopTopicsAndCounts(t, newMemTestCache(t))
+}
+
+func testCacheTopTopicsAndCounts(t *testing.T, c *messageCache) {
+	old := newDefaultMessage("topic1", "old message")
+	old.Time = time.Now().Add(-2 * time.Hour).Unix()
+	require.Nil(t, c.AddMessage(old))
+	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 1")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 2")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("topic3", "message 3")))
+
+	count, err := c.MessagesCount()
+	require.Nil(t, err)
+	require.Equal(t, 4, count)
+
+	count, err = c.MessagesCountSince(time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+
+	topics, err := c.TopTopics(2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(topics))
+	require.Equal(t, "topic2", topics[0].Topic)
+	require.Equal(t, 2, topics[0].Messages)
+	require.Equal(t, "topic1", topics[1].Topic) // Ties are ordered by topic name
+	require.Equal(t, 1, topics[1].Messages)
+}
+
 func TestSqliteCache_MessagesTagsPrioAndTitle(t *testing.T) {
 	testCacheMessagesTagsPrioAndTitle(t, newSqliteTestCache(t))
 }
@@ -233,6 +266,112 @@ func testCacheMessagesSinceID(t *testing.T, c *messageCache) {
 	require.Equal(t, "message 3", messages[1].Message)
 }
 
+func TestSqliteCache_ConsumeMessages(t *testing.T) {
+	testCacheConsumeMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ConsumeMessages(t *testing.T) {
+	testCacheConsumeMessages(t, newMemTestCache(t))
+}
+
+func testCacheConsumeMessages(t *testing.T, c *messageCache) {
+	m1 := newDefaultMessage("mytopic", "job 1")
+	m2 := newDefaultMessage("mytopic", "job 2")
+	m2.Priority = 5
+	m3 := newDefaultMessage("another_topic", "job 3")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+
+	consumed, err := c.ConsumeMessages("mytopic", sinceAllMessages, false, func(m *message) bool {
+		return m.Priority != 5
+	})
+	require.Nil(t, err)
+	require.Len(t, consumed, 1)
+	require.Equal(t, "job 1", consumed[0].Message)
+
+	// Consumed message is hidden, others are untouched
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, "job 2", messages[0].Message)
+	messages, err = c.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+	messages, err = c.Messages("mytopic", newSinceID(m1.ID), true)
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+	messages, err = c.Messages("another_topic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+
+	// Consumed message can still be looked up by ID (for attachments), and cannot be consumed again
+	m, err := c.Message(m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "job 1", m.Message)
+	consumed, err = c.ConsumeMessages("mytopic", sinceAllMessages, false, func(m *message) bool {
+		return true
+	})
+	require.Nil(t, err)
+	require.Len(t, consumed, 1)
+	require.Equal(t, "job 2", consumed[0].Message)
+
+	// Consumed messages expire like all other messages
+	require.Nil(t, c.ExpireMessages("mytopic"))
+	ids, err := c.MessagesExpired(0, 0)
+	require.Nil(t, err)
+	require.Contains(t, ids, m1.ID)
+	require.Contains(t, ids, m2.ID)
+}
+
+func TestSqliteCache_ReserveMessageID(t *testing.T) {
+	testCacheReserveMessageID(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ReserveMessageID(t *testing.T) {
+	testCacheReserveMessageID(t, newMemTestCache(t))
+}
+
+func testCacheReserveMessageID(t *testing.T, c *messageCache) {
+	future := time.Now().Add(time.Hour).Unix()
+
+	// Reserved IDs cannot be reserved again, not even on other topics
+	deleted, err := c.ReserveMessageID("order1234567", "mytopic", future)
+	require.Nil(t, err)
+	require.False(t, deleted)
+	_, err = c.ReserveMessageID("order1234567", "mytopic", future)
+	require.Equal(t, errMessageIDExists, err)
+	_, err = c.ReserveMessageID("order1234567", "othertopic", future)
+	require.Equal(t, errMessageIDExists, err)
+
+	// Released IDs can be reserved again
+	require.Nil(t, c.ReleaseMessageID("order1234567"))
+	_, err = c.ReserveMessageID("order1234567", "mytopic", future)
+	require.Nil(t, err)
+
+	// IDs of unexpired messages cannot be reserved, expired messages are deleted
+	m := newDefaultMessage("mytopic", "some message")
+	m.Expires = future
+	require.Nil(t, c.AddMessage(m))
+	_, err = c.ReserveMessageID(m.ID, "mytopic", future)
+	require.Equal(t, errMessageIDExists, err)
+	m = newDefaultMessage("mytopic", "expired message")
+	m.Expires = time.Now().Add(-time.Minute).Unix()
+	require.Nil(t, c.AddMessage(m))
+	deleted, err = c.ReserveMessageID(m.ID, "mytopic", future)
+	require.Nil(t, err)
+	require.True(t, deleted)
+	_, err = c.Message(m.ID)
+	require.Equal(t, errMessageNotFound, err)
+
+	// Expired reservations are removed
+	_, err = c.ReserveMessageID("expired12345", "mytopic", time.Now().Add(-time.Minute).Unix())
+	require.Nil(t, err)
+	require.Nil(t, c.DeleteExpiredMessageIDs())
+	_, err = c.ReserveMessageID("expired12345", "othertopic", future)
+	require.Nil(t, err)
+}
+
 func TestSqliteCache_Prune(t *testing.T) {
 	testCachePrune(t, newSqliteTestCache(t))
 }
@@ -265,7 +404,7 @@ func testCachePrune(t *testing.T, c *messageCache) {
 	require.Equal(t, 2, counts["mytopic"])
 	require.Equal(t, 1, counts["another_topic"])
 
-	expiredMessageIDs, err := c.MessagesExpired()
+	expiredMessageIDs, err := c.MessagesExpired(0, 0)
 	require.Nil(t, err)
 	require.Nil(t, c.DeleteMessages(expiredMessageIDs...))
 
@@ -280,6 +419,104 @@ func testCachePrune(t *testing.T, c *messageCache) {
 	require.Equal(t, "my other message", messages[0].Message)
 }
 
+func TestSqliteCache_PruneRetainPriority(t *testing.T) {
+	testCachePruneRetainPriority(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PruneRetainPriority(t *testing.T) {
+	testCachePruneRetainPriority(t, newMemTestCache(t))
+}
+
+func testCachePruneRetainPriority(t *testing.T, c *messageCache) {
+	now := time.Now()
+	for i, priority := range []int{0, 1, 3, 4, 5} {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message with priority %d", priority))
+		m.Time = now.Add(-13*time.Hour).Unix() + int64(i)
+		m.Expires = now.Add(-time.Hour).Unix() // Cache duration of 12h exceeded
+		m.Priority = priority
+		require.Nil(t, c.AddMessage(m))
+	}
+	old := newDefaultMessage("mytopic", "very old urgent message")
+	old.Time = now.Add(-31 * 24 * time.Hour).Unix()
+	old.Expires = now.Add(-31*24*time.Hour + 12*time.Hour).Unix()
+	old.Priority = 5
+	require.Nil(t, c.AddMessage(old))
+
+	expiredMessageIDs, err := c.MessagesExpired(4, 30*24*time.Hour)
+	require.Nil(t, err)
+	require.Nil(t, c.DeleteMessages(expiredMessageIDs...))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, 5, messages[1].Priority)
+
+	// Without retain priority, all expired messages are pruned
+	expiredMessageIDs, err = c.MessagesExpired(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(expiredMessageIDs))
+}
+
+func TestSqliteCache_SearchMessages(t *testing.T) {
+	testCacheSearchMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_SearchMessages(t *testing.T) {
+	testCacheSearchMessages(t, newMemTestCache(t))
+}
+
+func testCacheSearchMessages(t *testing.T, c *messageCache) {
+	now := time.Now().Unix()
+	for i, body := range []string{"Disk full on nas01", "disk FULL on nas02", "CPU at 100% on nas01", "all good", "disk full, but different topic"} {
+		topic := "alerts"
+		if i == 4 {
+			topic = "other"
+		}
+		m := newDefaultMessage(topic, body)
+		m.Time = now - int64(100-i)
+		require.Nil(t, c.AddMessage(m))
+	}
+	titled := newDefaultMessage("alerts", "see title")
+	titled.Title = "Disk full on backup server"
+	titled.Time = now - 10
+	require.Nil(t, c.AddMessage(titled))
+
+	// Case-insensitive match on message and title, newest first, only on the given topic
+	messages, err := c.SearchMessages("alerts", "disk full", 0, now, 10, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "see title", messages[0].Message)
+	require.Equal(t, "disk FULL on nas02", messages[1].Message)
+	require.Equal(t, "Disk full on nas01", messages[2].Message)
+
+	// Pagination
+	messages, err = c.SearchMessages("alerts", "disk full", 0, now, 1, 1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "disk FULL on nas02", messages[0].Message)
+
+	// Time bounds
+	messages, err = c.SearchMessages("alerts", "disk full", now-99, now-20, 10, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "disk FULL on nas02", messages[0].Message)
+
+	// Special characters are matched literally
+	messages, err = c.SearchMessages("alerts", "100%", 0, now, 10, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "CPU at 100% on nas01", messages[0].Message)
+
+	messages, err = c.SearchMessages("alerts", "%", 0, now, 10, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	messages, err = c.SearchMessages("alerts", "not there", 0, now, 10, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
 func TestSqliteCache_Attachments(t *testing.T) {
 	testCacheAttachments(t, newSqliteTestCache(t))
 }
@@ -417,6 +654,59 @@ func testCacheAttachmentsExpired(t *testing.T, c *messageCache) {
 	require.Equal(t, "m4", ids[0])
 }
 
+func TestSqliteCache_Attachments_Supersede(t *testing.T) {
+	testCacheAttachmentsSupersede(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Attachments_Supersede(t *testing.T) {
+	testCacheAttachmentsSupersede(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentsSupersede(t *testing.T, c *messageCache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	for _, m := range []struct{ id, topic, name string }{
+		{"m1", "sensor", "snapshot.jpg"},
+		{"m2", "sensor", "snapshot.jpg"},
+		{"m3", "sensor", "other.jpg"},
+		{"m4", "sensor2", "snapshot.jpg"},
+		{"m5", "sensor", "snapshot.jpg"},
+	} {
+		msg := newDefaultMessage(m.topic, "snapshot")
+		msg.ID = m.id
+		msg.Sender = netip.MustParseAddr("1.2.3.4")
+		msg.Expires = expires
+		msg.Attachment = &attachment{
+			Name:    m.name,
+			Type:    "image/jpeg",
+			Size:    1000,
+			Expires: expires,
+			URL:     "https://ntfy.sh/file/" + m.id + ".jpg",
+		}
+		require.Nil(t, c.AddMessage(msg))
+	}
+	size, err := c.AttachmentBytesUsedBySender("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), size)
+
+	ids, err := c.SupersedeAttachments("sensor", "snapshot.jpg", "m5")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"m1", "m2"}, ids)
+
+	// Messages are kept, but their attachments are expired and no longer count towards the quota
+	m1, err := c.Message("m1")
+	require.Nil(t, err)
+	require.Equal(t, "snapshot.jpg", m1.Attachment.Name)
+	require.Less(t, m1.Attachment.Expires, time.Now().Unix())
+	size, err = c.AttachmentBytesUsedBySender("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(3000), size)
+
+	// Already superseded attachments are not returned again
+	ids, err = c.SupersedeAttachments("sensor", "snapshot.jpg", "m5")
+	require.Nil(t, err)
+	require.Empty(t, ids)
+}
+
 func TestSqliteCache_Migration_From0(t *testing.T) {
 	filename := newSqliteTestCacheFile(t)
 	db, err := sql.Open("sqlite3", filename)
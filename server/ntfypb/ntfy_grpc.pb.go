@@ -0,0 +1,178 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: ntfy.proto
+
+package ntfypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Ntfy_Publish_FullMethodName   = "/ntfy.Ntfy/Publish"
+	Ntfy_Subscribe_FullMethodName = "/ntfy.Ntfy/Subscribe"
+)
+
+// NtfyClient is the client API for Ntfy service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type NtfyClient interface {
+	// Publish publishes a single message to a topic, and returns the published message
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*Message, error)
+	// Subscribe streams messages of one or more topics, including "open" and "keepalive" events
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Ntfy_SubscribeClient, error)
+}
+
+type ntfyClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewNtfyClient(cc grpc.ClientConnInterface) NtfyClient {
+	return &ntfyClient{cc}
+}
+
+func (c *ntfyClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*Message, error) {
+	out := new(Message)
+	err := c.cc.Invoke(ctx, Ntfy_Publish_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ntfyClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Ntfy_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Ntfy_ServiceDesc.Streams[0], Ntfy_Subscribe_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &ntfySubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Ntfy_SubscribeClient interface {
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type ntfySubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *ntfySubscribeClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NtfyServer is the server API for Ntfy service.
+// All implementations must embed UnimplementedNtfyServer
+// for forward compatibility
+type NtfyServer interface {
+	// Publish publishes a single message to a topic, and returns the published message
+	Publish(context.Context, *PublishRequest) (*Message, error)
+	// Subscribe streams messages of one or more topics, including "open" and "keepalive" events
+	Subscribe(*SubscribeRequest, Ntfy_SubscribeServer) error
+	mustEmbedUnimplementedNtfyServer()
+}
+
+// UnimplementedNtfyServer must be embedded to have forward compatible implementations.
+type UnimplementedNtfyServer struct {
+}
+
+func (UnimplementedNtfyServer) Publish(context.Context, *PublishRequest) (*Message, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedNtfyServer) Subscribe(*SubscribeRequest, Ntfy_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedNtfyServer) mustEmbedUnimplementedNtfyServer() {}
+
+// UnsafeNtfyServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to NtfyServer will
+// result in compilation errors.
+type UnsafeNtfyServer interface {
+	mustEmbedUnimplementedNtfyServer()
+}
+
+func RegisterNtfyServer(s grpc.ServiceRegistrar, srv NtfyServer) {
+	s.RegisterService(&Ntfy_ServiceDesc, srv)
+}
+
+func _Ntfy_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NtfyServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ntfy_Publish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NtfyServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Ntfy_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NtfyServer).Subscribe(m, &ntfySubscribeServer{stream})
+}
+
+type Ntfy_SubscribeServer interface {
+	Send(*Message) error
+	grpc.ServerStream
+}
+
+type ntfySubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *ntfySubscribeServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Ntfy_ServiceDesc is the grpc.ServiceDesc for Ntfy service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (including by way of reflection or type assertion)
+var Ntfy_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ntfy.Ntfy",
+	HandlerType: (*NtfyServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _Ntfy_Publish_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Ntfy_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "ntfy.proto",
+}
@@ -0,0 +1,500 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // SHA-256 of an empty body
+	s3DeleteBatchSize  = 1000                                                               // Max. number of keys per DeleteObjects request
+	s3DateFormat       = "20060102T150405Z"
+	s3ConnectTimeout   = 10 * time.Second // Timeout for connecting to the S3 endpoint, including the TLS handshake
+	s3ResponseTimeout  = 30 * time.Second // Timeout for the S3 endpoint to respond, after the request has been sent
+)
+
+var _ attachmentStore = (*s3Store)(nil)
+
+// s3Store is an attachmentStore that stores attachments in an S3-compatible object storage (AWS S3, MinIO,
+// Cloudflare R2, ...), so that attachments survive restarts and can be shared by multiple ntfy servers. Objects
+// are addressed path-style (<endpoint>/<bucket>/<message ID>), and requests are signed with AWS Signature V4.
+//
+// The bucket should be dedicated to ntfy, since all objects in it count towards the total size limit.
+type s3Store struct {
+	endpoint         *url.URL
+	bucket           string
+	region           string
+	accessKey        string
+	secretKey        string
+	client           *http.Client
+	sizes            map[string]int64 // Object sizes, so that the total size can be updated without listing the bucket
+	totalSizeCurrent int64
+	totalSizeLimit   int64
+	mu               sync.Mutex
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3DeleteRequest struct {
+	XMLName xml.Name            `xml:"Delete"`
+	Quiet   bool                `xml:"Quiet"`
+	Objects []s3DeleteRequestID `xml:"Object"`
+}
+
+type s3DeleteRequestID struct {
+	Key string `xml:"Key"`
+}
+
+type s3DeleteResult struct {
+	Errors []struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+func newS3Store(endpoint, bucket, region, accessKey, secretKey string, totalSizeLimit int64) (*s3Store, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %s, must be an http:// or https:// URL", endpoint)
+	}
+	c := &s3Store{
+		endpoint:       u,
+		bucket:         bucket,
+		region:         region,
+		accessKey:      accessKey,
+		secretKey:      secretKey,
+		client:         newS3HTTPClient(),
+		totalSizeLimit: totalSizeLimit,
+	}
+	sizes, err := c.listObjects()
+	if err != nil {
+		return nil, err
+	}
+	c.sizes = sizes
+	for _, size := range sizes {
+		c.totalSizeCurrent += size
+	}
+	return c, nil
+}
+
+// newS3HTTPClient returns the HTTP client used for S3 requests. There is no overall request timeout, since objects
+// are streamed to the subscriber while downloading (see s3Object), which may take a long time for slow clients.
+// Instead, connecting and waiting for the response are limited, so that an unresponsive endpoint does not block
+// publishers and subscribers forever.
+func newS3HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: s3ConnectTimeout}).DialContext,
+			TLSHandshakeTimeout:   s3ConnectTimeout,
+			ResponseHeaderTimeout: s3ResponseTimeout,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   10,
+		},
+	}
+}
+
+// Write uploads the attachment to the bucket. S3 requires the content length (and we sign the content hash) before
+// the upload starts, so the attachment is first written to a temporary file. The limiters are applied while doing
+// so, i.e. size limits and visitor quotas are enforced before anything is uploaded.
+func (c *s3Store) Write(id string, in io.Reader, limiters ...util.Limiter) (int64, error) {
+	if !fileIDRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	log.Tag(tagFileCache).Field("message_id", id).Debug("Writing attachment to S3")
+	if exists, err := c.exists(id); err != nil {
+		return 0, err
+	} else if exists {
+		return 0, errFileExists
+	}
+	f, err := os.CreateTemp("", "ntfy-attachment-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	hash := sha256.New()
+	limiters = append(limiters, util.NewFixedLimiter(c.Remaining()))
+	limitWriter := util.NewLimitWriter(io.MultiWriter(f, hash), limiters...)
+	size, err := io.Copy(limitWriter, in)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.objectURL(id), f)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.do(req, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	c.mu.Lock()
+	c.sizes[id] = size
+	c.totalSizeCurrent += size
+	mset(metricAttachmentsTotalSize, c.totalSizeCurrent)
+	c.mu.Unlock()
+	return size, nil
+}
+
+// Read returns a seekable reader for the attachment. Only the metadata is requested here (HEAD); the object itself
+// is downloaded when reading from the reader, starting at the current offset, so that HEAD and range requests do
+// not download the entire object. The reader must be closed.
+func (c *s3Store) Read(id string) (io.ReadSeekCloser, int64, time.Time, error) {
+	if !fileIDRegex.MatchString(id) {
+		return nil, 0, time.Time{}, errInvalidFileID
+	}
+	req, err := http.NewRequest(http.MethodHead, c.objectURL(id), nil)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	resp, err := c.do(req, s3EmptyPayloadHash)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3Object{store: c, id: id, size: resp.ContentLength}, resp.ContentLength, modTime, nil
+}
+
+// Remove deletes the attachments from the bucket (in batches, using DeleteObjects), and subtracts their sizes from
+// the total size. Deleting objects that do not exist is not an error. If objects cannot be deleted, an error is
+// returned after all batches were attempted.
+func (c *s3Store) Remove(ids ...string) error {
+	for _, id := range ids {
+		if !fileIDRegex.MatchString(id) {
+			return errInvalidFileID
+		}
+	}
+	var errs []error
+	for i := 0; i < len(ids); i += s3DeleteBatchSize {
+		batch := ids[i:min(i+s3DeleteBatchSize, len(ids))]
+		log.Tag(tagFileCache).Field("message_ids", batch).Debug("Deleting %d attachment(s) from S3", len(batch))
+		deleted, err := c.deleteObjects(batch)
+		c.forget(deleted...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *s3Store) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.totalSizeCurrent
+}
+
+func (c *s3Store) Remaining() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	remaining := c.totalSizeLimit - c.totalSizeCurrent
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// forget subtracts the sizes of the deleted objects from the total size. Objects that this server did not write or
+// list on startup (e.g. because they were written by another ntfy server) are not part of the total size.
+func (c *s3Store) forget(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		if size, ok := c.sizes[id]; ok {
+			c.totalSizeCurrent -= size
+			delete(c.sizes, id)
+		}
+	}
+	mset(metricAttachmentsTotalSize, c.totalSizeCurrent)
+}
+
+// get downloads the object, starting at the given offset
+func (c *s3Store) get(id string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.objectURL(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(req, s3EmptyPayloadHash)
+	if err != nil {
+		return nil, err
+	} else if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response from S3 for range request %s: %s", req.URL.Path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Store) exists(id string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, c.objectURL(id), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(req, s3EmptyPayloadHash)
+	if errors.Is(err, errFileNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// deleteObjects deletes the objects using a single DeleteObjects request, and returns the IDs of the objects that
+// were deleted. Since the request is sent in quiet mode, the response only lists the objects that could not be
+// deleted.
+func (c *s3Store) deleteObjects(ids []string) ([]string, error) {
+	deleteRequest := &s3DeleteRequest{Quiet: true}
+	for _, id := range ids {
+		deleteRequest.Objects = append(deleteRequest.Objects, s3DeleteRequestID{Key: id})
+	}
+	body, err := xml.Marshal(deleteRequest)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.bucketURL(url.Values{"delete": {""}}), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	checksum := md5.Sum(body)
+	bodyHash := sha256.Sum256(body)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(checksum[:])) // Required by DeleteObjects
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := c.do(req, hex.EncodeToString(bodyHash[:]))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result s3DeleteResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	} else if len(result.Errors) == 0 {
+		return ids, nil
+	}
+	failed := make(map[string]bool)
+	for _, e := range result.Errors {
+		failed[e.Key] = true
+	}
+	deleted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !failed[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	first := result.Errors[0]
+	return deleted, fmt.Errorf("cannot delete %d attachment(s) from S3, e.g. %s: %s %s", len(result.Errors), first.Key, first.Code, first.Message)
+}
+
+// listObjects returns the sizes of all objects in the bucket, following the pagination of ListObjectsV2
+func (c *s3Store) listObjects() (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	var continuationToken string
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		req, err := http.NewRequest(http.MethodGet, c.bucketURL(query), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, s3EmptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			sizes[object.Key] = object.Size
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return sizes, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// do signs and sends the request. Non-2xx responses are returned as errors; a 404 is returned as errFileNotFound.
+func (c *s3Store) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s3SignRequest(req, payloadHash, c.region, c.accessKey, c.secretKey, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errFileNotFound
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("unexpected response from S3 for %s %s: %s %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (c *s3Store) objectURL(id string) string {
+	return fmt.Sprintf("%s/%s/%s", c.endpoint.String(), c.bucket, id)
+}
+
+func (c *s3Store) bucketURL(query url.Values) string {
+	return fmt.Sprintf("%s/%s?%s", c.endpoint.String(), c.bucket, s3CanonicalQuery(query))
+}
+
+// s3SignRequest signs the request with AWS Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+//
+// The host header, all x-amz-* headers, as well as the Content-MD5, Content-Type and Range headers are signed.
+func s3SignRequest(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-md5" || name == "content-type" || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, region, "s3", "aws4_request"}, "/")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+	signingKey := s3HMAC([]byte("AWS4"+secretKey), date)
+	signingKey = s3HMAC(signingKey, region)
+	signingKey = s3HMAC(signingKey, "s3")
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalQuery encodes the query as required by Signature V4: sorted by key, and percent-encoded as in RFC 3986
+// (url.Values.Encode encodes spaces as "+", which S3 does not accept in signatures)
+func s3CanonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Object is a seekable reader for an object in the bucket. The object is downloaded lazily on the first read,
+// starting at the current offset (using a range request). Seeking to another offset closes the current download,
+// so that the next read starts a new one.
+type s3Object struct {
+	store  *s3Store
+	id     string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		body, err := o.store.get(o.id, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	case io.SeekStart:
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
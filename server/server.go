@@ -17,13 +17,14 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
+	"text/template/parse"
 	"time"
 	"unicode/utf8"
 
@@ -31,6 +32,8 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
@@ -38,29 +41,51 @@ import (
 
 // Server is the main server, providing the UI and API for ntfy
 type Server struct {
-	config            *Config
-	httpServer        *http.Server
-	httpsServer       *http.Server
-	httpMetricsServer *http.Server
-	httpProfileServer *http.Server
-	unixListener      net.Listener
-	smtpServer        *smtp.Server
-	smtpServerBackend *smtpBackend
-	smtpSender        mailer
-	topics            map[string]*topic
-	visitors          map[string]*visitor // ip:<ip> or user:<user>
-	firebaseClient    *firebaseClient
-	messages          int64                               // Total number of messages (persisted if messageCache enabled)
-	messagesHistory   []int64                             // Last n values of the messages counter, used to determine rate
-	userManager       *user.Manager                       // Might be nil!
-	messageCache      *messageCache                       // Database that stores the messages
-	webPush           *webPushStore                       // Database that stores web push subscriptions
-	fileCache         *fileCache                          // File system based cache that stores attachments
-	stripe            stripeAPI                           // Stripe API, can be replaced with a mock
-	priceCache        *util.LookupCache[map[string]int64] // Stripe price ID -> price as cents (USD implied!)
-	metricsHandler    http.Handler                        // Handles /metrics if enable-metrics set, and listen-metrics-http not set
-	closeChan         chan bool
-	mu                sync.RWMutex
+	config               *Config
+	httpServer           *http.Server
+	httpsServer          *http.Server
+	httpMetricsServer    *http.Server
+	httpProfileServer    *http.Server
+	unixListener         net.Listener
+	grpcServer           *grpc.Server
+	smtpServer           *smtp.Server
+	smtpServerBackend    *smtpBackend
+	smtpSender           mailer
+	topics               map[string]*topic
+	visitors             map[string]*visitor       // ip:<ip> or user:<user>
+	callMenus            map[string]*callMenu      // Message ID -> menu of an ongoing phone call, see X-Call-Menu
+	repeats              map[string]*messageRepeat // Message ID -> unacknowledged message, see X-Repeat-Until-Ack
+	repeatIDs            map[string]string         // Message ID of a repeat -> message ID of the original message
+	ackConsumers         map[string]*ackConsumer   // Owner (user or IP), topics and consumer ID -> pending deliveries, see ack_consumer
+	ackConnections       int                       // Sequence number of the last ack consumer connection
+	spamBodies           map[string]*spamBody      // Hash of title and body -> senders, see Config.SpamDuplicateThreshold
+	spamBodyQueue        []*spamBody               // Tracked bodies, oldest first, to prune and evict them in order
+	topicPublishLimiters map[string]*rate.Limiter  // Topic -> token bucket, see Config.TopicPublishLimits
+	tagMap               map[string]string         // Custom tag -> replacement, see emoji-tag-map-file
+	defaultFilters       map[string]*queryFilter   // Topic -> default subscribe filter, see Config.TopicDefaultFilters
+	firebaseClient       *firebaseClient
+	kafkaProducer        *kafkaProducer                      // Only set if Config.KafkaBrokers is set
+	iconClient           *http.Client                        // Fetches X-Icon URLs if icon caching is enabled, see newPublicHTTPClient
+	attachmentClient     *http.Client                        // Fetches X-Attach URLs on hosts with configured credentials
+	urlExpander          urlExpander                         // Expands shortened URLs in message bodies, only set if Config.ExpandURLHosts is set
+	markdownSanitizer    *util.MarkdownSanitizer             // Removes dangerous HTML from Markdown messages, only set if Config.MarkdownSanitizePolicy is set
+	receiptClient        *http.Client                        // Sends delivery receipts (X-Receipt-URL), see newPublicHTTPClient
+	callMenuClient       *http.Client                        // Sends call menu webhooks and HTTP actions (X-Call-Menu), see newPublicHTTPClient
+	messages             int64                               // Total number of messages (persisted if messageCache enabled)
+	messagesHistory      []int64                             // Last n values of the messages counter, used to determine rate
+	userManager          *user.Manager                       // Might be nil!
+	messageCache         *messageCache                       // Database that stores the messages
+	webPush              *webPushStore                       // Database that stores web push subscriptions
+	apnsStore            *apnsStore                          // Database that stores APNs device registrations, may be nil
+	apnsSender           apnsSender                          // Sends notifications to APNs directly, may be nil
+	fileCache            attachmentStore                     // Stores attachments, on disk or in S3-compatible object storage
+	stripe               stripeAPI                           // Stripe API, can be replaced with a mock
+	priceCache           *util.LookupCache[map[string]int64] // Stripe price ID -> price as cents (USD implied!)
+	metricsHandler       http.Handler                        // Handles /metrics if enable-metrics set, and listen-metrics-http not set
+	draining             atomic.Bool                         // Set when the server is shutting down gracefully, see Shutdown
+	drainChan            chan bool                           // Closed when the server starts shutting down gracefully, ends all subscriptions
+	closeChan            chan bool
+	mu                   sync.RWMutex
 }
 
 // handleFunc extends the normal http.HandlerFunc to be able to easily return errors
@@ -76,7 +101,14 @@ var (
 	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/raw$`)
 	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/ws$`)
 	authPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/auth$`)
+	subscribeAnyPathRegex  = regexp.MustCompile(`^/[^/]*/(json|sse|raw|ws|auth)$`) // Catches malformed topics in subscribe paths, e.g. //json or /my%20topic/sse
 	publishPathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/(publish|send|trigger)$`)
+	slackPathRegex         = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/slack$`)
+	ackPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/([-_A-Za-z0-9]{1,64})/ack$`)
+	scheduleListPathRegex  = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/schedules$`)
+	searchPathRegex        = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/search$`)
+	schedulePathRegex      = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/schedules/([-_A-Za-z0-9]{1,64})$`)
+	topicPathRegexes       = []*regexp.Regexp{topicPathRegex, jsonPathRegex, ssePathRegex, rawPathRegex, wsPathRegex, authPathRegex, publishPathRegex, slackPathRegex, ackPathRegex, scheduleListPathRegex, searchPathRegex, schedulePathRegex}
 
 	webConfigPath                                        = "/config.js"
 	webManifestPath                                      = "/manifest.webmanifest"
@@ -88,9 +120,12 @@ var (
 	apiHealthPath                                        = "/v1/health"
 	apiStatsPath                                         = "/v1/stats"
 	apiWebPushPath                                       = "/v1/webpush"
+	apiAPNSPath                                          = "/v1/apns"
+	apiSubscribeURLPath                                  = "/v1/account/subscribe-url"
 	apiTiersPath                                         = "/v1/tiers"
 	apiUsersPath                                         = "/v1/users"
 	apiUsersAccessPath                                   = "/v1/users/access"
+	apiSubscribersPath                                   = "/v1/subscribers"
 	apiAccountPath                                       = "/v1/account"
 	apiAccountTokenPath                                  = "/v1/account/token"
 	apiAccountPasswordPath                               = "/v1/account/password"
@@ -105,11 +140,14 @@ var (
 	apiAccountBillingSubscriptionCheckoutSuccessTemplate = "/v1/account/billing/subscription/success/{CHECKOUT_SESSION_ID}"
 	apiAccountBillingSubscriptionCheckoutSuccessRegex    = regexp.MustCompile(`/v1/account/billing/subscription/success/(.+)$`)
 	apiAccountReservationSingleRegex                     = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})$`)
+	apiCallGatherTemplate                                = "/v1/call/%s/gather"
+	apiCallGatherRegex                                   = regexp.MustCompile(`^/v1/call/([-_A-Za-z0-9]{1,64})/gather$`)
 	staticRegex                                          = regexp.MustCompile(`^/static/.+`)
 	docsRegex                                            = regexp.MustCompile(`^/docs(|/.*)$`)
 	fileRegex                                            = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
 	urlRegex                                             = regexp.MustCompile(`^https?://`)
 	phoneNumberRegex                                     = regexp.MustCompile(`^\+\d{1,100}$`)
+	collapseKeyRegex                                     = regexp.MustCompile(`^[-_.:A-Za-z0-9]{1,64}$`)
 
 	//go:embed site
 	webFs       embed.FS
@@ -129,17 +167,29 @@ const (
 	newMessageBody           = "New message"             // Used in poll requests as generic message
 	defaultAttachmentMessage = "You received a file: %s" // Used if message body is empty, and there is an attachment
 	encodingBase64           = "base64"                  // Used mainly for binary UnifiedPush messages
+	encryptionClient         = "client"                  // Attachment is encrypted client-side, the server only stores ciphertext
 	jsonBodyBytesLimit       = 32768                     // Max number of bytes for a request bodys (unless MessageLimit is higher)
 	unifiedPushTopicPrefix   = "up"                      // Temporarily, we rate limit all "up*" topics based on the subscriber
 	unifiedPushTopicLength   = 14                        // Length of UnifiedPush topics, including the "up" part
 	messagesHistoryMax       = 10                        // Number of message count values to keep in memory
 	templateMaxExecutionTime = 100 * time.Millisecond
+	statsTopTopicsDefault    = 10   // Number of topics returned in the admin stats, unless ?top= is passed
+	statsTopTopicsMax        = 100  // Max value for ?top= in the admin stats
+	subscribersLimitDefault  = 100  // Number of subscribers returned in the admin subscriber list, unless ?limit= is passed
+	subscribersLimitMax      = 1000 // Max value for ?limit= in the admin subscriber list
+	searchLimitDefault       = 100  // Number of messages returned by the topic search, unless ?limit= is passed
+	searchLimitMax           = 1000 // Max value for ?limit= in the topic search
+	keepaliveJitter          = 0.1  // Keepalive intervals are randomized by ±10%, to avoid all clients being woken up at once
 )
 
 var (
 	// templateDisallowedRegex tests a template for disallowed expressions. While not really dangerous, they
 	// are not useful, and seem potentially troublesome.
 	templateDisallowedRegex = regexp.MustCompile(`(?m)\{\{-?\s*(call|template|define)\b`)
+
+	// templateShorthandRegex matches the "${.field}" shorthand for "{{.field}}", which is easier to type in headers
+	// and query parameters of webhook URLs
+	templateShorthandRegex = regexp.MustCompile(`\$\{\s*(\.[^{}]*?)\s*}`)
 )
 
 // WebSocket constants
@@ -161,6 +211,22 @@ func New(conf *Config) (*Server, error) {
 	if conf.StripeSecretKey != "" {
 		stripe = newStripeAPI()
 	}
+	var tagMap map[string]string
+	if conf.EnableEmojiTags && conf.EmojiTagMapFile != "" {
+		var err error
+		tagMap, err = readTagMapFile(conf.EmojiTagMapFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defaultFilters := make(map[string]*queryFilter)
+	for topic, filter := range conf.TopicDefaultFilters {
+		f, err := parseDefaultFilter(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default filter for topic %s: %w", topic, err)
+		}
+		defaultFilters[topic] = f
+	}
 	messageCache, err := createMessageCache(conf)
 	if err != nil {
 		return nil, err
@@ -172,6 +238,18 @@ func New(conf *Config) (*Server, error) {
 			return nil, err
 		}
 	}
+	var apnsDevices *apnsStore
+	var apnsMessageSender apnsSender
+	if conf.APNSKeyFile != "" {
+		apnsMessageSender, err = newAPNSSender(conf.APNSKeyFile, conf.APNSKeyID, conf.APNSTeamID, conf.APNSBundleID, conf.APNSProduction)
+		if err != nil {
+			return nil, err
+		}
+		apnsDevices, err = newAPNSStore(conf.APNSDeviceFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 	topics, err := messageCache.Topics()
 	if err != nil {
 		return nil, err
@@ -180,8 +258,13 @@ func New(conf *Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	var fileCache *fileCache
-	if conf.AttachmentCacheDir != "" {
+	var fileCache attachmentStore
+	if conf.AttachmentS3Bucket != "" {
+		fileCache, err = newS3Store(conf.AttachmentS3Endpoint, conf.AttachmentS3Bucket, conf.AttachmentS3Region, conf.AttachmentS3AccessKey, conf.AttachmentS3SecretKey, conf.AttachmentTotalSizeLimit)
+		if err != nil {
+			return nil, err
+		}
+	} else if conf.AttachmentCacheDir != "" {
 		fileCache, err = newFileCache(conf.AttachmentCacheDir, conf.AttachmentTotalSizeLimit)
 		if err != nil {
 			return nil, err
@@ -193,6 +276,21 @@ func New(conf *Config) (*Server, error) {
 		if err != nil {
 			return nil, err
 		}
+		if conf.AuthLDAPURL != "" {
+			ldapAuthenticator := user.NewLDAPAuthenticator(&user.LDAPConfig{
+				URL:            conf.AuthLDAPURL,
+				BindDN:         conf.AuthLDAPBindDN,
+				BindPassword:   conf.AuthLDAPBindPassword,
+				BaseDN:         conf.AuthLDAPBaseDN,
+				UserFilter:     conf.AuthLDAPUserFilter,
+				GroupAttribute: conf.AuthLDAPGroupAttribute,
+				CacheTTL:       conf.AuthLDAPCacheTTL,
+			})
+			userManager.SetAuthenticator(ldapAuthenticator, &user.GroupMapping{
+				AdminGroups: conf.AuthLDAPAdminGroups,
+				Grants:      conf.AuthLDAPGroupAccess,
+			})
+		}
 	}
 	var firebaseClient *firebaseClient
 	if conf.FirebaseKeyFile != "" {
@@ -206,21 +304,62 @@ func New(conf *Config) (*Server, error) {
 		if userManager != nil {
 			auther = userManager
 		}
-		firebaseClient = newFirebaseClient(sender, auther)
+		firebaseClient = newFirebaseClient(sender, auther, conf.RedactPatterns, conf.FirebasePriorityRoutes)
+	}
+	var kafka *kafkaProducer
+	if len(conf.KafkaBrokers) > 0 {
+		kafka, err = newKafkaProducer(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var iconClient *http.Client
+	if conf.EnableIconCache && fileCache != nil {
+		iconClient = newPublicHTTPClient(iconFetchTimeout)
+	}
+	var attachmentClient *http.Client
+	if len(conf.AttachmentFetchCredentials) > 0 && fileCache != nil {
+		attachmentClient = &http.Client{
+			Timeout:       attachmentFetchTimeout,
+			CheckRedirect: checkAttachmentFetchRedirect,
+		}
+	}
+	var expander urlExpander
+	if len(conf.ExpandURLHosts) > 0 {
+		expander = newURLExpander(conf.ExpandURLHosts, conf.ExpandURLTimeout)
 	}
 	s := &Server{
-		config:          conf,
-		messageCache:    messageCache,
-		webPush:         webPush,
-		fileCache:       fileCache,
-		firebaseClient:  firebaseClient,
-		smtpSender:      mailer,
-		topics:          topics,
-		userManager:     userManager,
-		messages:        messages,
-		messagesHistory: []int64{messages},
-		visitors:        make(map[string]*visitor),
-		stripe:          stripe,
+		config:               conf,
+		messageCache:         messageCache,
+		webPush:              webPush,
+		apnsStore:            apnsDevices,
+		apnsSender:           apnsMessageSender,
+		fileCache:            fileCache,
+		firebaseClient:       firebaseClient,
+		kafkaProducer:        kafka,
+		iconClient:           iconClient,
+		attachmentClient:     attachmentClient,
+		urlExpander:          expander,
+		markdownSanitizer:    newMarkdownSanitizer(conf),
+		receiptClient:        newPublicHTTPClient(receiptRequestTimeout),
+		callMenuClient:       newPublicHTTPClient(callMenuWebhookTimeout),
+		smtpSender:           mailer,
+		topics:               topics,
+		userManager:          userManager,
+		messages:             messages,
+		messagesHistory:      []int64{messages},
+		visitors:             make(map[string]*visitor),
+		callMenus:            make(map[string]*callMenu),
+		repeats:              make(map[string]*messageRepeat),
+		repeatIDs:            make(map[string]string),
+		ackConsumers:         make(map[string]*ackConsumer),
+		spamBodies:           make(map[string]*spamBody),
+		spamBodyQueue:        make([]*spamBody, 0),
+		topicPublishLimiters: make(map[string]*rate.Limiter),
+		tagMap:               tagMap,
+		defaultFilters:       defaultFilters,
+		stripe:               stripe,
+		drainChan:            make(chan bool),
 	}
 	s.priceCache = util.NewLookupCache(s.fetchStripePrices, conf.StripePriceCacheDuration)
 	return s, nil
@@ -248,6 +387,9 @@ func (s *Server) Run() error {
 	if s.config.ListenUnix != "" {
 		listenStr += fmt.Sprintf(" %s[unix]", s.config.ListenUnix)
 	}
+	if s.config.ListenGRPC != "" {
+		listenStr += fmt.Sprintf(" %s[grpc]", s.config.ListenGRPC)
+	}
 	if s.config.SMTPServerListen != "" {
 		listenStr += fmt.Sprintf(" %s[smtp]", s.config.SMTPServerListen)
 	}
@@ -262,6 +404,13 @@ func (s *Server) Run() error {
 		fmt.Fprintf(os.Stderr, "Listening on%s, ntfy %s\n", listenStr, s.config.Version)
 		fmt.Fprintf(os.Stderr, "Logs are written to %s\n", log.File())
 	}
+	var grpcServer *grpc.Server
+	if s.config.ListenGRPC != "" {
+		var err error
+		if grpcServer, err = newGRPCServer(s); err != nil {
+			return err
+		}
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handle)
 	errChan := make(chan error)
@@ -275,8 +424,13 @@ func (s *Server) Run() error {
 	}
 	if s.config.ListenHTTPS != "" {
 		s.httpsServer = &http.Server{Addr: s.config.ListenHTTPS, Handler: mux}
+		httpsServer, closeChan := s.httpsServer, s.closeChan
 		go func() {
-			errChan <- s.httpsServer.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
+			if s.config.TLSSessionTicketRotation > 0 {
+				errChan <- s.listenAndServeTLSWithTicketRotation(httpsServer, closeChan)
+			} else {
+				errChan <- httpsServer.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
+			}
 		}()
 	}
 	if s.config.ListenUnix != "" {
@@ -303,6 +457,17 @@ func (s *Server) Run() error {
 			errChan <- httpServer.Serve(s.unixListener)
 		}()
 	}
+	if grpcServer != nil {
+		s.grpcServer = grpcServer
+		go func() {
+			listener, err := net.Listen("tcp", s.config.ListenGRPC)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			errChan <- grpcServer.Serve(listener)
+		}()
+	}
 	if s.config.MetricsListenHTTP != "" {
 		initMetrics()
 		s.httpMetricsServer = &http.Server{Addr: s.config.MetricsListenHTTP, Handler: promhttp.Handler()}
@@ -336,7 +501,11 @@ func (s *Server) Run() error {
 	go s.runDelayedSender()
 	go s.runFirebaseKeepaliver()
 
-	return <-errChan
+	err := <-errChan
+	if s.draining.Load() {
+		return nil // Listeners were closed by Shutdown, not an error
+	}
+	return err
 }
 
 // Stop stops HTTP (+HTTPS) server and all managers
@@ -352,9 +521,15 @@ func (s *Server) Stop() {
 	if s.unixListener != nil {
 		s.unixListener.Close()
 	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
 	if s.smtpServer != nil {
 		s.smtpServer.Close()
 	}
+	if s.kafkaProducer != nil {
+		s.kafkaProducer.Close()
+	}
 	s.closeDatabases()
 	close(s.closeChan)
 }
@@ -367,18 +542,39 @@ func (s *Server) closeDatabases() {
 	if s.webPush != nil {
 		s.webPush.Close()
 	}
+	if s.apnsStore != nil {
+		s.apnsStore.Close()
+	}
 }
 
 // handle is the main entry point for all HTTP requests
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if len(s.config.CORSAllowedOrigins) > 0 {
+		w.Header().Add("Vary", "Origin")
+		if origin := s.corsAllowedOrigin(r); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin) // CORS, allow cross-origin requests from this origin only
+		}
+	}
+	if proxyNode := extractForwardedBy(r, s.config.BehindProxy, s.config.ProxyTrustedPrefixes); proxyNode != "" {
+		r = withContext(r, map[contextKey]any{contextProxyNode: proxyNode}) // Logged as http_proxy_node, see httpContext
+	}
+	if s.topicPathDisallowed(r) {
+		// Checked before authentication, so that no auth (or any other) work is done for disallowed topics
+		s.handleError(w, r, s.visitor(extractIPAddress(r, s.config.BehindProxy, s.config.ProxyTrustedPrefixes), nil), errHTTPForbiddenTopicDisallowed)
+		return
+	}
 	v, err := s.maybeAuthenticate(r) // Note: Always returns v, even when error is returned
 	if err != nil {
 		s.handleError(w, r, v, err)
 		return
+	} else if s.draining.Load() {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(s.shutdownRetryAfter().Seconds())))
+		s.handleError(w, r, v, errHTTPServiceUnavailableShuttingDown)
+		return
 	}
 	ev := logvr(v, r)
 	if ev.IsTrace() {
-		ev.Field("http_request", renderHTTPRequest(r)).Trace("HTTP request started")
+		ev.Field("http_request", redactString(renderHTTPRequest(r), s.config.RedactPatterns)).Trace("HTTP request started")
 	} else if logvr(v, r).IsDebug() {
 		ev.Debug("HTTP request started")
 	}
@@ -406,7 +602,9 @@ func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor,
 	isRateLimiting := util.Contains(rateLimitingErrorCodes, httpErr.HTTPCode)
 	isNormalError := strings.Contains(err.Error(), "i/o timeout") || util.Contains(normalErrorCodes, httpErr.HTTPCode)
 	ev := logvr(v, r).Err(err)
-	if websocket.IsWebSocketUpgrade(r) {
+	if websocket.IsWebSocketUpgrade(r) && !ok {
+		// Errors that occur before the connection is upgraded (e.g. auth, rate limits) are always *errHTTP,
+		// and are written below like for any other request. Everything else happens after the upgrade.
 		ev.Tag(tagWebsocket).Fields(websocketErrorContext(err))
 		if isNormalError {
 			ev.Debug("WebSocket error (this error is okay, it happens a lot): %s", err.Error())
@@ -423,11 +621,11 @@ func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor,
 	if isRateLimiting && s.config.StripeSecretKey != "" {
 		u := v.User()
 		if u == nil || u.Tier == nil {
-			httpErr = httpErr.Wrap("increase your limits with a paid plan, see %s", s.config.BaseURL)
+			httpErr = httpErr.Wrap("increase your limits with a paid plan, see %s", s.externalBaseURL(r))
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	s.setAccessControlAllowOrigin(w)
 	w.WriteHeader(httpErr.HTTPCode)
 	io.WriteString(w, httpErr.JSON()+"\n")
 }
@@ -453,6 +651,8 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureAdmin(s.handleAccessAllow)(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiUsersAccessPath {
 		return s.ensureAdmin(s.handleAccessReset)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiSubscribersPath {
+		return s.ensureAdmin(s.handleSubscribersGet)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPath {
 		return s.ensureUserManager(s.handleAccountCreate)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountPath {
@@ -461,6 +661,8 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureUser(s.withAccountSync(s.handleAccountDelete))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPasswordPath {
 		return s.ensureUser(s.handleAccountPasswordChange)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountTokenPath {
+		return s.ensureUser(s.handleAccountTokensGet)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountTokenPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountTokenCreate))(w, r, v)
 	} else if r.Method == http.MethodPatch && r.URL.Path == apiAccountTokenPath {
@@ -475,6 +677,8 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureUser(s.withAccountSync(s.handleAccountSubscriptionChange))(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountSubscriptionPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountSubscriptionDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiSubscribeURLPath {
+		return s.ensureSubscribeURLsEnabled(s.ensureUser(s.handleSubscribeURLCreate))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountReservationPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountReservationAdd))(w, r, v)
 	} else if r.Method == http.MethodDelete && apiAccountReservationSingleRegex.MatchString(r.URL.Path) {
@@ -497,10 +701,16 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureUser(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberAdd)))(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountPhonePath {
 		return s.ensureUser(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberDelete)))(w, r, v)
+	} else if r.Method == http.MethodPost && apiCallGatherRegex.MatchString(r.URL.Path) {
+		return s.ensureCallsEnabled(s.handleCallGather)(w, r, v) // This request comes from Twilio!
 	} else if r.Method == http.MethodPost && apiWebPushPath == r.URL.Path {
 		return s.ensureWebPushEnabled(s.limitRequests(s.handleWebPushUpdate))(w, r, v)
 	} else if r.Method == http.MethodDelete && apiWebPushPath == r.URL.Path {
 		return s.ensureWebPushEnabled(s.limitRequests(s.handleWebPushDelete))(w, r, v)
+	} else if r.Method == http.MethodPut && apiAPNSPath == r.URL.Path {
+		return s.ensureAPNSEnabled(s.limitRequests(s.handleAPNSDeviceUpdate))(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAPNSPath == r.URL.Path {
+		return s.ensureAPNSEnabled(s.limitRequests(s.handleAPNSDeviceDelete))(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiStatsPath {
 		return s.handleStats(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiTiersPath {
@@ -513,7 +723,7 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureWebEnabled(s.handleStatic)(w, r, v)
 	} else if r.Method == http.MethodGet && docsRegex.MatchString(r.URL.Path) {
 		return s.ensureWebEnabled(s.handleDocs)(w, r, v)
-	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && s.config.AttachmentCacheDir != "" {
+	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && s.fileCache != nil {
 		return s.limitRequests(s.handleFile)(w, r, v)
 	} else if r.Method == http.MethodOptions {
 		return s.limitRequests(s.handleOptions)(w, r, v) // Should work even if the web app is not enabled, see #598
@@ -525,6 +735,16 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish))(w, r, v)
 	} else if r.Method == http.MethodGet && publishPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish))(w, r, v)
+	} else if r.Method == http.MethodPost && slackPathRegex.MatchString(r.URL.Path) {
+		return s.transformSlackJSON(s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublishSlack)))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && ackPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handleMessageAck))(w, r, v)
+	} else if r.Method == http.MethodGet && scheduleListPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handleScheduleList))(w, r, v)
+	} else if r.Method == http.MethodDelete && schedulePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handleScheduleDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && searchPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequestsWithTopic(s.authorizeTopicRead(s.handleMessageSearch))(w, r, v)
 	} else if r.Method == http.MethodGet && jsonPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeJSON))(w, r, v)
 	} else if r.Method == http.MethodGet && ssePathRegex.MatchString(r.URL.Path) {
@@ -537,6 +757,8 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.limitRequests(s.authorizeTopicRead(s.handleTopicAuth))(w, r, v)
 	} else if r.Method == http.MethodGet && (topicPathRegex.MatchString(r.URL.Path) || externalTopicPathRegex.MatchString(r.URL.Path)) {
 		return s.ensureWebEnabled(s.handleTopic)(w, r, v)
+	} else if r.Method == http.MethodGet && subscribeAnyPathRegex.MatchString(r.URL.Path) {
+		return errHTTPBadRequestSubscribeTopicInvalid // Must be after the valid subscribe paths, never creates a topic
 	}
 	return errHTTPNotFound
 }
@@ -550,7 +772,7 @@ func (s *Server) handleTopic(w http.ResponseWriter, r *http.Request, v *visitor)
 	unifiedpush := readBoolParam(r, false, "x-unifiedpush", "unifiedpush", "up") // see PUT/POST too!
 	if unifiedpush {
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+		s.setAccessControlAllowOrigin(w)
 		_, err := io.WriteString(w, `{"unifiedpush":{"version":1}}`+"\n")
 		return err
 	}
@@ -587,6 +809,7 @@ func (s *Server) handleWebConfig(w http.ResponseWriter, _ *http.Request, _ *visi
 		BillingContact:     s.config.BillingContact,
 		WebPushPublicKey:   s.config.WebPushPublicKey,
 		DisallowedTopics:   s.config.DisallowedTopics,
+		EnableEmojiTags:    s.config.EnableEmojiTags,
 	}
 	b, err := json.MarshalIndent(response, "", "  ")
 	if err != nil {
@@ -637,14 +860,18 @@ func (s *Server) handleDocs(w http.ResponseWriter, r *http.Request, _ *visitor)
 	return nil
 }
 
-// handleStats returns the publicly available server stats
-func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+// handleStats returns the publicly available server stats. If the request is authenticated as an admin, the
+// response additionally contains message counts from the cache, the number of subscribers and the busiest topics.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	s.mu.RLock()
 	messages, n, rate := s.messages, len(s.messagesHistory), float64(0)
 	if n > 1 {
 		rate = float64(s.messagesHistory[n-1]-s.messagesHistory[0]) / (float64(n-1) * s.config.ManagerInterval.Seconds())
 	}
 	s.mu.RUnlock()
+	if u := v.User(); u != nil && u.IsAdmin() {
+		return s.handleStatsAdmin(w, r, messages, rate)
+	}
 	response := &apiStatsResponse{
 		Messages:     messages,
 		MessagesRate: rate,
@@ -652,11 +879,50 @@ func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request, _ *visitor)
 	return s.writeJSON(w, response)
 }
 
+func (s *Server) handleStatsAdmin(w http.ResponseWriter, r *http.Request, messages int64, rate float64) error {
+	limit := statsTopTopicsDefault
+	if limitStr := readQueryParam(r, "top"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > statsTopTopicsMax {
+			return errHTTPBadRequest.Wrap("top must be a number between 1 and %d", statsTopTopicsMax)
+		}
+	}
+	messagesCached, err := s.messageCache.MessagesCount()
+	if err != nil {
+		return err
+	}
+	messagesLastHour, err := s.messageCache.MessagesCountSince(time.Now().Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	messagesLastDay, err := s.messageCache.MessagesCountSince(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		return err
+	}
+	topics, err := s.messageCache.TopTopics(limit)
+	if err != nil {
+		return err
+	}
+	subscribers := s.subscriberCount()
+	response := &apiStatsAdminResponse{
+		Messages:         messages,
+		MessagesRate:     rate,
+		MessagesCached:   messagesCached,
+		MessagesLastHour: messagesLastHour,
+		MessagesLastDay:  messagesLastDay,
+		Subscribers:      subscribers,
+		Topics:           topics,
+		CacheSize:        cacheFileSize(s.config.CacheFile),
+	}
+	return s.writeJSON(w, response)
+}
+
 // handleFile processes the download of attachment files. The method handles GET and HEAD requests against a file.
 // Before streaming the file to a client, it locates uploader (m.Sender or m.User) in the message cache, so it
 // can associate the download bandwidth with the uploader.
 func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	if s.config.AttachmentCacheDir == "" {
+	if s.fileCache == nil {
 		return errHTTPInternalError
 	}
 	matches := fileRegex.FindStringSubmatch(r.URL.Path)
@@ -664,17 +930,22 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 		return errHTTPInternalErrorInvalidPath
 	}
 	messageID := matches[1]
-	file := filepath.Join(s.config.AttachmentCacheDir, messageID)
-	stat, err := os.Stat(file)
-	if err != nil {
+	if isIconFileID(messageID) {
+		return s.handleFileIcon(w, r, v, messageID)
+	}
+	f, size, modTime, err := s.fileCache.Read(messageID)
+	if errors.Is(err, errFileNotFound) || errors.Is(err, errInvalidFileID) {
 		return errHTTPNotFound.Fields(log.Context{
 			"message_id":    messageID,
 			"error_context": "filesystem",
 		})
+	} else if err != nil {
+		return err
 	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
+	defer f.Close()
+	s.setAccessControlAllowOrigin(w)
 	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 		return nil
 	}
 	// Find message in database, and associate bandwidth to the uploader user
@@ -709,20 +980,58 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	} else if m.Sender.IsValid() {
 		bandwidthVisitor = s.visitor(m.Sender, nil)
 	}
-	if !bandwidthVisitor.BandwidthAllowed(stat.Size()) {
+	if !bandwidthVisitor.BandwidthAllowed(size) {
 		return errHTTPTooManyRequestsLimitAttachmentBandwidth.With(m)
 	}
 	// Actually send file
-	f, err := os.Open(file)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
 	if m.Attachment.Name != "" {
 		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(m.Attachment.Name))
 	}
-	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f)
-	return err
+	cw := newCountingResponseWriter(w)
+	if m.Attachment.Encryption != "" {
+		w.Header().Set("X-Encryption", m.Attachment.Encryption) // Bytes are served untouched, the client must decrypt them
+	}
+	contentType := "application/octet-stream" // Encrypted attachments are ciphertext, never sniff them
+	if m.Attachment.Encryption == "" {
+		contentType, err = detectFileContentType(f, r.URL.Path)
+		if err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", contentType) // Must be set, or http.ServeContent will sniff it (and allow text/html)
+	http.ServeContent(cw, r, "", modTime, f)    // Handles range requests and sets Content-Length
+	madd(metricAttachmentsBytesServed, cw.written)
+	logvrm(v, r, m).
+		Tag(tagFileCache).
+		Fields(log.Context{
+			"attachment_bytes_served": cw.written,
+			"attachment_size":         size,
+			"attachment_range":        r.Header.Get("Range"),
+			"http_status":             cw.status,
+		}).
+		Info("Served attachment %s, %d byte(s) written", messageID, cw.written)
+	return nil
+}
+
+// maybeSupersedeAttachments removes earlier uploaded attachments with the same filename on the message's topic, if
+// attachment deduplication is enabled for the topic (attachment-dedup-topics). The earlier messages are kept, but
+// their attachments are marked as expired, so that clients only download the latest file. Since this happens after
+// the message was delivered, errors are only logged by the caller, and do not fail the publish request.
+func (s *Server) maybeSupersedeAttachments(v *visitor, r *http.Request, m *message) error {
+	if m.Attachment == nil || m.Attachment.Expires == 0 || !util.Contains(s.config.AttachmentDedupTopics, m.Topic) {
+		return nil // External attachments (X-Attach) have no expiry, and are never removed
+	}
+	ids, err := s.messageCache.SupersedeAttachments(m.Topic, m.Attachment.Name, m.ID)
+	if err != nil {
+		return err
+	} else if len(ids) == 0 {
+		return nil
+	}
+	logvrm(v, r, m).
+		Tag(tagFileCache).
+		Field("attachment_superseded_ids", ids).
+		Debug("Removing %d attachment(s) superseded by %s", len(ids), m.Attachment.Name)
+	return s.fileCache.Remove(ids...)
 }
 
 func (s *Server) handleMatrixDiscovery(w http.ResponseWriter) error {
@@ -732,7 +1041,7 @@ func (s *Server) handleMatrixDiscovery(w http.ResponseWriter) error {
 	return writeMatrixDiscoveryResponse(w)
 }
 
-func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, error) {
+func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (_ *message, err error) {
 	start := time.Now()
 	t, err := fromContext[*topic](r, contextTopic)
 	if err != nil {
@@ -742,7 +1051,10 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	if err != nil {
 		return nil, err
 	}
-	body, err := util.Peek(r.Body, s.config.MessageSizeLimit)
+	if err := s.checkExpectContinue(r, v); err != nil {
+		return nil, err.With(t)
+	}
+	body, err := util.Peek(r.Body, v.Limits().MessageSizeLimit)
 	if err != nil {
 		return nil, err
 	}
@@ -750,37 +1062,123 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	cache, firebase, email, call, template, unifiedpush, e := s.parsePublishParams(r, m)
 	if e != nil {
 		return nil, e.With(t)
-	}
+	} else if m.Title == "" && m.PollID == "" && util.Contains(s.config.RequireTitleTopics, t.ID) {
+		return nil, errHTTPBadRequestTitleRequired.With(t)
+	} else if isConditionalPublish(r) && !t.HasSubscribers() {
+		// Checked before the rate limits, so that skipped messages do not count against them, and before the
+		// body is read, so that attachments of skipped messages are never stored
+		logvrm(v, r, m).Tag(tagPublish).With(t).Debug("No active subscribers, message not published")
+		return nil, errHTTPPreconditionFailedNoSubscribers.With(t)
+	}
+	dry := isDryRun(r)
+	messageAllowed, emailAllowed, callAllowed := vrate.MessageAllowed, vrate.EmailAllowed, vrate.CallAllowed
+	if dry {
+		// Dry runs check the limits, but do not count against them
+		messageAllowed, emailAllowed, callAllowed = vrate.MessageAvailable, vrate.EmailAvailable, vrate.CallAvailable
+	}
+	var menu *callMenu
 	if unifiedpush && s.config.VisitorSubscriberRateLimiting && t.RateVisitor() == nil {
 		// UnifiedPush clients must subscribe before publishing to allow proper subscriber-based rate limiting.
 		// The 5xx response is because some app servers (in particular Mastodon) will remove
 		// the subscription as invalid if any 400-499 code (except 429/408) is returned.
 		// See https://github.com/mastodon/mastodon/blob/730bb3e211a84a2f30e3e2bbeae3f77149824a68/app/workers/web/push_notification_worker.rb#L35-L46
 		return nil, errHTTPInsufficientStorageUnifiedPush.With(t)
-	} else if !util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) && !vrate.MessageAllowed() {
+	} else if !s.topicPublishAvailable(t.ID) {
+		// The topic limit is checked before and counted after the visitor limit, so that messages rejected by
+		// one limit do not count against the other
+		return nil, errHTTPTooManyRequestsLimitTopicMessages.With(t)
+	} else if !util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) && !messageAllowed() {
 		return nil, errHTTPTooManyRequestsLimitMessages.With(t)
-	} else if email != "" && !vrate.EmailAllowed() {
+	} else if !dry && !s.topicPublishAllowed(t.ID) {
+		return nil, errHTTPTooManyRequestsLimitTopicMessages.With(t)
+	} else if email != "" && !emailAllowed() {
 		return nil, errHTTPTooManyRequestsLimitEmails.With(t)
 	} else if call != "" {
 		var httpErr *errHTTP
 		call, httpErr = s.convertPhoneNumber(v.User(), call)
 		if httpErr != nil {
 			return nil, httpErr.With(t)
-		} else if !vrate.CallAllowed() {
+		} else if !callAllowed() {
 			return nil, errHTTPTooManyRequestsLimitCalls.With(t)
 		}
+		if menuSpec := readParam(r, "x-call-menu", "call-menu"); menuSpec != "" {
+			if s.config.BaseURL == "" {
+				return nil, errHTTPInternalErrorMissingBaseURL.With(t)
+			}
+			menu, httpErr = parseCallMenu(menuSpec, m)
+			if httpErr != nil {
+				return nil, httpErr.With(t)
+			}
+		}
+	}
+	var repeatInterval time.Duration
+	var repeats int
+	if repeatSpec := readParam(r, "x-repeat-until-ack", "repeat-until-ack", "repeat"); repeatSpec != "" {
+		var httpErr *errHTTP
+		repeatInterval, repeats, httpErr = s.parseRepeatUntilAck(v, repeatSpec)
+		if httpErr != nil {
+			return nil, httpErr.With(t)
+		}
+	}
+	var recurrence *util.Recurrence
+	if cronSpec := readParam(r, "x-cron", "cron", "x-recur", "recur"); cronSpec != "" {
+		var httpErr *errHTTP
+		recurrence, httpErr = s.parseRecurrence(v, m, cronSpec, cache, email, call)
+		if httpErr != nil {
+			return nil, httpErr.With(t)
+		}
+		m.Schedule = util.RandomString(messageIDLength)
+		m.Time = recurrence.Next(time.Now()).Unix() // First occurrence is sent as a delayed message
+	}
+	receiptURL := readParam(r, "x-receipt-url", "receipt-url", "receipt")
+	if receiptURL != "" && !urlRegex.MatchString(receiptURL) {
+		return nil, errHTTPBadRequestReceiptURLInvalid.With(t)
+	} else if receiptURL != "" && m.Time > time.Now().Unix() {
+		return nil, errHTTPBadRequestReceiptURLInvalid.With(t).Wrap("delivery receipts are not supported for delayed or recurring messages")
 	}
 	if m.PollID != "" {
 		m = newPollRequestMessage(t.ID, m.PollID)
+	} else if !dry && readParam(r, "x-message-id", "message-id") != "" {
+		// Dry runs do not reserve the ID. Must be before the body is read, since attachments are stored by message ID.
+		if e := s.reserveCustomMessageID(v, m); e != nil {
+			return nil, e.With(t)
+		}
+		defer func() {
+			if err != nil {
+				if err := s.messageCache.ReleaseMessageID(m.ID); err != nil {
+					logvrm(v, r, m).Tag(tagPublish).Err(err).Warn("Cannot release message ID")
+				}
+			}
+		}()
 	}
+	forwardedBy := readForwardedBy(r)
 	m.Sender = v.IP()
 	m.User = v.MaybeUserID()
 	if cache {
-		m.Expires = time.Unix(m.Time, 0).Add(v.Limits().MessageExpiryDuration).Unix()
+		m.Expires = time.Unix(m.Time, 0).Add(s.messageExpiryDuration(v, m)).Unix()
 	}
-	if err := s.handlePublishBody(r, v, m, body, template, unifiedpush); err != nil {
+	if err := s.handlePublishBody(r, v, m, body, template, unifiedpush, dry); err != nil {
 		return nil, err
 	}
+	if s.config.StripANSI && m.Encoding == "" {
+		m.Message = util.StripANSI(m.Message)
+	}
+	if err := s.checkUniqueTitle(v, r, m); err != nil {
+		return nil, err
+	}
+	if !dry { // Dry runs do not download icons, expand URLs or store schedules
+		s.maybeCacheIcon(r, v, m)
+		s.maybeExpandURLs(r, v, m)
+	}
+	if recurrence != nil && !dry {
+		if err := s.addSchedule(v, r, m, recurrence); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Data) > 0 && readBoolParam(r, false, "x-data-table", "data-table") {
+		renderDataTableIntoMessage(m)
+	}
+	s.sanitizeMarkdown(m) // Must be after all changes to the message body
 	if m.Message == "" {
 		m.Message = emptyMessageBody
 	}
@@ -796,37 +1194,80 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 			"message_call":        call,
 		})
 	if ev.IsTrace() {
-		ev.Field("message_body", util.MaybeMarshalJSON(m)).Trace("Received message")
+		ev.Field("message_body", util.MaybeMarshalJSON(redactMessage(m, s.config.RedactPatterns))).Trace("Received message")
 	} else if ev.IsDebug() {
 		ev.Debug("Received message")
 	}
+	if dry {
+		logvrm(v, r, m).Tag(tagPublish).Debug("Dry run, message not published")
+		return m, nil
+	}
+	if reason := s.spamReason(v, m); reason != "" {
+		if err := s.quarantineMessage(v, r, m, reason); err != nil {
+			return nil, err
+		}
+		return m, nil // The publisher is not told that the message was quarantined
+	}
 	if !delayed {
-		if err := t.Publish(v, m); err != nil {
+		var rc *receipt
+		if receiptURL != "" {
+			rc = newReceipt(receiptURL)
+		}
+		if err := t.PublishWithReceipt(v, m, rc); err != nil {
 			return nil, err
 		}
 		if s.firebaseClient != nil && firebase {
-			go s.sendToFirebase(v, m)
+			rc.expect(1)
+			go func() {
+				defer rc.done()
+				if err := s.sendToFirebase(v, m); err == nil {
+					rc.forwardedToFirebase()
+				}
+			}()
 		}
 		if s.smtpSender != nil && email != "" {
 			go s.sendEmail(v, m, email)
 		}
 		if s.config.TwilioAccount != "" && call != "" {
-			go s.callPhone(v, r, m, call)
+			go s.callPhone(v, r, m, call, menu)
 		}
 		if s.config.UpstreamBaseURL != "" && !unifiedpush { // UP messages are not sent to upstream
 			go s.forwardPollRequest(v, m)
 		}
+		if !unifiedpush {
+			s.forwardToFederatedTopics(v, m, forwardedBy)
+		}
+		if s.kafkaProducer != nil {
+			s.sendToKafka(v, m) // Not a goroutine, so records are produced in order
+		}
 		if s.config.WebPushPublicKey != "" {
 			go s.publishToWebPushEndpoints(v, m)
 		}
+		if s.apnsSender != nil {
+			go s.sendToAPNs(v, m)
+		}
+		if rc != nil {
+			go s.sendReceipt(v, m, rc)
+		}
 	} else {
 		logvrm(v, r, m).Tag(tagPublish).Debug("Message delayed, will process later")
 	}
+	if repeats > 0 {
+		s.scheduleMessageRepeat(v, m, firebase, repeatInterval, repeats)
+	}
 	if cache {
 		logvrm(v, r, m).Tag(tagPublish).Debug("Adding message to cache")
 		if err := s.messageCache.AddMessage(m); err != nil {
 			return nil, err
 		}
+		if err := s.maybeSupersedeAttachments(v, r, m); err != nil {
+			// The message was delivered and cached already, so the publish request must not fail
+			logvrm(v, r, m).Tag(tagFileCache).Err(err).Warn("Unable to remove superseded attachments")
+		}
+		if err := s.maybeReplaceMessagesWithSameTitle(v, r, m); err != nil {
+			// The message was delivered and cached already, so the publish request must not fail
+			logvrm(v, r, m).Tag(tagPublish).Err(err).Warn("Unable to delete messages replaced by message with the same title")
+		}
 	}
 	u := v.User()
 	if s.userManager != nil && u != nil && u.Tier != nil {
@@ -844,14 +1285,36 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 
 func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	m, err := s.handlePublishInternal(r, v)
-	if err != nil {
+	if e, ok := err.(*errHTTP); ok && e.Code == errHTTPPreconditionFailedNoSubscribers.Code && isNoopIfNoSubscribers(r) {
+		return s.writeJSON(w, &publishSkippedResponse{Published: false})
+	} else if err != nil {
 		minc(metricMessagesPublishedFailure)
 		return err
+	} else if isDryRun(r) {
+		return s.writeJSON(w, &publishDryRunResponse{message: m, Dry: true})
 	}
 	minc(metricMessagesPublishedSuccess)
 	return s.writeJSON(w, m)
 }
 
+// isDryRun returns true if the publish request only asks for a preview of the message (X-Dry-Run), i.e. the message
+// is parsed and validated, but not stored, delivered or counted against any limits
+func isDryRun(r *http.Request) bool {
+	return readBoolParam(r, false, "x-dry-run", "dry-run", "dry")
+}
+
+// isConditionalPublish returns true if the message must only be published if the topic has active subscribers
+// (X-If-Present or X-If-Subscribers), see topic.HasSubscribers
+func isConditionalPublish(r *http.Request) bool {
+	return readBoolParam(r, false, "x-if-present", "if-present") || isNoopIfNoSubscribers(r)
+}
+
+// isNoopIfNoSubscribers returns true if a conditional publish request without active subscribers should be answered
+// with {"published":false} and HTTP 200 (X-If-Subscribers), instead of HTTP 412 (X-If-Present)
+func isNoopIfNoSubscribers(r *http.Request) bool {
+	return readBoolParam(r, false, "x-if-subscribers", "if-subscribers")
+}
+
 func (s *Server) handlePublishMatrix(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	_, err := s.handlePublishInternal(r, v)
 	if err != nil {
@@ -877,7 +1340,7 @@ func (s *Server) handlePublishMatrix(w http.ResponseWriter, r *http.Request, v *
 	return writeMatrixSuccess(w)
 }
 
-func (s *Server) sendToFirebase(v *visitor, m *message) {
+func (s *Server) sendToFirebase(v *visitor, m *message) error {
 	logvm(v, m).Tag(tagFirebase).Debug("Publishing to Firebase")
 	if err := s.firebaseClient.Send(v, m); err != nil {
 		minc(metricFirebasePublishedFailure)
@@ -886,9 +1349,10 @@ func (s *Server) sendToFirebase(v *visitor, m *message) {
 		} else {
 			logvm(v, m).Tag(tagFirebase).Err(err).Warn("Unable to publish to Firebase: %v", err.Error())
 		}
-		return
+		return err
 	}
 	minc(metricFirebasePublishedSuccess)
+	return nil
 }
 
 func (s *Server) sendEmail(v *visitor, m *message, email string) {
@@ -934,19 +1398,32 @@ func (s *Server) forwardPollRequest(v *visitor, m *message) {
 }
 
 func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, firebase bool, email, call string, template bool, unifiedpush bool, err *errHTTP) {
-	cache = readBoolParam(r, true, "x-cache", "cache")
+	if messageID := readParam(r, "x-message-id", "message-id"); messageID != "" {
+		if !validMessageID(messageID) {
+			return false, false, "", "", false, false, errHTTPBadRequestMessageIDInvalid
+		}
+		m.ID = messageID
+	}
+	cache = readBoolParam(r, true, "x-cache", "cache") && !s.isNoCacheTopic(m.Topic)
 	firebase = readBoolParam(r, true, "x-firebase", "firebase")
 	m.Title = readParam(r, "x-title", "title", "t")
 	m.Click = readParam(r, "x-click", "click")
 	icon := readParam(r, "x-icon", "icon")
 	filename := readParam(r, "x-filename", "filename", "file", "f")
 	attach := readParam(r, "x-attach", "attach", "a")
-	if attach != "" || filename != "" {
+	encryption := strings.ToLower(readParam(r, "x-encryption", "encryption"))
+	if encryption != "" && encryption != encryptionClient {
+		return false, false, "", "", false, false, errHTTPBadRequestEncryptionInvalid
+	}
+	if attach != "" || filename != "" || encryption != "" {
 		m.Attachment = &attachment{}
 	}
 	if filename != "" {
 		m.Attachment.Name = filename
 	}
+	if encryption != "" {
+		m.Attachment.Encryption = encryption
+	}
 	if attach != "" {
 		if !urlRegex.MatchString(attach) {
 			return false, false, "", "", false, false, errHTTPBadRequestAttachmentURLInvalid
@@ -990,7 +1467,7 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 	if e != nil {
 		return false, false, "", "", false, false, errHTTPBadRequestPriorityInvalid
 	}
-	m.Tags = readCommaSeparatedParam(r, "x-tags", "tags", "tag", "ta")
+	m.Tags = mapTags(readCommaSeparatedParam(r, "x-tags", "tags", "tag", "ta"), s.tagMap)
 	delayStr := readParam(r, "x-delay", "delay", "x-at", "at", "x-in", "in")
 	if delayStr != "" {
 		if !cache {
@@ -1019,6 +1496,24 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 			return false, false, "", "", false, false, errHTTPBadRequestActionsInvalid.Wrap(e.Error())
 		}
 	}
+	dataStr := readParam(r, "x-data", "data")
+	if dataStr != "" {
+		m.Data, e = parseData(dataStr)
+		if e != nil {
+			return false, false, "", "", false, false, errHTTPBadRequestDataInvalid.Wrap(e.Error())
+		}
+	}
+	locationStr := readParam(r, "x-location", "location", "loc")
+	if locationStr != "" {
+		m.Location, e = parseLocation(locationStr)
+		if e != nil {
+			return false, false, "", "", false, false, errHTTPBadRequestLocationInvalid.Wrap(e.Error())
+		}
+	}
+	m.CollapseKey = readParam(r, "x-collapse-key", "collapse-key", "collapse")
+	if m.CollapseKey != "" && !collapseKeyRegex.MatchString(m.CollapseKey) {
+		return false, false, "", "", false, false, errHTTPBadRequestCollapseKeyInvalid
+	}
 	contentType, markdown := readParam(r, "content-type", "content_type"), readBoolParam(r, false, "x-markdown", "markdown", "md")
 	if markdown || strings.ToLower(contentType) == "text/markdown" {
 		m.ContentType = "text/markdown"
@@ -1046,6 +1541,7 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 //     If UnifiedPush is enabled, encode as base64 if body is binary, and do not trim
 //  3. curl -H "Attach: http://example.com/file.jpg" ntfy.sh/mytopic
 //     Body must be a message, because we attached an external URL
+//     If credentials are configured for the URL's host, the URL is fetched and stored as attachment
 //  4. curl -T short.txt -H "Filename: short.txt" ntfy.sh/mytopic
 //     Body must be attachment, because we passed a filename
 //  5. curl -H "Template: yes" -T file.txt ntfy.sh/mytopic
@@ -1053,22 +1549,28 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 //  6. curl -T file.txt ntfy.sh/mytopic
 //     If file.txt is <= 4096 (message limit) and valid UTF-8, treat it as a message
 //  7. curl -T file.txt ntfy.sh/mytopic
-//     In all other cases, mostly if file.txt is > message limit, treat it as an attachment
-func (s *Server) handlePublishBody(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser, template, unifiedpush bool) error {
+//     In all other cases, mostly if file.txt is > message limit, treat it as an attachment. If the visitor's
+//     tier does not allow attachments, a body that is > message limit is rejected instead
+func (s *Server) handlePublishBody(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser, template, unifiedpush, dry bool) error {
 	if m.Event == pollRequestEvent { // Case 1
 		return s.handleBodyDiscard(body)
 	} else if unifiedpush {
 		return s.handleBodyAsMessageAutoDetect(m, body) // Case 2
 	} else if m.Attachment != nil && m.Attachment.URL != "" {
+		if cred := s.attachmentFetchCredential(v, m.Attachment.URL); cred != nil && s.attachmentClient != nil {
+			return s.handleBodyAsFetchedAttachment(r, v, m, body, cred, dry) // Case 3, with configured credentials
+		}
 		return s.handleBodyAsTextMessage(m, body) // Case 3
-	} else if m.Attachment != nil && m.Attachment.Name != "" {
-		return s.handleBodyAsAttachment(r, v, m, body) // Case 4
+	} else if m.Attachment != nil && (m.Attachment.Name != "" || m.Attachment.Encryption != "") {
+		return s.handleBodyAsAttachment(r, v, m, body, dry) // Case 4
 	} else if template {
-		return s.handleBodyAsTemplatedTextMessage(m, body) // Case 5
+		return s.handleBodyAsTemplatedTextMessage(m, body, v.Limits().MessageSizeLimit) // Case 5
 	} else if !body.LimitReached && utf8.Valid(body.PeekedBytes) {
 		return s.handleBodyAsTextMessage(m, body) // Case 6
+	} else if body.LimitReached && v.Limits().AttachmentFileSizeLimit == 0 {
+		return errMessageTooLarge(v).With(m)
 	}
-	return s.handleBodyAsAttachment(r, v, m, body) // Case 7
+	return s.handleBodyAsAttachment(r, v, m, body, dry) // Case 7
 }
 
 func (s *Server) handleBodyDiscard(body *util.PeekedReadCloser) error {
@@ -1100,47 +1602,102 @@ func (s *Server) handleBodyAsTextMessage(m *message, body *util.PeekedReadCloser
 	return nil
 }
 
-func (s *Server) handleBodyAsTemplatedTextMessage(m *message, body *util.PeekedReadCloser) error {
-	body, err := util.Peek(body, max(s.config.MessageSizeLimit, jsonBodyBytesLimit))
+func (s *Server) handleBodyAsTemplatedTextMessage(m *message, body *util.PeekedReadCloser, limit int) error {
+	body, err := util.Peek(body, max(limit, jsonBodyBytesLimit))
 	if err != nil {
 		return err
 	} else if body.LimitReached {
 		return errHTTPEntityTooLargeJSONBody
 	}
 	peekedBody := strings.TrimSpace(string(body.PeekedBytes))
-	if m.Message, err = replaceTemplate(m.Message, peekedBody); err != nil {
-		return err
+	var data any
+	if err := json.Unmarshal([]byte(peekedBody), &data); err != nil {
+		// Not JSON, so there is nothing to evaluate the templates against: fall back to the raw body as message
+		if len(peekedBody) > limit {
+			return errHTTPBadRequestTemplateMessageTooLarge
+		} else if peekedBody != "" {
+			m.Message = peekedBody
+		}
+		return nil
 	}
-	if m.Title, err = replaceTemplate(m.Title, peekedBody); err != nil {
+	if m.Message, err = replaceTemplate(m.Message, data, limit); err != nil {
 		return err
 	}
-	if len(m.Message) > s.config.MessageSizeLimit {
-		return errHTTPBadRequestTemplateMessageTooLarge
+	if m.Title, err = replaceTemplate(m.Title, data, limit); err != nil {
+		return err
 	}
 	return nil
 }
 
-func replaceTemplate(tpl string, source string) (string, error) {
+// replaceTemplate evaluates the Go template tpl against the parsed JSON body data. References to missing fields
+// render as empty string. Execution time and output size are limited.
+func replaceTemplate(tpl string, data any, limit int) (string, error) {
+	tpl = templateShorthandRegex.ReplaceAllString(tpl, "{{$1}}")
 	if templateDisallowedRegex.MatchString(tpl) {
 		return "", errHTTPBadRequestTemplateDisallowedFunctionCalls
 	}
-	var data any
-	if err := json.Unmarshal([]byte(source), &data); err != nil {
-		return "", errHTTPBadRequestTemplateMessageNotJSON
-	}
-	t, err := template.New("").Parse(tpl)
+	t, err := template.New("").Funcs(template.FuncMap{templateEmptyIfMissing: emptyIfMissing}).Parse(tpl)
 	if err != nil {
 		return "", errHTTPBadRequestTemplateInvalid
 	}
+	for _, tt := range t.Templates() {
+		renderMissingAsEmpty(tt.Tree.Root)
+	}
 	var buf bytes.Buffer
-	if err := t.Execute(util.NewTimeoutWriter(&buf, templateMaxExecutionTime), data); err != nil {
+	limitWriter := util.NewLimitWriter(util.NewTimeoutWriter(&buf, templateMaxExecutionTime), util.NewFixedLimiter(int64(max(limit, jsonBodyBytesLimit))))
+	if err := t.Execute(limitWriter, data); errors.Is(err, util.ErrLimitReached) {
+		return "", errHTTPBadRequestTemplateMessageTooLarge
+	} else if err != nil {
 		return "", errHTTPBadRequestTemplateExecuteFailed
 	}
+	if buf.Len() > limit {
+		return "", errHTTPBadRequestTemplateMessageTooLarge
+	}
 	return buf.String(), nil
 }
 
-func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser) error {
-	if s.fileCache == nil || s.config.BaseURL == "" || s.config.AttachmentCacheDir == "" {
+// templateEmptyIfMissing is the name of the function appended to all printing actions, see renderMissingAsEmpty
+const templateEmptyIfMissing = "emptyIfMissing"
+
+// renderMissingAsEmpty appends the emptyIfMissing function to the pipeline of all printing actions in the template
+// tree (e.g. "{{.typo}}" becomes "{{.typo | emptyIfMissing}}"). Without this, text/template renders missing fields
+// and JSON null as "<no value>". Unlike replacing "<no value>" in the output, this leaves the JSON values untouched.
+func renderMissingAsEmpty(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			renderMissingAsEmpty(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 {
+			ident := parse.NewIdentifier(templateEmptyIfMissing).SetPos(n.Pos)
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{ident}})
+		}
+	case *parse.IfNode:
+		renderMissingAsEmpty(n.List)
+		renderMissingAsEmpty(n.ElseList)
+	case *parse.RangeNode:
+		renderMissingAsEmpty(n.List)
+		renderMissingAsEmpty(n.ElseList)
+	case *parse.WithNode:
+		renderMissingAsEmpty(n.List)
+		renderMissingAsEmpty(n.ElseList)
+	}
+}
+
+// emptyIfMissing returns an empty string for missing fields and JSON null, and the value itself otherwise
+func emptyIfMissing(v any) any {
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser, dry bool) error {
+	if s.fileCache == nil || s.config.BaseURL == "" {
 		return errHTTPBadRequestAttachmentsDisallowed.With(m)
 	}
 	vinfo, err := v.Info()
@@ -1167,8 +1724,13 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 	}
 	var ext string
 	m.Attachment.Expires = attachmentExpiry
-	m.Attachment.Type, ext = util.DetectContentType(body.PeekedBytes, m.Attachment.Name)
-	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", s.config.BaseURL, m.ID, ext)
+	if m.Attachment.Encryption != "" {
+		m.Attachment.Type, ext = "application/octet-stream", ".bin" // Ciphertext, sniffing the content type is pointless
+	} else {
+		m.Attachment.Type, ext = util.DetectContentType(body.PeekedBytes, m.Attachment.Name)
+	}
+	baseURL := s.externalBaseURL(r)
+	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", baseURL, m.ID, ext)
 	if m.Attachment.Name == "" {
 		m.Attachment.Name = fmt.Sprintf("attachment%s", ext)
 	}
@@ -1180,7 +1742,12 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 		util.NewFixedLimiter(vinfo.Limits.AttachmentFileSizeLimit),
 		util.NewFixedLimiter(vinfo.Stats.AttachmentTotalSizeRemaining),
 	}
-	m.Attachment.Size, err = s.fileCache.Write(m.ID, body, limiters...)
+	if dry {
+		// Dry runs check the size limits, but do not store the attachment or count against the bandwidth limit
+		m.Attachment.Size, err = io.Copy(util.NewLimitWriter(io.Discard, limiters[1:]...), body)
+	} else {
+		m.Attachment.Size, err = s.fileCache.Write(m.ID, body, limiters...)
+	}
 	if errors.Is(err, util.ErrLimitReached) {
 		return errHTTPEntityTooLargeAttachment.With(m)
 	} else if err != nil {
@@ -1189,29 +1756,111 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 	return nil
 }
 
+// reserveCustomMessageID reserves a client-supplied message ID (X-Message-ID) in the message cache, so that it is
+// unique among all unexpired messages, including messages that are not cached. Since attachments and icons are
+// stored by message ID, the ID must be unique across all topics. Files of expired messages that have not been
+// pruned yet are deleted right away.
+//
+// The error does not say whether (or on which topic) a message with the ID exists, since the publisher may not
+// be allowed to read the topic the ID is used on.
+func (s *Server) reserveCustomMessageID(v *visitor, m *message) *errHTTP {
+	expiryDuration := s.messageExpiryDuration(v, m)
+	if s.fileCache != nil && v.Limits().AttachmentExpiryDuration > expiryDuration {
+		expiryDuration = v.Limits().AttachmentExpiryDuration
+	}
+	expires := time.Unix(m.Time, 0).Add(expiryDuration).Unix()
+	deleted, err := s.messageCache.ReserveMessageID(m.ID, m.Topic, expires)
+	if errors.Is(err, errMessageIDExists) {
+		return errHTTPConflictMessageIDUnavailable
+	} else if err != nil {
+		return errHTTPInternalError
+	}
+	if deleted && s.fileCache != nil {
+		if err := s.fileCache.Remove(append([]string{m.ID}, s.iconFileIDs(m.ID)...)...); err != nil {
+			return errHTTPInternalError
+		}
+	}
+	return nil
+}
+
+// errMessageTooLarge returns errHTTPEntityTooLargeMessage, including the visitor's message size limit
+func errMessageTooLarge(v *visitor) *errHTTP {
+	return errHTTPEntityTooLargeMessage.Wrap("message size limit is %d bytes", v.Limits().MessageSizeLimit)
+}
+
+// checkExpectContinue evaluates the declared Content-Length of a request with "Expect: 100-continue" before any
+// of the body is read. Go's HTTP server only sends "100 Continue" once the handler starts reading the body, so
+// returning an error here rejects the request before the client sends the (potentially large) body. Auth checks
+// happen before this in the middleware chain.
+func (s *Server) checkExpectContinue(r *http.Request, v *visitor) *errHTTP {
+	if !strings.EqualFold(r.Header.Get("Expect"), "100-continue") || r.ContentLength <= int64(v.Limits().MessageSizeLimit) {
+		return nil
+	}
+	// The body is too large for a regular message, so it will be treated as an attachment
+	if s.fileCache == nil || s.config.BaseURL == "" {
+		return errHTTPBadRequestAttachmentsDisallowed
+	} else if v.Limits().AttachmentFileSizeLimit == 0 {
+		return errMessageTooLarge(v)
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return errHTTPInternalError
+	}
+	if r.ContentLength > vinfo.Stats.AttachmentTotalSizeRemaining || r.ContentLength > vinfo.Limits.AttachmentFileSizeLimit {
+		return errHTTPEntityTooLargeAttachment.Fields(log.Context{
+			"message_content_length":          r.ContentLength,
+			"attachment_total_size_remaining": vinfo.Stats.AttachmentTotalSizeRemaining,
+			"attachment_file_size_limit":      vinfo.Limits.AttachmentFileSizeLimit,
+		})
+	}
+	return nil
+}
+
 func (s *Server) handleSubscribeJSON(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	encodeJSON := newJSONMessageEncoder(r)
 	encoder := func(msg *message) (string, error) {
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(&msg); err != nil {
-			return "", err
-		}
-		return buf.String(), nil
+		return encodeJSON(msg)
 	}
-	return s.handleSubscribeHTTP(w, r, v, "application/x-ndjson", encoder)
+	return s.handleSubscribeHTTP(w, r, v, "json", "application/x-ndjson", encoder)
 }
 
 func (s *Server) handleSubscribeSSE(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	encodeJSON := newJSONMessageEncoder(r)
 	encoder := func(msg *message) (string, error) {
+		data, err := encodeJSON(msg)
+		if err != nil {
+			return "", err
+		}
+		if msg.Event == shutdownEvent {
+			return fmt.Sprintf("event: %s\nretry: %d\ndata: %s\n", msg.Event, msg.RetryAfter*1000, data), nil // Tells EventSource when to reconnect
+		} else if msg.Event != messageEvent {
+			return fmt.Sprintf("event: %s\ndata: %s\n", msg.Event, data), nil // Browser's .onmessage() does not fire on this!
+		}
+		return fmt.Sprintf("data: %s\n", data), nil
+	}
+	return s.handleSubscribeHTTP(w, r, v, "sse", "text/event-stream", encoder)
+}
+
+// newJSONMessageEncoder returns a messageEncoder that encodes a message as a JSON line. If delta encoding
+// is requested (?delta=1), messages are encoded as diffs to the previous message, see deltaEncoder.
+func newJSONMessageEncoder(r *http.Request) messageEncoder {
+	if readBoolParam(r, false, "x-delta", "delta") {
+		delta := newDeltaEncoder()
+		return func(msg *message) (string, error) {
+			b, err := delta.Encode(msg)
+			if err != nil {
+				return "", err
+			}
+			return string(b) + "\n", nil
+		}
+	}
+	return func(msg *message) (string, error) {
 		var buf bytes.Buffer
 		if err := json.NewEncoder(&buf).Encode(&msg); err != nil {
 			return "", err
 		}
-		if msg.Event != messageEvent {
-			return fmt.Sprintf("event: %s\ndata: %s\n", msg.Event, buf.String()), nil // Browser's .onmessage() does not fire on this!
-		}
-		return fmt.Sprintf("data: %s\n", buf.String()), nil
+		return buf.String(), nil
 	}
-	return s.handleSubscribeHTTP(w, r, v, "text/event-stream", encoder)
 }
 
 func (s *Server) handleSubscribeRaw(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -1221,10 +1870,10 @@ func (s *Server) handleSubscribeRaw(w http.ResponseWriter, r *http.Request, v *v
 		}
 		return "\n", nil // "keepalive" and "open" events just send an empty line
 	}
-	return s.handleSubscribeHTTP(w, r, v, "text/plain", encoder)
+	return s.handleSubscribeHTTP(w, r, v, "raw", "text/plain", encoder)
 }
 
-func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *visitor, contentType string, encoder messageEncoder) error {
+func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *visitor, protocol, contentType string, encoder messageEncoder) error {
 	logvr(v, r).Tag(tagSubscribe).Debug("HTTP stream connection opened")
 	defer logvr(v, r).Tag(tagSubscribe).Debug("HTTP stream connection closed")
 	if !v.SubscriptionAllowed() {
@@ -1235,10 +1884,26 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err != nil {
 		return err
 	}
-	poll, since, scheduled, filters, err := parseSubscribeParams(r)
+	poll, since, scheduled, filters, err := parseSubscribeParams(r, s.defaultFilters)
 	if err != nil {
 		return err
 	}
+	maxMessages, err := parseMaxMessages(r)
+	if err != nil {
+		return err
+	}
+	markdownStrip, err := parseMarkdownStrip(r)
+	if err != nil {
+		return err
+	}
+	consume := readBoolParam(r, false, "x-consume", "consume")
+	if consume {
+		if maxMessages > 0 {
+			return errHTTPBadRequestMaxMessagesInvalid.Wrap("cannot be combined with consume, messages would be lost")
+		} else if err := s.checkConsume(v, poll, topics); err != nil {
+			return err
+		}
+	}
 	var wlock sync.Mutex
 	defer func() {
 		// Hack: This is the fix for a horrible data race that I have not been able to figure out in quite some time.
@@ -1249,14 +1914,16 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	}()
 	sub := func(v *visitor, msg *message) error {
 		if !filters.Pass(msg) {
-			return nil
+			return errMessageNotDelivered
+		} else if markdownStrip {
+			msg = markdownToText(msg)
 		}
-		m, err := encoder(msg)
+		wlock.Lock()
+		defer wlock.Unlock()
+		m, err := encoder(msg) // Inside the lock, since encoders may be stateful, see deltaEncoder
 		if err != nil {
 			return err
 		}
-		wlock.Lock()
-		defer wlock.Unlock()
 		if _, err := w.Write([]byte(m)); err != nil {
 			return err
 		}
@@ -1265,22 +1932,26 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 		}
 		return nil
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub = maxMessagesSubscriber(sub, filters, maxMessages, cancel)
 	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
 		return err
 	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Content-Type", contentType+"; charset=utf-8")                    // Android/Volley client needs charset!
+	s.setAccessControlAllowOrigin(w)
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8") // Android/Volley client needs charset!
 	if poll {
 		for _, t := range topics {
 			t.Keepalive()
 		}
-		return s.sendOldMessages(topics, since, scheduled, v, sub)
+		if consume {
+			return s.sendConsumedMessages(r, topics, since, scheduled, filters, v, sub)
+		}
+		return s.sendOldMessages(topics, since, scheduled, true, v, sub)
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
-		subscriberIDs = append(subscriberIDs, t.Subscribe(sub, v.MaybeUserID(), cancel))
+		subscriberIDs = append(subscriberIDs, t.Subscribe(sub, newSubscriberInfo(v, protocol), cancel))
 	}
 	defer func() {
 		for i, subscriberID := range subscriberIDs {
@@ -1290,7 +1961,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
+	if err := s.sendOldMessages(topics, since, scheduled, false, v, sub); err != nil {
 		return err
 	}
 	for {
@@ -1299,7 +1970,9 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 			return nil
 		case <-r.Context().Done():
 			return nil
-		case <-time.After(s.config.KeepaliveInterval):
+		case <-s.drainChan:
+			return sub(v, newShutdownMessage(topicsStr, s.shutdownRetryAfter()))
+		case <-time.After(s.keepaliveInterval()):
 			ev := logvr(v, r).Tag(tagSubscribe)
 			if len(topics) == 1 {
 				ev.With(topics[0]).Trace("Sending keepalive message to %s", topics[0].ID)
@@ -1331,10 +2004,27 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err != nil {
 		return err
 	}
-	poll, since, scheduled, filters, err := parseSubscribeParams(r)
+	poll, since, scheduled, filters, err := parseSubscribeParams(r, s.defaultFilters)
+	if err != nil {
+		return err
+	}
+	maxMessages, err := parseMaxMessages(r)
 	if err != nil {
 		return err
 	}
+	markdownStrip, err := parseMarkdownStrip(r)
+	if err != nil {
+		return err
+	}
+	ackConsumerID, err := parseAckConsumer(r)
+	if err != nil {
+		return err
+	} else if ackConsumerID != "" && poll {
+		return errHTTPBadRequestAckConsumerInvalid
+	}
+	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
+		return err
+	}
 	upgrader := &websocket.Upgrader{
 		ReadBufferSize:  wsBufferSize,
 		WriteBufferSize: wsBufferSize,
@@ -1342,22 +2032,37 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			return true // We're open for business!
 		},
 	}
+
+	// Subscription connections can be canceled externally, see topic.CancelSubscribersExceptUser
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Subscribers that ack deliveries get their unacknowledged messages again when they reconnect
+	var consumer *ackConsumer
+	if ackConsumerID != "" {
+		var connection int
+		consumer, connection, err = s.attachAckConsumer(v, topicsStr, ackConsumerID, cancel)
+		if err != nil {
+			return err
+		}
+		defer s.detachAckConsumer(consumer, connection)
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
-	// Subscription connections can be canceled externally, see topic.CancelSubscribersExceptUser
-	cancelCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	// Use errgroup to run WebSocket reader and writer in Go routines
 	var wlock sync.Mutex
 	g, gctx := errgroup.WithContext(cancelCtx)
 	g.Go(func() error {
-		pongWait := s.config.KeepaliveInterval + wsPongWait
-		conn.SetReadLimit(wsReadLimit)
+		pongWait := s.config.KeepaliveInterval + time.Duration(keepaliveJitter*float64(s.config.KeepaliveInterval)) + wsPongWait
+		if consumer != nil {
+			conn.SetReadLimit(wsAckReadLimit)
+		} else {
+			conn.SetReadLimit(wsReadLimit)
+		}
 		if err := conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 			return err
 		}
@@ -1366,8 +2071,13 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			return conn.SetReadDeadline(time.Now().Add(pongWait))
 		})
 		for {
-			_, _, err := conn.NextReader()
-			if err != nil {
+			if consumer != nil {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return err
+				}
+				s.handleWebSocketCommand(v, r, consumer, data)
+			} else if _, _, err := conn.NextReader(); err != nil {
 				return err
 			}
 			select {
@@ -1395,7 +2105,20 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 				logvr(v, r).Tag(tagWebsocket).Trace("Cancel received, closing subscriber connection")
 				conn.Close()
 				return &websocket.CloseError{Code: websocket.CloseNormalClosure, Text: "subscription was canceled"}
-			case <-time.After(s.config.KeepaliveInterval):
+			case <-s.drainChan:
+				logvr(v, r).Tag(tagWebsocket).Trace("Server is shutting down, closing subscriber connection")
+				wlock.Lock()
+				defer wlock.Unlock()
+				if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+					return err
+				} else if err := conn.WriteJSON(newShutdownMessage(topicsStr, s.shutdownRetryAfter())); err != nil {
+					return err
+				}
+				closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+				conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(wsWriteWait))
+				conn.Close()
+				return &websocket.CloseError{Code: websocket.CloseGoingAway, Text: "server is shutting down"}
+			case <-time.After(s.keepaliveInterval()):
 				v.Keepalive()
 				for _, t := range topics {
 					t.Keepalive()
@@ -1408,7 +2131,9 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	})
 	sub := func(v *visitor, msg *message) error {
 		if !filters.Pass(msg) {
-			return nil
+			return errMessageNotDelivered
+		} else if markdownStrip {
+			msg = markdownToText(msg)
 		}
 		wlock.Lock()
 		defer wlock.Unlock()
@@ -1417,19 +2142,21 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 		}
 		return conn.WriteJSON(msg)
 	}
-	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
-		return err
+	send := sub
+	if consumer != nil {
+		sub = ackSubscriber(sub, filters, consumer)
 	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	sub = maxMessagesSubscriber(sub, filters, maxMessages, cancel)
+	s.setAccessControlAllowOrigin(w)
 	if poll {
 		for _, t := range topics {
 			t.Keepalive()
 		}
-		return s.sendOldMessages(topics, since, scheduled, v, sub)
+		return s.sendOldMessages(topics, since, scheduled, true, v, sub)
 	}
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
-		subscriberIDs = append(subscriberIDs, t.Subscribe(sub, v.MaybeUserID(), cancel))
+		subscriberIDs = append(subscriberIDs, t.Subscribe(sub, newSubscriberInfo(v, "ws"), cancel))
 	}
 	defer func() {
 		for i, subscriberID := range subscriberIDs {
@@ -1439,7 +2166,14 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
+	if consumer != nil {
+		for _, m := range consumer.Pending() { // Re-send unacknowledged messages of previous connections
+			if err := send(v, m); err != nil && !errors.Is(err, errMessageNotDelivered) {
+				return err
+			}
+		}
+	}
+	if err := s.sendOldMessages(topics, since, scheduled, false, v, sub); err != nil {
 		return err
 	}
 	err = g.Wait()
@@ -1450,7 +2184,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	return err
 }
 
-func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, scheduled bool, filters *queryFilter, err error) {
+func parseSubscribeParams(r *http.Request, defaultFilters map[string]*queryFilter) (poll bool, since sinceMarker, scheduled bool, filters *queryFilter, err error) {
 	poll = readBoolParam(r, false, "x-poll", "poll", "po")
 	scheduled = readBoolParam(r, false, "x-scheduled", "scheduled", "sched")
 	since, err = parseSince(r, poll)
@@ -1461,9 +2195,55 @@ func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, schedu
 	if err != nil {
 		return
 	}
+	filters.Defaults = defaultFilters
 	return
 }
 
+// parseMaxMessages parses the max_messages parameter, the number of messages after which a subscription is
+// closed (0 = no limit)
+func parseMaxMessages(r *http.Request) (int, error) {
+	maxMessagesStr := readParam(r, "x-max-messages", "max-messages", "max_messages")
+	if maxMessagesStr == "" {
+		return 0, nil
+	}
+	maxMessages, err := strconv.Atoi(maxMessagesStr)
+	if err != nil || maxMessages < 1 {
+		return 0, errHTTPBadRequestMaxMessagesInvalid
+	}
+	return maxMessages, nil
+}
+
+// maxMessagesSubscriber wraps a subscriber, so that only the first maxMessages messages that pass the filters are
+// delivered. Once the limit is reached, done is called to close the subscription. Open and keepalive messages
+// are passed through, and do not count towards the limit.
+func maxMessagesSubscriber(sub subscriber, filters *queryFilter, maxMessages int, done func()) subscriber {
+	if maxMessages <= 0 {
+		return sub
+	}
+	var mu sync.Mutex
+	var delivered int
+	return func(v *visitor, msg *message) error {
+		if msg.Event != messageEvent {
+			return sub(v, msg)
+		} else if !filters.Pass(msg) {
+			return errMessageNotDelivered
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if delivered >= maxMessages {
+			return errMessageNotDelivered
+		}
+		if err := sub(v, msg); err != nil {
+			return err
+		}
+		delivered++
+		if delivered == maxMessages {
+			done()
+		}
+		return nil
+	}
+}
+
 // maybeSetRateVisitors sets the rate visitor on a topic (v.SetRateVisitor), indicating that all messages published
 // to that topic will be rate limited against the rate visitor instead of the publishing visitor.
 //
@@ -1530,24 +2310,172 @@ func (s *Server) setRateVisitors(r *http.Request, v *visitor, rateTopics []*topi
 }
 
 // sendOldMessages selects old messages from the messageCache and calls sub for each of them. It uses since as the
-// marker, returning only messages that are newer than the marker.
-func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled bool, v *visitor, sub subscriber) error {
+// marker, returning only messages that are newer than the marker. Poll results are ordered by priority if all topics
+// are configured as Config.PriorityOrderedTopics, see sortMessagesByPriority.
+func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled, poll bool, v *visitor, sub subscriber) error {
 	if since.IsNone() {
 		return nil
 	}
 	messages := make([]*message, 0)
 	for _, t := range topics {
+		if s.isNoCacheTopic(t.ID) {
+			continue // May still have messages from before the topic was configured to not be cached
+		}
 		topicMessages, err := s.messageCache.Messages(t.ID, since, scheduled)
 		if err != nil {
 			return err
 		}
 		messages = append(messages, topicMessages...)
 	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time
+	})
+	messages = collapseMessages(messages)
+	if poll && s.isPriorityOrderedTopics(topics) {
+		sortMessagesByPriority(messages)
+	}
+	for _, m := range messages {
+		if err := sub(v, m); err != nil && !errors.Is(err, errMessageNotDelivered) {
+			return err
+		}
+	}
+	return nil
+}
+
+// collapseMessages removes messages that are superseded by a newer message with the same collapse key on the same
+// topic, see X-Collapse-Key. Messages must be sorted by time. Messages without a collapse key, and scheduled messages
+// that are not published yet, are never removed.
+func collapseMessages(messages []*message) []*message {
+	now := time.Now().Unix()
+	latest := make(map[string]string) // Topic and collapse key -> ID of latest message
+	for _, m := range messages {
+		if m.CollapseKey != "" && m.Time <= now {
+			latest[m.Topic+"/"+m.CollapseKey] = m.ID
+		}
+	}
+	if len(latest) == 0 {
+		return messages
+	}
+	collapsed := make([]*message, 0, len(messages))
+	for _, m := range messages {
+		if m.CollapseKey == "" || m.Time > now || latest[m.Topic+"/"+m.CollapseKey] == m.ID {
+			collapsed = append(collapsed, m)
+		}
+	}
+	return collapsed
+}
+
+// keepaliveInterval returns the configured keepalive interval with a random jitter. After a server restart, all
+// clients reconnect at about the same time; the jitter makes sure that their keepalives do not stay in sync.
+func (s *Server) keepaliveInterval() time.Duration {
+	return util.Jitter(s.config.KeepaliveInterval, keepaliveJitter)
+}
+
+// messageExpiryDuration returns the effective retention of a message in the cache, which is reported to the publisher
+// as the "expires" field: The visitor's message expiry (cache-duration, or the tier's limit), unless overridden for the
+// topic (topic-cache-duration). Messages with at least retain-priority are kept for retain-duration, if that is longer.
+func (s *Server) messageExpiryDuration(v *visitor, m *message) time.Duration {
+	expiry := v.Limits().MessageExpiryDuration
+	if topicExpiry, ok := s.config.TopicCacheDurations[m.Topic]; ok {
+		expiry = topicExpiry
+	}
+	if s.config.RetainPriority > 0 && m.Priority >= s.config.RetainPriority && s.config.RetainDuration > expiry {
+		expiry = s.config.RetainDuration
+	}
+	return expiry
+}
+
+// isNoCacheTopic returns true if the topic matches one of the no-cache-topics patterns. Messages on these topics are
+// only delivered to active subscribers (and Firebase, etc.), but never written to the message cache.
+func (s *Server) isNoCacheTopic(topic string) bool {
+	for _, pattern := range s.config.NoCacheTopics {
+		if matched, _ := path.Match(pattern, topic); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isPriorityOrderedTopics returns true if all topics match one of the Config.PriorityOrderedTopics, i.e. if poll results
+// should be ordered by priority instead of time. Mixing priority-ordered and regular topics falls back to time order.
+func (s *Server) isPriorityOrderedTopics(topics []*topic) bool {
+	if len(s.config.PriorityOrderedTopics) == 0 {
+		return false
+	}
+	for _, t := range topics {
+		if !s.isPriorityOrderedTopic(t.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) isPriorityOrderedTopic(topic string) bool {
+	for _, pattern := range s.config.PriorityOrderedTopics {
+		if matched, _ := path.Match(pattern, topic); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sortMessagesByPriority orders messages by priority (highest first), and then by time. Messages must be sorted by
+// time already. Messages without a priority are treated as default priority (3).
+func sortMessagesByPriority(messages []*message) {
+	priority := func(m *message) int {
+		if m.Priority == 0 {
+			return 3
+		}
+		return m.Priority
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return priority(messages[i]) > priority(messages[j])
+	})
+}
+
+// checkConsume verifies that the visitor may consume (poll and delete) messages from the given topics. Since consuming
+// deletes messages for all other subscribers, it is only allowed for authenticated users with write access to the topics.
+func (s *Server) checkConsume(v *visitor, poll bool, topics []*topic) error {
+	if !poll {
+		return errHTTPBadRequestConsumeWithoutPoll
+	} else if s.userManager == nil {
+		return errHTTPBadRequestConsumeWithoutAuth
+	} else if v.User() == nil {
+		return errHTTPUnauthorized
+	}
+	for _, t := range topics {
+		if err := s.userManager.Authorize(v.User(), t.ID, user.PermissionWrite); err != nil {
+			return errHTTPForbidden.With(t)
+		}
+	}
+	return nil
+}
+
+// sendConsumedMessages is like sendOldMessages, but marks the messages as consumed in the messageCache as part of
+// selecting them, so that every message is only delivered to one consumer. Messages are consumed before they are sent,
+// so a message may be lost if the connection breaks while sending it. Attachments are not deleted, so that the
+// consumer can still download them; they expire like all other attachments.
+func (s *Server) sendConsumedMessages(r *http.Request, topics []*topic, since sinceMarker, scheduled bool, filters *queryFilter, v *visitor, sub subscriber) error {
+	if since.IsNone() {
+		return nil
+	}
+	messages := make([]*message, 0)
+	for _, t := range topics {
+		topicMessages, err := s.messageCache.ConsumeMessages(t.ID, since, scheduled, filters.Pass)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, topicMessages...)
+	}
 	sort.Slice(messages, func(i, j int) bool {
 		return messages[i].Time < messages[j].Time
 	})
+	if s.isPriorityOrderedTopics(topics) {
+		sortMessagesByPriority(messages)
+	}
+	logvr(v, r).Tag(tagSubscribe).Debug("Consumed %d message(s)", len(messages))
 	for _, m := range messages {
-		if err := sub(v, m); err != nil {
+		if err := sub(v, m); err != nil && !errors.Is(err, errMessageNotDelivered) {
 			return err
 		}
 	}
@@ -1585,30 +2513,64 @@ func parseSince(r *http.Request, poll bool) (sinceMarker, error) {
 }
 
 func (s *Server) handleOptions(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	if len(s.config.CORSAllowedOrigins) > 0 && w.Header().Get("Access-Control-Allow-Origin") == "" {
+		return nil // Origin not allowed, answer preflight request without CORS headers, see handle()
+	}
 	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, PATCH, DELETE")
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Access-Control-Allow-Headers", "*")                              // CORS, allow auth via JS // FIXME is this terrible?
+	s.setAccessControlAllowOrigin(w)
+	w.Header().Set("Access-Control-Allow-Headers", "*") // CORS, allow auth via JS // FIXME is this terrible?
 	return nil
 }
 
+// setAccessControlAllowOrigin sets the CORS header to allow cross-origin requests from web clients. If
+// Config.CORSAllowedOrigins is set, the header is instead set per request in handle(), see corsAllowedOrigin.
+func (s *Server) setAccessControlAllowOrigin(w http.ResponseWriter) {
+	if len(s.config.CORSAllowedOrigins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	}
+}
+
+// corsAllowedOrigin returns the request's Origin header if it is in Config.CORSAllowedOrigins, or an empty
+// string otherwise. Requests from origins that are not allowed are not rejected, they just don't get CORS headers.
+func (s *Server) corsAllowedOrigin(r *http.Request) string {
+	origin := strings.TrimSuffix(strings.ToLower(r.Header.Get("Origin")), "/")
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range s.config.CORSAllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return r.Header.Get("Origin")
+		}
+	}
+	return ""
+}
+
 // topicFromPath returns the topic from a root path (e.g. /mytopic), creating it if it doesn't exist.
 func (s *Server) topicFromPath(path string) (*topic, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
 		return nil, errHTTPBadRequestTopicInvalid
+	} else if s.metaTopic(parts[1]) != nil {
+		return nil, errHTTPBadRequestTopicIsMetaTopic
 	}
 	return s.topicFromID(parts[1])
 }
 
 // topicsFromPath returns the topic from a root path (e.g. /mytopic,mytopic2), creating it if it doesn't exist.
+// Meta-topics are expanded to the topics they aggregate.
 func (s *Server) topicsFromPath(path string) ([]*topic, string, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
 		return nil, "", errHTTPBadRequestTopicInvalid
 	}
-	topicIDs := util.SplitNoEmpty(parts[1], ",")
+	topicIDs := s.expandMetaTopics(util.SplitNoEmpty(parts[1], ","))
+	if len(topicIDs) == 0 {
+		return nil, "", errHTTPBadRequestSubscribeTopicInvalid
+	}
 	topics, err := s.topicsFromIDs(topicIDs...)
-	if err != nil {
+	if err == errHTTPForbiddenTopicDisallowed {
+		return nil, "", err
+	} else if err != nil {
 		return nil, "", errHTTPBadRequestTopicInvalid
 	}
 	return topics, parts[1], nil
@@ -1622,6 +2584,8 @@ func (s *Server) topicsFromIDs(ids ...string) ([]*topic, error) {
 	for _, id := range ids {
 		if util.Contains(s.config.DisallowedTopics, id) {
 			return nil, errHTTPBadRequestTopicDisallowed
+		} else if s.topicNameDisallowed(id) {
+			return nil, errHTTPForbiddenTopicDisallowed
 		}
 		if _, ok := s.topics[id]; !ok {
 			if len(s.topics) >= s.config.TotalTopicLimit {
@@ -1634,6 +2598,38 @@ func (s *Server) topicsFromIDs(ids ...string) ([]*topic, error) {
 	return topics, nil
 }
 
+// topicNameDisallowed returns true if the topic name matches one of the disallowed topic patterns, e.g. to block
+// abusive or impersonating topic names on public servers
+func (s *Server) topicNameDisallowed(id string) bool {
+	for _, pattern := range s.config.DisallowedTopicPatterns {
+		if pattern.MatchString(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// topicPathDisallowed returns true if the request path refers to one or more topics (e.g. /mytopic/json or
+// /mytopic1,mytopic2/sse), and any of them matches one of the disallowed topic patterns. Reserved paths such
+// as /docs or /v1 are not topics, and are never matched.
+func (s *Server) topicPathDisallowed(r *http.Request) bool {
+	if len(s.config.DisallowedTopicPatterns) == 0 {
+		return false
+	}
+	for _, pathRegex := range topicPathRegexes {
+		if !pathRegex.MatchString(r.URL.Path) {
+			continue
+		}
+		for _, id := range s.expandMetaTopics(util.SplitNoEmpty(strings.Split(r.URL.Path, "/")[1], ",")) {
+			if !util.Contains(s.config.DisallowedTopics, id) && s.topicNameDisallowed(id) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
 // topicFromID returns the topic with the given ID, creating it if it doesn't exist.
 func (s *Server) topicFromID(id string) (*topic, error) {
 	topics, err := s.topicsFromIDs(id)
@@ -1668,6 +2664,9 @@ func (s *Server) runSMTPServer() error {
 	s.smtpServer.ReadTimeout = 10 * time.Second
 	s.smtpServer.WriteTimeout = 10 * time.Second
 	s.smtpServer.MaxMessageBytes = 1024 * 1024 // Must be much larger than message size (headers, multipart, etc.)
+	if s.config.AttachmentCacheDir != "" || s.config.AttachmentS3Bucket != "" {
+		s.smtpServer.MaxMessageBytes += int(s.config.AttachmentFileSizeLimit * 4 / 3) // Attachments are base64-encoded in emails
+	}
 	s.smtpServer.MaxRecipients = 1
 	s.smtpServer.AllowInsecureAuth = true
 	return s.smtpServer.ListenAndServe()
@@ -1750,6 +2749,7 @@ func (s *Server) runDelayedSender() {
 			if err := s.sendDelayedMessages(); err != nil {
 				log.Tag(tagPublish).Err(err).Warn("Error sending delayed messages")
 			}
+			s.sendRepeatedMessages()
 		case <-s.closeChan:
 			return
 		}
@@ -1797,12 +2797,24 @@ func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 	if s.config.UpstreamBaseURL != "" {
 		go s.forwardPollRequest(v, m)
 	}
+	s.forwardToFederatedTopics(v, m, nil)
+	if s.kafkaProducer != nil {
+		s.sendToKafka(v, m)
+	}
 	if s.config.WebPushPublicKey != "" {
 		go s.publishToWebPushEndpoints(v, m)
 	}
+	if s.apnsSender != nil {
+		go s.sendToAPNs(v, m)
+	}
 	if err := s.messageCache.MarkPublished(m); err != nil {
 		return err
 	}
+	if m.Schedule != "" { // After marking it published, so cancelling the schedule does not delete this occurrence
+		if err := s.scheduleNextOccurrence(v, m); err != nil {
+			logvm(v, m).Tag(tagSchedule).Err(err).Warn("Unable to schedule next occurrence of recurring message")
+		}
+	}
 	return nil
 }
 
@@ -1810,7 +2822,7 @@ func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 // before passing it on to the next handler. This is meant to be used in combination with handlePublish.
 func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		m, err := readJSONWithLimit[publishMessage](r.Body, s.config.MessageSizeLimit*2, false) // 2x to account for JSON format overhead
+		m, err := readJSONWithLimit[publishMessage](r.Body, v.Limits().MessageSizeLimit*2, false) // 2x to account for JSON format overhead
 		if err != nil {
 			return err
 		}
@@ -1846,6 +2858,26 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if m.Markdown {
 			r.Header.Set("X-Markdown", "yes")
 		}
+		if len(m.Data) > 0 {
+			dataStr, err := json.Marshal(m.Data)
+			if err != nil {
+				return errHTTPBadRequestMessageJSONInvalid
+			}
+			r.Header.Set("X-Data", string(dataStr))
+		}
+		if m.DataTable {
+			r.Header.Set("X-Data-Table", "yes")
+		}
+		if len(m.Location) > 0 && string(m.Location) != "null" {
+			var locationStr string
+			if err := json.Unmarshal(m.Location, &locationStr); err != nil {
+				locationStr = string(m.Location) // Not a string, so it must be a JSON object
+			}
+			r.Header.Set("X-Location", locationStr)
+		}
+		if m.CollapseKey != "" {
+			r.Header.Set("X-Collapse-Key", m.CollapseKey)
+		}
 		if len(m.Actions) > 0 {
 			actionsStr, err := json.Marshal(m.Actions)
 			if err != nil {
@@ -1859,9 +2891,15 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if m.Delay != "" {
 			r.Header.Set("X-Delay", m.Delay)
 		}
+		if m.ID != "" {
+			r.Header.Set("X-Message-ID", m.ID)
+		}
 		if m.Call != "" {
 			r.Header.Set("X-Call", m.Call)
 		}
+		if m.CallMenu != "" {
+			r.Header.Set("X-Call-Menu", m.CallMenu)
+		}
 		return next(w, r, v)
 	}
 }
@@ -1901,6 +2939,14 @@ func (s *Server) autorizeTopic(next handleFunc, perm user.Permission) handleFunc
 		if err != nil {
 			return err
 		}
+		if perm == user.PermissionRead {
+			if signed, err := s.authorizeSubscribeURL(r, topics); err != nil {
+				logvr(v, r).Tag(tagSubscribeURL).Err(err).Debug("Signed subscribe URL not authorized")
+				return err
+			} else if signed {
+				return next(w, r, v) // Signed subscribe URLs bypass the regular access control, see handleSubscribeURLCreate
+			}
+		}
 		u := v.User()
 		for _, t := range topics {
 			if err := s.userManager.Authorize(u, t.ID, perm); err != nil {
@@ -1925,13 +2971,15 @@ func (s *Server) autorizeTopic(next handleFunc, perm user.Permission) handleFunc
 // that subsequent logging calls still have a visitor context.
 func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
 	// Read "Authorization" header value, and exit out early if it's not set
-	ip := extractIPAddress(r, s.config.BehindProxy)
+	ip := extractIPAddress(r, s.config.BehindProxy, s.config.ProxyTrustedPrefixes)
 	vip := s.visitor(ip, nil)
 	if s.userManager == nil {
 		return vip, nil
 	}
 	header, err := readAuthHeader(r)
 	if err != nil {
+		vip.AuthFailed()
+		logr(r).Err(err).Debug("Authentication failed, invalid auth query parameter")
 		return vip, err
 	} else if !supportedAuthHeader(header) {
 		return vip, nil
@@ -1962,20 +3010,33 @@ func (s *Server) authenticate(r *http.Request, header string) (user *user.User,
 }
 
 // readAuthHeader reads the raw value of the Authorization header, either from the actual HTTP header,
-// or from the ?auth... query parameter
+// or from the ?auth... query parameter. Since the query param is only passed if the client intends to authenticate,
+// a query param that cannot be decoded, or that is not a Basic or Bearer credential, is rejected as unauthorized.
 func readAuthHeader(r *http.Request) (string, error) {
 	value := strings.TrimSpace(r.Header.Get("Authorization"))
 	queryParam := readQueryParam(r, "authorization", "auth")
 	if queryParam != "" {
-		a, err := base64.RawURLEncoding.DecodeString(queryParam)
-		if err != nil {
-			return "", err
+		a, err := decodeAuthQueryParam(queryParam)
+		if err != nil || !supportedAuthHeader(a) {
+			return "", errHTTPUnauthorized
 		}
-		value = strings.TrimSpace(string(a))
+		value = a
 	}
 	return value, nil
 }
 
+// decodeAuthQueryParam decodes the base64-encoded ?auth=... query param. Browsers typically encode it with btoa(),
+// so the standard and the URL-safe alphabet are both accepted, with or without padding. A "+" that was not
+// URL-encoded arrives as a space, and is treated as such.
+func decodeAuthQueryParam(param string) (string, error) {
+	param = strings.NewReplacer("+", "-", " ", "-", "/", "_").Replace(strings.TrimRight(param, "="))
+	b, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
 // supportedAuthHeader returns true only if the Authorization header value starts
 // with "Basic" or "Bearer". In particular, an empty value is not supported, and neither
 // are things like "WebPush", or "vapid" (see #629).
@@ -2000,10 +3061,11 @@ func (s *Server) authenticateBearerAuth(r *http.Request, token string) (*user.Us
 	if err != nil {
 		return nil, err
 	}
-	ip := extractIPAddress(r, s.config.BehindProxy)
+	ip := extractIPAddress(r, s.config.BehindProxy, s.config.ProxyTrustedPrefixes)
 	go s.userManager.EnqueueTokenUpdate(token, &user.TokenUpdate{
-		LastAccess: time.Now(),
-		LastOrigin: ip,
+		LastAccess:    time.Now(),
+		LastOrigin:    ip,
+		LastUserAgent: r.UserAgent(),
 	})
 	return u, nil
 }
@@ -2022,13 +3084,19 @@ func (s *Server) visitor(ip netip.Addr, user *user.User) *visitor {
 	return v
 }
 
+// externalBaseURL returns the base URL as seen by the client of the given request, see extractBaseURL.
+// It must be used for all links that are built from the base URL and handed out in response to a request.
+func (s *Server) externalBaseURL(r *http.Request) string {
+	return extractBaseURL(r, s.config.BaseURL, s.config.BehindProxy, s.config.ProxyTrustedPrefixes)
+}
+
 func (s *Server) writeJSON(w http.ResponseWriter, v any) error {
 	return s.writeJSONWithContentType(w, v, "application/json")
 }
 
 func (s *Server) writeJSONWithContentType(w http.ResponseWriter, v any, contentType string) error {
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	s.setAccessControlAllowOrigin(w)
 	if err := json.NewEncoder(w).Encode(v); err != nil {
 		return err
 	}
@@ -66,6 +66,7 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 			AttachmentFileSize:       limits.AttachmentFileSizeLimit,
 			AttachmentExpiryDuration: int64(limits.AttachmentExpiryDuration.Seconds()),
 			AttachmentBandwidth:      limits.AttachmentBandwidthLimit,
+			MessageSize:              int64(limits.MessageSizeLimit),
 		},
 		Stats: &apiAccountStats{
 			Messages:                     stats.Messages,
@@ -134,17 +135,7 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 		if len(tokens) > 0 {
 			response.Tokens = make([]*apiAccountTokenResponse, 0)
 			for _, t := range tokens {
-				var lastOrigin string
-				if t.LastOrigin != netip.IPv4Unspecified() {
-					lastOrigin = t.LastOrigin.String()
-				}
-				response.Tokens = append(response.Tokens, &apiAccountTokenResponse{
-					Token:      t.Value,
-					Label:      t.Label,
-					LastAccess: t.LastAccess.Unix(),
-					LastOrigin: lastOrigin,
-					Expires:    t.Expires.Unix(),
-				})
+				response.Tokens = append(response.Tokens, newAccountTokenResponse(t, u.Token))
 			}
 		}
 		if s.config.TwilioAccount != "" {
@@ -179,6 +170,11 @@ func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *
 			logvr(v, r).Err(err).Warn("Error removing web push subscriptions for %s", u.Name)
 		}
 	}
+	if s.apnsStore != nil && u.ID != "" {
+		if err := s.apnsStore.RemoveDevicesByUserID(u.ID); err != nil {
+			logvr(v, r).Err(err).Warn("Error removing APNs devices for %s", u.Name)
+		}
+	}
 	if u.Billing.StripeSubscriptionID != "" {
 		logvr(v, r).Tag(tagStripe).Info("Canceling billing subscription for user %s", u.Name)
 		if _, err := s.stripe.CancelSubscription(u.Billing.StripeSubscriptionID); err != nil {
@@ -234,16 +230,33 @@ func (s *Server) handleAccountTokenCreate(w http.ResponseWriter, r *http.Request
 			"token_expires": expires,
 		}).
 		Debug("Creating token for user %s", u.Name)
-	token, err := s.userManager.CreateToken(u.ID, label, expires, v.IP())
+	token, err := s.userManager.CreateToken(u.ID, label, expires, v.IP(), r.UserAgent())
 	if err != nil {
 		return err
 	}
 	response := &apiAccountTokenResponse{
-		Token:      token.Value,
-		Label:      token.Label,
-		LastAccess: token.LastAccess.Unix(),
-		LastOrigin: token.LastOrigin.String(),
-		Expires:    token.Expires.Unix(),
+		Token:         token.Value,
+		Label:         token.Label,
+		LastAccess:    token.LastAccess.Unix(),
+		LastOrigin:    token.LastOrigin.String(),
+		LastUserAgent: token.LastUserAgent,
+		Expires:       token.Expires.Unix(),
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAccountTokensGet lists the user's tokens, i.e. the devices and sessions that have access to the account,
+// including when and from where (IP address and user agent) they were last used. Individual tokens can be revoked
+// via handleAccountTokenDelete.
+func (s *Server) handleAccountTokensGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	tokens, err := s.userManager.Tokens(u.ID)
+	if err != nil {
+		return err
+	}
+	response := make([]*apiAccountTokenResponse, 0)
+	for _, t := range tokens {
+		response = append(response, newAccountTokenResponse(t, u.Token))
 	}
 	return s.writeJSON(w, response)
 }
@@ -277,15 +290,34 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 		return err
 	}
 	response := &apiAccountTokenResponse{
-		Token:      token.Value,
-		Label:      token.Label,
-		LastAccess: token.LastAccess.Unix(),
-		LastOrigin: token.LastOrigin.String(),
-		Expires:    token.Expires.Unix(),
+		Token:         token.Value,
+		Label:         token.Label,
+		LastAccess:    token.LastAccess.Unix(),
+		LastOrigin:    token.LastOrigin.String(),
+		LastUserAgent: token.LastUserAgent,
+		Expires:       token.Expires.Unix(),
 	}
 	return s.writeJSON(w, response)
 }
 
+// newAccountTokenResponse converts a token to its API representation. The current token is the one used to
+// authenticate the request, if any.
+func newAccountTokenResponse(t *user.Token, currentToken string) *apiAccountTokenResponse {
+	var lastOrigin string
+	if t.LastOrigin != netip.IPv4Unspecified() {
+		lastOrigin = t.LastOrigin.String()
+	}
+	return &apiAccountTokenResponse{
+		Token:         t.Value,
+		Label:         t.Label,
+		LastAccess:    t.LastAccess.Unix(),
+		LastOrigin:    lastOrigin,
+		LastUserAgent: t.LastUserAgent,
+		Expires:       t.Expires.Unix(),
+		Current:       currentToken != "" && t.Value == currentToken,
+	}
+}
+
 func (s *Server) handleAccountTokenDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	u := v.User()
 	token := readParam(r, "X-Token", "Token") // DELETEs cannot have a body, and we don't want it in the path
@@ -176,7 +176,7 @@ func TestAccount_ChangeSettings(t *testing.T) {
 
 	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
 	u, _ := s.userManager.User("phil")
-	token, _ := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
+	token, _ := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), "")
 
 	rr := request(t, s, "PATCH", "/v1/account/settings", `{"notification": {"sound": "juntos"},"ignored": true}`, map[string]string{
 		"Authorization": util.BasicAuth("phil", "phil"),
@@ -381,6 +381,89 @@ func TestAccount_DeleteToken(t *testing.T) {
 	require.Equal(t, 401, rr.Code)
 }
 
+func TestAccount_ListTokens_RevokeOne(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthStatsQueueWriterInterval = 100 * time.Millisecond
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	// Log in from two devices
+	tokens := make([]*apiAccountTokenResponse, 0)
+	for _, userAgent := range []string{"Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0", "ntfy/1.16.0 (Android)"} {
+		rr := request(t, s, "POST", "/v1/account/token", "", map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+			"User-Agent":    userAgent,
+		})
+		require.Equal(t, 200, rr.Code)
+		token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+		require.Nil(t, err)
+		require.Equal(t, userAgent, token.LastUserAgent)
+		tokens = append(tokens, token)
+	}
+
+	// Second device uses its token with a new app version
+	rr := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(tokens[1].Token),
+		"User-Agent":    "ntfy/1.17.0 (Android)",
+	})
+	require.Equal(t, 200, rr.Code)
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	waitFor(t, func() bool {
+		token, err := s.userManager.Token(u.ID, tokens[1].Token)
+		return err == nil && token.LastUserAgent == "ntfy/1.17.0 (Android)"
+	})
+
+	// List sessions
+	rr = request(t, s, "GET", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(tokens[0].Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	sessions, err := util.UnmarshalJSON[[]*apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(*sessions))
+	byToken := make(map[string]*apiAccountTokenResponse)
+	for _, session := range *sessions {
+		byToken[session.Token] = session
+	}
+	require.True(t, byToken[tokens[0].Token].Current)
+	require.Equal(t, "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0", byToken[tokens[0].Token].LastUserAgent)
+	require.False(t, byToken[tokens[1].Token].Current)
+	require.Equal(t, "ntfy/1.17.0 (Android)", byToken[tokens[1].Token].LastUserAgent)
+	require.Equal(t, "9.9.9.9", byToken[tokens[1].Token].LastOrigin)
+	require.Greater(t, byToken[tokens[1].Token].LastAccess, int64(0))
+
+	// Revoke the second device's session only
+	rr = request(t, s, "DELETE", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(tokens[0].Token),
+		"X-Token":       tokens[1].Token,
+	})
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(tokens[1].Token),
+	})
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "GET", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(tokens[0].Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	sessions, err = util.UnmarshalJSON[[]*apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(*sessions))
+	require.Equal(t, tokens[0].Token, (*sessions)[0].Token)
+}
+
+func TestAccount_ListTokens_NoAccount(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	rr := request(t, s, "GET", "/v1/account/token", "", nil)
+	require.Equal(t, 401, rr.Code)
+}
+
 func TestAccount_Delete_Success(t *testing.T) {
 	conf := newTestConfigWithAuthFile(t)
 	conf.EnableSignup = true
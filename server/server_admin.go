@@ -4,6 +4,8 @@ import (
 	"errors"
 	"heckel.io/ntfy/v2/user"
 	"net/http"
+	"sort"
+	"strconv"
 )
 
 func (s *Server) handleUsersGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -142,3 +144,67 @@ func (s *Server) killUserSubscriber(u *user.User, topicPattern string) error {
 	}
 	return nil
 }
+
+// handleSubscribersGet lists the currently connected subscribers, optionally filtered by ?topic=. Subscribers are
+// sorted by topic and connection time, and paginated using ?limit= and ?offset=.
+func (s *Server) handleSubscribersGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	limit, offset := subscribersLimitDefault, 0
+	if limitStr := readQueryParam(r, "limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > subscribersLimitMax {
+			return errHTTPBadRequest.Wrap("limit must be a number between 1 and %d", subscribersLimitMax)
+		}
+	}
+	if offsetStr := readQueryParam(r, "offset"); offsetStr != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return errHTTPBadRequest.Wrap("offset must be a non-negative number")
+		}
+	}
+	topicID := readQueryParam(r, "topic")
+	s.mu.RLock()
+	topics := make([]*topic, 0)
+	for _, t := range s.topics {
+		if topicID == "" || t.ID == topicID {
+			topics = append(topics, t)
+		}
+	}
+	s.mu.RUnlock()
+	type topicSubscriberInfo struct {
+		topic string
+		info  *subscriberInfo
+	}
+	infos := make([]*topicSubscriberInfo, 0)
+	for _, t := range topics {
+		for _, info := range t.SubscriberInfos() {
+			infos = append(infos, &topicSubscriberInfo{topic: t.ID, info: info})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].topic != infos[j].topic {
+			return infos[i].topic < infos[j].topic
+		}
+		return infos[i].info.connected.Before(infos[j].info.connected)
+	})
+	page := infos[min(offset, len(infos)):min(offset+limit, len(infos))]
+	subscribers := make([]*apiSubscriberResponse, len(page))
+	for i, sub := range page {
+		subscribers[i] = &apiSubscriberResponse{
+			Topic:     sub.topic,
+			IP:        sub.info.ip.String(),
+			User:      sub.info.userName,
+			Protocol:  sub.info.protocol,
+			Connected: sub.info.connected.Unix(),
+			Delivered: sub.info.delivered.Load(),
+		}
+	}
+	response := &apiSubscribersResponse{
+		Subscribers: subscribers,
+		Total:       len(infos),
+		Offset:      offset,
+		Limit:       limit,
+	}
+	return s.writeJSON(w, response)
+}
@@ -4,6 +4,9 @@ import (
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -179,3 +182,110 @@ func TestAccess_AllowReset_KillConnection(t *testing.T) {
 		return timeTaken.Load() >= 500
 	})
 }
+
+func TestAdmin_SubscribersGet(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+
+	// Three subscribers on two topics, one of them authenticated
+	withRemote := func(ip string, headers map[string]string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.RemoteAddr = "9.9.9.9"
+			r.Header.Set("X-Forwarded-For", ip)
+			for k, v := range headers {
+				r.Header.Set(k, v)
+			}
+		}
+	}
+	cancelBen := subscribe(t, s, "/mytopic/json", httptest.NewRecorder(), withRemote("1.1.1.1", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}))
+	defer cancelBen()
+	cancelAnonymous := subscribe(t, s, "/mytopic/sse?tags=prod", httptest.NewRecorder(), withRemote("2.2.2.2", nil))
+	defer cancelAnonymous()
+	cancelOther := subscribe(t, s, "/othertopic/raw", httptest.NewRecorder(), withRemote("3.3.3.3", nil))
+	defer cancelOther()
+
+	// Messages that do not pass the filters of a subscriber are not counted as delivered
+	rr := request(t, s, "PUT", "/mytopic", "hi there", nil)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "hi there", map[string]string{
+		"Tags": "prod",
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// All subscribers, sorted by topic and connection time
+	var subscribers *apiSubscribersResponse
+	waitFor(t, func() bool {
+		rr := request(t, s, "GET", "/v1/subscribers", "", map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, rr.Code)
+		subscribers, _ = util.UnmarshalJSON[apiSubscribersResponse](io.NopCloser(rr.Body))
+		return subscribers.Subscribers[0].Delivered == 2 && subscribers.Subscribers[1].Delivered == 1
+	})
+	time.Sleep(100 * time.Millisecond) // The filtered message must not be counted late
+	rr = request(t, s, "GET", "/v1/subscribers", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	subscribers, _ = util.UnmarshalJSON[apiSubscribersResponse](io.NopCloser(rr.Body))
+	require.Equal(t, int64(1), subscribers.Subscribers[1].Delivered)
+	require.Equal(t, 3, subscribers.Total)
+	require.Equal(t, 3, len(subscribers.Subscribers))
+	require.Equal(t, "mytopic", subscribers.Subscribers[0].Topic)
+	require.Equal(t, "1.1.1.1", subscribers.Subscribers[0].IP)
+	require.Equal(t, "ben", subscribers.Subscribers[0].User)
+	require.Equal(t, "json", subscribers.Subscribers[0].Protocol)
+	require.InDelta(t, time.Now().Unix(), subscribers.Subscribers[0].Connected, 5)
+	require.Equal(t, "mytopic", subscribers.Subscribers[1].Topic)
+	require.Equal(t, "2.2.2.2", subscribers.Subscribers[1].IP)
+	require.Equal(t, "", subscribers.Subscribers[1].User)
+	require.Equal(t, "sse", subscribers.Subscribers[1].Protocol)
+	require.Equal(t, "othertopic", subscribers.Subscribers[2].Topic)
+	require.Equal(t, "raw", subscribers.Subscribers[2].Protocol)
+	require.Equal(t, int64(0), subscribers.Subscribers[2].Delivered)
+
+	// Filtered by topic, paginated
+	rr = request(t, s, "GET", "/v1/subscribers?topic=mytopic&limit=1&offset=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	subscribers, _ = util.UnmarshalJSON[apiSubscribersResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 2, subscribers.Total)
+	require.Equal(t, 1, subscribers.Limit)
+	require.Equal(t, 1, subscribers.Offset)
+	require.Equal(t, 1, len(subscribers.Subscribers))
+	require.Equal(t, "2.2.2.2", subscribers.Subscribers[0].IP)
+
+	rr = request(t, s, "GET", "/v1/subscribers?offset=10", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	subscribers, _ = util.UnmarshalJSON[apiSubscribersResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 3, subscribers.Total)
+	require.Empty(t, subscribers.Subscribers)
+
+	rr = request(t, s, "GET", "/v1/subscribers?limit=0", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+}
+
+func TestAdmin_SubscribersGet_NonAdmin(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+
+	rr := request(t, s, "GET", "/v1/subscribers", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/subscribers", "", nil)
+	require.Equal(t, 401, rr.Code)
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+const (
+	apnsProductionURL        = "https://api.push.apple.com"
+	apnsSandboxURL           = "https://api.sandbox.push.apple.com"
+	apnsRequestTimeout       = 10 * time.Second
+	apnsIdleConnTimeout      = 5 * time.Minute
+	apnsMaxIdleConns         = 10
+	apnsTokenRefreshInterval = 50 * time.Minute // Apple rejects tokens older than an hour, and refreshing more often than every 20 minutes
+	apnsPayloadLimit         = 4096
+
+	// APNs reasons, see https://developer.apple.com/documentation/usernotifications/handling-notification-responses-from-apns
+	apnsReasonExpiredProviderToken = "ExpiredProviderToken"
+	apnsReasonBadDeviceToken       = "BadDeviceToken"
+	apnsReasonUnregistered         = "Unregistered"
+)
+
+var (
+	apnsDeviceTokenRegex = regexp.MustCompile(`^[0-9a-fA-F]{64,200}$`)
+)
+
+// apnsError is returned if APNs rejects a notification. The reason is the error string returned by APNs, e.g.
+// "BadDeviceToken" or "Unregistered".
+type apnsError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *apnsError) Error() string {
+	return fmt.Sprintf("APNs responded with HTTP %d: %s", e.StatusCode, e.Reason)
+}
+
+// deviceGone returns true if the device token is no longer valid, and should not be used again
+func (e *apnsError) deviceGone() bool {
+	return e.StatusCode == http.StatusGone || e.Reason == apnsReasonBadDeviceToken || e.Reason == apnsReasonUnregistered
+}
+
+// apnsNotification is a notification that is sent to one or more APNs devices
+type apnsNotification struct {
+	Headers map[string]string
+	Payload []byte
+}
+
+// apnsPayload is the JSON body of an APNs notification. The ntfy fields are sent as custom fields next to the
+// "aps" dictionary, so that the app can process them (e.g. in the Notification Service Extension).
+type apnsPayload struct {
+	Aps           apnsAps  `json:"aps"`
+	ID            string   `json:"id"`
+	Time          int64    `json:"time"`
+	Topic         string   `json:"topic"`
+	Priority      int      `json:"priority"`
+	Tags          []string `json:"tags,omitempty"`
+	Click         string   `json:"click,omitempty"`
+	Icon          string   `json:"icon,omitempty"`
+	AttachmentURL string   `json:"attachment_url,omitempty"`
+}
+
+type apnsAps struct {
+	Alert             apnsAlert `json:"alert"`
+	Sound             string    `json:"sound,omitempty"`
+	MutableContent    int       `json:"mutable-content"`
+	InterruptionLevel string    `json:"interruption-level"`
+}
+
+type apnsAlert struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body"`
+}
+
+// apnsSender is an interface that represents a client that can send notifications to APNs.
+// In tests, this can be implemented with a mock.
+type apnsSender interface {
+	// Send sends a notification to the given device, or returns an error. If APNs rejects the notification,
+	// an *apnsError is returned.
+	Send(deviceToken string, n *apnsNotification) error
+}
+
+// apnsSenderImpl is an apnsSender that talks to APNs directly via HTTP/2, using token-based authentication.
+// Connections are pooled and kept open by the HTTP transport, as recommended by Apple.
+type apnsSenderImpl struct {
+	baseURL  string
+	bundleID string
+	client   *http.Client
+	tokens   *apnsTokenProvider
+}
+
+func newAPNSSender(keyFile, keyID, teamID, bundleID string, production bool) (*apnsSenderImpl, error) {
+	keyBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseAPNSKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := apnsSandboxURL
+	if production {
+		baseURL = apnsProductionURL
+	}
+	return &apnsSenderImpl{
+		baseURL:  baseURL,
+		bundleID: bundleID,
+		client: &http.Client{
+			Timeout: apnsRequestTimeout,
+			Transport: &http.Transport{
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: apnsMaxIdleConns,
+				IdleConnTimeout:     apnsIdleConnTimeout,
+			},
+		},
+		tokens: newAPNSTokenProvider(key, keyID, teamID),
+	}, nil
+}
+
+// Send sends the notification to the device. If APNs reports that the provider token expired (e.g. because the
+// clock is off), a new token is generated and the notification is sent again once.
+func (c *apnsSenderImpl) Send(deviceToken string, n *apnsNotification) error {
+	token, err := c.tokens.Token()
+	if err != nil {
+		return err
+	}
+	err = c.send(deviceToken, n, token)
+	var apnsErr *apnsError
+	if errors.As(err, &apnsErr) && apnsErr.Reason == apnsReasonExpiredProviderToken {
+		c.tokens.Invalidate(token)
+		if token, err = c.tokens.Token(); err != nil {
+			return err
+		}
+		return c.send(deviceToken, n, token)
+	}
+	return err
+}
+
+func (c *apnsSenderImpl) send(deviceToken string, n *apnsNotification, token string) error {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/3/device/%s", c.baseURL, deviceToken), bytes.NewReader(n.Payload))
+	if err != nil {
+		return err
+	}
+	for k, v := range n.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("authorization", "bearer "+token)
+	req.Header.Set("apns-topic", c.bundleID)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&body) // Reason may be empty if the body cannot be parsed
+	return &apnsError{StatusCode: resp.StatusCode, Reason: body.Reason}
+}
+
+// apnsTokenProvider generates and caches the JWT provider token used to authenticate with APNs. Apple allows
+// refreshing the token at most every 20 minutes, and rejects tokens older than one hour.
+type apnsTokenProvider struct {
+	key      *ecdsa.PrivateKey
+	keyID    string
+	teamID   string
+	token    string
+	issuedAt time.Time
+	mu       sync.Mutex
+}
+
+func newAPNSTokenProvider(key *ecdsa.PrivateKey, keyID, teamID string) *apnsTokenProvider {
+	return &apnsTokenProvider{
+		key:    key,
+		keyID:  keyID,
+		teamID: teamID,
+	}
+}
+
+// Token returns the current provider token, or generates a new one if it is about to expire
+func (p *apnsTokenProvider) Token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Since(p.issuedAt) < apnsTokenRefreshInterval {
+		return p.token, nil
+	}
+	issuedAt := time.Now()
+	token, err := p.generate(issuedAt)
+	if err != nil {
+		return "", err
+	}
+	p.token, p.issuedAt = token, issuedAt
+	return token, nil
+}
+
+// Invalidate discards the given token, so that the next call to Token generates a new one. If the token was
+// already replaced (e.g. by a concurrent request), this is a no-op.
+func (p *apnsTokenProvider) Invalidate(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token == token {
+		p.token = ""
+	}
+}
+
+// generate creates an ES256-signed JWT with the key ID in the header, and the team ID as issuer
+func (p *apnsTokenProvider) generate(issuedAt time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": p.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{"iss": p.teamID, "iat": issuedAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseAPNSKey parses the PEM-encoded .p8 auth key downloaded from the Apple developer account
+func parseAPNSKey(keyBytes []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, errors.New("invalid APNs auth key, expected PEM-encoded .p8 file")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APNs auth key: %w", err)
+	}
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid APNs auth key, expected ECDSA key")
+	}
+	return ecdsaKey, nil
+}
+
+// toAPNSNotification converts a message to an APNs alert notification. The ntfy priority is mapped to the APNs
+// priority and interruption level: min and low priority messages are delivered power-considerate and without sound,
+// max priority messages are time-sensitive. If the payload is too large, the body is truncated.
+func toAPNSNotification(m *message) (*apnsNotification, error) {
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3 // Not set means default priority
+	}
+	apnsPriority, sound, interruptionLevel := "10", "default", "active"
+	if priority <= 2 {
+		apnsPriority, sound = "5", ""
+	}
+	if priority == 1 {
+		interruptionLevel = "passive"
+	} else if priority == 5 {
+		interruptionLevel = "time-sensitive"
+	}
+	p := &apnsPayload{
+		Aps: apnsAps{
+			Alert: apnsAlert{
+				Title: m.Title,
+				Body:  m.Message,
+			},
+			Sound:             sound,
+			MutableContent:    1,
+			InterruptionLevel: interruptionLevel,
+		},
+		ID:       m.ID,
+		Time:     m.Time,
+		Topic:    m.Topic,
+		Priority: priority,
+		Tags:     m.Tags,
+		Click:    m.Click,
+		Icon:     m.Icon,
+	}
+	if m.Attachment != nil {
+		p.AttachmentURL = m.Attachment.URL
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	for len(payload) > apnsPayloadLimit && p.Aps.Alert.Body != "" {
+		over := len(payload) - apnsPayloadLimit + len("...")
+		p.Aps.Alert.Body = truncateUTF8(strings.TrimSuffix(p.Aps.Alert.Body, "..."), over) + "..."
+		if payload, err = json.Marshal(p); err != nil {
+			return nil, err
+		}
+	}
+	headers := map[string]string{
+		"apns-push-type":  "alert",
+		"apns-priority":   apnsPriority,
+		"apns-expiration": fmt.Sprintf("%d", m.Expires),
+	}
+	if m.CollapseKey != "" {
+		headers["apns-collapse-id"] = m.CollapseKey
+	}
+	return &apnsNotification{
+		Headers: headers,
+		Payload: payload,
+	}, nil
+}
+
+// truncateUTF8 removes at least n bytes from the end of s, without cutting a multi-byte character in half
+func truncateUTF8(s string, n int) string {
+	if n >= len(s) {
+		return ""
+	}
+	s = s[:len(s)-n]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// sendToAPNs sends the message to all iOS devices registered for the message's topic. Devices that APNs reports as
+// gone (e.g. because the app was uninstalled) are removed. Other errors are logged per device, including the reason
+// returned by APNs.
+func (s *Server) sendToAPNs(v *visitor, m *message) {
+	if m.Event != messageEvent {
+		return
+	}
+	ev := logvm(v, m).Tag(tagAPNS)
+	tokens, err := s.apnsStore.DeviceTokensForTopic(m.Topic)
+	if err != nil {
+		ev.Err(err).Warn("Unable to read APNs devices")
+		return
+	} else if len(tokens) == 0 {
+		return
+	}
+	n, err := toAPNSNotification(m)
+	if err != nil {
+		ev.Err(err).Warn("Unable to create APNs notification")
+		return
+	}
+	ev.Debug("Sending APNs notification to %d device(s)", len(tokens))
+	for _, token := range tokens {
+		dev := logvm(v, m).Tag(tagAPNS).Field("apns_device", token)
+		err := s.apnsSender.Send(token, n)
+		var apnsErr *apnsError
+		if errors.As(err, &apnsErr) {
+			dev = dev.Fields(log.Context{
+				"apns_status": apnsErr.StatusCode,
+				"apns_reason": apnsErr.Reason,
+			})
+			if apnsErr.deviceGone() {
+				dev.Debug("APNs device is gone, removing it")
+				if err := s.apnsStore.RemoveDevice(token); err != nil {
+					dev.Err(err).Warn("Unable to remove APNs device")
+				}
+				continue
+			}
+		}
+		if err != nil {
+			dev.Err(err).Warn("Unable to send APNs notification")
+		}
+	}
+}
+
+// handleAPNSDeviceUpdate registers an iOS device for the given topics, replacing the topics it was registered for
+// before. Like for web push, the user must be allowed to read all topics.
+func (s *Server) handleAPNSDeviceUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAPNSDeviceRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil || !apnsDeviceTokenRegex.MatchString(req.Token) {
+		return errHTTPBadRequestAPNSDeviceInvalid
+	} else if len(req.Topics) > apnsDeviceTopicLimit {
+		return errHTTPBadRequestAPNSDeviceInvalid.Wrap("too many topics, limit is %d", apnsDeviceTopicLimit)
+	}
+	topics, err := s.topicsFromIDs(req.Topics...)
+	if err != nil {
+		return err
+	}
+	if s.userManager != nil {
+		u := v.User()
+		for _, t := range topics {
+			if err := s.userManager.Authorize(u, t.ID, user.PermissionRead); err != nil {
+				logvr(v, r).With(t).Err(err).Debug("Access to topic %s not authorized", t.ID)
+				return errHTTPForbidden.With(t)
+			}
+		}
+	}
+	if err := s.apnsStore.UpsertDevice(strings.ToLower(req.Token), v.MaybeUserID(), req.Topics); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAPNSDeviceDelete removes an iOS device for all topics
+func (s *Server) handleAPNSDeviceDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	req, err := readJSONWithLimit[apiAPNSDeviceRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil || !apnsDeviceTokenRegex.MatchString(req.Token) {
+		return errHTTPBadRequestAPNSDeviceInvalid
+	}
+	if err := s.apnsStore.RemoveDevice(strings.ToLower(req.Token)); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testAPNSSender struct {
+	errors map[string]error // Device token -> error returned by Send
+	sent   map[string][]*apnsNotification
+	mu     sync.Mutex
+}
+
+func newTestAPNSSender() *testAPNSSender {
+	return &testAPNSSender{
+		errors: make(map[string]error),
+		sent:   make(map[string][]*apnsNotification),
+	}
+}
+
+func (s *testAPNSSender) Send(deviceToken string, n *apnsNotification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err, ok := s.errors[deviceToken]; ok {
+		return err
+	}
+	s.sent[deviceToken] = append(s.sent[deviceToken], n)
+	return nil
+}
+
+func (s *testAPNSSender) Sent(deviceToken string) []*apnsNotification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(make([]*apnsNotification, 0), s.sent[deviceToken]...)
+}
+
+func TestServer_APNS_RegisterAndPublish(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAPNS(t))
+	sender := newTestAPNSSender()
+	s.apnsSender = sender
+
+	response := request(t, s, "PUT", "/v1/apns", `{"token":"`+strings.ToUpper(testAPNSDeviceToken)+`","topics":["mytopic"]}`, nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "backup failed", map[string]string{
+		"Title":    "Backup",
+		"Priority": "urgent",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/othertopic", "not for this device", nil)
+	require.Equal(t, 200, response.Code)
+
+	require.Eventually(t, func() bool { return len(sender.Sent(testAPNSDeviceToken)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	sent := sender.Sent(testAPNSDeviceToken)
+	require.Equal(t, 1, len(sent))
+	var payload apnsPayload
+	require.Nil(t, json.Unmarshal(sent[0].Payload, &payload))
+	require.Equal(t, m.ID, payload.ID)
+	require.Equal(t, "mytopic", payload.Topic)
+	require.Equal(t, "Backup", payload.Aps.Alert.Title)
+	require.Equal(t, "backup failed", payload.Aps.Alert.Body)
+	require.Equal(t, "time-sensitive", payload.Aps.InterruptionLevel)
+
+	// Unregistered devices are not sent to anymore
+	response = request(t, s, "DELETE", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`"}`, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "backup failed again", nil)
+	require.Equal(t, 200, response.Code)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 1, len(sender.Sent(testAPNSDeviceToken)))
+}
+
+func TestServer_APNS_DeviceGoneIsRemoved(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAPNS(t))
+	sender := newTestAPNSSender()
+	sender.errors[testAPNSDeviceToken] = &apnsError{StatusCode: http.StatusGone, Reason: apnsReasonUnregistered}
+	s.apnsSender = sender
+
+	response := request(t, s, "PUT", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi there", nil)
+	require.Equal(t, 200, response.Code)
+
+	require.Eventually(t, func() bool {
+		tokens, err := s.apnsStore.DeviceTokensForTopic("mytopic")
+		return err == nil && len(tokens) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_APNS_RegisterInvalid(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAPNS(t))
+
+	response := request(t, s, "PUT", "/v1/apns", `{"token":"not-a-token","topics":["mytopic"]}`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40067, toHTTPError(t, response.Body.String()).Code)
+
+	topics := make([]string, apnsDeviceTopicLimit+1)
+	for i := range topics {
+		topics[i] = "topic" + strings.Repeat("x", i%5)
+	}
+	body, _ := json.Marshal(&apiAPNSDeviceRequest{Token: testAPNSDeviceToken, Topics: topics})
+	response = request(t, s, "PUT", "/v1/apns", string(body), nil)
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_APNS_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_APNS_RegisterRequiresReadAccess(t *testing.T) {
+	c := configureAuth(t, newTestConfigWithAPNS(t))
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/v1/apns", `{"token":"`+testAPNSDeviceToken+`","topics":["mytopic"]}`, nil)
+	require.Equal(t, 403, response.Code)
+}
+
+func TestToAPNSNotification_PriorityMapping(t *testing.T) {
+	for _, tc := range []struct {
+		priority          int
+		apnsPriority      string
+		sound             string
+		interruptionLevel string
+	}{
+		{1, "5", "", "passive"},
+		{2, "5", "", "active"},
+		{0, "10", "default", "active"},
+		{4, "10", "default", "active"},
+		{5, "10", "default", "time-sensitive"},
+	} {
+		m := newDefaultMessage("mytopic", "hi there")
+		m.Priority = tc.priority
+		n, err := toAPNSNotification(m)
+		require.Nil(t, err)
+		require.Equal(t, "alert", n.Headers["apns-push-type"])
+		require.Equal(t, tc.apnsPriority, n.Headers["apns-priority"])
+		var payload apnsPayload
+		require.Nil(t, json.Unmarshal(n.Payload, &payload))
+		require.Equal(t, tc.sound, payload.Aps.Sound)
+		require.Equal(t, tc.interruptionLevel, payload.Aps.InterruptionLevel)
+		require.Equal(t, 1, payload.Aps.MutableContent)
+	}
+}
+
+func TestToAPNSNotification_FieldsAndTruncation(t *testing.T) {
+	m := newDefaultMessage("mytopic", strings.Repeat("ü", 3000))
+	m.Title = "Disk full"
+	m.Tags = []string{"warning"}
+	m.Click = "https://example.com"
+	m.Expires = 1700000000
+	m.CollapseKey = "disk:sda1"
+	m.Attachment = &attachment{Name: "df.txt", URL: "https://ntfy.sh/file/abc.txt"}
+	n, err := toAPNSNotification(m)
+	require.Nil(t, err)
+	require.LessOrEqual(t, len(n.Payload), apnsPayloadLimit)
+	require.Equal(t, "1700000000", n.Headers["apns-expiration"])
+	require.Equal(t, "disk:sda1", n.Headers["apns-collapse-id"])
+
+	var payload apnsPayload
+	require.Nil(t, json.Unmarshal(n.Payload, &payload))
+	require.Equal(t, "mytopic", payload.Topic)
+	require.Equal(t, 3, payload.Priority)
+	require.Equal(t, []string{"warning"}, payload.Tags)
+	require.Equal(t, "https://example.com", payload.Click)
+	require.Equal(t, "https://ntfy.sh/file/abc.txt", payload.AttachmentURL)
+	require.True(t, strings.HasSuffix(payload.Aps.Alert.Body, "ü..."))
+}
+
+func TestAPNSTokenProvider_TokenIsSignedAndCached(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tokens := newAPNSTokenProvider(key, "KEY123", "TEAM123")
+
+	token, err := tokens.Token()
+	require.Nil(t, err)
+	parts := strings.Split(token, ".")
+	require.Equal(t, 3, len(parts))
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	require.Equal(t, `{"alg":"ES256","kid":"KEY123"}`, string(header))
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	require.Contains(t, string(claims), `"iss":"TEAM123"`)
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	require.Equal(t, 64, len(signature))
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	require.True(t, ecdsa.Verify(&key.PublicKey, digest[:], r, s))
+
+	// Cached until invalidated or expired
+	token2, err := tokens.Token()
+	require.Nil(t, err)
+	require.Equal(t, token, token2)
+	tokens.Invalidate(token)
+	token3, err := tokens.Token()
+	require.Nil(t, err)
+	require.NotEqual(t, token, token3)
+	tokens.issuedAt = time.Now().Add(-apnsTokenRefreshInterval)
+	token4, err := tokens.Token()
+	require.Nil(t, err)
+	require.NotEqual(t, token3, token4)
+}
+
+func TestAPNSSender_HTTP2AndExpiredProviderToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	var mu sync.Mutex
+	authorizations := make([]string, 0)
+	apnsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, 2, r.ProtoMajor)
+		require.Equal(t, "io.heckel.ntfy", r.Header.Get("apns-topic"))
+		require.Equal(t, "alert", r.Header.Get("apns-push-type"))
+		authorizations = append(authorizations, r.Header.Get("authorization"))
+		switch {
+		case r.URL.Path == "/3/device/"+testAPNSDeviceToken && len(authorizations) == 1:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason":"ExpiredProviderToken"}`))
+		case r.URL.Path == "/3/device/"+testAPNSDeviceToken:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		}
+	}))
+	apnsServer.EnableHTTP2 = true
+	apnsServer.StartTLS()
+	defer apnsServer.Close()
+
+	sender := &apnsSenderImpl{
+		baseURL:  apnsServer.URL,
+		bundleID: "io.heckel.ntfy",
+		client:   apnsServer.Client(),
+		tokens:   newAPNSTokenProvider(key, "KEY123", "TEAM123"),
+	}
+	n, err := toAPNSNotification(newDefaultMessage("mytopic", "hi there"))
+	require.Nil(t, err)
+
+	// Expired provider token is regenerated, and the notification is sent again
+	require.Nil(t, sender.Send(testAPNSDeviceToken, n))
+	require.Equal(t, 2, len(authorizations))
+	require.True(t, strings.HasPrefix(authorizations[0], "bearer "))
+	require.NotEqual(t, authorizations[0], authorizations[1])
+
+	// Other errors include the reason
+	err = sender.Send(strings.Repeat("cd", 32), n)
+	require.Equal(t, &apnsError{StatusCode: http.StatusBadRequest, Reason: apnsReasonBadDeviceToken}, err)
+	require.Equal(t, authorizations[1], authorizations[2]) // Token is reused
+}
+
+func TestParseAPNSKey_Invalid(t *testing.T) {
+	_, err := parseAPNSKey([]byte("not a key"))
+	require.Error(t, err)
+}
+
+func newTestConfigWithAPNS(t *testing.T) *Config {
+	c := newTestConfig(t)
+	c.APNSKeyFile = newTestAPNSKeyFile(t)
+	c.APNSKeyID = "KEY123"
+	c.APNSTeamID = "TEAM123"
+	c.APNSBundleID = "io.heckel.ntfy"
+	c.APNSDeviceFile = filepath.Join(t.TempDir(), "apns.db")
+	return c
+}
+
+func newTestAPNSKeyFile(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	filename := filepath.Join(t.TempDir(), "AuthKey_KEY123.p8")
+	require.Nil(t, os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return filename
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	tagAttachmentFetch          = "attachment_fetch"
+	attachmentFetchTimeout      = 30 * time.Second
+	attachmentFetchPeek         = 4096 // Bytes used to detect the content type of fetched attachments
+	attachmentFetchMaxRedirects = 10
+)
+
+// AttachmentFetchCredential is a credential for a host that serves attachments only to authenticated clients.
+// Attachment URLs (X-Attach) on the host are fetched with this credential and stored like uploaded attachments,
+// so that subscribers can download them without having access to the host themselves.
+type AttachmentFetchCredential struct {
+	Host     string // Host name, including the port if it is not the default port, e.g. files.example.com:8443
+	Username string // Basic auth, if Token is empty
+	Password string
+	Token    string   // Bearer token, used instead of basic auth if set
+	Users    []string // Users that may use the credential; if empty, all authenticated users may use it
+}
+
+// attachmentFetchCredential returns the credential configured for the host of the attachment URL, or nil if
+// there is none, or if the visitor may not use it. Hosts are compared case-insensitively, and must match exactly
+// (including the port). Anonymous visitors may never use a credential, since that would let anyone read files
+// from the host.
+func (s *Server) attachmentFetchCredential(v *visitor, attachmentURL string) *AttachmentFetchCredential {
+	if len(s.config.AttachmentFetchCredentials) == 0 {
+		return nil
+	}
+	u, err := url.Parse(attachmentURL)
+	if err != nil {
+		return nil
+	}
+	for _, cred := range s.config.AttachmentFetchCredentials {
+		if strings.EqualFold(u.Host, cred.Host) {
+			if !cred.allowed(v) {
+				return nil
+			}
+			return cred
+		}
+	}
+	return nil
+}
+
+func (c *AttachmentFetchCredential) allowed(v *visitor) bool {
+	u := v.User()
+	if u == nil {
+		return false
+	}
+	return len(c.Users) == 0 || slices.Contains(c.Users, u.Name)
+}
+
+// checkAttachmentFetchRedirect only allows redirects on the same host, so that a host cannot make the server
+// fetch files from other (possibly private) hosts
+func checkAttachmentFetchRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= attachmentFetchMaxRedirects {
+		return errors.New("too many redirects")
+	} else if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		return fmt.Errorf("redirect to other host %s not allowed", req.URL.Host)
+	}
+	return nil
+}
+
+// handleBodyAsFetchedAttachment treats the body as message (like for any other X-Attach URL), and then downloads
+// the attachment URL with the configured credential and stores it like an uploaded attachment. The same limits
+// apply as for uploads, and the attachment URL is rewritten to point to the local copy. Dry runs do not contact
+// the attachment host.
+func (s *Server) handleBodyAsFetchedAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser, cred *AttachmentFetchCredential, dry bool) error {
+	if err := s.handleBodyAsTextMessage(m, body); err != nil {
+		return err
+	} else if dry {
+		return nil
+	} else if s.fileCache == nil || s.config.BaseURL == "" {
+		return errHTTPBadRequestAttachmentsDisallowed.With(m)
+	}
+	ev := logvrm(v, r, m).Tag(tagAttachmentFetch).Field("attachment_url", m.Attachment.URL)
+	resp, err := s.fetchAttachment(m.Attachment.URL, cred)
+	if err != nil {
+		ev.Err(err).Debug("Unable to fetch attachment")
+		return errHTTPBadRequestAttachmentNotFetchable.Wrap("%s", err.Error()).With(m)
+	}
+	defer resp.Body.Close()
+	fetched, err := util.Peek(resp.Body, attachmentFetchPeek)
+	if err != nil {
+		return err
+	}
+	if err := s.handleBodyAsAttachment(r, v, m, fetched, false); err != nil {
+		return err
+	}
+	ev.Field("attachment_size", m.Attachment.Size).Debug("Fetched attachment from %s", cred.Host)
+	return nil
+}
+
+// fetchAttachment downloads the attachment from the given URL, using the given credential. Unlike icons, attachments
+// may be fetched from private IP addresses, since only hosts explicitly configured by the admin are fetched. Redirects
+// to other hosts are not followed (see checkAttachmentFetchRedirect).
+func (s *Server) fetchAttachment(attachmentURL string, cred *AttachmentFetchCredential) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, attachmentURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	if cred.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cred.Token)
+	} else {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	resp, err := s.attachmentClient.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("attachment host responded with HTTP %s", resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServer_AttachmentFetch_ConfiguredHostWithCredentials(t *testing.T) {
+	var authorization atomic.Value
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		w.Write([]byte("quarterly numbers"))
+	}))
+	defer fileServer.Close()
+	u, _ := url.Parse(fileServer.URL)
+
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	c.AttachmentFetchCredentials = []*AttachmentFetchCredential{{Host: u.Host, Username: "phil", Password: "mypass"}}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	response := request(t, s, "PUT", "/mytopic", "report is ready", map[string]string{
+		"X-Attach":      fileServer.URL + "/reports/q3.txt",
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Basic cGhpbDpteXBhc3M=", authorization.Load())
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "report is ready", m.Message)
+	require.Equal(t, "q3.txt", m.Attachment.Name)
+	require.Equal(t, "text/plain; charset=utf-8", m.Attachment.Type)
+	require.Equal(t, int64(17), m.Attachment.Size)
+	require.Greater(t, m.Attachment.Expires, int64(0))
+	require.Equal(t, "http://127.0.0.1:12345/file/"+m.ID+".txt", m.Attachment.URL)
+
+	// Attachment is served from the file cache
+	response = request(t, s, "GET", strings.TrimPrefix(m.Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "quarterly numbers", response.Body.String())
+}
+
+func TestServer_AttachmentFetch_BearerToken(t *testing.T) {
+	var authorization atomic.Value
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		w.Write([]byte("some file"))
+	}))
+	defer fileServer.Close()
+	u, _ := url.Parse(fileServer.URL)
+
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	c.AttachmentFetchCredentials = []*AttachmentFetchCredential{{Host: strings.ToUpper(u.Host), Token: "secret-token"}}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	response := request(t, s, "PUT", "/mytopic?attach="+url.QueryEscape(fileServer.URL+"/file.txt"), "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Bearer secret-token", authorization.Load())
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "You received a file: file.txt", m.Message)
+	require.Equal(t, "http://127.0.0.1:12345/file/"+m.ID+".txt", m.Attachment.URL)
+}
+
+func TestServer_AttachmentFetch_OtherHostsAreNotFetched(t *testing.T) {
+	var requests atomic.Int32
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("some file"))
+	}))
+	defer fileServer.Close()
+
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	c.AttachmentFetchCredentials = []*AttachmentFetchCredential{{Host: "files.example.com", Token: "secret-token"}}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	attachURL := fileServer.URL + "/file.txt"
+	response := request(t, s, "PUT", "/mytopic", "some file", map[string]string{
+		"X-Attach":      attachURL,
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int32(0), requests.Load())
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, attachURL, m.Attachment.URL)
+	require.Equal(t, int64(0), m.Attachment.Expires)
+}
+
+func TestServer_AttachmentFetch_Errors(t *testing.T) {
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large.bin" {
+			w.Write(make([]byte, 2000))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer fileServer.Close()
+	u, _ := url.Parse(fileServer.URL)
+
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	c.AttachmentFileSizeLimit = 1000
+	c.AttachmentFetchCredentials = []*AttachmentFetchCredential{{Host: u.Host, Token: "wrong-token"}}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	response := request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"X-Attach":      fileServer.URL + "/file.txt",
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40066, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"X-Attach":      fileServer.URL + "/large.bin",
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 41301, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_AttachmentFetch_AnonymousAndOtherUsersAreNotFetched(t *testing.T) {
+	var requests atomic.Int32
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("payroll"))
+	}))
+	defer fileServer.Close()
+	u, _ := url.Parse(fileServer.URL)
+
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	c.AttachmentFetchCredentials = []*AttachmentFetchCredential{{Host: u.Host, Token: "secret-token", Users: []string{"phil"}}}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+
+	// Anonymous visitors and users that are not allowed to use the credential only get a link
+	attachURL := fileServer.URL + "/payroll.pdf"
+	for _, headers := range []map[string]string{
+		{"X-Attach": attachURL},
+		{"X-Attach": attachURL, "Authorization": util.BasicAuth("ben", "ben")},
+	} {
+		response := request(t, s, "PUT", "/mytopic", "", headers)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, attachURL, toMessage(t, response.Body.String()).Attachment.URL)
+	}
+	require.Equal(t, int32(0), requests.Load())
+
+	response := request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"X-Attach":      attachURL,
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int32(1), requests.Load())
+	require.NotEqual(t, attachURL, toMessage(t, response.Body.String()).Attachment.URL)
+}
+
+func TestServer_AttachmentFetch_RedirectToOtherHost(t *testing.T) {
+	var otherRequests atomic.Int32
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherRequests.Add(1)
+		w.Write([]byte("internal"))
+	}))
+	defer otherServer.Close()
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved.txt" {
+			http.Redirect(w, r, "/file.txt", http.StatusFound)
+			return
+		} else if r.URL.Path == "/file.txt" {
+			w.Write([]byte("some file"))
+			return
+		}
+		http.Redirect(w, r, otherServer.URL+"/secret.txt", http.StatusFound)
+	}))
+	defer fileServer.Close()
+	u, _ := url.Parse(fileServer.URL)
+
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	c.AttachmentFetchCredentials = []*AttachmentFetchCredential{{Host: u.Host, Token: "secret-token"}}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	// Redirects on the same host are followed
+	response := request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"X-Attach":      fileServer.URL + "/moved.txt",
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(9), toMessage(t, response.Body.String()).Attachment.Size)
+
+	// Redirects to other hosts are not
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"X-Attach":      fileServer.URL + "/redirect.txt",
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40066, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, int32(0), otherRequests.Load())
+}
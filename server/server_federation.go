@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/v2/util"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	tagFederation = "federation"
+
+	// federationForwardedByHeader lists the base URLs of all servers that forwarded a message. It is used to prevent
+	// forwarding loops, e.g. if two servers forward the same topic to each other.
+	federationForwardedByHeader = "X-Forwarded-By"
+	federationMaxAttempts       = 4
+	federationRequestTimeout    = 10 * time.Second
+
+	// Plain-text message headers, see Config.FederationMessageHeaders
+	federationPriorityHeader = "X-Ntfy-Priority"
+	federationTagsHeader     = "X-Ntfy-Tags"
+	federationTitleHeader    = "X-Ntfy-Title"
+)
+
+// FederatedTopic links a local topic to a topic on a remote ntfy server. All messages published to the local topic
+// are forwarded to the remote topic via the remote's publish API.
+type FederatedTopic struct {
+	Topic     string // Local topic, e.g. global-alerts
+	RemoteURL string // Topic URL on the remote server, e.g. https://ntfy.dc2.example.com/global-alerts
+	Token     string // Access token used to publish to the remote server, may be empty
+}
+
+// forwardToFederatedTopics forwards the message to all remote topics linked to the message's topic, unless the
+// message was forwarded to this server by the remote server (or it passed this server before). Forwarding happens
+// in the background, so it never blocks the publisher.
+func (s *Server) forwardToFederatedTopics(v *visitor, m *message, forwardedBy []string) {
+	if len(s.config.FederatedTopics) == 0 || m.Event != messageEvent || util.Contains(forwardedBy, s.config.BaseURL) {
+		return
+	}
+	forwardedByHeader := strings.Join(append(append([]string{}, forwardedBy...), s.config.BaseURL), ",")
+	for _, federated := range s.config.FederatedTopics {
+		if federated.Topic != m.Topic || federationForwardedByRemote(federated.RemoteURL, forwardedBy) {
+			continue
+		}
+		go s.forwardToFederatedTopic(v, m, federated, forwardedByHeader)
+	}
+}
+
+// forwardToFederatedTopic sends the message to the remote topic, and retries with exponential backoff (starting at
+// Config.FederationRetryDelay) if the remote server is unreachable, responds with 5xx, or rate limits us
+func (s *Server) forwardToFederatedTopic(v *visitor, m *message, federated *FederatedTopic, forwardedBy string) {
+	ev := logvm(v, m).Tag(tagFederation).Field("federation_remote_url", federated.RemoteURL)
+	delay := s.config.FederationRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := s.sendToFederatedTopic(m, federated, forwardedBy)
+		if err == nil {
+			ev.Debug("Forwarded message to %s", federated.RemoteURL)
+			return
+		} else if !retry || attempt >= federationMaxAttempts {
+			ev.Err(err).Warn("Unable to forward message to %s, giving up after %d attempt(s)", federated.RemoteURL, attempt)
+			return
+		}
+		ev.Err(err).Debug("Unable to forward message to %s, retrying in %s", federated.RemoteURL, delay.String())
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+func (s *Server) sendToFederatedTopic(m *message, federated *FederatedTopic, forwardedBy string) (retry bool, err error) {
+	req, err := newFederationRequest(redactMessage(m, s.config.RedactPatterns), federated, forwardedBy, s.config.FederationMessageHeaders)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	client := &http.Client{Timeout: federationRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusConflict { // Conflict: message ID exists, i.e. already forwarded
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("remote server responded with HTTP %s", resp.Status)
+}
+
+// newFederationRequest creates the publish request for the remote server. The message ID is kept, so that the
+// remote server rejects duplicates, and attachments are passed as references (X-Attach) to this server. The
+// message is expected to be redacted already, see Config.RedactPatterns. If messageHeaders is set, the priority,
+// tags and title are additionally passed as plain-text X-Ntfy-* headers, see Config.FederationMessageHeaders.
+func newFederationRequest(m *message, federated *FederatedTopic, forwardedBy string, messageHeaders bool) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, federated.RemoteURL, strings.NewReader(m.Message))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(federationForwardedByHeader, forwardedBy)
+	req.Header.Set("X-Message-ID", m.ID)
+	if m.Title != "" {
+		req.Header.Set("X-Title", mime.BEncoding.Encode("utf-8", m.Title))
+	}
+	if m.Priority != 0 {
+		req.Header.Set("X-Priority", fmt.Sprintf("%d", m.Priority))
+	}
+	if len(m.Tags) > 0 {
+		req.Header.Set("X-Tags", mime.BEncoding.Encode("utf-8", strings.Join(m.Tags, ",")))
+	}
+	if m.Click != "" {
+		req.Header.Set("X-Click", m.Click)
+	}
+	if m.Icon != "" {
+		req.Header.Set("X-Icon", m.Icon)
+	}
+	if len(m.Actions) > 0 {
+		actions, err := json.Marshal(m.Actions)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Actions", mime.BEncoding.Encode("utf-8", string(actions)))
+	}
+	if m.Attachment != nil && m.Attachment.URL != "" {
+		req.Header.Set("X-Attach", m.Attachment.URL)
+		req.Header.Set("X-Filename", mime.BEncoding.Encode("utf-8", m.Attachment.Name))
+	}
+	if m.ContentType == "text/markdown" {
+		req.Header.Set("X-Markdown", "yes")
+	}
+	if messageHeaders {
+		setFederationMessageHeaders(req, m)
+	}
+	if federated.Token != "" {
+		req.Header.Set("Authorization", util.BearerAuth(federated.Token))
+	}
+	return req, nil
+}
+
+// setFederationMessageHeaders sets the X-Ntfy-Priority, X-Ntfy-Tags and X-Ntfy-Title headers, so that receivers
+// (e.g. an API gateway) can route messages without parsing the body. Unlike X-Title and X-Tags, the values are not
+// RFC 2047 encoded, so control characters are replaced to prevent header injection.
+func setFederationMessageHeaders(req *http.Request, m *message) {
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3
+	}
+	req.Header.Set(federationPriorityHeader, fmt.Sprintf("%d", priority))
+	if len(m.Tags) > 0 {
+		req.Header.Set(federationTagsHeader, sanitizeHeaderValue(strings.Join(m.Tags, ",")))
+	}
+	if m.Title != "" {
+		req.Header.Set(federationTitleHeader, sanitizeHeaderValue(m.Title))
+	}
+}
+
+// sanitizeHeaderValue replaces control characters (including CR and LF) with spaces, and trims the result
+func sanitizeHeaderValue(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s))
+}
+
+// federationForwardedByRemote returns true if the remote topic URL belongs to one of the servers that forwarded
+// the message, i.e. forwarding it would echo the message back to where it came from
+func federationForwardedByRemote(remoteURL string, forwardedBy []string) bool {
+	for _, baseURL := range forwardedBy {
+		if strings.HasPrefix(remoteURL, baseURL+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// readForwardedBy reads the X-Forwarded-By header of a publish request forwarded by another server
+func readForwardedBy(r *http.Request) []string {
+	forwardedBy := make([]string, 0)
+	for _, baseURL := range util.SplitNoEmpty(r.Header.Get(federationForwardedByHeader), ",") {
+		forwardedBy = append(forwardedBy, strings.TrimSpace(baseURL))
+	}
+	return forwardedBy
+}
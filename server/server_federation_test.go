@@ -0,0 +1,246 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_Federation_ForwardsMessageWithoutEcho(t *testing.T) {
+	var s1, s2 *Server
+	var s1Requests, s2Requests atomic.Int32
+	httpServer1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s1Requests.Add(1)
+		s1.handle(w, r)
+	}))
+	defer httpServer1.Close()
+	httpServer2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s2Requests.Add(1)
+		s2.handle(w, r)
+	}))
+	defer httpServer2.Close()
+
+	// Both servers forward global-alerts to each other
+	c1 := newTestConfig(t)
+	c1.BaseURL = httpServer1.URL
+	c1.FederatedTopics = []*FederatedTopic{{Topic: "global-alerts", RemoteURL: httpServer2.URL + "/global-alerts"}}
+	s1 = newTestServer(t, c1)
+	c2 := newTestConfig(t)
+	c2.BaseURL = httpServer2.URL
+	c2.FederatedTopics = []*FederatedTopic{{Topic: "global-alerts", RemoteURL: httpServer1.URL + "/global-alerts"}}
+	s2 = newTestServer(t, c2)
+
+	response := request(t, s1, "PUT", "/global-alerts", "datacenter 1 is on fire", map[string]string{
+		"Title":    "Fire in DC1 🔥",
+		"Priority": "5",
+		"Tags":     "fire,warning",
+		"Click":    "https://status.example.com",
+		"Actions":  "view, Status, https://status.example.com",
+		"Markdown": "yes",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	var forwarded []*message
+	waitFor(t, func() bool {
+		response := request(t, s2, "GET", "/global-alerts/json?poll=1", "", nil)
+		forwarded = toMessages(t, response.Body.String())
+		return len(forwarded) == 1
+	})
+	require.Equal(t, m.ID, forwarded[0].ID)
+	require.Equal(t, "datacenter 1 is on fire", forwarded[0].Message)
+	require.Equal(t, "Fire in DC1 🔥", forwarded[0].Title)
+	require.Equal(t, 5, forwarded[0].Priority)
+	require.Equal(t, []string{"fire", "warning"}, forwarded[0].Tags)
+	require.Equal(t, "https://status.example.com", forwarded[0].Click)
+	require.Equal(t, 1, len(forwarded[0].Actions))
+	require.Equal(t, "Status", forwarded[0].Actions[0].Label)
+	require.Equal(t, "text/markdown", forwarded[0].ContentType)
+
+	// Server 2 does not echo the message back to server 1
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(1), s2Requests.Load())
+	require.Equal(t, int32(0), s1Requests.Load())
+
+	// Other topics are not forwarded
+	response = request(t, s1, "PUT", "/local-alerts", "local only", nil)
+	require.Equal(t, 200, response.Code)
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(1), s2Requests.Load())
+}
+
+func TestServer_Federation_RetriesFailedRequests(t *testing.T) {
+	var attempts atomic.Int32
+	var forwardedBy, authorization atomic.Pointer[string]
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		forwardedBy.Store(util.String(r.Header.Get("X-Forwarded-By")))
+		authorization.Store(util.String(r.Header.Get("Authorization")))
+	}))
+	defer remoteServer.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://dc1.internal"
+	c.FederationRetryDelay = 10 * time.Millisecond
+	c.FederatedTopics = []*FederatedTopic{{Topic: "global-alerts", RemoteURL: remoteServer.URL + "/global-alerts", Token: "tk_remote"}}
+	s := newTestServer(t, c)
+
+	start := time.Now()
+	response := request(t, s, "PUT", "/global-alerts", "datacenter 1 is on fire", nil)
+	require.Equal(t, 200, response.Code)
+	require.Less(t, time.Since(start), time.Second) // Forwarding does not block the publisher
+	waitFor(t, func() bool {
+		return attempts.Load() == 3 && authorization.Load() != nil
+	})
+	require.Equal(t, "http://dc1.internal", *forwardedBy.Load())
+	require.Equal(t, "Bearer tk_remote", *authorization.Load())
+}
+
+func TestServer_Federation_MessageHeaders(t *testing.T) {
+	var headers atomic.Pointer[http.Header]
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers.Store(&r.Header)
+	}))
+	defer remoteServer.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://dc1.internal"
+	c.FederationMessageHeaders = true
+	c.FederatedTopics = []*FederatedTopic{{Topic: "global-alerts", RemoteURL: remoteServer.URL + "/global-alerts"}}
+	s := newTestServer(t, c)
+
+	// Title and tags with CR/LF must not inject headers
+	response := request(t, s, "PUT", "/", `{"topic":"global-alerts","message":"datacenter 1 is on fire","title":"Fire 🔥\r\nX-Injected: yes","tags":["fire","warn\ning"],"priority":5}`, nil)
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return headers.Load() != nil
+	})
+	h := *headers.Load()
+	require.Equal(t, "5", h.Get("X-Ntfy-Priority"))
+	require.Equal(t, "fire,warn ing", h.Get("X-Ntfy-Tags"))
+	require.Equal(t, "Fire 🔥  X-Injected: yes", h.Get("X-Ntfy-Title"))
+	require.Equal(t, "", h.Get("X-Injected"))
+
+	// Default priority is sent explicitly, title and tags are omitted if empty
+	headers.Store(nil)
+	response = request(t, s, "PUT", "/global-alerts", "no title", nil)
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return headers.Load() != nil
+	})
+	h = *headers.Load()
+	require.Equal(t, "3", h.Get("X-Ntfy-Priority"))
+	require.Empty(t, h.Values("X-Ntfy-Tags"))
+	require.Empty(t, h.Values("X-Ntfy-Title"))
+}
+
+func TestServer_Federation_NoMessageHeadersByDefault(t *testing.T) {
+	var headers atomic.Pointer[http.Header]
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers.Store(&r.Header)
+	}))
+	defer remoteServer.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://dc1.internal"
+	c.FederatedTopics = []*FederatedTopic{{Topic: "global-alerts", RemoteURL: remoteServer.URL + "/global-alerts"}}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/global-alerts", "datacenter 1 is on fire", map[string]string{
+		"Title": "Fire",
+		"Tags":  "fire",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return headers.Load() != nil
+	})
+	h := *headers.Load()
+	require.Equal(t, "Fire", h.Get("X-Title"))
+	require.Empty(t, h.Values("X-Ntfy-Priority"))
+	require.Empty(t, h.Values("X-Ntfy-Tags"))
+	require.Empty(t, h.Values("X-Ntfy-Title"))
+}
+
+func TestServer_Federation_NoRetryOnClientError(t *testing.T) {
+	var attempts atomic.Int32
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer remoteServer.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://dc1.internal"
+	c.FederationRetryDelay = 10 * time.Millisecond
+	c.FederatedTopics = []*FederatedTopic{{Topic: "global-alerts", RemoteURL: remoteServer.URL + "/global-alerts"}}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/global-alerts", "datacenter 1 is on fire", nil)
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return attempts.Load() == 1
+	})
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(1), attempts.Load())
+}
+
+func TestServer_Federation_NotForwardedIfAlreadyForwardedByThisServer(t *testing.T) {
+	var attempts atomic.Int32
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+	}))
+	defer remoteServer.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://dc1.internal"
+	c.FederatedTopics = []*FederatedTopic{{Topic: "global-alerts", RemoteURL: remoteServer.URL + "/global-alerts"}}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/global-alerts", "loop", map[string]string{
+		"X-Forwarded-By": "http://dc2.internal, http://dc1.internal",
+	})
+	require.Equal(t, 200, response.Code)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(0), attempts.Load())
+}
+
+func TestServer_Federation_RedactsForwardedMessage(t *testing.T) {
+	var s2 *Server
+	httpServer2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s2.handle(w, r)
+	}))
+	defer httpServer2.Close()
+	s2 = newTestServer(t, newTestConfig(t))
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://dc1.internal"
+	c.RedactPatterns = []*regexp.Regexp{regexp.MustCompile(`password=\S+`)}
+	c.FederatedTopics = []*FederatedTopic{{Topic: "global-alerts", RemoteURL: httpServer2.URL + "/global-alerts"}}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/global-alerts", "login with password=hunter2 failed", map[string]string{
+		"Title": "password=hunter2",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "login with password=hunter2 failed", toMessage(t, response.Body.String()).Message)
+
+	// Local subscribers see the original message, the remote server only the redacted one
+	response = request(t, s, "GET", "/global-alerts/json?poll=1", "", nil)
+	require.Equal(t, "login with password=hunter2 failed", toMessages(t, response.Body.String())[0].Message)
+	var forwarded []*message
+	waitFor(t, func() bool {
+		response := request(t, s2, "GET", "/global-alerts/json?poll=1", "", nil)
+		forwarded = toMessages(t, response.Body.String())
+		return len(forwarded) == 1
+	})
+	require.Equal(t, "login with [redacted] failed", forwarded[0].Message)
+	require.Equal(t, "[redacted]", forwarded[0].Title)
+}
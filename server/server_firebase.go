@@ -10,12 +10,18 @@ import (
 	"google.golang.org/api/option"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"regexp"
 	"strings"
 )
 
 const (
 	fcmMessageLimit         = 4000
 	fcmApnsBodyMessageLimit = 100
+
+	// FirebasePriorityHigh and FirebasePriorityNormal are the Android (FCM) message priorities, see
+	// https://firebase.google.com/docs/cloud-messaging/android/message-priority
+	FirebasePriorityHigh   = "high"
+	FirebasePriorityNormal = "normal"
 )
 
 var (
@@ -23,17 +29,30 @@ var (
 	errFirebaseTemporarilyBanned = errors.New("visitor temporarily banned from using Firebase")
 )
 
+// FirebasePriorityRoute maps a range of message priorities to provider-specific delivery options, so that e.g.
+// urgent messages are delivered immediately, while low priority messages may be batched by FCM and APNs.
+type FirebasePriorityRoute struct {
+	MinPriority  int    // Lowest message priority this route applies to (1-5)
+	MaxPriority  int    // Highest message priority this route applies to (1-5)
+	FCMPriority  string // Android message priority, FirebasePriorityHigh or FirebasePriorityNormal
+	APNSPriority string // APNs priority ("10" = immediately, "5" = power-considerate, "1" = prioritize power), empty to not set
+}
+
 // firebaseClient is a generic client that formats and sends messages to Firebase.
 // The actual Firebase implementation is implemented in firebaseSenderImpl, to make it testable.
 type firebaseClient struct {
 	sender firebaseSender
 	auther user.Auther
+	redact []*regexp.Regexp         // Redact patterns, only applied to the trace log
+	routes []*FirebasePriorityRoute // Priority routes, if empty priorities >= 4 are sent with high priority
 }
 
-func newFirebaseClient(sender firebaseSender, auther user.Auther) *firebaseClient {
+func newFirebaseClient(sender firebaseSender, auther user.Auther, redact []*regexp.Regexp, routes []*FirebasePriorityRoute) *firebaseClient {
 	return &firebaseClient{
 		sender: sender,
 		auther: auther,
+		redact: redact,
+		routes: routes,
 	}
 }
 
@@ -41,13 +60,17 @@ func (c *firebaseClient) Send(v *visitor, m *message) error {
 	if !v.FirebaseAllowed() {
 		return errFirebaseTemporarilyBanned
 	}
-	fbm, err := toFirebaseMessage(m, c.auther)
+	fbm, err := toFirebaseMessage(m, c.auther, c.routes)
 	if err != nil {
 		return err
 	}
 	ev := logvm(v, m).Tag(tagFirebase)
 	if ev.IsTrace() {
-		ev.Field("firebase_message", util.MaybeMarshalJSON(fbm)).Trace("Firebase message")
+		redacted, err := toFirebaseMessage(redactMessage(m, c.redact), c.auther, c.routes)
+		if err != nil {
+			return err
+		}
+		ev.Field("firebase_message", util.MaybeMarshalJSON(redacted)).Trace("Firebase message")
 	}
 	err = c.sender.Send(fbm)
 	if err == errFirebaseQuotaExceeded {
@@ -115,7 +138,10 @@ func (c *firebaseSenderImpl) Send(m *messaging.Message) error {
 //     On Android, this will trigger the app to poll the topic and thereby displaying new messages.
 //   - If UpstreamBaseURL is set, messages are forwarded as poll requests to an upstream server and then forwarded
 //     to Firebase here. This is mainly for iOS to support self-hosted servers.
-func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, error) {
+//
+// The FCM and APNs priority of messages is determined by the first matching priority route (see FirebasePriorityRoute).
+// If no route matches, messages with priority >= 4 are sent with high priority on Android.
+func toFirebaseMessage(m *message, auther user.Auther, routes []*FirebasePriorityRoute) (*messaging.Message, error) {
 	var data map[string]string // Mostly matches https://ntfy.sh/docs/subscribe/api/#json-message-format
 	var apnsConfig *messaging.APNSConfig
 	switch m.Event {
@@ -164,12 +190,32 @@ func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, erro
 				}
 				data["actions"] = string(actions)
 			}
+			if len(m.Data) > 0 {
+				messageData, err := json.Marshal(m.Data)
+				if err != nil {
+					return nil, err
+				}
+				data["data"] = string(messageData)
+			}
+			if m.Location != nil {
+				location, err := json.Marshal(m.Location)
+				if err != nil {
+					return nil, err
+				}
+				data["location"] = string(location)
+			}
+			if m.CollapseKey != "" {
+				data["collapse_key"] = m.CollapseKey
+			}
 			if m.Attachment != nil {
 				data["attachment_name"] = m.Attachment.Name
 				data["attachment_type"] = m.Attachment.Type
 				data["attachment_size"] = fmt.Sprintf("%d", m.Attachment.Size)
 				data["attachment_expires"] = fmt.Sprintf("%d", m.Attachment.Expires)
 				data["attachment_url"] = m.Attachment.URL
+				if m.Attachment.Encryption != "" {
+					data["attachment_encryption"] = m.Attachment.Encryption
+				}
 			}
 			apnsConfig = createAPNSAlertConfig(m, data)
 		} else {
@@ -185,9 +231,19 @@ func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, erro
 		}
 	}
 	var androidConfig *messaging.AndroidConfig
-	if m.Priority >= 4 {
+	if route := firebasePriorityRoute(routes, m); route != nil {
+		androidConfig = &messaging.AndroidConfig{
+			Priority: route.FCMPriority,
+		}
+		if apnsConfig != nil && route.APNSPriority != "" {
+			apnsConfig.Headers = map[string]string{
+				"apns-push-type": "alert",
+				"apns-priority":  route.APNSPriority,
+			}
+		}
+	} else if m.Priority >= 4 {
 		androidConfig = &messaging.AndroidConfig{
-			Priority: "high",
+			Priority: FirebasePriorityHigh,
 		}
 	}
 	return maybeTruncateFCMMessage(&messaging.Message{
@@ -198,6 +254,24 @@ func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, erro
 	}), nil
 }
 
+// firebasePriorityRoute returns the first priority route matching the message priority, or nil if none matches.
+// Only messages are routed; keepalive and poll request messages keep their delivery options.
+func firebasePriorityRoute(routes []*FirebasePriorityRoute, m *message) *FirebasePriorityRoute {
+	if m.Event != messageEvent {
+		return nil
+	}
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3 // Not set means default priority
+	}
+	for _, route := range routes {
+		if priority >= route.MinPriority && priority <= route.MaxPriority {
+			return route
+		}
+	}
+	return nil
+}
+
 // maybeTruncateFCMMessage performs best-effort truncation of FCM messages.
 // The docs say the limit is 4000 characters, but during testing it wasn't quite clear
 // what fields matter; so we're just capping the serialized JSON to 4000 bytes.
@@ -62,7 +62,7 @@ func (s *testFirebaseSender) Messages() []*messaging.Message {
 
 func TestToFirebaseMessage_Keepalive(t *testing.T) {
 	m := newKeepaliveMessage("mytopic")
-	fbm, err := toFirebaseMessage(m, nil)
+	fbm, err := toFirebaseMessage(m, nil, nil)
 	require.Nil(t, err)
 	require.Equal(t, "mytopic", fbm.Topic)
 	require.Nil(t, fbm.Android)
@@ -93,7 +93,7 @@ func TestToFirebaseMessage_Keepalive(t *testing.T) {
 
 func TestToFirebaseMessage_Open(t *testing.T) {
 	m := newOpenMessage("mytopic")
-	fbm, err := toFirebaseMessage(m, nil)
+	fbm, err := toFirebaseMessage(m, nil, nil)
 	require.Nil(t, err)
 	require.Equal(t, "mytopic", fbm.Topic)
 	require.Nil(t, fbm.Android)
@@ -155,7 +155,7 @@ func TestToFirebaseMessage_Message_Normal_Allowed(t *testing.T) {
 		Expires: 98765543,
 		URL:     "https://example.com/file.jpg",
 	}
-	fbm, err := toFirebaseMessage(m, &testAuther{Allow: true})
+	fbm, err := toFirebaseMessage(m, &testAuther{Allow: true}, nil)
 	require.Nil(t, err)
 	require.Equal(t, "mytopic", fbm.Topic)
 	require.Equal(t, &messaging.AndroidConfig{
@@ -217,7 +217,7 @@ func TestToFirebaseMessage_Message_Normal_Allowed(t *testing.T) {
 func TestToFirebaseMessage_Message_Normal_Not_Allowed(t *testing.T) {
 	m := newDefaultMessage("mytopic", "this is a message")
 	m.Priority = 5
-	fbm, err := toFirebaseMessage(m, &testAuther{Allow: false}) // Not allowed!
+	fbm, err := toFirebaseMessage(m, &testAuther{Allow: false}, nil) // Not allowed!
 	require.Nil(t, err)
 	require.Equal(t, "mytopic", fbm.Topic)
 	require.Equal(t, &messaging.AndroidConfig{
@@ -233,9 +233,59 @@ func TestToFirebaseMessage_Message_Normal_Not_Allowed(t *testing.T) {
 	}, fbm.Data)
 }
 
+func TestToFirebaseMessage_PriorityRoutes(t *testing.T) {
+	routes := []*FirebasePriorityRoute{
+		{MinPriority: 5, MaxPriority: 5, FCMPriority: FirebasePriorityHigh, APNSPriority: "10"},
+		{MinPriority: 1, MaxPriority: 3, FCMPriority: FirebasePriorityNormal, APNSPriority: "5"},
+	}
+
+	m := newDefaultMessage("mytopic", "server is on fire")
+	m.Priority = 5
+	fbm, err := toFirebaseMessage(m, nil, routes)
+	require.Nil(t, err)
+	require.Equal(t, &messaging.AndroidConfig{Priority: "high"}, fbm.Android)
+	require.Equal(t, map[string]string{"apns-push-type": "alert", "apns-priority": "10"}, fbm.APNS.Headers)
+
+	m = newDefaultMessage("mytopic", "backup finished")
+	m.Priority = 1
+	fbm, err = toFirebaseMessage(m, nil, routes)
+	require.Nil(t, err)
+	require.Equal(t, &messaging.AndroidConfig{Priority: "normal"}, fbm.Android)
+	require.Equal(t, map[string]string{"apns-push-type": "alert", "apns-priority": "5"}, fbm.APNS.Headers)
+
+	// Default priority (not set) matches the 1-3 route
+	m = newDefaultMessage("mytopic", "hi")
+	fbm, err = toFirebaseMessage(m, nil, routes)
+	require.Nil(t, err)
+	require.Equal(t, &messaging.AndroidConfig{Priority: "normal"}, fbm.Android)
+
+	// No matching route, falls back to high priority for priority >= 4
+	m = newDefaultMessage("mytopic", "disk almost full")
+	m.Priority = 4
+	fbm, err = toFirebaseMessage(m, nil, routes)
+	require.Nil(t, err)
+	require.Equal(t, &messaging.AndroidConfig{Priority: "high"}, fbm.Android)
+	require.Nil(t, fbm.APNS.Headers)
+
+	// Keepalive messages are not routed
+	m = newKeepaliveMessage("mytopic")
+	fbm, err = toFirebaseMessage(m, nil, routes)
+	require.Nil(t, err)
+	require.Nil(t, fbm.Android)
+	require.Equal(t, "background", fbm.APNS.Headers["apns-push-type"])
+
+	// Poll request messages are not routed either
+	m = newPollRequestMessage("mytopic", "fOv6k1QbCzo6")
+	m.Priority = 1
+	fbm, err = toFirebaseMessage(m, nil, routes)
+	require.Nil(t, err)
+	require.Nil(t, fbm.Android)
+	require.Nil(t, fbm.APNS.Headers)
+}
+
 func TestToFirebaseMessage_PollRequest(t *testing.T) {
 	m := newPollRequestMessage("mytopic", "fOv6k1QbCzo6")
-	fbm, err := toFirebaseMessage(m, nil)
+	fbm, err := toFirebaseMessage(m, nil, nil)
 	require.Nil(t, err)
 	require.Equal(t, "mytopic", fbm.Topic)
 	require.Nil(t, fbm.Android)
@@ -327,7 +377,7 @@ func TestMaybeTruncateFCMMessage_NotTooLong(t *testing.T) {
 
 func TestToFirebaseSender_Abuse(t *testing.T) {
 	sender := &testFirebaseSender{allowed: 2}
-	client := newFirebaseClient(sender, &testAuther{})
+	client := newFirebaseClient(sender, &testAuther{}, nil, nil)
 	visitor := newVisitor(newTestConfig(t), newMemTestCache(t), nil, netip.MustParseAddr("1.2.3.4"), nil)
 
 	require.Nil(t, client.Send(visitor, &message{Topic: "mytopic"}))
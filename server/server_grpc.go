@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"heckel.io/ntfy/v2/server/ntfypb"
+)
+
+const (
+	tagGRPC = "grpc"
+)
+
+// grpcService implements the gRPC API (see ntfypb/ntfy.proto). RPCs are translated to HTTP requests, which are
+// passed through the same handlers as the HTTP API, so authentication, rate limiting, access control and filters
+// behave exactly the same. Only the encoding of the messages differs.
+type grpcService struct {
+	ntfypb.UnimplementedNtfyServer
+	s *Server
+}
+
+// newGRPCServer creates the gRPC server. If a key and cert file are configured, the server uses TLS.
+func newGRPCServer(s *Server) (*grpc.Server, error) {
+	var options []grpc.ServerOption
+	if s.config.CertFile != "" && s.config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	}
+	grpcServer := grpc.NewServer(options...)
+	ntfypb.RegisterNtfyServer(grpcServer, &grpcService{s: s})
+	return grpcServer, nil
+}
+
+// Publish publishes a message, like publishing as JSON (see transformBodyJSON)
+func (g *grpcService) Publish(ctx context.Context, req *ntfypb.PublishRequest) (*ntfypb.Message, error) {
+	body, err := json.Marshal(newPublishMessageFromProto(req))
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	r, err := newRequestFromGRPC(ctx, http.MethodPost, "/", bytes.NewReader(body))
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	if req.Cron != "" {
+		r.Header.Set("X-Cron", req.Cron)
+	}
+	var m *message
+	publish := func(_ http.ResponseWriter, r *http.Request, v *visitor) error {
+		var err error
+		if m, err = g.s.handlePublishInternal(r, v); err != nil {
+			minc(metricMessagesPublishedFailure)
+			return err
+		}
+		minc(metricMessagesPublishedSuccess)
+		return nil
+	}
+	if err := g.handle(r, g.s.transformBodyJSON(g.s.limitRequestsWithTopic(g.s.authorizeTopicWrite(publish)))); err != nil {
+		return nil, err
+	}
+	return toProtoMessage(m), nil
+}
+
+// Subscribe streams the messages of one or more topics, like the JSON stream (see handleSubscribeHTTP)
+func (g *grpcService) Subscribe(req *ntfypb.SubscribeRequest, stream ntfypb.Ntfy_SubscribeServer) error {
+	if len(req.Topics) == 0 {
+		return toGRPCError(errHTTPBadRequestTopicInvalid)
+	}
+	for _, t := range req.Topics {
+		if !topicRegex.MatchString(t) {
+			return toGRPCError(errHTTPBadRequestTopicInvalid)
+		}
+	}
+	query := url.Values{}
+	if req.Since != "" {
+		query.Set("since", req.Since)
+	}
+	if req.Poll {
+		query.Set("poll", "1")
+	}
+	if req.Scheduled {
+		query.Set("scheduled", "1")
+	}
+	if req.Id != "" {
+		query.Set("id", req.Id)
+	}
+	if req.Message != "" {
+		query.Set("message", req.Message)
+	}
+	if req.Title != "" {
+		query.Set("title", req.Title)
+	}
+	if len(req.Tags) > 0 {
+		query.Set("tags", strings.Join(req.Tags, ","))
+	}
+	if len(req.Priority) > 0 {
+		query.Set("priority", strings.Join(req.Priority, ","))
+	}
+	r, err := newRequestFromGRPC(stream.Context(), http.MethodGet, "/"+strings.Join(req.Topics, ",")+"/json?"+query.Encode(), nil)
+	if err != nil {
+		return toGRPCError(err)
+	}
+	subscribe := func(_ http.ResponseWriter, r *http.Request, v *visitor) error {
+		return g.s.handleSubscribeGRPC(r, v, stream)
+	}
+	return g.handle(r, g.s.limitRequests(g.s.authorizeTopicRead(subscribe)))
+}
+
+// handle authenticates the visitor (like Server.handle), and calls the handler chain. Handlers used via gRPC
+// must not write to the http.ResponseWriter, since there is none.
+func (g *grpcService) handle(r *http.Request, next handleFunc) error {
+	v, err := g.s.maybeAuthenticate(r) // Note: Always returns v, even when error is returned
+	if err == nil && g.s.draining.Load() {
+		err = errHTTPServiceUnavailableShuttingDown
+	}
+	if err == nil {
+		err = next(nil, r, v)
+	}
+	if err != nil {
+		logvr(v, r).Tag(tagGRPC).Err(err).Debug("gRPC request failed")
+		return toGRPCError(err)
+	}
+	return nil
+}
+
+// handleSubscribeGRPC is the gRPC equivalent of handleSubscribeHTTP
+func (s *Server) handleSubscribeGRPC(r *http.Request, v *visitor, stream ntfypb.Ntfy_SubscribeServer) error {
+	logvr(v, r).Tag(tagGRPC).Debug("gRPC stream opened")
+	defer logvr(v, r).Tag(tagGRPC).Debug("gRPC stream closed")
+	if !v.SubscriptionAllowed() {
+		return errHTTPTooManyRequestsLimitSubscriptions
+	}
+	defer v.RemoveSubscription()
+	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	poll, since, scheduled, filters, err := parseSubscribeParams(r, s.defaultFilters)
+	if err != nil {
+		return err
+	}
+	var wlock sync.Mutex
+	sub := func(v *visitor, msg *message) error {
+		if !filters.Pass(msg) {
+			return errMessageNotDelivered
+		}
+		wlock.Lock()
+		defer wlock.Unlock()
+		return stream.Send(toProtoMessage(msg)) // Inside the lock, since Send must not be called concurrently
+	}
+	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
+		return err
+	}
+	if poll {
+		for _, t := range topics {
+			t.Keepalive()
+		}
+		return s.sendOldMessages(topics, since, scheduled, true, v, sub)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscriberIDs := make([]int, 0)
+	for _, t := range topics {
+		subscriberIDs = append(subscriberIDs, t.Subscribe(sub, newSubscriberInfo(v, "grpc"), cancel))
+	}
+	defer func() {
+		for i, subscriberID := range subscriberIDs {
+			topics[i].Unsubscribe(subscriberID) // Order!
+		}
+	}()
+	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
+		return err
+	}
+	if err := s.sendOldMessages(topics, since, scheduled, false, v, sub); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.Context().Done():
+			return nil
+		case <-s.drainChan:
+			return sub(v, newShutdownMessage(topicsStr, s.shutdownRetryAfter()))
+		case <-time.After(s.keepaliveInterval()):
+			logvr(v, r).Tag(tagGRPC).Trace("Sending keepalive message to %s", topicsStr)
+			v.Keepalive()
+			for _, t := range topics {
+				t.Keepalive()
+			}
+			if err := sub(v, newKeepaliveMessage(topicsStr)); err != nil { // Send keepalive message
+				return err
+			}
+		}
+	}
+}
+
+// newRequestFromGRPC creates an HTTP request from the context of a gRPC call. The remote address is taken from the
+// peer, and the "authorization" metadata key is passed on as header. Credentials are only accepted over TLS, so
+// they are never sent in plain text.
+func newRequestFromGRPC(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := peer.FromContext(ctx)
+	if ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			if p == nil || p.AuthInfo == nil || p.AuthInfo.AuthType() != "tls" {
+				return nil, errHTTPUnauthorizedTLSRequired
+			}
+			r.Header.Set("authorization", values[0])
+		}
+	}
+	return r, nil
+}
+
+// toGRPCError converts an error to a gRPC status error. The message of the status is the JSON representation
+// of the errHTTP, so clients have access to the ntfy error code.
+func toGRPCError(err error) error {
+	var e *errHTTP
+	if !errors.As(err, &e) {
+		e = errHTTPInternalError
+	}
+	code := codes.Internal
+	switch e.HTTPCode {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, e.JSON())
+}
+
+func newPublishMessageFromProto(req *ntfypb.PublishRequest) *publishMessage {
+	actions := make([]action, 0, len(req.Actions))
+	for _, a := range req.Actions {
+		actions = append(actions, action{
+			ID:      a.Id,
+			Action:  a.Action,
+			Label:   a.Label,
+			Clear:   a.Clear,
+			URL:     a.Url,
+			Method:  a.Method,
+			Headers: a.Headers,
+			Body:    a.Body,
+			Intent:  a.Intent,
+			Extras:  a.Extras,
+		})
+	}
+	return &publishMessage{
+		Topic:     req.Topic,
+		ID:        req.Id,
+		Title:     req.Title,
+		Message:   req.Message,
+		Priority:  int(req.Priority),
+		Tags:      req.Tags,
+		Click:     req.Click,
+		Icon:      req.Icon,
+		Actions:   actions,
+		Attach:    req.Attach,
+		Markdown:  req.Markdown,
+		Data:      req.Data,
+		DataTable: req.DataTable,
+		Filename:  req.Filename,
+		Email:     req.Email,
+		Call:      req.Call,
+		Delay:     req.Delay,
+	}
+}
+
+func toProtoMessage(m *message) *ntfypb.Message {
+	actions := make([]*ntfypb.Action, 0, len(m.Actions))
+	for _, a := range m.Actions {
+		actions = append(actions, &ntfypb.Action{
+			Id:      a.ID,
+			Action:  a.Action,
+			Label:   a.Label,
+			Clear:   a.Clear,
+			Url:     a.URL,
+			Method:  a.Method,
+			Headers: a.Headers,
+			Body:    a.Body,
+			Intent:  a.Intent,
+			Extras:  a.Extras,
+		})
+	}
+	var att *ntfypb.Attachment
+	if m.Attachment != nil {
+		att = &ntfypb.Attachment{
+			Name:    m.Attachment.Name,
+			Type:    m.Attachment.Type,
+			Size:    m.Attachment.Size,
+			Expires: m.Attachment.Expires,
+			Url:     m.Attachment.URL,
+		}
+	}
+	var loc *ntfypb.Location
+	if m.Location != nil {
+		loc = &ntfypb.Location{
+			Lat:   m.Location.Latitude,
+			Lon:   m.Location.Longitude,
+			Label: m.Location.Label,
+		}
+	}
+	return &ntfypb.Message{
+		Id:          m.ID,
+		Time:        m.Time,
+		Expires:     m.Expires,
+		Event:       m.Event,
+		Topic:       m.Topic,
+		Title:       m.Title,
+		Message:     m.Message,
+		Priority:    int32(m.Priority),
+		Tags:        m.Tags,
+		Click:       m.Click,
+		Icon:        m.Icon,
+		Actions:     actions,
+		Data:        m.Data,
+		Schedule:    m.Schedule,
+		Attachment:  att,
+		PollId:      m.PollID,
+		ContentType: m.ContentType,
+		Encoding:    m.Encoding,
+		Location:    loc,
+	}
+}
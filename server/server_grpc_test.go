@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"heckel.io/ntfy/v2/server/ntfypb"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_GRPC_PublishAndSubscribe(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	client := newTestGRPCClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Subscribe(ctx, &ntfypb.SubscribeRequest{Topics: []string{"mytopic", "othertopic"}})
+	require.Nil(t, err)
+	open, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, openEvent, open.Event)
+	require.Equal(t, "mytopic,othertopic", open.Topic)
+
+	m, err := client.Publish(ctx, &ntfypb.PublishRequest{
+		Topic:    "mytopic",
+		Title:    "Disk alert",
+		Message:  "Disk is full",
+		Priority: 4,
+		Tags:     []string{"warning", "disk"},
+		Actions:  []*ntfypb.Action{{Action: "view", Label: "Open", Url: "https://example.com"}},
+		Data:     map[string]string{"disk": "99%"},
+	})
+	require.Nil(t, err)
+	require.NotEmpty(t, m.Id)
+	require.Equal(t, messageEvent, m.Event)
+	require.Equal(t, "Disk alert", m.Title)
+
+	received, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, m.Id, received.Id)
+	require.Equal(t, "mytopic", received.Topic)
+	require.Equal(t, "Disk is full", received.Message)
+	require.Equal(t, int32(4), received.Priority)
+	require.Equal(t, []string{"warning", "disk"}, received.Tags)
+	require.Equal(t, "https://example.com", received.Actions[0].Url)
+	require.Equal(t, map[string]string{"disk": "99%"}, received.Data)
+
+	// Message published via gRPC is cached like any other message
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, m.Id, toMessage(t, response.Body.String()).ID)
+}
+
+func TestServer_GRPC_SubscribePollWithFilters(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	client := newTestGRPCClient(t, s)
+
+	request(t, s, "PUT", "/mytopic", "low", map[string]string{"Priority": "low"})
+	request(t, s, "PUT", "/mytopic", "urgent", map[string]string{"Priority": "urgent", "Tags": "fire"})
+	request(t, s, "PUT", "/mytopic", "urgent without tag", map[string]string{"Priority": "urgent"})
+
+	stream, err := client.Subscribe(context.Background(), &ntfypb.SubscribeRequest{
+		Topics:   []string{"mytopic"},
+		Poll:     true,
+		Priority: []string{"high", "urgent"},
+		Tags:     []string{"fire"},
+	})
+	require.Nil(t, err)
+	m, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, "urgent", m.Message)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err) // Stream ends after cached messages, since poll is set
+}
+
+func TestServer_GRPC_SubscribeWithLocation(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	client := newTestGRPCClient(t, s)
+
+	request(t, s, "PUT", "/mytopic", "pump failure", map[string]string{"Location": "52.52,13.405,Pump station 7"})
+	request(t, s, "PUT", "/mytopic", "no location", nil)
+
+	stream, err := client.Subscribe(context.Background(), &ntfypb.SubscribeRequest{
+		Topics: []string{"mytopic"},
+		Poll:   true,
+	})
+	require.Nil(t, err)
+	m, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, 52.52, m.Location.Lat)
+	require.Equal(t, 13.405, m.Location.Lon)
+	require.Equal(t, "Pump station 7", m.Location.Label)
+	m, err = stream.Recv()
+	require.Nil(t, err)
+	require.Nil(t, m.Location)
+}
+
+func TestServer_GRPC_Auth(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.CertFile, c.KeyFile = newTestCertificate(t)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), "")
+	require.Nil(t, err)
+	client := newTestGRPCClient(t, s)
+
+	// Anonymous
+	_, err = client.Publish(context.Background(), &ntfypb.PublishRequest{Topic: "mytopic", Message: "hi"})
+	requireGRPCError(t, err, codes.PermissionDenied, 40301)
+
+	// Invalid token
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer tk_invalid")
+	_, err = client.Publish(ctx, &ntfypb.PublishRequest{Topic: "mytopic", Message: "hi"})
+	requireGRPCError(t, err, codes.Unauthenticated, 40101)
+
+	// Token, and basic auth
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token.Value)
+	m, err := client.Publish(ctx, &ntfypb.PublishRequest{Topic: "mytopic", Message: "hi"})
+	require.Nil(t, err)
+	require.Equal(t, "hi", m.Message)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", util.BasicAuth("phil", "phil"))
+	stream, err := client.Subscribe(ctx, &ntfypb.SubscribeRequest{Topics: []string{"mytopic"}, Poll: true, Since: "all"})
+	require.Nil(t, err)
+	m, err = stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, "hi", m.Message)
+
+	// No access to other topic
+	stream, err = client.Subscribe(ctx, &ntfypb.SubscribeRequest{Topics: []string{"mytopic", "secret"}, Poll: true})
+	require.Nil(t, err)
+	_, err = stream.Recv()
+	requireGRPCError(t, err, codes.PermissionDenied, 40301)
+}
+
+func TestServer_GRPC_Auth_RequiresTLS(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	client := newTestGRPCClient(t, s)
+
+	// Credentials are refused on a plaintext connection
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", util.BasicAuth("phil", "phil"))
+	_, err := client.Publish(ctx, &ntfypb.PublishRequest{Topic: "mytopic", Message: "hi"})
+	requireGRPCError(t, err, codes.Unauthenticated, 40103)
+
+	// Anonymous access still works
+	m, err := client.Publish(context.Background(), &ntfypb.PublishRequest{Topic: "mytopic", Message: "hi"})
+	require.Nil(t, err)
+	require.Equal(t, "hi", m.Message)
+}
+
+func TestServer_GRPC_IgnoresForwardedFor(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	client := newTestGRPCClient(t, s)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-forwarded-for", "1.2.3.4")
+	_, err := client.Publish(ctx, &ntfypb.PublishRequest{Topic: "mytopic", Message: "hi"})
+	require.Nil(t, err)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	require.Nil(t, s.visitors["ip:1.2.3.4"])
+	require.NotNil(t, s.visitors["ip:127.0.0.1"])
+}
+
+func TestServer_GRPC_Errors(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 3
+	s := newTestServer(t, c)
+	client := newTestGRPCClient(t, s)
+
+	_, err := client.Publish(context.Background(), &ntfypb.PublishRequest{Topic: "invalid topic"})
+	requireGRPCError(t, err, codes.InvalidArgument, 40009)
+
+	_, err = client.Publish(context.Background(), &ntfypb.PublishRequest{Topic: "mytopic", Delay: "invalid"})
+	requireGRPCError(t, err, codes.InvalidArgument, 40004)
+
+	for i := 0; i < 2; i++ { // The invalid delay counts as well
+		_, err = client.Publish(context.Background(), &ntfypb.PublishRequest{Topic: "mytopic", Message: "hi"})
+		require.Nil(t, err)
+	}
+	_, err = client.Publish(context.Background(), &ntfypb.PublishRequest{Topic: "mytopic", Message: "hi"})
+	requireGRPCError(t, err, codes.ResourceExhausted, 42901)
+}
+
+func newTestGRPCClient(t *testing.T, s *Server) ntfypb.NtfyClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	grpcServer, err := newGRPCServer(s)
+	require.Nil(t, err)
+	go grpcServer.Serve(listener)
+	transportCredentials := insecure.NewCredentials()
+	if s.config.CertFile != "" {
+		transportCredentials = credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	}
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(transportCredentials))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		grpcServer.Stop()
+	})
+	return ntfypb.NewNtfyClient(conn)
+}
+
+func requireGRPCError(t *testing.T, err error, code codes.Code, httpErrCode int) {
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, code, st.Code())
+	var e errHTTP
+	require.Nil(t, json.Unmarshal([]byte(st.Message()), &e))
+	require.Equal(t, httpErrCode, e.Code)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	tagIcon = "icon"
+
+	// iconFileIDPrefix marks the file IDs of cached icons. Message IDs only consist of letters and digits, so cached
+	// icons and attachments cannot share the same file ID.
+	iconFileIDPrefix = "_"
+	iconFetchTimeout = 5 * time.Second // The icon is fetched while publishing, so this delays the publish request
+)
+
+// iconContentTypes is the allowlist of icon image types, and the file extension used in the local icon URL. The
+// type is detected from the content, not from the Content-Type header of the icon host. SVG is not allowed,
+// since it may contain scripts.
+var iconContentTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// maybeCacheIcon fetches the message's icon (X-Icon) once, stores it in the attachment store, and rewrites the
+// icon URL to point to the local copy, so that clients do not have to download it from the (possibly slow) icon
+// host. The cached icon is deleted together with the message, so messages that are not cached keep their icon URL.
+//
+// The icon counts towards the publishing visitor's attachment bandwidth and total size limits. If the icon cannot be
+// fetched or stored, the message keeps the original icon URL; the publish request never fails because of the icon.
+func (s *Server) maybeCacheIcon(r *http.Request, v *visitor, m *message) {
+	if s.iconClient == nil || m.Icon == "" || m.Expires == 0 {
+		return
+	}
+	baseURL := s.externalBaseURL(r)
+	if strings.HasPrefix(m.Icon, baseURL+"/file/") {
+		return // Already served by this server, e.g. if the message was forwarded from another server
+	}
+	ev := logvrm(v, r, m).Tag(tagIcon).Field("message_icon", m.Icon)
+	vinfo, err := v.Info()
+	if err != nil {
+		ev.Err(err).Warn("Unable to cache icon, cannot retrieve visitor info")
+		return
+	}
+	icon, ext, err := s.fetchIcon(m.Icon)
+	if err != nil {
+		ev.Err(err).Debug("Unable to cache icon, keeping original icon URL")
+		return
+	}
+	id := iconFileID(m.ID)
+	limiters := []util.Limiter{
+		v.BandwidthLimiter(),
+		util.NewFixedLimiter(vinfo.Stats.AttachmentTotalSizeRemaining),
+	}
+	if _, err := s.fileCache.Write(id, bytes.NewReader(icon), limiters...); err != nil {
+		ev.Err(err).Debug("Unable to store icon, keeping original icon URL")
+		return
+	}
+	ev.Field("icon_size", len(icon)).Debug("Cached icon as %s", id)
+	m.Icon = fmt.Sprintf("%s/file/%s%s", baseURL, id, ext)
+}
+
+// fetchIcon downloads the icon from the given URL (no private IPs, see newPublicHTTPClient), and checks its
+// size and image type. It returns the icon and the file extension matching its type.
+func (s *Server) fetchIcon(iconURL string) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, iconURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	resp, err := s.iconClient.Do(req)
+	if errors.Is(err, errNonPublicIPAddress) {
+		return nil, "", errNonPublicIPAddress
+	} else if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("icon host responded with HTTP %s", resp.Status)
+	}
+	icon, err := io.ReadAll(io.LimitReader(resp.Body, s.config.IconCacheFileSizeLimit+1))
+	if err != nil {
+		return nil, "", err
+	} else if int64(len(icon)) > s.config.IconCacheFileSizeLimit {
+		return nil, "", fmt.Errorf("icon is larger than %d bytes", s.config.IconCacheFileSizeLimit)
+	}
+	contentType := http.DetectContentType(icon)
+	ext, ok := iconContentTypes[contentType]
+	if !ok {
+		return nil, "", fmt.Errorf("icon type %s is not supported", contentType)
+	}
+	return icon, ext, nil
+}
+
+// handleFileIcon serves a cached icon. Unlike attachments, icons are not associated with the uploader's bandwidth,
+// so the bandwidth is counted against the visitor downloading the icon.
+func (s *Server) handleFileIcon(w http.ResponseWriter, r *http.Request, v *visitor, id string) error {
+	f, size, modTime, err := s.fileCache.Read(id)
+	if errors.Is(err, errFileNotFound) || errors.Is(err, errInvalidFileID) {
+		return errHTTPNotFound.Fields(log.Context{
+			"icon_id":       id,
+			"error_context": "filesystem",
+		})
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.setAccessControlAllowOrigin(w)
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		return nil
+	} else if !v.BandwidthAllowed(size) {
+		return errHTTPTooManyRequestsLimitAttachmentBandwidth
+	}
+	contentType, err := detectFileContentType(f, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", modTime, f)
+	return nil
+}
+
+// iconFileIDs returns the file IDs of the cached icons of the given messages, or nothing if icon caching is disabled.
+// Messages without a cached icon are included; removing a file that does not exist is not an error.
+func (s *Server) iconFileIDs(messageIDs ...string) []string {
+	if s.iconClient == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		ids = append(ids, iconFileID(id))
+	}
+	return ids
+}
+
+// iconFileID returns the file ID of the cached icon of a message. The ID is derived from the message ID, which
+// has the same length as all file IDs.
+func iconFileID(messageID string) string {
+	hash := sha256.Sum256([]byte(messageID))
+	return iconFileIDPrefix + base64.RawURLEncoding.EncodeToString(hash[:])[:messageIDLength-len(iconFileIDPrefix)]
+}
+
+func isIconFileID(id string) bool {
+	return strings.HasPrefix(id, iconFileIDPrefix)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var testPNGIcon = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+
+func TestServer_IconCache_CachesAndRewritesIcon(t *testing.T) {
+	var iconRequests atomic.Int32
+	iconServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iconRequests.Add(1)
+		w.Header().Set("Content-Type", "text/plain") // Ignored, type is detected from the content
+		w.Write(testPNGIcon)
+	}))
+	defer iconServer.Close()
+
+	c := newTestConfig(t)
+	c.EnableIconCache = true
+	s := newTestServer(t, c)
+	s.iconClient = http.DefaultClient // The icon server runs on 127.0.0.1
+
+	response := request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+		"Icon": iconServer.URL + "/icon.png",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "http://127.0.0.1:12345/file/"+iconFileID(m.ID)+".png", m.Icon)
+	require.Equal(t, int32(1), iconRequests.Load())
+
+	// Subscribers get the rewritten URL
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, m.Icon, toMessage(t, response.Body.String()).Icon)
+
+	// Icon is served from the file cache, the icon host is not contacted again
+	path := strings.TrimPrefix(m.Icon, "http://127.0.0.1:12345")
+	for i := 0; i < 2; i++ {
+		response = request(t, s, "GET", path, "", nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, "image/png", response.Header().Get("Content-Type"))
+		require.Equal(t, testPNGIcon, response.Body.Bytes())
+	}
+	require.Equal(t, int32(1), iconRequests.Load())
+
+	// Icon is deleted with the message
+	require.Nil(t, s.messageCache.ExpireMessages("mytopic"))
+	s.pruneMessages()
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_IconCache_InvalidIcons(t *testing.T) {
+	iconServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/icon.png":
+			w.Write(testPNGIcon)
+		case "/icon.svg":
+			w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`))
+		case "/large.png":
+			w.Write(append(testPNGIcon, make([]byte, 100)...))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer iconServer.Close()
+
+	c := newTestConfig(t)
+	c.EnableIconCache = true
+	c.IconCacheFileSizeLimit = 100
+	s := newTestServer(t, c)
+	s.iconClient = http.DefaultClient // The icon server runs on 127.0.0.1
+
+	for _, path := range []string{"/icon.svg", "/large.png", "/notfound.png"} {
+		response := request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+			"Icon": iconServer.URL + path,
+		})
+		require.Equal(t, 200, response.Code, path)
+		require.Equal(t, iconServer.URL+path, toMessage(t, response.Body.String()).Icon, path) // Original URL is kept
+	}
+	response := request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+		"Icon": iconServer.URL + "/icon.png",
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_IconCache_NonPublicIPNotAllowed(t *testing.T) {
+	var iconRequests atomic.Int32
+	iconServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iconRequests.Add(1)
+		w.Write(testPNGIcon)
+	}))
+	defer iconServer.Close()
+
+	c := newTestConfig(t)
+	c.EnableIconCache = true
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+		"Icon": iconServer.URL + "/icon.png", // 127.0.0.1
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, iconServer.URL+"/icon.png", toMessage(t, response.Body.String()).Icon)
+	require.Equal(t, int32(0), iconRequests.Load())
+}
+
+func TestServer_IconCache_VisitorLimits(t *testing.T) {
+	iconServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testPNGIcon)
+	}))
+	defer iconServer.Close()
+
+	for _, limit := range []string{"total", "bandwidth"} {
+		c := newTestConfig(t)
+		c.EnableIconCache = true
+		if limit == "total" {
+			c.VisitorAttachmentTotalSizeLimit = 10
+		} else {
+			c.VisitorAttachmentDailyBandwidthLimit = 10
+		}
+		s := newTestServer(t, c)
+		s.iconClient = http.DefaultClient // The icon server runs on 127.0.0.1
+
+		// Icon exceeds the visitor's limit, so it is not cached, but the message is still published
+		response := request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+			"Icon": iconServer.URL + "/icon.png",
+		})
+		require.Equal(t, 200, response.Code, limit)
+		m := toMessage(t, response.Body.String())
+		require.Equal(t, iconServer.URL+"/icon.png", m.Icon, limit)
+		_, _, _, err := s.fileCache.Read(iconFileID(m.ID))
+		require.Equal(t, errFileNotFound, err, limit)
+	}
+}
+
+func TestServer_IconCache_Disabled(t *testing.T) {
+	var iconRequests atomic.Int32
+	iconServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iconRequests.Add(1)
+	}))
+	defer iconServer.Close()
+
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+		"Icon": iconServer.URL + "/icon.png",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, iconServer.URL+"/icon.png", toMessage(t, response.Body.String()).Icon)
+	require.Equal(t, int32(0), iconRequests.Load())
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"encoding/json"
+)
+
+const (
+	tagKafka = "kafka"
+
+	kafkaKeyTopic = "topic" // Record key is the ntfy topic, so all messages of a topic end up in the same partition
+	kafkaKeyID    = "id"    // Record key is the message ID
+)
+
+// sendToKafka produces the message to the configured Kafka topic. The record value is the message in the JSON
+// message format, and the record key is either the ntfy topic or the message ID, see Config.KafkaKey. The record
+// is produced asynchronously, and errors are only logged, since they must not affect local delivery.
+func (s *Server) sendToKafka(v *visitor, m *message) {
+	if m.Event != messageEvent {
+		return
+	}
+	ev := logvm(v, m).Tag(tagKafka).Field("kafka_topic", s.config.KafkaTopic)
+	value, err := json.Marshal(redactMessage(m, s.config.RedactPatterns))
+	if err != nil {
+		ev.Err(err).Warn("Unable to encode message for Kafka")
+		return
+	}
+	key := m.Topic
+	if s.config.KafkaKey == kafkaKeyID {
+		key = m.ID
+	}
+	s.kafkaProducer.Produce([]byte(key), value, func(err error) {
+		if err != nil {
+			ev.Err(err).Warn("Unable to produce message to Kafka topic %s", s.config.KafkaTopic)
+			return
+		}
+		ev.Debug("Produced message to Kafka topic %s", s.config.KafkaTopic)
+	})
+}
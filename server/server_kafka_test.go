@@ -0,0 +1,82 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+)
+
+func TestServer_Kafka_PublishWithTopicKey(t *testing.T) {
+	broker := newTestKafkaBroker(t, 4)
+	c := newTestConfig(t)
+	c.KafkaBrokers = []string{broker.Addr()}
+	c.KafkaTopic = "ntfy-events"
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "hi there", map[string]string{
+		"Title": "A title",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	record := broker.Record(t)
+	require.Equal(t, "ntfy-events", record.topic)
+	require.Equal(t, "mytopic", string(record.key))
+	produced := toMessage(t, string(record.value))
+	require.Equal(t, m.ID, produced.ID)
+	require.Equal(t, "mytopic", produced.Topic)
+	require.Equal(t, "A title", produced.Title)
+	require.Equal(t, "hi there", produced.Message)
+
+	// Same topic, same partition
+	request(t, s, "PUT", "/mytopic", "second message", nil)
+	require.Equal(t, record.partition, broker.Record(t).partition)
+}
+
+func TestServer_Kafka_PublishWithIDKey(t *testing.T) {
+	broker := newTestKafkaBroker(t, 1)
+	c := newTestConfig(t)
+	c.KafkaBrokers = []string{broker.Addr()}
+	c.KafkaTopic = "ntfy-events"
+	c.KafkaKey = "id"
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "hi there", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	record := broker.Record(t)
+	require.Equal(t, m.ID, string(record.key))
+	require.Equal(t, m.ID, toMessage(t, string(record.value)).ID)
+}
+
+func TestServer_Kafka_ProducerErrorDoesNotFailPublish(t *testing.T) {
+	broker := newTestKafkaBroker(t, 1)
+	broker.produceErrorCode = kerr.MessageTooLarge.Code
+	c := newTestConfig(t)
+	c.KafkaBrokers = []string{broker.Addr()}
+	c.KafkaTopic = "ntfy-events"
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "hi there", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "hi there", messages[0].Message)
+}
+
+func TestServer_Kafka_BrokerUnreachableDoesNotFailPublish(t *testing.T) {
+	c := newTestConfig(t)
+	c.KafkaBrokers = []string{"127.0.0.1:1"}
+	c.KafkaTopic = "ntfy-events"
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "hi there", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+}
@@ -16,6 +16,10 @@ func (s *Server) execManager() {
 	s.pruneAttachments()
 	s.pruneMessages()
 	s.pruneAndNotifyWebPushSubscriptions()
+	s.pruneCallMenus()
+	s.pruneSpamBodies()
+	s.pruneTopicPublishLimiters()
+	s.pruneAckConsumers()
 
 	// Message count per topic
 	var messagesCached int
@@ -172,12 +176,12 @@ func (s *Server) pruneMessages() {
 	log.
 		Tag(tagManager).
 		Timing(func() {
-			expiredMessageIDs, err := s.messageCache.MessagesExpired()
+			expiredMessageIDs, err := s.messageCache.MessagesExpired(s.config.RetainPriority, s.config.RetainDuration)
 			if err != nil {
 				log.Tag(tagManager).Err(err).Warn("Error retrieving expired messages")
 			} else if len(expiredMessageIDs) > 0 {
 				if s.fileCache != nil {
-					if err := s.fileCache.Remove(expiredMessageIDs...); err != nil {
+					if err := s.fileCache.Remove(append(expiredMessageIDs, s.iconFileIDs(expiredMessageIDs...)...)...); err != nil {
 						log.Tag(tagManager).Err(err).Warn("Error deleting attachments for expired messages")
 					}
 				}
@@ -187,6 +191,9 @@ func (s *Server) pruneMessages() {
 			} else {
 				log.Tag(tagManager).Debug("No expired messages to delete")
 			}
+			if err := s.messageCache.DeleteExpiredMessageIDs(); err != nil {
+				log.Tag(tagManager).Err(err).Warn("Error deleting expired message IDs")
+			}
 		}).
 		Debug("Pruned messages")
 }
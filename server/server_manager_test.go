@@ -3,6 +3,7 @@ package server
 import (
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestServer_Manager_Prune_Messages_Without_Attachments_DoesNotPanic(t *testing.T) {
@@ -26,3 +27,28 @@ func TestServer_Manager_Prune_Messages_Without_Attachments_DoesNotPanic(t *testi
 	_, err := s.messageCache.Message(m.ID)
 	require.Equal(t, errMessageNotFound, err)
 }
+
+func TestServer_Manager_Prune_Messages_RetainPriority(t *testing.T) {
+	c := newTestConfig(t)
+	c.RetainPriority = 5
+	c.RetainDuration = 30 * 24 * time.Hour
+	s := newTestServer(t, c)
+
+	// Publish messages with different priorities, and expire them
+	rr := request(t, s, "POST", "/mytopic", "regular", nil)
+	require.Equal(t, 200, rr.Code)
+	regular := toMessage(t, rr.Body.String())
+	rr = request(t, s, "POST", "/mytopic", "urgent", map[string]string{
+		"Priority": "urgent",
+	})
+	require.Equal(t, 200, rr.Code)
+	urgent := toMessage(t, rr.Body.String())
+	require.Nil(t, s.messageCache.ExpireMessages("mytopic"))
+
+	// Only the regular message is deleted
+	s.pruneMessages()
+	_, err := s.messageCache.Message(regular.ID)
+	require.Equal(t, errMessageNotFound, err)
+	_, err = s.messageCache.Message(urgent.ID)
+	require.Nil(t, err)
+}
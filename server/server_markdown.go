@@ -0,0 +1,71 @@
+package server
+
+import (
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+)
+
+const (
+	// MarkdownSanitizePolicySafe keeps common formatting tags in Markdown messages, except the disallowed HTML tags
+	// (see Config.MarkdownDisallowedTags), and removes all other tags, attributes and javascript: URLs
+	MarkdownSanitizePolicySafe = "safe"
+
+	// MarkdownSanitizePolicyStrict removes all HTML tags from Markdown messages
+	MarkdownSanitizePolicyStrict = "strict"
+
+	markdownModeStrip = "strip" // Subscribers passing markdown=strip receive Markdown messages as plain text
+)
+
+var (
+	// DefaultMarkdownDisallowedTags defines the HTML tags that are removed from Markdown messages if the
+	// markdown-sanitize-policy is "safe"
+	DefaultMarkdownDisallowedTags = []string{
+		"script", "style", "iframe", "frame", "frameset", "object", "embed", "applet", "form", "input",
+		"button", "textarea", "select", "link", "meta", "base", "svg", "math",
+	}
+)
+
+// newMarkdownSanitizer creates the sanitizer for the configured policy, or returns nil if sanitizing is disabled
+func newMarkdownSanitizer(conf *Config) *util.MarkdownSanitizer {
+	switch conf.MarkdownSanitizePolicy {
+	case MarkdownSanitizePolicySafe:
+		return util.NewMarkdownSanitizer(false, conf.MarkdownDisallowedTags)
+	case MarkdownSanitizePolicyStrict:
+		return util.NewMarkdownSanitizer(true, nil)
+	default:
+		return nil
+	}
+}
+
+// sanitizeMarkdown removes dangerous HTML from Markdown messages, so that clients rendering the Markdown (e.g. the
+// web app) are not exposed to XSS. Plain text messages are not touched, since they are never rendered as HTML.
+func (s *Server) sanitizeMarkdown(m *message) {
+	if s.markdownSanitizer == nil || m.ContentType != "text/markdown" || m.Encoding != "" {
+		return
+	}
+	m.Message = s.markdownSanitizer.Sanitize(m.Message)
+}
+
+// parseMarkdownStrip parses the markdown parameter of a subscriber, and returns true if Markdown messages should
+// be converted to plain text for this subscriber (markdown=strip)
+func parseMarkdownStrip(r *http.Request) (bool, error) {
+	mode := readParam(r, "x-markdown", "markdown", "md")
+	if mode == "" {
+		return false, nil
+	} else if mode != markdownModeStrip {
+		return false, errHTTPBadRequestMarkdownModeInvalid
+	}
+	return true, nil
+}
+
+// markdownToText returns a copy of the message with the Markdown body converted to plain text, for subscribers that
+// cannot render Markdown. The stored message, and the message sent to other subscribers, are not modified.
+func markdownToText(m *message) *message {
+	if m.Event != messageEvent || m.ContentType != "text/markdown" || m.Encoding != "" {
+		return m
+	}
+	text := *m
+	text.Message = util.MarkdownToText(m.Message)
+	text.ContentType = ""
+	return &text
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"heckel.io/ntfy/v2/util"
+)
+
+// MetaTopic is a named, server-side defined topic that aggregates multiple topics. Subscribing to a meta-topic
+// subscribes to all of its topics, so that their messages are merged into a single stream. Each message keeps
+// the topic it was published to, so subscribers can tell where it came from. Meta-topics cannot be published to.
+type MetaTopic struct {
+	Name   string   // Name of the meta-topic, e.g. dashboard
+	Topics []string // Topics aggregated by the meta-topic, e.g. alerts, backups
+}
+
+// metaTopic returns the meta-topic with the given name, or nil if there is none
+func (s *Server) metaTopic(name string) *MetaTopic {
+	for _, metaTopic := range s.config.MetaTopics {
+		if metaTopic.Name == name {
+			return metaTopic
+		}
+	}
+	return nil
+}
+
+// expandMetaTopics replaces all meta-topics in the list of topic IDs with the topics they aggregate. Duplicates
+// are removed, e.g. if a topic is subscribed to directly and via a meta-topic.
+func (s *Server) expandMetaTopics(ids []string) []string {
+	if len(s.config.MetaTopics) == 0 {
+		return ids
+	}
+	expanded := make([]string, 0, len(ids))
+	for _, id := range ids {
+		topicIDs := []string{id}
+		if metaTopic := s.metaTopic(id); metaTopic != nil {
+			topicIDs = metaTopic.Topics
+		}
+		for _, topicID := range topicIDs {
+			if !util.Contains(expanded, topicID) {
+				expanded = append(expanded, topicID)
+			}
+		}
+	}
+	return expanded
+}
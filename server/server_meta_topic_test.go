@@ -0,0 +1,74 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer_MetaTopic_SubscribeReceivesAllTopics(t *testing.T) {
+	c := newTestConfig(t)
+	c.MetaTopics = []*MetaTopic{{Name: "dashboard", Topics: []string{"alerts", "backups"}}}
+	s := newTestServer(t, c)
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/dashboard/json", subscribeRR)
+
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "disk full", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/backups", "backup done", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/other", "not in the dashboard", nil).Code)
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "dashboard", messages[0].Topic)
+	require.Equal(t, "alerts", messages[1].Topic)
+	require.Equal(t, "disk full", messages[1].Message)
+	require.Equal(t, "backups", messages[2].Topic)
+	require.Equal(t, "backup done", messages[2].Message)
+
+	// Polling works too, and topics subscribed to directly and via the meta-topic are not duplicated
+	response := request(t, s, "GET", "/dashboard,alerts/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "alerts", messages[0].Topic)
+	require.Equal(t, "backups", messages[1].Topic)
+}
+
+func TestServer_MetaTopic_AccessCheckedPerTopic(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.MetaTopics = []*MetaTopic{{Name: "dashboard", Topics: []string{"alerts", "backups"}}}
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts", user.PermissionRead))
+	require.Nil(t, s.userManager.AllowAccess("ben", "dashboard", user.PermissionRead)) // Access to the name alone is not enough
+
+	response := request(t, s, "GET", "/dashboard/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+
+	require.Nil(t, s.userManager.AllowAccess("ben", "backups", user.PermissionRead))
+	response = request(t, s, "GET", "/dashboard/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_MetaTopic_PublishNotAllowed(t *testing.T) {
+	c := newTestConfig(t)
+	c.MetaTopics = []*MetaTopic{{Name: "dashboard", Topics: []string{"alerts", "backups"}}}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/dashboard", "hi", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40052, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/dashboard/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "", response.Body.String())
+}
@@ -21,6 +21,7 @@ var (
 	metricMatrixPublishedSuccess       prometheus.Counter
 	metricMatrixPublishedFailure       prometheus.Counter
 	metricAttachmentsTotalSize         prometheus.Gauge
+	metricAttachmentsBytesServed       prometheus.Counter
 	metricVisitors                     prometheus.Gauge
 	metricSubscribers                  prometheus.Gauge
 	metricTopics                       prometheus.Gauge
@@ -77,6 +78,9 @@ func initMetrics() {
 	metricAttachmentsTotalSize = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ntfy_attachments_total_size",
 	})
+	metricAttachmentsBytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_attachments_bytes_served_total",
+	})
 	metricVisitors = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ntfy_visitors_total",
 	})
@@ -109,6 +113,7 @@ func initMetrics() {
 		metricMatrixPublishedSuccess,
 		metricMatrixPublishedFailure,
 		metricAttachmentsTotalSize,
+		metricAttachmentsBytesServed,
 		metricVisitors,
 		metricUsers,
 		metricSubscribers,
@@ -124,6 +129,13 @@ func minc(counter prometheus.Counter) {
 	}
 }
 
+// madd adds a value to a prometheus.Counter if it is non-nil
+func madd[T int | int64 | float64](counter prometheus.Counter, value T) {
+	if counter != nil {
+		counter.Add(float64(value))
+	}
+}
+
 // mset sets a prometheus.Gauge if it is non-nil
 func mset[T int | int64 | float64](gauge prometheus.Gauge, value T) {
 	if gauge != nil {
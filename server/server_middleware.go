@@ -12,6 +12,8 @@ const (
 	contextRateVisitor contextKey = iota + 2586
 	contextTopic
 	contextMatrixPushKey
+	contextProxyNode           // "by=" identifier of the proxy that received the client's connection, see extractForwardedBy
+	contextSMTPAttachmentCheck // Set on the dry run that checks e-mail attachments, see smtpSession.publishMessage
 )
 
 func (s *Server) limitRequests(next handleFunc) handleFunc {
@@ -40,8 +42,8 @@ func (s *Server) limitRequestsWithTopic(next handleFunc) handleFunc {
 			contextRateVisitor: vrate,
 			contextTopic:       t,
 		})
-		if util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) {
-			return next(w, r, v)
+		if util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) || isSMTPAttachmentCheck(r) {
+			return next(w, r, v) // The attachment check is followed by the actual publish request, which is counted
 		} else if !vrate.RequestAllowed() {
 			return errHTTPTooManyRequestsLimitRequests
 		}
@@ -49,6 +51,13 @@ func (s *Server) limitRequestsWithTopic(next handleFunc) handleFunc {
 	}
 }
 
+// isSMTPAttachmentCheck returns true if the request is the internal dry run of the SMTP server that checks an
+// e-mail attachment against the visitor's attachment limits. It cannot be set by HTTP clients.
+func isSMTPAttachmentCheck(r *http.Request) bool {
+	check, _ := fromContext[bool](r, contextSMTPAttachmentCheck)
+	return check && isDryRun(r)
+}
+
 func (s *Server) ensureWebEnabled(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		if s.config.WebRoot == "" {
@@ -67,6 +76,24 @@ func (s *Server) ensureWebPushEnabled(next handleFunc) handleFunc {
 	}
 }
 
+func (s *Server) ensureSubscribeURLsEnabled(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.config.SubscribeURLSecret == "" {
+			return errHTTPNotFound
+		}
+		return next(w, r, v)
+	}
+}
+
+func (s *Server) ensureAPNSEnabled(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.apnsStore == nil {
+			return errHTTPNotFound
+		}
+		return next(w, r, v)
+	}
+}
+
 func (s *Server) ensureUserManager(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		if s.userManager == nil {
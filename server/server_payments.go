@@ -73,6 +73,7 @@ func (s *Server) handleBillingTiersGet(w http.ResponseWriter, _ *http.Request, _
 				AttachmentTotalSize:      freeTier.AttachmentTotalSizeLimit,
 				AttachmentFileSize:       freeTier.AttachmentFileSizeLimit,
 				AttachmentExpiryDuration: int64(freeTier.AttachmentExpiryDuration.Seconds()),
+				MessageSize:              int64(freeTier.MessageSizeLimit),
 			},
 		},
 	}
@@ -102,6 +103,7 @@ func (s *Server) handleBillingTiersGet(w http.ResponseWriter, _ *http.Request, _
 				AttachmentTotalSize:      tier.AttachmentTotalSizeLimit,
 				AttachmentFileSize:       tier.AttachmentFileSizeLimit,
 				AttachmentExpiryDuration: int64(tier.AttachmentExpiryDuration.Seconds()),
+				MessageSize:              int64(tierMessageSizeLimit(s.config, tier)),
 			},
 		})
 	}
@@ -149,7 +151,7 @@ func (s *Server) handleAccountBillingSubscriptionCreate(w http.ResponseWriter, r
 			return errMultipleBillingSubscriptions
 		}
 	}
-	successURL := s.config.BaseURL + apiAccountBillingSubscriptionCheckoutSuccessTemplate
+	successURL := s.externalBaseURL(r) + apiAccountBillingSubscriptionCheckoutSuccessTemplate
 	params := &stripe.CheckoutSessionParams{
 		Customer:            stripeCustomerID, // A user may have previously deleted their subscription
 		ClientReferenceID:   &u.ID,
@@ -234,7 +236,7 @@ func (s *Server) handleAccountBillingSubscriptionCreateSuccess(w http.ResponseWr
 	if err := s.updateSubscriptionAndTier(r, v, u, tier, sess.Customer.ID, sub.ID, string(sub.Status), string(interval), sub.CurrentPeriodEnd, sub.CancelAt); err != nil {
 		return err
 	}
-	http.Redirect(w, r, s.config.BaseURL+accountPath, http.StatusSeeOther)
+	http.Redirect(w, r, s.externalBaseURL(r)+accountPath, http.StatusSeeOther)
 	return nil
 }
 
@@ -322,7 +324,7 @@ func (s *Server) handleAccountBillingPortalSessionCreate(w http.ResponseWriter,
 	}
 	params := &stripe.BillingPortalSessionParams{
 		Customer:  stripe.String(u.Billing.StripeCustomerID),
-		ReturnURL: stripe.String(s.config.BaseURL),
+		ReturnURL: stripe.String(s.externalBaseURL(r)),
 	}
 	ps, err := s.stripe.NewPortalSession(params)
 	if err != nil {
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tagReceipt            = "receipt"
+	receiptRequestTimeout = 10 * time.Second
+)
+
+// receipt tracks the delivery of a single message to live subscribers and Firebase, see X-Receipt-URL. Delivery
+// attempts are registered with expect and completed with done. All methods may be called on a nil receipt, which
+// makes it easy to pass it along for messages that did not ask for a receipt.
+type receipt struct {
+	url         string
+	pending     sync.WaitGroup
+	subscribers atomic.Int32
+	firebase    atomic.Bool
+	deliveredAt atomic.Int64 // Unix time stamp of the first delivery, zero if not delivered (yet)
+}
+
+// deliveryReceipt is the JSON body that is POSTed to the receipt URL
+type deliveryReceipt struct {
+	ID          string `json:"id"`
+	Topic       string `json:"topic"`
+	Delivered   bool   `json:"delivered"`
+	Subscribers int    `json:"subscribers"`        // Number of live subscribers the message was delivered to
+	Firebase    bool   `json:"firebase,omitempty"` // True if the message was forwarded to Firebase
+	Time        int64  `json:"time,omitempty"`     // Time of the first delivery, only set if delivered
+}
+
+// newReceipt creates a receipt that is held open until seal is called, so that all delivery attempts can be
+// registered before waiting for them
+func newReceipt(url string) *receipt {
+	rc := &receipt{url: url}
+	rc.pending.Add(1)
+	return rc
+}
+
+func (rc *receipt) expect(n int) {
+	if rc != nil {
+		rc.pending.Add(n)
+	}
+}
+
+func (rc *receipt) done() {
+	if rc != nil {
+		rc.pending.Done()
+	}
+}
+
+func (rc *receipt) seal() {
+	rc.done()
+}
+
+func (rc *receipt) deliveredToSubscriber() {
+	if rc != nil {
+		rc.subscribers.Add(1)
+		rc.deliveredAt.CompareAndSwap(0, time.Now().Unix())
+	}
+}
+
+func (rc *receipt) forwardedToFirebase() {
+	if rc != nil {
+		rc.firebase.Store(true)
+		rc.deliveredAt.CompareAndSwap(0, time.Now().Unix())
+	}
+}
+
+// wait blocks until all expected delivery attempts are done, or until the timeout is reached
+func (rc *receipt) wait(timeout time.Duration, closeChan <-chan bool) {
+	allDone := make(chan struct{})
+	go func() {
+		rc.pending.Wait()
+		close(allDone)
+	}()
+	select {
+	case <-allDone:
+	case <-time.After(timeout):
+	case <-closeChan:
+	}
+}
+
+func (rc *receipt) toDeliveryReceipt(m *message) *deliveryReceipt {
+	deliveredAt := rc.deliveredAt.Load()
+	return &deliveryReceipt{
+		ID:          m.ID,
+		Topic:       m.Topic,
+		Delivered:   deliveredAt > 0,
+		Subscribers: int(rc.subscribers.Load()),
+		Firebase:    rc.firebase.Load(),
+		Time:        deliveredAt,
+	}
+}
+
+// sendReceipt waits until the message was delivered to all live subscribers (and Firebase), or until
+// Config.ReceiptTimeout is reached, and then POSTs the delivery receipt to the receipt URL. It is meant to
+// be run in a Go routine, and never affects the publish request. Failed callbacks are logged, but not retried.
+func (s *Server) sendReceipt(v *visitor, m *message, rc *receipt) {
+	rc.seal()
+	rc.wait(s.config.ReceiptTimeout, s.closeChan)
+	ev := logvm(v, m).Tag(tagReceipt).Field("receipt_url", rc.url)
+	body, err := json.Marshal(rc.toDeliveryReceipt(m))
+	if err != nil {
+		ev.Err(err).Warn("Unable to marshal delivery receipt")
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, rc.url, bytes.NewReader(body))
+	if err != nil {
+		ev.Err(err).Warn("Unable to create delivery receipt request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	resp, err := s.receiptClient.Do(req)
+	if err != nil {
+		ev.Err(err).Warn("Unable to send delivery receipt")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		ev.Err(fmt.Errorf("receipt URL responded with HTTP %s", resp.Status)).Warn("Unable to send delivery receipt")
+		return
+	}
+	ev.Debug("Sent delivery receipt to %s", rc.url)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestReceiptServer(t *testing.T) (*httptest.Server, chan *deliveryReceipt) {
+	receipts := make(chan *deliveryReceipt, 10)
+	receiptServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var rc deliveryReceipt
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&rc))
+		receipts <- &rc
+	}))
+	t.Cleanup(receiptServer.Close)
+	return receiptServer, receipts
+}
+
+func waitForReceipt(t *testing.T, receipts chan *deliveryReceipt) *deliveryReceipt {
+	select {
+	case rc := <-receipts:
+		return rc
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery receipt received")
+		return nil
+	}
+}
+
+func TestServer_Receipt_Delivered(t *testing.T) {
+	receiptServer, receipts := newTestReceiptServer(t)
+	s := newTestServer(t, newTestConfig(t))
+	s.receiptClient = http.DefaultClient // The receipt server runs on 127.0.0.1
+
+	cancel1 := subscribe(t, s, "/pager/json", httptest.NewRecorder())
+	cancel2 := subscribe(t, s, "/pager/json", httptest.NewRecorder())
+	start := time.Now().Unix()
+	response := request(t, s, "PUT", "/pager", "database is down", map[string]string{
+		"X-Receipt-URL": receiptServer.URL + "/receipts",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	rc := waitForReceipt(t, receipts)
+	require.Equal(t, m.ID, rc.ID)
+	require.Equal(t, "pager", rc.Topic)
+	require.True(t, rc.Delivered)
+	require.Equal(t, 2, rc.Subscribers)
+	require.False(t, rc.Firebase)
+	require.GreaterOrEqual(t, rc.Time, start)
+	cancel1()
+	cancel2()
+}
+
+func TestServer_Receipt_FilteredSubscriber(t *testing.T) {
+	receiptServer, receipts := newTestReceiptServer(t)
+	s := newTestServer(t, newTestConfig(t))
+	s.receiptClient = http.DefaultClient
+
+	// The message does not pass the filters of either subscriber, so it is not delivered
+	cancel1 := subscribe(t, s, "/pager/json?priority=urgent", httptest.NewRecorder())
+	cancel2 := subscribe(t, s, "/pager/json?tags=prod", httptest.NewRecorder())
+	defer cancel1()
+	defer cancel2()
+	response := request(t, s, "PUT", "/pager?receipt="+receiptServer.URL, "database is down", nil)
+	require.Equal(t, 200, response.Code)
+
+	rc := waitForReceipt(t, receipts)
+	require.False(t, rc.Delivered)
+	require.Equal(t, 0, rc.Subscribers)
+	require.Equal(t, int64(0), rc.Time)
+
+	// Only counts the subscriber the message was written to
+	cancel3 := subscribe(t, s, "/pager/json", httptest.NewRecorder())
+	defer cancel3()
+	response = request(t, s, "PUT", "/pager?receipt="+receiptServer.URL, "database is down", map[string]string{
+		"Tags": "prod",
+	})
+	require.Equal(t, 200, response.Code)
+
+	rc = waitForReceipt(t, receipts)
+	require.True(t, rc.Delivered)
+	require.Equal(t, 2, rc.Subscribers)
+}
+
+func TestServer_Receipt_NotDelivered(t *testing.T) {
+	receiptServer, receipts := newTestReceiptServer(t)
+	s := newTestServer(t, newTestConfig(t))
+	s.receiptClient = http.DefaultClient
+
+	response := request(t, s, "PUT", "/pager?receipt="+receiptServer.URL, "nobody is listening", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	rc := waitForReceipt(t, receipts)
+	require.Equal(t, m.ID, rc.ID)
+	require.False(t, rc.Delivered)
+	require.Equal(t, 0, rc.Subscribers)
+	require.Equal(t, int64(0), rc.Time)
+}
+
+func TestServer_Receipt_FirebaseAndTimeout(t *testing.T) {
+	receiptServer, receipts := newTestReceiptServer(t)
+	c := newTestConfig(t)
+	c.ReceiptTimeout = 500 * time.Millisecond
+	sender := newTestFirebaseSender(10)
+	s := newTestServer(t, c)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true}, nil, nil)
+	s.receiptClient = http.DefaultClient
+
+	// The subscriber never reads, so its delivery never completes; the receipt is sent after the timeout anyway
+	blocked := make(chan struct{})
+	defer close(blocked)
+	s.topics["pager"] = newTopic("pager")
+	s.topics["pager"].Subscribe(func(v *visitor, msg *message) error {
+		<-blocked
+		return nil
+	}, &subscriberInfo{}, func() {})
+
+	start := time.Now()
+	response := request(t, s, "PUT", "/pager", "database is down", map[string]string{
+		"Receipt-URL": receiptServer.URL,
+	})
+	require.Equal(t, 200, response.Code)
+	require.True(t, time.Since(start) < 400*time.Millisecond) // Publish response is never delayed
+
+	rc := waitForReceipt(t, receipts)
+	require.True(t, rc.Delivered)
+	require.True(t, rc.Firebase)
+	require.Equal(t, 0, rc.Subscribers)
+	require.True(t, time.Since(start) >= 500*time.Millisecond)
+}
+
+func TestServer_Receipt_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/pager", "database is down", map[string]string{
+		"X-Receipt-URL": "ftp://example.com/receipts",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40064, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/pager", "database is down", map[string]string{
+		"X-Receipt-URL": "https://example.com/receipts",
+		"X-Delay":       "1h",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40064, toHTTPError(t, response.Body.String()).Code)
+}
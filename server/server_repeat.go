@@ -0,0 +1,191 @@
+package server
+
+import (
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tagRepeat = "repeat"
+
+	messageRepeatDefault = 10  // Number of repeats if only the interval is passed in X-Repeat-Until-Ack
+	messageRepeatMax     = 100 // Upper bound for the number of repeats of a single message
+)
+
+// messageRepeat is a message that is re-sent (X-Repeat-Until-Ack) every interval, until it is acknowledged via
+// the ack endpoint, or until all repeats have been sent. It is kept in memory only, so repeats do not survive
+// a server restart.
+type messageRepeat struct {
+	message   *message
+	visitor   *visitor
+	visitorID string // See visitorID, used to count the active repeats per visitor
+	firebase  bool
+	interval  time.Duration
+	remaining int
+	next      time.Time
+	ids       []string // Message IDs of the repeats sent so far, so they can be acknowledged as well, see Server.repeatIDs
+}
+
+// parseRepeatUntilAck parses the X-Repeat-Until-Ack header, which is in the format <interval>[,<repeats>],
+// e.g. "5m" or "5m,12". The interval must be at least Config.MessageRepeatIntervalMin, and the visitor must not
+// have more than Config.VisitorRepeatLimit messages that are still being repeated.
+func (s *Server) parseRepeatUntilAck(v *visitor, value string) (interval time.Duration, repeats int, err *errHTTP) {
+	intervalStr, repeatsStr, hasRepeats := strings.Cut(value, ",")
+	interval, e := util.ParseDuration(strings.TrimSpace(intervalStr))
+	if e != nil {
+		return 0, 0, errHTTPBadRequestRepeatUntilAckInvalid.Wrap("invalid interval %s", strings.TrimSpace(intervalStr))
+	} else if interval < s.config.MessageRepeatIntervalMin {
+		return 0, 0, errHTTPBadRequestRepeatUntilAckInvalid.Wrap("interval must be at least %s", s.config.MessageRepeatIntervalMin.String())
+	}
+	repeats = messageRepeatDefault
+	if hasRepeats {
+		repeats, e = strconv.Atoi(strings.TrimSpace(repeatsStr))
+		if e != nil || repeats < 1 || repeats > messageRepeatMax {
+			return 0, 0, errHTTPBadRequestRepeatUntilAckInvalid.Wrap("repeats must be between 1 and %d", messageRepeatMax)
+		}
+	}
+	if s.repeatCount(visitorID(v.IP(), v.User())) >= s.config.VisitorRepeatLimit {
+		return 0, 0, errHTTPTooManyRequestsLimitRepeats
+	}
+	return interval, repeats, nil
+}
+
+// repeatCount returns the number of messages of the given visitor that are still being repeated
+func (s *Server) repeatCount(visitorID string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var count int
+	for _, repeat := range s.repeats {
+		if repeat.visitorID == visitorID {
+			count++
+		}
+	}
+	return count
+}
+
+// scheduleMessageRepeat remembers the message, so that it is re-sent by sendRepeatedMessages. The first repeat
+// is sent one interval after the message is delivered, which also works for delayed messages.
+func (s *Server) scheduleMessageRepeat(v *visitor, m *message, firebase bool, interval time.Duration, repeats int) {
+	first := time.Now()
+	if delivery := time.Unix(m.Time, 0); delivery.After(first) {
+		first = delivery
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repeats[m.ID] = &messageRepeat{
+		message:   m,
+		visitor:   v,
+		visitorID: visitorID(v.IP(), v.User()),
+		firebase:  firebase,
+		interval:  interval,
+		remaining: repeats,
+		next:      first.Add(interval),
+	}
+}
+
+// sendRepeatedMessages re-sends all messages whose next repeat is due. Each repeat is a copy of the original
+// message with a new ID (clients discard messages with IDs they already know) and the current time. Repeats
+// are not cached, but count towards the visitor's message limit.
+func (s *Server) sendRepeatedMessages() {
+	now := time.Now()
+	due := make([]*messageRepeat, 0)
+	s.mu.Lock()
+	for id, repeat := range s.repeats {
+		if now.Before(repeat.next) {
+			continue
+		}
+		repeat.remaining--
+		repeat.next = now.Add(repeat.interval)
+		if repeat.remaining <= 0 {
+			s.deleteRepeat(id)
+		}
+		due = append(due, repeat)
+	}
+	s.mu.Unlock()
+	for _, repeat := range due {
+		s.sendRepeatedMessage(repeat)
+	}
+}
+
+func (s *Server) sendRepeatedMessage(repeat *messageRepeat) {
+	m := *repeat.message
+	m.ID = util.RandomString(messageIDLength)
+	m.Time = time.Now().Unix()
+	v := repeat.visitor
+	if !util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.IP()) && !v.MessageAllowed() {
+		logvm(v, &m).Tag(tagRepeat).Field("message_repeat_of", repeat.message.ID).Info("Message limit reached, stopping repeats")
+		s.mu.Lock()
+		s.deleteRepeat(repeat.message.ID)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Lock()
+	if _, ok := s.repeats[repeat.message.ID]; ok { // Not the last repeat, and not acknowledged in the meantime
+		repeat.ids = append(repeat.ids, m.ID)
+		s.repeatIDs[m.ID] = repeat.message.ID
+	}
+	s.mu.Unlock()
+	logvm(v, &m).Tag(tagRepeat).Field("message_repeat_of", repeat.message.ID).Field("message_repeats_remaining", repeat.remaining).Debug("Repeating unacknowledged message")
+	s.mu.RLock()
+	t, ok := s.topics[m.Topic] // If no subscribers, there is no one to notify except via push
+	s.mu.RUnlock()
+	if ok {
+		if err := t.Publish(v, &m); err != nil {
+			logvm(v, &m).Tag(tagRepeat).Err(err).Warn("Unable to publish repeated message")
+		}
+	}
+	if s.firebaseClient != nil && repeat.firebase {
+		go s.sendToFirebase(v, &m)
+	}
+	if s.config.WebPushPublicKey != "" {
+		go s.publishToWebPushEndpoints(v, &m)
+	}
+}
+
+// deleteRepeat stops the repeats of the message with the given ID. The caller must hold s.mu.
+func (s *Server) deleteRepeat(id string) {
+	repeat, ok := s.repeats[id]
+	if !ok {
+		return
+	}
+	for _, repeatID := range repeat.ids {
+		delete(s.repeatIDs, repeatID)
+	}
+	delete(s.repeats, id)
+}
+
+// handleMessageAck acknowledges a message that was published with X-Repeat-Until-Ack, which stops all further
+// repeats. The message can be acknowledged using the ID of the original message or the ID of any of its repeats.
+// Acknowledging requires write access to the topic.
+func (s *Server) handleMessageAck(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := fromContext[*topic](r, contextTopic)
+	if err != nil {
+		return err
+	}
+	matches := ackPathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	messageID := matches[1]
+	s.mu.Lock()
+	if originalID, ok := s.repeatIDs[messageID]; ok {
+		messageID = originalID
+	}
+	repeat, ok := s.repeats[messageID]
+	if !ok || repeat.message.Topic != t.ID {
+		s.mu.Unlock()
+		return errHTTPNotFound.With(t)
+	}
+	s.deleteRepeat(messageID)
+	remaining := repeat.remaining
+	s.mu.Unlock()
+	logvr(v, r).Tag(tagRepeat).With(t).Fields(log.Context{
+		"message_id":                messageID,
+		"message_repeats_remaining": remaining,
+	}).Debug("Message acknowledged, stopping repeats")
+	return s.writeJSON(w, newSuccessResponse())
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_RepeatUntilAck_RepeatsUntilMax(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageRepeatIntervalMin = 100 * time.Millisecond
+	s := newTestServer(t, c)
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/mytopic", "server is down", map[string]string{
+		"X-Repeat-Until-Ack": "300ms,2",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, 2, repeatsRemaining(s, m.ID))
+
+	// Not repeated before the interval has passed
+	s.sendRepeatedMessages()
+	require.Equal(t, 2, repeatsRemaining(s, m.ID))
+
+	// Repeated once per interval
+	time.Sleep(350 * time.Millisecond)
+	s.sendRepeatedMessages()
+	require.Equal(t, 1, repeatsRemaining(s, m.ID))
+	s.sendRepeatedMessages()
+	require.Equal(t, 1, repeatsRemaining(s, m.ID))
+
+	// Stops after the max number of repeats
+	time.Sleep(350 * time.Millisecond)
+	s.sendRepeatedMessages()
+	require.Equal(t, -1, repeatsRemaining(s, m.ID)) // Removed after the last repeat
+	time.Sleep(350 * time.Millisecond)
+	s.sendRepeatedMessages()
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, m.ID, messages[1].ID)
+	for _, repeated := range messages[2:] {
+		require.Equal(t, messageEvent, repeated.Event)
+		require.Equal(t, "server is down", repeated.Message)
+		require.NotEqual(t, m.ID, repeated.ID)
+	}
+	require.NotEqual(t, messages[2].ID, messages[3].ID)
+
+	// Repeats are not cached
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_RepeatUntilAck_AckStopsRepeats(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageRepeatIntervalMin = 100 * time.Millisecond
+	s := newTestServer(t, c)
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/mytopic", "server is down", map[string]string{
+		"X-Message-ID":       "alert1234567",
+		"X-Repeat-Until-Ack": "200ms,5",
+	})
+	require.Equal(t, 200, response.Code)
+
+	time.Sleep(250 * time.Millisecond)
+	s.sendRepeatedMessages()
+	require.Equal(t, 4, repeatsRemaining(s, "alert1234567"))
+
+	// Wrong topic cannot ack
+	response = request(t, s, "POST", "/othertopic/alert1234567/ack", "", nil)
+	require.Equal(t, 404, response.Code)
+
+	response = request(t, s, "POST", "/mytopic/alert1234567/ack", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, -1, repeatsRemaining(s, "alert1234567"))
+
+	// No repeats after the ack
+	time.Sleep(250 * time.Millisecond)
+	s.sendRepeatedMessages()
+
+	// Acking twice fails
+	response = request(t, s, "POST", "/mytopic/alert1234567/ack", "", nil)
+	require.Equal(t, 404, response.Code)
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages)) // open, original message, one repeat
+	require.Equal(t, "alert1234567", messages[1].ID)
+	require.NotEqual(t, "alert1234567", messages[2].ID)
+}
+
+func TestServer_RepeatUntilAck_AckWithRepeatID(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageRepeatIntervalMin = 100 * time.Millisecond
+	s := newTestServer(t, c)
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/mytopic", "server is down", map[string]string{
+		"X-Repeat-Until-Ack": "200ms,5",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	time.Sleep(250 * time.Millisecond)
+	s.sendRepeatedMessages()
+	s.mu.RLock()
+	require.Equal(t, 1, len(s.repeats[m.ID].ids))
+	repeatID := s.repeats[m.ID].ids[0]
+	s.mu.RUnlock()
+
+	// The subscriber acknowledges the repeat it received, which stops the repeats of the original message
+	response = request(t, s, "POST", "/mytopic/"+repeatID+"/ack", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, -1, repeatsRemaining(s, m.ID))
+	s.mu.RLock()
+	require.Empty(t, s.repeatIDs)
+	s.mu.RUnlock()
+
+	time.Sleep(250 * time.Millisecond)
+	s.sendRepeatedMessages()
+	response = request(t, s, "POST", "/mytopic/"+repeatID+"/ack", "", nil)
+	require.Equal(t, 404, response.Code)
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages)) // open, original message, one repeat
+	require.Equal(t, repeatID, messages[2].ID)
+}
+
+func TestServer_RepeatUntilAck_AckRequiresWriteAccess(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.MessageRepeatIntervalMin = 100 * time.Millisecond
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts", user.PermissionRead))
+
+	response := request(t, s, "PUT", "/alerts", "server is down", map[string]string{
+		"Authorization":    util.BasicAuth("phil", "phil"),
+		"Message-ID":       "alert1234567",
+		"Repeat-Until-Ack": "1s",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, messageRepeatDefault, repeatsRemaining(s, "alert1234567"))
+
+	response = request(t, s, "POST", "/alerts/alert1234567/ack", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, messageRepeatDefault, repeatsRemaining(s, "alert1234567"))
+
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts", user.PermissionReadWrite))
+	response = request(t, s, "POST", "/alerts/alert1234567/ack", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, -1, repeatsRemaining(s, "alert1234567"))
+}
+
+func TestServer_RepeatUntilAck_Invalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageRepeatIntervalMin = time.Minute
+	s := newTestServer(t, c)
+	for _, value := range []string{"invalid", "10s", "5m,0", "5m,101", "5m,many"} {
+		response := request(t, s, "PUT", "/mytopic", "server is down", map[string]string{
+			"X-Repeat-Until-Ack": value,
+		})
+		require.Equal(t, 400, response.Code, value)
+		require.Equal(t, 40051, toHTTPError(t, response.Body.String()).Code, value)
+	}
+	response := request(t, s, "PUT", "/mytopic?repeat=5m,12", "server is down", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 12, repeatsRemaining(s, toMessage(t, response.Body.String()).ID))
+}
+
+func TestServer_RepeatUntilAck_VisitorLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRepeatLimit = 2
+	s := newTestServer(t, c)
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/mytopic?repeat=5m", "server is down", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic?repeat=5m", "server is down", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42914, toHTTPError(t, response.Body.String()).Code)
+
+	// Messages without repeats are not affected
+	response = request(t, s, "PUT", "/mytopic", "server is down", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_RepeatUntilAck_RepeatsCountTowardsMessageLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageRepeatIntervalMin = 100 * time.Millisecond
+	c.VisitorMessageDailyLimit = 2
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "server is down", map[string]string{
+		"X-Repeat-Until-Ack": "100ms,5",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	// First repeat uses up the message limit
+	time.Sleep(150 * time.Millisecond)
+	s.sendRepeatedMessages()
+	require.Equal(t, 4, repeatsRemaining(s, m.ID))
+	response = request(t, s, "PUT", "/mytopic", "another message", nil)
+	require.Equal(t, 429, response.Code)
+
+	// Limit reached: repeats stop
+	time.Sleep(150 * time.Millisecond)
+	s.sendRepeatedMessages()
+	require.Equal(t, -1, repeatsRemaining(s, m.ID))
+}
+
+// repeatsRemaining returns the number of remaining repeats of a message, or -1 if the message is not repeated
+func repeatsRemaining(s *Server, messageID string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if repeat, ok := s.repeats[messageID]; ok {
+		return repeat.remaining
+	}
+	return -1
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const (
+	tagSchedule = "schedule"
+)
+
+// schedule is the definition of a recurring message (X-Cron). Only the definition is stored in the schedules
+// table. The next occurrence is stored like any other delayed message, and references the schedule. When it
+// is delivered, the following occurrence is added (see scheduleNextOccurrence), so schedules survive restarts.
+type schedule struct {
+	ID      string
+	Topic   string
+	Cron    string // Normalized cron expression, see util.Recurrence
+	Sender  netip.Addr
+	User    string
+	Created int64
+	Next    int64 // Time of the next occurrence, only set by messageCache.Schedules
+}
+
+// parseRecurrence parses the X-Cron header, and checks that the visitor has not reached the limit of active
+// schedules (per user, or per IP address for anonymous visitors). Recurring messages must be cached, and since
+// e-mail addresses and phone numbers are not stored, they cannot be combined with e-mails or calls.
+func (s *Server) parseRecurrence(v *visitor, m *message, spec string, cache bool, email, call string) (*util.Recurrence, *errHTTP) {
+	if !cache || email != "" || call != "" || m.Time > time.Now().Unix() {
+		return nil, errHTTPBadRequestCronNotAllowed
+	}
+	recurrence, err := util.ParseRecurrence(spec, time.Now())
+	if err != nil {
+		return nil, errHTTPBadRequestCronInvalid.Wrap("%s", err.Error())
+	}
+	var count int
+	if u := v.User(); u != nil {
+		count, err = s.messageCache.ScheduleCountByUserID(u.ID)
+	} else {
+		count, err = s.messageCache.ScheduleCountBySender(v.IP().String())
+	}
+	if err != nil {
+		return nil, errHTTPInternalError
+	} else if count >= s.config.VisitorScheduleLimit {
+		return nil, errHTTPTooManyRequestsLimitSchedules
+	}
+	return recurrence, nil
+}
+
+// addSchedule stores the schedule of a recurring message. The message itself is the first occurrence, and is
+// cached as a delayed message. Uploaded attachments are not allowed, since they expire long before the schedule.
+func (s *Server) addSchedule(v *visitor, r *http.Request, m *message, recurrence *util.Recurrence) error {
+	if m.Attachment != nil && m.Attachment.Expires > 0 {
+		if err := s.fileCache.Remove(m.ID); err != nil {
+			logvrm(v, r, m).Tag(tagSchedule).Err(err).Warn("Error removing attachment of recurring message")
+		}
+		return errHTTPBadRequestCronNotAllowed.With(m)
+	}
+	logvrm(v, r, m).Tag(tagSchedule).Field("schedule_cron", recurrence.String()).Debug("Adding recurring message schedule %s", m.Schedule)
+	return s.messageCache.AddSchedule(&schedule{
+		ID:      m.Schedule,
+		Topic:   m.Topic,
+		Cron:    recurrence.String(),
+		Sender:  m.Sender,
+		User:    m.User,
+		Created: time.Now().Unix(),
+	})
+}
+
+// scheduleNextOccurrence adds the occurrence following the given (just delivered) message of a schedule, as a
+// copy of the message with a new ID. If the schedule was cancelled in the meantime, nothing is added. Each
+// occurrence counts towards the visitor's message limit (the first one was counted when it was published); if
+// the limit is reached, the schedule is cancelled.
+func (s *Server) scheduleNextOccurrence(v *visitor, m *message) error {
+	sc, err := s.messageCache.Schedule(m.Schedule)
+	if errors.Is(err, errScheduleNotFound) {
+		logvm(v, m).Tag(tagSchedule).Debug("Schedule %s was cancelled, not scheduling next occurrence", m.Schedule)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.IP()) && !v.MessageAllowed() {
+		logvm(v, m).Tag(tagSchedule).Info("Message limit reached, cancelling schedule %s", m.Schedule)
+		return s.messageCache.RemoveSchedule(sc.Topic, sc.ID)
+	}
+	recurrence, err := util.ParseRecurrence(sc.Cron, time.Now())
+	if err != nil {
+		return err
+	}
+	after := time.Now()
+	if delivery := time.Unix(m.Time, 0); delivery.After(after) {
+		after = delivery
+	}
+	next := *m
+	next.ID = util.RandomString(messageIDLength)
+	next.Time = recurrence.Next(after).Unix()
+	next.Expires = next.Time + (m.Expires - m.Time)
+	logvm(v, &next).Tag(tagSchedule).Debug("Scheduling next occurrence of schedule %s", m.Schedule)
+	return s.messageCache.AddMessage(&next)
+}
+
+// handleScheduleList lists the recurring message schedules of a topic. Like cancelling schedules, this requires
+// write access to the topic.
+func (s *Server) handleScheduleList(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := fromContext[*topic](r, contextTopic)
+	if err != nil {
+		return err
+	}
+	schedules, err := s.messageCache.Schedules(t.ID)
+	if err != nil {
+		return err
+	}
+	response := make([]*apiScheduleResponse, 0, len(schedules))
+	for _, sc := range schedules {
+		response = append(response, &apiScheduleResponse{
+			ID:      sc.ID,
+			Cron:    sc.Cron,
+			Next:    sc.Next,
+			Created: sc.Created,
+		})
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleScheduleDelete cancels a recurring message schedule, and deletes its pending occurrence
+func (s *Server) handleScheduleDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := fromContext[*topic](r, contextTopic)
+	if err != nil {
+		return err
+	}
+	matches := schedulePathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	scheduleID := matches[1]
+	if err := s.messageCache.RemoveSchedule(t.ID, scheduleID); errors.Is(err, errScheduleNotFound) {
+		return errHTTPNotFound.With(t)
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagSchedule).With(t).Field("schedule_id", scheduleID).Debug("Recurring message schedule cancelled")
+	return s.writeJSON(w, newSuccessResponse())
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"testing"
+	"time"
+)
+
+func TestServer_Schedule_PublishAndDeliver(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/standup", "Daily standup in 5 minutes", map[string]string{
+		"Cron": "55 9 * * MON-FRI",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.NotEmpty(t, m.Schedule)
+	require.Equal(t, 9, time.Unix(m.Time, 0).Hour())
+	require.Equal(t, 55, time.Unix(m.Time, 0).Minute())
+	require.True(t, m.Time > time.Now().Unix())
+
+	// Not yet delivered, but listed
+	response = request(t, s, "GET", "/standup/json?poll=1", "", nil)
+	require.Equal(t, "", response.Body.String())
+	schedules := toSchedulesForTopic(t, s, "standup")
+	require.Equal(t, 1, len(schedules))
+	require.Equal(t, m.Schedule, schedules[0].ID)
+	require.Equal(t, "55 9 * * MON-FRI", schedules[0].Cron)
+	require.Equal(t, m.Time, schedules[0].Next)
+
+	// Make the first occurrence due, and deliver it; the next occurrence is scheduled
+	_, err := s.messageCache.db.Exec(`UPDATE messages SET time = ? WHERE mid = ?`, time.Now().Add(-time.Minute).Unix(), m.ID)
+	require.Nil(t, err)
+	require.Nil(t, s.sendDelayedMessages())
+
+	response = request(t, s, "GET", "/standup/json?poll=1", "", nil)
+	delivered := toMessage(t, response.Body.String())
+	require.Equal(t, m.ID, delivered.ID)
+	require.Equal(t, "Daily standup in 5 minutes", delivered.Message)
+	require.Equal(t, m.Schedule, delivered.Schedule)
+
+	response = request(t, s, "GET", "/standup/json?poll=1&scheduled=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	next := messages[1]
+	require.NotEqual(t, m.ID, next.ID)
+	require.Equal(t, m.Schedule, next.Schedule)
+	require.Equal(t, "Daily standup in 5 minutes", next.Message)
+	require.True(t, next.Time > time.Now().Unix())
+	require.Equal(t, next.Time, toSchedulesForTopic(t, s, "standup")[0].Next)
+}
+
+func TestServer_Schedule_OccurrencesCountTowardsMessageLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 3
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/standup", "Daily standup in 5 minutes", map[string]string{
+		"Cron": "55 9 * * *",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	// The first occurrence was counted when it was published, each following occurrence when it is scheduled
+	for i := 0; i < 3; i++ {
+		_, err := s.messageCache.db.Exec(`UPDATE messages SET time = ? WHERE topic = ? AND published = 0`, time.Now().Add(-time.Minute).Unix(), "standup")
+		require.Nil(t, err)
+		require.Nil(t, s.sendDelayedMessages())
+	}
+	response = request(t, s, "GET", "/standup/json?poll=1", "", nil)
+	require.Equal(t, 3, len(toMessages(t, response.Body.String())))
+
+	// The message limit was reached when scheduling the fourth occurrence, so the schedule was cancelled
+	require.Empty(t, toSchedulesForTopic(t, s, "standup"))
+	response = request(t, s, "GET", "/standup/json?poll=1&scheduled=1", "", nil)
+	require.Equal(t, 3, len(toMessages(t, response.Body.String())))
+	require.Equal(t, m.ID, toMessages(t, response.Body.String())[0].ID)
+}
+
+func TestServer_Schedule_SurvivesRestartAndCancel(t *testing.T) {
+	c := newTestConfig(t)
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/backups", "Check the backups", map[string]string{
+		"Recur": "FREQ=WEEKLY;BYDAY=MO;BYHOUR=8;BYMINUTE=0",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	s.closeDatabases()
+
+	// Schedule and pending occurrence are read from the cache after a restart
+	s = newTestServer(t, c)
+	schedules := toSchedulesForTopic(t, s, "backups")
+	require.Equal(t, 1, len(schedules))
+	require.Equal(t, m.Schedule, schedules[0].ID)
+	require.Equal(t, "0 8 * * 1", schedules[0].Cron)
+
+	// Cancel the schedule, which also deletes the pending occurrence
+	response = request(t, s, "DELETE", "/backups/schedules/"+m.Schedule, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, toSchedulesForTopic(t, s, "backups"))
+	response = request(t, s, "GET", "/backups/json?poll=1&scheduled=1", "", nil)
+	require.Equal(t, "", response.Body.String())
+
+	response = request(t, s, "DELETE", "/backups/schedules/"+m.Schedule, "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_Schedule_CancelRequiresWriteAccess(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionRead
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	response := request(t, s, "PUT", "/standup", "Standup", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Cron":          "@daily",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	response = request(t, s, "GET", "/standup/schedules", "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/standup/schedules/"+m.Schedule, "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/standup/schedules/"+m.Schedule, "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Schedule_Limit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorScheduleLimit = 2
+	s := newTestServer(t, c)
+
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/standup", "Standup", map[string]string{"Cron": "@daily"})
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/other", "Standup", map[string]string{"Cron": "@daily"})
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42911, toHTTPError(t, response.Body.String()).Code)
+
+	// Cancelling a schedule frees up the limit
+	schedules := toSchedulesForTopic(t, s, "standup")
+	response = request(t, s, "DELETE", "/standup/schedules/"+schedules[0].ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/other", "Standup", map[string]string{"Cron": "@daily"})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Schedule_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/standup", "Standup", map[string]string{"Cron": "61 * * * *"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40055, toHTTPError(t, response.Body.String()).Code)
+
+	for _, headers := range []map[string]string{
+		{"Cron": "@daily", "Delay": "1h"},
+		{"Cron": "@daily", "Cache": "no"},
+		{"Cron": "* * * * *", "Filename": "report.txt"}, // Next occurrence is before the attachment expires
+	} {
+		response = request(t, s, "PUT", "/standup", "Standup", headers)
+		require.Equal(t, 400, response.Code, headers)
+		require.Equal(t, 40056, toHTTPError(t, response.Body.String()).Code, headers)
+	}
+	require.Empty(t, toSchedulesForTopic(t, s, "standup"))
+	require.Equal(t, int64(0), s.fileCache.Size())
+}
+
+func toSchedulesForTopic(t *testing.T, s *Server, topic string) []*apiScheduleResponse {
+	response := request(t, s, "GET", "/"+topic+"/schedules", "", nil)
+	require.Equal(t, 200, response.Code)
+	var schedules []*apiScheduleResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&schedules))
+	return schedules
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/util"
+)
+
+// handleMessageSearch returns the cached messages of a topic whose title or message contain the ?q=... query,
+// newest first. Results can be paginated with ?limit= and ?offset=, and restricted with ?since= and ?until=
+// (Unix timestamps, or durations relative to now, e.g. 2h).
+func (s *Server) handleMessageSearch(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := fromContext[*topic](r, contextTopic)
+	if err != nil {
+		return err
+	}
+	query := readQueryParam(r, "q", "query")
+	if query == "" {
+		return errHTTPBadRequestSearchQueryMissing
+	}
+	limit, offset := searchLimitDefault, 0
+	if limitStr := readQueryParam(r, "limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > searchLimitMax {
+			return errHTTPBadRequest.Wrap("limit must be a number between 1 and %d", searchLimitMax)
+		}
+	}
+	if offsetStr := readQueryParam(r, "offset"); offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return errHTTPBadRequest.Wrap("offset must be a non-negative number")
+		}
+	}
+	since, err := parseSearchTime(readQueryParam(r, "since"), 0)
+	if err != nil {
+		return errHTTPBadRequest.Wrap("since must be a Unix timestamp or a duration, e.g. 2h")
+	}
+	until, err := parseSearchTime(readQueryParam(r, "until"), math.MaxInt64)
+	if err != nil {
+		return errHTTPBadRequest.Wrap("until must be a Unix timestamp or a duration, e.g. 2h")
+	}
+	messages, err := s.messageCache.SearchMessages(t.ID, query, since, until, limit, offset)
+	if err != nil {
+		return err
+	}
+	return s.writeJSON(w, &apiSearchResponse{
+		Messages: messages,
+		Offset:   offset,
+		Limit:    limit,
+	})
+}
+
+// parseSearchTime parses the ?since= and ?until= params of the search, which are either a Unix timestamp,
+// or a duration relative to now (e.g. 2h or 3d)
+func parseSearchTime(value string, defaultValue int64) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	} else if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return timestamp, nil
+	}
+	d, err := util.ParseDuration(strings.TrimPrefix(value, "-"))
+	if err != nil {
+		return 0, err
+	}
+	return time.Now().Add(-d).Unix(), nil
+}
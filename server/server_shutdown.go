@@ -0,0 +1,72 @@
+package server
+
+import (
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	tagShutdown = "shutdown"
+
+	shutdownPollInterval        = 100 * time.Millisecond
+	shutdownReconnectDelay      = 10 * time.Second // Added to the grace period, so clients reconnect after the restart
+	shutdownReconnectJitter     = 0.5              // Reconnect delays are randomized by ±50%, to avoid all clients reconnecting at once
+	shutdownDrainLogSubscribers = 5 * time.Second  // Interval in which the remaining subscribers are logged while draining
+)
+
+// Shutdown gracefully shuts down the server: New requests are rejected with HTTP 503, all subscribers are sent a
+// shutdown event with a suggested reconnect delay and are disconnected, and queued messages are written to the
+// message cache. It waits for the subscribers to disconnect for at most Config.ShutdownGracePeriod, and then
+// calls Stop, which closes all remaining connections.
+func (s *Server) Shutdown() {
+	s.drain()
+	if err := s.messageCache.Flush(); err != nil {
+		log.Tag(tagShutdown).Err(err).Warn("Cannot write queued messages to message cache")
+	}
+	s.Stop()
+	log.Tag(tagShutdown).Info("Server stopped")
+}
+
+// drain rejects new requests (see handle), ends all subscriptions, and waits until all subscribers are gone or
+// the grace period has passed
+func (s *Server) drain() {
+	if !s.draining.CompareAndSwap(false, true) {
+		return
+	}
+	log.Tag(tagShutdown).Info("Draining subscribers, waiting at most %s", s.config.ShutdownGracePeriod)
+	close(s.drainChan)
+	deadline := time.Now().Add(s.config.ShutdownGracePeriod)
+	lastLogged := time.Now()
+	for time.Now().Before(deadline) {
+		subscribers := s.subscriberCount()
+		if subscribers == 0 {
+			log.Tag(tagShutdown).Debug("All subscribers disconnected")
+			return
+		} else if time.Since(lastLogged) > shutdownDrainLogSubscribers {
+			log.Tag(tagShutdown).Info("Waiting for %d subscriber(s) to disconnect", subscribers)
+			lastLogged = time.Now()
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	log.Tag(tagShutdown).Info("Grace period passed, closing remaining %d subscriber connection(s)", s.subscriberCount())
+}
+
+// shutdownRetryAfter returns the time after which clients should reconnect, i.e. after the grace period, plus a
+// random delay to spread out the reconnects
+func (s *Server) shutdownRetryAfter() time.Duration {
+	return s.config.ShutdownGracePeriod + util.Jitter(shutdownReconnectDelay, shutdownReconnectJitter)
+}
+
+// subscriberCount returns the number of stream, WebSocket and gRPC subscribers across all topics
+func (s *Server) subscriberCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var subscribers int
+	for _, t := range s.topics {
+		subs, _ := t.Stats()
+		subscribers += subs
+	}
+	return subscribers
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Shutdown_DrainsStreamSubscribers(t *testing.T) {
+	c := newTestConfig(t)
+	c.ShutdownGracePeriod = 5 * time.Second
+	s := newTestServer(t, c)
+
+	jsonRR := httptest.NewRecorder()
+	sseRR := httptest.NewRecorder()
+	cancelJSON := subscribe(t, s, "/mytopic/json", jsonRR)
+	cancelSSE := subscribe(t, s, "/mytopic/sse", sseRR)
+	require.Equal(t, 2, s.subscriberCount())
+
+	// Subscribers are sent a shutdown event and disconnected, well before the grace period ends
+	start := time.Now()
+	s.drain()
+	require.Less(t, time.Since(start), c.ShutdownGracePeriod)
+	require.Equal(t, 0, s.subscriberCount())
+	cancelJSON()
+	cancelSSE()
+
+	messages := toMessages(t, jsonRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, shutdownEvent, messages[1].Event)
+	require.GreaterOrEqual(t, messages[1].RetryAfter, int64(10))
+	require.LessOrEqual(t, messages[1].RetryAfter, int64(20))
+
+	require.Contains(t, sseRR.Body.String(), "event: shutdown\nretry: ")
+}
+
+func TestServer_Shutdown_RejectsNewRequests(t *testing.T) {
+	c := newTestConfig(t)
+	c.ShutdownGracePeriod = time.Second
+	s := newTestServer(t, c)
+	s.drain()
+
+	response := request(t, s, "PUT", "/mytopic", "too late", nil)
+	require.Equal(t, 503, response.Code)
+	require.Equal(t, 50301, toHTTPError(t, response.Body.String()).Code)
+	retryAfter, err := strconv.Atoi(response.Header().Get("Retry-After"))
+	require.Nil(t, err)
+	require.GreaterOrEqual(t, retryAfter, 6)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 503, response.Code)
+}
+
+func TestServer_Shutdown_DrainsWebSocketSubscribers(t *testing.T) {
+	c := newTestConfig(t)
+	c.ShutdownGracePeriod = 5 * time.Second
+	s := newTestServer(t, c)
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/mytopic/ws", nil)
+	require.Nil(t, err)
+	defer conn.Close()
+	var m message
+	require.Nil(t, conn.ReadJSON(&m))
+	require.Equal(t, openEvent, m.Event)
+
+	go s.drain()
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.Nil(t, conn.ReadJSON(&m))
+	require.Equal(t, shutdownEvent, m.Event)
+	require.Equal(t, "mytopic", m.Topic)
+	require.Greater(t, m.RetryAfter, int64(0))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+	require.Eventually(t, func() bool {
+		return s.subscriberCount() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_Shutdown_FlushesQueuedMessages(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheBatchSize = 10
+	c.CacheBatchTimeout = time.Hour
+	s := newTestServer(t, c)
+	request(t, s, "PUT", "/mytopic", "queued", nil)
+	messages, err := s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(messages))
+
+	require.Nil(t, s.messageCache.Flush())
+	messages, err = s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "queued", messages[0].Message)
+}
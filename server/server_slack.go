@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Slack incoming webhook integration:
+//
+// Many tools can only send notifications to a Slack incoming webhook (https://api.slack.com/messaging/webhooks).
+// POST-ing the very same payload to /<topic>/slack translates it into an ntfy message, so that these tools can
+// target ntfy by only changing the webhook URL. The translation is best effort: the top-level text and the legacy
+// message attachments (https://api.slack.com/reference/messaging/attachments) are mapped to the message body,
+// title, click URL and priority. Blocks are not supported.
+
+const (
+	tagSlack = "slack"
+)
+
+// slackWebhookRequest represents the payload of a Slack incoming webhook
+type slackWebhookRequest struct {
+	Text        string                    `json:"text"`
+	IconEmoji   string                    `json:"icon_emoji"`
+	IconURL     string                    `json:"icon_url"`
+	Attachments []*slackWebhookAttachment `json:"attachments"`
+}
+
+type slackWebhookAttachment struct {
+	Fallback  string               `json:"fallback"`
+	Color     string               `json:"color"`
+	Pretext   string               `json:"pretext"`
+	Title     string               `json:"title"`
+	TitleLink string               `json:"title_link"`
+	Text      string               `json:"text"`
+	Fields    []*slackWebhookField `json:"fields"`
+}
+
+type slackWebhookField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// transformSlackJSON reads the Slack incoming webhook payload, and converts it to a regular publish request
+// to the topic, before passing it on to the next handler. This is meant to be used in combination with handlePublishSlack.
+func (s *Server) transformSlackJSON(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		req, err := readJSONWithLimit[slackWebhookRequest](r.Body, v.Limits().MessageSizeLimit*2, false) // 2x to account for JSON format overhead
+		if err != nil {
+			logvr(v, r).Tag(tagSlack).Err(err).Debug("Invalid Slack webhook request")
+			return err
+		}
+		title, body, click, priority := req.Translate()
+		if body == "" {
+			return errHTTPBadRequestSlackMessageInvalid
+		}
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/slack")
+		r.Body = io.NopCloser(strings.NewReader(body))
+		if title != "" {
+			r.Header.Set("X-Title", title)
+		}
+		if click != "" {
+			r.Header.Set("X-Click", click)
+		}
+		if priority != 0 {
+			r.Header.Set("X-Priority", strconv.Itoa(priority))
+		}
+		if tag := strings.Trim(req.IconEmoji, ":"); tag != "" {
+			r.Header.Set("X-Tags", tag)
+		}
+		if req.IconURL != "" {
+			r.Header.Set("X-Icon", req.IconURL)
+		}
+		return next(w, r, v)
+	}
+}
+
+// handlePublishSlack publishes the translated Slack webhook request (see transformSlackJSON), and responds
+// with "ok", like Slack does
+func (s *Server) handlePublishSlack(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if _, err := s.handlePublishInternal(r, v); err != nil {
+		minc(metricMessagesPublishedFailure)
+		return err
+	}
+	minc(metricMessagesPublishedSuccess)
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := io.WriteString(w, "ok")
+	return err
+}
+
+// Translate maps the Slack webhook payload to the title, body, click URL and priority of an ntfy message. The
+// title and click URL are taken from the first attachment that has them, and the priority is the highest priority
+// of all attachment colors (see slackColorToPriority).
+func (m *slackWebhookRequest) Translate() (title, body, click string, priority int) {
+	parts := make([]string, 0)
+	if text := strings.TrimSpace(m.Text); text != "" {
+		parts = append(parts, text)
+	}
+	for _, a := range m.Attachments {
+		if a == nil {
+			continue
+		}
+		if title == "" {
+			title = strings.TrimSpace(a.Title)
+		}
+		if click == "" {
+			click = a.TitleLink
+		}
+		priority = max(priority, slackColorToPriority(a.Color))
+		attachmentParts := make([]string, 0)
+		for _, part := range []string{a.Pretext, a.Text} {
+			if part = strings.TrimSpace(part); part != "" {
+				attachmentParts = append(attachmentParts, part)
+			}
+		}
+		for _, f := range a.Fields {
+			if f != nil && (f.Title != "" || f.Value != "") {
+				attachmentParts = append(attachmentParts, strings.TrimSpace(fmt.Sprintf("%s: %s", f.Title, f.Value)))
+			}
+		}
+		if len(attachmentParts) == 0 && strings.TrimSpace(a.Fallback) != "" {
+			attachmentParts = append(attachmentParts, strings.TrimSpace(a.Fallback))
+		}
+		parts = append(parts, attachmentParts...)
+	}
+	if len(parts) == 0 && title != "" {
+		parts = append(parts, title) // Title-only attachment, use the title as body
+		title = ""
+	}
+	return title, strings.Join(parts, "\n\n"), click, priority
+}
+
+// slackColorToPriority maps a Slack attachment color to a message priority: "danger" and reddish hex colors
+// map to high priority, all other colors to the default priority (0, i.e. not set)
+func slackColorToPriority(color string) int {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if color == "danger" {
+		return 4
+	}
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return 0
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0
+	}
+	red, green, blue := rgb>>16, (rgb>>8)&0xff, rgb&0xff
+	if red >= 0x80 && green < 0x60 && blue < 0x60 {
+		return 4
+	}
+	return 0
+}
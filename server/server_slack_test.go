@@ -0,0 +1,112 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestSlack_PublishText(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "POST", "/mytopic/slack", `{"text": "Deployment finished", "icon_emoji": ":rocket:"}`, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ok", response.Body.String())
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, "Deployment finished", m.Message)
+	require.Equal(t, "", m.Title)
+	require.Equal(t, 0, m.Priority)
+	require.Equal(t, []string{"rocket"}, m.Tags)
+}
+
+func TestSlack_PublishAttachments(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "POST", "/alerts/slack", `{
+		"text": "Alertmanager",
+		"attachments": [
+			{
+				"color": "danger",
+				"title": "[FIRING:1] DiskFull",
+				"title_link": "https://alertmanager.example.com/#/alerts",
+				"text": "Disk /dev/sda1 is 98% full",
+				"fields": [{"title": "host", "value": "nas01", "short": true}]
+			},
+			{
+				"color": "#36a64f",
+				"title": "Second title is ignored",
+				"pretext": "Also affected:",
+				"text": "backup job"
+			}
+		]
+	}`, nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "[FIRING:1] DiskFull", m.Title)
+	require.Equal(t, "Alertmanager\n\nDisk /dev/sda1 is 98% full\n\nhost: nas01\n\nAlso affected:\n\nbackup job", m.Message)
+	require.Equal(t, "https://alertmanager.example.com/#/alerts", m.Click)
+	require.Equal(t, 4, m.Priority)
+}
+
+func TestSlack_PublishAttachmentFallbackOnly(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "POST", "/mytopic/slack", `{"attachments": [{"fallback": "Build #12 failed", "color": "#ff0000"}]}`, nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Build #12 failed", m.Message)
+	require.Equal(t, 4, m.Priority)
+}
+
+func TestSlack_PublishInvalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "POST", "/mytopic/slack", `{"text": "not closed`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40024, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/mytopic/slack", `{"blocks": [{"type": "divider"}]}`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40058, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Empty(t, response.Body.String())
+}
+
+func TestSlack_PublishUnauthorized(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	response := request(t, s, "POST", "/mytopic/slack", `{"text": "hi"}`, nil)
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "POST", "/mytopic/slack", `{"text": "hi"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestSlack_ColorToPriority(t *testing.T) {
+	require.Equal(t, 4, slackColorToPriority("danger"))
+	require.Equal(t, 4, slackColorToPriority("#FF0000"))
+	require.Equal(t, 4, slackColorToPriority("#a30200"))
+	require.Equal(t, 4, slackColorToPriority("#e01e5a"))
+	require.Equal(t, 4, slackColorToPriority("f00"))
+	require.Equal(t, 0, slackColorToPriority("warning"))
+	require.Equal(t, 0, slackColorToPriority("good"))
+	require.Equal(t, 0, slackColorToPriority("#36a64f"))
+	require.Equal(t, 0, slackColorToPriority("#ff00ff"))
+	require.Equal(t, 0, slackColorToPriority("not a color"))
+	require.Equal(t, 0, slackColorToPriority(""))
+}
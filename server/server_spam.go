@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const (
+	tagSpam = "spam"
+
+	// DefaultSpamDuplicateWindow is the time window in which identical messages from different IP addresses are counted
+	DefaultSpamDuplicateWindow = time.Hour
+
+	spamBodiesLimit = 100000 // Max. number of tracked message bodies; if reached, the oldest one is forgotten
+)
+
+// spamBody tracks the IP addresses that published the same message (title and body) within the duplicate window,
+// see Config.SpamDuplicateThreshold. At most Config.SpamDuplicateThreshold senders are tracked per body.
+type spamBody struct {
+	key     string
+	first   time.Time
+	senders map[netip.Addr]struct{}
+}
+
+// spamReason classifies a message before it is delivered, and returns the reason why it is suspected spam, or an empty
+// string if it is not. Messages are suspected spam if they match one of the Config.SpamPatterns, or if the same title
+// and body were published from at least Config.SpamDuplicateThreshold IP addresses within the duplicate window. The
+// spam trap is only active if Config.SpamQuarantineTopic is set. Exempt IP addresses are never classified as spam.
+func (s *Server) spamReason(v *visitor, m *message) string {
+	if s.config.SpamQuarantineTopic == "" || m.Topic == s.config.SpamQuarantineTopic || m.Event != messageEvent {
+		return ""
+	} else if util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) {
+		return ""
+	}
+	for _, pattern := range s.config.SpamPatterns {
+		if pattern.MatchString(m.Title) || pattern.MatchString(m.Message) {
+			return fmt.Sprintf("message matches spam pattern %s", pattern.String())
+		}
+	}
+	if s.config.SpamDuplicateThreshold > 0 {
+		if senders := s.countSpamBodySenders(v.ip, m); senders >= s.config.SpamDuplicateThreshold {
+			return fmt.Sprintf("identical message published from %d IP addresses", senders)
+		}
+	}
+	return ""
+}
+
+// countSpamBodySenders records that the message was published from the given IP address, and returns the number of
+// distinct IP addresses that published the same title and body within the duplicate window
+func (s *Server) countSpamBodySenders(ip netip.Addr, m *message) int {
+	key := spamBodyKey(m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.spamBodies[key]
+	if !ok || time.Since(body.first) > s.config.SpamDuplicateWindow {
+		if !ok && len(s.spamBodies) >= spamBodiesLimit {
+			s.evictOldestSpamBody()
+		}
+		body = &spamBody{key: key, first: time.Now(), senders: make(map[netip.Addr]struct{})}
+		s.spamBodies[key] = body
+		s.spamBodyQueue = append(s.spamBodyQueue, body)
+	}
+	if len(body.senders) < s.config.SpamDuplicateThreshold {
+		body.senders[ip] = struct{}{}
+	}
+	return len(body.senders)
+}
+
+// spamBodyKey returns the hash of the message title and body, which identifies identical messages
+func spamBodyKey(m *message) string {
+	hash := sha256.Sum256([]byte(m.Title + "\n" + m.Message))
+	return hex.EncodeToString(hash[:])
+}
+
+// evictOldestSpamBody removes the oldest tracked message body. Bodies in the queue that have been replaced in the map
+// (because they expired and the same message was published again) are skipped. Must be called with s.mu held.
+func (s *Server) evictOldestSpamBody() {
+	for len(s.spamBodyQueue) > 0 {
+		body := s.spamBodyQueue[0]
+		s.spamBodyQueue = s.spamBodyQueue[1:]
+		if s.spamBodies[body.key] == body {
+			delete(s.spamBodies, body.key)
+			return
+		}
+	}
+}
+
+// quarantineMessage publishes a copy of a suspected spam message to the quarantine topic instead of its original
+// topic, so it can be reviewed. The copy is tagged with "spam" and the original topic. It is only delivered to
+// subscribers of the quarantine topic, and not forwarded anywhere else (Firebase, e-mail, etc.). It is always
+// cached, even if the publisher disabled caching, so that it can be reviewed later.
+func (s *Server) quarantineMessage(v *visitor, r *http.Request, m *message, reason string) error {
+	t, err := s.topicFromID(s.config.SpamQuarantineTopic)
+	if err != nil {
+		return err
+	}
+	qm := *m
+	qm.Topic = t.ID
+	qm.Tags = append(append([]string{}, m.Tags...), tagSpam, "topic:"+m.Topic)
+	if qm.Expires == 0 {
+		qm.Expires = time.Unix(qm.Time, 0).Add(s.config.CacheDuration).Unix()
+	}
+	logvrm(v, r, m).
+		Tag(tagSpam).
+		Fields(log.Context{
+			"spam_reason":           reason,
+			"spam_quarantine_topic": t.ID,
+		}).
+		Info("Quarantining suspected spam message")
+	if qm.Time <= time.Now().Unix() {
+		if err := t.Publish(v, &qm); err != nil {
+			return err
+		}
+	}
+	return s.messageCache.AddMessage(&qm)
+}
+
+// pruneSpamBodies removes the tracked message bodies that are older than the duplicate window. Since the queue is
+// ordered by time, only its expired head has to be looked at.
+func (s *Server) pruneSpamBodies() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.spamBodyQueue) > 0 && time.Since(s.spamBodyQueue[0].first) > s.config.SpamDuplicateWindow {
+		body := s.spamBodyQueue[0]
+		s.spamBodyQueue = s.spamBodyQueue[1:]
+		if s.spamBodies[body.key] == body {
+			delete(s.spamBodies, body.key)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestServer_Spam_PatternQuarantined(t *testing.T) {
+	c := newTestConfig(t)
+	c.SpamQuarantineTopic = "quarantine"
+	c.SpamPatterns = []*regexp.Regexp{regexp.MustCompile(`(?i)free bitcoin`)}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "Claim your FREE Bitcoin now", map[string]string{
+		"Tags": "moneybag",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "mytopic", m.Topic) // Publisher does not notice
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Empty(t, toMessages(t, response.Body.String()))
+
+	response = request(t, s, "GET", "/quarantine/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m.ID, messages[0].ID)
+	require.Equal(t, "quarantine", messages[0].Topic)
+	require.Equal(t, "Claim your FREE Bitcoin now", messages[0].Message)
+	require.Equal(t, []string{"moneybag", "spam", "topic:mytopic"}, messages[0].Tags)
+}
+
+func TestServer_Spam_PatternQuarantinedEvenIfNotCached(t *testing.T) {
+	c := newTestConfig(t)
+	c.SpamQuarantineTopic = "quarantine"
+	c.SpamPatterns = []*regexp.Regexp{regexp.MustCompile(`free bitcoin`)}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "free bitcoin", map[string]string{
+		"Cache": "no",
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/quarantine/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_Spam_NormalMessagePassesThrough(t *testing.T) {
+	c := newTestConfig(t)
+	c.SpamQuarantineTopic = "quarantine"
+	c.SpamPatterns = []*regexp.Regexp{regexp.MustCompile(`free bitcoin`)}
+	c.SpamDuplicateThreshold = 3
+	s := newTestServer(t, c)
+
+	for i := 0; i < 5; i++ { // Same IP address, so duplicates do not count
+		response := request(t, s, "PUT", "/mytopic", "backup finished", nil)
+		require.Equal(t, 200, response.Code)
+	}
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 5, len(toMessages(t, response.Body.String())))
+
+	response = request(t, s, "GET", "/quarantine/json?poll=1", "", nil)
+	require.Empty(t, toMessages(t, response.Body.String()))
+}
+
+func TestServer_Spam_DuplicateBodiesFromManyIPs(t *testing.T) {
+	c := newTestConfig(t)
+	c.SpamQuarantineTopic = "quarantine"
+	c.SpamDuplicateThreshold = 3
+	s := newTestServer(t, c)
+
+	for i := 1; i <= 4; i++ {
+		response := request(t, s, "PUT", fmt.Sprintf("/topic%d", i), "buy cheap watches", nil, func(r *http.Request) {
+			r.RemoteAddr = fmt.Sprintf("1.2.3.%d:1234", i)
+		})
+		require.Equal(t, 200, response.Code)
+	}
+
+	// The first two messages are delivered, the third and fourth are quarantined
+	for i, expected := range []int{1, 1, 0, 0} {
+		response := request(t, s, "GET", fmt.Sprintf("/topic%d/json?poll=1", i+1), "", nil)
+		require.Equal(t, expected, len(toMessages(t, response.Body.String())))
+	}
+	response := request(t, s, "GET", "/quarantine/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, []string{"spam", "topic:topic3"}, messages[0].Tags)
+	require.Equal(t, []string{"spam", "topic:topic4"}, messages[1].Tags)
+
+	// A different body is not affected
+	response = request(t, s, "PUT", "/topic5", "buy cheap watches!", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.5:1234"
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/topic5/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_Spam_ExemptIPs(t *testing.T) {
+	c := newTestConfig(t)
+	c.SpamQuarantineTopic = "quarantine"
+	c.SpamPatterns = []*regexp.Regexp{regexp.MustCompile(`free bitcoin`)}
+	c.VisitorRequestExemptIPAddrs = []netip.Prefix{netip.MustParsePrefix("9.9.9.9/32")}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "free bitcoin (just testing the spam trap)", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_CountSpamBodySenders_Limits(t *testing.T) {
+	c := newTestConfig(t)
+	c.SpamQuarantineTopic = "quarantine"
+	c.SpamDuplicateThreshold = 3
+	c.SpamDuplicateWindow = time.Hour
+	s := newTestServer(t, c)
+
+	// Senders are only tracked up to the threshold
+	m := newDefaultMessage("mytopic", "buy cheap watches")
+	for i := 1; i <= 10; i++ {
+		s.countSpamBodySenders(netip.MustParseAddr(fmt.Sprintf("1.2.3.%d", i)), m)
+	}
+	require.Equal(t, 3, len(s.spamBodies[spamBodyKey(m)].senders))
+
+	// The oldest body is forgotten if the limit is reached
+	ip := netip.MustParseAddr("1.2.3.4")
+	for i := 0; i < spamBodiesLimit; i++ {
+		s.countSpamBodySenders(ip, newDefaultMessage("mytopic", fmt.Sprintf("message %d", i)))
+	}
+	require.Equal(t, spamBodiesLimit, len(s.spamBodies))
+	require.NotContains(t, s.spamBodies, spamBodyKey(m))
+	require.Contains(t, s.spamBodies, spamBodyKey(newDefaultMessage("mytopic", "message 0")))
+
+	// Expired bodies are pruned
+	for _, body := range s.spamBodyQueue[:10] {
+		body.first = time.Now().Add(-2 * time.Hour)
+	}
+	s.pruneSpamBodies()
+	require.Equal(t, spamBodiesLimit-10, len(s.spamBodies))
+	require.Equal(t, spamBodiesLimit-10, len(s.spamBodyQueue))
+}
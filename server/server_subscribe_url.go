@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	tagSubscribeURL = "subscribe_url"
+
+	subscribeURLDefaultExpiry = 24 * time.Hour
+	subscribeURLMaxExpiry     = 30 * 24 * time.Hour // Signed URLs cannot be revoked, so they must not be valid forever
+)
+
+// handleSubscribeURLCreate mints a signed, time-limited subscribe URL for a single topic. The URL grants read access
+// to the topic until it expires, without an account or token (e.g. for sharing it with a contractor). Users can only
+// mint URLs for topics they can read themselves.
+func (s *Server) handleSubscribeURLCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiSubscribeURLRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !topicRegex.MatchString(req.Topic) {
+		return errHTTPBadRequestTopicInvalid
+	}
+	expires := time.Now().Add(subscribeURLDefaultExpiry)
+	if req.Expires != nil {
+		expires = time.Unix(*req.Expires, 0)
+	}
+	if !expires.After(time.Now()) || expires.After(time.Now().Add(subscribeURLMaxExpiry)) {
+		return errHTTPBadRequestSubscribeURLExpiresInvalid
+	}
+	u := v.User()
+	if err := s.userManager.Authorize(u, req.Topic, user.PermissionRead); err != nil {
+		return errHTTPForbidden
+	}
+	logvr(v, r).
+		Tag(tagSubscribeURL).
+		Fields(log.Context{
+			"topic":                 req.Topic,
+			"subscribe_url_expires": expires.Unix(),
+		}).
+		Debug("Creating signed subscribe URL for user %s", u.Name)
+	sig := s.subscribeURLSignature(req.Topic, expires.Unix())
+	response := &apiSubscribeURLResponse{
+		Topic:     req.Topic,
+		Expires:   expires.Unix(),
+		Signature: sig,
+	}
+	if s.config.BaseURL != "" {
+		response.URL = fmt.Sprintf("%s/%s/json?exp=%d&sig=%s", s.externalBaseURL(r), req.Topic, expires.Unix(), sig)
+	}
+	return s.writeJSON(w, response)
+}
+
+// authorizeSubscribeURL checks the ?sig= and ?exp= query parameters of a signed subscribe URL. It returns false if
+// there is no signature, so that the regular topic authorization applies. If there is one, it must be valid for
+// exactly the requested topic, and must not be expired.
+func (s *Server) authorizeSubscribeURL(r *http.Request, topics []*topic) (bool, error) {
+	sig := readQueryParam(r, "sig")
+	if sig == "" || s.config.SubscribeURLSecret == "" {
+		return false, nil
+	}
+	expires, err := strconv.ParseInt(readQueryParam(r, "exp"), 10, 64)
+	if err != nil || len(topics) != 1 {
+		return false, errHTTPForbidden
+	} else if !hmac.Equal([]byte(sig), []byte(s.subscribeURLSignature(topics[0].ID, expires))) {
+		return false, errHTTPForbidden
+	} else if time.Now().Unix() > expires {
+		return false, errHTTPUnauthorizedSubscribeURLExpired
+	}
+	return true, nil
+}
+
+// subscribeURLSignature returns the HMAC-SHA256 signature of the topic and expiry time, keyed with the server secret
+func (s *Server) subscribeURLSignature(topic string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(s.config.SubscribeURLSecret))
+	mac.Write([]byte(fmt.Sprintf("%s\n%d", topic, expires)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
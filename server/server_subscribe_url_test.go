@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_SubscribeURL_CreateAndSubscribe(t *testing.T) {
+	s := newTestServerWithSubscribeURLs(t)
+
+	// Mint a signed URL for a topic the user can read
+	response := request(t, s, "POST", "/v1/account/subscribe-url", `{"topic":"contractor"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	signed := toSubscribeURLResponse(t, response.Body.String())
+	require.Equal(t, "contractor", signed.Topic)
+	require.InDelta(t, time.Now().Add(subscribeURLDefaultExpiry).Unix(), signed.Expires, 5)
+	require.Equal(t, fmt.Sprintf("http://127.0.0.1:12345/contractor/json?exp=%d&sig=%s", signed.Expires, signed.Signature), signed.URL)
+
+	// Anonymous users cannot read the topic, unless they use the signed URL
+	request(t, s, "PUT", "/contractor", "job done", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	response = request(t, s, "GET", "/contractor/json?poll=1", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	query := fmt.Sprintf("exp=%d&sig=%s", signed.Expires, signed.Signature)
+	response = request(t, s, "GET", "/contractor/json?poll=1&"+query, "", nil)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "job done", messages[0].Message)
+
+	response = request(t, s, "GET", "/contractor/sse?poll=1&"+query, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Contains(t, response.Body.String(), "job done")
+
+	// The signature does not grant access to other topics, or to publishing
+	response = request(t, s, "GET", "/other/json?poll=1&"+query, "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/contractor,other/json?poll=1&"+query, "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/contractor?"+query, "spoofed", nil)
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_SubscribeURL_WebSocket(t *testing.T) {
+	s := newTestServerWithSubscribeURLs(t)
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+	expires := time.Now().Add(time.Hour).Unix()
+	wsURL := fmt.Sprintf("ws%s/contractor/ws?exp=%d&sig=%s", strings.TrimPrefix(httpServer.URL, "http"), expires, s.subscribeURLSignature("contractor", expires))
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Nil(t, err)
+	defer conn.Close()
+	var m message
+	require.Nil(t, conn.ReadJSON(&m))
+	require.Equal(t, openEvent, m.Event)
+}
+
+func TestServer_SubscribeURL_ExpiredOrTampered(t *testing.T) {
+	s := newTestServerWithSubscribeURLs(t)
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	response := request(t, s, "GET", fmt.Sprintf("/contractor/json?poll=1&exp=%d&sig=%s", expired, s.subscribeURLSignature("contractor", expired)), "", nil)
+	require.Equal(t, 401, response.Code)
+	require.Equal(t, 40102, toHTTPError(t, response.Body.String()).Code)
+
+	// Extending the expiry invalidates the signature
+	expires := time.Now().Add(time.Hour).Unix()
+	sig := s.subscribeURLSignature("contractor", expires)
+	response = request(t, s, "GET", fmt.Sprintf("/contractor/json?poll=1&exp=%d&sig=%s", expires+3600, sig), "", nil)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40301, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/contractor/json?poll=1&exp=notanumber&sig="+sig, "", nil)
+	require.Equal(t, 403, response.Code)
+
+	// Signatures from a server with a different secret are rejected
+	s.config.SubscribeURLSecret = strings.Repeat("y", 32)
+	response = request(t, s, "GET", fmt.Sprintf("/contractor/json?poll=1&exp=%d&sig=%s", expires, sig), "", nil)
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_SubscribeURL_BehindProxyForwardedProtoAndHost(t *testing.T) {
+	s := newTestServerWithSubscribeURLs(t)
+	s.config.BehindProxy = true
+	response := request(t, s, "POST", "/v1/account/subscribe-url", `{"topic":"contractor"}`, map[string]string{
+		"Authorization":     util.BasicAuth("phil", "phil"),
+		"X-Forwarded-For":   "1.2.3.4",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "ntfy.example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	signed := toSubscribeURLResponse(t, response.Body.String())
+	require.Equal(t, fmt.Sprintf("https://ntfy.example.com/contractor/json?exp=%d&sig=%s", signed.Expires, signed.Signature), signed.URL)
+}
+
+func TestServer_SubscribeURL_CreateNotAllowed(t *testing.T) {
+	s := newTestServerWithSubscribeURLs(t)
+	headers := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Anonymous users cannot mint URLs
+	response := request(t, s, "POST", "/v1/account/subscribe-url", `{"topic":"contractor"}`, nil)
+	require.Equal(t, 401, response.Code)
+
+	// Users cannot mint URLs for topics they cannot read
+	response = request(t, s, "POST", "/v1/account/subscribe-url", `{"topic":"secret"}`, headers)
+	require.Equal(t, 403, response.Code)
+
+	// Expiry must be in the future, and not too far
+	response = request(t, s, "POST", "/v1/account/subscribe-url", fmt.Sprintf(`{"topic":"contractor","expires":%d}`, time.Now().Add(-time.Hour).Unix()), headers)
+	require.Equal(t, 40070, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/account/subscribe-url", fmt.Sprintf(`{"topic":"contractor","expires":%d}`, time.Now().Add(subscribeURLMaxExpiry+time.Hour).Unix()), headers)
+	require.Equal(t, 40070, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/account/subscribe-url", `{"topic":"not/valid"}`, headers)
+	require.Equal(t, 40009, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_SubscribeURL_Disabled(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	response := request(t, s, "POST", "/v1/account/subscribe-url", `{"topic":"contractor"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 404, response.Code)
+}
+
+func newTestServerWithSubscribeURLs(t *testing.T) *Server {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.BaseURL = "http://127.0.0.1:12345"
+	c.SubscribeURLSecret = strings.Repeat("x", 32)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "contractor", user.PermissionReadWrite))
+	return s
+}
+
+func toSubscribeURLResponse(t *testing.T, s string) *apiSubscribeURLResponse {
+	var r apiSubscribeURLResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&r))
+	return &r
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
@@ -10,11 +11,13 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/user"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime/debug"
 	"strings"
 	"sync"
@@ -23,6 +26,7 @@ import (
 	"time"
 
 	"github.com/SherClockHolmes/webpush-go"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
@@ -33,6 +37,70 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+func TestServer_CORSAllowedOrigins(t *testing.T) {
+	c := newTestConfig(t)
+	c.CORSAllowedOrigins = []string{"https://dashboard.example.com"}
+	s := newTestServer(t, c)
+	allowed := map[string]string{"Origin": "https://dashboard.example.com"}
+	disallowed := map[string]string{"Origin": "https://evil.example.com"}
+
+	// Preflight
+	rr := request(t, s, "OPTIONS", "/mytopic", "", allowed)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "https://dashboard.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, PUT, POST, PATCH, DELETE", rr.Header().Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "Origin", rr.Header().Get("Vary"))
+
+	rr = request(t, s, "OPTIONS", "/mytopic", "", disallowed)
+	require.Equal(t, 200, rr.Code)
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Methods"))
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Headers"))
+
+	// Publish
+	rr = request(t, s, "PUT", "/mytopic", "from the dashboard", allowed)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "https://dashboard.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	rr = request(t, s, "PUT", "/mytopic", "from somewhere else", disallowed)
+	require.Equal(t, 200, rr.Code) // Not rejected, just no CORS headers
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+
+	rr = request(t, s, "PUT", "/mytopic", "no origin", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// Subscribe (poll)
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", allowed)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "https://dashboard.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, 3, len(toMessages(t, rr.Body.String())))
+
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", disallowed)
+	require.Equal(t, 200, rr.Code)
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// Errors
+	rr = request(t, s, "GET", "/file/doesnotexist", "", allowed)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, "https://dashboard.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestServer_CORSAllowedOrigins_Empty(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	rr := request(t, s, "OPTIONS", "/mytopic", "", map[string]string{"Origin": "https://evil.example.com"})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Headers"))
+
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Origin": "https://evil.example.com"})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, rr.Header().Get("Vary"))
+}
+
 func TestServer_PublishAndPoll(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -70,7 +138,7 @@ func TestServer_PublishAndPoll(t *testing.T) {
 func TestServer_PublishWithFirebase(t *testing.T) {
 	sender := newTestFirebaseSender(10)
 	s := newTestServer(t, newTestConfig(t))
-	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true}, nil, nil)
 
 	response := request(t, s, "PUT", "/mytopic", "my first message", nil)
 	msg1 := toMessage(t, response.Body.String())
@@ -189,6 +257,226 @@ func TestServer_PublishAndSubscribe(t *testing.T) {
 	require.Equal(t, []string{"tag1", "tag 2", "tag3"}, messages[2].Tags)
 }
 
+func TestServer_PublishWithCollapseKey_Backlog(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	// Device is subscribed, live delivery is unaffected by collapse keys
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/status/json", subscribeRR)
+	for _, publish := range []struct{ message, collapseKey string }{
+		{"cpu 10%", "cpu"},
+		{"disk 50%", "disk"},
+		{"cpu 20%", "cpu"},
+	} {
+		response := request(t, s, "PUT", "/status", publish.message, map[string]string{
+			"X-Collapse-Key": publish.collapseKey,
+		})
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, publish.collapseKey, toMessage(t, response.Body.String()).CollapseKey)
+	}
+	time.Sleep(200 * time.Millisecond)
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 4, len(messages)) // open + 3 messages
+	require.Equal(t, "cpu", messages[1].CollapseKey)
+
+	// Device is offline, more messages arrive
+	for _, publish := range []struct{ message, collapseKey string }{
+		{"backup finished", ""},
+		{"cpu 90%", "cpu"},
+		{"disk 55%", "disk"},
+		{"reboot scheduled", ""},
+		{"cpu 95%", "cpu"},
+	} {
+		response := request(t, s, "PUT", "/status", publish.message, map[string]string{
+			"Collapse": publish.collapseKey,
+		})
+		require.Equal(t, 200, response.Code)
+	}
+
+	time.Sleep(200 * time.Millisecond) // Publishing is done asynchronously, this avoids races
+
+	// Device reconnects and only gets the latest message per collapse key, in order
+	subscribeRR = httptest.NewRecorder()
+	subscribeCancel = subscribe(t, s, "/status/json?since=all", subscribeRR)
+	time.Sleep(200 * time.Millisecond)
+	subscribeCancel()
+	messages = toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "backup finished", messages[1].Message)
+	require.Equal(t, "disk 55%", messages[2].Message)
+	require.Equal(t, "reboot scheduled", messages[3].Message)
+	require.Equal(t, "cpu 95%", messages[4].Message)
+
+	// Polling works the same way
+	response := request(t, s, "GET", "/status/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, "cpu 95%", messages[3].Message)
+}
+
+func TestServer_PublishWithCollapseKey_MultipleTopics(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	ids := make([]string, 0)
+	for _, topic := range []string{"server1", "server2", "server1"} {
+		response := request(t, s, "PUT", "/"+topic, "status of "+topic, map[string]string{
+			"X-Collapse-Key": "status",
+		})
+		require.Equal(t, 200, response.Code)
+		ids = append(ids, toMessage(t, response.Body.String()).ID)
+	}
+
+	// Collapse keys are per topic
+	response := request(t, s, "GET", "/server1,server2/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.ElementsMatch(t, []string{ids[1], ids[2]}, []string{messages[0].ID, messages[1].ID})
+}
+
+func TestServer_PublishWithCollapseKey_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/status", "cpu 10%", map[string]string{
+		"X-Collapse-Key": "cpu load",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40065, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/status", "cpu 10%", map[string]string{
+		"X-Collapse-Key": strings.Repeat("x", 65),
+	})
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_PublishWithCollapseKey_JSON(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/", `{"topic":"status","message":"cpu 10%","collapse_key":"host1:cpu"}`, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "host1:cpu", toMessage(t, response.Body.String()).CollapseKey)
+}
+
+func TestServer_PriorityOrderedTopics_Poll(t *testing.T) {
+	c := newTestConfig(t)
+	c.PriorityOrderedTopics = []string{"triage-*"}
+	s := newTestServer(t, c)
+
+	for _, topic := range []string{"triage-ops", "other"} {
+		for _, publish := range []struct{ message, priority string }{
+			{"disk almost full", "4"},
+			{"weekly report", "2"},
+			{"backup done", ""},
+			{"database is down", "5"},
+			{"certificate expires soon", "4"},
+		} {
+			response := request(t, s, "PUT", "/"+topic, publish.message, map[string]string{
+				"Priority": publish.priority,
+			})
+			require.Equal(t, 200, response.Code)
+		}
+	}
+
+	// Configured topic: highest priority first, then by time
+	response := request(t, s, "GET", "/triage-ops/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, "database is down", messages[0].Message)
+	require.Equal(t, "disk almost full", messages[1].Message)
+	require.Equal(t, "certificate expires soon", messages[2].Message)
+	require.Equal(t, "backup done", messages[3].Message)
+	require.Equal(t, "weekly report", messages[4].Message)
+
+	// Filters still apply
+	response = request(t, s, "GET", "/triage-ops/json?poll=1&priority=4,5", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "database is down", messages[0].Message)
+
+	// Other topics, and mixed polls, are ordered by time
+	response = request(t, s, "GET", "/other/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, "disk almost full", messages[0].Message)
+	require.Equal(t, "certificate expires soon", messages[4].Message)
+
+	response = request(t, s, "GET", "/triage-ops,other/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 10, len(messages))
+	require.NotEqual(t, "database is down", messages[0].Message)
+}
+
+func TestServer_PriorityOrderedTopics_StreamIsTimeOrdered(t *testing.T) {
+	c := newTestConfig(t)
+	c.PriorityOrderedTopics = []string{"triage"}
+	s := newTestServer(t, c)
+
+	for _, priority := range []string{"2", "5", "4"} {
+		response := request(t, s, "PUT", "/triage", "priority "+priority, map[string]string{
+			"Priority": priority,
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	time.Sleep(200 * time.Millisecond) // Publishing is done asynchronously, this avoids races
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/triage/json?since=all", subscribeRR)
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, "priority 2", messages[1].Message)
+	require.Equal(t, "priority 5", messages[2].Message)
+	require.Equal(t, "priority 4", messages[3].Message)
+}
+
+func TestServer_Publish_EmojiTagMapFile(t *testing.T) {
+	c := newTestConfig(t)
+	c.EmojiTagMapFile = filepath.Join(t.TempDir(), "tags.json")
+	require.Nil(t, os.WriteFile(c.EmojiTagMapFile, []byte(`{"deploy":"🚀","db":"database"}`), 0600))
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "deployed", map[string]string{
+		"Tags": "deploy,db,warning,other",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, []string{"🚀", "database", "warning", "other"}, toMessage(t, response.Body.String()).Tags)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, []string{"🚀", "database", "warning", "other"}, messages[0].Tags)
+
+	response = request(t, s, "GET", "/config.js", "", nil)
+	require.Contains(t, response.Body.String(), `"enable_emoji_tags": true`)
+}
+
+func TestServer_Publish_EmojiTagsDisabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.EnableEmojiTags = false
+	c.EmojiTagMapFile = filepath.Join(t.TempDir(), "tags.json")
+	require.Nil(t, os.WriteFile(c.EmojiTagMapFile, []byte(`{"deploy":"🚀"}`), 0600))
+	s := newTestServer(t, c)
+
+	// Tags pass through verbatim
+	response := request(t, s, "PUT", "/mytopic", "deployed", map[string]string{
+		"Tags": "deploy,warning",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, []string{"deploy", "warning"}, toMessage(t, response.Body.String()).Tags)
+
+	response = request(t, s, "GET", "/config.js", "", nil)
+	require.Contains(t, response.Body.String(), `"enable_emoji_tags": false`)
+}
+
+func TestServer_Publish_EmojiTagMapFile_Invalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.EmojiTagMapFile = filepath.Join(t.TempDir(), "tags.json")
+	require.Nil(t, os.WriteFile(c.EmojiTagMapFile, []byte(`["deploy"]`), 0600))
+	_, err := New(c)
+	require.Error(t, err)
+}
+
 func TestServer_Publish_Disallowed_Topic(t *testing.T) {
 	c := newTestConfig(t)
 	c.DisallowedTopics = []string{"about", "time", "this", "got", "added"}
@@ -202,6 +490,167 @@ func TestServer_Publish_Disallowed_Topic(t *testing.T) {
 	require.Equal(t, 40010, toHTTPError(t, rr.Body.String()).Code)
 }
 
+func TestServer_DisallowedTopicPatterns(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.DisallowedTopicPatterns = []*regexp.Regexp{regexp.MustCompile(`(?i)^admin`), regexp.MustCompile(`official$`)}
+	c.VisitorAuthFailureLimitBurst = 10
+	s := newTestServer(t, c)
+
+	// Non-matching topics work as usual
+	for _, topic := range []string{"mytopic", "sysadmin", "official-ish"} {
+		rr := request(t, s, "PUT", "/"+topic, "hi", nil)
+		require.Equal(t, 200, rr.Code, topic)
+		rr = request(t, s, "GET", "/"+topic+"/json?poll=1", "", nil)
+		require.Equal(t, 200, rr.Code, topic)
+	}
+
+	// Matching topics are rejected on all topic endpoints
+	for _, path := range []string{"/admin", "/ADMIN-alerts", "/ntfy-official", "/admin/publish?m=hi"} {
+		method := "PUT"
+		if strings.Contains(path, "?") {
+			method = "GET"
+		}
+		rr := request(t, s, method, path, "hi", nil)
+		require.Equal(t, 403, rr.Code, path)
+		require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code, path)
+	}
+	for _, path := range []string{"/admin/json?poll=1", "/mytopic,admin/sse?poll=1", "/admin/raw?poll=1", "/admin/auth"} {
+		rr := request(t, s, "GET", path, "", nil)
+		require.Equal(t, 403, rr.Code, path)
+		require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code, path)
+	}
+	_, exists := s.topics["admin"]
+	require.False(t, exists)
+
+	// Disallowed topics are rejected before authentication, so bad credentials are not even checked
+	for i := 0; i < 15; i++ {
+		rr := request(t, s, "PUT", "/admin", "hi", map[string]string{
+			"Authorization": util.BasicAuth("phil", "incorrect"),
+		})
+		require.Equal(t, 403, rr.Code)
+		require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+	}
+	rr := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("phil", "incorrect"),
+	})
+	require.Equal(t, 401, rr.Code) // Not 429, the auth failure limiter was never touched
+
+	// Server paths are not topics, and are not affected
+	c.DisallowedTopicPatterns = []*regexp.Regexp{regexp.MustCompile(`.*`)}
+	rr = request(t, s, "GET", "/v1/health", "", nil)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/stats", "", nil)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 403, rr.Code)
+}
+
+func TestServer_Publish_RequireTitle(t *testing.T) {
+	c := newTestConfig(t)
+	c.RequireTitleTopics = []string{"alerts"}
+	s := newTestServer(t, c)
+
+	rr := request(t, s, "PUT", "/alerts", "disk full", map[string]string{"Title": "Disk alert"})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "Disk alert", toMessage(t, rr.Body.String()).Title)
+
+	rr = request(t, s, "PUT", "/alerts", "disk full", nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40057, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/", `{"topic":"alerts","message":"disk full"}`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40057, toHTTPError(t, rr.Body.String()).Code)
+
+	// Other topics are not affected
+	rr = request(t, s, "PUT", "/mytopic", "disk full", nil)
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Disk alert", messages[0].Title)
+}
+
+func TestServer_Publish_DryRun(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 1
+	s := newTestServer(t, c)
+
+	rr := request(t, s, "PUT", "/mytopic?dry=1", "disk full", map[string]string{
+		"Title":    "Disk alert",
+		"Priority": "high",
+		"Tags":     "warning,disk",
+		"Delay":    "1h",
+		"Actions":  "view, Open dashboard, https://dashboard.example.com",
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Contains(t, rr.Body.String(), `"dry":true`)
+	m := toMessage(t, rr.Body.String())
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, "disk full", m.Message)
+	require.Equal(t, "Disk alert", m.Title)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, []string{"warning", "disk"}, m.Tags)
+	require.Greater(t, m.Time, time.Now().Add(59*time.Minute).Unix())
+	require.Equal(t, 1, len(m.Actions))
+	require.Equal(t, "Open dashboard", m.Actions[0].Label)
+
+	// Same with the X-Dry-Run header
+	rr = request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"X-Dry-Run": "1"})
+	require.Equal(t, 200, rr.Code)
+	require.Contains(t, rr.Body.String(), `"dry":true`)
+
+	// Nothing was stored, and dry runs do not count against the daily message limit
+	rr = request(t, s, "GET", "/mytopic/json?poll=1&scheduled=1", "", nil)
+	require.Equal(t, 0, len(toMessages(t, rr.Body.String())))
+	rr = request(t, s, "PUT", "/mytopic", "real message", nil)
+	require.Equal(t, 200, rr.Code)
+	require.NotContains(t, rr.Body.String(), `"dry"`)
+	rr = request(t, s, "PUT", "/mytopic", "over the limit", nil)
+	require.Equal(t, 429, rr.Code)
+
+	// Limits are still checked
+	rr = request(t, s, "PUT", "/mytopic?dry=1", "over the limit", nil)
+	require.Equal(t, 429, rr.Code)
+}
+
+func TestServer_Publish_DryRun_SameErrors(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, headers := range []map[string]string{
+		{"Delay": "not a delay"},
+		{"Actions": `[{"action":"invalid"}]`},
+		{"Priority": "extreme"},
+	} {
+		rr := request(t, s, "PUT", "/mytopic", "hi", headers)
+		require.Equal(t, 400, rr.Code)
+		dryHeaders := map[string]string{"X-Dry-Run": "yes"}
+		for k, v := range headers {
+			dryHeaders[k] = v
+		}
+		dry := request(t, s, "PUT", "/mytopic", "hi", dryHeaders)
+		require.Equal(t, 400, dry.Code)
+		require.Equal(t, toHTTPError(t, rr.Body.String()).Code, toHTTPError(t, dry.Body.String()).Code)
+	}
+}
+
+func TestServer_Publish_DryRun_Attachment(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentFileSizeLimit = 6000
+	s := newTestServer(t, c)
+
+	rr := request(t, s, "PUT", "/mytopic?dry=1", "text file!"+util.RandomString(4990), nil) // > 4096
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	require.Equal(t, "attachment.txt", m.Attachment.Name)
+	require.Equal(t, int64(5000), m.Attachment.Size)
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, m.ID))
+
+	rr = request(t, s, "PUT", "/mytopic?dry=1", util.RandomString(7000), nil)
+	require.Equal(t, 413, rr.Code)
+	require.Equal(t, 41301, toHTTPError(t, rr.Body.String()).Code)
+}
+
 func TestServer_StaticSites(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -374,79 +823,223 @@ func TestServer_PublishNoCache(t *testing.T) {
 	require.Empty(t, messages)
 }
 
-func TestServer_PublishAt(t *testing.T) {
-	t.Parallel()
-	s := newTestServer(t, newTestConfig(t))
+func TestServer_PublishNoCacheTopics(t *testing.T) {
+	c := newTestConfig(t)
+	c.NoCacheTopics = []string{"telemetry-*", "heartbeat"}
+	s := newTestServer(t, c)
+	sender := newTestFirebaseSender(10)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true}, nil, nil)
 
-	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
-		"In": "1h",
-	})
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/telemetry-cpu/json", subscribeRR)
+	response := request(t, s, "PUT", "/telemetry-cpu", "cpu at 42%", nil)
 	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(0), toMessage(t, response.Body.String()).Expires)
+	require.Equal(t, 200, request(t, s, "PUT", "/heartbeat", "still alive", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/telemetry", "not matched by pattern", nil).Code)
+	waitFor(t, func() bool {
+		return len(sender.Messages()) == 3
+	})
+	subscribeCancel()
 
-	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
-	messages := toMessages(t, response.Body.String())
-	require.Equal(t, 0, len(messages))
-
-	// Update message time to the past
-	fakeTime := time.Now().Add(-10 * time.Second).Unix()
-	_, err := s.messageCache.db.Exec(`UPDATE messages SET time=?`, fakeTime)
+	// Live subscribers and Firebase receive the message
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "cpu at 42%", messages[1].Message)
+	require.Equal(t, "cpu at 42%", sender.Messages()[0].Data["message"])
+
+	// Nothing is cached, or counted as cached
+	response = request(t, s, "GET", "/telemetry-cpu,heartbeat/json?poll=1&since=all", "", nil)
+	require.Empty(t, toMessages(t, response.Body.String()))
+	response = request(t, s, "GET", "/telemetry/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+	count, err := s.messageCache.MessagesCount()
 	require.Nil(t, err)
+	require.Equal(t, 1, count)
 
-	// Trigger delayed message sending
-	require.Nil(t, s.sendDelayedMessages())
-	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
-	messages = toMessages(t, response.Body.String())
-	require.Equal(t, 1, len(messages))
-	require.Equal(t, "a message", messages[0].Message)
-	require.Equal(t, netip.Addr{}, messages[0].Sender) // Never return the sender!
-
-	messages, err = s.messageCache.Messages("mytopic", sinceAllMessages, true)
-	require.Nil(t, err)
-	require.Equal(t, 1, len(messages))
-	require.Equal(t, "a message", messages[0].Message)
-	require.Equal(t, "9.9.9.9", messages[0].Sender.String()) // It's stored in the DB though!
+	// Delayed messages require the cache
+	response = request(t, s, "PUT", "/heartbeat", "later", map[string]string{"In": "1h"})
+	require.Equal(t, 40002, toHTTPError(t, response.Body.String()).Code)
 }
 
-func TestServer_PublishAt_FromUser(t *testing.T) {
-	t.Parallel()
-	s := newTestServer(t, newTestConfigWithAuthFile(t))
+func TestServer_PublishStripANSI(t *testing.T) {
+	c := newTestConfig(t)
+	c.StripANSI = true
+	s := newTestServer(t, c)
 
-	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
-	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
-		"Authorization": util.BasicAuth("phil", "phil"),
-		"In":            "1h",
-	})
+	response := request(t, s, "PUT", "/mytopic", "\x1b[1;31mERROR:\x1b[0m disk full", nil)
 	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ERROR: disk full", toMessage(t, response.Body.String()).Message)
 
-	// Message doesn't show up immediately
 	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
 	messages := toMessages(t, response.Body.String())
-	require.Equal(t, 0, len(messages))
-
-	// Update message time to the past
-	fakeTime := time.Now().Add(-10 * time.Second).Unix()
-	_, err := s.messageCache.db.Exec(`UPDATE messages SET time=?`, fakeTime)
-	require.Nil(t, err)
-
-	// Trigger delayed message sending
-	require.Nil(t, s.sendDelayedMessages())
-	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
-	messages = toMessages(t, response.Body.String())
-	require.Equal(t, 1, len(messages))
-	require.Equal(t, fakeTime, messages[0].Time)
-	require.Equal(t, "a message", messages[0].Message)
-
-	messages, err = s.messageCache.Messages("mytopic", sinceAllMessages, true)
-	require.Nil(t, err)
 	require.Equal(t, 1, len(messages))
-	require.Equal(t, "a message", messages[0].Message)
-	require.True(t, strings.HasPrefix(messages[0].User, "u_"))
+	require.Equal(t, "ERROR: disk full", messages[0].Message)
 }
 
-func TestServer_PublishAt_Expires(t *testing.T) {
+func TestServer_PublishStripANSI_Disabled(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
-	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+	response := request(t, s, "PUT", "/mytopic", "\x1b[1;31mERROR:\x1b[0m disk full", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "\x1b[1;31mERROR:\x1b[0m disk full", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_PublishMarkdownSanitizeSafe(t *testing.T) {
+	c := newTestConfig(t)
+	c.MarkdownSanitizePolicy = MarkdownSanitizePolicySafe
+	s := newTestServer(t, c)
+
+	body := "**Alert** <script>alert(1)</script><img src=\"x.png\" onerror=\"alert(2)\"> [details](javascript:alert(3))"
+	response := request(t, s, "PUT", "/mytopic", body, map[string]string{"Markdown": "yes"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `**Alert** <img src="x.png"> [details](#)`, toMessage(t, response.Body.String()).Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, `**Alert** <img src="x.png"> [details](#)`, messages[0].Message)
+
+	// Plain text messages are never rendered as HTML, so they are not touched
+	response = request(t, s, "PUT", "/mytopic", body, nil)
+	require.Equal(t, body, toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_PublishMarkdownSanitizeStrict(t *testing.T) {
+	c := newTestConfig(t)
+	c.MarkdownSanitizePolicy = MarkdownSanitizePolicyStrict
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "Backup <b>done</b> > see [log](https://example.com/log)", map[string]string{"Markdown": "yes"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Backup done > see [log](https://example.com/log)", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_PublishMarkdownSanitize_DataTable(t *testing.T) {
+	c := newTestConfig(t)
+	c.MarkdownSanitizePolicy = MarkdownSanitizePolicySafe
+	s := newTestServer(t, c)
+
+	// The data table is rendered into the message after the body is read, and must be sanitized as well
+	response := request(t, s, "PUT", "/mytopic?data-table=1", "Backup report", map[string]string{
+		"Data": `{"host":"<img src=x onerror=alert(1)>"}`,
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Backup report\n\n| Key | Value |\n|-----|-------|\n| host | <img src=\"x\"> |", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_PublishMarkdownSanitize_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "<b>bold</b><script>alert(1)</script>", map[string]string{"Markdown": "yes"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "<b>bold</b><script>alert(1)</script>", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_SubscribeMarkdownStrip(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic", "**Backup** failed, see [logs](https://example.com/logs)", map[string]string{"Markdown": "yes"})
+	request(t, s, "PUT", "/mytopic", "**not markdown**", nil)
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&markdown=strip", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "Backup failed, see logs (https://example.com/logs)", messages[0].Message)
+	require.Equal(t, "", messages[0].ContentType)
+	require.Equal(t, "**not markdown**", messages[1].Message)
+
+	response = request(t, s, "GET", "/mytopic/raw?poll=1", "", map[string]string{"X-Markdown": "strip"})
+	require.Equal(t, "Backup failed, see logs (https://example.com/logs)\n**not markdown**\n", response.Body.String())
+
+	// Other subscribers still get the Markdown
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, "**Backup** failed, see [logs](https://example.com/logs)", messages[0].Message)
+	require.Equal(t, "text/markdown", messages[0].ContentType)
+}
+
+func TestServer_SubscribeMarkdownStrip_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&markdown=html", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40069, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishAt(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"In": "1h",
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 0, len(messages))
+
+	// Update message time to the past
+	fakeTime := time.Now().Add(-10 * time.Second).Unix()
+	_, err := s.messageCache.db.Exec(`UPDATE messages SET time=?`, fakeTime)
+	require.Nil(t, err)
+
+	// Trigger delayed message sending
+	require.Nil(t, s.sendDelayedMessages())
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "a message", messages[0].Message)
+	require.Equal(t, netip.Addr{}, messages[0].Sender) // Never return the sender!
+
+	messages, err = s.messageCache.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "a message", messages[0].Message)
+	require.Equal(t, "9.9.9.9", messages[0].Sender.String()) // It's stored in the DB though!
+}
+
+func TestServer_PublishAt_FromUser(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"In":            "1h",
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Message doesn't show up immediately
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 0, len(messages))
+
+	// Update message time to the past
+	fakeTime := time.Now().Add(-10 * time.Second).Unix()
+	_, err := s.messageCache.db.Exec(`UPDATE messages SET time=?`, fakeTime)
+	require.Nil(t, err)
+
+	// Trigger delayed message sending
+	require.Nil(t, s.sendDelayedMessages())
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, fakeTime, messages[0].Time)
+	require.Equal(t, "a message", messages[0].Message)
+
+	messages, err = s.messageCache.Messages("mytopic", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "a message", messages[0].Message)
+	require.True(t, strings.HasPrefix(messages[0].User, "u_"))
+}
+
+func TestServer_PublishAt_Expires(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
 		"In": "2 days",
 	})
 	require.Equal(t, 200, response.Code)
@@ -455,6 +1048,74 @@ func TestServer_PublishAt_Expires(t *testing.T) {
 	require.True(t, m.Expires < time.Now().Add(12*time.Hour+48*time.Hour+time.Minute).Unix())
 }
 
+func TestServer_Publish_Expires(t *testing.T) {
+	requireExpires := func(t *testing.T, m *message, d time.Duration) {
+		expected := time.Unix(m.Time, 0).Add(d).Unix()
+		require.Equal(t, expected, m.Expires)
+	}
+
+	t.Run("global cache duration", func(t *testing.T) {
+		c := newTestConfig(t)
+		c.CacheDuration = 3 * time.Hour
+		s := newTestServer(t, c)
+		response := request(t, s, "PUT", "/mytopic", "a message", nil)
+		require.Equal(t, 200, response.Code)
+		requireExpires(t, toMessage(t, response.Body.String()), 3*time.Hour)
+	})
+
+	t.Run("per-topic cache duration", func(t *testing.T) {
+		c := newTestConfig(t)
+		c.TopicCacheDurations = map[string]time.Duration{"audit-log": 30 * 24 * time.Hour}
+		s := newTestServer(t, c)
+		response := request(t, s, "PUT", "/audit-log", "a message", nil)
+		require.Equal(t, 200, response.Code)
+		requireExpires(t, toMessage(t, response.Body.String()), 30*24*time.Hour)
+
+		response = request(t, s, "PUT", "/mytopic", "a message", nil)
+		require.Equal(t, 200, response.Code)
+		requireExpires(t, toMessage(t, response.Body.String()), 12*time.Hour)
+	})
+
+	t.Run("retain priority", func(t *testing.T) {
+		c := newTestConfig(t)
+		c.RetainPriority = 5
+		c.RetainDuration = 7 * 24 * time.Hour
+		s := newTestServer(t, c)
+		response := request(t, s, "PUT", "/mytopic", "urgent message", map[string]string{"Priority": "urgent"})
+		require.Equal(t, 200, response.Code)
+		requireExpires(t, toMessage(t, response.Body.String()), 7*24*time.Hour)
+
+		response = request(t, s, "PUT", "/mytopic", "regular message", map[string]string{"Priority": "high"})
+		require.Equal(t, 200, response.Code)
+		requireExpires(t, toMessage(t, response.Body.String()), 12*time.Hour)
+	})
+
+	t.Run("tier limit", func(t *testing.T) {
+		c := newTestConfigWithAuthFile(t)
+		c.AuthDefault = user.PermissionReadWrite
+		s := newTestServer(t, c)
+		require.Nil(t, s.userManager.AddUser("phil", "mypass", user.RoleUser))
+		require.Nil(t, s.userManager.AddTier(&user.Tier{
+			Code:                  "pro",
+			MessageLimit:          100,
+			MessageExpiryDuration: 2 * time.Hour,
+		}))
+		require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+		response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+			"Authorization": util.BasicAuth("phil", "mypass"),
+		})
+		require.Equal(t, 200, response.Code)
+		requireExpires(t, toMessage(t, response.Body.String()), 2*time.Hour)
+	})
+
+	t.Run("no cache", func(t *testing.T) {
+		s := newTestServer(t, newTestConfig(t))
+		response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{"Cache": "no"})
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, int64(0), toMessage(t, response.Body.String()).Expires)
+	})
+}
+
 func TestServer_PublishAtWithCacheError(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -569,6 +1230,116 @@ func TestServer_PublishWithNopCache(t *testing.T) {
 	require.Empty(t, messages)
 }
 
+func TestServer_PublishWithCustomMessageID(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "my message", map[string]string{
+		"X-Message-ID": "order1234567",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "order1234567", toMessage(t, response.Body.String()).ID)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&id=order1234567", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my message", messages[0].Message)
+
+	// Collision, also across topics
+	response = request(t, s, "PUT", "/mytopic", "another message", map[string]string{
+		"X-Message-ID": "order1234567",
+	})
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40905, toHTTPError(t, response.Body.String()).Code)
+	conflict := response.Body.String()
+	require.NotContains(t, conflict, "exists")
+	response = request(t, s, "PUT", "/othertopic?message-id=order1234567", "another message", nil)
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, conflict, response.Body.String()) // Does not reveal on which topic the ID is used
+
+	// JSON
+	response = request(t, s, "PUT", "/", `{"topic":"mytopic","id":"order7654321","message":"json message"}`, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "order7654321", toMessage(t, response.Body.String()).ID)
+}
+
+func TestServer_PublishWithCustomMessageID_NoCache(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	// IDs of messages that are not cached cannot be reused either
+	response := request(t, s, "PUT", "/mytopic", "my message", map[string]string{
+		"X-Message-ID": "order1234567",
+		"X-Cache":      "no",
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "another message", map[string]string{
+		"X-Message-ID": "order1234567",
+	})
+	require.Equal(t, 409, response.Code)
+}
+
+func TestServer_PublishWithCustomMessageID_DryRunAndFailures(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 3
+	c.AttachmentFileSizeLimit = 5000
+	s := newTestServer(t, c)
+
+	// Dry runs do not reserve the ID
+	response := request(t, s, "PUT", "/mytopic", "my message", map[string]string{
+		"X-Message-ID": "order1234567",
+		"X-Dry-Run":    "yes",
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Failed publishes do not reserve the ID
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(5001), map[string]string{
+		"X-Message-ID": "order1234567",
+	})
+	require.Equal(t, 413, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "my message", map[string]string{
+		"X-Message-ID": "order1234567",
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Rate limits are checked before the ID
+	response = request(t, s, "PUT", "/mytopic", "another message", map[string]string{
+		"X-Message-ID": "order1234567",
+	})
+	require.Equal(t, 409, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "another message", map[string]string{
+		"X-Message-ID": "order1234567",
+	})
+	require.Equal(t, 429, response.Code)
+}
+
+func TestServer_PublishWithCustomMessageID_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, id := range []string{"short", "waytoolongforamessageid", "order-123456", "order 123456"} {
+		response := request(t, s, "PUT", "/mytopic", "my message", map[string]string{
+			"X-Message-ID": id,
+		})
+		require.Equal(t, 400, response.Code, id)
+		require.Equal(t, 40048, toHTTPError(t, response.Body.String()).Code, id)
+	}
+}
+
+func TestServer_PublishWithCustomMessageID_Expired(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	m := newDefaultMessage("mytopic", "expired message")
+	m.ID = "order1234567"
+	m.Expires = time.Now().Add(-time.Minute).Unix()
+	require.Nil(t, s.messageCache.AddMessage(m))
+
+	response := request(t, s, "PUT", "/mytopic", "new message", map[string]string{
+		"X-Message-ID": "order1234567",
+	})
+	require.Equal(t, 200, response.Code)
+	stored, err := s.messageCache.Message("order1234567")
+	require.Nil(t, err)
+	require.Equal(t, "new message", stored.Message)
+}
+
 func TestServer_PublishAndPollSince(t *testing.T) {
 	t.Parallel()
 	s := newTestServer(t, newTestConfig(t))
@@ -681,6 +1452,231 @@ func TestServer_PublishInvalidTopic(t *testing.T) {
 	require.Equal(t, 40010, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PollAndConsume(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "mytopic", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionRead))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}
+	request(t, s, "PUT", "/mytopic?priority=1", "low priority", headers)
+	request(t, s, "PUT", "/mytopic", "normal priority 1", headers)
+	request(t, s, "PUT", "/mytopic", "normal priority 2", headers)
+
+	// Only consumes messages that match the filters
+	response := request(t, s, "GET", "/mytopic/json?poll=1&consume=1&priority=3", "", headers)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Len(t, messages, 2)
+	require.Equal(t, "normal priority 1", messages[0].Message)
+	require.Equal(t, "normal priority 2", messages[1].Message)
+
+	// Consumed messages are gone for everyone, other messages are not
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "low priority", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&consume=1", "", headers)
+	messages = toMessages(t, response.Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "low priority", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&consume=1", "", headers)
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, toMessages(t, response.Body.String()))
+}
+
+func TestServer_PollAndConsume_Attachment(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}
+	response := request(t, s, "PUT", "/mytopic", "job data", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+		"Filename":      "job.txt",
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&consume=1", "", headers)
+	messages := toMessages(t, response.Body.String())
+	require.Len(t, messages, 1)
+
+	// Attachment of consumed message can still be downloaded, until it expires
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, messages[0].ID))
+	response = request(t, s, "GET", strings.TrimPrefix(messages[0].Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "job data", response.Body.String())
+}
+
+func TestServer_PollAndConsume_NotAllowed(t *testing.T) {
+	// Requires auth
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/mytopic/json?poll=1&consume=1", "", nil)
+	require.Equal(t, 40050, toHTTPError(t, response.Body.String()).Code)
+
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s = newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "readonly", user.PermissionRead))
+
+	// Only for poll requests
+	response = request(t, s, "GET", "/mytopic/json?consume=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 40049, toHTTPError(t, response.Body.String()).Code)
+
+	// Anonymous users cannot consume, even with write access
+	response = request(t, s, "GET", "/mytopic/json?poll=1&consume=1", "", nil)
+	require.Equal(t, 401, response.Code)
+
+	// Users need write access
+	response = request(t, s, "GET", "/mytopic,readonly/json?poll=1&consume=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_PollAndConsume_ConcurrentConsumers(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.VisitorRequestLimitBurst = 1000
+	c.VisitorMessageDailyLimit = 1000
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "queue", user.PermissionReadWrite))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}
+
+	// Publish messages while consumers are polling; all from different hosts, since authenticated users without
+	// a tier share the visitor of their IP address
+	const numMessages, numConsumers = 50, 5
+	var published atomic.Bool
+	go func() {
+		for i := 0; i < numMessages; i++ {
+			request(t, s, "PUT", "/queue", fmt.Sprintf("job %d", i), headers, func(r *http.Request) {
+				r.RemoteAddr = "10.0.0.1"
+			})
+		}
+		published.Store(true)
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	delivered := make(map[string]int)
+	codes := make(map[int]int)
+	for i := 0; i < numConsumers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				done := published.Load() // Must be read before polling, so the last poll sees all messages
+				response := request(t, s, "GET", "/queue/json?poll=1&consume=1", "", headers, func(r *http.Request) {
+					r.RemoteAddr = fmt.Sprintf("10.0.1.%d", i)
+				})
+				mu.Lock()
+				codes[response.Code]++
+				for _, line := range strings.Split(strings.TrimSpace(response.Body.String()), "\n") {
+					var m message
+					if line != "" && json.Unmarshal([]byte(line), &m) == nil {
+						delivered[m.Message]++
+					}
+				}
+				mu.Unlock()
+				if done {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Len(t, codes, 1)
+	require.Contains(t, codes, 200)
+	require.Len(t, delivered, numMessages)
+	for i := 0; i < numMessages; i++ {
+		require.Equal(t, 1, delivered[fmt.Sprintf("job %d", i)], "job %d not delivered exactly once", i)
+	}
+}
+
+func TestServer_PollWithTopicDefaultFilter(t *testing.T) {
+	c := newTestConfig(t)
+	c.TopicDefaultFilters = map[string]string{
+		"firehose": "priority=high,urgent",
+	}
+	s := newTestServer(t, c)
+	request(t, s, "PUT", "/firehose", "normal", nil)
+	request(t, s, "PUT", "/firehose?priority=high", "high", nil)
+	request(t, s, "PUT", "/firehose?priority=urgent&tags=disk", "urgent disk", nil)
+	request(t, s, "PUT", "/other", "other normal", nil)
+
+	// Default filter applies
+	response := request(t, s, "GET", "/firehose/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Len(t, messages, 2)
+	require.Equal(t, "high", messages[0].Message)
+	require.Equal(t, "urgent disk", messages[1].Message)
+
+	// Default filter only applies to its topic, also when subscribing to multiple topics
+	response = request(t, s, "GET", "/firehose,other/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Len(t, messages, 3)
+	require.Equal(t, "other normal", messages[2].Message)
+
+	// Client-specified filters override the default filter
+	response = request(t, s, "GET", "/firehose/json?poll=1&priority=1,2,3,4,5", "", nil)
+	require.Len(t, toMessages(t, response.Body.String()), 3)
+
+	response = request(t, s, "GET", "/firehose/json?poll=1&priority=default", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "normal", messages[0].Message)
+
+	response = request(t, s, "GET", "/firehose/json?poll=1&tags=disk", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "urgent disk", messages[0].Message)
+}
+
+func TestServer_SubscribeWithTopicDefaultFilter(t *testing.T) {
+	c := newTestConfig(t)
+	c.TopicDefaultFilters = map[string]string{
+		"firehose": "p=5",
+	}
+	s := newTestServer(t, c)
+
+	subscribeResponse := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/firehose/json", subscribeResponse)
+	request(t, s, "PUT", "/firehose", "normal", nil)
+	request(t, s, "PUT", "/firehose?priority=urgent", "urgent", nil)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeResponse.Body.String())
+	require.Len(t, messages, 2)
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "urgent", messages[1].Message)
+}
+
+func TestServer_TopicDefaultFilter_Invalid(t *testing.T) {
+	for _, filter := range []string{"priority=invalid", "message=hi", ""} {
+		c := newTestConfig(t)
+		c.TopicDefaultFilters = map[string]string{
+			"firehose": filter,
+		}
+		_, err := New(c)
+		require.Error(t, err, filter)
+	}
+}
+
 func TestServer_PollWithQueryFilters(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -750,31 +1746,234 @@ func TestServer_PollWithQueryFilters(t *testing.T) {
 	}
 }
 
-func TestServer_SubscribeWithQueryFilters(t *testing.T) {
-	t.Parallel()
-	c := newTestConfig(t)
-	c.KeepaliveInterval = 800 * time.Millisecond
+func TestServer_SubscribeWithQueryFilters(t *testing.T) {
+	t.Parallel()
+	c := newTestConfig(t)
+	c.KeepaliveInterval = 800 * time.Millisecond
+	s := newTestServer(t, c)
+
+	subscribeResponse := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json?tags=zfs-issue", subscribeResponse)
+
+	response := request(t, s, "PUT", "/mytopic", "my first message", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "ZFS scrub failed", map[string]string{
+		"Tags": "zfs-issue,zfs-scrub",
+	})
+	require.Equal(t, 200, response.Code)
+
+	time.Sleep(850 * time.Millisecond)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeResponse.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, messageEvent, messages[1].Event)
+	require.Equal(t, "ZFS scrub failed", messages[1].Message)
+	require.Equal(t, keepaliveEvent, messages[2].Event)
+}
+
+func TestServer_SubscribeWithMaxMessages(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+
+	// Subscribe with a filter, without canceling the request
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/mytopic/json?max_messages=2&priority=high", nil)
+	done := make(chan bool)
+	go func() {
+		s.handle(rr, req)
+		done <- true
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// Only matching messages count
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "low 1", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "high 1", map[string]string{"Priority": "high"}).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "low 2", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "high 2", map[string]string{"Priority": "high"}).Code)
+
+	// Stream is closed after the second matching message
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription was not closed after max_messages")
+	}
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "high 3", map[string]string{"Priority": "high"}).Code)
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "high 1", messages[1].Message)
+	require.Equal(t, "high 2", messages[2].Message)
+}
+
+func TestServer_SubscribeWithMaxMessages_Poll(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for i := 1; i <= 3; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), nil).Code)
+	}
+
+	// Cached messages count towards the limit, too
+	response := request(t, s, "GET", "/mytopic/json?poll=1&max_messages=2", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?since=all&max_messages=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "message 1", messages[1].Message)
+}
+
+func TestServer_SubscribeWithMaxMessages_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, value := range []string{"0", "-1", "ten"} {
+		response := request(t, s, "GET", "/mytopic/json?poll=1&max_messages="+value, "", nil)
+		require.Equal(t, 400, response.Code)
+		require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+	}
+}
+
+func TestServer_SubscribeWithInvalidTopic(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, path := range []string{"/,/json", "/mytopic,/sse", "/my%20topic/raw", "/" + strings.Repeat("a", 65) + "/json", "/topic!/ws", "/%C3%A4rger/auth"} {
+		response := request(t, s, "GET", path, "", nil)
+		require.Equal(t, 400, response.Code, path)
+		err := toHTTPError(t, response.Body.String())
+		require.Equal(t, 40062, err.Code, path)
+		require.Contains(t, err.Message, "topics must be 1-64 characters of A-Z, a-z, 0-9, _ and -")
+	}
+	response := request(t, s, "GET", "/x/json", "", nil, func(r *http.Request) {
+		r.URL.Path = "//json" // Empty topic, cannot be passed via http.NewRequest
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40062, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, 0, len(s.topics))
+}
+
+func TestServer_SearchMessages(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "Disk full on nas01", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "all good", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "disk full on nas02", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/other", "disk full elsewhere", nil).Code)
+
+	response := request(t, s, "GET", "/alerts/search?q=disk+full", "", nil)
+	require.Equal(t, 200, response.Code)
+	var result apiSearchResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&result))
+	require.Equal(t, 2, len(result.Messages))
+	require.Equal(t, "disk full on nas02", result.Messages[0].Message)
+	require.Equal(t, "Disk full on nas01", result.Messages[1].Message)
+	require.Equal(t, searchLimitDefault, result.Limit)
+
+	response = request(t, s, "GET", "/alerts/search?q=disk+full&limit=1&offset=1&since=1h", "", nil)
+	require.Equal(t, 200, response.Code)
+	result = apiSearchResponse{}
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&result))
+	require.Equal(t, 1, len(result.Messages))
+	require.Equal(t, "Disk full on nas01", result.Messages[0].Message)
+
+	response = request(t, s, "GET", "/alerts/search?q=disk+full&until=1000", "", nil)
+	require.Equal(t, 200, response.Code)
+	result = apiSearchResponse{}
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&result))
+	require.Empty(t, result.Messages)
+}
+
+func TestServer_SearchMessages_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/alerts/search?q=", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40060, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/alerts/search?q=disk&limit=0", "", nil)
+	require.Equal(t, 400, response.Code)
+
+	response = request(t, s, "GET", "/alerts/search?q=disk&since=yesterday", "", nil)
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_SearchMessages_NotAllowed(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
 	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts", user.PermissionRead))
 
-	subscribeResponse := httptest.NewRecorder()
-	subscribeCancel := subscribe(t, s, "/mytopic/json?tags=zfs-issue", subscribeResponse)
+	response := request(t, s, "GET", "/alerts/search?q=disk", "", nil)
+	require.Equal(t, 403, response.Code)
 
-	response := request(t, s, "PUT", "/mytopic", "my first message", nil)
-	require.Equal(t, 200, response.Code)
-	response = request(t, s, "PUT", "/mytopic", "ZFS scrub failed", map[string]string{
-		"Tags": "zfs-issue,zfs-scrub",
+	response = request(t, s, "GET", "/alerts/search?q=disk", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
 	})
 	require.Equal(t, 200, response.Code)
+}
 
-	time.Sleep(850 * time.Millisecond)
+func TestServer_PollWithDeltaEncoding(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	headers := map[string]string{"Title": "Disk usage", "Tags": "warning,disk", "Priority": "4"}
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "disk at 91%", headers).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "disk at 92%", headers).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "disk at 93%", map[string]string{"Title": "Disk usage"}).Code)
+
+	expected := toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", nil).Body.String())
+	require.Equal(t, 3, len(expected))
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&delta=1", "", nil)
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	require.Equal(t, 3, len(lines))
+	require.NotContains(t, lines[0], `"delta"`)
+	require.NotContains(t, lines[1], `"title"`) // Unchanged
+	require.NotContains(t, lines[1], `"tags"`)
+	require.Contains(t, lines[1], `"delta":true`)
+	require.Contains(t, lines[2], `"tags":null`) // Removed
+	require.Contains(t, lines[2], `"priority":null`)
+
+	// Reconstruct messages from diffs
+	var state map[string]json.RawMessage
+	for i, line := range lines {
+		var fields map[string]json.RawMessage
+		require.Nil(t, json.Unmarshal([]byte(line), &fields))
+		if state == nil {
+			state = fields
+		} else {
+			delete(fields, "delta")
+			for k, v := range fields {
+				if string(v) == "null" {
+					delete(state, k)
+				} else {
+					state[k] = v
+				}
+			}
+		}
+		b, err := json.Marshal(state)
+		require.Nil(t, err)
+		require.Equal(t, expected[i], toMessage(t, string(b)))
+	}
+}
+
+func TestServer_SubscribeWithDeltaEncoding_SSE(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	subscribeResponse := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/sse?delta=1", subscribeResponse)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "first", map[string]string{"Title": "Same"}).Code)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "second", map[string]string{"Title": "Same"}).Code)
 	subscribeCancel()
 
-	messages := toMessages(t, subscribeResponse.Body.String())
-	require.Equal(t, 3, len(messages))
-	require.Equal(t, openEvent, messages[0].Event)
-	require.Equal(t, messageEvent, messages[1].Event)
-	require.Equal(t, "ZFS scrub failed", messages[1].Message)
-	require.Equal(t, keepaliveEvent, messages[2].Event)
+	events := strings.Split(strings.TrimSpace(subscribeResponse.Body.String()), "\n\n")
+	require.Equal(t, 3, len(events))
+	require.True(t, strings.HasPrefix(events[0], "event: open\n"))
+	require.Contains(t, events[1], `"title":"Same"`)
+	require.Contains(t, events[1], `"message":"first"`)
+	require.NotContains(t, events[2], `"title"`)
+	require.Contains(t, events[2], `"message":"second"`)
+	require.Contains(t, events[2], `"delta":true`)
 }
 
 func TestServer_Auth_Success_Admin(t *testing.T) {
@@ -838,6 +2037,27 @@ func TestServer_Auth_Fail_InvalidPass(t *testing.T) {
 	require.Equal(t, 401, response.Code)
 }
 
+func TestServer_Auth_LDAP_FailedBindFallsBackToLocalUsers(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.AuthLDAPURL = "ldap://127.0.0.1:1" // Nothing listening here, so every bind fails
+	c.AuthLDAPBaseDN = "ou=people,dc=example,dc=com"
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	response := request(t, s, "GET", "/mytopic/auth", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, response.Code)
+	require.Equal(t, 40101, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/auth", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
 func TestServer_Auth_Fail_Unauthorized(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	c.AuthDefault = user.PermissionDenyAll
@@ -917,6 +2137,65 @@ func TestServer_Auth_ViaQuery(t *testing.T) {
 	require.Equal(t, 401, response.Code)
 }
 
+func TestServer_Auth_ViaQuery_SSE(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "some pass", user.RoleAdmin))
+	u, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), "")
+	require.Nil(t, err)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "hi there", map[string]string{
+		"Authorization": util.BasicAuth("ben", "some pass"),
+	}).Code)
+
+	// Standard base64 with padding (as produced by btoa() in the browser), Basic and Bearer
+	for _, header := range []string{util.BasicAuth("ben", "some pass"), util.BearerAuth(token.Value)} {
+		u := fmt.Sprintf("/mytopic/sse?poll=1&auth=%s", base64.StdEncoding.EncodeToString([]byte(header)))
+		response := request(t, s, "GET", u, "", nil)
+		require.Equal(t, 200, response.Code)
+		require.Contains(t, response.Body.String(), `"message":"hi there"`)
+	}
+
+	// Wrong password, invalid base64, and a credential that is not Basic or Bearer are all rejected
+	for _, auth := range []string{
+		base64.RawURLEncoding.EncodeToString([]byte(util.BasicAuth("ben", "WRONNNGGGG"))),
+		"not*base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("Digest ben")),
+	} {
+		response := request(t, s, "GET", "/mytopic/sse?poll=1&auth="+auth, "", nil)
+		require.Equal(t, 401, response.Code)
+		require.Equal(t, 40101, toHTTPError(t, response.Body.String()).Code)
+	}
+}
+
+func TestServer_Auth_ViaQuery_WebSocket(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "some pass", user.RoleAdmin))
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/mytopic/ws?auth="
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+base64.RawURLEncoding.EncodeToString([]byte(util.BasicAuth("ben", "some pass"))), nil)
+	require.Nil(t, err)
+	defer conn.Close()
+	var m message
+	require.Nil(t, conn.ReadJSON(&m))
+	require.Equal(t, openEvent, m.Event)
+	require.Equal(t, "mytopic", m.Topic)
+
+	_, response, err := websocket.DefaultDialer.Dial(wsURL+base64.RawURLEncoding.EncodeToString([]byte(util.BasicAuth("ben", "WRONNNGGGG"))), nil)
+	require.Equal(t, websocket.ErrBadHandshake, err)
+	require.Equal(t, 401, response.StatusCode)
+
+	_, response, err = websocket.DefaultDialer.Dial(wsURL+"not*base64!", nil)
+	require.Equal(t, websocket.ErrBadHandshake, err)
+	require.Equal(t, 401, response.StatusCode)
+}
+
 func TestServer_Auth_NonBasicHeader(t *testing.T) {
 	s := newTestServer(t, newTestConfigWithAuthFile(t))
 
@@ -1300,7 +2579,7 @@ func TestServer_PublishAndExpungeTopicAfter16Hours(t *testing.T) {
 	require.NotNil(t, s.topics["mytopic"])
 
 	// Fudge with last access, but subscribe, and see that it won't get pruned (because of subscriber)
-	subID := s.topics["mytopic"].Subscribe(subFn, "", func() {})
+	subID := s.topics["mytopic"].Subscribe(subFn, &subscriberInfo{}, func() {})
 	s.topics["mytopic"].mu.Lock()
 	s.topics["mytopic"].lastAccess = time.Now().Add(-17 * time.Hour)
 	s.topics["mytopic"].mu.Unlock()
@@ -1513,6 +2792,93 @@ func TestServer_MatrixGateway_Push_Failure_Unconfigured(t *testing.T) {
 	require.Equal(t, 50003, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PublishIfPresent_Subscribed(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/mytopic", "someone is at their desk", map[string]string{
+		"X-If-Present": "1",
+	})
+	require.Equal(t, 200, response.Code)
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "someone is at their desk", messages[1].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "someone is at their desk", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_PublishIfPresent_NoSubscribers(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic?if-present=yes", "nobody is listening", nil)
+	require.Equal(t, 412, response.Code)
+	require.Equal(t, 41201, toHTTPError(t, response.Body.String()).Code)
+
+	// Skipped messages are not cached, and the attachment is never stored
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(5000), map[string]string{
+		"If-Present": "true",
+	})
+	require.Equal(t, 412, response.Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, response.Body.String())
+	files, err := os.ReadDir(s.config.AttachmentCacheDir)
+	require.Nil(t, err)
+	require.Empty(t, files)
+
+	// Without the header, the message is published as usual
+	response = request(t, s, "PUT", "/mytopic", "nobody is listening", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_PublishIfSubscribers(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	// Without subscribers, the request is a no-op, but not an error
+	response := request(t, s, "PUT", "/mytopic", "is anyone watching?", map[string]string{
+		"X-If-Subscribers": "1",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"published":false}`, strings.TrimSpace(response.Body.String()))
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Empty(t, response.Body.String())
+
+	// With subscribers, the message is published as usual
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+	response = request(t, s, "PUT", "/mytopic?if-subscribers=yes", "someone is watching", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "someone is watching", toMessage(t, response.Body.String()).Message)
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "someone is watching", messages[1].Message)
+}
+
+func TestServer_PublishIfSubscribers_NotCountedAgainstMessageLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 1
+	s := newTestServer(t, c)
+
+	// Skipped messages do not count against the visitor's message limit
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic?if-present=1", "nobody is listening", nil)
+		require.Equal(t, 412, response.Code)
+		response = request(t, s, "PUT", "/mytopic?if-subscribers=1", "nobody is watching", nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, `{"published":false}`, strings.TrimSpace(response.Body.String()))
+	}
+	response := request(t, s, "PUT", "/mytopic", "published", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "over the limit", nil)
+	require.Equal(t, 429, response.Code)
+}
+
 func TestServer_PublishActions_AndPoll(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	response := request(t, s, "PUT", "/mytopic", "my message", map[string]string{
@@ -1533,6 +2899,110 @@ func TestServer_PublishActions_AndPoll(t *testing.T) {
 	require.Equal(t, "target_temp_f=65", m.Actions[1].Body)
 }
 
+func TestServer_PublishActions_HTTPBodyAndHeaders(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "Garage door is open", map[string]string{
+		"Actions": `http, Close door, https://api.mygarage.lan/, method=PUT, headers.Authorization=Bearer zAzsx1sk, headers.Content-Type=application/json, body='{"action": "close"}'`,
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, 1, len(m.Actions))
+	require.Equal(t, "PUT", m.Actions[0].Method)
+	require.Equal(t, map[string]string{"Authorization": "Bearer zAzsx1sk", "Content-Type": "application/json"}, m.Actions[0].Headers)
+	require.Equal(t, `{"action": "close"}`, m.Actions[0].Body)
+
+	response = request(t, s, "PUT", "/mytopic", "Garage door is open", map[string]string{
+		"Actions": "http, Close door, https://api.mygarage.lan/, method=PATCH",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40018, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishData_AndPoll(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "Backup report", map[string]string{
+		"Data": "host=nas01, duration=12m, status=ok",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, map[string]string{"host": "nas01", "duration": "12m", "status": "ok"}, m.Data)
+	require.Equal(t, "Backup report", m.Message)
+	require.Equal(t, "", m.ContentType)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, map[string]string{"host": "nas01", "duration": "12m", "status": "ok"}, m.Data)
+	require.Equal(t, "Backup report", m.Message)
+}
+
+func TestServer_PublishData_Table(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic?data-table=1", "Backup report", map[string]string{
+		"Data": `{"host":"nas01","files":"1|2"}`,
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Backup report\n\n| Key | Value |\n|-----|-------|\n| files | 1\\|2 |\n| host | nas01 |", m.Message)
+	require.Equal(t, "text/markdown", m.ContentType)
+	require.Equal(t, map[string]string{"host": "nas01", "files": "1|2"}, m.Data)
+
+	// Without a message body, only the table is sent
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"Data":       "status=ok",
+		"Data-Table": "yes",
+	})
+	require.Equal(t, 200, response.Code)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "| Key | Value |\n|-----|-------|\n| status | ok |", m.Message)
+}
+
+func TestServer_PublishData_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, data := range []string{"no pair", `{"a":1}`, "=value"} {
+		response := request(t, s, "PUT", "/mytopic", "Backup report", map[string]string{
+			"Data": data,
+		})
+		require.Equal(t, 400, response.Code, data)
+		require.Equal(t, 40054, toHTTPError(t, response.Body.String()).Code, data)
+	}
+}
+
+func TestServer_PublishLocation_AndPoll(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "Pump failure", map[string]string{
+		"Location": "52.5200,13.4050,Pump station 7",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, &location{Latitude: 52.52, Longitude: 13.405, Label: "Pump station 7"}, m.Location)
+
+	response = request(t, s, "PUT", "/mytopic?loc=-33.8688,151.2093", "No label", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, &location{Latitude: 52.52, Longitude: 13.405, Label: "Pump station 7"}, messages[0].Location)
+	require.Equal(t, &location{Latitude: -33.8688, Longitude: 151.2093}, messages[1].Location)
+	require.Contains(t, response.Body.String(), `"location":{"lat":-33.8688,"lon":151.2093}`)
+}
+
+func TestServer_PublishLocation_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, loc := range []string{"95,13.4", "52.52,-181", "52.52", "north,east", `{"lat":52.52}`} {
+		response := request(t, s, "PUT", "/mytopic", "Pump failure", map[string]string{
+			"X-Location": loc,
+		})
+		require.Equal(t, 400, response.Code, loc)
+		require.Equal(t, 40061, toHTTPError(t, response.Body.String()).Code, loc)
+	}
+}
+
 func TestServer_PublishMarkdown(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	response := request(t, s, "PUT", "/mytopic", "**make this bold**", map[string]string{
@@ -1602,6 +3072,37 @@ func TestServer_PublishAsJSON_Markdown(t *testing.T) {
 	require.Equal(t, "text/markdown", m.ContentType)
 }
 
+func TestServer_PublishAsJSON_Location(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	body := `{"topic":"mytopic","message":"Pump failure","location":{"lat":52.52,"lon":13.405,"label":"Pump station 7"}}`
+	response := request(t, s, "PUT", "/", body, nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, &location{Latitude: 52.52, Longitude: 13.405, Label: "Pump station 7"}, m.Location)
+
+	body = `{"topic":"mytopic","message":"Pump failure","location":"52.52,13.405"}`
+	response = request(t, s, "PUT", "/", body, nil)
+	require.Equal(t, 200, response.Code)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, &location{Latitude: 52.52, Longitude: 13.405}, m.Location)
+
+	body = `{"topic":"mytopic","message":"Pump failure","location":{"lat":-91,"lon":13.405}}`
+	response = request(t, s, "PUT", "/", body, nil)
+	require.Equal(t, 40061, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishAsJSON_Data(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	body := `{"topic":"mytopic","message":"Status","data":{"cpu":"12%","disk":"54%, 3 volumes"},"data_table":true}`
+	response := request(t, s, "PUT", "/", body, nil)
+	require.Equal(t, 200, response.Code)
+
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, map[string]string{"cpu": "12%", "disk": "54%, 3 volumes"}, m.Data)
+	require.Equal(t, "Status\n\n| Key | Value |\n|-----|-------|\n| cpu | 12% |\n| disk | 54%, 3 volumes |", m.Message)
+	require.Equal(t, "text/markdown", m.ContentType)
+}
+
 func TestServer_PublishAsJSON_RateLimit_MessageDailyLimit(t *testing.T) {
 	// Publishing as JSON follows a different path. This ensures that rate
 	// limiting works for this endpoint as well
@@ -1689,27 +3190,103 @@ func TestServer_PublishWithTierBasedMessageLimitAndExpiry(t *testing.T) {
 	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
 	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
 
-	// Publish to reach message limit
-	for i := 0; i < 5; i++ {
-		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("this is message %d", i+1), map[string]string{
+	// Publish to reach message limit
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("this is message %d", i+1), map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, response.Code)
+		msg := toMessage(t, response.Body.String())
+		require.True(t, msg.Expires < time.Now().Unix()+5)
+	}
+	response := request(t, s, "PUT", "/mytopic", "this is too much", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 429, response.Code)
+
+	// Run pruning and see if they are gone
+	s.execManager()
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, response.Body)
+}
+
+func TestServer_PublishWithLimitOverrides(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.MessageSizeLimit = 8192
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:             "test",
+		MessageLimit:     5,
+		MessageSizeLimit: 4096,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "test"))
+	require.Nil(t, s.userManager.ChangeLimitOverrides("phil", &user.LimitOverrides{
+		MessageLimit:     7,
+		MessageSizeLimit: 8192,
+	}))
+
+	// Override takes precedence over tier message limit
+	for i := 0; i < 7; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("this is message %d", i+1), map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "this is too much", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+
+	// Override takes precedence over tier message size limit; this is a message, not an attachment
+	require.Nil(t, s.userManager.ChangeLimitOverrides("phil", &user.LimitOverrides{
+		MessageLimit:     100,
+		MessageSizeLimit: 16384,
+	}))
+	content := util.RandomString(6000)
+	response = request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Nil(t, msg.Attachment)
+	require.Equal(t, content, msg.Message)
+
+	// But it cannot exceed the server-wide message size limit
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(10000), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 413, response.Code) // Treated as an attachment, which the tier does not allow
+}
+
+func TestServer_PublishWithRequestLimitOverride(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeLimitOverrides("phil", &user.LimitOverrides{
+		RequestLimit: 3, // per minute, instead of the default burst of 60
+	}))
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
 			"Authorization": util.BasicAuth("phil", "phil"),
 		})
 		require.Equal(t, 200, response.Code)
-		msg := toMessage(t, response.Body.String())
-		require.True(t, msg.Expires < time.Now().Unix()+5)
 	}
-	response := request(t, s, "PUT", "/mytopic", "this is too much", map[string]string{
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
 		"Authorization": util.BasicAuth("phil", "phil"),
 	})
 	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42901, toHTTPError(t, response.Body.String()).Code)
 
-	// Run pruning and see if they are gone
-	s.execManager()
-	response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
-		"Authorization": util.BasicAuth("phil", "phil"),
-	})
+	// Anonymous users are not affected
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
 	require.Equal(t, 200, response.Code)
-	require.Empty(t, response.Body)
 }
 
 func TestServer_PublishAttachment(t *testing.T) {
@@ -1744,6 +3321,273 @@ func TestServer_PublishAttachment(t *testing.T) {
 	require.Equal(t, int64(5000), size)
 }
 
+func TestServer_PublishAttachmentEncrypted(t *testing.T) {
+	content := "\x89PNG\r\n\x1a\n" + util.RandomString(100) // Would be sniffed as PNG if not encrypted
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", content, map[string]string{
+		"X-Encryption": "client",
+		"X-Filename":   "photo.jpg",
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "client", msg.Attachment.Encryption)
+	require.Equal(t, "photo.jpg", msg.Attachment.Name)
+	require.Equal(t, "application/octet-stream", msg.Attachment.Type)
+	require.Equal(t, int64(len(content)), msg.Attachment.Size)
+	require.True(t, strings.HasSuffix(msg.Attachment.URL, ".bin"))
+
+	// Poll, flag is stored in the cache
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	polled := toMessage(t, response.Body.String())
+	require.Equal(t, "client", polled.Attachment.Encryption)
+	require.Equal(t, msg.Attachment.URL, polled.Attachment.URL)
+
+	// GET, bytes are served untouched
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+	require.Equal(t, "application/octet-stream", response.Header().Get("Content-Type"))
+	require.Equal(t, "client", response.Header().Get("X-Encryption"))
+}
+
+func TestServer_PublishAttachmentEncrypted_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "ciphertext", map[string]string{
+		"X-Encryption": "server",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Publish_RedactPatternsInLogs(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetFormat(log.JSONFormat)
+	log.SetLevel(log.TraceLevel)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormat(log.TextFormat)
+		log.SetLevel(log.ErrorLevel) // See TestMain
+	})
+
+	c := newTestConfig(t)
+	c.RedactPatterns = []*regexp.Regexp{regexp.MustCompile(`password=\S+`), regexp.MustCompile(`tk_[a-z0-9]+`)}
+	s := newTestServer(t, c)
+	sender := newTestFirebaseSender(10)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true}, c.RedactPatterns, c.FirebasePriorityRoutes)
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+	response := request(t, s, "PUT", "/mytopic", "login with password=hunter2 failed", map[string]string{
+		"Title": "Token tk_secret123 expired",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return len(sender.Messages()) == 1
+	})
+	subscribeCancel()
+
+	// Subscribers and Firebase receive the original message
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "login with password=hunter2 failed", messages[1].Message)
+	require.Equal(t, "Token tk_secret123 expired", messages[1].Title)
+	require.Equal(t, "login with password=hunter2 failed", sender.Messages()[0].Data["message"])
+
+	// Logs are redacted
+	logs := out.String()
+	require.Contains(t, logs, "Received message")
+	require.Contains(t, logs, "Firebase message")
+	require.Contains(t, logs, "login with [redacted] failed")
+	require.Contains(t, logs, "Token [redacted] expired")
+	require.NotContains(t, logs, "hunter2")
+	require.NotContains(t, logs, "tk_secret123")
+}
+
+func TestServer_PublishAttachment_DownloadLogsBytesServed(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetFormat(log.JSONFormat)
+	log.SetLevel(log.InfoLevel)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormat(log.TextFormat)
+		log.SetLevel(log.ErrorLevel) // See TestMain
+	})
+
+	content := "text file!" + util.RandomString(4990)
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	msg := toMessage(t, response.Body.String())
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+
+	// Full download
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "text/plain; charset=utf-8", response.Header().Get("Content-Type"))
+	require.Equal(t, content, response.Body.String())
+
+	// Range download
+	response = request(t, s, "GET", path, "", map[string]string{
+		"Range": "bytes=10-109",
+	})
+	require.Equal(t, 206, response.Code)
+	require.Equal(t, "100", response.Header().Get("Content-Length"))
+	require.Equal(t, "bytes 10-109/5000", response.Header().Get("Content-Range"))
+	require.Equal(t, content[10:110], response.Body.String())
+
+	// HEAD requests do not serve any bytes, and are not logged
+	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 200, response.Code)
+
+	downloads := make([]map[string]any, 0)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var ev map[string]any
+		require.Nil(t, json.Unmarshal([]byte(line), &ev))
+		if ev["message_id"] == msg.ID && ev["attachment_bytes_served"] != nil {
+			downloads = append(downloads, ev)
+		}
+	}
+	require.Len(t, downloads, 2)
+	require.Equal(t, float64(5000), downloads[0]["attachment_bytes_served"])
+	require.Equal(t, float64(5000), downloads[0]["attachment_size"])
+	require.Equal(t, float64(200), downloads[0]["http_status"])
+	require.Equal(t, "9.9.9.9", downloads[0]["visitor_ip"])
+	require.Equal(t, float64(100), downloads[1]["attachment_bytes_served"])
+	require.Equal(t, "bytes=10-109", downloads[1]["attachment_range"])
+	require.Equal(t, float64(206), downloads[1]["http_status"])
+}
+
+func TestServer_PublishAttachment_ExpectContinue_TooLarge(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+
+	// Declared length is larger than the 15 MB attachment limit, so the body must never be requested
+	conn, reader := expectContinueRequest(t, httpServer, "/mytopic", 20*1024*1024, nil)
+	defer conn.Close()
+	response, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, 413, response.StatusCode)
+	require.Equal(t, 41301, toHTTPError(t, readAll(t, response.Body)).Code)
+}
+
+func TestServer_PublishAttachment_ExpectContinue_Unauthorized(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+
+	conn, reader := expectContinueRequest(t, httpServer, "/mytopic", 5000, nil)
+	defer conn.Close()
+	response, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, 403, response.StatusCode)
+}
+
+func TestServer_PublishAttachment_ExpectContinue_Success(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+
+	content := util.RandomString(5000) // > 4096
+	conn, reader := expectContinueRequest(t, httpServer, "/mytopic", len(content), map[string]string{"Filename": "file.txt"})
+	defer conn.Close()
+	response, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, 100, response.StatusCode)
+
+	_, err = conn.Write([]byte(content))
+	require.Nil(t, err)
+	response, err = http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, 200, response.StatusCode)
+	msg := toMessage(t, readAll(t, response.Body))
+	require.Equal(t, "file.txt", msg.Attachment.Name)
+	require.Equal(t, int64(5000), msg.Attachment.Size)
+}
+
+// expectContinueRequest writes the request line and headers of a PUT request with "Expect: 100-continue",
+// but not the body, so that tests can check what the server responds before the body is sent
+func expectContinueRequest(t *testing.T, httpServer *httptest.Server, path string, contentLength int, headers map[string]string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(httpServer.URL, "http://"))
+	require.Nil(t, err)
+	require.Nil(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("PUT %s HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: %d\r\n", path, contentLength))
+	for k, v := range headers {
+		b.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+	}
+	b.WriteString("\r\n")
+	_, err = conn.Write([]byte(b.String()))
+	require.Nil(t, err)
+	return conn, bufio.NewReader(conn)
+}
+
+func TestServer_PublishAttachment_BehindProxyForwardedProtoAndHost(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic?f=myfile.txt", "this is an ATTACHMENT", map[string]string{
+		"X-Forwarded-For":   "1.2.3.4",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "ntfy.example.com",
+	})
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "https://ntfy.example.com/file/"+msg.ID+".txt", msg.Attachment.URL)
+
+	// Download works via the regular path
+	response = request(t, s, "GET", "/file/"+msg.ID+".txt", "", nil)
+	require.Equal(t, "this is an ATTACHMENT", response.Body.String())
+}
+
+func TestServer_PublishAttachment_BehindProxyForwardedHeadersIgnored(t *testing.T) {
+	// Not behind proxy, headers are ignored
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "attachment", map[string]string{
+		"Filename":          "a.txt",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "evil.example.com",
+	})
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "http://127.0.0.1:12345/file/"+msg.ID+".txt", msg.Attachment.URL)
+
+	// Behind proxy, but request is not from a trusted proxy (see request(): 9.9.9.9)
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	c.ProxyTrustedPrefixes = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	s = newTestServer(t, c)
+	response = request(t, s, "PUT", "/mytopic", "attachment", map[string]string{
+		"Filename":          "a.txt",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "evil.example.com",
+	})
+	msg = toMessage(t, response.Body.String())
+	require.Equal(t, "http://127.0.0.1:12345/file/"+msg.ID+".txt", msg.Attachment.URL)
+
+	// Behind trusted proxy, with invalid values
+	c.ProxyTrustedPrefixes = []netip.Prefix{netip.MustParsePrefix("9.9.9.0/24")}
+	s = newTestServer(t, c)
+	response = request(t, s, "PUT", "/mytopic", "attachment", map[string]string{
+		"Filename":          "a.txt",
+		"X-Forwarded-Proto": "ftp",
+		"X-Forwarded-Host":  "evil.example.com/path",
+	})
+	msg = toMessage(t, response.Body.String())
+	require.Equal(t, "http://127.0.0.1:12345/file/"+msg.ID+".txt", msg.Attachment.URL)
+
+	// Behind trusted proxy, only the right-most value (added by our proxy) is used
+	response = request(t, s, "PUT", "/mytopic", "attachment", map[string]string{
+		"Filename":          "a.txt",
+		"X-Forwarded-Proto": "http, https",
+		"X-Forwarded-Host":  "evil.example.com, ntfy.example.com:8443",
+	})
+	msg = toMessage(t, response.Body.String())
+	require.Equal(t, "https://ntfy.example.com:8443/file/"+msg.ID+".txt", msg.Attachment.URL)
+}
+
 func TestServer_PublishAttachmentShortWithFilename(t *testing.T) {
 	c := newTestConfig(t)
 	c.BehindProxy = true
@@ -1903,6 +3747,150 @@ func TestServer_PublishAttachmentAndExpire(t *testing.T) {
 	require.Equal(t, 404, response.Code)
 }
 
+func TestServer_PublishAttachmentDedupSupersedesSameFilename(t *testing.T) {
+	t.Parallel()
+	c := newTestConfig(t)
+	c.AttachmentDedupTopics = []string{"camera"}
+	s := newTestServer(t, c)
+
+	publish := func(topic, filename string) *message {
+		response := request(t, s, "PUT", "/"+topic, util.RandomString(5000), map[string]string{
+			"Filename": filename,
+		})
+		require.Equal(t, 200, response.Code)
+		return toMessage(t, response.Body.String())
+	}
+	first := publish("camera", "snapshot.jpg")
+	other := publish("camera", "other.jpg")
+	notDedup := publish("mytopic", "snapshot.jpg")
+	second := publish("camera", "snapshot.jpg")
+
+	// The first attachment is gone, all others are still there
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, first.ID))
+	for _, m := range []*message{other, notDedup, second} {
+		require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m.ID))
+	}
+	response := request(t, s, "GET", strings.TrimPrefix(first.Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "GET", strings.TrimPrefix(second.Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, response.Code)
+
+	// The first message is kept, but its attachment is expired
+	response = request(t, s, "GET", "/camera/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, first.ID, messages[0].ID)
+	require.Equal(t, "snapshot.jpg", messages[0].Attachment.Name)
+	require.Less(t, messages[0].Attachment.Expires, time.Now().Unix())
+	require.Equal(t, second.Attachment.Expires, messages[2].Attachment.Expires)
+
+	// Superseded attachments no longer count towards the visitor's attachment quota
+	response = request(t, s, "GET", "/v1/account", "", nil)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(15000), account.Stats.AttachmentTotalSize)
+}
+
+func TestServer_PublishAttachmentDedup_RemoveError(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentDedupTopics = []string{"camera"}
+	s := newTestServer(t, c)
+	s.fileCache = &failingRemoveStore{s.fileCache}
+
+	// The message was already delivered when the superseded attachment cannot be removed, so it succeeds
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/camera", util.RandomString(5000), map[string]string{
+			"Filename": "snapshot.jpg",
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "GET", "/camera/json?poll=1", "", nil)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_PublishWithTierBasedMessageSizeLimit(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+
+	// Tier without attachments, and with a message size limit below the server-wide limit
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:             "free",
+		MessageLimit:     100,
+		MessageSizeLimit: 100,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "free"))
+
+	response := request(t, s, "PUT", "/mytopic", strings.Repeat("x", 99), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, strings.Repeat("x", 99), toMessage(t, response.Body.String()).Message)
+
+	response = request(t, s, "PUT", "/mytopic", strings.Repeat("x", 101), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 413, response.Code)
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 41304, err.Code)
+	require.Equal(t, "message too large; message size limit is 100 bytes", err.Message)
+
+	// Tier limit above the server-wide limit is capped by it; larger bodies become attachments
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                     "pro",
+		MessageLimit:             100,
+		MessageSizeLimit:         100000,
+		AttachmentFileSizeLimit:  100000,
+		AttachmentTotalSizeLimit: 100000,
+		AttachmentExpiryDuration: time.Hour,
+		AttachmentBandwidthLimit: 100000,
+	}))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("ben", "pro"))
+
+	response = request(t, s, "PUT", "/mytopic", strings.Repeat("x", 4000), map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Nil(t, toMessage(t, response.Body.String()).Attachment)
+
+	response = request(t, s, "PUT", "/mytopic", strings.Repeat("x", 5000), map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(5000), toMessage(t, response.Body.String()).Attachment.Size)
+
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(4096), account.Limits.MessageSize)
+}
+
+func TestServer_PublishWithTierBasedMessageSizeLimit_ExpectContinue(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:             "free",
+		MessageLimit:     100,
+		MessageSizeLimit: 100,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "free"))
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+
+	// The declared length exceeds the tier's message size limit, so the body must never be requested
+	conn, reader := expectContinueRequest(t, httpServer, "/mytopic", 5000, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	defer conn.Close()
+	response, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	require.Equal(t, 413, response.StatusCode)
+	require.Equal(t, 41304, toHTTPError(t, readAll(t, response.Body)).Code)
+}
+
 func TestServer_PublishAttachmentWithTierBasedExpiry(t *testing.T) {
 	t.Parallel()
 	content := util.RandomString(5000) // > 4096
@@ -2509,6 +4497,58 @@ func TestServer_MessageHistoryAndStatsEndpoint(t *testing.T) {
 	require.Equal(t, `{"messages":15,"messages_rate":3.75}`+"\n", response.Body.String()) // 15 messages in 4 seconds = 3.75 messages per second
 }
 
+func TestServer_StatsEndpoint_Admin(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 200, request(t, s, "POST", "/busytopic", "some message", nil).Code)
+	}
+	require.Equal(t, 200, request(t, s, "POST", "/quiettopic", "some message", nil).Code)
+	old := newDefaultMessage("quiettopic", "old message")
+	old.Time = time.Now().Add(-2 * time.Hour).Unix()
+	old.Expires = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, s.messageCache.AddMessage(old))
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/busytopic/json", subscribeRR)
+	defer subscribeCancel()
+
+	// Anonymous and regular users only see public stats
+	response := request(t, s, "GET", "/v1/stats", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"messages":4,"messages_rate":0}`+"\n", response.Body.String())
+	response = request(t, s, "GET", "/v1/stats", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, `{"messages":4,"messages_rate":0}`+"\n", response.Body.String())
+
+	// Admins see details
+	response = request(t, s, "GET", "/v1/stats?top=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	stats, err := util.UnmarshalJSON[apiStatsAdminResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, int64(4), stats.Messages)
+	require.Equal(t, 5, stats.MessagesCached)
+	require.Equal(t, 4, stats.MessagesLastHour)
+	require.Equal(t, 5, stats.MessagesLastDay)
+	require.Equal(t, 1, stats.Subscribers)
+	require.Equal(t, 1, len(stats.Topics))
+	require.Equal(t, "busytopic", stats.Topics[0].Topic)
+	require.Equal(t, 3, stats.Topics[0].Messages)
+	require.Greater(t, stats.CacheSize, int64(0))
+
+	response = request(t, s, "GET", "/v1/stats?top=1000", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, response.Code)
+}
+
 func TestServer_MessageHistoryMaxSize(t *testing.T) {
 	t.Parallel()
 	s := newTestServer(t, newTestConfig(t))
@@ -2703,8 +4743,36 @@ func TestServer_MessageTemplate_MalformedJSONBody(t *testing.T) {
 		"X-Template": "1",
 	})
 
-	require.Equal(t, 400, response.Code)
-	require.Equal(t, 40042, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, `{"foo":"bar","nested":{"title":"here"INVALID`, m.Message) // Falls back to raw body
+	require.Equal(t, "{{.nested.title}}", m.Title)
+}
+
+func TestServer_MessageTemplate_PlainTextBody(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/mytopic?template=1&title={{.title}}", "Backup finished successfully", nil)
+
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Backup finished successfully", m.Message)
+	require.Equal(t, "{{.title}}", m.Title)
+}
+
+func TestServer_MessageTemplate_Shorthand(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", `{"alert":{"summary":"Disk full","host":"srv1"},"price":5}`, map[string]string{
+		"X-Message":  "${.alert.summary} on ${ .alert.host }, costs ${{.price}}",
+		"X-Title":    "Alert: ${.alert.summary}",
+		"X-Template": "1",
+	})
+
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Disk full on srv1, costs $5", m.Message)
+	require.Equal(t, "Alert: Disk full", m.Title)
 }
 
 func TestServer_MessageTemplate_PlaceholderTypo(t *testing.T) {
@@ -2718,8 +4786,23 @@ func TestServer_MessageTemplate_PlaceholderTypo(t *testing.T) {
 
 	require.Equal(t, 200, response.Code)
 	m := toMessage(t, response.Body.String())
-	require.Equal(t, "<no value>", m.Message)
-	require.Equal(t, "<no value>", m.Title)
+	require.Equal(t, "triggered", m.Message) // Missing fields render as empty string, and empty messages default to "triggered"
+	require.Equal(t, "", m.Title)
+}
+
+func TestServer_MessageTemplate_MissingAndNullValues(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", `{"text":"a <no value> b","nothing":null,"items":[{"name":"x"},{}]}`, map[string]string{
+		"X-Message":  `{{.text}}|{{.nothing}}|{{.missing.field}}|{{range .items}}[{{.name}}]{{end}}|{{with .text}}{{.}}{{end}}`,
+		"X-Title":    "<no value> {{.nothing}}",
+		"X-Template": "1",
+	})
+
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "a <no value> b|||[x][]|a <no value> b", m.Message) // Values are never altered, only missing fields and null are empty
+	require.Equal(t, "<no value> ", m.Title)
 }
 
 func TestServer_MessageTemplate_MultiplePlaceholders(t *testing.T) {
@@ -2909,12 +4992,15 @@ func request(t *testing.T, s *Server, method, url, body string, headers map[stri
 	return rr
 }
 
-func subscribe(t *testing.T, s *Server, url string, rr *httptest.ResponseRecorder) context.CancelFunc {
+func subscribe(t *testing.T, s *Server, url string, rr *httptest.ResponseRecorder, fn ...func(r *http.Request)) context.CancelFunc {
 	ctx, cancel := context.WithCancel(context.Background())
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	for _, f := range fn {
+		f(req)
+	}
 	done := make(chan bool)
 	go func() {
 		s.handle(rr, req)
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"golang.org/x/time/rate"
+	"path"
+	"time"
+)
+
+// TopicPublishLimit limits the number of messages that can be published to a topic, regardless of which visitor
+// publishes them. This protects the subscribers of busy shared topics, and is enforced in addition to the
+// visitor limits. Each matching topic has its own limit.
+type TopicPublishLimit struct {
+	Pattern  string        // Topic name or pattern, e.g. alerts or ci-*
+	Limit    int           // Number of messages per interval; this is also the burst
+	Interval time.Duration // Interval in which Limit messages can be published, e.g. 1m
+}
+
+// topicPublishLimit returns the publish limit for the given topic, or nil if the topic is not limited. If more
+// than one pattern matches, the first one is used.
+func (s *Server) topicPublishLimit(topic string) *TopicPublishLimit {
+	for _, limit := range s.config.TopicPublishLimits {
+		if matched, _ := path.Match(limit.Pattern, topic); matched {
+			return limit
+		}
+	}
+	return nil
+}
+
+// topicPublishLimiter returns the token bucket of the given topic, creating it if necessary, or nil if the topic
+// is not limited
+func (s *Server) topicPublishLimiter(topic string) *rate.Limiter {
+	limit := s.topicPublishLimit(topic)
+	if limit == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limiter, ok := s.topicPublishLimiters[topic]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Every(limit.Interval/time.Duration(limit.Limit)), limit.Limit)
+		s.topicPublishLimiters[topic] = limiter
+	}
+	return limiter
+}
+
+// topicPublishAvailable returns true if a message can be published to the topic, without counting it
+func (s *Server) topicPublishAvailable(topic string) bool {
+	limiter := s.topicPublishLimiter(topic)
+	return limiter == nil || limiter.Tokens() >= 1
+}
+
+// topicPublishAllowed counts a message against the topic's publish limit, and returns false if the limit is reached
+func (s *Server) topicPublishAllowed(topic string) bool {
+	limiter := s.topicPublishLimiter(topic)
+	return limiter == nil || limiter.Allow()
+}
+
+// pruneTopicPublishLimiters removes the token buckets of idle topics. A bucket that is full is the same as a new
+// one, so it can be removed without affecting the limit.
+func (s *Server) pruneTopicPublishLimiters() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for topic, limiter := range s.topicPublishLimiters {
+		if limiter.Tokens() >= float64(limiter.Burst()) {
+			delete(s.topicPublishLimiters, topic)
+		}
+	}
+}
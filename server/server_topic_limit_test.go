@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer_TopicPublishLimit_AcrossVisitors(t *testing.T) {
+	c := newTestConfig(t)
+	c.TopicPublishLimits = []*TopicPublishLimit{{Pattern: "shared", Limit: 2, Interval: time.Hour}}
+	s := newTestServer(t, c)
+
+	for i := 1; i <= 3; i++ {
+		response := request(t, s, "PUT", "/shared", "build done", nil, func(r *http.Request) {
+			r.RemoteAddr = fmt.Sprintf("1.2.3.%d:1234", i)
+		})
+		if i <= 2 {
+			require.Equal(t, 200, response.Code)
+		} else {
+			require.Equal(t, 429, response.Code)
+			require.Equal(t, 42912, toHTTPError(t, response.Body.String()).Code)
+		}
+	}
+
+	// Other topics are not limited
+	response := request(t, s, "PUT", "/other", "build done", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_TopicPublishLimit_PatternAndDryRun(t *testing.T) {
+	c := newTestConfig(t)
+	c.TopicPublishLimits = []*TopicPublishLimit{{Pattern: "ci-*", Limit: 1, Interval: time.Hour}}
+	s := newTestServer(t, c)
+
+	// Dry runs check the limit, but do not count against it
+	response := request(t, s, "PUT", "/ci-builds?dry=1", "build done", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/ci-builds", "build done", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/ci-builds?dry=1", "build done", nil)
+	require.Equal(t, 429, response.Code)
+	response = request(t, s, "PUT", "/ci-builds", "build done", nil)
+	require.Equal(t, 429, response.Code)
+
+	// Each matching topic has its own limit
+	response = request(t, s, "PUT", "/ci-deploys", "deploy done", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_TopicPublishLimit_ComposesWithVisitorLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorMessageDailyLimit = 2
+	c.TopicPublishLimits = []*TopicPublishLimit{{Pattern: "shared", Limit: 3, Interval: time.Hour}}
+	s := newTestServer(t, c)
+	visitor1 := func(r *http.Request) { r.RemoteAddr = "1.1.1.1:1234" }
+	visitor2 := func(r *http.Request) { r.RemoteAddr = "2.2.2.2:1234" }
+
+	// Messages rejected by the visitor limit do not count against the topic limit
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "PUT", "/shared", "message", nil, visitor1)
+		if i < 2 {
+			require.Equal(t, 200, response.Code)
+		} else {
+			require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+		}
+	}
+	response := request(t, s, "PUT", "/shared", "message", nil, visitor2)
+	require.Equal(t, 200, response.Code)
+
+	// Messages rejected by the topic limit do not count against the visitor limit
+	response = request(t, s, "PUT", "/shared", "message", nil, visitor2)
+	require.Equal(t, 42912, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/other", "message", nil, visitor2)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/other", "message", nil, visitor2)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_TopicPublishLimit_PruneIdle(t *testing.T) {
+	c := newTestConfig(t)
+	c.TopicPublishLimits = []*TopicPublishLimit{{Pattern: "shared", Limit: 1, Interval: 300 * time.Millisecond}}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/shared", "message", nil)
+	require.Equal(t, 200, response.Code)
+	s.pruneTopicPublishLimiters()
+	require.Contains(t, s.topicPublishLimiters, "shared")
+
+	time.Sleep(400 * time.Millisecond)
+	s.pruneTopicPublishLimiters()
+	require.NotContains(t, s.topicPublishLimiters, "shared")
+	response = request(t, s, "PUT", "/shared", "message", nil)
+	require.Equal(t, 200, response.Code)
+}
@@ -2,6 +2,10 @@ package server
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"heckel.io/ntfy/v2/log"
@@ -10,7 +14,10 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 const (
@@ -30,8 +37,128 @@ const (
 	</Say>
 	<Say>Goodbye.</Say>
 </Response>`
+	twilioCallMenuFormat = `
+<Response>
+	<Pause length="1"/>
+	<Gather numDigits="1" timeout="10" method="POST" action="%s">
+		<Say loop="2">
+			You have a message from notify on topic %s. Message:
+			<break time="1s"/>
+			%s
+			<break time="1s"/>
+			End of message.
+			<break time="1s"/>
+			This message was sent by user %s.
+			<break time="1s"/>
+			%s
+			<break time="3s"/>
+		</Say>
+	</Gather>
+	<Say>No input received. Goodbye.</Say>
+	<Hangup/>
+</Response>`
+	twilioCallMenuResponseFormat = `
+<Response>
+	<Say>%s</Say>
+	<Hangup/>
+</Response>`
+)
+
+const (
+	callMenuAck            = "ack"                // Menu target that only acknowledges the message
+	callMenuMaxItems       = 9                    // Digits 1-9, 0 is reserved
+	callMenuExpiryDuration = 30 * time.Minute     // After this time, key presses for a call are no longer accepted
+	callMenuWebhookTimeout = 10 * time.Second     // Timeout for webhooks and HTTP actions triggered by a key press
+	twilioSignatureHeader  = "X-Twilio-Signature" // See https://www.twilio.com/docs/usage/security#validating-requests
+)
+
+var (
+	callMenuItemRegex = regexp.MustCompile(`^([1-9])\s*=\s*(.+)$`)
 )
 
+// callMenu is the DTMF menu of an outgoing phone call (X-Call-Menu). It is kept in memory until the callee
+// presses a key, or until it expires. Each digit maps to either an acknowledgement, a webhook URL, or the
+// label of one of the message's "http" actions.
+type callMenu struct {
+	messageID string
+	topic     string
+	visitor   *visitor
+	items     map[string]*callMenuItem // Digit -> item
+	expires   time.Time
+}
+
+type callMenuItem struct {
+	target string  // "ack", webhook URL, or action label
+	action *action // Set if target refers to an action of the message
+}
+
+// callMenuWebhookPayload is the payload that is POSTed to a webhook URL if the callee pressed the associated key
+type callMenuWebhookPayload struct {
+	ID     string `json:"id"`
+	Topic  string `json:"topic"`
+	Digits string `json:"digits"`
+}
+
+// parseCallMenu parses the X-Call-Menu header, e.g. "1=ack, 2=https://example.com/escalate, 3=Open garage".
+// Targets that are neither "ack" nor a URL must match the label of an "http" action of the given message.
+func parseCallMenu(s string, m *message) (*callMenu, *errHTTP) {
+	menu := &callMenu{
+		messageID: m.ID,
+		topic:     m.Topic,
+		items:     make(map[string]*callMenuItem),
+	}
+	for _, part := range util.SplitNoEmpty(s, ",") {
+		matches := callMenuItemRegex.FindStringSubmatch(strings.TrimSpace(part))
+		if matches == nil {
+			return nil, errHTTPBadRequestCallMenuInvalid.Wrap("invalid menu item %q, must be <digit>=<target>", part)
+		}
+		digit, target := matches[1], strings.TrimSpace(matches[2])
+		if _, exists := menu.items[digit]; exists {
+			return nil, errHTTPBadRequestCallMenuInvalid.Wrap("digit %s is used more than once", digit)
+		}
+		item := &callMenuItem{target: target}
+		if strings.EqualFold(target, callMenuAck) {
+			item.target = callMenuAck
+		} else if !urlRegex.MatchString(target) {
+			for _, a := range m.Actions {
+				if a.Action == actionHTTP && strings.EqualFold(a.Label, target) {
+					item.action = a
+					break
+				}
+			}
+			if item.action == nil {
+				return nil, errHTTPBadRequestCallMenuInvalid.Wrap("target %q is not \"ack\", a URL, or the label of an http action", target)
+			}
+		}
+		menu.items[digit] = item
+	}
+	if len(menu.items) == 0 || len(menu.items) > callMenuMaxItems {
+		return nil, errHTTPBadRequestCallMenuInvalid
+	}
+	return menu, nil
+}
+
+// prompt returns the spoken menu, e.g. "Press 1 to acknowledge. Press 2 for Open garage."
+func (c *callMenu) prompt() string {
+	digits := make([]string, 0, len(c.items))
+	for digit := range c.items {
+		digits = append(digits, digit)
+	}
+	sort.Strings(digits)
+	lines := make([]string, 0, len(digits))
+	for _, digit := range digits {
+		item := c.items[digit]
+		if item.target == callMenuAck {
+			lines = append(lines, fmt.Sprintf("Press %s to acknowledge.", digit))
+		} else if item.action != nil {
+			lines = append(lines, fmt.Sprintf("Press %s for %s.", digit, item.action.Label))
+		} else {
+			lines = append(lines, fmt.Sprintf("Press %s to acknowledge and notify the sender.", digit))
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
 // convertPhoneNumber checks if the given phone number is verified for the given user, and if so, returns the verified
 // phone number. It also converts a boolean string ("yes", "1", "true") to the first verified phone number.
 // If the user is anonymous, it will return an error.
@@ -59,18 +186,28 @@ func (s *Server) convertPhoneNumber(u *user.User, phoneNumber string) (string, *
 }
 
 // callPhone calls the Twilio API to make a phone call to the given phone number, using the given message.
-// Failures will be logged, but not returned to the caller.
-func (s *Server) callPhone(v *visitor, r *http.Request, m *message, to string) {
+// If menu is not nil, the callee is asked to press a key, see handleCallGather. Failures will be logged,
+// but not returned to the caller.
+func (s *Server) callPhone(v *visitor, r *http.Request, m *message, to string, menu *callMenu) {
 	u, sender := v.User(), m.Sender.String()
 	if u != nil {
 		sender = u.Name
 	}
 	body := fmt.Sprintf(twilioCallFormat, xmlEscapeText(m.Topic), xmlEscapeText(m.Message), xmlEscapeText(sender))
+	if menu != nil {
+		menu.visitor = v
+		menu.expires = time.Now().Add(callMenuExpiryDuration)
+		s.mu.Lock()
+		s.callMenus[m.ID] = menu
+		s.mu.Unlock()
+		gatherURL := s.config.BaseURL + fmt.Sprintf(apiCallGatherTemplate, m.ID)
+		body = fmt.Sprintf(twilioCallMenuFormat, xmlEscapeText(gatherURL), xmlEscapeText(m.Topic), xmlEscapeText(m.Message), xmlEscapeText(sender), xmlEscapeText(menu.prompt()))
+	}
 	data := url.Values{}
 	data.Set("From", s.config.TwilioPhoneNumber)
 	data.Set("To", to)
 	data.Set("Twiml", body)
-	ev := logvrm(v, r, m).Tag(tagTwilio).Field("twilio_to", to).FieldIf("twilio_body", body, log.TraceLevel).Debug("Sending Twilio request")
+	ev := logvrm(v, r, m).Tag(tagTwilio).Field("twilio_to", to).FieldIf("twilio_body", redactString(body, s.config.RedactPatterns), log.TraceLevel).Debug("Sending Twilio request")
 	response, err := s.callPhoneInternal(data)
 	if err != nil {
 		ev.Field("twilio_response", response).Err(err).Warn("Error sending Twilio request")
@@ -101,6 +238,138 @@ func (s *Server) callPhoneInternal(data url.Values) (string, error) {
 	return string(response), nil
 }
 
+// handleCallGather is called by Twilio when the callee pressed a key during a call with a menu (X-Call-Menu), or
+// when the gather timed out. It fires the action associated with the key, and publishes a "call_ack" event to the
+// topic. The response is TwiML, since it is read out to the callee.
+func (s *Server) handleCallGather(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiCallGatherRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	messageID := matches[1]
+	if err := r.ParseForm(); err != nil {
+		return errHTTPBadRequest.Wrap("cannot parse form: %s", err.Error())
+	}
+	if !s.verifyTwilioSignature(r) {
+		return errHTTPForbidden
+	}
+	digits := r.PostForm.Get("Digits")
+	s.mu.Lock()
+	menu, ok := s.callMenus[messageID]
+	if ok && digits != "" {
+		delete(s.callMenus, messageID)
+	}
+	s.mu.Unlock()
+	if !ok || time.Now().After(menu.expires) {
+		logvr(v, r).Tag(tagTwilio).Field("message_id", messageID).Debug("Received key press for unknown or expired call menu")
+		return writeTwiML(w, "This call has expired. Goodbye.")
+	} else if digits == "" {
+		return writeTwiML(w, "No input received. Goodbye.")
+	}
+	item, ok := menu.items[digits]
+	if !ok {
+		return writeTwiML(w, "Invalid choice. Goodbye.")
+	}
+	ev := logv(menu.visitor).Tag(tagTwilio).Fields(log.Context{
+		"message_id":       messageID,
+		"call_menu_digits": digits,
+		"call_menu_target": item.target,
+	})
+	ev.Debug("Callee pressed %s, firing menu action", digits)
+	if item.action != nil {
+		go s.callMenuFireAction(ev, item.action.Method, item.action.URL, item.action.Headers, item.action.Body)
+	} else if item.target != callMenuAck {
+		payload, err := json.Marshal(&callMenuWebhookPayload{ID: messageID, Topic: menu.topic, Digits: digits})
+		if err != nil {
+			return err
+		}
+		go s.callMenuFireAction(ev, http.MethodPost, item.target, map[string]string{"Content-Type": "application/json"}, string(payload))
+	}
+	t, err := s.topicFromID(menu.topic)
+	if err != nil {
+		return err
+	}
+	ack := newCallAckMessage(menu.topic, messageID, digits)
+	if err := t.Publish(menu.visitor, ack); err != nil {
+		return err
+	}
+	return writeTwiML(w, "Thank you, your response has been recorded. Goodbye.")
+}
+
+// callMenuFireAction sends the HTTP request associated with a call menu item. Since the URL is supplied by the
+// publisher, private IP addresses are never contacted. Failures are logged only.
+func (s *Server) callMenuFireAction(ev *log.Event, method, actionURL string, headers map[string]string, body string) {
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, actionURL, strings.NewReader(body))
+	if err != nil {
+		ev.Err(err).Warn("Cannot create call menu request")
+		return
+	}
+	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.callMenuClient.Do(req) // No private IPs, see newPublicHTTPClient
+	if err != nil {
+		ev.Err(err).Warn("Error sending call menu request")
+		return
+	}
+	defer resp.Body.Close()
+	ev.Field("call_menu_response_status", resp.StatusCode).Debug("Call menu request sent")
+}
+
+// verifyTwilioSignature checks the X-Twilio-Signature header of a Twilio callback. The signature is computed
+// over the full URL (as configured via base-url) and the sorted POST parameters, see
+// https://www.twilio.com/docs/usage/webhooks/webhooks-security
+func (s *Server) verifyTwilioSignature(r *http.Request) bool {
+	signature := r.Header.Get(twilioSignatureHeader)
+	if signature == "" {
+		return false
+	}
+	expected := twilioSignature(s.config.TwilioAuthToken, s.config.BaseURL+r.URL.RequestURI(), r.PostForm)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+func twilioSignature(authToken, requestURL string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(requestURL)
+	for _, k := range keys {
+		values := append([]string{}, params[k]...)
+		sort.Strings(values)
+		for _, value := range values {
+			b.WriteString(k)
+			b.WriteString(value)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// pruneCallMenus removes call menus for which the callee has not pressed a key in time
+func (s *Server) pruneCallMenus() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, menu := range s.callMenus {
+		if time.Now().After(menu.expires) {
+			delete(s.callMenus, id)
+		}
+	}
+}
+
+func writeTwiML(w http.ResponseWriter, text string) error {
+	w.Header().Set("Content-Type", "text/xml")
+	_, err := io.WriteString(w, fmt.Sprintf(twilioCallMenuResponseFormat, xmlEscapeText(text)))
+	return err
+}
+
 func (s *Server) verifyPhoneNumber(v *visitor, r *http.Request, phoneNumber, channel string) error {
 	ev := logvr(v, r).Tag(tagTwilio).Field("twilio_to", phoneNumber).Field("twilio_channel", channel).Debug("Sending phone verification")
 	data := url.Values{}
@@ -1,14 +1,20 @@
 package server
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestServer_Twilio_Call_Add_Verify_Call_Delete_Success(t *testing.T) {
@@ -157,6 +163,55 @@ func TestServer_Twilio_Call_Success(t *testing.T) {
 	})
 }
 
+func TestServer_Twilio_Call_RedactPatternsInLogs(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetLevel(log.TraceLevel)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.ErrorLevel) // See TestMain
+	})
+
+	var called atomic.Bool
+	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Contains(t, string(body), "password%3Dhunter2") // Twilio receives the original message
+		called.Store(true)
+	}))
+	defer twilioServer.Close()
+
+	c := newTestConfigWithAuthFile(t)
+	c.TwilioCallsBaseURL = twilioServer.URL
+	c.TwilioAccount = "AC1234567890"
+	c.TwilioAuthToken = "AAEAA1234567890"
+	c.TwilioPhoneNumber = "+1234567890"
+	c.RedactPatterns = []*regexp.Regexp{regexp.MustCompile(`password=\S+`)}
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "pro",
+		MessageLimit: 10,
+		CallLimit:    1,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+
+	response := request(t, s, "POST", "/mytopic", "login with password=hunter2 failed", map[string]string{
+		"authorization": util.BasicAuth("phil", "phil"),
+		"x-call":        "+11122233344",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return called.Load()
+	})
+	require.Contains(t, out.String(), "Sending Twilio request")
+	require.NotContains(t, out.String(), "hunter2")
+}
+
 func TestServer_Twilio_Call_Success_With_Yes(t *testing.T) {
 	var called atomic.Bool
 	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -262,3 +317,207 @@ func TestServer_Twilio_Call_Unconfigured(t *testing.T) {
 	})
 	require.Equal(t, 40032, toHTTPError(t, response.Body.String()).Code)
 }
+
+func TestServer_Twilio_Call_Menu_Ack_And_Webhook(t *testing.T) {
+	var twiml atomic.Pointer[string]
+	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		twiml.Store(util.String(r.PostForm.Get("Twiml")))
+	}))
+	defer twilioServer.Close()
+	var webhookBody atomic.Pointer[string]
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, "POST", r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		webhookBody.Store(util.String(string(body)))
+	}))
+	defer webhookServer.Close()
+
+	s := newTestServerWithCalls(t, twilioServer.URL)
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "POST", "/mytopic", "server is on fire", map[string]string{
+		"authorization": util.BasicAuth("phil", "phil"),
+		"x-call":        "yes",
+		"x-call-menu":   "1=ack, 2=" + webhookServer.URL,
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	waitFor(t, func() bool {
+		return twiml.Load() != nil
+	})
+	require.Contains(t, *twiml.Load(), `<Gather numDigits="1" timeout="10" method="POST" action="http://127.0.0.1:12345/v1/call/`+m.ID+`/gather">`)
+	require.Contains(t, *twiml.Load(), `Press 1 to acknowledge. Press 2 to acknowledge and notify the sender.`)
+	require.Contains(t, *twiml.Load(), `<Say>No input received. Goodbye.</Say>`)
+
+	// Callee presses 2
+	response = twilioGatherRequest(t, s, m.ID, "2")
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "text/xml", response.Header().Get("Content-Type"))
+	require.Contains(t, response.Body.String(), "Thank you, your response has been recorded. Goodbye.")
+	waitFor(t, func() bool {
+		return webhookBody.Load() != nil
+	})
+	require.Equal(t, `{"id":"`+m.ID+`","topic":"mytopic","digits":"2"}`, *webhookBody.Load())
+
+	// Menu is one-time use
+	response = twilioGatherRequest(t, s, m.ID, "1")
+	require.Contains(t, response.Body.String(), "This call has expired. Goodbye.")
+
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, m.ID, messages[1].ID)
+	require.Equal(t, callAckEvent, messages[2].Event)
+	require.Equal(t, "Message "+m.ID+" acknowledged via phone call, key 2 pressed", messages[2].Message)
+}
+
+func TestServer_Twilio_Call_Menu_Webhook_NonPublicIPNotAllowed(t *testing.T) {
+	var called atomic.Bool
+	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called.Store(true)
+	}))
+	defer twilioServer.Close()
+	var webhookRequests atomic.Int32
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookRequests.Add(1)
+	}))
+	defer webhookServer.Close()
+
+	s := newTestServerWithCalls(t, twilioServer.URL)
+	s.callMenuClient = newPublicHTTPClient(callMenuWebhookTimeout)
+	response := request(t, s, "POST", "/mytopic", "server is on fire", map[string]string{
+		"authorization": util.BasicAuth("phil", "phil"),
+		"x-call":        "yes",
+		"x-call-menu":   "2=" + webhookServer.URL, // 127.0.0.1
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	waitFor(t, func() bool {
+		return called.Load()
+	})
+
+	// The key press is still recorded, but the webhook is never called
+	response = twilioGatherRequest(t, s, m.ID, "2")
+	require.Equal(t, 200, response.Code)
+	require.Contains(t, response.Body.String(), "Thank you, your response has been recorded. Goodbye.")
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(0), webhookRequests.Load())
+}
+
+func TestServer_Twilio_Call_Menu_HTTPAction(t *testing.T) {
+	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer twilioServer.Close()
+	var actionCalled atomic.Bool
+	actionServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, "PUT", r.Method)
+		require.Equal(t, "close", string(body))
+		actionCalled.Store(true)
+	}))
+	defer actionServer.Close()
+
+	s := newTestServerWithCalls(t, twilioServer.URL)
+	response := request(t, s, "POST", "/mytopic", "garage door open", map[string]string{
+		"authorization": util.BasicAuth("phil", "phil"),
+		"x-call":        "yes",
+		"x-call-menu":   "3=Close door",
+		"x-actions":     "http, Close door, " + actionServer.URL + ", method=PUT, body=close",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	waitFor(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.callMenus[m.ID] != nil
+	})
+
+	response = twilioGatherRequest(t, s, m.ID, "3")
+	require.Contains(t, response.Body.String(), "Thank you, your response has been recorded. Goodbye.")
+	waitFor(t, func() bool {
+		return actionCalled.Load()
+	})
+}
+
+func TestServer_Twilio_Call_Menu_NoInput_And_InvalidChoice(t *testing.T) {
+	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer twilioServer.Close()
+
+	s := newTestServerWithCalls(t, twilioServer.URL)
+	response := request(t, s, "POST", "/mytopic", "hi there", map[string]string{
+		"authorization": util.BasicAuth("phil", "phil"),
+		"x-call":        "yes",
+		"x-call-menu":   "1=ack",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	waitFor(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.callMenus[m.ID] != nil
+	})
+
+	response = twilioGatherRequest(t, s, m.ID, "")
+	require.Contains(t, response.Body.String(), "No input received. Goodbye.")
+	response = twilioGatherRequest(t, s, m.ID, "5")
+	require.Contains(t, response.Body.String(), "Invalid choice. Goodbye.")
+}
+
+func TestServer_Twilio_Call_Menu_InvalidSignature(t *testing.T) {
+	s := newTestServerWithCalls(t, "http://127.0.0.1:1")
+	response := request(t, s, "POST", "/v1/call/abcdefghijkl/gather", "Digits=1", map[string]string{
+		"Content-Type":       "application/x-www-form-urlencoded",
+		"X-Twilio-Signature": "invalid",
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_Twilio_Call_Menu_Invalid(t *testing.T) {
+	s := newTestServerWithCalls(t, "http://127.0.0.1:1")
+	for _, menu := range []string{"0=ack", "1=ack,1=ack", "1", "1=Unknown action", "x=ack"} {
+		response := request(t, s, "POST", "/mytopic", "hi there", map[string]string{
+			"authorization": util.BasicAuth("phil", "phil"),
+			"x-call":        "yes",
+			"x-call-menu":   menu,
+		})
+		require.Equal(t, 40047, toHTTPError(t, response.Body.String()).Code, menu)
+	}
+}
+
+func newTestServerWithCalls(t *testing.T, twilioCallsBaseURL string) *Server {
+	c := newTestConfigWithAuthFile(t)
+	c.TwilioCallsBaseURL = twilioCallsBaseURL
+	c.TwilioAccount = "AC1234567890"
+	c.TwilioAuthToken = "AAEAA1234567890"
+	c.TwilioPhoneNumber = "+1234567890"
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "pro",
+		MessageLimit: 10,
+		CallLimit:    10,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+	s.callMenuClient = http.DefaultClient // The webhook and action servers run on 127.0.0.1
+	return s
+}
+
+func twilioGatherRequest(t *testing.T, s *Server, messageID, digits string) *httptest.ResponseRecorder {
+	path := "/v1/call/" + messageID + "/gather"
+	form := url.Values{}
+	form.Set("CallSid", "CA1234567890")
+	form.Set("Digits", digits)
+	return request(t, s, "POST", path, form.Encode(), map[string]string{
+		"Content-Type":       "application/x-www-form-urlencoded",
+		"X-Twilio-Signature": twilioSignature(s.config.TwilioAuthToken, s.config.BaseURL+path, form),
+	})
+}
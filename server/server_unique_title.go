@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// UniqueTitleModeSuppress rejects a message if a message with the same title was published recently
+	UniqueTitleModeSuppress = "suppress"
+
+	// UniqueTitleModeUpdate publishes the message, and deletes recent messages with the same title from the cache
+	UniqueTitleModeUpdate = "update"
+
+	// DefaultUniqueTitleWindow is the time window in which titles must be unique, if not set for the topic
+	DefaultUniqueTitleWindow = time.Hour
+)
+
+// UniqueTitleTopic enforces unique message titles on a topic within a time window, so that e.g. repeated alerts
+// do not pile up. Only cached messages are considered, and messages without a title are never affected.
+type UniqueTitleTopic struct {
+	Topic  string        // Topic, e.g. alerts
+	Mode   string        // UniqueTitleModeSuppress or UniqueTitleModeUpdate
+	Window time.Duration // Only messages published within this window count as duplicates
+}
+
+// uniqueTitleTopic returns the unique title config for the topic, or nil if titles are not unique on the topic
+func (s *Server) uniqueTitleTopic(topic string) *UniqueTitleTopic {
+	for _, uniqueTitleTopic := range s.config.UniqueTitleTopics {
+		if uniqueTitleTopic.Topic == topic {
+			return uniqueTitleTopic
+		}
+	}
+	return nil
+}
+
+// checkUniqueTitle rejects the message with errHTTPConflictTitleExists, if the topic is in suppress mode and a
+// message with the same title was published within the window. An attachment that was already uploaded for the
+// rejected message is removed.
+func (s *Server) checkUniqueTitle(v *visitor, r *http.Request, m *message) error {
+	uniqueTitleTopic := s.uniqueTitleTopic(m.Topic)
+	if uniqueTitleTopic == nil || uniqueTitleTopic.Mode != UniqueTitleModeSuppress || m.Event != messageEvent || m.Title == "" {
+		return nil
+	}
+	ids, err := s.messageCache.MessagesByTitle(m.Topic, m.Title, m.ID, time.Now().Add(-uniqueTitleTopic.Window))
+	if err != nil {
+		return err
+	} else if len(ids) == 0 {
+		return nil
+	}
+	if m.Attachment != nil && m.Attachment.Expires > 0 && s.fileCache != nil {
+		if err := s.fileCache.Remove(m.ID); err != nil {
+			return err
+		}
+	}
+	logvrm(v, r, m).
+		Tag(tagPublish).
+		Field("message_duplicate_ids", ids).
+		Debug("Suppressing message, title was published recently")
+	return errHTTPConflictTitleExists.With(m)
+}
+
+// maybeReplaceMessagesWithSameTitle deletes the messages with the same title that were published within the window
+// from the cache, including their attachments, if the topic is in update mode. The new message must be cached
+// already, so that pollers and reconnecting subscribers only receive the latest message. Since this happens after
+// the message was delivered, errors are only logged by the caller, and do not fail the publish request.
+func (s *Server) maybeReplaceMessagesWithSameTitle(v *visitor, r *http.Request, m *message) error {
+	uniqueTitleTopic := s.uniqueTitleTopic(m.Topic)
+	if uniqueTitleTopic == nil || uniqueTitleTopic.Mode != UniqueTitleModeUpdate || m.Event != messageEvent || m.Title == "" {
+		return nil
+	}
+	ids, err := s.messageCache.MessagesByTitle(m.Topic, m.Title, m.ID, time.Now().Add(-uniqueTitleTopic.Window))
+	if err != nil {
+		return err
+	} else if len(ids) == 0 {
+		return nil
+	}
+	logvrm(v, r, m).
+		Tag(tagPublish).
+		Field("message_replaced_ids", ids).
+		Debug("Deleting %d message(s) replaced by message with the same title", len(ids))
+	if err := s.messageCache.DeleteMessages(ids...); err != nil {
+		return err
+	}
+	if s.fileCache != nil {
+		return s.fileCache.Remove(append(ids, s.iconFileIDs(ids...)...)...)
+	}
+	return nil
+}
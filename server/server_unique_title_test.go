@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_UniqueTitle_Suppress(t *testing.T) {
+	c := newTestConfig(t)
+	c.UniqueTitleTopics = []*UniqueTitleTopic{{Topic: "alerts", Mode: UniqueTitleModeSuppress, Window: time.Hour}}
+	s := newTestServer(t, c)
+
+	rr := request(t, s, "PUT", "/alerts", "disk full", map[string]string{"Title": "Disk alert"})
+	require.Equal(t, 200, rr.Code)
+	first := toMessage(t, rr.Body.String())
+
+	// Duplicate title is rejected, also via JSON, and uploaded attachments are removed
+	rr = request(t, s, "PUT", "/alerts", "disk still full", map[string]string{"Title": "Disk alert"})
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40906, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/", `{"topic":"alerts","title":"Disk alert","message":"disk still full"}`, nil)
+	require.Equal(t, 409, rr.Code)
+	rr = request(t, s, "PUT", "/alerts", util.RandomString(5000), map[string]string{"Title": "Disk alert", "X-Message-ID": "disk12345678"})
+	require.Equal(t, 409, rr.Code)
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, "disk12345678"))
+
+	// Other titles, messages without title and other topics are unaffected
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "cpu hot", map[string]string{"Title": "CPU alert"}).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "no title", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "no title", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/other", "disk full", map[string]string{"Title": "Disk alert"}).Code)
+
+	rr = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, first.ID, messages[0].ID)
+	require.Equal(t, "disk full", messages[0].Message)
+}
+
+func TestServer_UniqueTitle_Suppress_OutsideWindow(t *testing.T) {
+	c := newTestConfig(t)
+	c.UniqueTitleTopics = []*UniqueTitleTopic{{Topic: "alerts", Mode: UniqueTitleModeSuppress, Window: time.Hour}}
+	s := newTestServer(t, c)
+
+	m := newDefaultMessage("alerts", "disk full")
+	m.Title = "Disk alert"
+	m.Time = time.Now().Add(-2 * time.Hour).Unix()
+	require.Nil(t, s.messageCache.AddMessage(m))
+
+	rr := request(t, s, "PUT", "/alerts", "disk full again", map[string]string{"Title": "Disk alert"})
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestServer_UniqueTitle_Update(t *testing.T) {
+	c := newTestConfig(t)
+	c.UniqueTitleTopics = []*UniqueTitleTopic{{Topic: "alerts", Mode: UniqueTitleModeUpdate, Window: time.Hour}}
+	s := newTestServer(t, c)
+
+	rr := request(t, s, "PUT", "/alerts", "disk 90% full", map[string]string{"Title": "Disk alert"})
+	require.Equal(t, 200, rr.Code)
+	first := toMessage(t, rr.Body.String())
+	rr = request(t, s, "PUT", "/alerts", util.RandomString(5000), map[string]string{"Title": "Disk alert", "Filename": "df.txt"})
+	require.Equal(t, 200, rr.Code)
+	second := toMessage(t, rr.Body.String())
+	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, second.ID))
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "cpu hot", map[string]string{"Title": "CPU alert"}).Code)
+
+	// Only the latest message with the title is kept, the earlier one's attachment is removed
+	rr = request(t, s, "PUT", "/alerts", "disk 99% full", map[string]string{"Title": "Disk alert"})
+	require.Equal(t, 200, rr.Code)
+	third := toMessage(t, rr.Body.String())
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, second.ID))
+
+	rr = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "CPU alert", messages[0].Title)
+	require.Equal(t, third.ID, messages[1].ID)
+	require.Equal(t, "disk 99% full", messages[1].Message)
+	for _, m := range messages {
+		require.NotEqual(t, first.ID, m.ID)
+	}
+}
+
+func TestServer_UniqueTitle_Update_RemoveError(t *testing.T) {
+	c := newTestConfig(t)
+	c.UniqueTitleTopics = []*UniqueTitleTopic{{Topic: "alerts", Mode: UniqueTitleModeUpdate, Window: time.Hour}}
+	s := newTestServer(t, c)
+	s.fileCache = &failingRemoveStore{s.fileCache}
+
+	rr := request(t, s, "PUT", "/alerts", util.RandomString(5000), map[string]string{"Title": "Disk alert", "Filename": "df.txt"})
+	require.Equal(t, 200, rr.Code)
+	first := toMessage(t, rr.Body.String())
+
+	// The message was already delivered when the earlier message's attachment cannot be removed, so it succeeds
+	rr = request(t, s, "PUT", "/alerts", "disk 99% full", map[string]string{"Title": "Disk alert"})
+	require.Equal(t, 200, rr.Code)
+	second := toMessage(t, rr.Body.String())
+
+	rr = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, second.ID, messages[0].ID)
+	require.NotEqual(t, first.ID, messages[0].ID)
+}
+
+// failingRemoveStore is an attachmentStore that fails to remove attachments
+type failingRemoveStore struct {
+	attachmentStore
+}
+
+func (c *failingRemoveStore) Remove(ids ...string) error {
+	return errors.New("cannot remove attachments")
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	tagExpandURL = "expand_url"
+
+	// ExpandURLModeRewrite replaces shortened URLs in the message body with the URL they redirect to
+	ExpandURLModeRewrite = "rewrite"
+
+	// ExpandURLModeAnnotate keeps shortened URLs in the message body, and appends the URL they redirect to
+	ExpandURLModeAnnotate = "annotate"
+
+	expandURLMaxRedirects      = 5  // Max. number of redirects followed within the shortener hosts
+	expandURLMaxURLsPerMessage = 10 // Max. number of URLs expanded per message, to bound the publish latency
+)
+
+var (
+	expandURLRegex             = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+	errExpandURLNotRedirecting = errors.New("shortener did not redirect")
+)
+
+// urlExpander resolves a shortened URL to the URL it redirects to. In tests, this can be implemented with a stub.
+type urlExpander interface {
+	Expand(shortURL string) (string, error)
+}
+
+// urlExpanderImpl is a urlExpander that asks the URL shortener where a URL redirects to. Redirects are only
+// followed as long as they stay on the allowlisted shortener hosts (e.g. t.co -> bit.ly), so the final destination
+// itself is never requested. Private IP addresses are never contacted, see newPublicHTTPClient.
+type urlExpanderImpl struct {
+	client *http.Client
+}
+
+func newURLExpander(hosts []string, timeout time.Duration) *urlExpanderImpl {
+	client := newPublicHTTPClient(timeout)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= expandURLMaxRedirects || !isExpandURLHost(hosts, req.URL) {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	return &urlExpanderImpl{
+		client: client,
+	}
+}
+
+func (e *urlExpanderImpl) Expand(shortURL string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, shortURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return "", errExpandURLNotRedirecting
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", err
+	}
+	return location.String(), nil
+}
+
+// maybeExpandURLs expands shortened URLs in the message body (see Config.ExpandURLHosts), if enabled. URLs that
+// cannot be expanded are left as they are; expansion never fails the publish request.
+func (s *Server) maybeExpandURLs(r *http.Request, v *visitor, m *message) {
+	if s.urlExpander == nil || m.Encoding != "" {
+		return
+	}
+	expansions := make(map[string]string) // Short URL -> long URL, empty if it could not be expanded
+	for _, candidate := range expandURLRegex.FindAllString(m.Message, -1) {
+		shortURL := strings.TrimRight(candidate, ".,;:!?")
+		if _, exists := expansions[shortURL]; exists {
+			continue
+		} else if len(expansions) >= expandURLMaxURLsPerMessage {
+			break
+		}
+		u, err := url.Parse(shortURL)
+		if err != nil || !isExpandURLHost(s.config.ExpandURLHosts, u) || strings.Trim(u.Path, "/") == "" {
+			continue
+		}
+		ev := logvrm(v, r, m).Tag(tagExpandURL).Field("expand_url_short", shortURL)
+		longURL, err := s.urlExpander.Expand(shortURL)
+		if err != nil {
+			ev.Err(err).Debug("Unable to expand URL")
+		} else {
+			ev.Field("expand_url_long", longURL).Debug("Expanded URL")
+		}
+		expansions[shortURL] = longURL
+	}
+	m.Message = expandURLRegex.ReplaceAllStringFunc(m.Message, func(candidate string) string {
+		shortURL := strings.TrimRight(candidate, ".,;:!?")
+		longURL := expansions[shortURL]
+		if longURL == "" {
+			return candidate
+		} else if s.config.ExpandURLMode == ExpandURLModeAnnotate {
+			return fmt.Sprintf("%s (%s)%s", shortURL, longURL, candidate[len(shortURL):])
+		}
+		return longURL + candidate[len(shortURL):]
+	})
+}
+
+// isExpandURLHost returns true if the URL's host is one of the allowlisted shortener hosts
+func isExpandURLHost(hosts []string, u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	for _, h := range hosts {
+		if host == h {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testURLExpander struct {
+	urls     map[string]string
+	expanded []string
+	mu       sync.Mutex
+}
+
+func (e *testURLExpander) Expand(shortURL string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expanded = append(e.expanded, shortURL)
+	if longURL, ok := e.urls[shortURL]; ok {
+		return longURL, nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestServer_ExpandURLs_Rewrite(t *testing.T) {
+	c := newTestConfig(t)
+	c.ExpandURLHosts = []string{"bit.ly", "t.co"}
+	s := newTestServer(t, c)
+	expander := &testURLExpander{urls: map[string]string{
+		"https://bit.ly/3xYz": "https://example.com/incidents/42?utm_source=twitter",
+	}}
+	s.urlExpander = expander
+
+	response := request(t, s, "PUT", "/mytopic", "Incident: https://bit.ly/3xYz. Docs: https://docs.example.com/x, broken: https://t.co/nope (see https://bit.ly/3xYz)", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Incident: https://example.com/incidents/42?utm_source=twitter. Docs: https://docs.example.com/x, broken: https://t.co/nope (see https://example.com/incidents/42?utm_source=twitter)", m.Message)
+
+	// Only allowlisted hosts are expanded, and each URL only once
+	require.Equal(t, []string{"https://bit.ly/3xYz", "https://t.co/nope"}, expander.expanded)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, m.Message, toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_ExpandURLs_Annotate(t *testing.T) {
+	c := newTestConfig(t)
+	c.ExpandURLHosts = []string{"bit.ly"}
+	c.ExpandURLMode = ExpandURLModeAnnotate
+	s := newTestServer(t, c)
+	s.urlExpander = &testURLExpander{urls: map[string]string{
+		"https://bit.ly/3xYz": "https://example.com/incidents/42",
+	}}
+
+	response := request(t, s, "PUT", "/mytopic", "See https://bit.ly/3xYz!", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "See https://bit.ly/3xYz (https://example.com/incidents/42)!", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_ExpandURLs_DisabledByDefault(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	require.Nil(t, s.urlExpander)
+
+	response := request(t, s, "PUT", "/mytopic", "See https://bit.ly/3xYz", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "See https://bit.ly/3xYz", toMessage(t, response.Body.String()).Message)
+}
+
+func TestURLExpander_Expand(t *testing.T) {
+	hosts := []string{"127.0.0.1"} // The test server stands in for the shortener
+	var shortener *httptest.Server
+	shortener = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hop":
+			http.Redirect(w, r, shortener.URL+"/short", http.StatusFound)
+		case "/short":
+			http.Redirect(w, r, "https://example.com/final", http.StatusMovedPermanently)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer shortener.Close()
+
+	expander := newURLExpander(hosts, DefaultExpandURLTimeout)
+	expander.client.Transport = http.DefaultTransport // The test server runs on 127.0.0.1
+
+	// Redirects on shortener hosts are followed, the final destination is not requested
+	longURL, err := expander.Expand(shortener.URL + "/hop")
+	require.Nil(t, err)
+	require.Equal(t, "https://example.com/final", longURL)
+
+	_, err = expander.Expand(shortener.URL + "/not-a-redirect")
+	require.Equal(t, errExpandURLNotRedirecting, err)
+}
+
+func TestURLExpander_NoPrivateIPs(t *testing.T) {
+	expander := newURLExpander([]string{"127.0.0.1"}, DefaultExpandURLTimeout)
+	_, err := expander.Expand("http://127.0.0.1:1/abc")
+	require.ErrorIs(t, err, errNonPublicIPAddress)
+}
+
+func TestIsExpandURLHost(t *testing.T) {
+	hosts := []string{"bit.ly", "t.co"}
+	for _, s := range []string{"https://bit.ly/abc", "http://www.BIT.ly/abc", "https://t.co:443/x"} {
+		u, _ := url.Parse(s)
+		require.True(t, isExpandURLHost(hosts, u), s)
+	}
+	for _, s := range []string{"https://bit.ly.evil.com/abc", "ftp://bit.ly/abc", "https://example.com/bit.ly"} {
+		u, _ := url.Parse(s)
+		require.False(t, isExpandURLHost(hosts, u), s)
+	}
+}
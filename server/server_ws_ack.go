@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/util"
+)
+
+const (
+	tagWebsocketAck = "websocket_ack"
+
+	wsAckEvent              = "ack" // Command sent by the client to acknowledge a delivery, see wsCommand
+	wsAckReadLimit          = 512   // Enough for an ack command, see wsReadLimit
+	deliveryIDLength        = 12
+	ackConsumerPendingLimit = 1000           // Max. number of unacknowledged deliveries kept per consumer, oldest are dropped
+	ackConsumerExpiry       = 24 * time.Hour // Consumers without connection are forgotten after this time
+	ackConsumerVisitorLimit = 10             // Max. number of consumers per user (or IP address for anonymous visitors)
+)
+
+var (
+	ackConsumerIDRegex = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+)
+
+// wsCommand is a command sent by a WebSocket client, e.g. {"event":"ack","delivery_id":"..."}
+type wsCommand struct {
+	Event      string `json:"event"`
+	DeliveryID string `json:"delivery_id"`
+}
+
+// ackConsumer tracks the messages delivered to a WebSocket subscriber that requires acknowledgments (ack_consumer=...).
+// Messages stay pending until the client acks their delivery ID, and pending messages are delivered again when the
+// consumer reconnects (at-least-once delivery). Consumers are kept in memory only, so pending deliveries do not
+// survive a server restart.
+type ackConsumer struct {
+	owner      string     // User ID, or IP address for anonymous visitors, see ackConsumerOwner
+	pending    []*message // Delivered but unacknowledged messages (with DeliveryID), oldest first
+	connection int        // Sequence number of the active connection, 0 if not connected
+	cancel     func()     // Cancels the active connection, if any
+	lastSeen   time.Time
+	mu         sync.Mutex
+}
+
+// Deliver returns a copy of the message with a new delivery ID, and remembers it as pending. If the message is
+// already pending (e.g. because it was re-sent on reconnect), it returns false, so that it is not sent twice.
+func (c *ackConsumer) Deliver(m *message) (*message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pending {
+		if p.ID == m.ID {
+			return nil, false
+		}
+	}
+	delivery := *m
+	delivery.DeliveryID = util.RandomString(deliveryIDLength)
+	c.pending = append(c.pending, &delivery)
+	if len(c.pending) > ackConsumerPendingLimit {
+		c.pending = c.pending[len(c.pending)-ackConsumerPendingLimit:]
+	}
+	return &delivery, true
+}
+
+// Ack removes the delivery with the given ID from the pending messages, and returns false if there is no such delivery
+func (c *ackConsumer) Ack(deliveryID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.pending {
+		if p.DeliveryID == deliveryID {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the delivered but unacknowledged messages, oldest first
+func (c *ackConsumer) Pending() []*message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := make([]*message, len(c.pending))
+	copy(pending, c.pending)
+	return pending
+}
+
+// parseAckConsumer reads the consumer ID of a subscriber that requires acknowledgments, or returns an empty string
+func parseAckConsumer(r *http.Request) (string, error) {
+	consumerID := readParam(r, "x-ack-consumer", "ack-consumer", "ack_consumer")
+	if consumerID != "" && !ackConsumerIDRegex.MatchString(consumerID) {
+		return "", errHTTPBadRequestAckConsumerInvalid
+	}
+	return consumerID, nil
+}
+
+// attachAckConsumer returns the consumer for the given visitor, topics and consumer ID, creating it if necessary, and
+// makes the calling connection its active connection. Only one connection per consumer can be active, so an existing
+// connection is canceled (e.g. if the client reconnected before the server noticed the old connection was gone).
+// The returned connection number must be passed to detachAckConsumer.
+//
+// Consumers belong to the user, or to the IP address for anonymous visitors, so that other visitors cannot take over
+// a consumer (and its pending deliveries) by guessing its ID. Each owner can have at most ackConsumerVisitorLimit
+// consumers; if the limit is reached, the least recently seen disconnected consumer is forgotten.
+func (s *Server) attachAckConsumer(v *visitor, topicsStr, consumerID string, cancel func()) (*ackConsumer, int, error) {
+	owner := ackConsumerOwner(v)
+	key := owner + "/" + topicsStr + "/" + consumerID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	consumer, ok := s.ackConsumers[key]
+	if !ok {
+		if err := s.evictAckConsumer(owner); err != nil {
+			return nil, 0, err
+		}
+		consumer = &ackConsumer{owner: owner, pending: make([]*message, 0)}
+		s.ackConsumers[key] = consumer
+	}
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	if consumer.cancel != nil {
+		consumer.cancel()
+	}
+	s.ackConnections++
+	consumer.connection = s.ackConnections
+	consumer.cancel = cancel
+	consumer.lastSeen = time.Now()
+	return consumer, consumer.connection, nil
+}
+
+// evictAckConsumer makes room for a new consumer of the given owner, if the owner has reached
+// ackConsumerVisitorLimit, by removing its least recently seen disconnected consumer. If all consumers are
+// connected, an error is returned. Must be called with s.mu held.
+func (s *Server) evictAckConsumer(owner string) error {
+	var count int
+	var oldestKey string
+	var oldestLastSeen time.Time
+	for key, consumer := range s.ackConsumers {
+		if consumer.owner != owner {
+			continue
+		}
+		count++
+		consumer.mu.Lock()
+		if consumer.connection == 0 && (oldestKey == "" || consumer.lastSeen.Before(oldestLastSeen)) {
+			oldestKey, oldestLastSeen = key, consumer.lastSeen
+		}
+		consumer.mu.Unlock()
+	}
+	if count < ackConsumerVisitorLimit {
+		return nil
+	} else if oldestKey == "" {
+		return errHTTPTooManyRequestsLimitAckConsumers
+	}
+	delete(s.ackConsumers, oldestKey)
+	return nil
+}
+
+// ackConsumerOwner returns the owner of the visitor's consumers: the user ID for authenticated users, and the
+// IP address (or prefix, see visitor) for anonymous visitors
+func ackConsumerOwner(v *visitor) string {
+	if userID := v.MaybeUserID(); userID != "" {
+		return "user:" + userID
+	}
+	return "ip:" + v.IP().String()
+}
+
+// detachAckConsumer marks the consumer as disconnected, unless another connection has taken over in the meantime
+func (s *Server) detachAckConsumer(consumer *ackConsumer, connection int) {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	if consumer.connection == connection {
+		consumer.connection = 0
+		consumer.cancel = nil
+		consumer.lastSeen = time.Now()
+	}
+}
+
+// pruneAckConsumers removes the consumers that have not been connected for ackConsumerExpiry, along with their
+// pending deliveries
+func (s *Server) pruneAckConsumers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, consumer := range s.ackConsumers {
+		consumer.mu.Lock()
+		expired := consumer.connection == 0 && time.Since(consumer.lastSeen) > ackConsumerExpiry
+		consumer.mu.Unlock()
+		if expired {
+			delete(s.ackConsumers, key)
+		}
+	}
+}
+
+// handleWebSocketCommand processes a command sent by a WebSocket client. Unknown commands and acks for unknown
+// deliveries are ignored, since they may have been acked or dropped already.
+func (s *Server) handleWebSocketCommand(v *visitor, r *http.Request, consumer *ackConsumer, data []byte) {
+	var cmd wsCommand
+	if err := json.Unmarshal(data, &cmd); err != nil || cmd.Event != wsAckEvent {
+		logvr(v, r).Tag(tagWebsocketAck).Debug("Ignoring invalid WebSocket command")
+		return
+	}
+	if !consumer.Ack(cmd.DeliveryID) {
+		logvr(v, r).Tag(tagWebsocketAck).Field("delivery_id", cmd.DeliveryID).Debug("Ignoring ack for unknown delivery")
+		return
+	}
+	logvr(v, r).Tag(tagWebsocketAck).Field("delivery_id", cmd.DeliveryID).Trace("Delivery acknowledged")
+}
+
+// ackSubscriber wraps a subscriber, so that each message that passes the filters is delivered with a delivery ID,
+// and remembered by the consumer until it is acked. Open and keepalive messages are passed through.
+func ackSubscriber(sub subscriber, filters *queryFilter, consumer *ackConsumer) subscriber {
+	return func(v *visitor, msg *message) error {
+		if msg.Event != messageEvent {
+			return sub(v, msg)
+		} else if !filters.Pass(msg) {
+			return errMessageNotDelivered
+		}
+		delivery, ok := consumer.Deliver(msg)
+		if !ok {
+			return errMessageNotDelivered
+		}
+		return sub(v, delivery)
+	}
+}
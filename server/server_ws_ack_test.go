@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_WebSocketAck_UnackedMessageIsRedelivered(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/mytopic/ws?ack_consumer=worker1"
+
+	// First connection: receive two messages, but only ack the first one
+	conn := dialAckConsumer(t, wsURL)
+	request(t, s, "PUT", "/mytopic", "first", nil)
+	first := readWebSocketMessage(t, conn)
+	require.Equal(t, "first", first.Message)
+	require.Len(t, first.DeliveryID, deliveryIDLength)
+	request(t, s, "PUT", "/mytopic", "second", nil)
+	second := readWebSocketMessage(t, conn)
+	require.Equal(t, "second", second.Message)
+	require.NotEqual(t, first.DeliveryID, second.DeliveryID)
+	require.Nil(t, conn.WriteJSON(&wsCommand{Event: wsAckEvent, DeliveryID: first.DeliveryID}))
+	require.Eventually(t, func() bool {
+		return len(s.ackConsumers["ip:127.0.0.1/mytopic/worker1"].Pending()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	conn.Close()
+
+	// Second connection: only the unacked message is redelivered, with the same delivery ID
+	conn = dialAckConsumer(t, wsURL)
+	redelivered := readWebSocketMessage(t, conn)
+	require.Equal(t, second.ID, redelivered.ID)
+	require.Equal(t, "second", redelivered.Message)
+	require.Equal(t, second.DeliveryID, redelivered.DeliveryID)
+	require.Nil(t, conn.WriteJSON(&wsCommand{Event: wsAckEvent, DeliveryID: redelivered.DeliveryID}))
+	require.Eventually(t, func() bool {
+		return len(s.ackConsumers["ip:127.0.0.1/mytopic/worker1"].Pending()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	conn.Close()
+
+	// Third connection: nothing is redelivered, the next message is a new one
+	conn = dialAckConsumer(t, wsURL)
+	defer conn.Close()
+	request(t, s, "PUT", "/mytopic", "third", nil)
+	require.Equal(t, "third", readWebSocketMessage(t, conn).Message)
+}
+
+func TestServer_WebSocketAck_SinceDoesNotDuplicateRedelivery(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/mytopic/ws?ack_consumer=worker1"
+
+	conn := dialAckConsumer(t, wsURL)
+	request(t, s, "PUT", "/mytopic", "unacked", nil)
+	unacked := readWebSocketMessage(t, conn)
+	conn.Close()
+
+	// The unacked message is also a cached message, but it is only sent once
+	conn = dialAckConsumer(t, wsURL+"&since=all")
+	defer conn.Close()
+	require.Equal(t, unacked.DeliveryID, readWebSocketMessage(t, conn).DeliveryID)
+	request(t, s, "PUT", "/mytopic", "next", nil)
+	require.Equal(t, "next", readWebSocketMessage(t, conn).Message)
+}
+
+func TestServer_WebSocketAck_OtherConsumerIsIndependent(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	httpServer := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/mytopic/ws?ack_consumer="
+
+	conn := dialAckConsumer(t, wsURL+"worker1")
+	request(t, s, "PUT", "/mytopic", "for worker1", nil)
+	require.Equal(t, "for worker1", readWebSocketMessage(t, conn).Message)
+	conn.Close()
+
+	conn = dialAckConsumer(t, wsURL+"worker2")
+	defer conn.Close()
+	request(t, s, "PUT", "/mytopic", "for worker2", nil)
+	require.Equal(t, "for worker2", readWebSocketMessage(t, conn).Message)
+}
+
+func TestServer_WebSocketAck_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	headers := map[string]string{"Upgrade": "websocket"}
+
+	response := request(t, s, "GET", "/mytopic/ws?ack_consumer=not*valid", "", headers)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40068, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/ws?ack_consumer=worker1&poll=1", "", headers)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40068, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestAckConsumer_PendingLimit(t *testing.T) {
+	consumer := &ackConsumer{pending: make([]*message, 0)}
+	for i := 0; i < ackConsumerPendingLimit+5; i++ {
+		_, ok := consumer.Deliver(newDefaultMessage("mytopic", "msg"))
+		require.True(t, ok)
+	}
+	require.Len(t, consumer.Pending(), ackConsumerPendingLimit)
+	require.False(t, consumer.Ack("unknown"))
+}
+
+func TestServer_PruneAckConsumers(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	v := newVisitor(s.config, s.messageCache, s.userManager, netip.MustParseAddr("9.9.9.9"), nil)
+
+	consumer, connection, err := s.attachAckConsumer(v, "mytopic", "worker1", func() {})
+	require.Nil(t, err)
+	s.pruneAckConsumers()
+	require.Len(t, s.ackConsumers, 1) // Still connected
+
+	s.detachAckConsumer(consumer, connection)
+	consumer.lastSeen = time.Now().Add(-ackConsumerExpiry - time.Minute)
+	s.pruneAckConsumers()
+	require.Len(t, s.ackConsumers, 0)
+}
+
+func TestServer_AttachAckConsumer_OwnedByVisitor(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	v1 := newVisitor(s.config, s.messageCache, s.userManager, netip.MustParseAddr("9.9.9.9"), nil)
+	v2 := newVisitor(s.config, s.messageCache, s.userManager, netip.MustParseAddr("8.8.8.8"), nil)
+
+	// Anonymous visitors with different IP addresses get different consumers for the same ID
+	consumer1, _, err := s.attachAckConsumer(v1, "mytopic", "worker1", func() {})
+	require.Nil(t, err)
+	_, ok := consumer1.Deliver(newDefaultMessage("mytopic", "secret"))
+	require.True(t, ok)
+	consumer2, _, err := s.attachAckConsumer(v2, "mytopic", "worker1", func() {})
+	require.Nil(t, err)
+	require.NotSame(t, consumer1, consumer2)
+	require.Empty(t, consumer2.Pending())
+
+	// The same visitor takes over its own consumer, and the old connection is canceled
+	var canceled bool
+	_, _, err = s.attachAckConsumer(v1, "mytopic", "worker1", func() { canceled = true })
+	require.Nil(t, err)
+	consumer3, _, err := s.attachAckConsumer(v1, "mytopic", "worker1", func() {})
+	require.Nil(t, err)
+	require.Same(t, consumer1, consumer3)
+	require.True(t, canceled)
+	require.Len(t, consumer3.Pending(), 1)
+}
+
+func TestServer_AttachAckConsumer_VisitorLimit(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	v := newVisitor(s.config, s.messageCache, s.userManager, netip.MustParseAddr("9.9.9.9"), nil)
+
+	// All consumers connected: no new consumer can be created
+	consumers := make([]*ackConsumer, 0)
+	connections := make([]int, 0)
+	for i := 0; i < ackConsumerVisitorLimit; i++ {
+		consumer, connection, err := s.attachAckConsumer(v, "mytopic", fmt.Sprintf("worker%d", i), func() {})
+		require.Nil(t, err)
+		consumers = append(consumers, consumer)
+		connections = append(connections, connection)
+	}
+	_, _, err := s.attachAckConsumer(v, "mytopic", "another", func() {})
+	require.Equal(t, errHTTPTooManyRequestsLimitAckConsumers, err)
+
+	// Other visitors are not affected
+	other := newVisitor(s.config, s.messageCache, s.userManager, netip.MustParseAddr("8.8.8.8"), nil)
+	_, _, err = s.attachAckConsumer(other, "mytopic", "another", func() {})
+	require.Nil(t, err)
+
+	// A disconnected consumer is forgotten to make room for a new one
+	s.detachAckConsumer(consumers[3], connections[3])
+	_, _, err = s.attachAckConsumer(v, "mytopic", "another", func() {})
+	require.Nil(t, err)
+	require.Len(t, s.ackConsumers, ackConsumerVisitorLimit+1)
+	require.NotContains(t, s.ackConsumers, "ip:9.9.9.9/mytopic/worker3")
+}
+
+func dialAckConsumer(t *testing.T, wsURL string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Nil(t, err)
+	var open message
+	require.Nil(t, conn.ReadJSON(&open))
+	require.Equal(t, openEvent, open.Event)
+	return conn
+}
+
+func readWebSocketMessage(t *testing.T, conn *websocket.Conn) *message {
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var m message
+	require.Nil(t, conn.ReadJSON(&m))
+	require.Equal(t, messageEvent, m.Event)
+	return &m
+}
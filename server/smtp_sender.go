@@ -33,7 +33,7 @@ func (s *smtpSender) Send(v *visitor, m *message, to string) error {
 		if err != nil {
 			return err
 		}
-		message, err := formatMail(s.config.BaseURL, v.ip.String(), s.config.SMTPSenderFrom, to, m)
+		message, err := formatMail(s.config.BaseURL, v.ip.String(), s.config.SMTPSenderFrom, to, m, s.config.EnableEmojiTags)
 		if err != nil {
 			return err
 		}
@@ -49,7 +49,11 @@ func (s *smtpSender) Send(v *visitor, m *message, to string) error {
 				"email_to":   to,
 			})
 		if ev.IsTrace() {
-			ev.Field("email_body", message).Trace("Sending email")
+			redacted, err := formatMail(s.config.BaseURL, v.ip.String(), s.config.SMTPSenderFrom, to, redactMessage(m, s.config.RedactPatterns), s.config.EnableEmojiTags)
+			if err != nil {
+				return err
+			}
+			ev.Field("email_body", redacted).Trace("Sending email")
 		} else if ev.IsDebug() {
 			ev.Debug("Sending email")
 		}
@@ -76,7 +80,7 @@ func (s *smtpSender) withCount(v *visitor, m *message, fn func() error) error {
 	return err
 }
 
-func formatMail(baseURL, senderIP, from, to string, m *message) (string, error) {
+func formatMail(baseURL, senderIP, from, to string, m *message, emojiTags bool) (string, error) {
 	topicURL := baseURL + "/" + m.Topic
 	subject := m.Title
 	if subject == "" {
@@ -86,9 +90,13 @@ func formatMail(baseURL, senderIP, from, to string, m *message) (string, error)
 	message := m.Message
 	trailer := ""
 	if len(m.Tags) > 0 {
-		emojis, tags, err := toEmojis(m.Tags)
-		if err != nil {
-			return "", err
+		emojis, tags := make([]string, 0), m.Tags
+		if emojiTags {
+			var err error
+			emojis, tags, err = toEmojis(m.Tags)
+			if err != nil {
+				return "", err
+			}
 		}
 		if len(emojis) > 0 {
 			subject = strings.Join(emojis, " ") + " " + subject
@@ -111,9 +119,16 @@ func formatMail(baseURL, senderIP, from, to string, m *message) (string, error)
 		message += "\n\n" + trailer
 	}
 	subject = mime.BEncoding.Encode("utf-8", subject)
+	xPriority, importance := emailPriorityHeaders(m.Priority)
+	headers := fmt.Sprintf("X-Priority: %s\nImportance: %s", xPriority, importance)
+	if len(m.Tags) > 0 {
+		tags := strings.ReplaceAll(strings.ReplaceAll(strings.Join(m.Tags, ","), "\r", ""), "\n", "")
+		headers += "\nX-Ntfy-Tags: " + mime.BEncoding.Encode("utf-8", tags)
+	}
 	body := `From: "{shortTopicURL}" <{from}>
 To: {to}
 Subject: {subject}
+{headers}
 Content-Type: text/plain; charset="utf-8"
 
 {message}
@@ -123,6 +138,7 @@ This message was sent by {ip} at {time} via {topicURL}`
 	body = strings.ReplaceAll(body, "{from}", from)
 	body = strings.ReplaceAll(body, "{to}", to)
 	body = strings.ReplaceAll(body, "{subject}", subject)
+	body = strings.ReplaceAll(body, "{headers}", headers)
 	body = strings.ReplaceAll(body, "{message}", message)
 	body = strings.ReplaceAll(body, "{topicURL}", topicURL)
 	body = strings.ReplaceAll(body, "{shortTopicURL}", util.ShortTopicURL(topicURL))
@@ -131,6 +147,23 @@ This message was sent by {ip} at {time} via {topicURL}`
 	return body, nil
 }
 
+// emailPriorityHeaders maps the message priority to the values of the X-Priority and Importance email headers,
+// which email clients and ticketing systems use to flag or route emails
+func emailPriorityHeaders(priority int) (xPriority string, importance string) {
+	switch priority {
+	case 5:
+		return "1 (Highest)", "high"
+	case 4:
+		return "2 (High)", "high"
+	case 2:
+		return "4 (Low)", "low"
+	case 1:
+		return "5 (Lowest)", "low"
+	default:
+		return "3 (Normal)", "normal"
+	}
+}
+
 var (
 	//go:embed "mailer_emoji_map.json"
 	emojisJSON string
@@ -2,6 +2,7 @@ package server
 
 import (
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -12,10 +13,12 @@ func TestFormatMail_Basic(t *testing.T) {
 		Event:   "message",
 		Topic:   "alerts",
 		Message: "A simple message",
-	})
+	}, true)
 	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Subject: A simple message
+X-Priority: 3 (Normal)
+Importance: normal
 Content-Type: text/plain; charset="utf-8"
 
 A simple message
@@ -33,10 +36,13 @@ func TestFormatMail_JustEmojis(t *testing.T) {
 		Topic:   "alerts",
 		Message: "A simple message",
 		Tags:    []string{"grinning"},
-	})
+	}, true)
 	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Subject: =?utf-8?b?8J+YgCBBIHNpbXBsZSBtZXNzYWdl?=
+X-Priority: 3 (Normal)
+Importance: normal
+X-Ntfy-Tags: grinning
 Content-Type: text/plain; charset="utf-8"
 
 A simple message
@@ -54,10 +60,13 @@ func TestFormatMail_JustOtherTags(t *testing.T) {
 		Topic:   "alerts",
 		Message: "A simple message",
 		Tags:    []string{"not-an-emoji"},
-	})
+	}, true)
 	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Subject: A simple message
+X-Priority: 3 (Normal)
+Importance: normal
+X-Ntfy-Tags: not-an-emoji
 Content-Type: text/plain; charset="utf-8"
 
 A simple message
@@ -77,10 +86,12 @@ func TestFormatMail_JustPriority(t *testing.T) {
 		Topic:    "alerts",
 		Message:  "A simple message",
 		Priority: 2,
-	})
+	}, true)
 	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Subject: A simple message
+X-Priority: 4 (Low)
+Importance: low
 Content-Type: text/plain; charset="utf-8"
 
 A simple message
@@ -100,10 +111,12 @@ func TestFormatMail_UTF8Subject(t *testing.T) {
 		Topic:   "alerts",
 		Message: "A simple message",
 		Title:   " :: A not so simple title öäüß ¡Hola, señor!",
-	})
+	}, true)
 	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Subject: =?utf-8?b?IDo6IEEgbm90IHNvIHNpbXBsZSB0aXRsZSDDtsOkw7zDnyDCoUhvbGEsIHNl?= =?utf-8?b?w7FvciE=?=
+X-Priority: 3 (Normal)
+Importance: normal
 Content-Type: text/plain; charset="utf-8"
 
 A simple message
@@ -123,10 +136,13 @@ func TestFormatMail_WithAllTheThings(t *testing.T) {
 		Tags:     []string{"warning", "skull", "tag123", "other"},
 		Title:    "Oh no 🙈\nThis is a message across\nmultiple lines",
 		Message:  "A message that contains monkeys 🙉\nNo really, though. Monkeys!",
-	})
+	}, true)
 	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
 To: phil@example.com
 Subject: =?utf-8?b?4pqg77iPIPCfkoAgT2ggbm8g8J+ZiCBUaGlzIGlzIGEgbWVzc2FnZSBhY3Jv?= =?utf-8?b?c3MgbXVsdGlwbGUgbGluZXM=?=
+X-Priority: 1 (Highest)
+Importance: high
+X-Ntfy-Tags: warning,skull,tag123,other
 Content-Type: text/plain; charset="utf-8"
 
 A message that contains monkeys 🙉
@@ -139,3 +155,69 @@ Priority: max
 This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
 	require.Equal(t, expected, actual)
 }
+
+func TestFormatMail_WithEmojiTagsDisabled(t *testing.T) {
+	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Tags:    []string{"warning", "tag123"},
+		Message: "A simple message",
+	}, false)
+	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+To: phil@example.com
+Subject: A simple message
+X-Priority: 3 (Normal)
+Importance: normal
+X-Ntfy-Tags: warning,tag123
+Content-Type: text/plain; charset="utf-8"
+
+A simple message
+
+Tags: warning, tag123
+
+--
+This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
+	require.Equal(t, expected, actual)
+}
+
+func TestFormatMail_PriorityHeaders(t *testing.T) {
+	expected := map[int]string{
+		0: "X-Priority: 3 (Normal)\nImportance: normal\n",
+		1: "X-Priority: 5 (Lowest)\nImportance: low\n",
+		2: "X-Priority: 4 (Low)\nImportance: low\n",
+		3: "X-Priority: 3 (Normal)\nImportance: normal\n",
+		4: "X-Priority: 2 (High)\nImportance: high\n",
+		5: "X-Priority: 1 (Highest)\nImportance: high\n",
+	}
+	for priority, headers := range expected {
+		actual, err := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+			ID:       "abc",
+			Time:     1640382204,
+			Event:    "message",
+			Topic:    "alerts",
+			Priority: priority,
+			Message:  "A simple message",
+		}, true)
+		require.Nil(t, err)
+		require.Contains(t, actual, "Subject: A simple message\n"+headers+"Content-Type: text/plain")
+	}
+}
+
+func TestFormatMail_TagsHeader(t *testing.T) {
+	actual, err := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Title:   "Disk full",
+		Tags:    []string{"disk", "ünicode", "in\r\njected"},
+		Message: "A simple message",
+	}, true)
+	require.Nil(t, err)
+	headers, _, _ := strings.Cut(actual, "\n\n")
+	require.Contains(t, headers, "Subject: Disk full\n")
+	require.Contains(t, headers, "X-Ntfy-Tags: =?utf-8?b?ZGlzayzDvG5pY29kZSxpbmplY3RlZA==?=\n") // disk,ünicode,injected
+	require.NotContains(t, headers, "\r")
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/emersion/go-smtp"
 	"github.com/microcosm-cc/bluemonday"
+	"heckel.io/ntfy/v2/log"
 	"io"
 	"mime"
 	"mime/multipart"
@@ -16,6 +17,7 @@ import (
 	"net/http/httptest"
 	"net/mail"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -38,6 +40,19 @@ const (
 	maxMultipartDepth = 2
 )
 
+// mailAttachment is a file extracted from an incoming email. It is published as a ntfy attachment.
+type mailAttachment struct {
+	filename string
+	data     []byte
+	ignored  []string // Filenames of further attachments, which are not published (one attachment per message)
+}
+
+// mailParts collects the text bodies (by content type) and the first attachment of a multipart email
+type mailParts struct {
+	text       map[string]string
+	attachment *mailAttachment
+}
+
 // smtpBackend implements SMTP server methods.
 type smtpBackend struct {
 	config  *Config
@@ -137,7 +152,7 @@ func (s *smtpSession) Data(r io.Reader) error {
 		}
 		ev := logem(s.conn)
 		if ev.IsTrace() {
-			ev.Field("smtp_data", string(b)).Trace("DATA")
+			ev.Field("smtp_data", redactString(string(b), conf.RedactPatterns)).Trace("DATA")
 		} else if ev.IsDebug() {
 			ev.Field("smtp_data_len", len(b)).Debug("DATA")
 		}
@@ -145,10 +160,19 @@ func (s *smtpSession) Data(r io.Reader) error {
 		if err != nil {
 			return err
 		}
-		body, err := readMailBody(msg.Body, msg.Header)
+		body, attachment, err := readMailBody(msg.Body, msg.Header)
 		if err != nil {
 			return err
 		}
+		if attachment != nil && conf.AttachmentCacheDir == "" && conf.AttachmentS3Bucket == "" {
+			ev.Field("smtp_attachment_name", attachment.filename).Debug("Ignoring attachment, attachments are disabled")
+			attachment = nil
+		} else if attachment != nil && len(attachment.ignored) > 0 {
+			ev.Fields(log.Context{
+				"smtp_attachment_name":     attachment.filename,
+				"smtp_attachments_ignored": strings.Join(attachment.ignored, ", "),
+			}).Info("Email has %d attachments, only publishing the first one", len(attachment.ignored)+1)
+		}
 		body = strings.TrimSpace(body)
 		if len(body) > conf.MessageSizeLimit {
 			body = body[:conf.MessageSizeLimit]
@@ -167,7 +191,7 @@ func (s *smtpSession) Data(r io.Reader) error {
 			m.Message = m.Title // Flip them, this makes more sense
 			m.Title = ""
 		}
-		if err := s.publishMessage(m); err != nil {
+		if err := s.publishMessage(m, attachment); err != nil {
 			return err
 		}
 		s.backend.mu.Lock()
@@ -178,7 +202,36 @@ func (s *smtpSession) Data(r io.Reader) error {
 	})
 }
 
-func (s *smtpSession) publishMessage(m *message) error {
+// publishMessage publishes the message by calling the HTTP handler with a fake HTTP request. If the email
+// contained an attachment, the attachment is passed as the request body, and the message is passed via header
+// (just like "curl -T file.jpg -H 'Filename: file.jpg' -H 'Message: ...'" would).
+//
+// Attachments are first checked against the visitor's attachment limits with a dry run, which does not count
+// against the visitor's request limit. If the attachment limits are exceeded, the message is published without
+// the attachment.
+func (s *smtpSession) publishMessage(m *message, attachment *mailAttachment) error {
+	if attachment != nil {
+		rr, err := s.sendPublishRequest(m, attachment, true)
+		if err != nil {
+			return err
+		} else if rr.Code == http.StatusRequestEntityTooLarge {
+			logem(s.conn).Fields(log.Context{
+				"smtp_attachment_name": attachment.filename,
+				"smtp_attachment_size": len(attachment.data),
+			}).Info("Ignoring attachment, it exceeds the attachment limits of the visitor")
+			attachment = nil
+		}
+	}
+	rr, err := s.sendPublishRequest(m, attachment, false)
+	if err != nil {
+		return err
+	} else if rr.Code != http.StatusOK {
+		return errors.New("error: " + rr.Body.String())
+	}
+	return nil
+}
+
+func (s *smtpSession) sendPublishRequest(m *message, attachment *mailAttachment, dry bool) (*httptest.ResponseRecorder, error) {
 	// Extract remote address (for rate limiting)
 	remoteAddr, _, err := net.SplitHostPort(s.conn.Conn().RemoteAddr().String())
 	if err != nil {
@@ -186,12 +239,25 @@ func (s *smtpSession) publishMessage(m *message) error {
 	}
 	// Call HTTP handler with fake HTTP request
 	url := fmt.Sprintf("%s/%s", s.backend.config.BaseURL, m.Topic)
-	req, err := http.NewRequest("POST", url, strings.NewReader(m.Message))
+	var body io.Reader
+	if attachment != nil {
+		body = bytes.NewReader(attachment.data)
+	} else {
+		body = strings.NewReader(m.Message)
+	}
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
 	req.RequestURI = "/" + m.Topic // just for the logs
 	req.RemoteAddr = remoteAddr    // rate limiting!!
 	req.Header.Set("X-Forwarded-For", remoteAddr)
-	if err != nil {
-		return err
+	if attachment != nil {
+		req.Header.Set("Filename", attachment.filename)
+		req.Header.Set("Content-Length", strconv.Itoa(len(attachment.data)))
+		if m.Message != "" {
+			req.Header.Set("Message", strings.ReplaceAll(m.Message, "\n", "\\n"))
+		}
 	}
 	if m.Title != "" {
 		req.Header.Set("Title", m.Title)
@@ -199,12 +265,13 @@ func (s *smtpSession) publishMessage(m *message) error {
 	if s.token != "" {
 		req.Header.Add("Authorization", "Bearer "+s.token)
 	}
+	if dry {
+		req.Header.Set("X-Dry-Run", "1")
+		req = withContext(req, map[contextKey]any{contextSMTPAttachmentCheck: true})
+	}
 	rr := httptest.NewRecorder()
 	s.backend.handler(rr, req)
-	if rr.Code != http.StatusOK {
-		return errors.New("error: " + rr.Body.String())
-	}
-	return nil
+	return rr, nil
 }
 
 func (s *smtpSession) Reset() {
@@ -231,36 +298,42 @@ func (s *smtpSession) withFailCount(fn func() error) error {
 	return err
 }
 
-func readMailBody(body io.Reader, header mail.Header) (string, error) {
+func readMailBody(body io.Reader, header mail.Header) (string, *mailAttachment, error) {
 	if header.Get("Content-Type") == "" {
-		return readPlainTextMailBody(body, header.Get("Content-Transfer-Encoding"))
+		s, err := readPlainTextMailBody(body, header.Get("Content-Transfer-Encoding"))
+		return s, nil, err
 	}
 	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	canonicalContentType := strings.ToLower(contentType)
 	if canonicalContentType == "text/plain" || canonicalContentType == "text/html" {
-		return readTextMailBody(body, canonicalContentType, header.Get("Content-Transfer-Encoding"))
+		s, err := readTextMailBody(body, canonicalContentType, header.Get("Content-Transfer-Encoding"))
+		return s, nil, err
 	} else if strings.HasPrefix(canonicalContentType, "multipart/") {
 		return readMultipartMailBody(body, params)
 	}
-	return "", errUnsupportedContentType
+	return "", nil, errUnsupportedContentType
 }
 
-func readMultipartMailBody(body io.Reader, params map[string]string) (string, error) {
-	parts := make(map[string]string)
+// readMultipartMailBody reads the text body and the first attachment (if any) of a multipart email. If the email
+// only contains an attachment, the returned body is empty.
+func readMultipartMailBody(body io.Reader, params map[string]string) (string, *mailAttachment, error) {
+	parts := &mailParts{text: make(map[string]string)}
 	if err := readMultipartMailBodyParts(body, params, 0, parts); err != nil && err != io.EOF {
-		return "", err
-	} else if s, ok := parts["text/plain"]; ok {
-		return s, nil
-	} else if s, ok := parts["text/html"]; ok {
-		return s, nil
+		return "", nil, err
+	} else if s, ok := parts.text["text/plain"]; ok {
+		return s, parts.attachment, nil
+	} else if s, ok := parts.text["text/html"]; ok {
+		return s, parts.attachment, nil
+	} else if parts.attachment != nil {
+		return "", parts.attachment, nil
 	}
-	return "", io.EOF
+	return "", nil, io.EOF
 }
 
-func readMultipartMailBodyParts(body io.Reader, params map[string]string, depth int, parts map[string]string) error {
+func readMultipartMailBodyParts(body io.Reader, params map[string]string, depth int, parts *mailParts) error {
 	if depth >= maxMultipartDepth {
 		return errMultipartNestedTooDeep
 	}
@@ -275,14 +348,24 @@ func readMultipartMailBodyParts(body io.Reader, params map[string]string, depth
 			return err
 		}
 		canonicalPartContentType := strings.ToLower(partContentType)
-		if canonicalPartContentType == "text/plain" || canonicalPartContentType == "text/html" {
+		if filename := mailAttachmentFilename(part, partParams); filename != "" {
+			if parts.attachment != nil {
+				parts.attachment.ignored = append(parts.attachment.ignored, filename)
+				continue // Only one attachment per message is supported, use the first one
+			}
+			data, err := io.ReadAll(decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding")))
+			if err != nil {
+				return err
+			}
+			parts.attachment = &mailAttachment{filename: filename, data: data}
+		} else if canonicalPartContentType == "text/plain" || canonicalPartContentType == "text/html" {
 			s, err := readTextMailBody(part, canonicalPartContentType, part.Header.Get("Content-Transfer-Encoding"))
 			if err != nil {
 				return err
 			}
-			parts[canonicalPartContentType] = s
+			parts.text[canonicalPartContentType] = s
 		} else if strings.HasPrefix(strings.ToLower(partContentType), "multipart/") {
-			if err := readMultipartMailBodyParts(part, partParams, depth+1, parts); err != nil {
+			if err := readMultipartMailBodyParts(part, partParams, depth+1, parts); err != nil && err != io.EOF {
 				return err
 			}
 		}
@@ -299,19 +382,44 @@ func readTextMailBody(reader io.Reader, contentType, transferEncoding string) (s
 	return "", fmt.Errorf("unsupported content type: %s", contentType)
 }
 
-func readPlainTextMailBody(reader io.Reader, transferEncoding string) (string, error) {
-	if strings.ToLower(transferEncoding) == "base64" {
-		reader = base64.NewDecoder(base64.StdEncoding, reader)
-	} else if strings.ToLower(transferEncoding) == "quoted-printable" {
-		reader = quotedprintable.NewReader(reader)
+// mailAttachmentFilename returns the filename of a multipart part, if the part is an attachment. A part is considered
+// an attachment if it has a filename (in the Content-Disposition or the Content-Type header), or if it is explicitly
+// marked as attachment. Inline text parts without filename are the email body, and are not attachments.
+func mailAttachmentFilename(part *multipart.Part, partParams map[string]string) string {
+	disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	filename := part.FileName()
+	if filename == "" {
+		filename = partParams["name"]
 	}
-	body, err := io.ReadAll(reader)
+	if filename == "" && strings.ToLower(disposition) == "attachment" {
+		filename = "attachment"
+	}
+	if filename != "" {
+		dec := mime.WordDecoder{}
+		if decoded, err := dec.DecodeHeader(filename); err == nil {
+			filename = decoded
+		}
+	}
+	return filename
+}
+
+func readPlainTextMailBody(reader io.Reader, transferEncoding string) (string, error) {
+	body, err := io.ReadAll(decodeTransferEncoding(reader, transferEncoding))
 	if err != nil {
 		return "", err
 	}
 	return string(body), nil
 }
 
+func decodeTransferEncoding(reader io.Reader, transferEncoding string) io.Reader {
+	if strings.ToLower(transferEncoding) == "base64" {
+		return base64.NewDecoder(base64.StdEncoding, reader)
+	} else if strings.ToLower(transferEncoding) == "quoted-printable" {
+		return quotedprintable.NewReader(reader)
+	}
+	return reader
+}
+
 func readHTMLMailBody(reader io.Reader, transferEncoding string) (string, error) {
 	body, err := readPlainTextMailBody(reader, transferEncoding)
 	if err != nil {
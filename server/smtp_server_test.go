@@ -2,11 +2,16 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"github.com/emersion/go-smtp"
 	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/log"
 	"io"
 	"net"
 	"net/http"
+	"net/mail"
+	"os"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -48,6 +53,36 @@ Content-Type: text/html; charset="UTF-8"
 	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
 }
 
+func TestSmtpBackend_RedactPatternsInLogs(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetLevel(log.TraceLevel)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.ErrorLevel) // See TestMain
+	})
+
+	email := `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+Subject: Login failed
+Content-Type: text/plain
+
+login with password=hunter2 failed
+.
+`
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "login with password=hunter2 failed", readAll(t, r.Body))
+	})
+	conf.RedactPatterns = []*regexp.Regexp{regexp.MustCompile(`password=\S+`)}
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+	require.Contains(t, out.String(), "login with [redacted] failed")
+	require.NotContains(t, out.String(), "hunter2")
+}
+
 func TestSmtpBackend_MultipartNoBody(t *testing.T) {
 	email := `EHLO example.com
 MAIL FROM: phil@example.com
@@ -1386,6 +1421,214 @@ what's up
 	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
 }
 
+const smtpTestEmailWithImageAttachment = `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+MIME-Version: 1.0
+Date: Sun, 11 Oct 2026 10:12:44 +0200
+Message-ID: <CAAvm79a1kx2+F3z0GpVnRj0mLh8W4wq@mail.gmail.com>
+Subject: Look at this
+From: Phil <phil@example.com>
+To: ntfy-mytopic@ntfy.sh
+Content-Type: multipart/mixed; boundary="000000000000a1b2c3d4e5f6a7b8"
+
+--000000000000a1b2c3d4e5f6a7b8
+Content-Type: multipart/alternative; boundary="000000000000f0e1d2c3b4a59687"
+
+--000000000000f0e1d2c3b4a59687
+Content-Type: text/plain; charset="UTF-8"
+
+A tiny picture
+of a pixel
+
+--000000000000f0e1d2c3b4a59687
+Content-Type: text/html; charset="UTF-8"
+
+<div dir="ltr">A tiny picture<br>of a pixel</div>
+
+--000000000000f0e1d2c3b4a59687--
+--000000000000a1b2c3d4e5f6a7b8
+Content-Type: image/png; name="pixel.png"
+Content-Disposition: attachment; filename="pixel.png"
+Content-Transfer-Encoding: base64
+Content-ID: <f_lx1abc0>
+
+iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6
+kgAAAABJRU5ErkJggg==
+--000000000000a1b2c3d4e5f6a7b8--
+.
+`
+
+func TestSmtpBackend_MultipartWithAttachment(t *testing.T) {
+	s, c, _, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path)
+		require.Equal(t, "Look at this", r.Header.Get("Title"))
+		require.Equal(t, "pixel.png", r.Header.Get("Filename"))
+		require.Equal(t, "A tiny picture\\nof a pixel", r.Header.Get("Message"))
+		require.Equal(t, "\x89PNG", readAll(t, r.Body)[:4])
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, smtpTestEmailWithImageAttachment, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_MultipartWithAttachment_AttachmentsDisabled(t *testing.T) {
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path)
+		require.Equal(t, "Look at this", r.Header.Get("Title"))
+		require.Equal(t, "", r.Header.Get("Filename"))
+		require.Equal(t, "A tiny picture\nof a pixel", readAll(t, r.Body))
+	})
+	conf.AttachmentCacheDir = ""
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, smtpTestEmailWithImageAttachment, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_MultipartWithAttachment_RealServer(t *testing.T) {
+	var srv *Server
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		srv.handle(w, r)
+	})
+	srv = newTestServer(t, conf)
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, smtpTestEmailWithImageAttachment, c, scanner, "250 2.0.0 OK: queued")
+
+	response := request(t, srv, "GET", "/mytopic/json?poll=1", "", nil)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Look at this", m.Title)
+	require.Equal(t, "A tiny picture\nof a pixel", m.Message)
+	require.NotNil(t, m.Attachment)
+	require.Equal(t, "pixel.png", m.Attachment.Name)
+	require.Equal(t, "image/png", m.Attachment.Type)
+	require.Equal(t, int64(70), m.Attachment.Size)
+	require.Equal(t, "http://127.0.0.1:12345/file/"+m.ID+".png", m.Attachment.URL)
+
+	path := strings.TrimPrefix(m.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, srv, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "\x89PNG", response.Body.String()[:4])
+}
+
+func TestSmtpBackend_MultipartWithAttachment_TooLarge(t *testing.T) {
+	var srv *Server
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		srv.handle(w, r)
+	})
+	conf.AttachmentFileSizeLimit = 50 // The pixel is 70 bytes
+	srv = newTestServer(t, conf)
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, smtpTestEmailWithImageAttachment, c, scanner, "250 2.0.0 OK: queued")
+
+	// Published without the attachment
+	response := request(t, srv, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Look at this", messages[0].Title)
+	require.Equal(t, "A tiny picture\nof a pixel", messages[0].Message)
+	require.Nil(t, messages[0].Attachment)
+}
+
+func TestSmtpBackend_MultipartWithAttachment_VisitorTotalSizeLimit(t *testing.T) {
+	var srv *Server
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		srv.handle(w, r)
+	})
+	conf.VisitorAttachmentTotalSizeLimit = 100 // The pixel is 70 bytes, so only one fits
+	srv = newTestServer(t, conf)
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, smtpTestEmailWithImageAttachment, c, scanner, "250 2.0.0 OK: queued")
+	writeAndReadUntilLine(t, smtpTestEmailWithImageAttachment, c, scanner, "250 2.0.0 OK: queued")
+
+	// The second message exceeds the visitor's remaining attachment storage, and is published without the attachment
+	response := request(t, srv, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.NotNil(t, messages[0].Attachment)
+	require.Equal(t, "pixel.png", messages[0].Attachment.Name)
+	require.Nil(t, messages[1].Attachment)
+	require.Equal(t, "A tiny picture\nof a pixel", messages[1].Message)
+}
+
+func TestSmtpBackend_MultipartWithAttachment_RequestLimit(t *testing.T) {
+	var srv *Server
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		srv.handle(w, r)
+	})
+	conf.VisitorRequestLimitBurst = 1 // The attachment check must not use up the only request
+	conf.VisitorRequestLimitReplenish = time.Hour
+	srv = newTestServer(t, conf)
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, smtpTestEmailWithImageAttachment, c, scanner, "250 2.0.0 OK: queued")
+
+	response := request(t, srv, "GET", "/mytopic/json?poll=1", "", nil) // Different visitor, not rate limited
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.NotNil(t, messages[0].Attachment)
+	require.Equal(t, "pixel.png", messages[0].Attachment.Name)
+}
+
+func TestSmtpBackend_MultipartWithMultipleAttachments(t *testing.T) {
+	email := strings.Replace(smtpTestEmailWithImageAttachment, "--000000000000a1b2c3d4e5f6a7b8--", `--000000000000a1b2c3d4e5f6a7b8
+Content-Type: application/pdf; name="scan.pdf"
+Content-Disposition: attachment; filename="scan.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--000000000000a1b2c3d4e5f6a7b8--`, 1)
+	var srv *Server
+	s, c, conf, scanner := newTestSMTPServer(t, func(w http.ResponseWriter, r *http.Request) {
+		srv.handle(w, r)
+	})
+	srv = newTestServer(t, conf)
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+
+	// Only the first attachment is published
+	response := request(t, srv, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "A tiny picture\nof a pixel", messages[0].Message)
+	require.NotNil(t, messages[0].Attachment)
+	require.Equal(t, "pixel.png", messages[0].Attachment.Name)
+}
+
+func TestReadMailBody_MultipleAttachments(t *testing.T) {
+	body := `--b
+Content-Type: text/plain
+
+Two files
+--b
+Content-Type: image/png; name="a.png"
+Content-Disposition: attachment; filename="a.png"
+
+a
+--b
+Content-Type: image/png; name="b.png"
+Content-Disposition: attachment; filename="b.png"
+
+b
+--b
+Content-Type: application/octet-stream
+Content-Disposition: attachment
+
+c
+--b--`
+	header := mail.Header{"Content-Type": []string{`multipart/mixed; boundary="b"`}}
+	text, attachment, err := readMailBody(strings.NewReader(strings.ReplaceAll(body, "\n", "\r\n")), header)
+	require.Nil(t, err)
+	require.Equal(t, "Two files", text)
+	require.Equal(t, "a.png", attachment.filename)
+	require.Equal(t, "a", string(attachment.data))
+	require.Equal(t, []string{"b.png", "attachment"}, attachment.ignored)
+}
+
 type smtpHandlerFunc func(http.ResponseWriter, *http.Request)
 
 func newTestSMTPServer(t *testing.T, handler smtpHandlerFunc) (s *smtp.Server, c net.Conn, conf *Config, scanner *bufio.Scanner) {
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"heckel.io/ntfy/v2/log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	tagTLS = "tls"
+
+	// sessionTicketKeysMax is the number of session ticket keys kept. The first key is used to encrypt new
+	// tickets; all keys can decrypt tickets. Keeping the previous key means that tickets stay valid for at
+	// least one rotation interval, and at most two.
+	sessionTicketKeysMax = 2
+)
+
+// sessionTicketKeyRotator periodically replaces the TLS session ticket keys of a tls.Config with freshly
+// generated random keys. This limits the window in which a compromised key can be used to decrypt resumed
+// sessions (forward secrecy), instead of relying on keys that are only rotated by the Go runtime.
+type sessionTicketKeyRotator struct {
+	interval time.Duration
+	setKeys  func(keys [][32]byte) // Usually tls.Config.SetSessionTicketKeys, replaced in tests
+	keys     [][32]byte
+	mu       sync.Mutex
+}
+
+func newSessionTicketKeyRotator(tlsConfig *tls.Config, interval time.Duration) (*sessionTicketKeyRotator, error) {
+	r := &sessionTicketKeyRotator{
+		interval: interval,
+		setKeys:  tlsConfig.SetSessionTicketKeys,
+		keys:     make([][32]byte, 0, sessionTicketKeysMax),
+	}
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// rotate generates a new session ticket key, and sets it as the key used to encrypt new tickets. Older
+// keys are kept for decryption only, up to sessionTicketKeysMax keys in total.
+func (r *sessionTicketKeyRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append([][32]byte{key}, r.keys...)
+	if len(r.keys) > sessionTicketKeysMax {
+		r.keys = r.keys[:sessionTicketKeysMax]
+	}
+	r.setKeys(r.keys)
+	return nil
+}
+
+// run rotates the keys every interval, until closeChan is closed
+func (r *sessionTicketKeyRotator) run(closeChan chan bool) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.rotate(); err != nil {
+				log.Tag(tagTLS).Err(err).Warn("Cannot rotate TLS session ticket keys")
+			} else {
+				log.Tag(tagTLS).Debug("Rotated TLS session ticket keys")
+			}
+		case <-closeChan:
+			return
+		}
+	}
+}
+
+// listenAndServeTLSWithTicketRotation is like http.Server.ListenAndServeTLS, but rotates the session ticket keys
+// every Config.TLSSessionTicketRotation. Since http.Server.ServeTLS clones the tls.Config (and with it the
+// session ticket keys), the TLS listener has to be created manually, so that the rotated keys are actually used.
+func (s *Server) listenAndServeTLSWithTicketRotation(httpsServer *http.Server, closeChan chan bool) error {
+	cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	rotator, err := newSessionTicketKeyRotator(tlsConfig, s.config.TLSSessionTicketRotation)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", httpsServer.Addr)
+	if err != nil {
+		return err
+	}
+	go rotator.run(closeChan)
+	httpsServer.TLSConfig = tlsConfig
+	return httpsServer.Serve(tls.NewListener(listener, tlsConfig))
+}
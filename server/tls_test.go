@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionTicketKeyRotator_Rotate(t *testing.T) {
+	var calls [][][32]byte
+	r := newTestSessionTicketKeyRotator(t, time.Hour, func(keys [][32]byte) {
+		calls = append(calls, append([][32]byte{}, keys...))
+	})
+
+	// Initial key is set on creation
+	require.Len(t, calls, 1)
+	require.Len(t, calls[0], 1)
+	first := calls[0][0]
+
+	// New key is used for encryption, previous key is kept for decryption
+	require.Nil(t, r.rotate())
+	require.Len(t, calls, 2)
+	require.Len(t, calls[1], 2)
+	second := calls[1][0]
+	require.NotEqual(t, first, second)
+	require.Equal(t, first, calls[1][1])
+
+	// Oldest key is dropped
+	require.Nil(t, r.rotate())
+	require.Len(t, calls, 3)
+	require.Len(t, calls[2], sessionTicketKeysMax)
+	require.NotEqual(t, second, calls[2][0])
+	require.Equal(t, second, calls[2][1])
+	require.NotContains(t, calls[2], first)
+}
+
+func TestSessionTicketKeyRotator_RotatesAfterInterval(t *testing.T) {
+	var mu sync.Mutex
+	var encryptionKeys [][32]byte
+	r := newTestSessionTicketKeyRotator(t, 100*time.Millisecond, func(keys [][32]byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		encryptionKeys = append(encryptionKeys, keys[0])
+	})
+	closeChan := make(chan bool)
+	go r.run(closeChan)
+
+	// Not rotated before interval
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	require.Len(t, encryptionKeys, 1)
+	mu.Unlock()
+
+	// Rotated after the interval
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(encryptionKeys) >= 3
+	})
+	close(closeChan)
+	mu.Lock()
+	require.NotEqual(t, encryptionKeys[0], encryptionKeys[1])
+	require.NotEqual(t, encryptionKeys[1], encryptionKeys[2])
+	mu.Unlock()
+
+	// Stops rotating after the server is closed
+	mu.Lock()
+	count := len(encryptionKeys)
+	mu.Unlock()
+	time.Sleep(250 * time.Millisecond)
+	mu.Lock()
+	require.LessOrEqual(t, len(encryptionKeys), count+1) // One rotation may have raced with the close
+	mu.Unlock()
+}
+
+func TestServer_ListenHTTPS_WithSessionTicketRotation(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.ListenHTTP = ""
+	conf.ListenHTTPS = fmt.Sprintf("127.0.0.1:%d", 10000+time.Now().Nanosecond()%30000)
+	conf.CertFile, conf.KeyFile = newTestCertificate(t)
+	conf.TLSSessionTicketRotation = 200 * time.Millisecond
+	s := newTestServer(t, conf)
+	go func() {
+		if err := s.Run(); err != nil && err != http.ErrServerClosed {
+			panic(err) // 'go vet' complains about 't.Fatal(err)'
+		}
+	}()
+	defer s.Stop()
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", conf.ListenHTTPS)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+
+	// Second connection resumes the session, but once the key of the ticket was rotated out, sessions cannot
+	// be resumed anymore. This proves that the rotated keys are actually used by the listener.
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				ClientSessionCache: tls.NewLRUClientSessionCache(1),
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func() bool {
+		resp, err := client.Get("https://" + conf.ListenHTTPS + "/v1/health")
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		resp.Body.Close()
+		return resp.TLS.DidResume
+	}
+	require.False(t, get())
+	require.True(t, get())
+	time.Sleep(3 * conf.TLSSessionTicketRotation) // More than sessionTicketKeysMax rotations
+	require.False(t, get())
+}
+
+func newTestSessionTicketKeyRotator(t *testing.T, interval time.Duration, setKeys func(keys [][32]byte)) *sessionTicketKeyRotator {
+	r := &sessionTicketKeyRotator{
+		interval: interval,
+		setKeys:  setKeys,
+	}
+	require.Nil(t, r.rotate())
+	return r
+}
+
+func newTestCertificate(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	certFile = filepath.Join(t.TempDir(), "cert.pem")
+	keyFile = filepath.Join(t.TempDir(), "key.pem")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600))
+	return certFile, keyFile
+}
@@ -1,8 +1,11 @@
 package server
 
 import (
+	"errors"
 	"math/rand"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"heckel.io/ntfy/v2/log"
@@ -28,13 +31,41 @@ type topic struct {
 
 type topicSubscriber struct {
 	userID     string // User ID associated with this subscription, may be empty
+	info       *subscriberInfo
 	subscriber subscriber
 	cancel     func()
 }
 
-// subscriber is a function that is called for every new message on a topic
+// subscriberInfo describes the connection of a subscriber, as exposed in the admin API (see handleSubscribersGet)
+type subscriberInfo struct {
+	userID    string     // User ID, may be empty
+	userName  string     // User name, may be empty
+	ip        netip.Addr // Visitor IP address, extracted from proxy headers if behind a proxy
+	protocol  string     // Subscription protocol, e.g. "json", "sse", "ws" or "grpc"
+	connected time.Time
+	delivered atomic.Int64 // Messages written to this connection (if they passed its filters), not including cached messages sent on connect
+}
+
+func newSubscriberInfo(v *visitor, protocol string) *subscriberInfo {
+	info := &subscriberInfo{
+		ip:        v.IP(),
+		protocol:  protocol,
+		connected: time.Now(),
+	}
+	if u := v.User(); u != nil {
+		info.userID, info.userName = u.ID, u.Name
+	}
+	return info
+}
+
+// subscriber is a function that is called for every new message on a topic. If the subscriber does not write the
+// message, e.g. because it does not pass its filters, it returns errMessageNotDelivered.
 type subscriber func(v *visitor, msg *message) error
 
+// errMessageNotDelivered is returned by a subscriber that intentionally skipped a message. The message is then not
+// counted as delivered (see subscriberInfo.delivered and X-Receipt-URL), but it is not an error either.
+var errMessageNotDelivered = errors.New("message not delivered to subscriber")
+
 // newTopic creates a new topic
 func newTopic(id string) *topic {
 	return &topic{
@@ -45,7 +76,7 @@ func newTopic(id string) *topic {
 }
 
 // Subscribe subscribes to this topic
-func (t *topic) Subscribe(s subscriber, userID string, cancel func()) (subscriberID int) {
+func (t *topic) Subscribe(s subscriber, info *subscriberInfo, cancel func()) (subscriberID int) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	for i := 0; i < 5; i++ { // Best effort retry
@@ -56,7 +87,8 @@ func (t *topic) Subscribe(s subscriber, userID string, cancel func()) (subscribe
 		}
 	}
 	t.subscribers[subscriberID] = &topicSubscriber{
-		userID:     userID, // May be empty
+		userID:     info.userID, // May be empty
+		info:       info,
 		subscriber: s,
 		cancel:     cancel,
 	}
@@ -104,20 +136,34 @@ func (t *topic) Unsubscribe(id int) {
 
 // Publish asynchronously publishes to all subscribers
 func (t *topic) Publish(v *visitor, m *message) error {
+	return t.PublishWithReceipt(v, m, nil)
+}
+
+// PublishWithReceipt is like Publish, but also records every delivery in the given receipt (may be nil), see X-Receipt-URL
+func (t *topic) PublishWithReceipt(v *visitor, m *message, rc *receipt) error {
+	rc.expect(1) // Fan-out
 	go func() {
+		defer rc.done()
 		// We want to lock the topic as short as possible, so we make a shallow copy of the
 		// subscribers map here. Actually sending out the messages then doesn't have to lock.
 		subscribers := t.subscribersCopy()
+		rc.expect(len(subscribers))
 		if len(subscribers) > 0 {
 			logvm(v, m).Tag(tagPublish).Debug("Forwarding to %d subscriber(s)", len(subscribers))
 			for _, s := range subscribers {
 				// We call the subscriber functions in their own Go routines because they are blocking, and
 				// we don't want individual slow subscribers to be able to block others.
-				go func(s subscriber) {
-					if err := s(v, m); err != nil {
+				go func(s *topicSubscriber) {
+					defer rc.done()
+					if err := s.subscriber(v, m); errors.Is(err, errMessageNotDelivered) {
+						return
+					} else if err != nil {
 						logvm(v, m).Tag(tagPublish).Err(err).Warn("Error forwarding to subscriber")
+						return
 					}
-				}(s.subscriber)
+					s.info.delivered.Add(1)
+					rc.deliveredToSubscriber()
+				}(s)
 			}
 		} else {
 			logvm(v, m).Tag(tagPublish).Trace("No stream or WebSocket subscribers, not forwarding")
@@ -134,6 +180,25 @@ func (t *topic) Stats() (int, time.Time) {
 	return len(t.subscribers), t.lastAccess
 }
 
+// HasSubscribers returns true if the topic has at least one active subscriber (e.g. via JSON/SSE stream or WebSocket).
+// Firebase, web push and UnifiedPush distributors are not subscribers in this sense.
+func (t *topic) HasSubscribers() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.subscribers) > 0
+}
+
+// SubscriberInfos returns the connection info of all subscribers of this topic
+func (t *topic) SubscriberInfos() []*subscriberInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	infos := make([]*subscriberInfo, 0, len(t.subscribers))
+	for _, sub := range t.subscribers {
+		infos = append(infos, sub.info)
+	}
+	return infos
+}
+
 // Keepalive sets the last access time and ensures that Stale does not return true
 func (t *topic) Keepalive() {
 	t.mu.Lock()
@@ -199,6 +264,7 @@ func (t *topic) subscribersCopy() map[int]*topicSubscriber {
 	for k, sub := range t.subscribers {
 		subscribers[k] = &topicSubscriber{
 			userID:     sub.userID,
+			info:       sub.info,
 			subscriber: sub.subscriber,
 			cancel:     sub.cancel,
 		}
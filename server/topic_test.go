@@ -24,8 +24,8 @@ func TestTopic_CancelSubscribersExceptUser(t *testing.T) {
 		canceled2.Store(true)
 	}
 	to := newTopic("mytopic")
-	to.Subscribe(subFn, "", cancelFn1)
-	to.Subscribe(subFn, "u_phil", cancelFn2)
+	to.Subscribe(subFn, &subscriberInfo{}, cancelFn1)
+	to.Subscribe(subFn, &subscriberInfo{userID: "u_phil"}, cancelFn2)
 
 	to.CancelSubscribersExceptUser("u_phil")
 	require.True(t, canceled1.Load())
@@ -47,8 +47,8 @@ func TestTopic_CancelSubscribersUser(t *testing.T) {
 		canceled2.Store(true)
 	}
 	to := newTopic("mytopic")
-	to.Subscribe(subFn, "u_another", cancelFn1)
-	to.Subscribe(subFn, "u_phil", cancelFn2)
+	to.Subscribe(subFn, &subscriberInfo{userID: "u_another"}, cancelFn1)
+	to.Subscribe(subFn, &subscriberInfo{userID: "u_phil"}, cancelFn2)
 
 	to.CancelSubscriberUser("u_phil")
 	require.False(t, canceled1.Load())
@@ -84,7 +84,7 @@ func TestTopic_Subscribe_DuplicateID(t *testing.T) {
 
 	//lint:ignore SA1019 Force rand.Int to generate the same id once more
 	rand.Seed(1)
-	id := to.Subscribe(subFn, "b", func() {})
+	id := to.Subscribe(subFn, &subscriberInfo{userID: "b"}, func() {})
 	res := to.subscribers[id]
 
 	require.NotEqual(t, id, a)
@@ -1,8 +1,14 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"strings"
 	"time"
 
 	"heckel.io/ntfy/v2/log"
@@ -17,6 +23,8 @@ const (
 	keepaliveEvent   = "keepalive"
 	messageEvent     = "message"
 	pollRequestEvent = "poll_request"
+	callAckEvent     = "call_ack"
+	shutdownEvent    = "shutdown"
 )
 
 const (
@@ -25,24 +33,30 @@ const (
 
 // message represents a message published to a topic
 type message struct {
-	ID          string      `json:"id"`                // Random message ID
-	Time        int64       `json:"time"`              // Unix time in seconds
-	Expires     int64       `json:"expires,omitempty"` // Unix time in seconds (not required for open/keepalive)
-	Event       string      `json:"event"`             // One of the above
-	Topic       string      `json:"topic"`
-	Title       string      `json:"title,omitempty"`
-	Message     string      `json:"message,omitempty"`
-	Priority    int         `json:"priority,omitempty"`
-	Tags        []string    `json:"tags,omitempty"`
-	Click       string      `json:"click,omitempty"`
-	Icon        string      `json:"icon,omitempty"`
-	Actions     []*action   `json:"actions,omitempty"`
-	Attachment  *attachment `json:"attachment,omitempty"`
-	PollID      string      `json:"poll_id,omitempty"`
-	ContentType string      `json:"content_type,omitempty"` // text/plain by default (if empty), or text/markdown
-	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
-	Sender      netip.Addr  `json:"-"`                      // IP address of uploader, used for rate limiting
-	User        string      `json:"-"`                      // UserID of the uploader, used to associated attachments
+	ID          string            `json:"id"`                // Random message ID
+	Time        int64             `json:"time"`              // Unix time in seconds
+	Expires     int64             `json:"expires,omitempty"` // Unix time in seconds (not required for open/keepalive)
+	Event       string            `json:"event"`             // One of the above
+	Topic       string            `json:"topic"`
+	Title       string            `json:"title,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Click       string            `json:"click,omitempty"`
+	Icon        string            `json:"icon,omitempty"`
+	Actions     []*action         `json:"actions,omitempty"`
+	Data        map[string]string `json:"data,omitempty"`         // Structured key-value data, e.g. for status reports
+	Location    *location         `json:"location,omitempty"`     // Geographic location, e.g. to show a map pin
+	Schedule    string            `json:"schedule,omitempty"`     // ID of the recurring message schedule (X-Cron), if any
+	CollapseKey string            `json:"collapse_key,omitempty"` // Only the latest message per collapse key is sent to reconnecting subscribers
+	Attachment  *attachment       `json:"attachment,omitempty"`
+	PollID      string            `json:"poll_id,omitempty"`
+	ContentType string            `json:"content_type,omitempty"` // text/plain by default (if empty), or text/markdown
+	Encoding    string            `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
+	DeliveryID  string            `json:"delivery_id,omitempty"`  // Only set for WebSocket subscribers that ack deliveries, see ackConsumer
+	RetryAfter  int64             `json:"retry_after,omitempty"`  // Seconds to wait before reconnecting, only set for shutdown events
+	Sender      netip.Addr        `json:"-"`                      // IP address of uploader, used for rate limiting
+	User        string            `json:"-"`                      // UserID of the uploader, used to associated attachments
 }
 
 func (m *message) Context() log.Context {
@@ -63,11 +77,12 @@ func (m *message) Context() log.Context {
 }
 
 type attachment struct {
-	Name    string `json:"name"`
-	Type    string `json:"type,omitempty"`
-	Size    int64  `json:"size,omitempty"`
-	Expires int64  `json:"expires,omitempty"`
-	URL     string `json:"url"`
+	Name       string `json:"name"`
+	Type       string `json:"type,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Expires    int64  `json:"expires,omitempty"`
+	URL        string `json:"url"`
+	Encryption string `json:"encryption,omitempty"` // "client" if the file is encrypted client-side, see encryptionClient
 }
 
 type action struct {
@@ -92,20 +107,26 @@ func newAction() *action {
 
 // publishMessage is used as input when publishing as JSON
 type publishMessage struct {
-	Topic    string   `json:"topic"`
-	Title    string   `json:"title"`
-	Message  string   `json:"message"`
-	Priority int      `json:"priority"`
-	Tags     []string `json:"tags"`
-	Click    string   `json:"click"`
-	Icon     string   `json:"icon"`
-	Actions  []action `json:"actions"`
-	Attach   string   `json:"attach"`
-	Markdown bool     `json:"markdown"`
-	Filename string   `json:"filename"`
-	Email    string   `json:"email"`
-	Call     string   `json:"call"`
-	Delay    string   `json:"delay"`
+	Topic       string            `json:"topic"`
+	ID          string            `json:"id"`
+	Title       string            `json:"title"`
+	Message     string            `json:"message"`
+	Priority    int               `json:"priority"`
+	Tags        []string          `json:"tags"`
+	Click       string            `json:"click"`
+	Icon        string            `json:"icon"`
+	Actions     []action          `json:"actions"`
+	Attach      string            `json:"attach"`
+	Markdown    bool              `json:"markdown"`
+	Data        map[string]string `json:"data"`
+	DataTable   bool              `json:"data_table"`
+	Location    json.RawMessage   `json:"location"` // JSON object or "<lat>,<lon>[,<label>]" string, see parseLocation
+	CollapseKey string            `json:"collapse_key"`
+	Filename    string            `json:"filename"`
+	Email       string            `json:"email"`
+	Call        string            `json:"call"`
+	CallMenu    string            `json:"call_menu"`
+	Delay       string            `json:"delay"`
 }
 
 // messageEncoder is a function that knows how to encode a message
@@ -132,6 +153,14 @@ func newKeepaliveMessage(topic string) *message {
 	return newMessage(keepaliveEvent, topic, "")
 }
 
+// newShutdownMessage is a convenience method to create a message telling the subscriber that the server is shutting
+// down, and when to reconnect
+func newShutdownMessage(topic string, retryAfter time.Duration) *message {
+	m := newMessage(shutdownEvent, topic, "")
+	m.RetryAfter = int64(retryAfter.Seconds())
+	return m
+}
+
 // newDefaultMessage is a convenience method to create a notification message
 func newDefaultMessage(topic, msg string) *message {
 	return newMessage(messageEvent, topic, msg)
@@ -144,6 +173,12 @@ func newPollRequestMessage(topic, pollID string) *message {
 	return m
 }
 
+// newCallAckMessage is a convenience method to create a message signaling that the callee of a phone call
+// with a menu (X-Call-Menu) pressed a key
+func newCallAckMessage(topic, messageID, digits string) *message {
+	return newMessage(callAckEvent, topic, fmt.Sprintf("Message %s acknowledged via phone call, key %s pressed", messageID, digits))
+}
+
 func validMessageID(s string) bool {
 	return util.ValidRandomString(s, messageIDLength)
 }
@@ -192,6 +227,7 @@ type queryFilter struct {
 	Title    string
 	Tags     []string
 	Priority []int
+	Defaults map[string]*queryFilter // Topic -> default filter, only applied if neither Tags nor Priority are set
 }
 
 func parseQueryFilters(r *http.Request) (*queryFilter, error) {
@@ -236,9 +272,116 @@ func (q *queryFilter) Pass(msg *message) bool {
 	if len(q.Tags) > 0 && !util.ContainsAll(msg.Tags, q.Tags) {
 		return false
 	}
+	if len(q.Priority) == 0 && len(q.Tags) == 0 {
+		if defaultFilter, ok := q.Defaults[msg.Topic]; ok {
+			return defaultFilter.Pass(msg)
+		}
+	}
 	return true
 }
 
+// parseDefaultFilter parses a default subscribe filter as defined in Config.TopicDefaultFilters, e.g.
+// "priority=high,urgent&tags=prod". Only the priority and tags filters are supported.
+func parseDefaultFilter(s string) (*queryFilter, error) {
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	filter := &queryFilter{
+		Tags:     make([]string, 0),
+		Priority: make([]int, 0),
+	}
+	for key, value := range values {
+		switch strings.ToLower(key) {
+		case "priority", "prio", "p":
+			for _, p := range util.SplitNoEmpty(strings.Join(value, ","), ",") {
+				priority, err := util.ParsePriority(p)
+				if err != nil {
+					return nil, err
+				}
+				filter.Priority = append(filter.Priority, priority)
+			}
+		case "tags", "tag", "ta":
+			filter.Tags = append(filter.Tags, util.SplitNoEmpty(strings.Join(value, ","), ",")...)
+		default:
+			return nil, fmt.Errorf("unsupported filter %s, only priority and tags are allowed", key)
+		}
+	}
+	if len(filter.Priority) == 0 && len(filter.Tags) == 0 {
+		return nil, errors.New("filter must contain a priority or tags filter")
+	}
+	return filter, nil
+}
+
+// deltaEncoder encodes messages as field-level diffs against the previously encoded message (?delta=1).
+// The first message is sent in full, every following message only contains the fields that changed, plus
+// the "id" and "event" fields and "delta": true. Fields that were removed are set to null. Non-message
+// events (open, keepalive, ...) are always sent in full and do not affect the state.
+//
+// A deltaEncoder is stateful and must only be used for a single connection, and not concurrently.
+type deltaEncoder struct {
+	last map[string]json.RawMessage
+}
+
+func newDeltaEncoder() *deltaEncoder {
+	return &deltaEncoder{}
+}
+
+// Encode returns the JSON representation of the message, or of its diff to the last message
+func (d *deltaEncoder) Encode(msg *message) ([]byte, error) {
+	full, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	} else if msg.Event != messageEvent {
+		return full, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(full, &fields); err != nil {
+		return nil, err
+	}
+	last := d.last
+	d.last = fields
+	if last == nil {
+		return full, nil
+	}
+	diff := map[string]json.RawMessage{
+		"id":    fields["id"],
+		"event": fields["event"],
+		"delta": json.RawMessage("true"),
+	}
+	for k, v := range fields {
+		if !bytes.Equal(last[k], v) {
+			diff[k] = v
+		}
+	}
+	for k := range last {
+		if _, ok := fields[k]; !ok {
+			diff[k] = json.RawMessage("null")
+		}
+	}
+	return json.Marshal(diff)
+}
+
+// publishDryRunResponse is the response to a dry-run publish request (X-Dry-Run), i.e. the message that would
+// have been published
+type publishDryRunResponse struct {
+	*message
+	Dry bool `json:"dry"`
+}
+
+// publishSkippedResponse is the response to a conditional publish request (X-If-Subscribers) if the topic has no
+// active subscribers, i.e. the message was neither stored nor delivered
+type publishSkippedResponse struct {
+	Published bool `json:"published"`
+}
+
+type apiScheduleResponse struct {
+	ID      string `json:"id"`
+	Cron    string `json:"cron"`
+	Next    int64  `json:"next,omitempty"` // Time of the next occurrence
+	Created int64  `json:"created"`
+}
+
 type apiHealthResponse struct {
 	Healthy bool `json:"healthy"`
 }
@@ -248,6 +391,24 @@ type apiStatsResponse struct {
 	MessagesRate float64 `json:"messages_rate"` // Average number of messages per second
 }
 
+// apiStatsAdminResponse extends apiStatsResponse with details that are only visible to admins
+type apiStatsAdminResponse struct {
+	Messages         int64                `json:"messages"`
+	MessagesRate     float64              `json:"messages_rate"`
+	MessagesCached   int                  `json:"messages_cached"`
+	MessagesLastHour int                  `json:"messages_last_hour"`
+	MessagesLastDay  int                  `json:"messages_last_day"` // Limited by the cache duration
+	Subscribers      int                  `json:"subscribers"`
+	Topics           []*topicMessageCount `json:"topics"`
+	CacheSize        int64                `json:"cache_size,omitempty"` // Size of the cache database file(s) in bytes
+}
+
+// topicMessageCount is the number of cached messages in a topic
+type topicMessageCount struct {
+	Topic    string `json:"topic"`
+	Messages int    `json:"messages"`
+}
+
 type apiUserAddRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -267,6 +428,28 @@ type apiUserGrantResponse struct {
 	Permission string `json:"permission"`
 }
 
+type apiSearchResponse struct {
+	Messages []*message `json:"messages"`
+	Offset   int        `json:"offset"`
+	Limit    int        `json:"limit"`
+}
+
+type apiSubscribersResponse struct {
+	Subscribers []*apiSubscriberResponse `json:"subscribers"`
+	Total       int                      `json:"total"`
+	Offset      int                      `json:"offset"`
+	Limit       int                      `json:"limit"`
+}
+
+type apiSubscriberResponse struct {
+	Topic     string `json:"topic"`
+	IP        string `json:"ip"`
+	User      string `json:"user,omitempty"`
+	Protocol  string `json:"protocol"`
+	Connected int64  `json:"connected"`
+	Delivered int64  `json:"delivered"`
+}
+
 type apiUserDeleteRequest struct {
 	Username string `json:"username"`
 }
@@ -307,12 +490,26 @@ type apiAccountTokenUpdateRequest struct {
 	Expires *int64  `json:"expires"` // Unix timestamp
 }
 
+type apiSubscribeURLRequest struct {
+	Topic   string `json:"topic"`
+	Expires *int64 `json:"expires"` // Unix timestamp
+}
+
+type apiSubscribeURLResponse struct {
+	URL       string `json:"url,omitempty"` // Only set if base-url is configured
+	Topic     string `json:"topic"`
+	Expires   int64  `json:"expires"` // Unix timestamp
+	Signature string `json:"signature"`
+}
+
 type apiAccountTokenResponse struct {
-	Token      string `json:"token"`
-	Label      string `json:"label,omitempty"`
-	LastAccess int64  `json:"last_access,omitempty"`
-	LastOrigin string `json:"last_origin,omitempty"`
-	Expires    int64  `json:"expires,omitempty"` // Unix timestamp
+	Token         string `json:"token"`
+	Label         string `json:"label,omitempty"`
+	LastAccess    int64  `json:"last_access,omitempty"`
+	LastOrigin    string `json:"last_origin,omitempty"`
+	LastUserAgent string `json:"last_user_agent,omitempty"`
+	Expires       int64  `json:"expires,omitempty"` // Unix timestamp
+	Current       bool   `json:"current,omitempty"` // Token is used to authenticate this request
 }
 
 type apiAccountPhoneNumberVerifyRequest struct {
@@ -341,6 +538,7 @@ type apiAccountLimits struct {
 	AttachmentFileSize       int64  `json:"attachment_file_size"`
 	AttachmentExpiryDuration int64  `json:"attachment_expiry_duration"`
 	AttachmentBandwidth      int64  `json:"attachment_bandwidth"`
+	MessageSize              int64  `json:"message_size"`
 }
 
 type apiAccountStats struct {
@@ -404,6 +602,7 @@ type apiConfigResponse struct {
 	BillingContact     string   `json:"billing_contact"`
 	WebPushPublicKey   string   `json:"web_push_public_key"`
 	DisallowedTopics   []string `json:"disallowed_topics"`
+	EnableEmojiTags    bool     `json:"enable_emoji_tags"`
 }
 
 type apiAccountBillingPrices struct {
@@ -475,6 +674,11 @@ type apiWebPushUpdateSubscriptionRequest struct {
 	Topics   []string `json:"topics"`
 }
 
+type apiAPNSDeviceRequest struct {
+	Token  string   `json:"token"`
+	Topics []string `json:"topics"`
+}
+
 // List of possible Web Push events (see sw.js)
 const (
 	webPushMessageEvent  = "message"
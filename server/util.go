@@ -2,22 +2,81 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"heckel.io/ntfy/v2/util"
 	"io"
 	"mime"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	fileContentTypeSniffLen = 3072 // Same as the default read limit of the mimetype library
+	redactedReplacement     = "[redacted]"
 )
 
 var (
 	mimeDecoder               mime.WordDecoder
 	priorityHeaderIgnoreRegex = regexp.MustCompile(`^u=\d,\s*(i|\d)$|^u=\d$`)
+	sharedAddressSpacePrefix  = netip.MustParsePrefix("100.64.0.0/10") // Carrier-grade NAT, RFC 6598
+	thisNetworkPrefix         = netip.MustParsePrefix("0.0.0.0/8")
+	errNonPublicIPAddress     = errors.New("connecting to non-public IP addresses is not allowed")
 )
 
+// redactMessage returns a copy of the message, in which all matches of the redact patterns in title and body are
+// replaced. It is used for logging and outbound forwarding only; subscribers always receive the original message.
+func redactMessage(m *message, patterns []*regexp.Regexp) *message {
+	if len(patterns) == 0 {
+		return m
+	}
+	redacted := *m
+	redacted.Title = redactString(m.Title, patterns)
+	redacted.Message = redactString(m.Message, patterns)
+	return &redacted
+}
+
+func redactString(s string, patterns []*regexp.Regexp) string {
+	for _, pattern := range patterns {
+		s = pattern.ReplaceAllLiteralString(s, redactedReplacement)
+	}
+	return s
+}
+
+// readTagMapFile reads a JSON file that maps custom tags to strings, e.g. {"deploy":"🚀","db":"database"}
+func readTagMapFile(filename string) (map[string]string, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var tagMap map[string]string
+	if err := json.Unmarshal(b, &tagMap); err != nil {
+		return nil, fmt.Errorf("invalid emoji tag map file %s: %w", filename, err)
+	}
+	return tagMap, nil
+}
+
+// mapTags replaces all tags that are in the tag map with their mapped value. Tags not in the map are kept as is.
+func mapTags(tags []string, tagMap map[string]string) []string {
+	if len(tagMap) == 0 {
+		return tags
+	}
+	for i, tag := range tags {
+		if mapped, ok := tagMap[tag]; ok {
+			tags[i] = mapped
+		}
+	}
+	return tags
+}
+
 func readBoolParam(r *http.Request, defaultValue bool, names ...string) bool {
 	value := strings.ToLower(readParam(r, names...))
 	if value == "" {
@@ -73,7 +132,7 @@ func readQueryParam(r *http.Request, names ...string) string {
 	return ""
 }
 
-func extractIPAddress(r *http.Request, behindProxy bool) netip.Addr {
+func extractIPAddress(r *http.Request, behindProxy bool, trustedProxies []netip.Prefix) netip.Addr {
 	remoteAddr := r.RemoteAddr
 	addrPort, err := netip.ParseAddrPort(remoteAddr)
 	ip := addrPort.Addr()
@@ -99,10 +158,141 @@ func extractIPAddress(r *http.Request, behindProxy bool) netip.Addr {
 		} else {
 			ip = realIP
 		}
+	} else if behindProxy {
+		// The RFC 7239 Forwarded header is only used if X-Forwarded-For is not set
+		if hop := forwardedClientHop(parseForwardedHeader(r.Header.Values("Forwarded")), trustedProxies); hop != nil {
+			ip = hop.For
+		}
 	}
 	return ip
 }
 
+// extractForwardedBy returns the "by=" node identifier of the proxy that received the client's connection (see
+// forwardedClientHop), e.g. "proxy-eu-1" or "10.0.1.1", or an empty string if unknown or not behind a proxy
+func extractForwardedBy(r *http.Request, behindProxy bool, trustedProxies []netip.Prefix) string {
+	if !behindProxy || strings.TrimSpace(r.Header.Get("X-Forwarded-For")) != "" {
+		return ""
+	}
+	if hop := forwardedClientHop(parseForwardedHeader(r.Header.Values("Forwarded")), trustedProxies); hop != nil {
+		return hop.By
+	}
+	return ""
+}
+
+// forwardedHop is a single element of an RFC 7239 Forwarded header, e.g. for=192.0.2.60;proto=http;by=proxy1.
+// For is invalid if the "for=" parameter is missing, obfuscated (e.g. "_hidden") or "unknown".
+type forwardedHop struct {
+	For netip.Addr
+	By  string
+}
+
+// parseForwardedHeader parses the values of all Forwarded headers into a list of hops, from the left-most (i.e.
+// the first proxy) to the right-most (i.e. the proxy that connected to us). Multiple headers are treated as if
+// they were a single comma-separated header. Parameters other than "for=" and "by=" are ignored.
+func parseForwardedHeader(values []string) []*forwardedHop {
+	hops := make([]*forwardedHop, 0)
+	for _, value := range values {
+		for _, element := range util.SplitNoEmpty(value, ",") {
+			hop := &forwardedHop{}
+			for _, pair := range util.SplitNoEmpty(element, ";") {
+				key, val, ok := strings.Cut(pair, "=")
+				if !ok {
+					continue
+				}
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "for":
+					hop.For = parseForwardedNode(val)
+				case "by":
+					hop.By = val
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseForwardedNode parses the IP address of a node identifier, e.g. 192.0.2.43, 192.0.2.43:47011 or
+// [2001:db8:cafe::17]:4711. Obfuscated identifiers (e.g. _hidden) and "unknown" return an invalid address.
+func parseForwardedNode(node string) netip.Addr {
+	if node == "" || strings.HasPrefix(node, "_") || strings.EqualFold(node, "unknown") {
+		return netip.Addr{}
+	}
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr()
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr
+}
+
+// forwardedClientHop returns the right-most hop whose "for=" address is not one of the trusted proxies, i.e. the
+// hop that describes the client as seen by the first of our proxies. Hops with obfuscated or unknown addresses
+// (e.g. for=_hidden or for=unknown) are skipped, so the next usable address further left is used instead. It
+// returns nil if no such hop exists.
+func forwardedClientHop(hops []*forwardedHop, trustedProxies []netip.Prefix) *forwardedHop {
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].For.IsValid() && !util.ContainsIP(trustedProxies, hops[i].For) {
+			return hops[i]
+		}
+	}
+	return nil
+}
+
+// extractBaseURL returns the base URL used to build URLs that are handed out to clients, e.g. attachment and icon URLs,
+// signed subscribe URLs, or billing redirects.
+// If we are behind a (trusted) proxy, the scheme and host of the configured base URL are replaced with the externally
+// visible ones from the X-Forwarded-Proto and X-Forwarded-Host headers, if they are set.
+func extractBaseURL(r *http.Request, baseURL string, behindProxy bool, trustedProxies []netip.Prefix) string {
+	if !behindProxy || !isTrustedProxy(r, trustedProxies) {
+		return baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return baseURL
+	}
+	// Like with X-Forwarded-For, only the right-most value can be trusted, as this is the one added by our proxy server
+	proto := strings.ToLower(strings.TrimSpace(util.LastString(util.SplitNoEmpty(r.Header.Get("X-Forwarded-Proto"), ","), "")))
+	if proto == "http" || proto == "https" {
+		u.Scheme = proto
+	}
+	host := strings.TrimSpace(util.LastString(util.SplitNoEmpty(r.Header.Get("X-Forwarded-Host"), ","), ""))
+	if host != "" {
+		if hostURL, err := url.Parse("http://" + host); err == nil && hostURL.Host == host && hostURL.User == nil && hostURL.Path == "" {
+			u.Host = host
+		} else {
+			logr(r).Warn("invalid host %s received in X-Forwarded-Host header, ignoring", host)
+		}
+	}
+	return u.String()
+}
+
+// isTrustedProxy returns true if the request was sent by one of the trusted proxies, or if no trusted
+// proxies are defined (in which case all proxies are trusted)
+func isTrustedProxy(r *http.Request, trustedProxies []netip.Prefix) bool {
+	if len(trustedProxies) == 0 {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	ip := addrPort.Addr()
+	if err != nil {
+		// This should only happen in tests, see extractIPAddress
+		if ip, err = netip.ParseAddr(r.RemoteAddr); err != nil {
+			return false
+		}
+	}
+	ip = ip.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func readJSONWithLimit[T any](r io.ReadCloser, limit int, allowEmpty bool) (*T, error) {
 	obj, err := util.UnmarshalJSONWithLimit[T](r, limit, allowEmpty)
 	if errors.Is(err, util.ErrUnmarshalJSON) {
@@ -115,6 +305,38 @@ func readJSONWithLimit[T any](r io.ReadCloser, limit int, allowEmpty bool) (*T,
 	return obj, nil
 }
 
+// cacheFileSize returns the size of the SQLite cache database on disk, including the write-ahead log,
+// or 0 if there is no cache file
+func cacheFileSize(filename string) int64 {
+	if filename == "" {
+		return 0
+	}
+	var size int64
+	for _, f := range []string{filename, filename + "-wal"} {
+		if stat, err := os.Stat(f); err == nil {
+			size += stat.Size()
+		}
+	}
+	return size
+}
+
+// detectFileContentType detects the content type of a file based on its first bytes (see util.DetectSafeContentType),
+// and rewinds the file to the beginning afterwards
+func detectFileContentType(f io.ReadSeeker, filename string) (string, error) {
+	buf := make([]byte, fileContentTypeSniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if contentType := util.DetectSafeContentType(buf[:n], filename); contentType != "" {
+		return contentType, nil
+	}
+	return "application/octet-stream", nil
+}
+
 func withContext(r *http.Request, ctx map[contextKey]any) *http.Request {
 	c := r.Context()
 	for k, v := range ctx {
@@ -154,3 +376,67 @@ func maybeIgnoreSpecialHeader(name, value string) string {
 	}
 	return value
 }
+
+// countingResponseWriter is an http.ResponseWriter that counts the bytes written to the response body,
+// and remembers the response status code
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+	status  int
+}
+
+func newCountingResponseWriter(w http.ResponseWriter) *countingResponseWriter {
+	return &countingResponseWriter{ResponseWriter: w}
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// newPublicHTTPClient returns an HTTP client for server-side requests to user-supplied URLs. To prevent server-side
+// request forgery (SSRF), it refuses to connect to loopback, private, link-local and other non-public IP addresses.
+// The check is done when dialing, i.e. after DNS resolution and for every redirect, so it cannot be bypassed with a
+// DNS name pointing to an internal address. Proxy environment variables are ignored for the same reason.
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			} else if !isPublicIP(addrPort.Addr()) {
+				return errNonPublicIPAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+	}
+}
+
+// isPublicIP returns true if the IP address is a publicly routable unicast address
+func isPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() &&
+		ip.IsGlobalUnicast() &&
+		!ip.IsPrivate() &&
+		!sharedAddressSpacePrefix.Contains(ip) &&
+		!thisNetworkPrefix.Contains(ip)
+}
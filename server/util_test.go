@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"net/http"
+	"net/netip"
 	"strings"
 	"testing"
 )
@@ -42,6 +43,15 @@ some message`
 	require.Equal(t, expected, renderHTTPRequest(r))
 }
 
+func TestRenderHTTPRequest_RedactsCredentials(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://ntfy.sh/mytopic/sse?since=all&auth=QmFzaWMgYmVuOnBhc3M", nil)
+	r.Header.Set("Authorization", "Basic YmVuOnBhc3M=")
+	expected := `GET /mytopic/sse?since=all&auth=REDACTED HTTP/1.1
+Authorization: REDACTED`
+	require.Equal(t, expected, renderHTTPRequest(r))
+	require.Equal(t, "/mytopic/ws?authorization=REDACTED&since=1h", redactAuthQueryParam("/mytopic/ws?authorization=QmFzaWMgYmVuOnBhc3M&since=1h"))
+}
+
 func TestRenderHTTPRequest_ValidLong(t *testing.T) {
 	body := strings.Repeat("a", 5000)
 	r, _ := http.NewRequest("POST", "http://ntfy.sh/mytopic?p=2", strings.NewReader(body))
@@ -88,3 +98,78 @@ func TestMaybeDecodeHeaders(t *testing.T) {
 	r.Header.Set("X-Priority", "5") // ntfy priority header
 	require.Equal(t, "5", readHeaderParam(r, "x-priority", "priority", "p"))
 }
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, public := range map[string]bool{
+		"1.1.1.1":              true,
+		"93.184.216.34":        true,
+		"2606:4700::1111":      true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false, // Cloud metadata endpoint
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"255.255.255.255":      false,
+		"224.0.0.1":            false,
+		"::1":                  false,
+		"fe80::1":              false,
+		"fd00::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:169.254.169.1": false,
+	} {
+		require.Equal(t, public, isPublicIP(netip.MustParseAddr(ip)), ip)
+	}
+}
+
+func TestExtractIPAddress_Forwarded(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name      string
+		headers   []string
+		trusted   []netip.Prefix
+		wantIP    string
+		wantProxy string
+	}{
+		{"single", []string{"for=1.2.3.4"}, nil, "1.2.3.4", ""},
+		{"single with by", []string{`for=1.2.3.4;proto=https;by=proxy-eu-1`}, nil, "1.2.3.4", "proxy-eu-1"},
+		{"case and quotes", []string{`For="1.2.3.4:4711";BY="_edge1"`}, nil, "1.2.3.4", "_edge1"},
+		{"ipv6", []string{`for="[2001:db8:cafe::17]:4711";by=edge`}, nil, "2001:db8:cafe::17", "edge"},
+		{"ipv6 without port", []string{`for="[2001:db8:cafe::17]"`}, nil, "2001:db8:cafe::17", ""},
+		{"right-most wins", []string{"for=6.6.6.6;by=spoofed, for=1.2.3.4;by=edge"}, nil, "1.2.3.4", "edge"},
+		{"multiple headers", []string{"for=6.6.6.6;by=spoofed", "for=1.2.3.4;by=edge", "for=10.0.1.1;by=10.0.2.2"}, trusted, "1.2.3.4", "edge"},
+		{"trusted hops skipped", []string{"for=1.2.3.4;by=edge, for=10.0.1.1;by=10.0.2.2, for=10.0.2.2;by=10.0.3.3"}, trusted, "1.2.3.4", "edge"},
+		{"without trusted proxies", []string{"for=1.2.3.4;by=edge, for=10.0.1.1;by=10.0.2.2"}, nil, "10.0.1.1", "10.0.2.2"},
+		{"obfuscated skipped", []string{"for=1.2.3.4;by=edge, for=_hidden;by=_mesh"}, nil, "1.2.3.4", "edge"},
+		{"unknown skipped", []string{"for=1.2.3.4;by=edge, for=unknown"}, nil, "1.2.3.4", "edge"},
+		{"obfuscated behind trusted skipped", []string{"for=1.2.3.4;by=edge, for=_hidden;by=_mesh, for=10.0.1.1;by=10.0.2.2"}, trusted, "1.2.3.4", "edge"},
+		{"obfuscated left of client", []string{"for=_hidden;by=_mesh, for=1.2.3.4;by=edge, for=10.0.1.1;by=10.0.2.2"}, trusted, "1.2.3.4", "edge"},
+		{"only obfuscated", []string{"for=_hidden;by=edge"}, nil, "8.9.10.11", ""},
+		{"only trusted", []string{"for=10.0.1.1;by=edge"}, trusted, "8.9.10.11", ""},
+		{"invalid", []string{"for=not-an-ip, garbage"}, nil, "8.9.10.11", ""},
+		{"no for", []string{"by=edge;proto=http"}, nil, "8.9.10.11", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/bla", nil)
+			r.RemoteAddr = "8.9.10.11"
+			for _, header := range tt.headers {
+				r.Header.Add("Forwarded", header)
+			}
+			require.Equal(t, tt.wantIP, extractIPAddress(r, true, tt.trusted).String())
+			require.Equal(t, tt.wantProxy, extractForwardedBy(r, true, tt.trusted))
+			require.Equal(t, "8.9.10.11", extractIPAddress(r, false, tt.trusted).String()) // Not behind proxy
+			require.Equal(t, "", extractForwardedBy(r, false, tt.trusted))
+		})
+	}
+}
+
+func TestExtractIPAddress_XForwardedForBeforeForwarded(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/bla", nil)
+	r.RemoteAddr = "8.9.10.11"
+	r.Header.Set("Forwarded", "for=1.2.3.4;by=edge")
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+	require.Equal(t, "5.6.7.8", extractIPAddress(r, true, nil).String())
+	require.Equal(t, "", extractForwardedBy(r, true, nil))
+}
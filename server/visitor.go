@@ -81,6 +81,7 @@ type visitorLimits struct {
 	RequestLimitReplenish    rate.Limit
 	MessageLimit             int64
 	MessageExpiryDuration    time.Duration
+	MessageSizeLimit         int
 	EmailLimit               int64
 	EmailLimitBurst          int
 	EmailLimitReplenish      rate.Limit
@@ -239,6 +240,27 @@ func (v *visitor) CallAllowed() bool {
 	return v.callsLimiter.Allow()
 }
 
+// MessageAvailable returns true if MessageAllowed would succeed, without counting the message (used for dry runs)
+func (v *visitor) MessageAvailable() bool {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.messagesLimiter.Peek()
+}
+
+// EmailAvailable returns true if EmailAllowed would succeed, without counting the e-mail (used for dry runs)
+func (v *visitor) EmailAvailable() bool {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.emailsLimiter.Peek()
+}
+
+// CallAvailable returns true if CallAllowed would succeed, without counting the call (used for dry runs)
+func (v *visitor) CallAvailable() bool {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.callsLimiter.Peek()
+}
+
 func (v *visitor) SubscriptionAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
@@ -356,8 +378,8 @@ func (v *visitor) Authenticated() bool {
 func (v *visitor) SetUser(u *user.User) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
-	shouldResetLimiters := v.user.TierID() != u.TierID() // TierID works with nil receiver
-	v.user = u                                           // u may be nil!
+	shouldResetLimiters := v.user.TierID() != u.TierID() || limitOverrides(v.user) != limitOverrides(u) // TierID works with nil receiver
+	v.user = u                                                                                          // u may be nil!
 	if shouldResetLimiters {
 		var messages, emails, calls int64
 		if u != nil {
@@ -409,10 +431,40 @@ func (v *visitor) Limits() *visitorLimits {
 }
 
 func (v *visitor) limitsNoLock() *visitorLimits {
+	var limits *visitorLimits
 	if v.user != nil && v.user.Tier != nil {
-		return tierBasedVisitorLimits(v.config, v.user.Tier)
+		limits = tierBasedVisitorLimits(v.config, v.user.Tier)
+	} else {
+		limits = configBasedVisitorLimits(v.config)
+	}
+	if v.user != nil && v.user.LimitOverrides != nil {
+		applyLimitOverrides(v.config, limits, v.user.LimitOverrides)
+	}
+	return limits
+}
+
+// applyLimitOverrides applies the per-user limit overrides (see user.LimitOverrides) to the given limits.
+// A request limit of N per minute translates to a burst of N, replenished at N per minute. Like for tiers, the
+// message size limit cannot exceed the server-wide message size limit.
+func applyLimitOverrides(conf *Config, limits *visitorLimits, overrides *user.LimitOverrides) {
+	if overrides.RequestLimit > 0 {
+		limits.RequestLimitBurst = int(overrides.RequestLimit)
+		limits.RequestLimitReplenish = rate.Limit(float64(overrides.RequestLimit) / time.Minute.Seconds())
+	}
+	if overrides.MessageLimit > 0 {
+		limits.MessageLimit = overrides.MessageLimit
+	}
+	if overrides.MessageSizeLimit > 0 {
+		limits.MessageSizeLimit = int(min(overrides.MessageSizeLimit, int64(conf.MessageSizeLimit)))
 	}
-	return configBasedVisitorLimits(v.config)
+}
+
+// limitOverrides returns the limit overrides of the given user, or zero values if there are none
+func limitOverrides(u *user.User) user.LimitOverrides {
+	if u == nil || u.LimitOverrides == nil {
+		return user.LimitOverrides{}
+	}
+	return *u.LimitOverrides
 }
 
 func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
@@ -422,6 +474,7 @@ func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
 		RequestLimitReplenish:    util.Max(rate.Every(conf.VisitorRequestLimitReplenish), dailyLimitToRate(tier.MessageLimit*visitorMessageToRequestLimitReplenishFactor)),
 		MessageLimit:             tier.MessageLimit,
 		MessageExpiryDuration:    tier.MessageExpiryDuration,
+		MessageSizeLimit:         tierMessageSizeLimit(conf, tier),
 		EmailLimit:               tier.EmailLimit,
 		EmailLimitBurst:          util.MinMax(int(float64(tier.EmailLimit)*visitorEmailLimitBurstRate), conf.VisitorEmailLimitBurst, visitorEmailLimitBurstMax),
 		EmailLimitReplenish:      dailyLimitToRate(tier.EmailLimit),
@@ -434,6 +487,14 @@ func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
 	}
 }
 
+// tierMessageSizeLimit returns the message size limit of the tier, which can only lower the server-wide limit
+func tierMessageSizeLimit(conf *Config, tier *user.Tier) int {
+	if tier.MessageSizeLimit > 0 && tier.MessageSizeLimit < int64(conf.MessageSizeLimit) {
+		return int(tier.MessageSizeLimit)
+	}
+	return conf.MessageSizeLimit
+}
+
 func configBasedVisitorLimits(conf *Config) *visitorLimits {
 	messagesLimit := replenishDurationToDailyLimit(conf.VisitorRequestLimitReplenish) // Approximation!
 	if conf.VisitorMessageDailyLimit > 0 {
@@ -445,6 +506,7 @@ func configBasedVisitorLimits(conf *Config) *visitorLimits {
 		RequestLimitReplenish:    rate.Every(conf.VisitorRequestLimitReplenish),
 		MessageLimit:             messagesLimit,
 		MessageExpiryDuration:    conf.CacheDuration,
+		MessageSizeLimit:         conf.MessageSizeLimit,
 		EmailLimit:               replenishDurationToDailyLimit(conf.VisitorEmailLimitReplenish), // Approximation!
 		EmailLimitBurst:          conf.VisitorEmailLimitBurst,
 		EmailLimitReplenish:      rate.Every(conf.VisitorEmailLimitReplenish),
@@ -524,8 +586,10 @@ func dailyLimitToRate(limit int64) rate.Limit {
 	return rate.Limit(limit) * rate.Every(oneDay)
 }
 
+// visitorID returns the key of the visitor in the visitor map. Users with a tier or with limit overrides have their
+// own limits, and are therefore tracked separately. All other users share the visitor of their IP address.
 func visitorID(ip netip.Addr, u *user.User) string {
-	if u != nil && u.Tier != nil {
+	if u != nil && (u.Tier != nil || u.LimitOverrides != nil) {
 		return fmt.Sprintf("user:%s", u.ID)
 	}
 	return fmt.Sprintf("ip:%s", ip.String())
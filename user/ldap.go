@@ -0,0 +1,312 @@
+package user
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"heckel.io/ntfy/v2/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLDAPUserFilter is the default search filter used to look up a user. The %s is replaced
+	// with the (escaped) username.
+	DefaultLDAPUserFilter = "(uid=%s)"
+
+	// DefaultLDAPGroupAttribute is the default attribute of the user entry that lists the user's groups
+	DefaultLDAPGroupAttribute = "memberOf"
+
+	// DefaultLDAPCacheTTL is the default duration for which successful authentications are cached
+	DefaultLDAPCacheTTL = 5 * time.Minute
+
+	ldapTimeout = 10 * time.Second
+)
+
+// LDAPConfig is the configuration of the LDAPAuthenticator
+type LDAPConfig struct {
+	URL            string        // e.g. ldaps://ldap.example.com:636
+	BindDN         string        // Service account used to look up users, may be empty for anonymous lookups
+	BindPassword   string        // Password of the service account
+	BaseDN         string        // Base DN under which users are searched, e.g. ou=people,dc=example,dc=com
+	UserFilter     string        // Search filter, e.g. (sAMAccountName=%s); %s is replaced by the username
+	GroupAttribute string        // Attribute listing the user's groups, e.g. memberOf
+	CacheTTL       time.Duration // Duration for which successful authentications are cached
+}
+
+// ldapConn is the subset of ldap.Conn used by the LDAPAuthenticator, so it can be replaced in tests
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPAuthenticator is an Authenticator that verifies username and password against an LDAP server
+// (e.g. Active Directory). It first looks up the user's DN and groups (optionally using a service account),
+// and then binds as the user to verify the password. Successful authentications and group lookups are cached
+// for a short time to avoid hammering the directory.
+type LDAPAuthenticator struct {
+	config      *LDAPConfig
+	dial        func() (ldapConn, error)
+	cache       map[string]*ldapCacheEntry // Cache key (username + password hash) -> entry
+	groupsCache map[string]*ldapCacheEntry // Username -> entry, see Groups
+	mu          sync.Mutex
+}
+
+type ldapCacheEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+var _ Authenticator = (*LDAPAuthenticator)(nil)
+
+// NewLDAPAuthenticator creates a new LDAPAuthenticator. Connections to the LDAP server are established
+// lazily, once for every (uncached) authentication.
+func NewLDAPAuthenticator(config *LDAPConfig) *LDAPAuthenticator {
+	if config.UserFilter == "" {
+		config.UserFilter = DefaultLDAPUserFilter
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = DefaultLDAPGroupAttribute
+	}
+	return &LDAPAuthenticator{
+		config: config,
+		dial: func() (ldapConn, error) {
+			conn, err := ldap.DialURL(config.URL)
+			if err != nil {
+				return nil, err
+			}
+			conn.SetTimeout(ldapTimeout)
+			return conn, nil
+		},
+		cache:       make(map[string]*ldapCacheEntry),
+		groupsCache: make(map[string]*ldapCacheEntry),
+	}
+}
+
+// Authenticate verifies username and password against the LDAP server, and returns the groups
+// of the user. It returns ErrUnauthenticated if the user does not exist or the password is wrong.
+func (a *LDAPAuthenticator) Authenticate(username, password string) ([]string, error) {
+	if username == "" || password == "" {
+		return nil, ErrUnauthenticated // An empty password would result in an unauthenticated bind, which always succeeds!
+	}
+	cacheKey := ldapCacheKey(username, password)
+	if groups, ok := a.cached(a.cache, cacheKey); ok {
+		return groups, nil
+	}
+	groups, err := a.authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.pruneCache()
+	expires := time.Now().Add(a.config.CacheTTL)
+	a.cache[cacheKey] = &ldapCacheEntry{groups: groups, expires: expires}
+	a.groupsCache[username] = &ldapCacheEntry{groups: groups, expires: expires}
+	a.mu.Unlock()
+	return groups, nil
+}
+
+// Groups looks up the current groups of the user, without verifying a password. It returns ErrUnauthenticated
+// if the user no longer exists in the directory. This is used to re-check users that authenticate with an
+// access token, so the service account (or anonymous binds) must be allowed to search the directory.
+func (a *LDAPAuthenticator) Groups(username string) ([]string, error) {
+	if username == "" {
+		return nil, ErrUnauthenticated
+	}
+	if groups, ok := a.cached(a.groupsCache, username); ok {
+		return groups, nil
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entry, err := a.lookup(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	groups := entry.GetAttributeValues(a.config.GroupAttribute)
+	a.mu.Lock()
+	a.pruneCache()
+	a.groupsCache[username] = &ldapCacheEntry{groups: groups, expires: time.Now().Add(a.config.CacheTTL)}
+	a.mu.Unlock()
+	return groups, nil
+}
+
+func (a *LDAPAuthenticator) authenticate(username, password string) ([]string, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entry, err := a.lookup(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		log.Tag(tag).Field("user_name", username).Trace("LDAP authentication failed: invalid credentials")
+		return nil, ErrUnauthenticated
+	} else if err != nil {
+		return nil, err
+	}
+	return entry.GetAttributeValues(a.config.GroupAttribute), nil
+}
+
+// lookup binds with the service account (if any), and searches the user's entry. It returns ErrUnauthenticated
+// if the user does not exist.
+func (a *LDAPAuthenticator) lookup(conn ldapConn, username string) (*ldap.Entry, error) {
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("cannot bind with service account: %w", err)
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2, // We only need one, but want to detect ambiguous filters
+		int(ldapTimeout.Seconds()),
+		false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{a.config.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	} else if len(result.Entries) != 1 {
+		log.Tag(tag).Field("user_name", username).Trace("LDAP authentication failed: user search returned %d entries", len(result.Entries))
+		return nil, ErrUnauthenticated
+	}
+	return result.Entries[0], nil
+}
+
+func (a *LDAPAuthenticator) cached(cache map[string]*ldapCacheEntry, cacheKey string) ([]string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := cache[cacheKey]
+	if !ok {
+		return nil, false
+	} else if time.Now().After(entry.expires) {
+		delete(cache, cacheKey)
+		return nil, false
+	}
+	return entry.groups, true
+}
+
+// pruneCache removes expired entries from the caches. It must be called with the lock held.
+func (a *LDAPAuthenticator) pruneCache() {
+	for _, cache := range []map[string]*ldapCacheEntry{a.cache, a.groupsCache} {
+		for key, entry := range cache {
+			if time.Now().After(entry.expires) {
+				delete(cache, key)
+			}
+		}
+	}
+}
+
+// ldapCacheKey derives the cache key from username and password. The password is hashed, so that
+// it is not kept in memory in plain text.
+func ldapCacheKey(username, password string) string {
+	hash := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(hash[:])
+}
+
+// GroupMapping maps the groups returned by an external Authenticator to ntfy roles and topic permissions.
+// Groups can be referenced by their full DN (cn=ntfy-admins,ou=groups,dc=example,dc=com), or by their
+// common name only (ntfy-admins). Group names are compared case-insensitively.
+type GroupMapping struct {
+	AdminGroups []string           // Members of these groups get the admin role, everyone else is a regular user
+	Grants      map[string][]Grant // Group -> topic permissions granted to all members of the group
+}
+
+// Role returns the role of a user with the given groups
+func (m *GroupMapping) Role(groups []string) Role {
+	if m == nil {
+		return RoleUser
+	}
+	for _, adminGroup := range m.AdminGroups {
+		for _, group := range groups {
+			if groupMatches(adminGroup, group) {
+				return RoleAdmin
+			}
+		}
+	}
+	return RoleUser
+}
+
+// Allowed returns true if any of the given groups grants the desired permission on the topic
+func (m *GroupMapping) Allowed(groups []string, topic string, perm Permission) bool {
+	if m == nil {
+		return false
+	}
+	for mappedGroup, grants := range m.Grants {
+		for _, group := range groups {
+			if !groupMatches(mappedGroup, group) {
+				continue
+			}
+			for _, grant := range grants {
+				if topicPatternMatches(grant.TopicPattern, topic) && ((perm == PermissionRead && grant.Allow.IsRead()) || (perm == PermissionWrite && grant.Allow.IsWrite())) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ParseGroupGrant parses a group permission in the format GROUP:TOPIC:PERMISSION, e.g.
+// "cn=ops,ou=groups,dc=example,dc=com:alerts*:rw". Since the group may be a DN, it is everything
+// before the second-to-last colon.
+func ParseGroupGrant(s string) (group string, grant Grant, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 3 {
+		return "", Grant{}, errors.New("invalid group permission, expected format GROUP:TOPIC:PERMISSION")
+	}
+	group = strings.TrimSpace(strings.Join(parts[:len(parts)-2], ":"))
+	topicPattern := strings.TrimSpace(parts[len(parts)-2])
+	permission, err := ParsePermission(strings.TrimSpace(parts[len(parts)-1]))
+	if err != nil {
+		return "", Grant{}, err
+	} else if group == "" || !AllowedTopicPattern(topicPattern) {
+		return "", Grant{}, ErrInvalidArgument
+	}
+	return group, Grant{TopicPattern: topicPattern, Allow: permission}, nil
+}
+
+// groupMatches returns true if the configured group name matches the group DN, either fully or
+// by its common name (first RDN value)
+func groupMatches(configured, group string) bool {
+	if strings.EqualFold(configured, group) {
+		return true
+	}
+	if dn, err := ldap.ParseDN(group); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+		return strings.EqualFold(configured, dn.RDNs[0].Attributes[0].Value)
+	}
+	return false
+}
+
+// topicPatternMatches returns true if the topic matches the pattern, which may include wildcards (*)
+func topicPatternMatches(pattern, topic string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == topic
+	} else if !strings.HasPrefix(topic, parts[0]) {
+		return false
+	}
+	rest := topic[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		idx := strings.Index(rest, part)
+		if idx == -1 {
+			return false
+		}
+		rest = rest[idx+len(part):]
+	}
+	return true
+}
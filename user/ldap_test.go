@@ -0,0 +1,333 @@
+package user
+
+import (
+	"errors"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLDAPAuthenticator_Authenticate_Success(t *testing.T) {
+	a, dir := newTestLDAPAuthenticator()
+	groups, err := a.Authenticate("phil", "phil-pass")
+	require.Nil(t, err)
+	require.Equal(t, []string{"cn=ntfy-admins,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"}, groups)
+	require.Equal(t, 1, dir.dials)
+	require.Equal(t, []string{"cn=ntfy,dc=example,dc=com", "uid=phil,ou=people,dc=example,dc=com"}, dir.binds)
+	require.Equal(t, "(uid=phil)", dir.filters[0])
+}
+
+func TestLDAPAuthenticator_Authenticate_WrongPassword(t *testing.T) {
+	a, _ := newTestLDAPAuthenticator()
+	_, err := a.Authenticate("phil", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestLDAPAuthenticator_Authenticate_UnknownUserOrEmptyPassword(t *testing.T) {
+	a, dir := newTestLDAPAuthenticator()
+	_, err := a.Authenticate("nobody", "pass")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("phil", "")
+	require.Equal(t, ErrUnauthenticated, err)
+	require.Equal(t, 1, dir.dials) // Empty password is never sent to the server
+}
+
+func TestLDAPAuthenticator_Authenticate_EscapesFilter(t *testing.T) {
+	a, dir := newTestLDAPAuthenticator()
+	_, err := a.Authenticate("*)(uid=*", "pass")
+	require.Equal(t, ErrUnauthenticated, err)
+	require.Equal(t, `(uid=\2a\29\28uid=\2a)`, dir.filters[0])
+}
+
+func TestLDAPAuthenticator_Authenticate_ServiceAccountBindFails(t *testing.T) {
+	a, _ := newTestLDAPAuthenticator()
+	a.config.BindPassword = "wrong"
+	_, err := a.Authenticate("phil", "phil-pass")
+	require.Error(t, err)
+	require.NotEqual(t, ErrUnauthenticated, err)
+}
+
+func TestLDAPAuthenticator_Authenticate_Cached(t *testing.T) {
+	a, dir := newTestLDAPAuthenticator()
+	a.config.CacheTTL = 100 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		_, err := a.Authenticate("phil", "phil-pass")
+		require.Nil(t, err)
+	}
+	require.Equal(t, 1, dir.dials)
+
+	// Wrong password is not served from the cache
+	_, err := a.Authenticate("phil", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+	require.Equal(t, 2, dir.dials)
+
+	// Cache entry expires, and is pruned when the next entry is added
+	time.Sleep(150 * time.Millisecond)
+	_, err = a.Authenticate("phil", "phil-pass")
+	require.Nil(t, err)
+	require.Equal(t, 3, dir.dials)
+	require.Len(t, a.cache, 1)
+}
+
+func TestLDAPAuthenticator_Groups(t *testing.T) {
+	a, dir := newTestLDAPAuthenticator()
+	groups, err := a.Groups("phil")
+	require.Nil(t, err)
+	require.Equal(t, []string{"cn=ntfy-admins,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"}, groups)
+	require.Equal(t, []string{"cn=ntfy,dc=example,dc=com"}, dir.binds) // Only the service account binds
+	_, err = a.Groups("phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, dir.dials)
+
+	_, err = a.Groups("nobody")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestLDAPAuthenticator_Groups_CachedByAuthenticate(t *testing.T) {
+	a, dir := newTestLDAPAuthenticator()
+	_, err := a.Authenticate("phil", "phil-pass")
+	require.Nil(t, err)
+	_, err = a.Groups("phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, dir.dials)
+}
+
+func TestGroupMapping_RoleAndAllowed(t *testing.T) {
+	_, grant, err := ParseGroupGrant("cn=ops,ou=groups,dc=example,dc=com:alerts*:rw")
+	require.Nil(t, err)
+	mapping := &GroupMapping{
+		AdminGroups: []string{"NTFY-Admins"},
+		Grants: map[string][]Grant{
+			"cn=ops,ou=groups,dc=example,dc=com": {grant},
+			"readers":                            {{TopicPattern: "news", Allow: PermissionRead}},
+		},
+	}
+	require.Equal(t, RoleAdmin, mapping.Role([]string{"cn=ntfy-admins,ou=groups,dc=example,dc=com"}))
+	require.Equal(t, RoleUser, mapping.Role([]string{"cn=ops,ou=groups,dc=example,dc=com"}))
+	require.True(t, mapping.Allowed([]string{"CN=Ops,OU=Groups,DC=example,DC=com"}, "alerts-prod", PermissionWrite))
+	require.False(t, mapping.Allowed([]string{"cn=ops,ou=groups,dc=example,dc=com"}, "prod-alerts", PermissionRead))
+	require.True(t, mapping.Allowed([]string{"cn=readers,ou=groups,dc=example,dc=com"}, "news", PermissionRead))
+	require.False(t, mapping.Allowed([]string{"cn=readers,ou=groups,dc=example,dc=com"}, "news", PermissionWrite))
+	require.False(t, mapping.Allowed(nil, "news", PermissionRead))
+}
+
+func TestParseGroupGrant_Invalid(t *testing.T) {
+	_, _, err := ParseGroupGrant("ops:alerts")
+	require.Error(t, err)
+	_, _, err = ParseGroupGrant("ops:alerts:invalid")
+	require.Error(t, err)
+	_, _, err = ParseGroupGrant(":alerts:rw")
+	require.Error(t, err)
+	_, _, err = ParseGroupGrant("ops:al/erts:rw")
+	require.Error(t, err)
+}
+
+func TestTopicPatternMatches(t *testing.T) {
+	require.True(t, topicPatternMatches("mytopic", "mytopic"))
+	require.False(t, topicPatternMatches("mytopic", "mytopic2"))
+	require.True(t, topicPatternMatches("*", "anything"))
+	require.True(t, topicPatternMatches("my*", "mytopic"))
+	require.True(t, topicPatternMatches("*topic", "mytopic"))
+	require.True(t, topicPatternMatches("my*pic*x", "mytopic-x"))
+	require.False(t, topicPatternMatches("my*pic*x", "mytopic-y"))
+	require.False(t, topicPatternMatches("ab*ba", "aba"))
+}
+
+func TestManager_Authenticate_External(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	auth := &testAuthenticator{users: map[string]testAuthenticatorUser{
+		"phil": {"phil-pass", []string{"cn=ntfy-admins,ou=groups,dc=example,dc=com"}},
+		"ben":  {"ben-pass", []string{"cn=ops,ou=groups,dc=example,dc=com"}},
+	}}
+	a.SetAuthenticator(auth, &GroupMapping{
+		AdminGroups: []string{"ntfy-admins"},
+		Grants: map[string][]Grant{
+			"ops": {{TopicPattern: "alerts*", Allow: PermissionReadWrite}},
+		},
+	})
+	require.Nil(t, a.AddUser("localadmin", "local-pass", RoleAdmin))
+
+	// Users are created on first login, with the role from the group mapping
+	phil, err := a.Authenticate("phil", "phil-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, phil.Role)
+	ben, err := a.Authenticate("ben", "ben-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleUser, ben.Role)
+	ben2, err := a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, ben.ID, ben2.ID)
+
+	// Wrong passwords fail like local auth, and local users still work
+	_, err = a.Authenticate("ben", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("nobody", "pass")
+	require.Equal(t, ErrUnauthenticated, err)
+	localAdmin, err := a.Authenticate("localadmin", "local-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, localAdmin.Role)
+
+	// Group permissions add to database permissions
+	require.Nil(t, a.AllowAccess("ben", "ben-only", PermissionRead))
+	require.Nil(t, a.Authorize(ben, "alerts-prod", PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "ben-only", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "ben-only", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "other", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "alerts-prod", PermissionRead))
+
+	// Group changes are picked up right away for permissions, and on next login for the role
+	auth.users["phil"] = testAuthenticatorUser{"phil-pass", []string{"cn=ops,ou=groups,dc=example,dc=com"}}
+	auth.users["ben"] = testAuthenticatorUser{"ben-pass", nil}
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts-prod", PermissionWrite))
+	phil, err = a.Authenticate("phil", "phil-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleUser, phil.Role)
+}
+
+func TestManager_Authenticate_ExternalDoesNotTakeOverLocalUser(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	a.SetAuthenticator(&testAuthenticator{users: map[string]testAuthenticatorUser{
+		"phil": {"ldap-pass", []string{"ntfy-admins"}},
+	}}, &GroupMapping{AdminGroups: []string{"ntfy-admins"}})
+	require.Nil(t, a.AddUser("phil", "local-pass", RoleUser))
+
+	// The directory password does not work for the local user, and the local user is not modified
+	_, err := a.Authenticate("phil", "ldap-pass")
+	require.Equal(t, ErrUnauthenticated, err)
+	phil, err := a.Authenticate("phil", "local-pass")
+	require.Nil(t, err)
+	require.Equal(t, RoleUser, phil.Role)
+	require.False(t, a.allowedByGroups(phil, "mytopic", PermissionRead))
+}
+
+func TestManager_AuthenticateToken_External(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "user.db")
+	auth := &testAuthenticator{users: map[string]testAuthenticatorUser{
+		"ben": {"ben-pass", []string{"ops"}},
+	}}
+	mapping := &GroupMapping{
+		AdminGroups: []string{"ntfy-admins"},
+		Grants: map[string][]Grant{
+			"ops": {{TopicPattern: "alerts", Allow: PermissionReadWrite}},
+		},
+	}
+	a := newTestManagerFromFile(t, filename, "", PermissionDenyAll, bcrypt.MinCost, DefaultUserStatsQueueWriterInterval)
+	a.SetAuthenticator(auth, mapping)
+	ben, err := a.Authenticate("ben", "ben-pass")
+	require.Nil(t, err)
+	token, err := a.CreateToken(ben.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), "")
+	require.Nil(t, err)
+	require.Nil(t, a.Close())
+
+	// After a restart, token users get their group permissions without logging in again
+	a = newTestManagerFromFile(t, filename, "", PermissionDenyAll, bcrypt.MinCost, DefaultUserStatsQueueWriterInterval)
+	a.SetAuthenticator(auth, mapping)
+	ben, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "alerts", PermissionWrite))
+
+	// Role changes are picked up when the token is used
+	auth.users["ben"] = testAuthenticatorUser{"ben-pass", []string{"ntfy-admins"}}
+	ben, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, RoleAdmin, ben.Role)
+
+	// Tokens of users removed from the directory are rejected
+	delete(auth.users, "ben")
+	_, err = a.AuthenticateToken(token.Value)
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestManager_Authenticate_ExternalDeletedUser(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	a.SetAuthenticator(&testAuthenticator{users: map[string]testAuthenticatorUser{
+		"phil": {"phil-pass", nil},
+	}}, nil)
+	phil, err := a.Authenticate("phil", "phil-pass")
+	require.Nil(t, err)
+	require.Nil(t, a.MarkUserRemoved(phil))
+	_, err = a.Authenticate("phil", "phil-pass")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+type testAuthenticatorUser struct {
+	password string
+	groups   []string
+}
+
+type testAuthenticator struct {
+	users map[string]testAuthenticatorUser
+}
+
+func (a *testAuthenticator) Authenticate(username, password string) ([]string, error) {
+	u, ok := a.users[username]
+	if !ok || u.password != password {
+		return nil, ErrUnauthenticated
+	}
+	return u.groups, nil
+}
+
+func (a *testAuthenticator) Groups(username string) ([]string, error) {
+	u, ok := a.users[username]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return u.groups, nil
+}
+
+// testLDAPDirectory is a fake LDAP server with a service account and a single user
+type testLDAPDirectory struct {
+	dials   int
+	binds   []string
+	filters []string
+}
+
+type testLDAPConn struct {
+	dir *testLDAPDirectory
+}
+
+func (c *testLDAPConn) Bind(username, password string) error {
+	c.dir.binds = append(c.dir.binds, username)
+	if (username == "cn=ntfy,dc=example,dc=com" && password == "service-pass") || (username == "uid=phil,ou=people,dc=example,dc=com" && password == "phil-pass") {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (c *testLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.dir.filters = append(c.dir.filters, req.Filter)
+	if req.BaseDN != "ou=people,dc=example,dc=com" || req.Filter != "(uid=phil)" {
+		return &ldap.SearchResult{}, nil
+	}
+	return &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			ldap.NewEntry("uid=phil,ou=people,dc=example,dc=com", map[string][]string{
+				"memberOf": {"cn=ntfy-admins,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+			}),
+		},
+	}, nil
+}
+
+func (c *testLDAPConn) Close() error {
+	return nil
+}
+
+func newTestLDAPAuthenticator() (*LDAPAuthenticator, *testLDAPDirectory) {
+	dir := &testLDAPDirectory{}
+	a := NewLDAPAuthenticator(&LDAPConfig{
+		URL:          "ldap://ldap.example.com",
+		BindDN:       "cn=ntfy,dc=example,dc=com",
+		BindPassword: "service-pass",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		CacheTTL:     time.Minute,
+	})
+	a.dial = func() (ldapConn, error) {
+		dir.dials++
+		return &testLDAPConn{dir: dir}, nil
+	}
+	return a, dir
+}
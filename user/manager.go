@@ -25,10 +25,12 @@ const (
 	userIDPrefix                    = "u_"
 	userIDLength                    = 12
 	userAuthIntentionalSlowDownHash = "$2a$10$YFCQvqQDwIIwnJM1xkAYOeih0dg17UVGanaTStnrSzC8NCWxcLDwy" // Cost should match DefaultUserPasswordBcryptCost
+	userExternalHash                = "external"                                                     // Password "hash" of users created by the external authenticator, never matches a password
 	userHardDeleteAfterDuration     = 7 * 24 * time.Hour
 	tokenPrefix                     = "tk_"
 	tokenLength                     = 32
 	tokenMaxCount                   = 20 // Only keep this many tokens in the table per user
+	tokenUserAgentMaxLength         = 256
 	tag                             = "user_manager"
 )
 
@@ -61,6 +63,7 @@ const (
 			attachment_total_size_limit INT NOT NULL,
 			attachment_expiry_duration INT NOT NULL,
 			attachment_bandwidth_limit INT NOT NULL,
+			message_size_limit INT NOT NULL,
 			stripe_monthly_price_id TEXT,
 			stripe_yearly_price_id TEXT
 		);
@@ -78,6 +81,9 @@ const (
 			stats_messages INT NOT NULL DEFAULT (0),
 			stats_emails INT NOT NULL DEFAULT (0),
 			stats_calls INT NOT NULL DEFAULT (0),
+			override_requests_limit INT,
+			override_messages_limit INT,
+			override_message_size_limit INT,
 			stripe_customer_id TEXT,
 			stripe_subscription_id TEXT,
 			stripe_subscription_status TEXT,
@@ -107,6 +113,7 @@ const (
 			label TEXT NOT NULL,
 			last_access INT NOT NULL,
 			last_origin TEXT NOT NULL,
+			last_user_agent TEXT NOT NULL,
 			expires INT NOT NULL,
 			PRIMARY KEY (user_id, token),
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
@@ -132,26 +139,26 @@ const (
 	`
 
 	selectUserByIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.override_requests_limit, u.override_messages_limit, u.override_message_size_limit, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.message_size_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE u.id = ?
 	`
 	selectUserByNameQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.override_requests_limit, u.override_messages_limit, u.override_message_size_limit, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.message_size_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE user = ?
 	`
 	selectUserByTokenQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.override_requests_limit, u.override_messages_limit, u.override_message_size_limit, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.message_size_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		JOIN user_token tk on u.id = tk.user_id
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE tk.token = ? AND (tk.expires = 0 OR tk.expires >= ?)
 	`
 	selectUserByStripeCustomerIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.override_requests_limit, u.override_messages_limit, u.override_message_size_limit, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.message_size_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
 		FROM user u
 		LEFT JOIN tier t on t.id = u.tier_id
 		WHERE u.stripe_customer_id = ?
@@ -185,6 +192,7 @@ const (
 	updateUserStatsQuery         = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ? WHERE id = ?`
 	updateUserStatsResetAllQuery = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0`
 	updateUserDeletedQuery       = `UPDATE user SET deleted = ? WHERE id = ?`
+	updateUserLimitOverrides     = `UPDATE user SET override_requests_limit = ?, override_messages_limit = ?, override_message_size_limit = ? WHERE user = ?`
 	deleteUsersMarkedQuery       = `DELETE FROM user WHERE deleted < ?`
 	deleteUserQuery              = `DELETE FROM user WHERE user = ?`
 
@@ -251,12 +259,12 @@ const (
   	`
 
 	selectTokenCountQuery      = `SELECT COUNT(*) FROM user_token WHERE user_id = ?`
-	selectTokensQuery          = `SELECT token, label, last_access, last_origin, expires FROM user_token WHERE user_id = ?`
-	selectTokenQuery           = `SELECT token, label, last_access, last_origin, expires FROM user_token WHERE user_id = ? AND token = ?`
-	insertTokenQuery           = `INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires) VALUES (?, ?, ?, ?, ?, ?)`
+	selectTokensQuery          = `SELECT token, label, last_access, last_origin, last_user_agent, expires FROM user_token WHERE user_id = ?`
+	selectTokenQuery           = `SELECT token, label, last_access, last_origin, last_user_agent, expires FROM user_token WHERE user_id = ? AND token = ?`
+	insertTokenQuery           = `INSERT INTO user_token (user_id, token, label, last_access, last_origin, last_user_agent, expires) VALUES (?, ?, ?, ?, ?, ?, ?)`
 	updateTokenExpiryQuery     = `UPDATE user_token SET expires = ? WHERE user_id = ? AND token = ?`
 	updateTokenLabelQuery      = `UPDATE user_token SET label = ? WHERE user_id = ? AND token = ?`
-	updateTokenLastAccessQuery = `UPDATE user_token SET last_access = ?, last_origin = ? WHERE token = ?`
+	updateTokenLastAccessQuery = `UPDATE user_token SET last_access = ?, last_origin = ?, last_user_agent = ? WHERE token = ?`
 	deleteTokenQuery           = `DELETE FROM user_token WHERE user_id = ? AND token = ?`
 	deleteAllTokenQuery        = `DELETE FROM user_token WHERE user_id = ?`
 	deleteExpiredTokensQuery   = `DELETE FROM user_token WHERE expires > 0 AND expires < ?`
@@ -277,25 +285,25 @@ const (
 	deletePhoneNumberQuery  = `DELETE FROM user_phone WHERE user_id = ? AND phone_number = ?`
 
 	insertTierQuery = `
-		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, message_size_limit, stripe_monthly_price_id, stripe_yearly_price_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	updateTierQuery = `
 		UPDATE tier
-		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
+		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, message_size_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
 		WHERE code = ?
 	`
 	selectTiersQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, message_size_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 	`
 	selectTierByCodeQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, message_size_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 		WHERE code = ?
 	`
 	selectTierByPriceIDQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, message_size_limit, stripe_monthly_price_id, stripe_yearly_price_id
 		FROM tier
 		WHERE (stripe_monthly_price_id = ? OR stripe_yearly_price_id = ?)
 	`
@@ -312,7 +320,7 @@ const (
 
 // Schema management queries
 const (
-	currentSchemaVersion     = 5
+	currentSchemaVersion     = 8
 	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
 	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
 	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
@@ -427,6 +435,23 @@ const (
 	migrate4To5UpdateQueries = `
 		UPDATE user_access SET topic = REPLACE(topic, '_', '\_');
 	`
+
+	// 5 -> 6
+	migrate5To6UpdateQueries = `
+		ALTER TABLE user ADD COLUMN override_requests_limit INT;
+		ALTER TABLE user ADD COLUMN override_messages_limit INT;
+		ALTER TABLE user ADD COLUMN override_message_size_limit INT;
+	`
+
+	// 6 -> 7
+	migrate6To7UpdateQueries = `
+		ALTER TABLE user_token ADD COLUMN last_user_agent TEXT NOT NULL DEFAULT ('');
+	`
+
+	// 7 -> 8
+	migrate7To8UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN message_size_limit INT NOT NULL DEFAULT (0);
+	`
 )
 
 var (
@@ -435,6 +460,9 @@ var (
 		2: migrateFrom2,
 		3: migrateFrom3,
 		4: migrateFrom4,
+		5: migrateFrom5,
+		6: migrateFrom6,
+		7: migrateFrom7,
 	}
 )
 
@@ -446,6 +474,8 @@ type Manager struct {
 	statsQueue    map[string]*Stats       // "Queue" to asynchronously write user stats to the database (UserID -> Stats)
 	tokenQueue    map[string]*TokenUpdate // "Queue" to asynchronously write token access stats to the database (Token ID -> TokenUpdate)
 	bcryptCost    int                     // Makes testing easier
+	authenticator Authenticator           // External authenticator (e.g. LDAP), may be nil
+	groupMapping  *GroupMapping           // Maps groups of the external authenticator to roles and permissions
 	mu            sync.Mutex
 }
 
@@ -481,6 +511,15 @@ func (a *Manager) Authenticate(username, password string) (*User, error) {
 	if username == Everyone {
 		return nil, ErrUnauthenticated
 	}
+	if a.authenticator != nil {
+		user, err := a.authenticateExternal(username, password)
+		if err == nil {
+			return user, nil
+		} else if !errors.Is(err, ErrUnauthenticated) {
+			log.Tag(tag).Field("user_name", username).Err(err).Warn("External authentication of user failed")
+		}
+		// Fall back to local users (e.g. for admin accounts that do not exist in the directory)
+	}
 	user, err := a.User(username)
 	if err != nil {
 		log.Tag(tag).Field("user_name", username).Err(err).Trace("Authentication of user failed (1)")
@@ -497,6 +536,77 @@ func (a *Manager) Authenticate(username, password string) (*User, error) {
 	return user, nil
 }
 
+// SetAuthenticator configures an external authenticator (e.g. LDAP), which is used to verify passwords before
+// falling back to local users. Users authenticated externally are created in the database on first login, so
+// that tokens, preferences and ACL entries can be stored for them. Their role is derived from their current
+// groups on every login and token use, and the groups additionally grant topic permissions according to the
+// group mapping. Local users are never authenticated externally, even if a user with the same name exists in
+// the directory.
+func (a *Manager) SetAuthenticator(authenticator Authenticator, groupMapping *GroupMapping) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.authenticator = authenticator
+	a.groupMapping = groupMapping
+}
+
+func (a *Manager) authenticateExternal(username, password string) (*User, error) {
+	if !AllowedUsername(username) {
+		return nil, ErrUnauthenticated
+	}
+	user, err := a.User(username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	} else if user != nil && !user.external() {
+		return nil, ErrUnauthenticated // Local user, see Authenticate
+	}
+	groups, err := a.authenticator.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if err := a.addExternalUser(username, a.groupMapping.Role(groups)); err != nil && !errors.Is(err, ErrUserExists) {
+			return nil, err
+		}
+		log.Tag(tag).Field("user_name", username).Info("Created user %s on first external login", username)
+		user, err = a.User(username)
+		if err != nil {
+			return nil, err
+		} else if !user.external() {
+			return nil, ErrUnauthenticated // Local user was created in the meantime
+		}
+	}
+	return a.updateExternalUser(user, groups)
+}
+
+// addExternalUser creates a user for an externally authenticated user. It does not have a password,
+// and is always authenticated externally.
+func (a *Manager) addExternalUser(username string, role Role) error {
+	userID := util.RandomStringPrefix(userIDPrefix, userIDLength)
+	syncTopic, now := util.RandomStringPrefix(syncTopicPrefix, syncTopicLength), time.Now().Unix()
+	if _, err := a.db.Exec(insertUserQuery, userID, username, userExternalHash, role, syncTopic, now); err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return ErrUserExists
+		}
+		return err
+	}
+	return nil
+}
+
+// updateExternalUser updates the role of an externally authenticated user according to its current groups
+func (a *Manager) updateExternalUser(user *User, groups []string) (*User, error) {
+	if user.Deleted {
+		return nil, ErrUnauthenticated
+	}
+	role := a.groupMapping.Role(groups)
+	if user.Role != role {
+		if err := a.ChangeRole(user.Name, role); err != nil {
+			return nil, err
+		}
+		user.Role = role
+	}
+	return user, nil
+}
+
 // AuthenticateToken checks if the token exists and returns the associated User if it does.
 // The method sets the User.Token value to the token that was used for authentication.
 func (a *Manager) AuthenticateToken(token string) (*User, error) {
@@ -508,14 +618,26 @@ func (a *Manager) AuthenticateToken(token string) (*User, error) {
 		log.Tag(tag).Field("token", token).Err(err).Trace("Authentication of token failed")
 		return nil, ErrUnauthenticated
 	}
+	if a.authenticator != nil && user.external() {
+		// Tokens of external users are only valid as long as the user exists in the directory
+		groups, err := a.authenticator.Groups(user.Name)
+		if err != nil {
+			log.Tag(tag).Field("user_name", user.Name).Err(err).Debug("External lookup of token user failed")
+			return nil, ErrUnauthenticated
+		}
+		if user, err = a.updateExternalUser(user, groups); err != nil {
+			return nil, err
+		}
+	}
 	user.Token = token
 	return user, nil
 }
 
 // CreateToken generates a random token for the given user and returns it. The token expires
 // after a fixed duration unless ChangeToken is called. This function also prunes tokens for the
-// given user, if there are too many of them.
-func (a *Manager) CreateToken(userID, label string, expires time.Time, origin netip.Addr) (*Token, error) {
+// given user, if there are too many of them. The origin and user agent identify the device that
+// created the token, and are updated whenever the token is used, see EnqueueTokenUpdate.
+func (a *Manager) CreateToken(userID, label string, expires time.Time, origin netip.Addr, userAgent string) (*Token, error) {
 	token := util.RandomLowerStringPrefix(tokenPrefix, tokenLength) // Lowercase only to support "<topic>+<token>@<domain>" email addresses
 	tx, err := a.db.Begin()
 	if err != nil {
@@ -523,7 +645,8 @@ func (a *Manager) CreateToken(userID, label string, expires time.Time, origin ne
 	}
 	defer tx.Rollback()
 	access := time.Now()
-	if _, err := tx.Exec(insertTokenQuery, userID, token, label, access.Unix(), origin.String(), expires.Unix()); err != nil {
+	userAgent = truncateUserAgent(userAgent)
+	if _, err := tx.Exec(insertTokenQuery, userID, token, label, access.Unix(), origin.String(), userAgent, expires.Unix()); err != nil {
 		return nil, err
 	}
 	rows, err := tx.Query(selectTokenCountQuery, userID)
@@ -549,11 +672,12 @@ func (a *Manager) CreateToken(userID, label string, expires time.Time, origin ne
 		return nil, err
 	}
 	return &Token{
-		Value:      token,
-		Label:      label,
-		LastAccess: access,
-		LastOrigin: origin,
-		Expires:    expires,
+		Value:         token,
+		Label:         label,
+		LastAccess:    access,
+		LastOrigin:    origin,
+		LastUserAgent: userAgent,
+		Expires:       expires,
 	}, nil
 }
 
@@ -588,12 +712,12 @@ func (a *Manager) Token(userID, token string) (*Token, error) {
 }
 
 func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
-	var token, label, lastOrigin string
+	var token, label, lastOrigin, lastUserAgent string
 	var lastAccess, expires int64
 	if !rows.Next() {
 		return nil, ErrTokenNotFound
 	}
-	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &expires); err != nil {
+	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &lastUserAgent, &expires); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -603,11 +727,12 @@ func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
 		lastOriginIP = netip.IPv4Unspecified()
 	}
 	return &Token{
-		Value:      token,
-		Label:      label,
-		LastAccess: time.Unix(lastAccess, 0),
-		LastOrigin: lastOriginIP,
-		Expires:    time.Unix(expires, 0),
+		Value:         token,
+		Label:         label,
+		LastAccess:    time.Unix(lastAccess, 0),
+		LastOrigin:    lastOriginIP,
+		LastUserAgent: lastUserAgent,
+		Expires:       time.Unix(expires, 0),
 	}, nil
 }
 
@@ -816,7 +941,7 @@ func (a *Manager) writeTokenUpdateQueue() error {
 	log.Tag(tag).Debug("Writing token update queue for %d token(s)", len(tokenQueue))
 	for tokenID, update := range tokenQueue {
 		log.Tag(tag).Trace("Updating token %s with last access time %v", tokenID, update.LastAccess.Unix())
-		if _, err := tx.Exec(updateTokenLastAccessQuery, update.LastAccess.Unix(), update.LastOrigin.String(), tokenID); err != nil {
+		if _, err := tx.Exec(updateTokenLastAccessQuery, update.LastAccess.Unix(), update.LastOrigin.String(), truncateUserAgent(update.LastUserAgent), tokenID); err != nil {
 			return err
 		}
 	}
@@ -832,6 +957,9 @@ func (a *Manager) Authorize(user *User, topic string, perm Permission) error {
 	username := Everyone
 	if user != nil {
 		username = user.Name
+		if a.allowedByGroups(user, topic, perm) {
+			return nil
+		}
 	}
 	// Select the read/write permissions for this user/topic combo.
 	// - The query may return two rows (one for everyone, and one for the user), but prioritizes the user.
@@ -854,6 +982,21 @@ func (a *Manager) Authorize(user *User, topic string, perm Permission) error {
 	return a.resolvePerms(NewPermission(read, write), perm)
 }
 
+// allowedByGroups returns true if the current groups of an externally authenticated user grant the desired
+// permission. Group permissions are added to the permissions stored in the database; they cannot revoke access.
+// The groups are looked up with the authenticator, which caches them for a short time.
+func (a *Manager) allowedByGroups(user *User, topic string, perm Permission) bool {
+	if a.authenticator == nil || a.groupMapping == nil || !user.external() {
+		return false
+	}
+	groups, err := a.authenticator.Groups(user.Name)
+	if err != nil {
+		log.Tag(tag).Field("user_name", user.Name).Err(err).Debug("External lookup of groups failed")
+		return false
+	}
+	return a.groupMapping.Allowed(groups, topic, perm)
+}
+
 func (a *Manager) resolvePerms(base, perm Permission) error {
 	if perm == PermissionRead && base.IsRead() {
 		return nil
@@ -1006,11 +1149,12 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 	var id, username, hash, role, prefs, syncTopic string
 	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, tierID, tierCode, tierName sql.NullString
 	var messages, emails, calls int64
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, messageSizeLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
+	var overrideRequestsLimit, overrideMessagesLimit, overrideMessageSizeLimit sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrUserNotFound
 	}
-	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &overrideRequestsLimit, &overrideMessagesLimit, &overrideMessageSizeLimit, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &messageSizeLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -1040,6 +1184,13 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 	if err := json.Unmarshal([]byte(prefs), user.Prefs); err != nil {
 		return nil, err
 	}
+	if overrideRequestsLimit.Valid || overrideMessagesLimit.Valid || overrideMessageSizeLimit.Valid {
+		user.LimitOverrides = &LimitOverrides{
+			RequestLimit:     overrideRequestsLimit.Int64,    // May be zero
+			MessageLimit:     overrideMessagesLimit.Int64,    // May be zero
+			MessageSizeLimit: overrideMessageSizeLimit.Int64, // May be zero
+		}
+	}
 	if tierCode.Valid {
 		// See readTier() when this is changed!
 		user.Tier = &Tier{
@@ -1055,6 +1206,7 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 			AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
 			AttachmentExpiryDuration: time.Duration(attachmentExpiryDuration.Int64) * time.Second,
 			AttachmentBandwidthLimit: attachmentBandwidthLimit.Int64,
+			MessageSizeLimit:         messageSizeLimit.Int64,
 			StripeMonthlyPriceID:     stripeMonthlyPriceID.String, // May be empty
 			StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
 		}
@@ -1238,6 +1390,22 @@ func (a *Manager) ChangeTier(username, tier string) error {
 	return nil
 }
 
+// ChangeLimitOverrides sets per-user limits that take precedence over the user's tier, or the server defaults.
+// Zero values in overrides are not overridden. If overrides is nil, all overrides are removed.
+func (a *Manager) ChangeLimitOverrides(username string, overrides *LimitOverrides) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	} else if overrides == nil {
+		overrides = &LimitOverrides{}
+	} else if overrides.RequestLimit < 0 || overrides.MessageLimit < 0 || overrides.MessageSizeLimit < 0 {
+		return ErrInvalidArgument
+	}
+	if _, err := a.db.Exec(updateUserLimitOverrides, nullInt64(overrides.RequestLimit), nullInt64(overrides.MessageLimit), nullInt64(overrides.MessageSizeLimit), username); err != nil {
+		return err
+	}
+	return nil
+}
+
 // ResetTier removes the tier from the given user
 func (a *Manager) ResetTier(username string) error {
 	if !AllowedUsername(username) && username != Everyone && username != "" {
@@ -1382,7 +1550,7 @@ func (a *Manager) AddTier(tier *Tier) error {
 	if tier.ID == "" {
 		tier.ID = util.RandomStringPrefix(tierIDPrefix, tierIDLength)
 	}
-	if _, err := a.db.Exec(insertTierQuery, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
+	if _, err := a.db.Exec(insertTierQuery, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, tier.MessageSizeLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
 		return err
 	}
 	return nil
@@ -1390,7 +1558,7 @@ func (a *Manager) AddTier(tier *Tier) error {
 
 // UpdateTier updates a tier's properties in the database
 func (a *Manager) UpdateTier(tier *Tier) error {
-	if _, err := a.db.Exec(updateTierQuery, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
+	if _, err := a.db.Exec(updateTierQuery, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, tier.MessageSizeLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
 		return err
 	}
 	return nil
@@ -1459,11 +1627,11 @@ func (a *Manager) TierByStripePrice(priceID string) (*Tier, error) {
 func (a *Manager) readTier(rows *sql.Rows) (*Tier, error) {
 	var id, code, name string
 	var stripeMonthlyPriceID, stripeYearlyPriceID sql.NullString
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit sql.NullInt64
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, messageSizeLimit sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrTierNotFound
 	}
-	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &messageSizeLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -1482,6 +1650,7 @@ func (a *Manager) readTier(rows *sql.Rows) (*Tier, error) {
 		AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
 		AttachmentExpiryDuration: time.Duration(attachmentExpiryDuration.Int64) * time.Second,
 		AttachmentBandwidthLimit: attachmentBandwidthLimit.Int64,
+		MessageSizeLimit:         messageSizeLimit.Int64,
 		StripeMonthlyPriceID:     stripeMonthlyPriceID.String, // May be empty
 		StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
 	}, nil
@@ -1663,6 +1832,62 @@ func migrateFrom4(db *sql.DB) error {
 	return tx.Commit()
 }
 
+func migrateFrom5(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 5 to 6")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate5To6UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 6); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom6(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 6 to 7")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate6To7UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 7); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom7(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 7 to 8")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate7To8UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 8); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// truncateUserAgent limits the length of user agents stored with tokens, since they are client-supplied
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > tokenUserAgentMaxLength {
+		return userAgent[:tokenUserAgentMaxLength]
+	}
+	return userAgent
+}
+
 func nullString(s string) sql.NullString {
 	if s == "" {
 		return sql.NullString{}
@@ -194,7 +194,7 @@ func TestManager_MarkUserRemoved_RemoveDeletedUsers(t *testing.T) {
 	require.Nil(t, err)
 	require.False(t, u.Deleted)
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), "")
 	require.Nil(t, err)
 
 	u, err = a.Authenticate("user", "pass")
@@ -241,7 +241,7 @@ func TestManager_CreateToken_Only_Lower(t *testing.T) {
 	u, err := a.User("user")
 	require.Nil(t, err)
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), "")
 	require.Nil(t, err)
 	require.Equal(t, token.Value, strings.ToLower(token.Value))
 }
@@ -513,7 +513,7 @@ func TestManager_Token_Valid(t *testing.T) {
 	require.Nil(t, err)
 
 	// Create token for user
-	token, err := a.CreateToken(u.ID, "some label", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "some label", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), "")
 	require.Nil(t, err)
 	require.NotEmpty(t, token.Value)
 	require.Equal(t, "some label", token.Label)
@@ -576,12 +576,12 @@ func TestManager_Token_Expire(t *testing.T) {
 	require.Nil(t, err)
 
 	// Create tokens for user
-	token1, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token1, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), "")
 	require.Nil(t, err)
 	require.NotEmpty(t, token1.Value)
 	require.True(t, time.Now().Add(71*time.Hour).Unix() < token1.Expires.Unix())
 
-	token2, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token2, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), "")
 	require.Nil(t, err)
 	require.NotEmpty(t, token2.Value)
 	require.NotEqual(t, token1.Value, token2.Value)
@@ -628,7 +628,7 @@ func TestManager_Token_Extend(t *testing.T) {
 	require.Equal(t, errNoTokenProvided, err)
 
 	// Create token for user
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), "")
 	require.Nil(t, err)
 	require.NotEmpty(t, token.Value)
 
@@ -658,12 +658,12 @@ func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
 
 	// Create 2 tokens for phil
 	philTokens := make([]string, 0)
-	token, err := a.CreateToken(phil.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(phil.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), "")
 	require.Nil(t, err)
 	require.NotEmpty(t, token.Value)
 	philTokens = append(philTokens, token.Value)
 
-	token, err = a.CreateToken(phil.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
+	token, err = a.CreateToken(phil.ID, "", time.Unix(0, 0), netip.IPv4Unspecified(), "")
 	require.Nil(t, err)
 	require.NotEmpty(t, token.Value)
 	philTokens = append(philTokens, token.Value)
@@ -672,7 +672,7 @@ func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
 	baseTime := time.Now().Add(24 * time.Hour)
 	benTokens := make([]string, 0)
 	for i := 0; i < 22; i++ { //
-		token, err := a.CreateToken(ben.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+		token, err := a.CreateToken(ben.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified(), "")
 		require.Nil(t, err)
 		require.NotEmpty(t, token.Value)
 		benTokens = append(benTokens, token.Value)
@@ -771,13 +771,14 @@ func TestManager_EnqueueTokenUpdate(t *testing.T) {
 	u, err := a.User("ben")
 	require.Nil(t, err)
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), "ntfy/1.0 (web)")
 	require.Nil(t, err)
 
 	// Queue token update
 	a.EnqueueTokenUpdate(token.Value, &TokenUpdate{
-		LastAccess: time.Unix(111, 0).UTC(),
-		LastOrigin: netip.MustParseAddr("1.2.3.3"),
+		LastAccess:    time.Unix(111, 0).UTC(),
+		LastOrigin:    netip.MustParseAddr("1.2.3.3"),
+		LastUserAgent: "ntfy/1.16.0 (Android)",
 	})
 
 	// Token has not changed yet.
@@ -785,6 +786,7 @@ func TestManager_EnqueueTokenUpdate(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, token.LastAccess.Unix(), token2.LastAccess.Unix())
 	require.Equal(t, token.LastOrigin, token2.LastOrigin)
+	require.Equal(t, "ntfy/1.0 (web)", token2.LastUserAgent)
 
 	// After a second or so they should be persisted
 	time.Sleep(time.Second)
@@ -793,6 +795,21 @@ func TestManager_EnqueueTokenUpdate(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, time.Unix(111, 0).UTC().Unix(), token3.LastAccess.Unix())
 	require.Equal(t, netip.MustParseAddr("1.2.3.3"), token3.LastOrigin)
+	require.Equal(t, "ntfy/1.16.0 (Android)", token3.LastUserAgent)
+}
+
+func TestManager_CreateToken_TruncatesUserAgent(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+
+	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified(), strings.Repeat("x", 1000))
+	require.Nil(t, err)
+	require.Equal(t, tokenUserAgentMaxLength, len(token.LastUserAgent))
+	token, err = a.Token(u.ID, token.Value)
+	require.Nil(t, err)
+	require.Equal(t, strings.Repeat("x", tokenUserAgentMaxLength), token.LastUserAgent)
 }
 
 func TestManager_ChangeSettings(t *testing.T) {
@@ -864,6 +881,7 @@ func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
 		AttachmentTotalSizeLimit: 123123,
 		AttachmentExpiryDuration: 10800 * time.Second,
 		AttachmentBandwidthLimit: 21474836480,
+		MessageSizeLimit:         2048,
 		StripeMonthlyPriceID:     "price_2",
 	}))
 	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
@@ -890,6 +908,7 @@ func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
 	require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
 	require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
 	require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
+	require.Equal(t, int64(2048), ti.MessageSizeLimit)
 	require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
 
 	// Update tier
@@ -925,6 +944,7 @@ func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
 	require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
 	require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
 	require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
+	require.Equal(t, int64(2048), ti.MessageSizeLimit)
 	require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
 
 	ti, err = a.TierByStripePrice("price_1")
@@ -1004,6 +1024,30 @@ func TestManager_Tier_Change_And_Reset(t *testing.T) {
 	require.Nil(t, a.ResetTier("phil"))
 }
 
+func TestManager_ChangeLimitOverrides(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+
+	u, err := a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, u.LimitOverrides)
+
+	require.Nil(t, a.ChangeLimitOverrides("phil", &LimitOverrides{
+		RequestLimit:     120,
+		MessageSizeLimit: 8192,
+	}))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, &LimitOverrides{RequestLimit: 120, MessageSizeLimit: 8192}, u.LimitOverrides)
+
+	require.Nil(t, a.ChangeLimitOverrides("phil", nil))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, u.LimitOverrides)
+
+	require.Equal(t, ErrInvalidArgument, a.ChangeLimitOverrides("phil", &LimitOverrides{MessageLimit: -1}))
+}
+
 func TestUser_PhoneNumberAddListRemove(t *testing.T) {
 	a := newTestManager(t, PermissionDenyAll)
 
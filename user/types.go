@@ -12,17 +12,18 @@ import (
 
 // User is a struct that represents a user
 type User struct {
-	ID        string
-	Name      string
-	Hash      string // password hash (bcrypt)
-	Token     string // Only set if token was used to log in
-	Role      Role
-	Prefs     *Prefs
-	Tier      *Tier
-	Stats     *Stats
-	Billing   *Billing
-	SyncTopic string
-	Deleted   bool
+	ID             string
+	Name           string
+	Hash           string // password hash (bcrypt)
+	Token          string // Only set if token was used to log in
+	Role           Role
+	Prefs          *Prefs
+	Tier           *Tier
+	LimitOverrides *LimitOverrides // May be nil, if no limits are overridden
+	Stats          *Stats
+	Billing        *Billing
+	SyncTopic      string
+	Deleted        bool
 }
 
 // TierID returns the ID of the User.Tier, or an empty string if the user has no tier,
@@ -34,6 +35,11 @@ func (u *User) TierID() string {
 	return u.Tier.ID
 }
 
+// external returns true if the user was created by an external authenticator (e.g. LDAP), see Manager.SetAuthenticator
+func (u *User) external() bool {
+	return u.Hash == userExternalHash
+}
+
 // IsAdmin returns true if the user is an admin
 func (u *User) IsAdmin() bool {
 	return u != nil && u.Role == RoleAdmin
@@ -44,6 +50,14 @@ func (u *User) IsUser() bool {
 	return u != nil && u.Role == RoleUser
 }
 
+// LimitOverrides are per-user limits that take precedence over the limits of the user's tier (or the
+// server defaults, if the user has no tier). Zero values mean that the respective limit is not overridden.
+type LimitOverrides struct {
+	RequestLimit     int64 // Number of requests per minute
+	MessageLimit     int64 // Number of messages per day
+	MessageSizeLimit int64 // Max message size in bytes
+}
+
 // Auther is an interface for authentication and authorization
 type Auther interface {
 	// Authenticate checks username and password and returns a user if correct. The method
@@ -56,19 +70,30 @@ type Auther interface {
 	Authorize(user *User, topic string, perm Permission) error
 }
 
+// Authenticator verifies a username and password against an external identity provider (e.g. LDAP),
+// and returns the groups the user is a member of. It returns ErrUnauthenticated if the credentials are invalid.
+// Groups returns the current groups of a user without a password (e.g. for token authentication), or
+// ErrUnauthenticated if the user no longer exists. Implementations should cache both for a short time.
+type Authenticator interface {
+	Authenticate(username, password string) (groups []string, err error)
+	Groups(username string) (groups []string, err error)
+}
+
 // Token represents a user token, including expiry date
 type Token struct {
-	Value      string
-	Label      string
-	LastAccess time.Time
-	LastOrigin netip.Addr
-	Expires    time.Time
+	Value         string
+	Label         string
+	LastAccess    time.Time
+	LastOrigin    netip.Addr
+	LastUserAgent string // User-Agent header of the last request, to identify the device
+	Expires       time.Time
 }
 
-// TokenUpdate holds information about the last access time and origin IP address of a token
+// TokenUpdate holds information about the last access time, origin IP address and user agent of a token
 type TokenUpdate struct {
-	LastAccess time.Time
-	LastOrigin netip.Addr
+	LastAccess    time.Time
+	LastOrigin    netip.Addr
+	LastUserAgent string
 }
 
 // Prefs represents a user's configuration settings
@@ -92,6 +117,7 @@ type Tier struct {
 	AttachmentTotalSizeLimit int64         // Total file size for all files of this user (bytes)
 	AttachmentExpiryDuration time.Duration // Duration after which attachments will be deleted
 	AttachmentBandwidthLimit int64         // Daily bandwidth limit for the user
+	MessageSizeLimit         int64         // Max message size in bytes, capped by the server-wide limit (0 = server-wide limit)
 	StripeMonthlyPriceID     string        // Monthly price ID for paid tiers (price_...)
 	StripeYearlyPriceID      string        // Yearly price ID for paid tiers (price_...)
 }
@@ -63,6 +63,14 @@ func (q *BatchingQueue[T]) Dequeue() <-chan []T {
 	return q.out
 }
 
+// Flush removes and returns the elements that have not been emitted as part of a batch yet, e.g. to process
+// them synchronously before shutting down
+func (q *BatchingQueue[T]) Flush() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dequeueAll()
+}
+
 func (q *BatchingQueue[T]) dequeueAll() []T {
 	elements := make([]T, len(q.in))
 	copy(elements, q.in)
@@ -56,3 +56,12 @@ func TestBatchingQueue_WithTimeout(t *testing.T) {
 	require.True(t, len(batches) < 21)
 	mu.Unlock()
 }
+
+func TestBatchingQueue_Flush(t *testing.T) {
+	q := util.NewBatchingQueue[int](25, 1*time.Hour)
+	for i := 0; i < 3; i++ {
+		q.Enqueue(i)
+	}
+	require.Equal(t, []int{0, 1, 2}, q.Flush())
+	require.Empty(t, q.Flush())
+}
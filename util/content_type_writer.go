@@ -26,17 +26,23 @@ func (w *ContentTypeWriter) Write(p []byte) (n int, err error) {
 		return w.w.Write(p)
 	}
 	// Detect and set Content-Type header
-	// Fix content types that we don't want to inline-render in the browser. In particular,
-	// we don't want to render HTML in the browser for security reasons.
-	contentType, _ := DetectContentType(p, w.filename)
-	if strings.HasPrefix(contentType, "text/html") {
-		contentType = strings.ReplaceAll(contentType, "text/html", "text/plain")
-	} else if contentType == "application/octet-stream" {
-		contentType = "" // Reset to let downstream http.ResponseWriter take care of it
-	}
-	if contentType != "" {
+	if contentType := DetectSafeContentType(p, w.filename); contentType != "" {
 		w.w.Header().Set("Content-Type", contentType)
 	}
 	w.sniffed = true
 	return w.w.Write(p)
 }
+
+// DetectSafeContentType detects the content type of the given bytes, and fixes content types that we don't want
+// to inline-render in the browser. In particular, we don't want to render HTML in the browser for security reasons,
+// so "text/html" is returned as "text/plain". If the detected type is "application/octet-stream", an empty
+// string is returned, so that a downstream http.ResponseWriter can take care of it.
+func DetectSafeContentType(p []byte, filename string) string {
+	contentType, _ := DetectContentType(p, filename)
+	if strings.HasPrefix(contentType, "text/html") {
+		return strings.ReplaceAll(contentType, "text/html", "text/plain")
+	} else if contentType == "application/octet-stream" {
+		return ""
+	}
+	return contentType
+}
@@ -0,0 +1,257 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	cronMacros = map[string]string{
+		"@hourly":   "0 * * * *",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@weekly":   "0 0 * * 0",
+		"@monthly":  "0 0 1 * *",
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+	}
+	cronMonthNames   = map[string]int{"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6, "JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12}
+	cronWeekdayNames = map[string]int{"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6}
+	rruleWeekdays    = map[string]int{"SU": 0, "MO": 1, "TU": 2, "WE": 3, "TH": 4, "FR": 5, "SA": 6}
+)
+
+const (
+	cronSearchYears = 5 // Upper bound when searching for the next occurrence, e.g. for "0 0 31 2 *" (never)
+)
+
+// Recurrence is a parsed recurrence rule, see ParseRecurrence. Occurrences are in whole minutes.
+type Recurrence struct {
+	spec               string
+	minutes            uint64
+	hours              uint64
+	days               uint64
+	months             uint64
+	weekdays           uint64
+	daysRestricted     bool
+	weekdaysRestricted bool
+}
+
+// ParseRecurrence parses a recurrence rule, which is either a standard 5-field cron expression
+// (minute, hour, day of month, month, day of week, e.g. "30 9 * * MON-FRI"), one of the macros
+// @hourly, @daily, @weekly, @monthly and @yearly, or a simple RFC 5545 RRULE (e.g. "FREQ=DAILY;BYHOUR=9").
+//
+// RRULEs are converted to a cron expression. Parts that are not defined in the RRULE are taken from the
+// given time (like the DTSTART), e.g. "FREQ=WEEKLY" recurs on the current day of week, at the current time.
+// Occurrences are in the time zone of the given time.
+func ParseRecurrence(s string, now time.Time) (*Recurrence, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(strings.ToUpper(s), "FREQ=") {
+		spec, err := rruleToCron(s, now)
+		if err != nil {
+			return nil, err
+		}
+		s = spec
+	} else if macro, ok := cronMacros[strings.ToLower(s)]; ok {
+		s = macro
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression must have 5 fields: minute, hour, day of month, month, day of week")
+	}
+	r := &Recurrence{
+		spec:               strings.Join(fields, " "),
+		daysRestricted:     !strings.HasPrefix(fields[2], "*"),
+		weekdaysRestricted: !strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	if r.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid minute field: %w", err)
+	} else if r.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid hour field: %w", err)
+	} else if r.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid day of month field: %w", err)
+	} else if r.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("invalid month field: %w", err)
+	} else if r.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdayNames); err != nil {
+		return nil, fmt.Errorf("invalid day of week field: %w", err)
+	}
+	if r.weekdays&(1<<7) != 0 {
+		r.weekdays |= 1 // 7 is Sunday as well
+	}
+	if r.Next(now).IsZero() {
+		return nil, errors.New("recurrence never occurs")
+	}
+	return r, nil
+}
+
+// Next returns the first occurrence strictly after the given time, or the zero time if there is
+// no occurrence within the next few years
+func (r *Recurrence) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, loc).Add(time.Minute)
+	end := t.AddDate(cronSearchYears, 0, 0)
+	for t.Before(end) {
+		if !hasBit(r.months, int(t.Month())) {
+			t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+		} else if !r.dayMatches(t) {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+		} else if !hasBit(r.hours, t.Hour()) {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute) // Not time.Date, the next hour may not exist (DST)
+		} else if !hasBit(r.minutes, t.Minute()) {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// forward returns next, or the next minute if next is not after t. time.Date may normalize a local time that
+// does not exist (e.g. midnight on a DST switch) to a time before t.
+func forward(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Minute)
+}
+
+// String returns the recurrence as cron expression. RRULEs and macros are returned in their converted form.
+func (r *Recurrence) String() string {
+	return r.spec
+}
+
+// dayMatches implements the cron semantics for the day fields: If both day of month and day of week
+// are restricted, a day matches if either field matches.
+func (r *Recurrence) dayMatches(t time.Time) bool {
+	day, weekday := hasBit(r.days, t.Day()), hasBit(r.weekdays, int(t.Weekday()))
+	if r.daysRestricted && r.weekdaysRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// parseCronField parses a comma-separated list of values, ranges ("1-5"), and steps ("*/15", "0-30/10")
+// into a bit set
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step '%s'", stepStr)
+			}
+		}
+		var from, to int
+		if rangeStr == "*" {
+			from, to = min, max
+		} else {
+			fromStr, toStr, isRange := strings.Cut(rangeStr, "-")
+			var err error
+			if from, err = parseCronValue(fromStr, min, max, names); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = parseCronValue(toStr, min, max, names); err != nil {
+					return 0, err
+				} else if to < from {
+					return 0, fmt.Errorf("invalid range '%s'", rangeStr)
+				}
+			} else if hasStep {
+				to = max // "5/10" is "5-max/10"
+			}
+		}
+		for i := from; i <= to; i += step {
+			bits |= 1 << i
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, min, max int, names map[string]int) (int, error) {
+	if value, ok := names[strings.ToUpper(s)]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(s)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("value '%s' out of range %d-%d", s, min, max)
+	}
+	return value, nil
+}
+
+// rruleToCron converts a simple RRULE to a cron expression. FREQ may be HOURLY, DAILY, WEEKLY, MONTHLY or YEARLY,
+// and BYMINUTE, BYHOUR, BYDAY, BYMONTHDAY and BYMONTH are supported. INTERVAL (other than 1), COUNT and UNTIL
+// cannot be expressed as cron expression, and are rejected.
+func rruleToCron(s string, now time.Time) (string, error) {
+	if len(s) > 6 && strings.EqualFold(s[:6], "RRULE:") {
+		s = s[6:]
+	}
+	parts := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return "", fmt.Errorf("invalid RRULE part '%s'", part)
+		}
+		parts[strings.ToUpper(key)] = strings.ToUpper(value)
+	}
+	minute, hour := strconv.Itoa(now.Minute()), strconv.Itoa(now.Hour())
+	day, month, weekday := strconv.Itoa(now.Day()), strconv.Itoa(int(now.Month())), strconv.Itoa(int(now.Weekday()))
+	var fields [5]string
+	switch parts["FREQ"] {
+	case "HOURLY":
+		fields = [5]string{minute, "*", "*", "*", "*"}
+	case "DAILY":
+		fields = [5]string{minute, hour, "*", "*", "*"}
+	case "WEEKLY":
+		fields = [5]string{minute, hour, "*", "*", weekday}
+	case "MONTHLY":
+		fields = [5]string{minute, hour, day, "*", "*"}
+	case "YEARLY":
+		fields = [5]string{minute, hour, day, month, "*"}
+	default:
+		return "", fmt.Errorf("unsupported RRULE frequency '%s'", parts["FREQ"])
+	}
+	for key, value := range parts {
+		switch key {
+		case "FREQ", "WKST":
+			// Already handled, or irrelevant
+		case "INTERVAL":
+			if value != "1" {
+				return "", errors.New("RRULE INTERVAL is not supported")
+			}
+		case "BYMINUTE":
+			fields[0] = value
+		case "BYHOUR":
+			fields[1] = value
+		case "BYMONTHDAY":
+			fields[2] = value
+		case "BYMONTH":
+			fields[3] = value
+		case "BYDAY":
+			weekdays := make([]string, 0)
+			for _, d := range strings.Split(value, ",") {
+				w, ok := rruleWeekdays[d]
+				if !ok {
+					return "", fmt.Errorf("unsupported RRULE day '%s'", d)
+				}
+				weekdays = append(weekdays, strconv.Itoa(w))
+			}
+			fields[4] = strings.Join(weekdays, ",")
+			if parts["BYMONTHDAY"] == "" {
+				fields[2] = "*" // Otherwise MONTHLY;BYDAY=MO would recur on the current day of month as well
+			}
+		default:
+			return "", fmt.Errorf("unsupported RRULE part '%s'", key)
+		}
+	}
+	return strings.Join(fields[:], " "), nil
+}
+
+func hasBit(bits uint64, i int) bool {
+	return bits&(1<<i) != 0
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence_Cron(t *testing.T) {
+	r, err := ParseRecurrence("30 9 * * MON-FRI", base) // base is Friday, 10:17
+	require.Nil(t, err)
+	require.Equal(t, "30 9 * * MON-FRI", r.String())
+	next := r.Next(base)
+	require.Equal(t, time.Date(2021, 12, 13, 9, 30, 0, 0, time.UTC), next) // Monday
+	require.Equal(t, time.Date(2021, 12, 14, 9, 30, 0, 0, time.UTC), r.Next(next))
+
+	r, err = ParseRecurrence("*/15 * * * *", base)
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2021, 12, 10, 10, 30, 0, 0, time.UTC), r.Next(base))
+
+	r, err = ParseRecurrence("0 0,12 1 jan,jul *", base)
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), r.Next(base))
+	require.Equal(t, time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC), r.Next(r.Next(base)))
+
+	r, err = ParseRecurrence("@daily", base)
+	require.Nil(t, err)
+	require.Equal(t, "0 0 * * *", r.String())
+	require.Equal(t, time.Date(2021, 12, 11, 0, 0, 0, 0, time.UTC), r.Next(base))
+
+	r, err = ParseRecurrence("0 8 * * 7", base) // 7 is Sunday
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2021, 12, 12, 8, 0, 0, 0, time.UTC), r.Next(base))
+}
+
+func TestParseRecurrence_CronDayOfMonthOrDayOfWeek(t *testing.T) {
+	// If both day fields are restricted, either may match
+	r, err := ParseRecurrence("0 9 15 * MON", base)
+	require.Nil(t, err)
+	next := r.Next(base)
+	require.Equal(t, time.Date(2021, 12, 13, 9, 0, 0, 0, time.UTC), next) // Monday
+	require.Equal(t, time.Date(2021, 12, 15, 9, 0, 0, 0, time.UTC), r.Next(next))
+}
+
+func TestParseRecurrence_CronInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "x * * * *"} {
+		_, err := ParseRecurrence(spec, base)
+		require.Error(t, err, spec)
+	}
+	_, err := ParseRecurrence("0 0 31 2 *", base)
+	require.EqualError(t, err, "recurrence never occurs")
+}
+
+func TestParseRecurrence_RRULE(t *testing.T) {
+	r, err := ParseRecurrence("RRULE:FREQ=DAILY;BYHOUR=9;BYMINUTE=30", base)
+	require.Nil(t, err)
+	require.Equal(t, "30 9 * * *", r.String())
+	require.Equal(t, time.Date(2021, 12, 11, 9, 30, 0, 0, time.UTC), r.Next(base))
+
+	r, err = ParseRecurrence("FREQ=WEEKLY;BYDAY=MO,WE;BYHOUR=8;BYMINUTE=0", base)
+	require.Nil(t, err)
+	require.Equal(t, "0 8 * * 1,3", r.String())
+	require.Equal(t, time.Date(2021, 12, 13, 8, 0, 0, 0, time.UTC), r.Next(base))
+
+	// Undefined parts are taken from the base time (Friday, 10:17)
+	r, err = ParseRecurrence("freq=weekly", base)
+	require.Nil(t, err)
+	require.Equal(t, "17 10 * * 5", r.String())
+	require.Equal(t, time.Date(2021, 12, 17, 10, 17, 0, 0, time.UTC), r.Next(base))
+
+	r, err = ParseRecurrence("FREQ=MONTHLY;BYMONTHDAY=1;BYHOUR=0;BYMINUTE=0", base)
+	require.Nil(t, err)
+	require.Equal(t, "0 0 1 * *", r.String())
+
+	for _, spec := range []string{"FREQ=SECONDLY", "FREQ=DAILY;INTERVAL=2", "FREQ=DAILY;COUNT=3", "FREQ=WEEKLY;BYDAY=1MO", "FREQ=DAILY;BYHOUR", "FREQ=DAILY;BYHOUR=25"} {
+		_, err := ParseRecurrence(spec, base)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestRecurrence_NextInTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.Nil(t, err)
+	now := time.Date(2023, time.March, 11, 10, 0, 0, 0, loc) // Day before DST starts
+	r, err := ParseRecurrence("0 9 * * *", now)
+	require.Nil(t, err)
+	next := r.Next(now)
+	require.Equal(t, time.Date(2023, time.March, 12, 9, 0, 0, 0, loc), next)
+	require.Equal(t, 22*time.Hour, next.Sub(now)) // Clocks are set forward by one hour
+}
+
+func TestRecurrence_NextSkipsNonExistentTime(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.Nil(t, err)
+	now := time.Date(2023, time.March, 11, 10, 0, 0, 0, loc)
+	r, err := ParseRecurrence("30 2 * * *", now) // 2:30am does not exist on March 12
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2023, time.March, 13, 2, 30, 0, 0, loc), r.Next(now))
+}
@@ -67,6 +67,13 @@ func (l *FixedLimiter) AllowN(n int64) bool {
 	return true
 }
 
+// Peek returns true if Allow would succeed, but does not add to the limiter's internal value
+func (l *FixedLimiter) Peek() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.value+1 <= l.limit
+}
+
 // Value returns the current limiter value
 func (l *FixedLimiter) Value() int64 {
 	l.mu.Lock()
@@ -137,6 +144,13 @@ func (l *RateLimiter) AllowN(n int64) bool {
 	return true
 }
 
+// Peek returns true if Allow would succeed, but does not consume a token or add to the limiter's internal value
+func (l *RateLimiter) Peek() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limiter.Tokens() >= 1
+}
+
 // Value returns the current limiter value
 func (l *RateLimiter) Value() int64 {
 	l.mu.Lock()
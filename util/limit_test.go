@@ -3,6 +3,7 @@ package util
 import (
 	"bytes"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 	"testing"
 	"time"
 )
@@ -37,6 +38,24 @@ func TestFixedLimiter_AddSub(t *testing.T) {
 	}
 }
 
+func TestFixedLimiter_Peek(t *testing.T) {
+	l := NewFixedLimiter(2)
+	require.True(t, l.Peek())
+	require.True(t, l.Peek())
+	require.Equal(t, int64(0), l.Value())
+	require.True(t, l.AllowN(2))
+	require.False(t, l.Peek())
+}
+
+func TestRateLimiter_Peek(t *testing.T) {
+	l := NewRateLimiter(rate.Every(time.Hour), 2)
+	require.True(t, l.Peek())
+	require.True(t, l.Peek())
+	require.Equal(t, int64(0), l.Value())
+	require.True(t, l.AllowN(2))
+	require.False(t, l.Peek())
+}
+
 func TestBytesLimiter_Add_Simple(t *testing.T) {
 	l := NewBytesLimiter(250*1024*1024, 24*time.Hour) // 250 MB per 24h
 	require.True(t, l.AllowN(100*1024*1024))
@@ -0,0 +1,205 @@
+package util
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+const (
+	markdownSanitizeMaxPasses = 5 // Max. number of HTML sanitizer runs until the Markdown no longer changes
+)
+
+var (
+	markdownURLAutolinkRegex   = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9+.-]*:[^\s<>()\[\]]*)>`) // Autolinks, e.g. <https://ntfy.sh>
+	markdownEmailAutolinkRegex = regexp.MustCompile(`<([^\s<>@"'()\[\]]+@[^\s<>@"'()\[\]]+)>`)    // Email autolinks, e.g. <phil@example.com>
+	markdownLinkRegex          = regexp.MustCompile(`(\]\(\s*<?)((?:[^\s()<>]|\([^\s()<>]*\))+)`) // Inline links and images, e.g. [text](url)
+	markdownLinkDefRegex       = regexp.MustCompile(`(?m)^( {0,3}\[[^\]]+\]:\s*<?)([^\s>]+)`)     // Link reference definitions, e.g. [id]: url
+	markdownURLNoiseRegex      = regexp.MustCompile(`[\x00-\x20]+`)                               // Ignored by browsers in URL schemes, e.g. "java\tscript:"
+	markdownUnsafeURL          = regexp.MustCompile(`(?i)^(javascript|vbscript|data):`)           // URL schemes that can execute code
+
+	// markdownAttrValueRegex restricts attribute values, so that a Markdown renderer cannot parse them differently than
+	// the HTML sanitizer, e.g. "<a title='`'>" followed by "<img onerror=...>`" in a code span
+	markdownAttrValueRegex = regexp.MustCompile("^[^<>\"'`]*$")
+
+	// markdownAllowedTags are the HTML tags that are kept by the "safe" policy, unless they are disallowed
+	markdownAllowedTags = []string{
+		"a", "abbr", "b", "blockquote", "br", "code", "dd", "del", "details", "div", "dl", "dt", "em", "h1", "h2",
+		"h3", "h4", "h5", "h6", "hr", "i", "img", "ins", "kbd", "li", "mark", "ol", "p", "pre", "q", "s", "samp",
+		"small", "span", "strike", "strong", "sub", "summary", "sup", "table", "tbody", "td", "tfoot", "th", "thead",
+		"tr", "u", "ul",
+	}
+)
+
+// MarkdownSanitizer removes potentially dangerous HTML from Markdown, so that it can be rendered safely. The HTML is
+// sanitized with bluemonday, and Markdown links with unsafe URLs are replaced with "#".
+//
+// Since bluemonday escapes text (e.g. ">" as "&gt;"), which would break the Markdown syntax, the sanitized output is
+// unescaped and sanitized again, until it no longer changes. Autolinks (e.g. <https://ntfy.sh>) look like HTML tags,
+// so they are converted to inline links (e.g. [https://ntfy.sh](https://ntfy.sh)) first.
+type MarkdownSanitizer struct {
+	policy *bluemonday.Policy
+}
+
+// NewMarkdownSanitizer creates a new MarkdownSanitizer. If stripAllTags is true, all HTML tags are removed. Otherwise,
+// common formatting tags (see markdownAllowedTags) that are not in disallowedTags are kept, with a few harmless
+// attributes (title, href, src, alt) and http(s) and mailto URLs only. All other tags and attributes are removed.
+func NewMarkdownSanitizer(stripAllTags bool, disallowedTags []string) *MarkdownSanitizer {
+	if stripAllTags {
+		return &MarkdownSanitizer{policy: bluemonday.StrictPolicy()}
+	}
+	disallowed := make(map[string]bool)
+	for _, tag := range disallowedTags {
+		disallowed[strings.ToLower(tag)] = true
+	}
+	allowed := make([]string, 0, len(markdownAllowedTags))
+	for _, tag := range markdownAllowedTags {
+		if !disallowed[tag] {
+			allowed = append(allowed, tag)
+		}
+	}
+	policy := bluemonday.NewPolicy()
+	policy.AllowStandardURLs()
+	policy.AllowElements(allowed...)
+	policy.AllowAttrs("title").Matching(markdownAttrValueRegex).Globally()
+	if !disallowed["a"] {
+		policy.AllowAttrs("href").Matching(markdownAttrValueRegex).OnElements("a")
+	}
+	if !disallowed["img"] {
+		policy.AllowAttrs("src", "alt").Matching(markdownAttrValueRegex).OnElements("img")
+	}
+	return &MarkdownSanitizer{policy: policy}
+}
+
+// Sanitize returns the sanitized Markdown. Links with unsafe URLs are replaced with "#".
+func (s *MarkdownSanitizer) Sanitize(markdown string) string {
+	markdown = markdownURLAutolinkRegex.ReplaceAllStringFunc(markdown, func(link string) string {
+		u := link[1 : len(link)-1]
+		if isUnsafeURL(u) {
+			return ""
+		}
+		return "[" + u + "](" + u + ")"
+	})
+	markdown = markdownEmailAutolinkRegex.ReplaceAllString(markdown, "[$1](mailto:$1)")
+	markdown = s.sanitizeHTML(markdown)
+	markdown = markdownLinkRegex.ReplaceAllStringFunc(markdown, func(link string) string {
+		return sanitizeMarkdownLink(markdownLinkRegex, link)
+	})
+	return markdownLinkDefRegex.ReplaceAllStringFunc(markdown, func(link string) string {
+		return sanitizeMarkdownLink(markdownLinkDefRegex, link)
+	})
+}
+
+// sanitizeHTML runs the HTML sanitizer and unescapes its output until it no longer changes. Unescaping may turn
+// escaped text into HTML again (e.g. "&lt;script&gt;"), which is why the result has to be sanitized again. If the
+// Markdown does not settle within markdownSanitizeMaxPasses, the escaped output is returned.
+func (s *MarkdownSanitizer) sanitizeHTML(markdown string) string {
+	for i := 0; i < markdownSanitizeMaxPasses; i++ {
+		sanitized := html.UnescapeString(s.policy.Sanitize(markdown))
+		if sanitized == markdown {
+			return markdown
+		}
+		markdown = sanitized
+	}
+	return s.policy.Sanitize(markdown)
+}
+
+func sanitizeMarkdownLink(re *regexp.Regexp, link string) string {
+	matches := re.FindStringSubmatch(link)
+	if isUnsafeURL(matches[2]) {
+		return matches[1] + "#"
+	}
+	return link
+}
+
+// isUnsafeURL returns true if the URL uses a scheme that can execute code. HTML entities and whitespace are
+// removed first, since browsers ignore them as well (e.g. "java&#x73;cript:" or "java\tscript:").
+func isUnsafeURL(u string) bool {
+	return markdownUnsafeURL.MatchString(markdownURLNoiseRegex.ReplaceAllString(html.UnescapeString(u), ""))
+}
+
+const (
+	markdownTextMaxLength     = 64 * 1024 // Longer Markdown is returned as is by MarkdownToText, to bound the conversion time
+	markdownEscapedRuneOffset = 0xE000    // Unicode private use area, used as placeholder for escaped ASCII characters
+)
+
+var (
+	markdownFenceRegex        = regexp.MustCompile("^ {0,3}(```|~~~)")
+	markdownHeadingRegex      = regexp.MustCompile(`^ {0,3}#{1,6}(?:\s+|$)(.*?)(?:\s+#+)?\s*$`)
+	markdownQuoteRegex        = regexp.MustCompile(`^ {0,3}(?:>\s?)+`)
+	markdownRuleRegex         = regexp.MustCompile(`^ {0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	markdownBulletRegex       = regexp.MustCompile(`^(\s*)[*+]\s+`)
+	markdownImageRegex        = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownInlineLinkRegex   = regexp.MustCompile(`\[([^\]]+)\]\(\s*<?([^\s)>]+)>?(?:\s+"[^"]*")?\s*\)`)
+	markdownRefLinkRegex      = regexp.MustCompile(`\[([^\]]+)\]\[[^\]]*\]`)
+	markdownAutolinkRegex     = regexp.MustCompile(`<((?:[a-zA-Z][a-zA-Z0-9+.-]*:|[^\s<>@]+@)[^\s<>]*)>`)
+	markdownCodeSpanRegex     = regexp.MustCompile("`+([^`]+)`+")
+	markdownStrongStarRegex   = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*`)
+	markdownStrongUndRegex    = regexp.MustCompile(`__(\S(?:.*?\S)?)__`)
+	markdownEmphasisStarRegex = regexp.MustCompile(`\*(\S(?:[^*]*?\S)?)\*`)
+	markdownEmphasisUndRegex  = regexp.MustCompile(`(^|[^\w])_(\S(?:[^_]*?\S)?)_([^\w]|$)`)
+	markdownStrikeRegex       = regexp.MustCompile(`~~(\S(?:.*?\S)?)~~`)
+	markdownEscapeRegex       = regexp.MustCompile("\\\\([!-/:-@\\[-`{-~])")
+	markdownTagRegex          = regexp.MustCompile(`<!--.*?-->|</?[a-zA-Z][a-zA-Z0-9-]*(?:\s+[a-zA-Z_:][a-zA-Z0-9_.:-]*(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*\s*/?>`)
+)
+
+// MarkdownToText converts Markdown to plain text, for clients that cannot render Markdown. It removes the formatting
+// (emphasis, headings, quotes, code fences, HTML tags, ...), and keeps the text, list items and link URLs. This is
+// not a full Markdown parser: It works line by line with linear-time regular expressions, and returns Markdown longer
+// than markdownTextMaxLength as is.
+func MarkdownToText(markdown string) string {
+	if len(markdown) > markdownTextMaxLength {
+		return markdown
+	}
+	lines := strings.Split(markdown, "\n")
+	text := make([]string, 0, len(lines))
+	var fenced bool
+	for _, line := range lines {
+		if markdownFenceRegex.MatchString(line) {
+			fenced = !fenced
+			continue
+		} else if fenced {
+			text = append(text, line) // Code is kept as is
+			continue
+		} else if markdownRuleRegex.MatchString(line) {
+			text = append(text, "")
+			continue
+		}
+		line = markdownQuoteRegex.ReplaceAllString(line, "")
+		line = markdownHeadingRegex.ReplaceAllString(line, "$1")
+		line = markdownBulletRegex.ReplaceAllString(line, "$1- ")
+		text = append(text, markdownInlineToText(line))
+	}
+	return strings.Join(text, "\n")
+}
+
+func markdownInlineToText(line string) string {
+	line = markdownEscapeRegex.ReplaceAllStringFunc(line, func(escaped string) string {
+		return string(markdownEscapedRuneOffset + rune(escaped[1])) // Hide escaped characters from the other rules
+	})
+	line = markdownTagRegex.ReplaceAllString(line, "")
+	line = markdownImageRegex.ReplaceAllString(line, "$1")
+	line = markdownInlineLinkRegex.ReplaceAllStringFunc(line, func(link string) string {
+		matches := markdownInlineLinkRegex.FindStringSubmatch(link)
+		if matches[1] == matches[2] {
+			return matches[2]
+		}
+		return matches[1] + " (" + matches[2] + ")"
+	})
+	line = markdownRefLinkRegex.ReplaceAllString(line, "$1")
+	line = markdownAutolinkRegex.ReplaceAllString(line, "$1")
+	line = markdownCodeSpanRegex.ReplaceAllString(line, "$1")
+	line = markdownStrongStarRegex.ReplaceAllString(line, "$1")
+	line = markdownStrongUndRegex.ReplaceAllString(line, "$1")
+	line = markdownEmphasisStarRegex.ReplaceAllString(line, "$1")
+	line = markdownEmphasisUndRegex.ReplaceAllString(line, "$1$2$3")
+	line = markdownStrikeRegex.ReplaceAllString(line, "$1")
+	return strings.Map(func(r rune) rune {
+		if r >= markdownEscapedRuneOffset && r < markdownEscapedRuneOffset+128 {
+			return r - markdownEscapedRuneOffset
+		}
+		return r
+	}, line)
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMarkdownDisallowedTags = []string{"script", "style", "iframe", "object", "embed", "form"}
+
+func TestMarkdownSanitizer_DangerousHTMLIsStripped(t *testing.T) {
+	s := NewMarkdownSanitizer(false, testMarkdownDisallowedTags)
+	require.Equal(t, "Hello !", s.Sanitize("Hello <script>alert(document.cookie)</script>!"))
+	require.Equal(t, "Hello ", s.Sanitize("Hello <SCRIPT type=\"text/javascript\">alert(1)"))
+	require.Equal(t, "Video: ", s.Sanitize(`Video: <iframe src="https://evil.example.com"></iframe>`))
+	require.Equal(t, `<img src="cat.png">`, s.Sanitize(`<img src="cat.png" onerror="alert(1)">`))
+	require.Equal(t, `<a title="click">me</a>`, s.Sanitize(`<a href="javascript:alert(1)" title="click" onClick='alert(2)'>me</a>`))
+	require.Equal(t, `me`, s.Sanitize(`<a href="java&#x73;cript:alert(1)">me</a>`))
+	require.Equal(t, `me`, s.Sanitize("<a href=\" java\tscript:alert(1)\">me</a>"))
+	require.Equal(t, `<br/>`, s.Sanitize(`<br onmouseover=alert(1) />`))
+	require.Equal(t, "a  b", s.Sanitize("a <!-- <script>alert(1)</script> --> b"))
+	require.Equal(t, "ipt>alert(1)", s.Sanitize("<scr<script>ipt>alert(1)</script>"))
+	require.Equal(t, "Hi there", s.Sanitize("Hi <marquee>there</marquee><video src=x></video>"))
+}
+
+func TestMarkdownSanitizer_Bypasses(t *testing.T) {
+	safe := NewMarkdownSanitizer(false, testMarkdownDisallowedTags)
+	strict := NewMarkdownSanitizer(true, nil)
+	for _, markdown := range []string{
+		"<img src=x onerror=alert(1) title=a<b>",
+		"&lt;img src=x onerror=alert(1)&gt;",
+		"&amp;lt;img src=x onerror=alert(1)&amp;gt;",
+		"<title><img src=x onerror=alert(1)></title>",
+		"<a title=\"x&#34; onclick=&#34;alert(1)\">me</a>",
+		"`<a title=\"`\">` <img src=x onerror=alert(1)>`\">`",
+	} {
+		require.NotContains(t, strings.ToLower(safe.Sanitize(markdown)), "on", markdown)
+		require.NotContains(t, strict.Sanitize(markdown), "<", markdown)
+	}
+	require.Equal(t, `<img src="x">`, safe.Sanitize("<img src=x onerror=alert(1) title=a<b>"))
+	require.Equal(t, "", strict.Sanitize("<img src=x onerror=alert(1) title=a<b>"))
+}
+
+func TestMarkdownSanitizer_UnsafeMarkdownLinks(t *testing.T) {
+	s := NewMarkdownSanitizer(false, testMarkdownDisallowedTags)
+	require.Equal(t, "[click](#)", s.Sanitize("[click](javascript:alert(1))"))
+	require.Equal(t, "[click](#)", s.Sanitize("[click](java&#x73;cript:alert(1))"))
+	require.Equal(t, "![img](#)", s.Sanitize("![img](data:text/html;base64,PHNjcmlwdD4=)"))
+	require.Equal(t, "[click]()", s.Sanitize("[click](<JavaScript:alert(1)>)"))
+	require.Equal(t, "[id]: #", s.Sanitize("[id]: vbscript:msgbox(1)"))
+	require.Equal(t, "Go ", s.Sanitize("Go <javascript:alert(1)>"))
+}
+
+func TestMarkdownSanitizer_SafeMarkdownIsPreserved(t *testing.T) {
+	s := NewMarkdownSanitizer(false, testMarkdownDisallowedTags)
+	for _, markdown := range []string{
+		"# Backup report\n\n> All **5** jobs succeeded & took < 2 minutes\n\n- [x] `db`\n- [ ] files",
+		"See [the docs](https://ntfy.sh/docs/?a=1&b=2 \"Docs\") or [ntfy](https://ntfy.sh)",
+		"![logo](https://ntfy.sh/logo.png)\n\n[docs]: https://ntfy.sh/docs",
+		"Some <b>bold</b>, <i>italic</i> and <code>HTML</code><br/>",
+		"```\nif a < b && c > d { return }\n```",
+	} {
+		require.Equal(t, markdown, s.Sanitize(markdown))
+	}
+}
+
+func TestMarkdownSanitizer_HTMLIsNormalized(t *testing.T) {
+	s := NewMarkdownSanitizer(false, testMarkdownDisallowedTags)
+	require.Equal(t, `<a href="https://ntfy.sh" title="ntfy" rel="nofollow">HTML</a>`, s.Sanitize(`<a href="https://ntfy.sh" title='ntfy'>HTML</a>`))
+	require.Equal(t, "```html\n<p>code</p>\n```", s.Sanitize("```html\n<p class=\"x\">code</p>\n```"))
+	require.Equal(t, "if a<b>d { return }", s.Sanitize("if a<b && c>d { return }"))
+	require.Equal(t, "See [https://ntfy.sh](https://ntfy.sh) or [phil@example.com](mailto:phil@example.com)", s.Sanitize("See <https://ntfy.sh> or <phil@example.com>"))
+}
+
+func TestMarkdownSanitizer_StripAllTags(t *testing.T) {
+	s := NewMarkdownSanitizer(true, nil)
+	require.Equal(t, "Some bold and HTML", s.Sanitize(`Some <b>bold</b> and <a href="https://ntfy.sh">HTML</a>`))
+	require.Equal(t, "Hi ", s.Sanitize("Hi <style>body { display: none }</style>"))
+	require.Equal(t, "**Markdown** > [link](https://ntfy.sh) [https://ntfy.sh](https://ntfy.sh)", s.Sanitize("**Markdown** > [link](https://ntfy.sh) <https://ntfy.sh>"))
+}
+
+func TestMarkdownToText(t *testing.T) {
+	markdown := `# Backup report #
+
+> All **5** jobs __succeeded__, *one* was _slow_ ~~and failed~~
+
+* [x] ` + "`db`" + `
++ [ ] files
+
+---
+See [the docs](https://ntfy.sh/docs "Docs"), [ref link][docs], <https://ntfy.sh> and ![logo](https://ntfy.sh/logo.png)
+Some <b>bold</b> HTML<br/>, snake_case_name, 2 * 3 * 4, a<b && c>d and \*escaped\*
+` + "```html\n<p>**code**</p>\n```"
+	expected := `Backup report
+
+All 5 jobs succeeded, one was slow and failed
+
+- [x] db
+- [ ] files
+
+
+See the docs (https://ntfy.sh/docs), ref link, https://ntfy.sh and logo
+Some bold HTML, snake_case_name, 2 * 3 * 4, a<b && c>d and *escaped*
+<p>**code**</p>`
+	require.Equal(t, expected, MarkdownToText(markdown))
+}
+
+func TestMarkdownToText_Links(t *testing.T) {
+	require.Equal(t, "https://ntfy.sh", MarkdownToText("[https://ntfy.sh](https://ntfy.sh)"))
+	require.Equal(t, "ntfy (https://ntfy.sh)", MarkdownToText("[**ntfy**](<https://ntfy.sh>)"))
+	require.Equal(t, "Mail phil@example.com", MarkdownToText("Mail <phil@example.com>"))
+}
+
+func TestMarkdownToText_TooLong(t *testing.T) {
+	markdown := strings.Repeat("**a** ", markdownTextMaxLength/6+1)
+	require.Equal(t, markdown, MarkdownToText(markdown))
+}
+
+func TestMarkdownToText_PathologicalInput(t *testing.T) {
+	start := time.Now()
+	MarkdownToText(strings.Repeat("*_[`<a ~~", markdownTextMaxLength/9))
+	MarkdownToText(strings.Repeat("[", markdownTextMaxLength) + strings.Repeat("]", 10))
+	require.Less(t, time.Since(start), 5*time.Second)
+}
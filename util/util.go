@@ -34,6 +34,7 @@ var (
 	sizeStrRegex       = regexp.MustCompile(`(?i)^(\d+)([gmkb])?$`)
 	errInvalidPriority = errors.New("invalid priority")
 	noQuotesRegex      = regexp.MustCompile(`^[-_./:@a-zA-Z0-9]+$`)
+	ansiEscapeRegex    = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[0-~])`) // CSI, OSC, and two-character sequences
 )
 
 // Errors for UnmarshalJSON and UnmarshalJSONWithLimit functions
@@ -122,6 +123,14 @@ func RandomLowerStringPrefix(prefix string, length int) string {
 	return randomStringPrefixWithCharset(prefix, length, randomStringLowerCaseCharset)
 }
 
+// Jitter returns a random duration within ±fraction of d, e.g. Jitter(10*time.Second, 0.1) returns a
+// duration between 9s and 11s. This is useful to keep many timers from firing at the same time.
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return d + time.Duration((random.Float64()*2-1)*fraction*float64(d))
+}
+
 func randomStringPrefixWithCharset(prefix string, length int, charset string) string {
 	randomMutex.Lock() // Who would have thought that random.Intn() is not thread-safe?!
 	defer randomMutex.Unlock()
@@ -341,6 +350,14 @@ func QuoteCommand(command []string) string {
 	return strings.Join(quoted, " ")
 }
 
+// StripANSI removes ANSI escape sequences (e.g. terminal colors, cursor movement or window titles) from a string
+func StripANSI(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return s
+	}
+	return ansiEscapeRegex.ReplaceAllString(s, "")
+}
+
 // UnmarshalJSON reads the given io.ReadCloser into a struct
 func UnmarshalJSON[T any](body io.ReadCloser) (*T, error) {
 	var obj T
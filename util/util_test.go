@@ -178,6 +178,25 @@ func TestQuoteCommand(t *testing.T) {
 	require.Equal(t, `/home/sweet/home "Äöü this is a test" "\a\b"`, QuoteCommand([]string{"/home/sweet/home", "Äöü this is a test", "\\a\\b"}))
 }
 
+func TestJitter(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		d := Jitter(10*time.Second, 0.1)
+		require.GreaterOrEqual(t, d, 9*time.Second)
+		require.LessOrEqual(t, d, 11*time.Second)
+	}
+	require.Equal(t, 10*time.Second, Jitter(10*time.Second, 0))
+}
+
+func TestStripANSI(t *testing.T) {
+	require.Equal(t, "ERROR: disk full", StripANSI("\x1b[1;31mERROR:\x1b[0m disk full"))
+	require.Equal(t, "100% done", StripANSI("\x1b[2K\x1b[1G100% done"))
+	require.Equal(t, "build ok", StripANSI("\x1b]0;my title\x07build ok"))
+	require.Equal(t, "link", StripANSI("\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\"))
+	require.Equal(t, "saved", StripANSI("\x1b7saved\x1b8"))
+	require.Equal(t, "no escapes [0m here", StripANSI("no escapes [0m here"))
+	require.Equal(t, "Äöü 🎉", StripANSI("Äöü \x1b[32m🎉\x1b[m"))
+}
+
 func TestBasicAuth(t *testing.T) {
 	require.Equal(t, "Basic cGhpbDpwaGls", BasicAuth("phil", "phil"))
 }
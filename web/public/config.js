@@ -17,5 +17,6 @@ var config = {
   enable_web_push: true,
   billing_contact: "",
   web_push_public_key: "",
+  enable_emoji_tags: true,
   disallowed_topics: ["docs", "static", "file", "app", "account", "settings", "signup", "login", "v1"],
 };
@@ -3,8 +3,12 @@
 
 import emojisMapped from "./emojisMapped";
 
+// The server config is a global in both the window and the service worker (if loaded), see `config.js`.
+// If the server disables emoji tags, tags are shown verbatim.
+const emojiTagsEnabled = () => self.config?.enable_emoji_tags !== false; // eslint-disable-line no-restricted-globals
+
 const toEmojis = (tags) => {
-  if (!tags) return [];
+  if (!tags || !emojiTagsEnabled()) return [];
   return tags.filter((tag) => tag in emojisMapped).map((tag) => emojisMapped[tag]);
 };
 
@@ -57,6 +57,7 @@ export const topicDisplayName = (subscription) => {
 
 export const unmatchedTags = (tags) => {
   if (!tags) return [];
+  if (config.enable_emoji_tags === false) return tags;
   return tags.filter((tag) => !(tag in emojisMapped));
 };
 
@@ -877,9 +877,16 @@ const TokensTable = (props) => {
               <div style={{ display: "flex", alignItems: "center" }}>
                 <span>{formatShortDateTime(token.last_access, i18n.language)}</span>
                 <Tooltip
-                  title={t("account_tokens_table_last_origin_tooltip", {
-                    ip: token.last_origin,
-                  })}
+                  title={
+                    token.last_user_agent
+                      ? t("account_tokens_table_last_origin_user_agent_tooltip", {
+                          ip: token.last_origin,
+                          userAgent: token.last_user_agent,
+                        })
+                      : t("account_tokens_table_last_origin_tooltip", {
+                          ip: token.last_origin,
+                        })
+                  }
                 >
                   <IconButton onClick={() => openUrl(`https://whatismyipaddress.com/ip/${token.last_origin}`)}>
                     <Public />